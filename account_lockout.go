@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	accountLockoutKeyPrefix = "nginx-sso:account-lockout:"
+
+	defaultAccountLockoutDuration    = time.Minute
+	defaultAccountLockoutMaxDuration = time.Hour
+	defaultAccountLockoutResetAfter  = 24 * time.Hour
+)
+
+var (
+	accountLockoutStores     = map[string]accountLockoutStore{}
+	accountLockoutStoresLock sync.Mutex
+)
+
+// accountLockoutConfig locks accounts after max_failures failed logins.
+// Every further failure locks the account again for twice the previous
+// duration until a login succeeds or no failure happened within
+// reset_after.
+type accountLockoutConfig struct {
+	MaxFailures int           `yaml:"max_failures"`
+	Duration    time.Duration `yaml:"duration"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+	ResetAfter  time.Duration `yaml:"reset_after"`
+	Store       string        `yaml:"store"`
+}
+
+// accountLockoutState is kept for every account with failed logins
+type accountLockoutState struct {
+	Failures    int       `json:"failures"`
+	Lockouts    int       `json:"lockouts"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+func (a accountLockoutConfig) Validate() error {
+	if a.MaxFailures == 0 {
+		return nil
+	}
+
+	switch {
+	case a.MaxFailures < 0:
+		return errors.New("Max failures must not be negative")
+	case a.Duration <= 0:
+		return errors.New("Duration must be set")
+	case a.MaxDuration < a.Duration:
+		return errors.New("Max duration must not be shorter than duration")
+	case a.ResetAfter <= 0:
+		return errors.New("Reset after must be set")
+	}
+
+	if a.Store == "" || a.Store == "memory" {
+		return nil
+	}
+
+	_, err := parseRedisURI(a.Store)
+	return err
+}
+
+func (a accountLockoutConfig) enabled(user string) bool {
+	return a.MaxFailures > 0 && user != ""
+}
+
+// Locked returns the remaining time the account of the user is locked
+// or zero if it is not locked. If the store is not available the
+// account is treated as not locked.
+func (a accountLockoutConfig) Locked(r *http.Request, user string) time.Duration {
+	if !a.enabled(user) {
+		return 0
+	}
+
+	state, err := a.state(user)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to read account lockout")
+		return 0
+	}
+
+	if remaining := time.Until(state.LockedUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// RecordFailure counts the failed login and locks the account if the
+// user reached the maximum number of failures
+func (a accountLockoutConfig) RecordFailure(r *http.Request, user string) {
+	if !a.enabled(user) {
+		return
+	}
+
+	store, err := getAccountLockoutStore(getMainConfig().Cluster.storeFor(a.Store))
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to access account lockout store")
+		return
+	}
+
+	key := normalizeLockoutUser(user)
+	state, err := store.Get(key)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to read account lockout")
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(state.LastFailure) > a.ResetAfter {
+		state = accountLockoutState{}
+	}
+	state.Failures++
+	state.LastFailure = now
+
+	var lockout time.Duration
+	if state.Failures >= a.MaxFailures {
+		lockout = a.Duration
+		for i := 0; i < state.Lockouts && lockout < a.MaxDuration; i++ {
+			lockout *= 2
+		}
+		if lockout > a.MaxDuration {
+			lockout = a.MaxDuration
+		}
+
+		state.Lockouts++
+		state.LockedUntil = now.Add(lockout)
+	}
+
+	if err := store.Set(key, state, lockout+a.ResetAfter); err != nil {
+		requestLog(r).WithError(err).Error("Unable to store account lockout")
+		return
+	}
+
+	if lockout > 0 {
+		requestLog(r).WithFields(log.Fields{
+			"user":     user,
+			"duration": lockout,
+		}).Warn("Account locked after failed logins")
+		getMainConfig().AuditLog.Log(auditEventAccountLocked, r, map[string]string{
+			"username":     user,
+			"failures":     strconv.Itoa(state.Failures),
+			"locked_until": state.LockedUntil.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// RecordSuccess resets the failures of the user after a successful
+// login
+func (a accountLockoutConfig) RecordSuccess(r *http.Request, user string) {
+	if !a.enabled(user) {
+		return
+	}
+
+	if _, err := a.Unlock(user); err != nil {
+		requestLog(r).WithError(err).Error("Unable to reset account lockout")
+	}
+}
+
+// Unlock removes the lockout and the failures of the user and returns
+// whether there was anything to remove
+func (a accountLockoutConfig) Unlock(user string) (bool, error) {
+	store, err := getAccountLockoutStore(getMainConfig().Cluster.storeFor(a.Store))
+	if err != nil {
+		return false, err
+	}
+	return store.Delete(normalizeLockoutUser(user))
+}
+
+func (a accountLockoutConfig) state(user string) (accountLockoutState, error) {
+	store, err := getAccountLockoutStore(getMainConfig().Cluster.storeFor(a.Store))
+	if err != nil {
+		return accountLockoutState{}, err
+	}
+	return store.Get(normalizeLockoutUser(user))
+}
+
+// normalizeLockoutUser lowercases the username as most providers match
+// usernames case-insensitive
+func normalizeLockoutUser(user string) string {
+	return strings.ToLower(user)
+}
+
+type accountLockoutStore interface {
+	// Get returns the state of the user or an empty state if the user
+	// has no failures
+	Get(user string) (accountLockoutState, error)
+
+	// Set stores the state of the user for the given time
+	Set(user string, state accountLockoutState, ttl time.Duration) error
+
+	// Delete removes the state of the user and returns whether it
+	// existed
+	Delete(user string) (bool, error)
+}
+
+func getAccountLockoutStore(store string) (accountLockoutStore, error) {
+	accountLockoutStoresLock.Lock()
+	defer accountLockoutStoresLock.Unlock()
+
+	if s, ok := accountLockoutStores[store]; ok {
+		return s, nil
+	}
+
+	var s accountLockoutStore
+	if store == "" || store == "memory" {
+		s = newMemoryAccountLockoutStore()
+	} else {
+		c, err := getRedisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		s = redisAccountLockoutStore{c}
+	}
+
+	accountLockoutStores[store] = s
+	return s, nil
+}
+
+type memoryAccountLockoutEntry struct {
+	state   accountLockoutState
+	expires time.Time
+}
+
+type memoryAccountLockoutStore struct {
+	entries map[string]memoryAccountLockoutEntry
+	lock    sync.Mutex
+}
+
+func newMemoryAccountLockoutStore() *memoryAccountLockoutStore {
+	m := &memoryAccountLockoutStore{entries: map[string]memoryAccountLockoutEntry{}}
+	go m.cleanup()
+	return m
+}
+
+func (m *memoryAccountLockoutStore) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for user, e := range m.entries {
+			if e.expires.Before(time.Now()) {
+				delete(m.entries, user)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *memoryAccountLockoutStore) Get(user string) (accountLockoutState, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[user]
+	if !ok || e.expires.Before(time.Now()) {
+		return accountLockoutState{}, nil
+	}
+	return e.state, nil
+}
+
+func (m *memoryAccountLockoutStore) Set(user string, state accountLockoutState, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.entries[user] = memoryAccountLockoutEntry{state: state, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryAccountLockoutStore) Delete(user string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.entries[user]
+	delete(m.entries, user)
+	return ok, nil
+}
+
+// redisAccountLockoutStore keeps the states as JSON in Redis to share
+// lockouts between all instances using the same Redis. Concurrent
+// failures of the same account on different instances might be counted
+// once.
+type redisAccountLockoutStore struct {
+	client *redisClient
+}
+
+func (r redisAccountLockoutStore) Get(user string) (accountLockoutState, error) {
+	state := accountLockoutState{}
+
+	reply, err := r.client.Do("GET", accountLockoutKeyPrefix+user)
+	if err != nil || reply == nil {
+		return state, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return state, errors.Errorf("Unexpected reply %v", reply)
+	}
+
+	return state, errors.Wrap(json.Unmarshal([]byte(data), &state), "Unable to decode state")
+}
+
+func (r redisAccountLockoutStore) Set(user string, state accountLockoutState, ttl time.Duration) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Do("SET", accountLockoutKeyPrefix+user, string(data), "PX", strconv.Itoa(int(ttl/time.Millisecond)))
+	return err
+}
+
+func (r redisAccountLockoutStore) Delete(user string) (bool, error) {
+	reply, err := r.client.Do("DEL", accountLockoutKeyPrefix+user)
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := reply.(int64)
+	return n > 0, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccountLockoutBackoff(t *testing.T) {
+	a := accountLockoutConfig{
+		MaxFailures: 2,
+		Duration:    time.Minute,
+		MaxDuration: 3 * time.Minute,
+		ResetAfter:  time.Hour,
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatalf("Unable to validate lockout: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	store, _ := getAccountLockoutStore(a.Store)
+
+	// expireLock simulates the lockout being over
+	expireLock := func() {
+		state, _ := store.Get("mallory")
+		state.LockedUntil = time.Now().Add(-time.Second)
+		store.Set("mallory", state, time.Hour)
+	}
+
+	a.RecordFailure(r, "Mallory")
+	if a.Locked(r, "mallory") != 0 {
+		t.Fatal("Expected account not to be locked after first failure")
+	}
+
+	for _, expect := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		a.RecordFailure(r, "mallory")
+		if wait := a.Locked(r, "MALLORY"); wait <= expect-time.Second || wait > expect {
+			t.Errorf("Expected lockout of %s, got %s", expect, wait)
+		}
+		expireLock()
+	}
+
+	a.RecordSuccess(r, "mallory")
+	if state, _ := store.Get("mallory"); state.Failures != 0 {
+		t.Errorf("Expected failures to be reset on success, got %d", state.Failures)
+	}
+
+	a.RecordFailure(r, "mallory")
+	a.RecordFailure(r, "mallory")
+	if a.Locked(r, "mallory") == 0 {
+		t.Fatal("Expected account to be locked again")
+	}
+	if found, err := a.Unlock("Mallory"); err != nil || !found {
+		t.Fatalf("Unable to unlock account: found=%v, err=%v", found, err)
+	}
+	if a.Locked(r, "mallory") != 0 {
+		t.Error("Expected account to be unlocked")
+	}
+
+	if err := (accountLockoutConfig{MaxFailures: 3, Duration: time.Hour, MaxDuration: time.Minute, ResetAfter: time.Hour}).Validate(); err == nil {
+		t.Error("Expected max duration below duration to be rejected")
+	}
+}
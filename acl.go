@@ -1,189 +1,193 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/Luzifer/go_helpers/str"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
 )
 
-type aclRule struct {
-	Field       string  `yaml:"field"`
-	Invert      bool    `yaml:"invert"`
-	IsPresent   *bool   `yaml:"present"`
-	MatchRegex  *string `yaml:"regexp"`
-	MatchString *string `yaml:"equals"`
-}
+// aclHeaderFieldsMax limits the number of header names kept as the
+// headers are chosen by the client
+const aclHeaderFieldsMax = 256
 
-func (a aclRule) Validate() error {
-	if a.Field == "" {
-		return fmt.Errorf("Field is not set")
-	}
+var (
+	// aclHeaderFields maps the header names seen before to their field
+	// names to not lower them for every request
+	aclHeaderFields     = map[string]string{}
+	aclHeaderFieldsLock sync.RWMutex
 
-	if a.IsPresent == nil && a.MatchRegex == nil && a.MatchString == nil {
-		return fmt.Errorf("No matcher (present, regexp, equals) is set")
-	}
+	// aclReservedFieldPrefixes are the prefixes of the fields computed
+	// by nginx-sso, headers using them are ignored to not let clients
+	// supply those fields when nginx-sso does not set them
+	aclReservedFieldPrefixes = []string{"client.", "session.", "claim."}
+)
 
-	if a.MatchRegex != nil {
-		if _, err := regexp.Compile(*a.MatchRegex); err != nil {
-			return fmt.Errorf("Regexp is invalid: %s", err)
+// requestMethod returns the method of the original request: nginx
+// passes it in the X-Origin-Method header, Caddy in X-Forwarded-Method,
+// otherwise the method of the auth request is used which is inherited
+// from the original request
+func requestMethod(r *http.Request) string {
+	for _, hdr := range []string{"X-Origin-Method", "X-Forwarded-Method"} {
+		if m := r.Header.Get(hdr); m != "" {
+			return strings.ToUpper(m)
 		}
 	}
 
-	return nil
+	return r.Method
 }
 
-func (a aclRule) AppliesToFields(fields map[string]string) bool {
-	var field, value string
-
-	for f, v := range fields {
-		if strings.ToLower(a.Field) == f {
-			field = f
-			value = v
-			break
-		}
+// requestURI returns the URI of the original request: nginx passes it
+// in the X-Origin-URI header (by convention of the example config),
+// Caddy forward_auth in X-Forwarded-Uri
+func requestURI(r *http.Request) string {
+	if u := r.Header.Get("X-Origin-URI"); u != "" {
+		return u
 	}
 
-	if a.IsPresent != nil {
-		if !a.Invert && *a.IsPresent && field == "" {
-			// Field is expected to be present but isn't, rule does not apply
-			return false
-		}
-		if !a.Invert && !*a.IsPresent && field != "" {
-			// Field is expected not to be present but is, rule does not apply
-			return false
-		}
-		if a.Invert && *a.IsPresent && field != "" {
-			// Field is expected not to be present but is, rule does not apply
-			return false
-		}
-		if a.Invert && !*a.IsPresent && field == "" {
-			// Field is expected to be present but isn't, rule does not apply
-			return false
-		}
+	return r.Header.Get("X-Forwarded-Uri")
+}
 
-		return true
-	}
+// buildACLFieldSet collects the fields of the request the rules are
+// matched against
+func buildACLFieldSet(r *http.Request) map[string]string {
+	return withSessionMetaFields(r, buildACLRequestFields(r))
+}
 
-	if field == "" {
-		// We found a rule which has no matching field, rule does not apply
-		return false
-	}
+// buildACLRequestFields collects the fields of the request itself
+// without the metadata of the session the user was detected from
+func buildACLRequestFields(r *http.Request) map[string]string {
+	// Headers and the request fields
+	result := make(map[string]string, len(r.Header)+8)
 
-	if a.MatchString != nil {
-		if (*a.MatchString != value) == !a.Invert {
-			// Value does not match expected string, rule does not apply
-			return false
+	for k, v := range r.Header {
+		if field := aclHeaderField(k); len(v) > 0 && !aclReservedField(field) {
+			result[field] = v[0]
 		}
 	}
 
-	if a.MatchRegex != nil {
-		if regexp.MustCompile(*a.MatchRegex).MatchString(value) == a.Invert {
-			// Value does not match expected regexp, rule does not apply
-			return false
-		}
+	if _, ok := result["host"]; !ok {
+		// The Host header is not part of the headers of incoming requests
+		result["host"] = requestHost(r)
 	}
 
-	return true
-}
-
-type aclAccessResult uint
+	if _, ok := result["x-origin-uri"]; !ok && requestURI(r) != "" {
+		// Provide the URI of other proxies in the well known field
+		result["x-origin-uri"] = requestURI(r)
+	}
 
-const (
-	accessDunno aclAccessResult = iota
-	accessAllow
-	accessDeny
-)
+	result["method"] = requestMethod(r)
 
-type aclRuleSet struct {
-	Rules []aclRule `yaml:"rules"`
+	result["client.ip"] = getMainConfig().trustedClientIP(r)
+	if country := geoIPCountry(result["client.ip"]); country != "" {
+		result["client.country"] = country
+	}
 
-	Allow []string `yaml:"allow"`
-	Deny  []string `yaml:"deny"`
+	return result
 }
 
-func (a aclRuleSet) buildFieldSet(r *http.Request) map[string]string {
-	result := map[string]string{}
+// withSessionMetaFields returns the fields with the session metadata of
+// the request added. The given fields are shared with the concurrent
+// detections and therefore copied instead of modified.
+func withSessionMetaFields(r *http.Request, fields map[string]string) map[string]string {
+	m, ok := getSessionMeta(r)
+	if !ok {
+		return fields
+	}
 
-	for k := range r.Header {
-		result[strings.ToLower(k)] = r.Header.Get(k)
+	result := make(map[string]string, len(fields)+8)
+	for k, v := range fields {
+		result[k] = v
 	}
+	m.addFields(result)
 
 	return result
 }
 
-func (a aclRuleSet) HasAccess(user string, groups []string, r *http.Request) aclAccessResult {
-	fields := a.buildFieldSet(r)
-
-	for _, rule := range a.Rules {
-		if !rule.AppliesToFields(fields) {
-			// At least one rule does not match the request
-			return accessDunno
+// aclReservedField checks whether the field name uses a prefix of the
+// fields computed by nginx-sso
+func aclReservedField(field string) bool {
+	for _, prefix := range aclReservedFieldPrefixes {
+		if strings.HasPrefix(field, prefix) {
+			return true
 		}
 	}
 
-	// All rules do apply to this request, we can judge
+	return false
+}
 
-	if str.StringInSlice(user, a.Deny) {
-		// Explicit deny, final result
-		return accessDeny
+// aclHeaderField returns the field name of the header
+func aclHeaderField(header string) string {
+	aclHeaderFieldsLock.RLock()
+	field, ok := aclHeaderFields[header]
+	aclHeaderFieldsLock.RUnlock()
+	if ok {
+		return field
 	}
 
-	if str.StringInSlice(user, a.Allow) {
-		// Explicit allow, final result
-		return accessAllow
+	field = strings.ToLower(header)
+
+	aclHeaderFieldsLock.Lock()
+	defer aclHeaderFieldsLock.Unlock()
+	if len(aclHeaderFields) < aclHeaderFieldsMax {
+		aclHeaderFields[header] = field
 	}
+	return field
+}
 
-	for _, group := range groups {
-		if str.StringInSlice("@"+group, a.Deny) {
-			// Deny through group, final result
-			return accessDeny
-		}
+// newACLRequest passes the user, the fields of the request and the
+// session the user was detected from to the ACL
+func newACLRequest(user string, groups []string, r *http.Request, fields map[string]string) acl.Request {
+	m, _ := getSessionMeta(r)
 
-		if str.StringInSlice("@"+group, a.Allow) {
-			// Allow through group, final result
-			return accessAllow
-		}
+	return acl.Request{
+		User:    user,
+		Groups:  groups,
+		Fields:  fields,
+		Session: acl.Session{Provider: m.Provider, MFA: m.MFA, LoginTime: m.LoginTime},
+		Counter: getRequestCounter(),
 	}
-
-	// Neither user nor group are handled
-	return accessDunno
 }
 
-func (a aclRuleSet) Validate() error {
-	for i, r := range a.Rules {
-		if err := r.Validate(); err != nil {
-			return fmt.Errorf("Rule on position %d is invalid: %s", i+1, err)
-		}
-	}
+// activeACL holds the acl used by the requests
+var activeACL atomic.Value
 
-	return nil
+// getACL returns the currently active ACL. The ACL is never modified
+// after being activated so requests can keep using the returned ACL
+// while a new one is loaded.
+func getACL() acl.ACL {
+	if a, ok := activeACL.Load().(acl.ACL); ok {
+		return a
+	}
+	return acl.ACL{}
 }
 
-type acl struct {
-	RuleSets []aclRuleSet `yaml:"rule_sets"`
+func setACL(a acl.ACL) {
+	activeACL.Store(a)
 }
 
-func (a acl) Validate() error {
-	for i, r := range a.RuleSets {
-		if err := r.Validate(); err != nil {
-			return fmt.Errorf("RuleSet on position %d is invalid: %s", i+1, err)
-		}
-	}
+// loadACL parses the ACL from the configuration including the files
+// referenced in it (relative to baseDir) and compiles it
+func loadACL(yamlSource []byte, baseDir string) (acl.ACL, error) {
+	envelope := struct {
+		ACL acl.ACL `yaml:"acl"`
+	}{}
 
-	return nil
-}
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return acl.ACL{}, err
+	}
 
-func (a acl) HasAccess(user string, groups []string, r *http.Request) bool {
-	result := accessDunno
+	if err := envelope.ACL.LoadIncludes(baseDir, readConfigFile); err != nil {
+		return acl.ACL{}, err
+	}
 
-	for _, rs := range a.RuleSets {
-		if intermediateResult := rs.HasAccess(user, groups, r); intermediateResult > result {
-			result = intermediateResult
-		}
+	if err := envelope.ACL.Compile(); err != nil {
+		return acl.ACL{}, err
 	}
 
-	return result == accessAllow
+	return envelope.ACL, nil
 }
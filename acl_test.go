@@ -3,6 +3,9 @@ package main
 import (
 	"net/http"
 	"testing"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
 )
 
 var (
@@ -18,202 +21,232 @@ func aclTestRequest(headers map[string]string) *http.Request {
 	return req
 }
 
+// aclTestHasAccess judges the request using the fields built from it
+func aclTestHasAccess(a acl.ACL, user string, groups []string, r *http.Request) bool {
+	return a.HasAccess(newACLRequest(user, groups, r, buildACLFieldSet(r)))
+}
+
 func aclTestString(in string) *string { return &in }
 func aclTestBool(in bool) *bool       { return &in }
 
-func TestEmptyACL(t *testing.T) {
-	a := acl{}
-
-	if a.HasAccess(aclTestUser, aclTestGroups, aclTestRequest(map[string]string{})) {
-		t.Fatal("Empty ACL (= default action) was ALLOW instead of DENY")
-	}
-}
-
-func TestRuleSetMatcher(t *testing.T) {
-	r := aclRuleSet{
-		Rules: []aclRule{
-			{
-				Field:       "field_a",
-				MatchString: aclTestString("expected"),
-			},
-			{
-				Field:       "field_c",
-				MatchString: aclTestString("expected"),
-			},
+func TestSessionMetaFields(t *testing.T) {
+	r := acl.RuleSet{
+		Rules: []acl.Rule{
+			{Field: "session.provider", MatchString: aclTestString("simple")},
+			{Field: "session.mfa", MatchString: aclTestString("true")},
 		},
 		Allow: []string{aclTestUser},
 	}
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
-		"field_c": "expected",
-	}
 
-	if r.HasAccess(aclTestUser, aclTestGroups, aclTestRequest(fields)) != accessAllow {
-		t.Error("Access was denied")
+	req := aclTestRequest(map[string]string{})
+	if r.HasAccess(newACLRequest(aclTestUser, aclTestGroups, req, buildACLFieldSet(req))) != acl.Dunno {
+		t.Error("Rule applied without session metadata")
 	}
 
-	delete(fields, "field_c")
-	if r.HasAccess(aclTestUser, aclTestGroups, aclTestRequest(fields)) != accessDunno {
-		t.Error("Access was not unknown")
+	setSessionMeta(req, sessionMeta{Provider: "simple", MFA: true})
+	if r.HasAccess(newACLRequest(aclTestUser, aclTestGroups, req, buildACLFieldSet(req))) != acl.Allow {
+		t.Error("Access was denied")
 	}
 }
 
-func TestInvertedRegexMatcher(t *testing.T) {
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
-	}
-
-	ar := aclRule{
-		Field:      "field_a",
-		Invert:     true,
-		MatchRegex: aclTestString("^expected$"),
-	}
+func TestACLRequestSession(t *testing.T) {
+	login := time.Now().Add(-time.Minute)
+	req := aclTestRequest(map[string]string{})
+	setSessionMeta(req, sessionMeta{Provider: "token", MFA: true, LoginTime: login})
 
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	aclReq := newACLRequest(aclTestUser, aclTestGroups, req, buildACLFieldSet(req))
+	if aclReq.Session != (acl.Session{Provider: "token", MFA: true, LoginTime: login}) {
+		t.Errorf("Unexpected session: %#v", aclReq.Session)
 	}
 
-	fields["field_a"] = "unexpected"
-
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	if aclReq.Counter == nil {
+		t.Error("Request counter was not set, quotas would not be enforced")
 	}
 }
 
-func TestRegexMatcher(t *testing.T) {
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
-	}
-
-	ar := aclRule{
-		Field:      "field_a",
-		MatchRegex: aclTestString("^expected$"),
-	}
+func TestMethodField(t *testing.T) {
+	a := acl.ACL{RuleSets: []acl.RuleSet{
+		{
+			Rules: []acl.Rule{
+				{Field: "method", MatchRegex: aclTestString("^(GET|HEAD)$")},
+			},
+			Allow: []string{aclTestUser},
+		},
+	}}
 
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	if !aclTestHasAccess(a, aclTestUser, aclTestGroups, aclTestRequest(map[string]string{})) {
+		t.Error("Access was denied for method of the auth request")
 	}
 
-	fields["field_a"] = "unexpected"
-
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	if aclTestHasAccess(a, aclTestUser, aclTestGroups, aclTestRequest(map[string]string{"X-Origin-Method": "post"})) {
+		t.Error("Rule applied to POST request")
 	}
 }
 
-func TestInvertedEqualsMatcher(t *testing.T) {
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
-	}
-
-	ar := aclRule{
-		Field:       "field_a",
-		Invert:      true,
-		MatchString: aclTestString("expected"),
+func TestUserAgentField(t *testing.T) {
+	a := acl.ACL{RuleSets: []acl.RuleSet{
+		{
+			Rules: []acl.Rule{
+				{Field: "user-agent", MatchRegex: aclTestString("^Prometheus/")},
+			},
+			Deny:  []string{aclTestUser},
+			Final: true,
+		},
+		{
+			Rules: []acl.Rule{
+				{Field: "user-agent", IsPresent: aclTestBool(true)},
+			},
+			Allow: []string{aclTestUser},
+		},
+	}}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
 	}
 
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	if aclTestHasAccess(a, aclTestUser, aclTestGroups, aclTestRequest(map[string]string{"User-Agent": "Prometheus/2.3.1"})) {
+		t.Error("Monitoring agent was granted access")
 	}
 
-	fields["field_a"] = "unexpected"
-
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	if !aclTestHasAccess(a, aclTestUser, aclTestGroups, aclTestRequest(map[string]string{"User-Agent": "Mozilla/5.0"})) {
+		t.Error("Browser was denied access")
 	}
 }
 
-func TestEqualsMatcher(t *testing.T) {
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
+func TestHostField(t *testing.T) {
+	a := acl.ACL{
+		HostDefaults: []acl.HostDefault{
+			{Hosts: []string{"legacy.example.com"}, Policy: "allow"},
+		},
+		RuleSets: []acl.RuleSet{
+			{
+				Rules: []acl.Rule{{Field: "host", MatchString: aclTestString("wiki.example.com")}},
+				Allow: []string{aclTestUser},
+			},
+		},
 	}
-
-	ar := aclRule{
-		Field:       "field_a",
-		MatchString: aclTestString("expected"),
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
 	}
 
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	for host, expected := range map[string]bool{
+		"wiki.example.com":   true,
+		"Legacy.Example.com": true,
+		"new.example.com":    false,
+	} {
+		if aclTestHasAccess(a, aclTestUser, aclTestGroups, aclTestRequest(map[string]string{"X-Host": host})) != expected {
+			t.Errorf("Access to %s expected to be %v", host, expected)
+		}
 	}
+}
 
-	fields["field_a"] = "unexpected"
+func TestReservedFieldHeaders(t *testing.T) {
+	a := acl.ACL{RuleSets: []acl.RuleSet{
+		{
+			Rules: []acl.Rule{{Field: "client.country", MatchString: aclTestString("DE")}},
+			Allow: []string{aclTestUser},
+		},
+	}}
 
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	// Without GeoIP database the lookup never returns a country
+	req := aclTestRequest(map[string]string{"Client.Country": "DE"})
+	if _, ok := buildACLFieldSet(req)["client.country"]; ok {
+		t.Error("Header was used as client.country field")
+	}
+	if aclTestHasAccess(a, aclTestUser, aclTestGroups, req) {
+		t.Error("Spoofed client.country header granted access")
 	}
 }
 
-func TestInvertedIsPresentMatcher(t *testing.T) {
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
-	}
+func TestReservedSessionHeaders(t *testing.T) {
+	a := acl.ACL{RuleSets: []acl.RuleSet{
+		{
+			Rules: []acl.Rule{{Field: "session.mfa", MatchString: aclTestString("true")}},
+			Allow: []string{aclTestUser},
+		},
+		{
+			Rules: []acl.Rule{{Field: "session.login_time", IsPresent: aclTestBool(true)}},
+			Allow: []string{"mike"},
+		},
+	}}
 
-	ar := aclRule{
-		Field:     "field_a",
-		Invert:    true,
-		IsPresent: aclTestBool(true),
-	}
+	headers := map[string]string{"Session.Mfa": "true", "Session.Login_time": "1"}
 
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	// Request without session
+	req := aclTestRequest(headers)
+	if aclTestHasAccess(a, aclTestUser, aclTestGroups, req) {
+		t.Error("Spoofed session.mfa header granted access without session")
 	}
 
-	ar.IsPresent = aclTestBool(false)
-
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	// Session without login time
+	req = aclTestRequest(headers)
+	setSessionMeta(req, sessionMeta{Provider: "token"})
+	if aclTestHasAccess(a, aclTestUser, aclTestGroups, req) {
+		t.Error("Spoofed session.mfa header overruled the session")
 	}
+	if aclTestHasAccess(a, "mike", aclTestGroups, req) {
+		t.Error("Spoofed session.login_time header was used")
+	}
+}
 
-	ar.IsPresent = aclTestBool(true)
-	delete(fields, "field_a")
+func TestReservedClaimHeaders(t *testing.T) {
+	a := acl.ACL{RuleSets: []acl.RuleSet{
+		{
+			Rules: []acl.Rule{{Field: "claim.department", MatchString: aclTestString("hr")}},
+			Allow: []string{aclTestUser},
+		},
+	}}
 
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	req := aclTestRequest(map[string]string{"Claim.Department": "hr"})
+	setSessionMeta(req, sessionMeta{Provider: "simple", Claims: map[string]string{"mail": "test@example.com"}})
+	if aclTestHasAccess(a, aclTestUser, aclTestGroups, req) {
+		t.Error("Spoofed claim header supplied a claim missing in the session")
 	}
 
-	ar.IsPresent = aclTestBool(false)
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	setSessionMeta(req, sessionMeta{Provider: "simple", Claims: map[string]string{"department": "hr"}})
+	if !aclTestHasAccess(a, aclTestUser, aclTestGroups, req) {
+		t.Error("Claim of the session was not used")
 	}
 }
 
-func TestIsPresentMatcher(t *testing.T) {
-	fields := map[string]string{
-		"field_a": "expected",
-		"field_b": "unchecked",
+func TestForwardedRequestFields(t *testing.T) {
+	a := acl.ACL{RuleSets: []acl.RuleSet{
+		{
+			Rules: []acl.Rule{
+				{Field: "x-origin-uri", MatchGlob: aclTestString("/api/**")},
+				{Field: "method", MatchString: aclTestString("POST")},
+			},
+			Allow: []string{aclTestUser},
+		},
+	}}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
 	}
 
-	ar := aclRule{
-		Field:     "field_a",
-		IsPresent: aclTestBool(true),
+	req := aclTestRequest(map[string]string{
+		"X-Forwarded-Method": "post",
+		"X-Forwarded-Uri":    "/api/v1/users",
+	})
+	if !aclTestHasAccess(a, aclTestUser, aclTestGroups, req) {
+		t.Error("Caddy forwarded request was not matched")
 	}
+}
 
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
-	}
+func TestACLFieldSetReused(t *testing.T) {
+	r := aclTestRequest(map[string]string{"host": "a.example.com"})
+	defer clearRequestValues(r)
 
-	ar.IsPresent = aclTestBool(false)
+	fields := map[string]string{"host": "b.example.com"}
+	setACLRequestFields(r, fields)
 
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	if host := aclFieldSet(r)["host"]; host != "b.example.com" {
+		t.Errorf("Attached fields were not used, got host %q", host)
 	}
 
-	ar.IsPresent = aclTestBool(true)
-	delete(fields, "field_a")
-
-	if ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	setSessionMeta(r, sessionMeta{Provider: "simple"})
+	if provider := aclFieldSet(r)["session.provider"]; provider != "simple" {
+		t.Errorf("Session metadata was not added, got provider %q", provider)
 	}
-
-	ar.IsPresent = aclTestBool(false)
-	if !ar.AppliesToFields(fields) {
-		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	if _, ok := fields["session.provider"]; ok {
+		t.Error("Attached fields were modified")
 	}
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+type adminConfig struct {
+	Allow    []string             `yaml:"allow"`
+	Listener *adminListenerConfig `yaml:"listener"`
+	Pprof    bool                 `yaml:"pprof"`
+}
+
+// HasAccess checks whether the user is allowed to use the admin API.
+// The list contains users and groups prefixed with an @ like the ACL
+func (a adminConfig) HasAccess(user string, groups []string) bool {
+	if str.StringInSlice(user, a.Allow) {
+		return true
+	}
+
+	for _, group := range groups {
+		if str.StringInSlice("@"+group, a.Allow) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// detectAdmin ensures the request is made by an user allowed to use
+// the admin API and writes an error response otherwise
+func detectAdmin(res http.ResponseWriter, r *http.Request) (string, bool) {
+	if user, ok := getListenerAdmin(r); ok {
+		// Authenticated using the credentials of the admin listener
+		return user, true
+	}
+
+	user, groups, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Check access below
+
+	case errors.Is(err, errNoUser):
+		http.Error(res, "No valid user found", http.StatusUnauthorized)
+		return "", false
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting admin user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return "", false
+	}
+
+	if !getMainConfig().Admin.HasAccess(user, groups) {
+		publishEvent(authEvent{Type: auditEventAccessDenied, Request: r, User: user})
+		http.Error(res, "Access denied for this resource", http.StatusForbidden)
+		return "", false
+	}
+
+	return user, true
+}
+
+func handleAdminSessionsRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	store := getSessionStore()
+	if store == nil {
+		http.Error(res, errSessionTrackingDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	var (
+		id   = r.URL.Query().Get("id")
+		user = r.URL.Query().Get("user")
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		if user == "" {
+			http.Error(res, "Parameter user is required", http.StatusBadRequest)
+			return
+		}
+
+		sessions, err := store.ListByUser(user)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to list sessions")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(sessions); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode sessions")
+		}
+
+	case http.MethodDelete:
+		var (
+			n   = 1
+			err error
+		)
+
+		switch {
+		case id != "":
+			// The cache is indexed by user, the cached users of the other
+			// sessions of the user are removed too
+			info, _ := store.Get(id)
+			if err = store.Delete(id); err == nil && info.User != "" {
+				getMainConfig().DetectCache.InvalidateUser(info.User)
+			}
+		case user != "":
+			n, err = revokeUserSessions(user)
+		default:
+			http.Error(res, "Parameter id or user is required", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to revoke sessions")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventSessionsRevoked, r, map[string]string{
+			"admin":    admin,
+			"count":    strconv.Itoa(n),
+			"session":  id,
+			"username": user,
+		})
+
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminLockoutsRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	if getMainConfig().AccountLockout.MaxFailures == 0 {
+		http.Error(res, "Account lockout is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(res, "Parameter user is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := getMainConfig().AccountLockout.state(user)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to read account lockout")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(struct {
+			accountLockoutState
+			User   string `json:"user"`
+			Locked bool   `json:"locked"`
+		}{state, user, time.Now().Before(state.LockedUntil)}); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode account lockout")
+		}
+
+	case http.MethodDelete:
+		found, err := getMainConfig().AccountLockout.Unlock(user)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to unlock account")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(res, "Account has no failed logins", http.StatusNotFound)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventAccountUnlocked, r, map[string]string{
+			"admin":    admin,
+			"username": user,
+		})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminGroupsRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(res, "Parameter user is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if getMainConfig().GroupCache.TTL <= 0 {
+			http.Error(res, "Group cache is not enabled", http.StatusNotImplemented)
+			return
+		}
+
+		scopes, err := getMainConfig().GroupCache.List(user)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to read cached groups")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(scopes); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode cached groups")
+		}
+
+	case http.MethodDelete:
+		if err := getMainConfig().GroupCache.Invalidate(user); err != nil {
+			requestLog(r).WithError(err).Error("Unable to invalidate cached groups")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventGroupsInvalidated, r, map[string]string{
+			"admin":    admin,
+			"username": user,
+		})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminProviders describes the providers activated by the current
+// configuration
+type adminProviders struct {
+	Authenticators []adminAuthenticator `json:"authenticators"`
+	GroupProviders []string             `json:"group_providers"`
+	MFAProviders   []string             `json:"mfa_providers"`
+}
+
+type adminAuthenticator struct {
+	ID      string `json:"id"`
+	Enabled bool   `json:"enabled"`
+	Login   bool   `json:"login"`
+	MFA     bool   `json:"mfa"`
+}
+
+func getActiveProviders() adminProviders {
+	out := adminProviders{
+		Authenticators: []adminAuthenticator{},
+		GroupProviders: []string{},
+		MFAProviders:   []string{},
+	}
+
+	snapshot := getAuthenticatorSnapshot()
+	enabled := map[string]bool{}
+	for _, a := range snapshot.active {
+		enabled[a.AuthenticatorID()] = true
+	}
+	for _, a := range snapshot.configured {
+		out.Authenticators = append(out.Authenticators, adminAuthenticator{
+			ID:      a.AuthenticatorID(),
+			Enabled: enabled[a.AuthenticatorID()],
+			Login:   len(a.LoginFields()) > 0,
+			MFA:     a.SupportsMFA(),
+		})
+	}
+
+	groupProviderRegistryMutex.RLock()
+	for _, g := range activeGroupProviders {
+		out.GroupProviders = append(out.GroupProviders, g.GroupProviderID())
+	}
+	groupProviderRegistryMutex.RUnlock()
+
+	mfaRegistryMutex.RLock()
+	for _, m := range activeMFAProviders {
+		out.MFAProviders = append(out.MFAProviders, m.ProviderID())
+	}
+	mfaRegistryMutex.RUnlock()
+
+	return out
+}
+
+func handleAdminProvidersRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(getActiveProviders()); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode providers")
+		}
+
+	case http.MethodPost, http.MethodDelete:
+		id := r.FormValue("authenticator")
+		if id == "" {
+			http.Error(res, "Parameter authenticator is required", http.StatusBadRequest)
+			return
+		}
+
+		enabled := r.Method == http.MethodPost
+		switch err := setAuthenticatorEnabled(id, enabled); err {
+		case nil:
+		case errAuthenticatorNotConfigured:
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		case errLastAuthenticator:
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		default:
+			requestLog(r).WithError(err).Error("Unable to change authenticator")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		log.WithFields(log.Fields{"admin": admin, "authenticator": id, "enabled": enabled}).Warn("Authenticator changed")
+		getMainConfig().AuditLog.Log(auditEventProviderChanged, r, map[string]string{
+			"admin":         admin,
+			"authenticator": id,
+			"enabled":       strconv.FormatBool(enabled),
+		})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
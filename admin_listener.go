@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminListenerConfig configures a second listener serving the admin
+// API, metrics and profiles instead of the main listener
+type adminListenerConfig struct {
+	listenConfig `yaml:",inline"`
+
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// BasicAuth maps usernames to bcrypt hashed passwords
+	BasicAuth map[string]string `yaml:"basic_auth"`
+}
+
+// Enabled returns whether the admin listener is configured
+func (a *adminListenerConfig) Enabled() bool {
+	return a != nil && (a.Port != 0 || a.Socket != "" || a.SystemdSocket != "")
+}
+
+func (a *adminListenerConfig) Validate() error {
+	if !a.Enabled() {
+		return nil
+	}
+
+	if err := a.listenConfig.Validate(); err != nil {
+		return err
+	}
+
+	if a.ClientCAFile != "" && a.TLSCertFile == "" {
+		return fmt.Errorf("Client certificates require TLS to be configured")
+	}
+
+	return nil
+}
+
+// authenticate checks the credentials required by the admin listener
+// itself and returns the name of the authenticated admin. If the
+// listener does not require credentials an empty name is returned and
+// the admin is detected through the authenticators.
+func (a *adminListenerConfig) authenticate(r *http.Request) (string, bool) {
+	if !a.Enabled() {
+		// Listener was removed from the configuration but is kept
+		// running until restart
+		return "", false
+	}
+
+	var user string
+
+	if a.ClientCAFile != "" {
+		// The TLS handshake already verified the certificate
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return "", false
+		}
+		user = r.TLS.PeerCertificates[0].Subject.CommonName
+		if user == "" {
+			user = r.TLS.PeerCertificates[0].Subject.String()
+		}
+	}
+
+	if len(a.BasicAuth) == 0 {
+		return user, true
+	}
+
+	basicUser, basicPass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	hash, ok := a.BasicAuth[basicUser]
+	if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(basicPass)) != nil {
+		return "", false
+	}
+
+	return basicUser, true
+}
+
+func (a *adminListenerConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig, err := a.TLSConfig()
+	if err != nil || a.ClientCAFile == "" {
+		return tlsConfig, err
+	}
+
+	pem, err := ioutil.ReadFile(a.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read client CA file")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Client CA file contains no certificates")
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+}
+
+// getListenerAdmin returns the admin authenticated by the admin listener
+func getListenerAdmin(r *http.Request) (string, bool) {
+	user, ok := context.Get(r, adminUserContextKey).(string)
+	return user, ok
+}
+
+// adminListenerHandler enforces the authentication of the admin listener
+// before passing the request to the next handler. The configuration is
+// read on every request to apply changed credentials on reload.
+func adminListenerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		lc := getMainConfig().Admin.Listener
+
+		user, ok := lc.authenticate(r)
+		if !ok {
+			publishEvent(authEvent{Type: auditEventAccessDenied, Request: r, Fields: map[string]string{"reason": "invalid admin listener credentials"}})
+			if lc != nil && len(lc.BasicAuth) > 0 {
+				res.Header().Set("WWW-Authenticate", `Basic realm="nginx-sso admin"`)
+			}
+			http.Error(res, "No valid user found", http.StatusUnauthorized)
+			return
+		}
+
+		if user != "" {
+			context.Set(r, adminUserContextKey, user)
+		}
+
+		next.ServeHTTP(res, r)
+	})
+}
+
+// listenAdmin starts the admin listener serving the given handler
+func listenAdmin(a *adminListenerConfig, handler http.Handler) {
+	tlsConfig, err := a.tlsConfig()
+	if err != nil {
+		log.WithError(err).Fatal("Unable to configure admin listener TLS")
+	}
+
+	log.WithField("addr", a.String()).Info("Starting admin listener")
+	err = a.Serve(context.ClearHandler(withRequestID(adminListenerHandler(handler))), tlsConfig)
+	if err != http.ErrServerClosed {
+		log.WithError(err).WithField("addr", a.String()).Fatal("Admin listener failed")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminListenerAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Unable to hash password: %s", err)
+	}
+
+	open := &adminListenerConfig{listenConfig: listenConfig{Port: 8083}}
+	protected := &adminListenerConfig{
+		listenConfig: listenConfig{Port: 8083},
+		BasicAuth:    map[string]string{"monitoring": string(hash)},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cfg      *adminListenerConfig
+		user     string
+		pass     string
+		expUser  string
+		expValid bool
+	}{
+		{name: "removed listener", cfg: nil},
+		{name: "no credentials required", cfg: open, expValid: true},
+		{name: "missing credentials", cfg: protected},
+		{name: "wrong password", cfg: protected, user: "monitoring", pass: "wrong"},
+		{name: "unknown user", cfg: protected, user: "luzifer", pass: "secret"},
+		{name: "valid credentials", cfg: protected, user: "monitoring", pass: "secret", expUser: "monitoring", expValid: true},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.pass)
+		}
+
+		user, ok := tc.cfg.authenticate(r)
+		if ok != tc.expValid || user != tc.expUser {
+			t.Errorf("%s: Expected (%q, %v), got (%q, %v)", tc.name, tc.expUser, tc.expValid, user, ok)
+		}
+	}
+}
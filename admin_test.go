@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/context"
+)
+
+func TestAdminRecentAuditEvents(t *testing.T) {
+	prevEvents, prevRecent := getMainConfig().AuditLog.Events, getMainConfig().AuditLog.RecentEvents
+	defer func() {
+		getMainConfig().AuditLog.Events, getMainConfig().AuditLog.RecentEvents = prevEvents, prevRecent
+		recentAuditEvents = &auditEventBuffer{}
+	}()
+
+	getMainConfig().AuditLog.Events = []string{string(auditEventLoginFailure), string(auditEventLoginSuccess)}
+	getMainConfig().AuditLog.RecentEvents = 2
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	getMainConfig().AuditLog.Log(auditEventLoginFailure, r, map[string]string{"username": "alice"})
+	getMainConfig().AuditLog.Log(auditEventLoginFailure, r, map[string]string{"username": "bob"})
+	getMainConfig().AuditLog.Log(auditEventLoginSuccess, r, map[string]string{"username": "bob"})
+	getMainConfig().AuditLog.Log(auditEventLogout, r, map[string]string{"username": "bob"})
+
+	query := func(q string) (int, []map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodGet, "/admin/audit"+q, nil)
+		context.Set(r, adminUserContextKey, "admin")
+		defer context.Clear(r)
+
+		res := httptest.NewRecorder()
+		handleAdminAuditRequest(res, r)
+
+		events := []map[string]interface{}{}
+		json.Unmarshal(res.Body.Bytes(), &events)
+		return res.Code, events
+	}
+
+	code, events := query("")
+	if code != http.StatusOK || len(events) != 2 {
+		t.Fatalf("Expected 2 events, got status %d with %v", code, events)
+	}
+	if events[0]["event_type"] != string(auditEventLoginSuccess) || events[1]["username"] != "bob" {
+		t.Errorf("Expected newest events first, got %v", events)
+	}
+
+	if _, events = query("?event=login_failure&user=bob"); len(events) != 1 {
+		t.Errorf("Expected filtered event, got %v", events)
+	}
+	if _, events = query("?limit=1"); len(events) != 1 {
+		t.Errorf("Expected limited events, got %v", events)
+	}
+	if code, _ = query("?since=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid since to be rejected, got status %d", code)
+	}
+}
+
+func TestAdminToggleAuthenticators(t *testing.T) {
+	prevAuthenticators := getAuthenticatorSnapshot()
+	defer func() {
+		authenticatorState.Store(prevAuthenticators)
+		disabledAuthenticators = map[string]bool{}
+	}()
+	setAuthenticators([]authenticator{&authSimple{}, &authToken{}})
+
+	toggle := func(method, id string) int {
+		r := httptest.NewRequest(method, "/admin/providers?authenticator="+id, nil)
+		context.Set(r, adminUserContextKey, "admin")
+		defer context.Clear(r)
+
+		res := httptest.NewRecorder()
+		handleAdminProvidersRequest(res, r)
+		return res.Code
+	}
+
+	if code := toggle(http.MethodDelete, "ldap"); code != http.StatusNotFound {
+		t.Errorf("Expected unconfigured authenticator to be rejected, got status %d", code)
+	}
+	if code := toggle(http.MethodDelete, "simple"); code != http.StatusNoContent {
+		t.Fatalf("Expected authenticator to be disabled, got status %d", code)
+	}
+	if len(getAuthenticatorSnapshot().active) != 1 || getAuthenticatorSnapshot().active[0].AuthenticatorID() != "token" {
+		t.Errorf("Expected only the token authenticator to be active, got %v", getAuthenticatorSnapshot().active)
+	}
+	if code := toggle(http.MethodDelete, "token"); code != http.StatusConflict {
+		t.Errorf("Expected last authenticator not to be disabled, got status %d", code)
+	}
+
+	// The disabled state survives reloads
+	setAuthenticators([]authenticator{&authSimple{}, &authToken{}})
+	if p := getActiveProviders(); len(getAuthenticatorSnapshot().active) != 1 || p.Authenticators[0].Enabled || !p.Authenticators[1].Enabled {
+		t.Errorf("Expected simple authenticator to stay disabled, got %v", p.Authenticators)
+	}
+
+	if code := toggle(http.MethodPost, "simple"); code != http.StatusNoContent || len(getAuthenticatorSnapshot().active) != 2 {
+		t.Errorf("Expected authenticator to be enabled, got status %d", code)
+	}
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"fmt"
+	"math/rand"
 	"net/http"
-	"net/url"
-	"os"
-	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/Luzifer/go_helpers/str"
 )
@@ -18,39 +18,156 @@ import (
 type auditEvent string
 
 const (
-	auditEventAccessDenied            = "access_denied"
-	auditEventLoginFailure            = "login_failure"
-	auditEventLoginSuccess auditEvent = "login_success"
-	auditEventLogout                  = "logout"
-	auditEventValidate                = "validate"
+	auditEventACLDecision                       = "acl_decision"
+	auditEventAccountLocked                     = "account_locked"
+	auditEventAccountUnlocked                   = "account_unlocked"
+	auditEventACLShadowDecision                 = "acl_shadow_decision"
+	auditEventAccessDenied                      = "access_denied"
+	auditEventBannerChanged                     = "banner_changed"
+	auditEventConfigReloaded                    = "config_reloaded"
+	auditEventGroupsInvalidated                 = "groups_invalidated"
+	auditEventLoginFailure                      = "login_failure"
+	auditEventLoginSuccess           auditEvent = "login_success"
+	auditEventLogout                            = "logout"
+	auditEventMaintenanceChanged                = "maintenance_changed"
+	auditEventMFAFailure                        = "mfa_failure"
+	auditEventMFARequired                       = "mfa_required"
+	auditEventMFASuccess                        = "mfa_success"
+	auditEventPasswordChanged                   = "password_changed"
+	auditEventPasswordReset                     = "password_reset"
+	auditEventPasswordResetRequested            = "password_reset_requested"
+	auditEventProviderChanged                   = "provider_changed"
+	auditEventRegistrationApproved              = "registration_approved"
+	auditEventRegistrationRejected              = "registration_rejected"
+	auditEventRegistrationRequested             = "registration_requested"
+	auditEventRegistrationVerified              = "registration_verified"
+	auditEventServiceAccountRotated             = "service_account_rotated"
+	auditEventSessionCreated                    = "session_created"
+	auditEventSessionsRevoked                   = "sessions_revoked"
+	auditEventTermsAccepted                     = "terms_accepted"
+	auditEventTokenCreated                      = "token_created"
+	auditEventTokenRevoked                      = "token_revoked"
+	auditEventValidate                          = "validate"
 )
 
-type auditLogger struct {
-	Targets          []string `yaml:"targets"`
-	Events           []string `yaml:"events"`
-	Headers          []string `yaml:"headers"`
-	TrustedIPHeaders []string `yaml:"trusted_ip_headers"`
+// auditEventCategories groups the events for consumers only interested
+// in some kinds of events
+var auditEventCategories = map[auditEvent]string{
+	auditEventACLDecision:            "authorization",
+	auditEventACLShadowDecision:      "authorization",
+	auditEventAccessDenied:           "authorization",
+	auditEventAccountLocked:          "authentication",
+	auditEventAccountUnlocked:        "admin",
+	auditEventBannerChanged:          "admin",
+	auditEventConfigReloaded:         "admin",
+	auditEventGroupsInvalidated:      "admin",
+	auditEventLoginFailure:           "authentication",
+	auditEventLoginSuccess:           "authentication",
+	auditEventLogout:                 "authentication",
+	auditEventMaintenanceChanged:     "admin",
+	auditEventMFAFailure:             "authentication",
+	auditEventMFARequired:            "authentication",
+	auditEventMFASuccess:             "authentication",
+	auditEventPasswordChanged:        "authentication",
+	auditEventPasswordReset:          "authentication",
+	auditEventPasswordResetRequested: "authentication",
+	auditEventProviderChanged:        "admin",
+	auditEventRegistrationApproved:   "admin",
+	auditEventRegistrationRejected:   "admin",
+	auditEventRegistrationRequested:  "authentication",
+	auditEventRegistrationVerified:   "authentication",
+	auditEventServiceAccountRotated:  "admin",
+	auditEventSessionCreated:         "session",
+	auditEventSessionsRevoked:        "session",
+	auditEventTermsAccepted:          "authentication",
+	auditEventTokenCreated:           "session",
+	auditEventTokenRevoked:           "session",
+	auditEventValidate:               "authentication",
+}
+
+func init() {
+	// The audit log and the webhooks receive all events on the event bus
+	subscribeEvents(func(e authEvent) {
+		fields := map[string]string{}
+		for k, v := range e.Fields {
+			fields[k] = v
+		}
+		if e.User != "" && fields["username"] == "" {
+			fields["username"] = e.User
+		}
 
-	lock sync.Mutex
+		getMainConfig().AuditLog.Log(e.Type, e.Request, fields)
+	})
 }
 
-func (a *auditLogger) Log(event auditEvent, r *http.Request, extraFields map[string]string) error {
-	if len(a.Targets) == 0 {
-		return nil
+// auditLogLock serializes the writes of all audit loggers
+var auditLogLock sync.Mutex
+
+type auditLogger struct {
+	Targets            []string          `yaml:"targets"`
+	Events             []string          `yaml:"events"`
+	Headers            []string          `yaml:"headers"`
+	TrustedIPHeaders   []string          `yaml:"trusted_ip_headers"`
+	DecisionSampleRate float64           `yaml:"decision_sample_rate"`
+	WebhookHeaders     map[string]string `yaml:"webhook_headers"`
+	RecentEvents       int               `yaml:"recent_events"`
+}
+
+// Validate checks the targets and events
+func (a *auditLogger) Validate() error {
+	for _, target := range a.Targets {
+		if err := validateAuditTarget(target); err != nil {
+			return errors.Wrapf(err, "Target %q is invalid", target)
+		}
+	}
+
+	for _, event := range a.Events {
+		if _, ok := auditEventCategories[auditEvent(event)]; !ok {
+			return errors.Errorf("Event %q is unknown", event)
+		}
+	}
+
+	if a.RecentEvents < 0 {
+		return errors.New("Recent events must not be negative")
 	}
 
-	if !str.StringInSlice(string(event), a.Events) {
+	return nil
+}
+
+// receivers returns whether the event is written to the audit log and
+// the webhooks subscribed to it. Webhooks subscribe to events on their
+// own, the event is only written to the audit log if configured there.
+func (a *auditLogger) receivers(event auditEvent) (bool, webhooksConfig) {
+	audited := (len(a.Targets) > 0 || a.RecentEvents > 0) && str.StringInSlice(string(event), a.Events)
+	return audited, getMainConfig().Webhooks.Subscribed(event)
+}
+
+func (a *auditLogger) Log(event auditEvent, r *http.Request, extraFields map[string]string) error {
+	audited, hooks := a.receivers(event)
+	if !audited && len(hooks) == 0 {
 		return nil
 	}
 
-	// Ensure order of logs, prevent file operation collisions
-	a.lock.Lock()
-	defer a.lock.Unlock()
+	// Ensure order of logs, prevent file operation collisions. The lock
+	// is shared by the configurations to not interleave the writes of
+	// requests started before a reload with newer ones.
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
 
-	// Compile log event
+	// Compile log event, the extra fields are added on the top level
+	// next to the common fields
+	now := time.Now()
 	evt := map[string]interface{}{}
+	evt["timestamp"] = now.UTC().Format(time.RFC3339Nano)
 	evt["event_type"] = event
+	evt["category"] = auditEventCategories[event]
 	evt["remote_addr"] = a.findIP(r)
+	if id := getRequestID(r); id != "" {
+		evt["request_id"] = id
+	}
+	if realm := getRealmName(r); realm != "" {
+		evt["realm"] = realm
+	}
 
 	if extraFields != nil {
 		for k, v := range extraFields {
@@ -67,69 +184,116 @@ func (a *auditLogger) Log(event auditEvent, r *http.Request, extraFields map[str
 
 	evt["headers"] = headers
 
-	// Submit event to all specified targets
-	for _, target := range a.Targets {
-		if err := a.submitLog(target, evt); err != nil {
-			return errors.Wrapf(err, "Could not submit log to target %q", target)
-		}
+	line, err := json.Marshal(evt)
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal event")
 	}
 
-	return nil
-}
+	if err := hooks.Fire(line); err != nil {
+		requestLog(r).WithError(err).WithField("event_type", event).Error("Unable to submit webhook")
+	}
 
-func (a *auditLogger) findIP(r *http.Request) string {
-	remoteAddr := strings.SplitN(r.RemoteAddr, ":", 2)[0]
+	if !audited {
+		return nil
+	}
 
-	for _, hdr := range a.TrustedIPHeaders {
-		if value := r.Header.Get(hdr); value != "" {
-			return strings.SplitN(value, ",", 2)[0]
+	if a.RecentEvents > 0 {
+		recentAuditEvents.Add(a.RecentEvents, recentAuditEvent{
+			eventType: string(event),
+			username:  extraFields["username"],
+			timestamp: now,
+			line:      line,
+		})
+	}
+
+	// Submit event to all specified targets, a failing target must not
+	// prevent the event from reaching the others
+	var errs []string
+	for _, target := range a.Targets {
+		sink, err := getAuditSink(target)
+		if err == nil {
+			err = sink.Write(line)
+		}
+		if err != nil {
+			requestLog(r).WithError(err).WithField("event_type", event).Error("Unable to submit audit event")
+			errs = append(errs, fmt.Sprintf("%s: %s", target, err))
 		}
 	}
 
-	return remoteAddr
+	if len(errs) > 0 {
+		return errors.Errorf("Could not submit event to targets: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
 }
 
-func (a *auditLogger) submitLog(target string, event map[string]interface{}) error {
-	u, err := url.Parse(target)
-	if err != nil {
-		return errors.Wrap(err, "Unable to parse target")
+// LogDecision logs the decision of the ACL together with the rule set
+// responsible for it. Decisions are always logged on debug level, the
+// audit log only contains the configured fraction of them.
+func (a *auditLogger) LogDecision(r *http.Request, user, result, ruleID string) error {
+	// Decisions are logged for every request, the fields are only
+	// collected if the decision is written anywhere
+	if log.GetLevel() >= log.DebugLevel {
+		requestLog(r).WithFields(log.Fields{
+			"user":    user,
+			"host":    requestHost(r),
+			"path":    requestURI(r),
+			"result":  result,
+			"rule_id": ruleID,
+		}).Debug("ACL decision")
 	}
 
-	switch u.Scheme {
-	case "fd":
-		return a.submitLogFileDescriptor(u.Host, event)
-	case "file":
-		return a.submitLogFile(u.Path, event)
-	default:
-		return errors.Errorf("Unsupported target scheme %q", u.Scheme)
+	if audited, hooks := a.receivers(auditEventACLDecision); !audited && len(hooks) == 0 {
+		return nil
 	}
-}
 
-func (a *auditLogger) submitLogFile(filename string, event map[string]interface{}) error {
-	if err := os.MkdirAll(path.Dir(filename), 0600); err != nil {
-		return errors.Wrap(err, "Unable to create required paths")
+	if a.DecisionSampleRate < 1 && rand.Float64() >= a.DecisionSampleRate {
+		return nil
 	}
 
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		return errors.Wrap(err, "Unable to open audit file")
+	return a.Log(auditEventACLDecision, r, map[string]string{
+		"username": user,
+		"host":     requestHost(r),
+		"path":     requestURI(r),
+		"result":   result,
+		"rule_id":  ruleID,
+	})
+}
+
+// LogShadowDecision logs the result of a shadow rule set which does
+// not influence the real decision. Shadow decisions are not sampled.
+func (a *auditLogger) LogShadowDecision(r *http.Request, user, result, shadowResult, ruleID string) error {
+	fields := map[string]string{
+		"username":     user,
+		"host":         requestHost(r),
+		"path":         requestURI(r),
+		"result":       result,
+		"rule_id":      ruleID,
+		"would_result": shadowResult,
 	}
-	defer f.Close()
 
-	return json.NewEncoder(f).Encode(event)
+	requestLog(r).WithFields(log.Fields{
+		"user":         fields["username"],
+		"host":         fields["host"],
+		"path":         fields["path"],
+		"result":       result,
+		"rule_id":      ruleID,
+		"would_result": shadowResult,
+	}).Info("ACL shadow decision")
+
+	return a.Log(auditEventACLShadowDecision, r, fields)
 }
 
-func (a *auditLogger) submitLogFileDescriptor(descriptor string, event map[string]interface{}) error {
-	var w io.Writer
+func (a *auditLogger) findIP(r *http.Request) string {
+	if len(getMainConfig().trustedProxyNets) > 0 {
+		return getMainConfig().trustedClientIP(r)
+	}
 
-	switch descriptor {
-	case "stdout":
-		w = os.Stdout
-	case "stderr":
-		w = os.Stderr
-	default:
-		return errors.Errorf("Unsupported file descriptor %q", descriptor)
+	for _, hdr := range a.TrustedIPHeaders {
+		if value := r.Header.Get(hdr); value != "" {
+			return strings.SplitN(value, ",", 2)[0]
+		}
 	}
 
-	return errors.Wrap(json.NewEncoder(w).Encode(event), "Unable to marshal event")
+	return remoteIP(r)
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultRecentAuditEventsLimit = 100
+
+// recentAuditEvents keeps the last events written to the audit log to
+// be queried through the admin API. It is kept outside of the config
+// to survive reloads.
+var recentAuditEvents = &auditEventBuffer{}
+
+type recentAuditEvent struct {
+	eventType string
+	username  string
+	timestamp time.Time
+	line      json.RawMessage
+}
+
+type auditEventBuffer struct {
+	events []recentAuditEvent
+	lock   sync.RWMutex
+}
+
+// Add stores the event and drops the oldest events exceeding size
+func (b *auditEventBuffer) Add(size int, evt recentAuditEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.events = append(b.events, evt)
+	if len(b.events) > size {
+		b.events = append([]recentAuditEvent{}, b.events[len(b.events)-size:]...)
+	}
+}
+
+// Query returns up to limit events, newest first, matching the given
+// filters. Empty filters match all events.
+func (b *auditEventBuffer) Query(eventType, username string, since time.Time, limit int) []json.RawMessage {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	out := []json.RawMessage{}
+	for i := len(b.events) - 1; i >= 0 && len(out) < limit; i-- {
+		e := b.events[i]
+		switch {
+		case eventType != "" && e.eventType != eventType:
+		case username != "" && e.username != username:
+		case e.timestamp.Before(since):
+		default:
+			out = append(out, e.line)
+		}
+	}
+
+	return out
+}
+
+func handleAdminAuditRequest(res http.ResponseWriter, r *http.Request) {
+	if _, ok := detectAdmin(res, r); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if getMainConfig().AuditLog.RecentEvents == 0 {
+		http.Error(res, "Recent audit events are not kept", http.StatusNotImplemented)
+		return
+	}
+
+	var (
+		query = r.URL.Query()
+		limit = defaultRecentAuditEventsLimit
+		since time.Time
+		err   error
+	)
+
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(res, "Parameter limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := query.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			d, derr := time.ParseDuration(v)
+			if derr != nil {
+				http.Error(res, "Parameter since must be a RFC3339 time or a duration", http.StatusBadRequest)
+				return
+			}
+			since = time.Now().Add(-d)
+		}
+	}
+
+	events := recentAuditEvents.Query(query.Get("event"), query.Get("user"), since, limit)
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(events); err != nil {
+		requestLog(r).WithError(err).Error("Unable to encode audit events")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	deliveryQueueSize   = 1000
+	deliveryAttempts    = 3
+	auditKafkaBatchSize = 100
+	auditWebhookTimeout = 10 * time.Second
+)
+
+var (
+	// auditSinks keeps the sinks by their target to keep queues and
+	// connections across events and reloads
+	auditSinks     = map[string]auditSink{}
+	auditSinksLock sync.Mutex
+)
+
+// auditSink is a destination for audit events. Events are passed as
+// encoded JSON objects.
+type auditSink interface {
+	Write(event []byte) error
+}
+
+// getAuditSink returns the sink for the target. Network sinks
+// (webhooks, Kafka) deliver the events asynchronously to not delay the
+// requests; local targets are shared with the log outputs.
+func getAuditSink(target string) (auditSink, error) {
+	auditSinksLock.Lock()
+	defer auditSinksLock.Unlock()
+
+	if s, ok := auditSinks[target]; ok {
+		return s, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse target")
+	}
+
+	var sink auditSink
+	switch u.Scheme {
+	case "http", "https":
+		sink = newDeliveryQueue(u.Redacted(), 1, webhookAuditSink{url: target}.Deliver)
+
+	case "kafka":
+		p, err := newKafkaProducer(u)
+		if err != nil {
+			return nil, err
+		}
+		sink = newDeliveryQueue(u.Redacted(), auditKafkaBatchSize, p.Produce)
+
+	default:
+		out, err := getLogOutput(target)
+		if err != nil {
+			return nil, err
+		}
+		sink = logOutputAuditSink{out}
+	}
+
+	auditSinks[target] = sink
+	return sink, nil
+}
+
+// validateAuditTarget checks the target without connecting to it
+func validateAuditTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return errors.Wrap(err, "Unable to parse target")
+	}
+
+	switch u.Scheme {
+	case "fd", "syslog":
+		return nil
+	case "file":
+		if u.Path == "" {
+			return errors.New("File target needs a path")
+		}
+		return nil
+	case "http", "https":
+		if u.Host == "" {
+			return errors.New("Webhook target needs a host")
+		}
+		return nil
+	case "kafka":
+		_, err := newKafkaProducer(u)
+		return err
+	default:
+		return errors.Errorf("Unsupported target scheme %q", u.Scheme)
+	}
+}
+
+type logOutputAuditSink struct {
+	out logOutput
+}
+
+func (l logOutputAuditSink) Write(event []byte) error {
+	return l.out.WriteLevel(log.InfoLevel, append(event, '\n'))
+}
+
+// deliveryQueue buffers events for a network sink and delivers them in
+// batches of up to batchSize events in the background. Failed batches
+// are retried and dropped after the configured attempts, events are
+// dropped if the queue is full. It is shared by the audit sinks, the
+// trace exporter and the webhooks.
+type deliveryQueue struct {
+	name      string
+	batchSize int
+	attempts  int
+	backoff   func(attempt int) time.Duration
+	deliver   func([][]byte) error
+	events    chan []byte
+}
+
+func newDeliveryQueue(name string, batchSize int, deliver func([][]byte) error) *deliveryQueue {
+	return newRetryingDeliveryQueue(name, batchSize, deliveryAttempts, func(attempt int) time.Duration {
+		return time.Duration(attempt) * time.Second
+	}, deliver)
+}
+
+// newRetryingDeliveryQueue creates a queue trying to deliver each batch
+// up to attempts times, waiting for backoff(attempt) after each failed
+// attempt
+func newRetryingDeliveryQueue(name string, batchSize, attempts int, backoff func(int) time.Duration, deliver func([][]byte) error) *deliveryQueue {
+	q := &deliveryQueue{
+		name:      name,
+		batchSize: batchSize,
+		attempts:  attempts,
+		backoff:   backoff,
+		deliver:   deliver,
+		events:    make(chan []byte, deliveryQueueSize),
+	}
+	go q.run()
+	return q
+}
+
+func (a *deliveryQueue) Write(event []byte) error {
+	select {
+	case a.events <- event:
+		return nil
+	default:
+		return errors.Errorf("Queue for %s is full, event dropped", a.name)
+	}
+}
+
+func (a *deliveryQueue) run() {
+	for event := range a.events {
+		batch := [][]byte{event}
+	collect:
+		for len(batch) < a.batchSize {
+			select {
+			case e := <-a.events:
+				batch = append(batch, e)
+			default:
+				break collect
+			}
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := a.deliver(batch)
+			if err == nil {
+				break
+			}
+
+			if attempt >= a.attempts {
+				log.WithError(err).WithFields(log.Fields{
+					"sink":   a.name,
+					"events": len(batch),
+				}).Error("Unable to deliver events, dropping them")
+				break
+			}
+
+			time.Sleep(a.backoff(attempt))
+		}
+	}
+}
+
+// webhookAuditSink posts every event as JSON object to the URL, basic
+// auth credentials can be passed in the URL
+type webhookAuditSink struct {
+	url string
+}
+
+var webhookAuditClient = &http.Client{Timeout: auditWebhookTimeout}
+
+func (w webhookAuditSink) Deliver(events [][]byte) error {
+	for _, event := range events {
+		req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(event))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "nginx-sso/"+version)
+		for k, v := range getMainConfig().AuditLog.WebhookHeaders {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := webhookAuditClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return errors.Errorf("Webhook responded with status %d", resp.StatusCode)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuditWebhookSink(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "audit" || pass != "secret" || r.Header.Get("X-Tenant") != "sso" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		evt := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&evt)
+		received <- evt
+	}))
+	defer srv.Close()
+
+	target := "http://audit:secret@" + srv.Listener.Addr().String() + "/events"
+	a := &auditLogger{
+		Targets:        []string{target},
+		Events:         []string{string(auditEventMFASuccess)},
+		WebhookHeaders: map[string]string{"X-Tenant": "sso"},
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatalf("Unable to validate audit log: %s", err)
+	}
+
+	getMainConfig().AuditLog.WebhookHeaders = a.WebhookHeaders
+	defer func() { getMainConfig().AuditLog.WebhookHeaders = nil }()
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	if err := a.Log(auditEventMFASuccess, r, map[string]string{"username": "alice"}); err != nil {
+		t.Fatalf("Unable to log event: %s", err)
+	}
+
+	select {
+	case evt := <-received:
+		if evt["event_type"] != "mfa_success" || evt["category"] != "authentication" || evt["username"] != "alice" || evt["timestamp"] == nil {
+			t.Errorf("Unexpected event %v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was not delivered")
+	}
+
+	if err := (&auditLogger{Events: []string{"unknown"}}).Validate(); err == nil {
+		t.Error("Expected unknown event to be rejected")
+	}
+	if err := (&auditLogger{Targets: []string{"kafka://broker:9092"}}).Validate(); err == nil {
+		t.Error("Expected Kafka target without topic to be rejected")
+	}
+}
+
+func TestKafkaProducer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	produced := make(chan [][]byte, 1)
+	go fakeKafkaBroker(t, l, produced)
+
+	u, _ := url.Parse("kafka://" + l.Addr().String() + "/audit")
+	p, err := newKafkaProducer(u)
+	if err != nil {
+		t.Fatalf("Unable to create producer: %s", err)
+	}
+
+	if err := p.Produce([][]byte{[]byte(`{"event_type":"logout"}`), []byte(`{"event_type":"login_success"}`)}); err != nil {
+		t.Fatalf("Unable to produce: %s", err)
+	}
+
+	select {
+	case values := <-produced:
+		if len(values) != 2 || string(values[1]) != `{"event_type":"login_success"}` {
+			t.Errorf("Unexpected records %q", values)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Records were not produced")
+	}
+}
+
+// fakeKafkaBroker answers metadata requests with itself as leader of
+// partition 0 and decodes the record batches of produce requests
+func fakeKafkaBroker(t *testing.T, l net.Listener, produced chan [][]byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		req := &kafkaDecoder{r: bytes.NewReader(data)}
+		apiKey, _, correlationID := req.Int16(), req.Int16(), req.Int32()
+		req.Text() // client_id
+
+		resp := &kafkaEncoder{}
+		resp.Int32(correlationID)
+
+		switch apiKey {
+		case kafkaAPIMetadata:
+			resp.Int32(1) // brokers
+			resp.Int32(1)
+			resp.String("127.0.0.1")
+			resp.Int32(int32(port))
+			resp.Int16(-1) // rack
+			resp.Int32(1)  // controller_id
+			resp.Int32(1)  // topics
+			resp.Int16(0)
+			resp.String("audit")
+			resp.Int8(0)
+			resp.Int32(1) // partitions
+			resp.Int16(0)
+			resp.Int32(0) // partition
+			resp.Int32(1) // leader
+			resp.Int32(1) // replicas
+			resp.Int32(1)
+			resp.Int32(1) // isr
+			resp.Int32(1)
+
+		case kafkaAPIProduce:
+			req.Int16() // transactional_id
+			req.Int16() // acks
+			req.Int32() // timeout
+			req.Int32()
+			req.Text()
+			req.Int32()
+			req.Int32()
+			batch := make([]byte, req.Int32())
+			io.ReadFull(req.r, batch)
+			produced <- decodeKafkaRecordBatch(t, batch)
+
+			resp.Int32(1) // topics
+			resp.String("audit")
+			resp.Int32(1) // partitions
+			resp.Int32(0)
+			resp.Int16(0)  // error_code
+			resp.Int64(0)  // base_offset
+			resp.Int64(-1) // log_append_time
+			resp.Int32(0)  // throttle_time
+		}
+
+		out := &kafkaEncoder{}
+		out.Bytes(resp.buf.Bytes())
+		conn.Write(out.buf.Bytes())
+	}
+}
+
+func decodeKafkaRecordBatch(t *testing.T, batch []byte) [][]byte {
+	// base_offset, batch_length, partition_leader_epoch, magic, crc
+	if batch[16] != 2 {
+		t.Errorf("Unexpected magic %d", batch[16])
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:21]); crc != crc32.Checksum(batch[21:], kafkaCRCTable) {
+		t.Error("CRC of record batch does not match")
+	}
+
+	r := bytes.NewReader(batch[21+2+4+8+8+8+2+4:])
+	var count int32
+	binary.Read(r, binary.BigEndian, &count)
+
+	values := [][]byte{}
+	for i := int32(0); i < count; i++ {
+		length, _ := binary.ReadVarint(r)
+		buf := make([]byte, length)
+		io.ReadFull(r, buf)
+		rec := bytes.NewReader(buf)
+
+		rec.ReadByte()         // attributes
+		binary.ReadVarint(rec) // timestamp delta
+		binary.ReadVarint(rec) // offset delta
+		binary.ReadVarint(rec) // key length
+		l, _ := binary.ReadVarint(rec)
+		value := make([]byte, l)
+		io.ReadFull(rec, value)
+		values = append(values, value)
+	}
+
+	return values
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+// benchmarkACL returns an ACL with a rule set for every one of n hosts
+// granting access to the benchmark user for its host
+func benchmarkACL(b *testing.B, n int) acl.ACL {
+	a := acl.ACL{}
+	for i := 0; i < n; i++ {
+		a.RuleSets = append(a.RuleSets, acl.RuleSet{
+			Rules: []acl.Rule{
+				{Field: "host", MatchString: aclTestString(fmt.Sprintf("app%d.example.com", i))},
+				{Field: "x-origin-uri", MatchRegex: aclTestString("^/")},
+			},
+			Allow: []string{"alice"},
+		})
+	}
+	if err := a.Compile(); err != nil {
+		b.Fatalf("ACL did not compile: %s", err)
+	}
+	return a
+}
+
+func benchmarkAuthRequest(b *testing.B, header, value string) {
+	res := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set(header, value)
+	r.Header.Set("X-Host", "app250.example.com")
+	r.Header.Set("X-Origin-URI", "/dashboard")
+
+	handleAuthRequest(res, r)
+	if res.Code != http.StatusOK {
+		b.Fatalf("Expected request to be authorized, got status %d", res.Code)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set(header, value)
+		r.Header.Set("X-Host", "app250.example.com")
+		r.Header.Set("X-Origin-URI", "/dashboard")
+		handleAuthRequest(res, r)
+	}
+}
+
+func BenchmarkAuthRequest(b *testing.B) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	prevAuthenticators, prevACL := getAuthenticatorSnapshot(), getACL()
+	defer func() {
+		authenticatorState.Store(prevAuthenticators)
+		setACL(prevACL)
+	}()
+	simple := &authSimple{Users: map[string]string{"alice": string(hash)}}
+	setAuthenticators([]authenticator{
+		&authToken{Tokens: map[string]string{"alice": "benchmark-token"}},
+		simple,
+	})
+	setACL(benchmarkACL(b, 500))
+
+	m := mainConfig{}
+	m.Cookie.AuthKey = "cookie-key-for-the-auth-benchmark"
+	if err := cookieStore.Configure(&m); err != nil {
+		b.Fatalf("Unable to configure cookie store: %s", err)
+	}
+
+	login := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("simple-username=alice&simple-password=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, _, err := simple.Login(context.Background(), login, r); err != nil {
+		b.Fatalf("Unable to log in: %s", err)
+	}
+	cookies := []string{}
+	for _, c := range login.Result().Cookies() {
+		cookies = append(cookies, c.Name+"="+c.Value)
+	}
+
+	b.Run("token", func(b *testing.B) { benchmarkAuthRequest(b, "Authorization", "Token benchmark-token") })
+	b.Run("session", func(b *testing.B) { benchmarkAuthRequest(b, "Cookie", strings.Join(cookies, "; ")) })
+}
+
+func BenchmarkACLEvaluate(b *testing.B) {
+	a := benchmarkACL(b, 500)
+	r := aclTestRequest(map[string]string{"X-Host": "app499.example.com", "X-Origin-URI": "/dashboard"})
+
+	if !aclTestHasAccess(a, "alice", nil, r) {
+		b.Fatal("Expected user to have access")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aclTestHasAccess(a, "alice", nil, r)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultAuthCacheTTL = 10 * time.Second
+
+// authCacheConfig controls the caching headers on /auth responses to
+// allow nginx to cache the auth subrequest using proxy_cache
+type authCacheConfig struct {
+	Enable bool          `yaml:"enable"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// setHeaders marks successful responses as cacheable per cookie and
+// authorization header. Responses setting cookies and failed requests
+// are never cached.
+func (a authCacheConfig) setHeaders(header http.Header, status int) {
+	if !a.Enable {
+		return
+	}
+
+	if status != http.StatusOK || len(header["Set-Cookie"]) > 0 || a.TTL <= 0 {
+		header.Set("Cache-Control", "no-store")
+		return
+	}
+
+	header.Set("Cache-Control", "max-age="+strconv.Itoa(int(a.TTL/time.Second)))
+	header.Add("Vary", "Cookie")
+	header.Add("Vary", "Authorization")
+}
+
+// authCacheHeaderWriter adds the caching headers right before the
+// status is written as only then the result of the request is known
+type authCacheHeaderWriter struct {
+	http.ResponseWriter
+	cfg         authCacheConfig
+	wroteHeader bool
+}
+
+func (a *authCacheHeaderWriter) WriteHeader(status int) {
+	if !a.wroteHeader {
+		a.wroteHeader = true
+		a.cfg.setHeaders(a.Header(), status)
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *authCacheHeaderWriter) Write(p []byte) (int, error) {
+	if !a.wroteHeader {
+		a.WriteHeader(http.StatusOK)
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+func withAuthCacheHeaders(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		cfg := getMainConfig().AuthCache
+		if r.Header.Get(dpopHeader) != "" {
+			// DPoP proofs are valid for one request only
+			cfg.TTL = 0
+		}
+		if _, ok := maintenanceFor(r); ok {
+			// The decision must not outlive the maintenance mode
+			cfg.TTL = 0
+		}
+		h(&authCacheHeaderWriter{ResponseWriter: res, cfg: cfg}, r)
+	}
+}
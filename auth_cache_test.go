@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthCacheHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		cfg          authCacheConfig
+		status       int
+		setCookie    bool
+		cacheControl string
+		vary         int
+	}{
+		{authCacheConfig{}, http.StatusOK, false, "", 0},
+		{authCacheConfig{Enable: true, TTL: 10 * time.Second}, http.StatusOK, false, "max-age=10", 2},
+		{authCacheConfig{Enable: true, TTL: 10 * time.Second}, http.StatusOK, true, "no-store", 0},
+		{authCacheConfig{Enable: true, TTL: 10 * time.Second}, http.StatusUnauthorized, false, "no-store", 0},
+		{authCacheConfig{Enable: true}, http.StatusOK, false, "no-store", 0},
+	} {
+		rec := httptest.NewRecorder()
+		w := &authCacheHeaderWriter{ResponseWriter: rec, cfg: tc.cfg}
+		if tc.setCookie {
+			w.Header().Set("Set-Cookie", "nginx-sso=refreshed")
+		}
+		w.WriteHeader(tc.status)
+
+		if cc := rec.Header().Get("Cache-Control"); cc != tc.cacheControl {
+			t.Errorf("Config %+v, status %d: Expected Cache-Control %q, got %q", tc.cfg, tc.status, tc.cacheControl, cc)
+		}
+		if vary := len(rec.Header()["Vary"]); vary != tc.vary {
+			t.Errorf("Config %+v, status %d: Expected %d Vary headers, got %d", tc.cfg, tc.status, tc.vary, vary)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"net/url"
 	"strings"
 
 	crowd "github.com/jda/go-crowd"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -60,9 +63,9 @@ func (a *authCrowd) Configure(yamlSource []byte) error {
 
 // DetectUser is used to detect a user without a login form from
 // a cookie, header or other methods
-// If no user was detected the errNoValidUserFound needs to be
+// If no user was detected the errNoUser needs to be
 // returned
-func (a authCrowd) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+func (a authCrowd) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
 	cc, err := a.crowd.GetCookieConfig()
 	if err != nil {
 		return "", nil, err
@@ -74,22 +77,34 @@ func (a authCrowd) DetectUser(res http.ResponseWriter, r *http.Request) (string,
 		// Fine, we do have a cookie
 	case http.ErrNoCookie:
 		// Also fine, there is no cookie
-		return "", nil, errNoValidUserFound
+		return "", nil, errNoUser
 	default:
 		return "", nil, err
 	}
 
 	ssoToken := cookie.Value
-	sess, err := a.crowd.GetSession(ssoToken)
+	s := startClientSpan(r, "crowd get_session", a.URL)
+	var sess crowd.Session
+	err = callWithContext(ctx, func() (err error) {
+		sess, err = a.crowd.GetSession(ssoToken)
+		return err
+	})
+	s.Finish(err)
 	if err != nil {
-		log.WithError(err).Debug("Getting crowd session failed")
-		return "", nil, errNoValidUserFound
+		requestLog(r).WithError(err).Debug("Getting crowd session failed")
+		return "", nil, crowdError(err, errNoUser)
 	}
 
 	user := sess.User.UserName
-	cGroups, err := a.crowd.GetDirectGroups(user)
+	s = startClientSpan(r, "crowd get_direct_groups", a.URL)
+	var cGroups []*crowd.Group
+	err = callWithContext(ctx, func() (err error) {
+		cGroups, err = a.crowd.GetDirectGroups(user)
+		return err
+	})
+	s.Finish(err)
 	if err != nil {
-		return "", nil, err
+		return "", nil, crowdError(err, err)
 	}
 
 	groups := []string{}
@@ -104,9 +119,9 @@ func (a authCrowd) DetectUser(res http.ResponseWriter, r *http.Request) (string,
 // to authenticate the user or throw an error. If the user has
 // successfully logged in the persistent cookie should be written
 // in order to use DetectUser for the next login.
-// If the user did not login correctly the errNoValidUserFound
+// If the user did not login correctly the errNoUser
 // needs to be returned
-func (a authCrowd) Login(res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+func (a authCrowd) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
 	username := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
 	password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
 
@@ -115,12 +130,18 @@ func (a authCrowd) Login(res http.ResponseWriter, r *http.Request) (string, []mf
 		return "", nil, err
 	}
 
-	sess, err := a.crowd.NewSession(username, password, r.RemoteAddr)
+	s := startClientSpan(r, "crowd new_session", a.URL)
+	var sess crowd.Session
+	err = callWithContext(ctx, func() (err error) {
+		sess, err = a.crowd.NewSession(username, password, r.RemoteAddr)
+		return err
+	})
+	s.Finish(err)
 	if err != nil {
-		log.WithFields(log.Fields{
+		requestLog(r).WithFields(log.Fields{
 			"username": username,
 		}).WithError(err).Debug("Crowd authentication failed")
-		return "", nil, errNoValidUserFound
+		return "", nil, crowdError(err, errWrongCredentials)
 	}
 
 	http.SetCookie(res, &http.Cookie{
@@ -158,7 +179,7 @@ func (a authCrowd) LoginFields() (fields []loginField) {
 
 // Logout is called when the user visits the logout endpoint and
 // needs to destroy any persistent stored cookies
-func (a authCrowd) Logout(res http.ResponseWriter, r *http.Request) (err error) {
+func (a authCrowd) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) (err error) {
 	cc, err := a.crowd.GetCookieConfig()
 	if err != nil {
 		return err
@@ -177,9 +198,44 @@ func (a authCrowd) Logout(res http.ResponseWriter, r *http.Request) (err error)
 	return nil
 }
 
+// UpstreamLogout invalidates the SSO token at the Crowd server to
+// also log the user out of all other applications using Crowd SSO
+func (a authCrowd) UpstreamLogout(res http.ResponseWriter, r *http.Request, returnTo string) (string, error) {
+	cc, err := a.crowd.GetCookieConfig()
+	if err != nil {
+		return "", err
+	}
+
+	cookie, err := r.Cookie(cc.Name)
+	if err != nil {
+		// No SSO token, nothing to invalidate
+		return "", nil
+	}
+
+	return "", a.crowd.InvalidateSession(cookie.Value)
+}
+
+// CheckReadiness verifies the Crowd server is reachable and accepts the
+// application credentials
+func (a authCrowd) CheckReadiness() error {
+	_, err := a.crowd.GetCookieConfig()
+	return err
+}
+
 // SupportsMFA returns the MFA detection capabilities of the login
 // provider. If the provider can provide mfaConfig objects from its
 // configuration return true. If this is true the login interface
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a authCrowd) SupportsMFA() bool { return false }
+
+// crowdError classifies the errors of the Crowd client: Requests not
+// reaching Crowd are reported as outage, other errors are replaced by
+// the rejection of the user
+func crowdError(err, rejected error) error {
+	var urlErr *url.Error
+	if errors.Is(err, errBackendUnavailable) || errors.As(err, &urlErr) {
+		return backendUnavailable(err)
+	}
+	return rejected
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/flosch/pongo2"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+const (
+	authFailureUnauthenticated = "unauthenticated"
+	authFailureForbidden       = "forbidden"
+	authFailureMaintenance     = "maintenance"
+)
+
+// authFailureResponse describes the response sent instead of the plain
+// text 401 / 403 responses
+type authFailureResponse struct {
+	Status      int    `yaml:"status"`
+	Redirect    string `yaml:"redirect"`
+	ContentType string `yaml:"content_type"`
+	Body        string `yaml:"body"`
+
+	redirect *pongo2.Template
+	body     *pongo2.Template
+}
+
+func compileAuthFailureTemplate(tpl string, autoescape bool) (*pongo2.Template, error) {
+	if !autoescape {
+		tpl = "{% autoescape off %}" + tpl + "{% endautoescape %}"
+	}
+	return pongo2.FromString(tpl)
+}
+
+func (a *authFailureResponse) Compile() error {
+	var err error
+
+	if a.Redirect != "" {
+		if a.Status == 0 {
+			a.Status = http.StatusFound
+		}
+		if a.redirect, err = compileAuthFailureTemplate(a.Redirect, false); err != nil {
+			return fmt.Errorf("Redirect template is invalid: %s", err)
+		}
+	}
+
+	if a.Status != 0 && http.StatusText(a.Status) == "" {
+		return fmt.Errorf("Status %d is invalid", a.Status)
+	}
+
+	if a.Body != "" {
+		if a.ContentType == "" {
+			a.ContentType = "text/plain; charset=utf-8"
+		}
+		// Only HTML bodies get their values escaped, JSON templates need
+		// to use the escapejs filter for user supplied values
+		if a.body, err = compileAuthFailureTemplate(a.Body, strings.Contains(a.ContentType, "html")); err != nil {
+			return fmt.Errorf("Body template is invalid: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// authFailureRule selects the responses for requests to the given hosts
+// and paths
+type authFailureRule struct {
+	Hosts []string `yaml:"hosts"`
+	Paths []string `yaml:"paths"`
+
+	Unauthenticated *authFailureResponse `yaml:"unauthenticated"`
+	Forbidden       *authFailureResponse `yaml:"forbidden"`
+	Maintenance     *authFailureResponse `yaml:"maintenance"`
+
+	paths []*regexp.Regexp
+}
+
+func (a authFailureRule) Matches(r *http.Request) bool {
+	if len(a.Hosts) > 0 && !hostMatches(a.Hosts, requestHost(r)) {
+		return false
+	}
+
+	if len(a.paths) == 0 {
+		return true
+	}
+
+	path := strings.SplitN(requestURI(r), "?", 2)[0]
+	for _, p := range a.paths {
+		if p.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type authFailureConfig []authFailureRule
+
+// Compile prepares the path globs and templates of all rules
+func (a authFailureConfig) Compile() error {
+	for i := range a {
+		rule := &a[i]
+
+		rule.paths = nil
+		for _, p := range rule.Paths {
+			re, err := acl.CompileGlob(p)
+			if err != nil {
+				return fmt.Errorf("Rule on position %d has invalid path %q: %s", i+1, p, err)
+			}
+			rule.paths = append(rule.paths, re)
+		}
+
+		for _, resp := range []*authFailureResponse{rule.Unauthenticated, rule.Forbidden, rule.Maintenance} {
+			if resp == nil {
+				continue
+			}
+			if err := resp.Compile(); err != nil {
+				return fmt.Errorf("Rule on position %d is invalid: %s", i+1, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a authFailureConfig) responseForRequest(r *http.Request, kind string) *authFailureResponse {
+	for _, rule := range a {
+		if !rule.Matches(r) {
+			continue
+		}
+
+		switch kind {
+		case authFailureUnauthenticated:
+			return rule.Unauthenticated
+		case authFailureForbidden:
+			return rule.Forbidden
+		case authFailureMaintenance:
+			return rule.Maintenance
+		}
+	}
+
+	return nil
+}
+
+// originalURL reconstructs the URL the user requested from the headers
+// passed by the proxy
+func originalURL(r *http.Request) string {
+	return requestScheme(r) + "://" + requestHost(r) + requestURI(r)
+}
+
+// Respond sends the configured response for the failure kind or the
+// given status and message if no response is configured
+func (a authFailureConfig) Respond(res http.ResponseWriter, r *http.Request, kind, user string, status int, msg string) {
+	resp := a.responseForRequest(r, kind)
+	if resp == nil {
+		http.Error(res, msg, status)
+		return
+	}
+
+	if resp.Status != 0 {
+		status = resp.Status
+	}
+
+	ctx := pongo2.Context{
+		"error":  msg,
+		"host":   requestHost(r),
+		"status": status,
+		"uri":    requestURI(r),
+		"url":    originalURL(r),
+		"user":   user,
+	}
+
+	if resp.redirect != nil {
+		target, err := resp.redirect.Execute(ctx)
+		if err != nil {
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("Location", strings.TrimSpace(target))
+	}
+
+	if resp.body == nil {
+		if resp.redirect != nil {
+			res.WriteHeader(status)
+			return
+		}
+		http.Error(res, msg, status)
+		return
+	}
+
+	body, err := resp.body.Execute(ctx)
+	if err != nil {
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", resp.ContentType)
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+	fmt.Fprint(res, body)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthFailureResponses(t *testing.T) {
+	a := authFailureConfig{
+		{
+			Paths: []string{"/api/**"},
+			Unauthenticated: &authFailureResponse{
+				ContentType: "application/json",
+				Body:        `{"error":"{{ error }}","uri":"{{ uri|escapejs }}"}`,
+			},
+		},
+		{
+			Hosts: []string{"app.example.com"},
+			Unauthenticated: &authFailureResponse{
+				Redirect: `https://login.example.com/login?go={{ url|urlencode }}`,
+			},
+		},
+	}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("Config did not compile: %s", err)
+	}
+
+	res := httptest.NewRecorder()
+	a.Respond(res, aclTestRequest(map[string]string{"X-Host": "app.example.com", "X-Origin-URI": "/api/users"}),
+		authFailureUnauthenticated, "", http.StatusUnauthorized, "No valid user found")
+	if res.Code != http.StatusUnauthorized || res.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected API response: %d %v", res.Code, res.Header())
+	}
+	if exp := `{"error":"No valid user found","uri":"/api/users"}`; res.Body.String() != exp {
+		t.Errorf("Unexpected body %q", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	a.Respond(res, aclTestRequest(map[string]string{"X-Host": "app.example.com", "X-Origin-URI": "/index.html"}),
+		authFailureUnauthenticated, "", http.StatusUnauthorized, "No valid user found")
+	if exp := "https://login.example.com/login?go=https%3A%2F%2Fapp.example.com%2Findex.html"; res.Code != http.StatusFound || res.Header().Get("Location") != exp {
+		t.Errorf("Unexpected redirect: %d %q", res.Code, res.Header().Get("Location"))
+	}
+
+	res = httptest.NewRecorder()
+	a.Respond(res, aclTestRequest(map[string]string{"X-Host": "app.example.com", "X-Origin-URI": "/index.html"}),
+		authFailureForbidden, aclTestUser, http.StatusForbidden, "Access denied for this resource")
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Unconfigured failure did not use default status, got %d", res.Code)
+	}
+}
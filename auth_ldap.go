@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -11,25 +13,34 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
+const errLDAPPasswordRejected = passwordPolicyViolation("The directory rejected the new password, please choose another one")
+
 func init() {
 	registerAuthenticator(&authLDAP{})
 }
 
 type authLDAP struct {
-	EnableBasicAuth       bool   `yaml:"enable_basic_auth"`
-	GroupMembershipFilter string `yaml:"group_membership_filter"`
-	GroupSearchBase       string `yaml:"group_search_base"`
-	ManagerDN             string `yaml:"manager_dn"`
-	ManagerPassword       string `yaml:"manager_password"`
-	RootDN                string `yaml:"root_dn"`
-	Server                string `yaml:"server"`
-	UserSearchBase        string `yaml:"user_search_base"`
-	UserSearchFilter      string `yaml:"user_search_filter"`
-	UsernameAttribute     string `yaml:"username_attribute"`
+	AllowPasswordChange   bool           `yaml:"allow_password_change"`
+	AllowPasswordReset    bool           `yaml:"allow_password_reset"`
+	ClaimAttributes       []string       `yaml:"claim_attributes"`
+	EmailAttribute        string         `yaml:"email_attribute"`
+	EnableBasicAuth       bool           `yaml:"enable_basic_auth"`
+	GroupMembershipFilter string         `yaml:"group_membership_filter"`
+	GroupSearchBase       string         `yaml:"group_search_base"`
+	ManagerDN             string         `yaml:"manager_dn"`
+	ManagerPassword       string         `yaml:"manager_password"`
+	RootDN                string         `yaml:"root_dn"`
+	Server                string         `yaml:"server"`
+	UserSearchBase        string         `yaml:"user_search_base"`
+	UserSearchFilter      string         `yaml:"user_search_filter"`
+	UsernameAttribute     string         `yaml:"username_attribute"`
+	Pool                  ldapPoolConfig `yaml:"pool"`
 	TLSConfig             *struct {
 		ValidateHostname string `yaml:"validate_hostname"`
 		AllowInsecure    bool   `yaml:"allow_insecure"`
 	} `yaml:"tls_config"`
+
+	pool *ldapPool
 }
 
 // AuthenticatorID needs to return an unique string to identify
@@ -55,6 +66,10 @@ func (a *authLDAP) Configure(yamlSource []byte) error {
 		return errProviderUnconfigured
 	}
 
+	a.AllowPasswordChange = envelope.Providers.LDAP.AllowPasswordChange
+	a.AllowPasswordReset = envelope.Providers.LDAP.AllowPasswordReset
+	a.ClaimAttributes = envelope.Providers.LDAP.ClaimAttributes
+	a.EmailAttribute = envelope.Providers.LDAP.EmailAttribute
 	a.EnableBasicAuth = envelope.Providers.LDAP.EnableBasicAuth
 	a.GroupMembershipFilter = envelope.Providers.LDAP.GroupMembershipFilter
 	a.GroupSearchBase = envelope.Providers.LDAP.GroupSearchBase
@@ -65,9 +80,17 @@ func (a *authLDAP) Configure(yamlSource []byte) error {
 	a.UserSearchBase = envelope.Providers.LDAP.UserSearchBase
 	a.UserSearchFilter = envelope.Providers.LDAP.UserSearchFilter
 	a.UsernameAttribute = envelope.Providers.LDAP.UsernameAttribute
+	a.Pool = envelope.Providers.LDAP.Pool
 	a.TLSConfig = envelope.Providers.LDAP.TLSConfig
 
-	// Set defaults
+	a.setDefaults()
+	a.configurePool()
+
+	return nil
+}
+
+// setDefaults fills the unset options with their default values
+func (a *authLDAP) setDefaults() {
 	if a.UserSearchFilter == "" {
 		a.UserSearchFilter = `(uid={0})`
 	}
@@ -86,51 +109,66 @@ func (a *authLDAP) Configure(yamlSource []byte) error {
 		a.UsernameAttribute = "dn"
 	}
 
-	return nil
+	if a.EmailAttribute == "" {
+		a.EmailAttribute = "mail"
+	}
 }
 
 // DetectUser is used to detect a user without a login form from
 // a cookie, header or other methods
-// If no user was detected the errNoValidUserFound needs to be
+// If no user was detected the errNoUser needs to be
 // returned
-func (a authLDAP) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+func (a authLDAP) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
 	var alias, user string
 
 	if a.EnableBasicAuth {
 		if basicUser, basicPass, ok := r.BasicAuth(); ok {
-			if userDN, a, err := a.checkLogin(basicUser, basicPass, a.UsernameAttribute); err != nil {
+			s := startClientSpan(r, "ldap check_login", a.Server)
+			userDN, userAlias, err := a.checkLogin(ctx, basicUser, basicPass, a.UsernameAttribute)
+			s.Finish(err)
+			if err != nil {
 				return "", nil, err
-			} else {
-				user = userDN
-				alias = a
+			}
+			user = userDN
+			alias = userAlias
+
+			if user != "" {
+				s := startClientSpan(r, "ldap get_user_claims", a.Server)
+				claims, err := a.getUserClaims(ctx, user)
+				s.Finish(err)
+				if err != nil {
+					return "", nil, err
+				}
+				setSessionClaims(r, claims)
 			}
 		}
 	}
 
 	if user == "" {
-		sess, err := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
+		sess, err := getAuthSession(r, a.AuthenticatorID())
 		if err != nil {
-			return "", nil, errNoValidUserFound
+			return "", nil, err
 		}
 
 		var ok bool
 		if user, ok = sess.Values["user"].(string); !ok {
-			return "", nil, errNoValidUserFound
+			return "", nil, errNoUser
 		}
 
 		if alias, ok = sess.Values["alias"].(string); !ok {
 			// Most likely an old cookie, force re-login
-			return "", nil, errNoValidUserFound
+			return "", nil, errNoUser
 		}
 
 		// We had a cookie, lets renew it
-		sess.Options = mainCfg.GetSessionOpts()
-		if err := sess.Save(r, res); err != nil {
+		if err := saveAuthSession(res, r, sess, a.AuthenticatorID(), alias); err != nil {
 			return "", nil, err
 		}
 	}
 
-	groups, err := a.getUserGroups(user, alias)
+	s := startClientSpan(r, "ldap get_user_groups", a.Server)
+	groups, err := a.getUserGroups(ctx, user, alias)
+	s.Finish(err)
 
 	return alias, groups, err
 }
@@ -139,9 +177,9 @@ func (a authLDAP) DetectUser(res http.ResponseWriter, r *http.Request) (string,
 // to authenticate the user or throw an error. If the user has
 // successfully logged in the persistent cookie should be written
 // in order to use DetectUser for the next login.
-// If the user did not login correctly the errNoValidUserFound
+// If the user did not login correctly the errNoUser
 // needs to be returned
-func (a authLDAP) Login(res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+func (a authLDAP) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
 	username := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
 	password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
 
@@ -151,15 +189,31 @@ func (a authLDAP) Login(res http.ResponseWriter, r *http.Request) (string, []mfa
 		err    error
 	)
 
-	if userDN, alias, err = a.checkLogin(username, password, a.UsernameAttribute); err != nil {
+	s := startClientSpan(r, "ldap check_login", a.Server)
+	userDN, alias, err = a.checkLogin(ctx, username, password, a.UsernameAttribute)
+	s.Finish(err)
+	if err != nil {
 		return "", nil, err
 	}
 
-	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
-	sess.Options = mainCfg.GetSessionOpts()
+	sess, err := newAuthSession(r, a.AuthenticatorID())
+	if err != nil {
+		return "", nil, err
+	}
 	sess.Values["user"] = userDN
 	sess.Values["alias"] = alias
-	return userDN, nil, sess.Save(r, res)
+
+	if len(a.ClaimAttributes) > 0 {
+		s := startClientSpan(r, "ldap get_user_claims", a.Server)
+		claims, err := a.getUserClaims(ctx, userDN)
+		s.Finish(err)
+		if err != nil {
+			return "", nil, err
+		}
+		sess.Values["claims"] = encodeSessionClaims(claims)
+	}
+
+	return userDN, nil, saveAuthSession(res, r, sess, a.AuthenticatorID(), alias)
 }
 
 // LoginFields needs to return the fields required for this login
@@ -184,22 +238,147 @@ func (a authLDAP) LoginFields() (fields []loginField) {
 
 // Logout is called when the user visits the logout endpoint and
 // needs to destroy any persistent stored cookies
-func (a authLDAP) Logout(res http.ResponseWriter, r *http.Request) (err error) {
-	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
-	sess.Options = mainCfg.GetSessionOpts()
-	sess.Options.MaxAge = -1 // Instant delete
-	return sess.Save(r, res)
+func (a authLDAP) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) (err error) {
+	return deleteAuthSession(res, r, a.AuthenticatorID())
+}
+
+// sessionUserDN returns the DN of the user logged in through the login
+// form, users authenticated through basic auth have no session
+func (a authLDAP) sessionUserDN(r *http.Request) (string, bool) {
+	sess, err := getAuthSession(r, a.AuthenticatorID())
+	if err != nil {
+		return "", false
+	}
+
+	userDN, ok := sess.Values["user"].(string)
+	return userDN, ok && userDN != ""
+}
+
+// CanChangePassword reports whether users may change their password
+// in the directory
+func (a authLDAP) CanChangePassword(r *http.Request, user string) bool {
+	if !a.AllowPasswordChange {
+		return false
+	}
+
+	_, ok := a.sessionUserDN(r)
+	return ok
+}
+
+// ChangePassword binds as the user using the old password and changes
+// it using the password modify extended operation (RFC 3062). Password
+// policies of the directory are enforced by the server.
+func (a authLDAP) ChangePassword(r *http.Request, user, oldPassword, newPassword string) error {
+	userDN, ok := a.sessionUserDN(r)
+	if !a.AllowPasswordChange || !ok {
+		return errPasswordChangeUnsupported
+	}
+
+	s := startClientSpan(r, "ldap change_password", a.Server)
+	err := a.changePassword(userDN, oldPassword, newPassword)
+	s.Finish(err)
+
+	return err
+}
+
+func (a authLDAP) changePassword(userDN, oldPassword, newPassword string) error {
+	l, err := a.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err := l.Bind(userDN, oldPassword); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return errPasswordMismatch
+		}
+		return fmt.Errorf("Unable to authenticate as user: %s", err)
+	}
+
+	_, err = l.PasswordModify(ldap.NewPasswordModifyRequest("", oldPassword, newPassword))
+	switch {
+	case err == nil:
+		return nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation):
+		return errLDAPPasswordRejected
+	default:
+		return fmt.Errorf("Unable to change password: %s", err)
+	}
+}
+
+// PasswordResetAccount searches the user and returns the DN and the mail
+// address read from the email_attribute
+func (a authLDAP) PasswordResetAccount(username string) (string, string, error) {
+	if !a.AllowPasswordReset {
+		return "", "", errNoUser
+	}
+
+	l, err := a.dial(context.Background())
+	if err != nil {
+		return "", "", err
+	}
+	defer l.Close()
+
+	userDN, email, err := a.searchUser(l, username, a.EmailAttribute)
+	if err != nil {
+		return "", "", err
+	}
+	if email == "" {
+		return "", "", errNoUser
+	}
+
+	return userDN, email, nil
+}
+
+// ResetPassword sets the password of the user using the password modify
+// extended operation bound as manager_dn which needs write access to
+// the passwords of the users
+func (a authLDAP) ResetPassword(userDN, newPassword string) error {
+	if !a.AllowPasswordReset {
+		return errPasswordChangeUnsupported
+	}
+
+	l, err := a.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	_, err = l.PasswordModify(ldap.NewPasswordModifyRequest(userDN, "", newPassword))
+	switch {
+	case err == nil:
+		return nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation):
+		return errLDAPPasswordRejected
+	default:
+		return fmt.Errorf("Unable to reset password: %s", err)
+	}
 }
 
 // checkLogin searches for the username using the specified UserSearchFilter
-// and returns the UserDN and an error (errNoValidUserFound / processing error)
-func (a authLDAP) checkLogin(username, password, aliasAttribute string) (string, string, error) {
-	l, err := a.dial()
+// and returns the UserDN and an error (errNoUser / processing error)
+func (a authLDAP) checkLogin(ctx context.Context, username, password, aliasAttribute string) (string, string, error) {
+	l, err := a.dial(ctx)
 	if err != nil {
 		return "", "", err
 	}
 	defer l.Close()
 
+	userDN, alias, err := a.searchUser(l, username, aliasAttribute)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := l.Bind(userDN, password); err != nil {
+		return "", "", errWrongCredentials
+	}
+
+	return userDN, alias, nil
+}
+
+// searchUser searches for the username using the specified UserSearchFilter
+// and returns the UserDN and the alias (errNoUser / processing error)
+func (a authLDAP) searchUser(l *ldapPoolConn, username, aliasAttribute string) (string, string, error) {
 	sreq := ldap.NewSearchRequest(
 		a.UserSearchBase,
 		ldap.ScopeWholeSubtree,
@@ -212,19 +391,15 @@ func (a authLDAP) checkLogin(username, password, aliasAttribute string) (string,
 
 	sres, err := l.Search(sreq)
 	if err != nil {
-		return "", "", fmt.Errorf("Unable to search for user: %s", err)
+		return "", "", backendUnavailable(fmt.Errorf("Unable to search for user: %s", err))
 	}
 
 	if len(sres.Entries) != 1 {
-		return "", "", errNoValidUserFound
+		return "", "", errNoUser
 	}
 
 	userDN := sres.Entries[0].DN
 
-	if err := l.Bind(userDN, password); err != nil {
-		return "", "", errNoValidUserFound
-	}
-
 	alias := sres.Entries[0].GetAttributeValue(aliasAttribute)
 	if aliasAttribute == "dn" {
 		// DN is not fetchable through GetAttributeValue as it is not an attribute
@@ -249,24 +424,37 @@ func (a authLDAP) portFromScheme(scheme, override string) string {
 	}
 }
 
-// dial connects to the LDAP server and authenticates using manager_dn
-func (a authLDAP) dial() (*ldap.Conn, error) {
+// dial returns a connection authenticated using manager_dn from the
+// pool. The connection is closed when the context ends which aborts
+// pending operations, the deadline of the context also applies to every
+// operation on the connection. Closing it returns it to the pool.
+func (a authLDAP) dial(ctx context.Context) (*ldapPoolConn, error) {
+	if a.pool == nil {
+		// Not set up through Configure, connections are not reused
+		return (&ldapPool{cfg: ldapPoolConfig{MaxIdle: -1}, connect: a.connect, bind: a.bindManager}).Get(ctx)
+	}
+
+	return a.pool.Get(ctx)
+}
+
+// connect opens a new connection to the LDAP server
+func (a authLDAP) connect(ctx context.Context) (*ldap.Conn, error) {
 	u, err := url.Parse(a.Server)
 	if err != nil {
 		return nil, err
 	}
 
-	host := u.Host
+	host := u.Hostname()
 	port := u.Port()
 
-	var l *ldap.Conn
+	var tlsConfig *tls.Config
 
 	switch u.Scheme {
 	case "ldap":
-		l, err = ldap.Dial("tcp", fmt.Sprintf("%s:%s", host, a.portFromScheme(u.Scheme, port)))
+		// Plain connection
 
 	case "ldaps":
-		tlsConfig := &tls.Config{ServerName: host}
+		tlsConfig = &tls.Config{ServerName: host}
 
 		if a.TLSConfig != nil && (a.TLSConfig.ValidateHostname != "" || a.TLSConfig.AllowInsecure) {
 			tlsConfig = &tls.Config{
@@ -275,29 +463,64 @@ func (a authLDAP) dial() (*ldap.Conn, error) {
 			}
 		}
 
-		l, err = ldap.DialTLS(
-			"tcp", fmt.Sprintf("%s:%s", host, a.portFromScheme(u.Scheme, port)),
-			tlsConfig,
-		)
-
 	default:
 		return nil, fmt.Errorf("Unsupported scheme %s", u.Scheme)
 	}
 
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", fmt.Sprintf("%s:%s", host, a.portFromScheme(u.Scheme, port)))
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	l := ldap.NewConn(conn, tlsConfig != nil)
+	l.Start()
+
+	return l, nil
+}
+
+// bindManager authenticates the connection using manager_dn
+func (a authLDAP) bindManager(l *ldap.Conn) error {
+	return l.Bind(a.ManagerDN, a.ManagerPassword)
+}
+
+// configurePool sets up the connection pool using the current
+// configuration
+func (a *authLDAP) configurePool() {
+	a.Pool.setDefaults()
+	a.pool = newLDAPPool(a.Pool, a.connect, a.bindManager)
+}
+
+// CheckReadiness verifies the LDAP server is reachable and accepts the
+// manager credentials
+func (a authLDAP) CheckReadiness() error {
+	l, err := a.dial(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to LDAP: %s", err)
+		return err
 	}
+	defer l.Close()
 
-	if err := l.Bind(a.ManagerDN, a.ManagerPassword); err != nil {
-		return nil, fmt.Errorf("Unable to authenticate with manager_dn: %s", err)
+	// Pooled connections are not verified before reuse within the health
+	// check interval
+	if err := l.ping(); err != nil {
+		l.broken = true
+		return backendUnavailable(fmt.Errorf("Unable to read from LDAP: %s", err))
 	}
 
-	return l, err
+	return nil
 }
 
 // getUserGroups searches for groups containing the user
-func (a authLDAP) getUserGroups(userDN, alias string) ([]string, error) {
-	l, err := a.dial()
+func (a authLDAP) getUserGroups(ctx context.Context, userDN, alias string) ([]string, error) {
+	l, err := a.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -318,7 +541,7 @@ func (a authLDAP) getUserGroups(userDN, alias string) ([]string, error) {
 
 	sres, err := l.Search(sreq)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to search for groups: %s", err)
+		return nil, backendUnavailable(fmt.Errorf("Unable to search for groups: %s", err))
 	}
 
 	groups := []string{}
@@ -329,6 +552,45 @@ func (a authLDAP) getUserGroups(userDN, alias string) ([]string, error) {
 	return groups, nil
 }
 
+// getUserClaims reads the claim_attributes of the user
+func (a authLDAP) getUserClaims(ctx context.Context, userDN string) (map[string]string, error) {
+	if len(a.ClaimAttributes) == 0 {
+		return nil, nil
+	}
+
+	l, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	sreq := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		"(objectClass=*)",
+		a.ClaimAttributes,
+		nil,
+	)
+
+	sres, err := l.Search(sreq)
+	if err != nil {
+		return nil, backendUnavailable(fmt.Errorf("Unable to read user attributes: %s", err))
+	}
+
+	claims := map[string]string{}
+	if len(sres.Entries) == 1 {
+		for _, attr := range a.ClaimAttributes {
+			if v := sres.Entries[0].GetAttributeValue(attr); v != "" {
+				claims[attr] = v
+			}
+		}
+	}
+
+	return claims, nil
+}
+
 // SupportsMFA returns the MFA detection capabilities of the login
 // provider. If the provider can provide mfaConfig objects from its
 // configuration return true. If this is true the login interface
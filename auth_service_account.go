@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func init() {
+	registerAuthenticator(&authServiceAccount{})
+}
+
+var errServiceAccountStoreDisabled = errors.New("No credential store configured for service accounts")
+
+// serviceAccount is a machine identity with its own groups which can
+// only be used on the given hosts
+type serviceAccount struct {
+	Groups      []string                   `yaml:"groups"`
+	Hosts       []string                   `yaml:"hosts"`
+	Credentials []serviceAccountCredential `yaml:"credentials"`
+}
+
+// serviceAccountCredential is a static token of a service account. An
+// account can have multiple credentials to rotate them without
+// downtime: Add the new one, update the clients, remove the old one or
+// let it expire.
+type serviceAccountCredential struct {
+	Name    string    `yaml:"name"`
+	Token   string    `yaml:"token"`
+	Expires time.Time `yaml:"expires"`
+}
+
+func (s serviceAccountCredential) valid(token string) bool {
+	if !s.Expires.IsZero() && !s.Expires.After(time.Now()) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(s.Token), []byte(token)) == 1
+}
+
+type authServiceAccount struct {
+	EnableBasicAuth bool                      `yaml:"enable_basic_auth"`
+	Accounts        map[string]serviceAccount `yaml:"accounts"`
+	Store           string                    `yaml:"store"`
+	MaxLifetime     time.Duration             `yaml:"max_lifetime"`
+
+	// credentials issued through the admin API
+	issued *patStore
+	lock   sync.RWMutex
+}
+
+// AuthenticatorID needs to return an unique string to identify
+// this special authenticator
+func (a *authServiceAccount) AuthenticatorID() string { return "service_account" }
+
+// Configure loads the configuration for the Authenticator from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the Authenticator is supplied the function
+// needs to return the errProviderUnconfigured
+func (a *authServiceAccount) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			ServiceAccount *authServiceAccount `yaml:"service_account"`
+		} `yaml:"providers"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.Providers.ServiceAccount == nil {
+		return errProviderUnconfigured
+	}
+	c := envelope.Providers.ServiceAccount
+
+	for name, account := range c.Accounts {
+		for _, cred := range account.Credentials {
+			if cred.Token == "" {
+				return errors.Errorf("Credential %q of service account %q has no token", cred.Name, name)
+			}
+		}
+	}
+
+	var issued *patStore
+	if c.Store != "" {
+		if c.MaxLifetime == 0 {
+			c.MaxLifetime = patDefaultMaxLifetime
+		}
+
+		issued = &patStore{config: patConfig{Store: c.Store, MaxLifetime: c.MaxLifetime}}
+		if err := issued.load(); err != nil {
+			return errors.Wrap(err, "Unable to load service account credentials")
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.EnableBasicAuth = c.EnableBasicAuth
+	a.Accounts = c.Accounts
+	a.Store = c.Store
+	a.MaxLifetime = c.MaxLifetime
+	a.issued = issued
+
+	return nil
+}
+
+// DetectUser is used to detect a user without a login form from
+// a cookie, header or other methods
+// If no user was detected the errNoUser needs to be
+// returned
+func (a *authServiceAccount) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	authHeader := r.Header.Get("Authorization")
+
+	var suppliedAccount, suppliedToken string
+	switch {
+	case strings.HasPrefix(authHeader, "Token "):
+		suppliedToken = strings.SplitN(authHeader, " ", 2)[1]
+
+	case a.EnableBasicAuth:
+		if basicUser, basicPass, ok := r.BasicAuth(); ok {
+			suppliedAccount, suppliedToken = basicUser, basicPass
+		}
+	}
+
+	if suppliedToken == "" {
+		return "", nil, errNoUser
+	}
+
+	name, credential, ok := a.findAccount(suppliedToken)
+	if !ok || (suppliedAccount != "" && suppliedAccount != name) {
+		return "", nil, errNoUser
+	}
+
+	a.lock.RLock()
+	account := a.Accounts[name]
+	a.lock.RUnlock()
+
+	if len(account.Hosts) > 0 && !hostMatches(account.Hosts, requestHost(r)) {
+		return "", nil, errNoUser
+	}
+
+	setSessionClaims(r, map[string]string{"credential": credential})
+
+	return name, account.Groups, nil
+}
+
+// findAccount returns the name of the account and the name of the
+// credential matching the token
+func (a *authServiceAccount) findAccount(token string) (string, string, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for name, account := range a.Accounts {
+		for _, cred := range account.Credentials {
+			if cred.valid(token) {
+				return name, cred.Name, true
+			}
+		}
+	}
+
+	if a.issued == nil {
+		return "", "", false
+	}
+
+	if cred, ok := a.issued.Lookup(token); ok {
+		if _, exists := a.Accounts[cred.User]; exists {
+			// Accounts removed from the config must not be usable anymore
+			return cred.User, cred.Name, true
+		}
+	}
+
+	return "", "", false
+}
+
+// Login is called when the user submits the login form and needs
+// to authenticate the user or throw an error. If the user has
+// successfully logged in the persistent cookie should be written
+// in order to use DetectUser for the next login.
+// If the user did not login correctly the errNoUser
+// needs to be returned
+func (a *authServiceAccount) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+	return "", nil, errNoUser
+}
+
+// LoginFields needs to return the fields required for this login
+// method. If no login using this method is possible the function
+// needs to return nil.
+func (a *authServiceAccount) LoginFields() []loginField { return nil }
+
+// Logout is called when the user visits the logout endpoint and
+// needs to destroy any persistent stored cookies
+func (a *authServiceAccount) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// SupportsMFA returns the MFA detection capabilities of the login
+// provider. If the provider can provide mfaConfig objects from its
+// configuration return true. If this is true the login interface
+// will display an additional field for this provider for the user
+// to fill in their MFA token.
+func (a *authServiceAccount) SupportsMFA() bool { return false }
+
+// getServiceAccountProvider returns the service account provider if it
+// is configured
+func getServiceAccountProvider() *authServiceAccount {
+	for _, a := range getAuthenticatorSnapshot().active {
+		if sa, ok := a.(*authServiceAccount); ok {
+			return sa
+		}
+	}
+
+	return nil
+}
+
+type serviceAccountCredentialView struct {
+	ID      string    `json:"id,omitempty"`
+	Name    string    `json:"name"`
+	Source  string    `json:"source"`
+	Created time.Time `json:"created,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type serviceAccountView struct {
+	Name        string                         `json:"name"`
+	Groups      []string                       `json:"groups"`
+	Hosts       []string                       `json:"hosts"`
+	Credentials []serviceAccountCredentialView `json:"credentials"`
+}
+
+// list returns the accounts with their credentials without exposing
+// the tokens
+func (a *authServiceAccount) list() []serviceAccountView {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	result := []serviceAccountView{}
+	for name, account := range a.Accounts {
+		v := serviceAccountView{
+			Name:        name,
+			Groups:      account.Groups,
+			Hosts:       account.Hosts,
+			Credentials: []serviceAccountCredentialView{},
+		}
+
+		for _, c := range account.Credentials {
+			v.Credentials = append(v.Credentials, serviceAccountCredentialView{Name: c.Name, Source: "config", Expires: c.Expires})
+		}
+
+		if a.issued != nil {
+			for _, c := range a.issued.ListByUser(name) {
+				v.Credentials = append(v.Credentials, serviceAccountCredentialView{ID: c.ID, Name: c.Name, Source: "api", Created: c.Created, Expires: c.Expires})
+			}
+		}
+
+		result = append(result, v)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func handleAdminServiceAccountsRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	sa := getServiceAccountProvider()
+	if sa == nil {
+		http.Error(res, "Service accounts are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(sa.list()); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode service accounts")
+		}
+		return
+	}
+
+	account := r.FormValue("account")
+
+	sa.lock.RLock()
+	_, exists := sa.Accounts[account]
+	issued := sa.issued
+	sa.lock.RUnlock()
+
+	if !exists {
+		http.Error(res, "Unknown service account", http.StatusNotFound)
+		return
+	}
+
+	if issued == nil {
+		http.Error(res, errServiceAccountStoreDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var lifetime, expirePrevious time.Duration
+		for param, target := range map[string]*time.Duration{"lifetime": &lifetime, "expire_previous": &expirePrevious} {
+			v := r.FormValue(param)
+			if v == "" {
+				continue
+			}
+
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(res, "Invalid duration in "+param, http.StatusBadRequest)
+				return
+			}
+			*target = d
+		}
+
+		var expired int
+		if r.FormValue("expire_previous") != "" {
+			// Keep the previous credentials working for a grace period to
+			// give the clients time to pick up the new credential
+			var err error
+			if expired, err = issued.ExpireByUser(account, time.Now().Add(expirePrevious)); err != nil {
+				requestLog(r).WithError(err).Error("Unable to expire service account credentials")
+				http.Error(res, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			name = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+		}
+
+		token, cred, err := issued.Create(account, name, nil, nil, lifetime, "")
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to create service account credential")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventServiceAccountRotated, r, map[string]string{
+			"admin":    admin,
+			"expired":  strconv.Itoa(expired),
+			"token":    cred.ID,
+			"username": account,
+		})
+
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusCreated)
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"id":      cred.ID,
+			"token":   token,
+			"expires": cred.Expires,
+		})
+
+	case http.MethodDelete:
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(res, "Parameter id is required", http.StatusBadRequest)
+			return
+		}
+
+		ok, err := issued.Delete(account, id)
+		switch {
+		case err != nil:
+			requestLog(r).WithError(err).Error("Unable to revoke service account credential")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		case !ok:
+			http.Error(res, "Unknown credential", http.StatusNotFound)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventTokenRevoked, r, map[string]string{"admin": admin, "token": id, "username": account})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
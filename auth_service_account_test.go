@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServiceAccountDetectUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-sa")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &authServiceAccount{}
+	if err := a.Configure([]byte(`---
+providers:
+  service_account:
+    enable_basic_auth: true
+    store: ` + filepath.Join(dir, "credentials.json") + `
+    accounts:
+      deploy-bot:
+        groups: ["deployers"]
+        hosts: ["ci.example.com"]
+        credentials:
+          - name: current
+            token: "currenttoken"
+          - name: old
+            token: "oldtoken"
+            expires: "2001-01-01T00:00:00Z"
+`)); err != nil {
+		t.Fatalf("Unable to configure provider: %s", err)
+	}
+
+	issued, _, err := a.issued.Create("deploy-bot", "rotated", nil, nil, time.Hour, "")
+	if err != nil {
+		t.Fatalf("Unable to issue credential: %s", err)
+	}
+
+	for _, tc := range []struct {
+		token    string
+		host     string
+		account  string
+		expectOK bool
+	}{
+		{"currenttoken", "ci.example.com", "", true},
+		{"currenttoken", "ci.example.com", "deploy-bot", true},
+		{"currenttoken", "ci.example.com", "other-bot", false},
+		{"currenttoken", "www.example.com", "", false},
+		{"oldtoken", "ci.example.com", "", false},
+		{issued, "ci.example.com", "", true},
+		{"unknown", "ci.example.com", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Host", tc.host)
+		if tc.account != "" {
+			r.SetBasicAuth(tc.account, tc.token)
+		} else {
+			r.Header.Set("Authorization", "Token "+tc.token)
+		}
+
+		user, groups, err := a.DetectUser(context.Background(), httptest.NewRecorder(), r)
+		clearSessionMeta(r)
+
+		if !tc.expectOK {
+			if err != errNoUser {
+				t.Errorf("Token %q on %q: Expected errNoUser, got %v", tc.token, tc.host, err)
+			}
+			continue
+		}
+
+		if err != nil || user != "deploy-bot" || len(groups) != 1 || groups[0] != "deployers" {
+			t.Errorf("Token %q on %q: Expected deploy-bot (deployers), got %q %v (%v)", tc.token, tc.host, user, groups, err)
+		}
+	}
+
+	// Rotating with a grace period keeps the previous credential valid
+	// until the grace period is over
+	if n, err := a.issued.ExpireByUser("deploy-bot", time.Now().Add(-time.Second)); err != nil || n != 1 {
+		t.Fatalf("Expected one credential to be expired, got %d (%v)", n, err)
+	}
+	if _, _, ok := a.findAccount(issued); ok {
+		t.Error("Expected expired credential not to be accepted")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/Luzifer/go_helpers/str"
@@ -15,10 +19,14 @@ func init() {
 }
 
 type authSimple struct {
-	EnableBasicAuth bool                   `yaml:"enable_basic_auth"`
-	Users           map[string]string      `yaml:"users"`
-	Groups          map[string][]string    `yaml:"groups"`
-	MFA             map[string][]mfaConfig `yaml:"mfa"`
+	EnableBasicAuth bool                         `yaml:"enable_basic_auth"`
+	Users           map[string]string            `yaml:"users"`
+	Groups          map[string][]string          `yaml:"groups"`
+	MFA             map[string][]mfaConfig       `yaml:"mfa"`
+	Attributes      map[string]map[string]string `yaml:"attributes"`
+	PasswordFile    string                       `yaml:"password_file"`
+
+	passwords *simplePasswordFile
 }
 
 // AuthenticatorID needs to return an unique string to identify
@@ -48,47 +56,65 @@ func (a *authSimple) Configure(yamlSource []byte) error {
 	a.Users = envelope.Providers.Simple.Users
 	a.Groups = envelope.Providers.Simple.Groups
 	a.MFA = envelope.Providers.Simple.MFA
+	a.Attributes = envelope.Providers.Simple.Attributes
+	a.PasswordFile = envelope.Providers.Simple.PasswordFile
+
+	if a.PasswordFile != "" {
+		passwords, err := loadSimplePasswordFile(a.PasswordFile)
+		if err != nil {
+			return err
+		}
+		a.passwords = passwords
+	}
 
 	return nil
 }
 
 // DetectUser is used to detect a user without a login form from
 // a cookie, header or other methods
-// If no user was detected the errNoValidUserFound needs to be
+// If no user was detected the errNoUser needs to be
 // returned
-func (a authSimple) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+func (a authSimple) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
 	var user string
 
 	if a.EnableBasicAuth {
 		if basicUser, basicPass, ok := r.BasicAuth(); ok {
-			for u, p := range a.Users {
+			for u := range a.Users {
 				if u != basicUser {
 					continue
 				}
-				if bcrypt.CompareHashAndPassword([]byte(p), []byte(basicPass)) != nil {
+				if comparePasswordHash(a.passwordHash(u), basicPass) != nil {
 					continue
 				}
 
 				user = basicUser
 			}
+
+			if store := getSCIMStore(); user == "" && store != nil && !a.isConfigured(basicUser) {
+				user, _ = store.Authenticate(basicUser, basicPass)
+			}
 		}
 	}
 
 	if user == "" {
-		sess, err := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
+		sess, err := getAuthSession(r, a.AuthenticatorID())
 		if err != nil {
-			return "", nil, errNoValidUserFound
+			return "", nil, err
 		}
 
 		var ok bool
 		user, ok = sess.Values["user"].(string)
 		if !ok {
-			return "", nil, errNoValidUserFound
+			return "", nil, errNoUser
+		}
+
+		if store := getSCIMStore(); store != nil && !a.isConfigured(user) && !store.Active(user) {
+			// Deprovisioned users must not be able to use existing sessions
+			return "", nil, errNoUser
 		}
 
 		// We had a cookie, lets renew it
-		sess.Options = mainCfg.GetSessionOpts()
-		if err := sess.Save(r, res); err != nil {
+		if err := saveAuthSession(res, r, sess, a.AuthenticatorID(), user); err != nil {
 			return "", nil, err
 		}
 	}
@@ -100,34 +126,78 @@ func (a authSimple) DetectUser(res http.ResponseWriter, r *http.Request) (string
 		}
 	}
 
+	claims := a.Attributes[user]
+	if store := getSCIMStore(); store != nil && !a.isConfigured(user) {
+		groups = append(groups, store.GroupsOf(user)...)
+		claims = store.Claims(user)
+	}
+
+	setSessionClaims(r, claims)
+
 	return user, groups, nil
 }
 
+// isConfigured returns whether the user is defined in the config.
+// Users not defined there are looked up in the users provisioned
+// through SCIM.
+func (a authSimple) isConfigured(user string) bool {
+	_, ok := a.Users[user]
+	return ok
+}
+
+// passwordHash returns the hash of the password the user changed or the
+// one from the config
+func (a authSimple) passwordHash(user string) string {
+	if a.passwords != nil {
+		if hash, ok := a.passwords.Get(user); ok {
+			return hash
+		}
+	}
+	return a.Users[user]
+}
+
 // Login is called when the user submits the login form and needs
 // to authenticate the user or throw an error. If the user has
 // successfully logged in the persistent cookie should be written
 // in order to use DetectUser for the next login.
-// If the user did not login correctly the errNoValidUserFound
+// If the user did not login correctly the errNoUser
 // needs to be returned
-func (a authSimple) Login(res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+func (a authSimple) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
 	username := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "username"}, "-"))
 	password := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "password"}, "-"))
 
-	for u, p := range a.Users {
+	loginErr := errNoUser
+	for u := range a.Users {
 		if u != username {
 			continue
 		}
-		if bcrypt.CompareHashAndPassword([]byte(p), []byte(password)) != nil {
+		if comparePasswordHash(a.passwordHash(u), password) != nil {
+			loginErr = errWrongCredentials
 			continue
 		}
 
-		sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
-		sess.Options = mainCfg.GetSessionOpts()
+		sess, err := newAuthSession(r, a.AuthenticatorID())
+		if err != nil {
+			return "", nil, err
+		}
 		sess.Values["user"] = u
-		return u, a.MFA[u], sess.Save(r, res)
+		sess.Values["mfa"] = len(a.MFA[u]) > 0
+		return u, a.MFA[u], saveAuthSession(res, r, sess, a.AuthenticatorID(), u)
 	}
 
-	return "", nil, errNoValidUserFound
+	if store := getSCIMStore(); store != nil && !a.isConfigured(username) {
+		if u, ok := store.Authenticate(username, password); ok {
+			sess, err := newAuthSession(r, a.AuthenticatorID())
+			if err != nil {
+				return "", nil, err
+			}
+			sess.Values["user"] = u
+			sess.Values["mfa"] = false
+			return u, nil, saveAuthSession(res, r, sess, a.AuthenticatorID(), u)
+		}
+	}
+
+	return "", nil, loginErr
 }
 
 // LoginFields needs to return the fields required for this login
@@ -152,11 +222,8 @@ func (a authSimple) LoginFields() (fields []loginField) {
 
 // Logout is called when the user visits the logout endpoint and
 // needs to destroy any persistent stored cookies
-func (a authSimple) Logout(res http.ResponseWriter, r *http.Request) (err error) {
-	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
-	sess.Options = mainCfg.GetSessionOpts()
-	sess.Options.MaxAge = -1 // Instant delete
-	return sess.Save(r, res)
+func (a authSimple) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) (err error) {
+	return deleteAuthSession(res, r, a.AuthenticatorID())
 }
 
 // SupportsMFA returns the MFA detection capabilities of the login
@@ -165,3 +232,153 @@ func (a authSimple) Logout(res http.ResponseWriter, r *http.Request) (err error)
 // will display an additional field for this provider for the user
 // to fill in their MFA token.
 func (a authSimple) SupportsMFA() bool { return true }
+
+// CanChangePassword reports whether the password of the user can be
+// changed: Configured users need a password_file to store the changed
+// password in, provisioned users are updated in the SCIM store.
+func (a authSimple) CanChangePassword(r *http.Request, user string) bool {
+	if a.isConfigured(user) {
+		return a.passwords != nil
+	}
+
+	store := getSCIMStore()
+	return store != nil && store.hasPassword(user)
+}
+
+// ChangePassword verifies the old password and stores the hash of the
+// new one using the algorithm of the previous hash
+func (a authSimple) ChangePassword(r *http.Request, user, oldPassword, newPassword string) error {
+	if !a.isConfigured(user) {
+		store := getSCIMStore()
+		if store == nil {
+			return errPasswordChangeUnsupported
+		}
+		return store.ChangePassword(user, oldPassword, newPassword)
+	}
+
+	if a.passwords == nil {
+		return errPasswordChangeUnsupported
+	}
+
+	// Concurrent changes must not both verify the same old password
+	a.passwords.changeLock.Lock()
+	defer a.passwords.changeLock.Unlock()
+
+	hash := a.passwordHash(user)
+	if comparePasswordHash(hash, oldPassword) != nil {
+		return errPasswordMismatch
+	}
+
+	newHash, err := rehashPassword(hash, newPassword)
+	if err != nil {
+		return err
+	}
+
+	return a.passwords.Set(user, newHash)
+}
+
+// PasswordResetAccount returns the email attribute of configured users
+// (which need a password_file to store the new password in) or the
+// primary address of provisioned users
+func (a authSimple) PasswordResetAccount(username string) (string, string, error) {
+	if a.isConfigured(username) {
+		if email := a.Attributes[username]["email"]; a.passwords != nil && email != "" {
+			return username, email, nil
+		}
+		return "", "", errNoUser
+	}
+
+	if store := getSCIMStore(); store != nil {
+		if user, email, ok := store.passwordResetAccount(username); ok {
+			return user, email, nil
+		}
+	}
+
+	return "", "", errNoUser
+}
+
+// ResetPassword stores the hash of the new password without verifying
+// the old one
+func (a authSimple) ResetPassword(user, newPassword string) error {
+	if !a.isConfigured(user) {
+		store := getSCIMStore()
+		if store == nil {
+			return errPasswordChangeUnsupported
+		}
+		return store.ResetPassword(user, newPassword)
+	}
+
+	if a.passwords == nil {
+		return errPasswordChangeUnsupported
+	}
+
+	a.passwords.changeLock.Lock()
+	defer a.passwords.changeLock.Unlock()
+
+	hash, err := rehashPassword(a.passwordHash(user), newPassword)
+	if err != nil {
+		return err
+	}
+
+	return a.passwords.Set(user, hash)
+}
+
+// simplePasswordFile stores the hashes of the passwords changed by the
+// users, they take precedence over the hashes in the config
+type simplePasswordFile struct {
+	path   string
+	hashes map[string]string
+
+	changeLock sync.Mutex
+	lock       sync.RWMutex
+}
+
+func loadSimplePasswordFile(path string) (*simplePasswordFile, error) {
+	f := &simplePasswordFile{path: path, hashes: map[string]string{}}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		// No password changed yet
+	case err != nil:
+		return nil, errors.Wrap(err, "Unable to read password file")
+	default:
+		if err := yaml.Unmarshal(data, &f.hashes); err != nil {
+			return nil, errors.Wrap(err, "Unable to parse password file")
+		}
+	}
+
+	return f, nil
+}
+
+func (f *simplePasswordFile) Get(user string) (string, bool) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	hash, ok := f.hashes[user]
+	return hash, ok
+}
+
+// Set stores the hash and persists the file
+func (f *simplePasswordFile) Set(user, hash string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	hashes := map[string]string{user: hash}
+	for u, h := range f.hashes {
+		if u != user {
+			hashes[u] = h
+		}
+	}
+
+	data, err := yaml.Marshal(hashes)
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal password file")
+	}
+	if err := writeFileAtomic(f.path, data); err != nil {
+		return err
+	}
+
+	f.hashes = hashes
+	return nil
+}
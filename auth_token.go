@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -14,8 +15,11 @@ func init() {
 }
 
 type authToken struct {
-	Tokens map[string]string   `yaml:"tokens"`
-	Groups map[string][]string `yaml:"groups"`
+	EnableBasicAuth      bool                         `yaml:"enable_basic_auth"`
+	Tokens               map[string]string            `yaml:"tokens"`
+	Groups               map[string][]string          `yaml:"groups"`
+	Attributes           map[string]map[string]string `yaml:"attributes"`
+	PersonalAccessTokens patConfig                    `yaml:"personal_access_tokens"`
 }
 
 // AuthenticatorID needs to return an unique string to identify
@@ -38,42 +42,63 @@ func (a *authToken) Configure(yamlSource []byte) error {
 	}
 
 	if envelope.Providers.Token == nil {
+		if err := initializePATStore(patConfig{}); err != nil {
+			return err
+		}
 		return errProviderUnconfigured
 	}
 
+	a.EnableBasicAuth = envelope.Providers.Token.EnableBasicAuth
 	a.Tokens = envelope.Providers.Token.Tokens
 	a.Groups = envelope.Providers.Token.Groups
+	a.Attributes = envelope.Providers.Token.Attributes
+	a.PersonalAccessTokens = envelope.Providers.Token.PersonalAccessTokens
 
-	return nil
+	return initializePATStore(a.PersonalAccessTokens)
 }
 
 // DetectUser is used to detect a user without a login form from
 // a cookie, header or other methods
-// If no user was detected the errNoValidUserFound needs to be
+// If no user was detected the errNoUser needs to be
 // returned
-func (a authToken) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+func (a authToken) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
 	authHeader := r.Header.Get("Authorization")
 
-	if !strings.HasPrefix(authHeader, "Token ") {
-		return "", nil, errNoValidUserFound
+	var suppliedUser, suppliedToken string
+	switch {
+	case strings.HasPrefix(authHeader, "Token "), strings.HasPrefix(authHeader, "DPoP "):
+		tmp := strings.SplitN(authHeader, " ", 2)
+		suppliedToken = tmp[1]
+
+	case a.EnableBasicAuth:
+		// Basic auth with the token as password of the user owning it
+		if basicUser, basicPass, ok := r.BasicAuth(); ok {
+			suppliedUser, suppliedToken = basicUser, basicPass
+		}
 	}
 
-	tmp := strings.SplitN(authHeader, " ", 2)
-	suppliedToken := tmp[1]
+	if suppliedToken == "" {
+		return "", nil, errNoUser
+	}
 
 	var (
 		user, token string
 		userFound   bool
 	)
 	for user, token = range a.Tokens {
-		if token == suppliedToken {
+		if token == suppliedToken && (suppliedUser == "" || suppliedUser == user) {
 			userFound = true
 			break
 		}
 	}
 
 	if !userFound {
-		return "", nil, errNoValidUserFound
+		return a.detectPersonalAccessToken(r, suppliedUser, suppliedToken)
+	}
+
+	if strings.HasPrefix(authHeader, "DPoP ") {
+		// Static tokens are never bound to a key
+		return "", nil, errNoUser
 	}
 
 	groups := []string{}
@@ -83,17 +108,54 @@ func (a authToken) DetectUser(res http.ResponseWriter, r *http.Request) (string,
 		}
 	}
 
+	setSessionClaims(r, a.Attributes[user])
+
 	return user, groups, nil
 }
 
+// detectPersonalAccessToken looks up tokens created by the users
+// themselves. These can be restricted to a set of hosts.
+func (a authToken) detectPersonalAccessToken(r *http.Request, suppliedUser, suppliedToken string) (string, []string, error) {
+	store := getPATStore()
+	if store == nil {
+		return "", nil, errNoUser
+	}
+
+	pat, ok := store.Lookup(suppliedToken)
+	if !ok || (suppliedUser != "" && suppliedUser != pat.User) {
+		return "", nil, errNoUser
+	}
+
+	if len(pat.Hosts) > 0 && !hostMatches(pat.Hosts, requestHost(r)) {
+		return "", nil, errNoUser
+	}
+
+	// Bound tokens need to be sent using the DPoP scheme together with
+	// a proof for the original request, unbound tokens must not
+	if (pat.JKT != "") != strings.HasPrefix(r.Header.Get("Authorization"), "DPoP ") {
+		return "", nil, errNoUser
+	}
+	if pat.JKT != "" {
+		uri := requestScheme(r) + "://" + requestHost(r) + requestURI(r)
+		proof, err := verifyDPoPRequest(r, requestMethod(r), uri, suppliedToken)
+		if err != nil || proof == nil || proof.Thumbprint != pat.JKT {
+			return "", nil, errNoUser
+		}
+	}
+
+	setSessionClaims(r, map[string]string{"token_name": pat.Name})
+
+	return pat.User, pat.Groups, nil
+}
+
 // Login is called when the user submits the login form and needs
 // to authenticate the user or throw an error. If the user has
 // successfully logged in the persistent cookie should be written
 // in order to use DetectUser for the next login.
-// If the user did not login correctly the errNoValidUserFound
+// If the user did not login correctly the errNoUser
 // needs to be returned
-func (a authToken) Login(res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
-	return "", nil, errNoValidUserFound
+func (a authToken) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+	return "", nil, errNoUser
 }
 
 // LoginFields needs to return the fields required for this login
@@ -103,7 +165,9 @@ func (a authToken) LoginFields() []loginField { return nil }
 
 // Logout is called when the user visits the logout endpoint and
 // needs to destroy any persistent stored cookies
-func (a authToken) Logout(res http.ResponseWriter, r *http.Request) error { return nil }
+func (a authToken) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	return nil
+}
 
 // SupportsMFA returns the MFA detection capabilities of the login
 // provider. If the provider can provide mfaConfig objects from its
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -54,22 +55,21 @@ func (a *authYubikey) Configure(yamlSource []byte) error {
 
 // DetectUser is used to detect a user without a login form from
 // a cookie, header or other methods
-// If no user was detected the errNoValidUserFound needs to be
+// If no user was detected the errNoUser needs to be
 // returned
-func (a authYubikey) DetectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
-	sess, err := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
+func (a authYubikey) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	sess, err := getAuthSession(r, a.AuthenticatorID())
 	if err != nil {
-		return "", nil, errNoValidUserFound
+		return "", nil, err
 	}
 
 	user, ok := sess.Values["user"].(string)
 	if !ok {
-		return "", nil, errNoValidUserFound
+		return "", nil, errNoUser
 	}
 
 	// We had a cookie, lets renew it
-	sess.Options = mainCfg.GetSessionOpts()
-	if err := sess.Save(r, res); err != nil {
+	if err := saveAuthSession(res, r, sess, a.AuthenticatorID(), user); err != nil {
 		return "", nil, err
 	}
 
@@ -87,9 +87,9 @@ func (a authYubikey) DetectUser(res http.ResponseWriter, r *http.Request) (strin
 // to authenticate the user or throw an error. If the user has
 // successfully logged in the persistent cookie should be written
 // in order to use DetectUser for the next login.
-// If the user did not login correctly the errNoValidUserFound
+// If the user did not login correctly the errNoUser
 // needs to be returned
-func (a authYubikey) Login(res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+func (a authYubikey) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
 	keyInput := r.FormValue(strings.Join([]string{a.AuthenticatorID(), "key-input"}, "-"))
 
 	yubiAuth, err := yubigo.NewYubiAuth(a.ClientID, a.SecretKey)
@@ -97,26 +97,32 @@ func (a authYubikey) Login(res http.ResponseWriter, r *http.Request) (string, []
 		return "", nil, err
 	}
 
-	_, ok, err := yubiAuth.Verify(keyInput)
+	var ok bool
+	err = callWithContext(ctx, func() (err error) {
+		_, ok, err = yubiAuth.Verify(keyInput)
+		return err
+	})
 	if err != nil && !strings.Contains(err.Error(), "OTP has wrong length.") {
-		return "", nil, err
+		return "", nil, backendUnavailable(err)
 	}
 
 	if !ok {
 		// Not a valid authentication
-		return "", nil, errNoValidUserFound
+		return "", nil, errNoUser
 	}
 
 	user, ok := a.Devices[keyInput[:12]]
 	if !ok {
 		// We do not have a definition for that key
-		return "", nil, errNoValidUserFound
+		return "", nil, errNoUser
 	}
 
-	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
-	sess.Options = mainCfg.GetSessionOpts()
+	sess, err := newAuthSession(r, a.AuthenticatorID())
+	if err != nil {
+		return "", nil, err
+	}
 	sess.Values["user"] = user
-	return user, nil, sess.Save(r, res)
+	return user, nil, saveAuthSession(res, r, sess, a.AuthenticatorID(), user)
 }
 
 // LoginFields needs to return the fields required for this login
@@ -135,11 +141,8 @@ func (a authYubikey) LoginFields() (fields []loginField) {
 
 // Logout is called when the user visits the logout endpoint and
 // needs to destroy any persistent stored cookies
-func (a authYubikey) Logout(res http.ResponseWriter, r *http.Request) (err error) {
-	sess, _ := cookieStore.Get(r, strings.Join([]string{mainCfg.Cookie.Prefix, a.AuthenticatorID()}, "-"))
-	sess.Options = mainCfg.GetSessionOpts()
-	sess.Options.MaxAge = -1 // Instant delete
-	return sess.Save(r, res)
+func (a authYubikey) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) (err error) {
+	return deleteAuthSession(res, r, a.AuthenticatorID())
 }
 
 // SupportsMFA returns the MFA detection capabilities of the login
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+const (
+	authzEngineACL    = "acl"
+	authzEngineCasbin = "casbin"
+	authzEngineOPA    = "opa"
+)
+
+type authorizationConfig struct {
+	Engine string       `yaml:"engine"`
+	Casbin casbinConfig `yaml:"casbin"`
+	OPA    opaConfig    `yaml:"opa"`
+}
+
+// Load validates the configuration and prepares the configured engine
+func (a *authorizationConfig) Load() error {
+	switch a.Engine {
+	case "", authzEngineACL:
+		return nil
+	case authzEngineCasbin:
+		return a.Casbin.Load()
+	case authzEngineOPA:
+		return a.OPA.Validate()
+	default:
+		return fmt.Errorf("Unsupported authorization engine %q", a.Engine)
+	}
+}
+
+// hasAccess decides whether the user may access the requested resource
+// using the configured authorization engine. The ACL is matched against
+// the given fields of the request.
+func hasAccess(user string, groups []string, r *http.Request, fields map[string]string) (bool, error) {
+	s := startSpan(r, "authorize")
+	allowed, err := evaluateAccess(user, groups, r, fields)
+
+	engine := getMainConfig().Authorization.Engine
+	if engine == "" {
+		engine = authzEngineACL
+	}
+	s.SetAttribute("authz.engine", engine)
+	s.SetAttribute("authz.allowed", allowed)
+	s.SetError(err)
+	s.End()
+
+	return allowed, err
+}
+
+func evaluateAccess(user string, groups []string, r *http.Request, fields map[string]string) (bool, error) {
+	engine := getMainConfig().Authorization.Engine
+	if getRealm(r) != nil {
+		// Realms are always judged by their own ACL
+		engine = authzEngineACL
+	}
+
+	switch engine {
+	case authzEngineCasbin:
+		allowed, err := getMainConfig().Authorization.Casbin.HasAccess(user, groups, r)
+		metricAccessDecisions.Inc(authzEngineCasbin, authzMetricResult(allowed, err), "")
+		return allowed, err
+	case authzEngineOPA:
+		allowed, err := getMainConfig().Authorization.OPA.HasAccess(user, groups, r)
+		metricAccessDecisions.Inc(authzEngineOPA, authzMetricResult(allowed, err), "")
+		return allowed, err
+	default:
+		a, req := requestACL(r), newACLRequest(user, groups, r, fields)
+		result, decidedBy := a.Evaluate(req)
+		getMainConfig().AuditLog.LogDecision(r, user, result.String(), a.RuleSetID(decidedBy))
+		metricAccessDecisions.Inc(authzEngineACL, result.String(), a.RuleSetID(decidedBy))
+
+		for _, shadow := range a.EvaluateShadow(req) {
+			getMainConfig().AuditLog.LogShadowDecision(r, user, result.String(), shadow.Result.String(), a.RuleSetID(shadow.Position))
+		}
+
+		return result == acl.Allow, nil
+	}
+}
+
+func authzMetricResult(allowed bool, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case allowed:
+		return acl.Allow.String()
+	default:
+		return acl.Deny.String()
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/casbin/casbin"
+	fileadapter "github.com/casbin/casbin/persist/file-adapter"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+// casbinDefaultModel is the RBAC model with domains used when no model
+// file is configured:
+//
+//	p, <subject>, <domain>, <object>, <action>, allow|deny
+//	g, <member>, <role>
+const casbinDefaultModel = `
+[request_definition]
+r = sub, groups, dom, obj, act
+
+[policy_definition]
+p = sub, dom, obj, act, eft
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = subjectMatch(r.sub, r.groups, p.sub) && domainMatch(r.dom, p.dom) && keyMatch2(r.obj, p.obj) && regexMatch(r.act, p.act)
+`
+
+// casbinConfig evaluates the request using a Casbin enforcer loaded
+// from the model and the policy file. The request is mapped to the
+// tokens of the request definition: sub = user, groups = groups of the
+// user, dom = host, obj = path and act = method.
+type casbinConfig struct {
+	Model  string `yaml:"model"`
+	Policy string `yaml:"policy"`
+
+	enforcer *casbin.Enforcer
+	request  []string
+}
+
+var casbinRequestTokens = []string{"r_sub", "r_groups", "r_dom", "r_obj", "r_act"}
+
+func (c *casbinConfig) Load() error {
+	if c.Policy == "" {
+		return fmt.Errorf("Casbin policy is not set")
+	}
+
+	modelText := casbinDefaultModel
+	if c.Model != "" {
+		raw, err := ioutil.ReadFile(c.Model)
+		if err != nil {
+			return fmt.Errorf("Unable to read model file: %s", err)
+		}
+		modelText = string(raw)
+	}
+
+	e, err := newCasbinEnforcer(modelText)
+	if err != nil {
+		return fmt.Errorf("Unable to load model: %s", err)
+	}
+
+	m := e.GetModel()
+	for _, sec := range []string{"r", "p", "e", "m"} {
+		if _, ok := m[sec][sec]; !ok {
+			return fmt.Errorf("Model is missing the %q definition", sec)
+		}
+	}
+
+	for _, token := range m["r"]["r"].Tokens {
+		if !str.StringInSlice(token, casbinRequestTokens) {
+			return fmt.Errorf("Request definition contains unsupported token %q", strings.TrimPrefix(token, "r_"))
+		}
+	}
+
+	e.AddFunction("subjectMatch", casbinSubjectMatchFunc(e))
+	e.AddFunction("domainMatch", casbinDomainMatchFunc)
+
+	e.SetAdapter(fileadapter.NewAdapter(c.Policy))
+	if err := e.LoadPolicy(); err != nil {
+		return fmt.Errorf("Unable to load policy file: %s", err)
+	}
+
+	for ptype, ast := range m["p"] {
+		for _, rule := range ast.Policy {
+			if len(rule) != len(ast.Tokens) {
+				return fmt.Errorf("Policy %q needs to have %d fields: %s", ptype, len(ast.Tokens), strings.Join(rule, ", "))
+			}
+		}
+	}
+
+	c.enforcer = e
+	c.request = m["r"]["r"].Tokens
+
+	return nil
+}
+
+// newCasbinEnforcer creates an enforcer for the model without loading
+// a policy as the Casbin constructors panic on invalid models and
+// ignore errors while loading the policy
+func newCasbinEnforcer(modelText string) (e *casbin.Enforcer, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return casbin.NewEnforcer(casbin.NewModel(modelText), false), nil
+}
+
+// casbinSubjectMatchFunc implements the subjectMatch(r.sub, r.groups,
+// p.sub) matcher function: It matches if the policy subject is the user,
+// one of their groups prefixed with an @ sign or a role assigned to any
+// of them through the "g" role definition.
+func casbinSubjectMatchFunc(e *casbin.Enforcer) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 3 {
+			return false, fmt.Errorf("subjectMatch expects 3 arguments, got %d", len(args))
+		}
+
+		user, _ := args[0].(string)
+		groups, _ := args[1].([]string)
+		subject, _ := args[2].(string)
+
+		subjects := []string{user}
+		for _, g := range groups {
+			subjects = append(subjects, "@"+g)
+		}
+
+		roles, hasRoles := e.GetModel()["g"]["g"]
+		for _, s := range subjects {
+			if s == subject {
+				return true, nil
+			}
+
+			if !hasRoles || roles.RM == nil {
+				continue
+			}
+
+			if ok, err := roles.RM.HasLink(s, subject); err != nil {
+				return false, err
+			} else if ok {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+}
+
+func casbinDomainMatch(pattern, host string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return pattern == host
+	}
+}
+
+// casbinDomainMatchFunc implements the domainMatch(r.dom, p.dom) matcher
+// function supporting "*" and "*.example.com" wildcards
+func casbinDomainMatchFunc(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return false, fmt.Errorf("domainMatch expects 2 arguments, got %d", len(args))
+	}
+
+	host, _ := args[0].(string)
+	pattern, _ := args[1].(string)
+
+	return casbinDomainMatch(pattern, host), nil
+}
+
+// HasAccess passes the request to the enforcer, errors in the model
+// (for example an unsupported effect) are returned
+func (c casbinConfig) HasAccess(user string, groups []string, r *http.Request) (bool, error) {
+	values := map[string]interface{}{
+		"r_sub":    user,
+		"r_groups": groups,
+		"r_dom":    requestHost(r),
+		"r_obj":    strings.SplitN(requestURI(r), "?", 2)[0],
+		"r_act":    requestMethod(r),
+	}
+
+	rvals := make([]interface{}, len(c.request))
+	for i, token := range c.request {
+		rvals[i] = values[token]
+	}
+
+	return c.enforcer.EnforceSafe(rvals...)
+}
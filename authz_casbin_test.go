@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeCasbinFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "nginx-sso-casbin")
+	if err != nil {
+		t.Fatalf("Unable to create file: %s", err)
+	}
+	defer f.Close()
+
+	f.WriteString(content)
+	return f.Name()
+}
+
+func casbinTestRequest(method, path string) *http.Request {
+	r, _ := http.NewRequest("GET", "http://localhost/auth", nil)
+	r.Header.Set("X-Host", "app.example.com")
+	r.Header.Set("X-Origin-URI", path)
+	r.Header.Set("X-Origin-Method", method)
+	return r
+}
+
+func TestCasbinPolicy(t *testing.T) {
+	policy := writeCasbinFile(t, `# Test policy
+p, reader, *.example.com, /api/*, ^(GET|HEAD)$, allow
+p, editor, app.example.com, /api/:resource, ^POST$, allow
+p, contractor, *, /api/secrets/*, .*, deny
+g, @staff, reader
+g, editor, reader
+g, alice, editor
+g, bob, contractor
+`)
+	defer os.Remove(policy)
+
+	c := casbinConfig{Policy: policy}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Unable to load policy: %s", err)
+	}
+
+	for _, tc := range []struct {
+		user     string
+		groups   []string
+		method   string
+		path     string
+		expected bool
+	}{
+		{"carol", []string{"staff"}, "GET", "/api/users", true},
+		{"carol", []string{"staff"}, "POST", "/api/users", false},
+		{"alice", nil, "POST", "/api/users", true},
+		{"alice", nil, "POST", "/api/users/1", false},
+		{"alice", nil, "GET", "/other", false},
+		{"bob", []string{"staff"}, "GET", "/api/users", true},
+		{"bob", []string{"staff"}, "GET", "/api/secrets/1", false},
+	} {
+		ok, err := c.HasAccess(tc.user, tc.groups, casbinTestRequest(tc.method, tc.path))
+		if err != nil {
+			t.Fatalf("Unexpected error for %s %s %s: %s", tc.user, tc.method, tc.path, err)
+		}
+		if ok != tc.expected {
+			t.Errorf("Unexpected result for %s %s %s: %v", tc.user, tc.method, tc.path, ok)
+		}
+	}
+}
+
+func TestCasbinModel(t *testing.T) {
+	modelText := `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && keyMatch(r.obj, p.obj) && r.act == p.act
+`
+
+	model := writeCasbinFile(t, modelText)
+	defer os.Remove(model)
+
+	policy := writeCasbinFile(t, "p, admin, /admin/*, GET\ng, alice, admin\n")
+	defer os.Remove(policy)
+
+	c := casbinConfig{Model: model, Policy: policy}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Unable to load model: %s", err)
+	}
+
+	if ok, err := c.HasAccess("alice", nil, casbinTestRequest("GET", "/admin/users")); err != nil || !ok {
+		t.Errorf("Expected access for alice: %v (%v)", ok, err)
+	}
+	if ok, err := c.HasAccess("bob", []string{"admin"}, casbinTestRequest("GET", "/admin/users")); err != nil || ok {
+		t.Errorf("Expected no access for bob: %v (%v)", ok, err)
+	}
+
+	invalid := writeCasbinFile(t, strings.Replace(modelText, "r = sub, obj, act", "r = sub, ip, act", 1))
+	defer os.Remove(invalid)
+
+	if err := (&casbinConfig{Model: invalid, Policy: policy}).Load(); err == nil {
+		t.Error("Model with unsupported request token was accepted")
+	}
+}
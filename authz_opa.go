@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type opaConfig struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (o opaConfig) Validate() error {
+	if o.URL == "" {
+		return errors.New("OPA url is not set")
+	}
+
+	return nil
+}
+
+type opaInput struct {
+	User     string            `json:"user"`
+	Groups   []string          `json:"groups"`
+	Host     string            `json:"host"`
+	Path     string            `json:"path"`
+	Method   string            `json:"method"`
+	ClientIP string            `json:"client_ip"`
+	Headers  map[string]string `json:"headers"`
+	Session  map[string]string `json:"session"`
+}
+
+func newOPAInput(user string, groups []string, r *http.Request) opaInput {
+	in := opaInput{
+		User:     user,
+		Groups:   groups,
+		Host:     requestHost(r),
+		Path:     requestURI(r),
+		Method:   requestMethod(r),
+		ClientIP: getMainConfig().trustedClientIP(r),
+		Headers:  map[string]string{},
+		Session:  map[string]string{},
+	}
+
+	for k := range r.Header {
+		in.Headers[strings.ToLower(k)] = r.Header.Get(k)
+	}
+
+	if m, ok := getSessionMeta(r); ok {
+		for k, v := range m.Fields() {
+			in.Session[strings.TrimPrefix(k, "session.")] = v
+		}
+	}
+
+	return in
+}
+
+// HasAccess queries the OPA server for a decision. The policy can
+// either return a boolean or an object containing an allow key.
+func (o opaConfig) HasAccess(user string, groups []string, r *http.Request) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": newOPAInput(user, groups, r)})
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to marshal OPA input")
+	}
+
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	resp, err := client.Post(o.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to query OPA")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA responded with unexpected status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, errors.Wrap(err, "Unable to decode OPA response")
+	}
+
+	switch v := result.Result.(type) {
+	case bool:
+		return v, nil
+	case map[string]interface{}:
+		allow, _ := v["allow"].(bool)
+		return allow, nil
+	default:
+		// Undefined decision or unexpected document: Deny access
+		return false, nil
+	}
+}
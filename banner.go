@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	bannerSeverityInfo    = "info"
+	bannerSeverityWarning = "warning"
+	bannerSeverityDanger  = "danger"
+
+	bannerCacheTTL = time.Second
+	bannerRedisKey = "nginx-sso:banner"
+)
+
+var (
+	// bannerOverride is set through the admin API and replaces the
+	// configured banner, in cluster mode it is a cache of the state kept
+	// in the cluster store
+	bannerOverride        bannerState
+	bannerOverrideFetched time.Time
+	bannerOverrideLock    sync.RWMutex
+)
+
+// bannerConfig describes the announcement shown on the login page, for
+// example to inform about a scheduled maintenance
+type bannerConfig struct {
+	Message  string `yaml:"message"`
+	Severity string `yaml:"severity"`
+	URL      string `yaml:"url"`
+	From     string `yaml:"from"`
+	Until    string `yaml:"until"`
+
+	state bannerState
+}
+
+// bannerState is the banner shown to the users
+type bannerState struct {
+	Message  string     `json:"message"`
+	Severity string     `json:"severity"`
+	URL      string     `json:"url,omitempty"`
+	Admin    string     `json:"admin,omitempty"`
+	From     *time.Time `json:"from,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// Validate checks the banner and parses its schedule
+func (b *bannerConfig) Validate() error {
+	b.state = bannerState{Message: b.Message, Severity: b.Severity, URL: b.URL}
+	if b.Message == "" {
+		return nil
+	}
+
+	var err error
+	if b.state.From, err = parseBannerTime("from", b.From); err != nil {
+		return err
+	}
+	if b.state.Until, err = parseBannerTime("until", b.Until); err != nil {
+		return err
+	}
+
+	return b.state.validate()
+}
+
+func parseBannerTime(name, v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid time in %s, use RFC 3339 format", name)
+	}
+	return &t, nil
+}
+
+func (b *bannerState) validate() error {
+	switch b.Severity {
+	case "":
+		b.Severity = bannerSeverityInfo
+	case bannerSeverityInfo, bannerSeverityWarning, bannerSeverityDanger:
+	default:
+		return errors.Errorf("Unsupported severity %q, use info, warning or danger", b.Severity)
+	}
+
+	if b.URL != "" {
+		if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("URL needs to be an absolute http or https URL")
+		}
+	}
+
+	if b.From != nil && b.Until != nil && !b.Until.After(*b.From) {
+		return errors.New("Until needs to be after from")
+	}
+
+	return nil
+}
+
+// Active checks whether the banner is to be shown at the given time
+func (b bannerState) Active(now time.Time) bool {
+	switch {
+	case b.Message == "":
+		return false
+	case b.From != nil && now.Before(*b.From):
+		return false
+	case b.Until != nil && !now.Before(*b.Until):
+		return false
+	}
+	return true
+}
+
+// expired reports whether the banner will not be shown anymore
+func (b bannerState) expired(now time.Time) bool {
+	return b.Message == "" || (b.Until != nil && !now.Before(*b.Until))
+}
+
+// getBannerOverride returns the banner set through the admin API. In
+// cluster mode it is read from the cluster store at most once per
+// bannerCacheTTL, if the store is not reachable the last known banner
+// is used.
+func getBannerOverride() (bannerState, error) {
+	bannerOverrideLock.RLock()
+	state, fetched := bannerOverride, bannerOverrideFetched
+	bannerOverrideLock.RUnlock()
+
+	if !getMainConfig().Cluster.Enabled() || time.Since(fetched) < bannerCacheTTL {
+		return state, nil
+	}
+
+	client, err := getRedisClient(getMainConfig().Cluster.Store)
+	if err != nil {
+		return state, err
+	}
+
+	bannerOverrideLock.Lock()
+	defer bannerOverrideLock.Unlock()
+
+	// Do not retry on every request while the store is unreachable
+	bannerOverrideFetched = time.Now()
+
+	reply, err := client.Do("GET", bannerRedisKey)
+	if err != nil {
+		return bannerOverride, errors.Wrap(err, "Unable to read banner")
+	}
+
+	bannerOverride = bannerState{}
+	if v, ok := reply.(string); ok {
+		if err := json.Unmarshal([]byte(v), &bannerOverride); err != nil {
+			return bannerOverride, errors.Wrap(err, "Unable to decode banner")
+		}
+	}
+
+	return bannerOverride, nil
+}
+
+// setBannerOverride replaces the configured banner or removes the
+// replacement if the state has no message
+func setBannerOverride(state bannerState) error {
+	if getMainConfig().Cluster.Enabled() {
+		client, err := getRedisClient(getMainConfig().Cluster.Store)
+		if err != nil {
+			return err
+		}
+
+		if state.Message == "" {
+			_, err = client.Do("DEL", bannerRedisKey)
+		} else {
+			v, _ := json.Marshal(state)
+			args := []string{"SET", bannerRedisKey, string(v)}
+			if state.Until != nil {
+				args = append(args, "PX", strconv.FormatInt(int64(time.Until(*state.Until)/time.Millisecond)+1, 10))
+			}
+			_, err = client.Do(args...)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Unable to store banner")
+		}
+	}
+
+	bannerOverrideLock.Lock()
+	defer bannerOverrideLock.Unlock()
+
+	bannerOverride, bannerOverrideFetched = state, time.Now()
+	return nil
+}
+
+// currentBanner returns the banner set through the admin API or the
+// configured one while the replacement has not expired
+func currentBanner(r *http.Request) bannerState {
+	state, err := getBannerOverride()
+	if err != nil {
+		requestLog(r).WithError(err).Warn("Unable to update banner, using last known state")
+	}
+
+	if state.expired(time.Now()) {
+		return getMainConfig().Banner.state
+	}
+	return state
+}
+
+// visibleBanner returns the banner to show on the login page or nil
+func visibleBanner(r *http.Request) *bannerState {
+	if b := currentBanner(r); b.Active(time.Now()) {
+		return &b
+	}
+	return nil
+}
+
+func handleAdminBannerRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state := currentBanner(r)
+		if state.expired(time.Now()) {
+			state = bannerState{}
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(struct {
+			bannerState
+			Active bool `json:"active"`
+		}{state, state.Active(time.Now())}); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode banner")
+		}
+
+	case http.MethodPost:
+		now := time.Now()
+		state := bannerState{
+			Message:  r.FormValue("message"),
+			Severity: r.FormValue("severity"),
+			URL:      r.FormValue("url"),
+			Admin:    admin,
+		}
+
+		if state.Message == "" {
+			http.Error(res, "Parameter message is required", http.StatusBadRequest)
+			return
+		}
+
+		for param, target := range map[string]**time.Time{"start": &state.From, "duration": &state.Until} {
+			v := r.FormValue(param)
+			if v == "" {
+				continue
+			}
+
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(res, "Parameter "+param+" must be a positive duration", http.StatusBadRequest)
+				return
+			}
+			t := now.Add(d)
+			*target = &t
+		}
+		if state.From != nil && state.Until != nil {
+			// The duration starts with the banner
+			until := state.Until.Add(state.From.Sub(now))
+			state.Until = &until
+		}
+
+		if err := state.validate(); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := setBannerOverride(state); err != nil {
+			requestLog(r).WithError(err).Error("Unable to set banner")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		log.WithFields(log.Fields{"admin": admin, "severity": state.Severity}).Info("Banner set")
+		getMainConfig().AuditLog.Log(auditEventBannerChanged, r, map[string]string{
+			"admin":    admin,
+			"message":  state.Message,
+			"severity": state.Severity,
+		})
+		res.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := setBannerOverride(bannerState{}); err != nil {
+			requestLog(r).WithError(err).Error("Unable to remove banner")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		log.WithField("admin", admin).Info("Banner removed")
+		getMainConfig().AuditLog.Log(auditEventBannerChanged, r, map[string]string{"admin": admin})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
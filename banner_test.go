@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBannerConfig(t *testing.T) {
+	for name, b := range map[string]bannerConfig{
+		"unknown severity": {Message: "Maintenance", Severity: "critical"},
+		"invalid time":     {Message: "Maintenance", From: "tomorrow"},
+		"until before":     {Message: "Maintenance", From: "2026-10-02T08:00:00Z", Until: "2026-10-01T08:00:00Z"},
+		"relative url":     {Message: "Maintenance", URL: "/status"},
+	} {
+		if err := b.Validate(); err == nil {
+			t.Errorf("Expected banner with %s to be rejected", name)
+		}
+	}
+
+	b := bannerConfig{Message: "Maintenance", From: "2026-10-01T08:00:00Z", Until: "2026-10-01T10:00:00Z"}
+	if err := b.Validate(); err != nil {
+		t.Fatalf("Unable to validate banner: %s", err)
+	}
+	if b.state.Severity != bannerSeverityInfo {
+		t.Errorf("Expected default severity info, got %s", b.state.Severity)
+	}
+
+	for at, active := range map[string]bool{
+		"2026-10-01T07:59:59Z": false,
+		"2026-10-01T08:00:00Z": true,
+		"2026-10-01T10:00:00Z": false,
+	} {
+		now, _ := time.Parse(time.RFC3339, at)
+		if b.state.Active(now) != active {
+			t.Errorf("Expected banner to be active=%v at %s", active, at)
+		}
+	}
+}
+
+func TestBannerOverride(t *testing.T) {
+	prevBanner, prevFrontend := getMainConfig().Banner, getMainConfig().Frontend
+	defer func() {
+		getMainConfig().Banner, getMainConfig().Frontend = prevBanner, prevFrontend
+		setBannerOverride(bannerState{})
+	}()
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().Banner = bannerConfig{Message: "Configured banner"}
+	if err := getMainConfig().Banner.Validate(); err != nil {
+		t.Fatalf("Unable to validate banner: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	if b := visibleBanner(r); b == nil || b.Message != "Configured banner" {
+		t.Errorf("Expected configured banner, got %#v", b)
+	}
+
+	until := time.Now().Add(time.Hour)
+	setBannerOverride(bannerState{Message: "IdP maintenance tonight", Severity: bannerSeverityWarning, Until: &until})
+
+	res := httptest.NewRecorder()
+	handleLoginRequest(res, r)
+	if body := res.Body.String(); !strings.Contains(body, "IdP maintenance tonight") || !strings.Contains(body, "alert-warning") {
+		t.Errorf("Expected banner set through the API on the login page, got %d", res.Code)
+	}
+
+	// Expired replacements fall back to the configured banner
+	expired := time.Now().Add(-time.Minute)
+	setBannerOverride(bannerState{Message: "Done", Until: &expired})
+	if b := visibleBanner(r); b == nil || b.Message != "Configured banner" {
+		t.Errorf("Expected configured banner after expiry, got %#v", b)
+	}
+}
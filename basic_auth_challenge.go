@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const basicAuthChallengeDefaultRealm = "nginx-sso"
+
+// basicAuthChallengeConfig configures for which requests a missing
+// authentication is answered with a basic auth challenge to be handled
+// by API clients instead of being redirected to the login page
+type basicAuthChallengeConfig struct {
+	Enable       bool     `yaml:"enable"`
+	Accept       []string `yaml:"accept"`
+	PathPrefixes []string `yaml:"path_prefixes"`
+	Realm        string   `yaml:"realm"`
+}
+
+// Applies checks whether the request accepts one of the configured
+// media types or requests a path with one of the configured prefixes
+func (b basicAuthChallengeConfig) Applies(r *http.Request) bool {
+	if !b.Enable {
+		return false
+	}
+
+	accept := b.Accept
+	if len(accept) == 0 {
+		accept = []string{"application/json"}
+	}
+
+	for _, mediaType := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]))
+		for _, a := range accept {
+			if mediaType == strings.ToLower(a) {
+				return true
+			}
+		}
+	}
+
+	uri := requestURI(r)
+	for _, prefix := range b.PathPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetChallenge adds the WWW-Authenticate header to the response if the
+// challenge applies to the request
+func (b basicAuthChallengeConfig) SetChallenge(res http.ResponseWriter, r *http.Request) {
+	if !b.Applies(r) {
+		return
+	}
+
+	realm := b.Realm
+	if realm == "" {
+		realm = basicAuthChallengeDefaultRealm
+	}
+
+	res.Header().Set("WWW-Authenticate", `Basic realm="`+strings.Replace(realm, `"`, "", -1)+`", charset="UTF-8"`)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthChallenge(t *testing.T) {
+	b := basicAuthChallengeConfig{Enable: true, PathPrefixes: []string{"/api/"}}
+
+	for _, tc := range []struct {
+		Headers  map[string]string
+		Expected bool
+	}{
+		{map[string]string{"Accept": "text/html,application/xhtml+xml"}, false},
+		{map[string]string{"Accept": "application/json; charset=utf-8"}, true},
+		{map[string]string{"X-Origin-URI": "/api/v1/users"}, true},
+		{map[string]string{"X-Origin-URI": "/index.html"}, false},
+	} {
+		res := httptest.NewRecorder()
+		b.SetChallenge(res, aclTestRequest(tc.Headers))
+
+		if (res.Header().Get("WWW-Authenticate") != "") != tc.Expected {
+			t.Errorf("Challenge for %v expected = %v", tc.Headers, tc.Expected)
+		}
+	}
+
+	b.Enable = false
+	if b.Applies(aclTestRequest(map[string]string{"Accept": "application/json"})) {
+		t.Error("Disabled challenge applied")
+	}
+}
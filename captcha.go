@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	captchaKeyPrefix         = "nginx-sso:captcha:"
+	captchaVerifyTimeout     = 10 * time.Second
+	defaultCaptchaResetAfter = time.Hour
+)
+
+// captchaProvider describes how to embed and verify the challenges of
+// one of the supported CAPTCHA services
+type captchaProvider struct {
+	Script    string
+	Class     string
+	Field     string
+	VerifyURL string
+	// CSPSources need to be allowed in the content security policy
+	// to load the scripts, styles and frames of the widget
+	CSPSources []string
+}
+
+var captchaProviders = map[string]captchaProvider{
+	"hcaptcha": {
+		Script:     "https://js.hcaptcha.com/1/api.js",
+		Class:      "h-captcha",
+		Field:      "h-captcha-response",
+		VerifyURL:  "https://api.hcaptcha.com/siteverify",
+		CSPSources: []string{"https://hcaptcha.com", "https://*.hcaptcha.com"},
+	},
+	"recaptcha": {
+		Script:     "https://www.google.com/recaptcha/api.js",
+		Class:      "g-recaptcha",
+		Field:      "g-recaptcha-response",
+		VerifyURL:  "https://www.google.com/recaptcha/api/siteverify",
+		CSPSources: []string{"https://www.google.com/recaptcha/", "https://www.gstatic.com/recaptcha/"},
+	},
+	"turnstile": {
+		Script:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		Class:      "cf-turnstile",
+		Field:      "cf-turnstile-response",
+		VerifyURL:  "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		CSPSources: []string{"https://challenges.cloudflare.com"},
+	},
+}
+
+var (
+	captchaVerifyClient = &http.Client{Timeout: captchaVerifyTimeout}
+
+	failureCounterStores     = map[string]failureCounter{}
+	failureCounterStoresLock sync.Mutex
+)
+
+// captchaConfig requires a solved challenge on the login form once the
+// IP or the attempted account of the client reached after_failures
+// failed logins
+type captchaConfig struct {
+	Provider      string        `yaml:"provider"`
+	SiteKey       string        `yaml:"site_key"`
+	SecretKey     string        `yaml:"secret_key"`
+	AfterFailures int           `yaml:"after_failures"`
+	ResetAfter    time.Duration `yaml:"reset_after"`
+	MinScore      float64       `yaml:"min_score"`
+	VerifyURL     string        `yaml:"verify_url"`
+	Store         string        `yaml:"store"`
+}
+
+// captchaWidget is passed to the login template to render the challenge
+type captchaWidget struct {
+	Script  string
+	Class   string
+	SiteKey string
+}
+
+func (c captchaConfig) Validate() error {
+	if c.Provider == "" {
+		return nil
+	}
+
+	if _, ok := captchaProviders[c.Provider]; !ok {
+		return errors.Errorf("Unsupported provider %q, use hcaptcha, recaptcha or turnstile", c.Provider)
+	}
+
+	switch {
+	case c.SiteKey == "" || c.SecretKey == "":
+		return errors.New("Site key and secret key are required")
+	case c.AfterFailures < 0:
+		return errors.New("After failures must not be negative")
+	case c.ResetAfter <= 0:
+		return errors.New("Reset after must be set")
+	case c.MinScore < 0 || c.MinScore > 1:
+		return errors.New("Min score needs to be between 0 and 1")
+	}
+
+	if c.VerifyURL != "" {
+		if u, err := url.Parse(c.VerifyURL); err != nil || u.Host == "" {
+			return errors.New("Verify URL is invalid")
+		}
+	}
+
+	if c.Store == "" || c.Store == "memory" {
+		return nil
+	}
+
+	_, err := parseRedisURI(c.Store)
+	return err
+}
+
+func (c captchaConfig) provider() captchaProvider {
+	p := captchaProviders[c.Provider]
+	if c.VerifyURL != "" {
+		p.VerifyURL = c.VerifyURL
+	}
+	return p
+}
+
+// Widget returns the challenge to render into the login form or nil if
+// the client does not need to solve one (yet)
+func (c captchaConfig) Widget(r *http.Request) *captchaWidget {
+	if c.Provider == "" {
+		return nil
+	}
+
+	if r.URL.Query().Get("captcha") != "required" && !c.Required(r, "") {
+		return nil
+	}
+
+	p := c.provider()
+	return &captchaWidget{Script: p.Script, Class: p.Class, SiteKey: c.SiteKey}
+}
+
+// Required checks whether the IP of the client or the attempted user
+// reached the failure threshold. If the counter is not available no
+// challenge is required.
+func (c captchaConfig) Required(r *http.Request, user string) bool {
+	if c.Provider == "" {
+		return false
+	}
+	if c.AfterFailures == 0 {
+		return true
+	}
+
+	counter, err := getFailureCounter(getMainConfig().Cluster.storeFor(c.Store))
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to access CAPTCHA failure counter")
+		return false
+	}
+
+	for _, key := range c.keys(r, user) {
+		n, err := counter.Get(key)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to read CAPTCHA failure counter")
+			return false
+		}
+		if n >= c.AfterFailures {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecordFailure counts a failed login for the IP and the user
+func (c captchaConfig) RecordFailure(r *http.Request, user string) {
+	if c.Provider == "" || c.AfterFailures == 0 {
+		return
+	}
+
+	counter, err := getFailureCounter(getMainConfig().Cluster.storeFor(c.Store))
+	if err == nil {
+		for _, key := range c.keys(r, user) {
+			if _, err = counter.Increment(key, c.ResetAfter); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to count failure for CAPTCHA")
+	}
+}
+
+// RecordSuccess resets the failures of the user. The failures of the
+// IP are kept to not let attackers reset them using their own account.
+func (c captchaConfig) RecordSuccess(r *http.Request, user string) {
+	if c.Provider == "" || c.AfterFailures == 0 || user == "" {
+		return
+	}
+
+	counter, err := getFailureCounter(getMainConfig().Cluster.storeFor(c.Store))
+	if err == nil {
+		err = counter.Delete(c.keys(r, user)[1])
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to reset CAPTCHA failure counter")
+	}
+}
+
+func (c captchaConfig) keys(r *http.Request, user string) []string {
+	keys := []string{captchaKeyPrefix + "ip:" + getMainConfig().trustedClientIP(r)}
+	if user != "" {
+		keys = append(keys, captchaKeyPrefix+"user:"+strings.ToLower(user))
+	}
+	return keys
+}
+
+// Verify checks the response to the challenge submitted with the login
+// form at the provider
+func (c captchaConfig) Verify(r *http.Request) error {
+	p := c.provider()
+
+	token := r.PostFormValue(p.Field)
+	if token == "" {
+		return errors.New("No CAPTCHA response submitted")
+	}
+
+	resp, err := captchaVerifyClient.PostForm(p.VerifyURL, url.Values{
+		"secret":   {c.SecretKey},
+		"response": {token},
+		"remoteip": {getMainConfig().trustedClientIP(r)},
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to verify CAPTCHA response")
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		Score      *float64 `json:"score"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.Wrap(err, "Unable to decode verification result")
+	}
+
+	if !result.Success {
+		return errors.Errorf("CAPTCHA response rejected: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+
+	// Only reCAPTCHA v3 returns a score
+	if result.Score != nil && *result.Score < c.MinScore {
+		return errors.Errorf("CAPTCHA score %s below minimum", strconv.FormatFloat(*result.Score, 'f', -1, 64))
+	}
+
+	return nil
+}
+
+type failureCounter interface {
+	// Get returns the number of failures counted for the key
+	Get(key string) (int, error)
+
+	// Increment counts a failure, the counter expires after ttl
+	// without failures
+	Increment(key string, ttl time.Duration) (int, error)
+
+	// Delete resets the counter of the key
+	Delete(key string) error
+}
+
+func getFailureCounter(store string) (failureCounter, error) {
+	failureCounterStoresLock.Lock()
+	defer failureCounterStoresLock.Unlock()
+
+	if f, ok := failureCounterStores[store]; ok {
+		return f, nil
+	}
+
+	var f failureCounter
+	if store == "" || store == "memory" {
+		f = newMemoryFailureCounter()
+	} else {
+		c, err := getRedisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		f = redisFailureCounter{c}
+	}
+
+	failureCounterStores[store] = f
+	return f, nil
+}
+
+type memoryFailureCounterEntry struct {
+	count   int
+	expires time.Time
+}
+
+type memoryFailureCounter struct {
+	entries map[string]memoryFailureCounterEntry
+	lock    sync.Mutex
+}
+
+func newMemoryFailureCounter() *memoryFailureCounter {
+	m := &memoryFailureCounter{entries: map[string]memoryFailureCounterEntry{}}
+	go m.cleanup()
+	return m
+}
+
+func (m *memoryFailureCounter) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for key, e := range m.entries {
+			if e.expires.Before(time.Now()) {
+				delete(m.entries, key)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *memoryFailureCounter) Get(key string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.expires.Before(time.Now()) {
+		return 0, nil
+	}
+	return e.count, nil
+}
+
+func (m *memoryFailureCounter) Increment(key string, ttl time.Duration) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.expires.Before(time.Now()) {
+		e = memoryFailureCounterEntry{}
+	}
+	e.count++
+	e.expires = time.Now().Add(ttl)
+	m.entries[key] = e
+
+	return e.count, nil
+}
+
+func (m *memoryFailureCounter) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// redisFailureCounter shares the counters between all instances using
+// the same Redis
+type redisFailureCounter struct {
+	client *redisClient
+}
+
+func (r redisFailureCounter) Get(key string) (int, error) {
+	reply, err := r.client.Do("GET", key)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	s, _ := reply.(string)
+	return strconv.Atoi(s)
+}
+
+func (r redisFailureCounter) Increment(key string, ttl time.Duration) (int, error) {
+	reply, err := r.client.Do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.client.Do("PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10)); err != nil {
+		return 0, err
+	}
+
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+func (r redisFailureCounter) Delete(key string) error {
+	_, err := r.client.Do("DEL", key)
+	return err
+}
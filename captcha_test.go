@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptcha(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.PostFormValue("secret") != "secret":
+			res.Write([]byte(`{"success": false, "error-codes": ["invalid-input-secret"]}`))
+		case r.PostFormValue("response") == "bot":
+			res.Write([]byte(`{"success": true, "score": 0.1}`))
+		default:
+			res.Write([]byte(`{"success": true, "score": 0.9}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := captchaConfig{
+		Provider:      "recaptcha",
+		SiteKey:       "site",
+		SecretKey:     "secret",
+		AfterFailures: 2,
+		ResetAfter:    time.Hour,
+		MinScore:      0.5,
+		VerifyURL:     srv.URL,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unable to validate CAPTCHA config: %s", err)
+	}
+
+	login := func(response string) *http.Request {
+		form := url.Values{"g-recaptcha-response": {response}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "198.51.100.20:40000"
+		return r
+	}
+
+	r := login("")
+	if c.Required(r, "eve") || c.Widget(r) != nil {
+		t.Fatal("Expected no challenge before the first failure")
+	}
+
+	c.RecordFailure(r, "eve")
+	c.RecordFailure(r, "eve")
+
+	if !c.Required(login(""), "someone") {
+		t.Error("Expected challenge for the IP with failures")
+	}
+	if w := c.Widget(login("")); w == nil || w.Class != "g-recaptcha" || w.SiteKey != "site" {
+		t.Errorf("Unexpected widget %v", w)
+	}
+
+	other := login("")
+	other.RemoteAddr = "203.0.113.50:40000"
+	if !c.Required(other, "Eve") {
+		t.Error("Expected challenge for the account with failures from other IPs")
+	}
+
+	if err := c.Verify(login("")); err == nil {
+		t.Error("Expected missing response to be rejected")
+	}
+	if err := c.Verify(login("bot")); err == nil {
+		t.Error("Expected response with low score to be rejected")
+	}
+	if err := c.Verify(login("human")); err != nil {
+		t.Errorf("Expected valid response to be accepted: %s", err)
+	}
+
+	c.RecordSuccess(other, "eve")
+	if c.Required(other, "eve") {
+		t.Error("Expected account failures to be reset on success")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/flosch/pongo2"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+// reservedClaims are set by nginx-sso in the issued tokens and can not
+// be overwritten by the claims mapping
+var reservedClaims = []string{"aud", "auth_time", "cnf", "exp", "groups", "iat", "iss", "jti", "nbf", "nonce", "scope", "sub", "token_use"}
+
+func init() {
+	pongo2.RegisterFilter("strip_domain", filterStripDomain)
+}
+
+// filterStripDomain removes the domain from user names in the forms
+// user@example.com and EXAMPLE\user
+func filterStripDomain(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	s := in.String()
+	if i := strings.LastIndex(s, "\\"); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.Index(s, "@"); i >= 0 {
+		s = s[:i]
+	}
+	return pongo2.AsValue(s), nil
+}
+
+// claimsMappingConfig transforms the identity detected by the providers
+// before it is forwarded to the upstream applications through identity
+// headers, the identity assertion and the tokens of the OIDC provider.
+// The ACL is still evaluated against the identity of the providers.
+type claimsMappingConfig struct {
+	User   string            `yaml:"user"`
+	Groups []string          `yaml:"groups"`
+	Claims map[string]string `yaml:"claims"`
+
+	user   *pongo2.Template
+	groups []*pongo2.Template
+	claims map[string]*pongo2.Template
+}
+
+func compileMappingTemplate(tpl string) (*pongo2.Template, error) {
+	// Values are no HTML, they must not be escaped
+	return pongo2.FromString("{% autoescape off %}" + tpl + "{% endautoescape %}")
+}
+
+// Compile parses the templates of the mapping
+func (c *claimsMappingConfig) Compile() error {
+	var err error
+
+	c.user = nil
+	if c.User != "" {
+		if c.user, err = compileMappingTemplate(c.User); err != nil {
+			return fmt.Errorf("Template for user is invalid: %s", err)
+		}
+	}
+
+	c.groups = nil
+	for n, tpl := range c.Groups {
+		t, err := compileMappingTemplate(tpl)
+		if err != nil {
+			return fmt.Errorf("Template for groups on position %d is invalid: %s", n+1, err)
+		}
+		c.groups = append(c.groups, t)
+	}
+
+	c.claims = map[string]*pongo2.Template{}
+	for name, tpl := range c.Claims {
+		if str.StringInSlice(name, reservedClaims) {
+			return fmt.Errorf("Claim %q is reserved and can not be mapped", name)
+		}
+
+		if c.claims[name], err = compileMappingTemplate(tpl); err != nil {
+			return fmt.Errorf("Template for claim %q is invalid: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Apply renders the mapping for the identity of the request. The
+// mapped claims are added to the claims of the session and returned
+// to be embedded into tokens.
+func (c claimsMappingConfig) Apply(r *http.Request, user string, groups []string) (string, []string, map[string]string, error) {
+	if c.user == nil && len(c.groups) == 0 && len(c.claims) == 0 {
+		// Nothing to render, the identity is passed on as it is
+		return user, groups, map[string]string{}, nil
+	}
+
+	m, _ := getSessionMeta(r)
+
+	ctx := pongo2.Context{
+		"user":     user,
+		"groups":   groups,
+		"provider": m.Provider,
+		"mfa":      m.MFA,
+		"claims":   m.Claims,
+	}
+
+	// All templates are rendered using the original identity
+	render := func(t *pongo2.Template) (string, error) {
+		v, err := t.Execute(ctx)
+		return strings.TrimSpace(lineBreakReplacer.Replace(v)), err
+	}
+
+	mappedUser := user
+	if c.user != nil {
+		v, err := render(c.user)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("Unable to render user: %s", err)
+		}
+		if v == "" {
+			return "", nil, nil, fmt.Errorf("Mapped user for %q is empty", user)
+		}
+		mappedUser = v
+	}
+
+	mappedGroups := groups
+	if len(c.groups) > 0 {
+		// Every template renders a comma separated list of groups, the
+		// lists are merged
+		mappedGroups = []string{}
+		for n, t := range c.groups {
+			v, err := render(t)
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("Unable to render groups on position %d: %s", n+1, err)
+			}
+
+			for _, g := range strings.Split(v, ",") {
+				if g = strings.TrimSpace(g); g != "" && !str.StringInSlice(g, mappedGroups) {
+					mappedGroups = append(mappedGroups, g)
+				}
+			}
+		}
+	}
+
+	mappedClaims := map[string]string{}
+	for name, t := range c.claims {
+		v, err := render(t)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("Unable to render claim %q: %s", name, err)
+		}
+		if v != "" {
+			mappedClaims[name] = v
+		}
+	}
+	setSessionClaims(r, mappedClaims)
+
+	return mappedUser, mappedGroups, mappedClaims, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClaimsMapping(t *testing.T) {
+	c := claimsMappingConfig{
+		User: "{{ user|strip_domain|lower }}",
+		Groups: []string{
+			`{{ groups|join:"," }}`,
+			"{{ claims.department }}",
+			"staff",
+		},
+		Claims: map[string]string{
+			"email":  "{{ claims.mail|default:user|lower }}",
+			"absent": "{{ claims.unknown }}",
+		},
+	}
+	if err := c.Compile(); err != nil {
+		t.Fatalf("Unable to compile mapping: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	setSessionClaims(r, map[string]string{"department": "engineering"})
+	defer clearSessionMeta(r)
+
+	user, groups, claims, err := c.Apply(r, `EXAMPLE\Jane.Doe`, []string{"admins", "staff"})
+	if err != nil {
+		t.Fatalf("Unable to apply mapping: %s", err)
+	}
+
+	if user != "jane.doe" {
+		t.Errorf("Expected user jane.doe, got %q", user)
+	}
+
+	if len(groups) != 3 || groups[0] != "admins" || groups[1] != "staff" || groups[2] != "engineering" {
+		t.Errorf("Expected merged groups without duplicates, got %v", groups)
+	}
+
+	if claims["email"] != `example\jane.doe` {
+		t.Errorf("Expected email to fall back to the user, got %q", claims["email"])
+	}
+	if _, ok := claims["absent"]; ok {
+		t.Error("Expected empty claim to be omitted")
+	}
+
+	if m, _ := getSessionMeta(r); m.Claims["email"] != claims["email"] || m.Claims["department"] != "engineering" {
+		t.Errorf("Expected mapped claims to be merged into the session claims, got %v", m.Claims)
+	}
+}
+
+func TestClaimsMappingDefaults(t *testing.T) {
+	c := claimsMappingConfig{}
+	if err := c.Compile(); err != nil {
+		t.Fatalf("Unable to compile mapping: %s", err)
+	}
+
+	user, groups, claims, err := c.Apply(httptest.NewRequest(http.MethodGet, "/auth", nil), "alice", []string{"admins"})
+	if err != nil || user != "alice" || len(groups) != 1 || len(claims) != 0 {
+		t.Errorf("Expected identity to pass unchanged, got %q %v %v (%v)", user, groups, claims, err)
+	}
+}
+
+func TestClaimsMappingReserved(t *testing.T) {
+	c := claimsMappingConfig{Claims: map[string]string{"sub": "{{ user }}"}}
+	if err := c.Compile(); err == nil {
+		t.Error("Expected reserved claim to be rejected")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+// forwardedElement contains the parameters of one element of the
+// Forwarded header (RFC 7239)
+type forwardedElement struct {
+	For   string
+	Proto string
+}
+
+// parseForwardedHeader parses all Forwarded headers of the request into
+// their elements, the proxy closest to the client comes first
+func parseForwardedHeader(r *http.Request) []forwardedElement {
+	var elements []forwardedElement
+
+	for _, hdr := range r.Header["Forwarded"] {
+		for _, raw := range strings.Split(hdr, ",") {
+			var e forwardedElement
+			for _, pair := range strings.Split(raw, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+
+				value := strings.Trim(kv[1], `"`)
+				switch strings.ToLower(kv[0]) {
+				case "for":
+					e.For = stripForwardedPort(value)
+				case "proto":
+					e.Proto = strings.ToLower(value)
+				}
+			}
+			elements = append(elements, e)
+		}
+	}
+
+	return elements
+}
+
+// stripForwardedPort removes the port from addresses like 192.0.2.1:80
+// or [2001:db8::1]:80 and the brackets of IPv6 addresses
+func stripForwardedPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+func (m *mainConfig) validateTrustedProxyHeader() error {
+	switch http.CanonicalHeaderKey(m.TrustedProxyHeader) {
+	case "", "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+		return nil
+	}
+	return errors.Errorf("Unsupported header %q, use Forwarded, X-Forwarded-For or X-Real-IP", m.TrustedProxyHeader)
+}
+
+// forwardedFor returns the chain of client addresses passed by the
+// proxies in the trusted_proxy_header. The proxy closest to the client
+// comes first. Only the configured header is read: The proxy passes
+// other headers sent by the client unchanged.
+func (m *mainConfig) forwardedFor(r *http.Request) []string {
+	var addrs []string
+
+	switch http.CanonicalHeaderKey(m.TrustedProxyHeader) {
+	case "Forwarded":
+		for _, e := range parseForwardedHeader(r) {
+			addrs = append(addrs, e.For)
+		}
+
+	case "X-Real-Ip":
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			addrs = append(addrs, strings.TrimSpace(realIP))
+		}
+
+	default:
+		for _, hdr := range r.Header["X-Forwarded-For"] {
+			for _, addr := range strings.Split(hdr, ",") {
+				addrs = append(addrs, strings.TrimSpace(addr))
+			}
+		}
+	}
+
+	return addrs
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		// Also handles IPv6 addresses like [::1]:1234
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// isTrustedProxy checks whether the address belongs to a proxy allowed
+// to pass the client address and scheme
+func (m *mainConfig) isTrustedProxy(addr string) bool {
+	return acl.IPInNetworks(addr, m.trustedProxyNets)
+}
+
+// trustedClientIP walks the chain of forwarded addresses from the
+// connection back to the client and returns the first address not
+// belonging to a trusted proxy. Addresses passed by other sources are
+// ignored as they can be spoofed.
+func (m *mainConfig) trustedClientIP(r *http.Request) string {
+	addrs := append(m.forwardedFor(r), remoteIP(r))
+
+	for i := len(addrs) - 1; i > 0; i-- {
+		if !m.isTrustedProxy(addrs[i]) {
+			return addrs[i]
+		}
+	}
+
+	return addrs[0]
+}
+
+// requestScheme returns the scheme the client used to access the
+// original URL
+func requestScheme(r *http.Request) string {
+	if len(getMainConfig().trustedProxyNets) == 0 {
+		// Legacy behaviour: Trust the header of every source
+		if scheme := r.Header.Get("X-Forwarded-Proto"); scheme != "" {
+			return scheme
+		}
+		return "https"
+	}
+
+	if m := getMainConfig(); m.isTrustedProxy(remoteIP(r)) {
+		if http.CanonicalHeaderKey(m.TrustedProxyHeader) == "Forwarded" {
+			for _, e := range parseForwardedHeader(r) {
+				if e.Proto != "" {
+					return e.Proto
+				}
+			}
+		} else if scheme := r.Header.Get("X-Forwarded-Proto"); scheme != "" {
+			return strings.TrimSpace(strings.SplitN(scheme, ",", 2)[0])
+		}
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	defer func() {
+		getMainConfig().trustedProxyNets = nil
+		getMainConfig().TrustedProxyHeader = "X-Forwarded-For"
+	}()
+
+	var err error
+	if getMainConfig().trustedProxyNets, err = acl.ParseCIDRs([]string{"127.0.0.1", "10.0.0.0/8", "2001:db8::/32"}); err != nil {
+		t.Fatalf("Unable to parse trusted proxies: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		remote    string
+		header    string
+		headers   map[string]string
+		expIP     string
+		expScheme string
+	}{
+		{
+			name:      "direct client spoofing headers",
+			remote:    "192.0.2.10:5000",
+			headers:   map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"},
+			expIP:     "192.0.2.10",
+			expScheme: "http",
+		},
+		{
+			name:      "single trusted proxy",
+			remote:    "127.0.0.1:5000",
+			headers:   map[string]string{"X-Forwarded-For": "192.0.2.10", "X-Forwarded-Proto": "https"},
+			expIP:     "192.0.2.10",
+			expScheme: "https",
+		},
+		{
+			name:    "client prepending spoofed address",
+			remote:  "127.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.10, 10.1.2.3"},
+			expIP:   "192.0.2.10",
+		},
+		{
+			name:    "only trusted proxies",
+			remote:  "127.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-For": "10.1.2.3"},
+			expIP:   "10.1.2.3",
+		},
+		{
+			name:      "forwarded header",
+			remote:    "[2001:db8::1]:5000",
+			header:    "Forwarded",
+			headers:   map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711";proto=https, for=10.1.2.3`},
+			expIP:     "2001:db8:cafe::17",
+			expScheme: "https",
+		},
+		{
+			name:    "client sending forwarded header",
+			remote:  "127.0.0.1:5000",
+			headers: map[string]string{"Forwarded": "for=198.51.100.1;proto=https", "X-Forwarded-For": "192.0.2.10", "X-Real-IP": "198.51.100.2"},
+			expIP:   "192.0.2.10",
+		},
+		{
+			name:    "real ip",
+			remote:  "127.0.0.1:5000",
+			header:  "X-Real-IP",
+			headers: map[string]string{"X-Real-IP": "192.0.2.10", "X-Forwarded-For": "198.51.100.1"},
+			expIP:   "192.0.2.10",
+		},
+	} {
+		getMainConfig().TrustedProxyHeader = tc.header
+		if tc.header == "" {
+			getMainConfig().TrustedProxyHeader = "X-Forwarded-For"
+		}
+
+		r, _ := http.NewRequest(http.MethodGet, "/auth", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+
+		if ip := getMainConfig().AuditLog.findIP(r); ip != tc.expIP {
+			t.Errorf("%s: Expected client IP %q, got %q", tc.name, tc.expIP, ip)
+		}
+
+		expScheme := tc.expScheme
+		if expScheme == "" {
+			expScheme = "http"
+		}
+		if scheme := requestScheme(r); scheme != expScheme {
+			t.Errorf("%s: Expected scheme %q, got %q", tc.name, expScheme, scheme)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// clusterConfig lets multiple instances behind a load-balancer share
+// their state through Redis so they behave like a single instance
+type clusterConfig struct {
+	Store string `yaml:"store"`
+}
+
+func (c clusterConfig) Enabled() bool { return c.Store != "" }
+
+// Validate checks the store and rejects settings keeping state which
+// would differ between the instances of the cluster
+func (m *mainConfig) validateCluster() error {
+	c := m.Cluster
+	if !c.Enabled() {
+		return nil
+	}
+
+	if _, err := parseRedisURI(c.Store); err != nil {
+		return errors.Wrap(err, "Invalid store")
+	}
+
+	if m.SessionStore.Type == "memory" {
+		return errors.New("The memory session store is not shared between the instances, use the redis session store")
+	}
+
+	if m.Cookie.KeyRotation.Interval > 0 {
+		return errors.New("Rotated cookie keys are generated by every instance on its own, configure the cookie keys instead")
+	}
+
+	return nil
+}
+
+// storeFor returns the store to use for a feature: If the feature has
+// no store configured the store of the cluster is used.
+func (c clusterConfig) storeFor(store string) string {
+	if store == "" {
+		return c.Store
+	}
+	return store
+}
+
+// clusterChecker reports the instance to be not ready while the store
+// of the cluster is not reachable
+type clusterChecker struct {
+	store string
+}
+
+func (c clusterChecker) CheckReadiness() error {
+	client, err := getRedisClient(c.store)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Do("PING")
+	return errors.Wrap(err, "Cluster store is not reachable")
+}
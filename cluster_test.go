@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements the commands used by the cluster mode
+// including its scripts, expiry is ignored
+type fakeRedis struct {
+	strings map[string]string
+	sets    map[string]map[string]bool
+	lock    sync.Mutex
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	f := &fakeRedis{strings: map[string]string{}, sets: map[string]map[string]bool{}}
+	addr, _ := serveFakeRedis(t, f.exec)
+	return f, "redis://" + addr
+}
+
+// serveFakeRedis serves RESP connections answering every command with
+// the reply returned by handle
+func serveFakeRedis(t *testing.T, handle func(cmd []string) string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.Peek(1); err != nil {
+						return
+					}
+					conn.Write([]byte(handle(readRESPCommand(r))))
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func readRESPCommand(r *bufio.Reader) []string {
+	line, _ := r.ReadString('\n')
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	args := []string{}
+	for i := 0; i < n; i++ {
+		line, _ = r.ReadString('\n')
+		length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, length+2)
+		io.ReadFull(r, arg)
+		args = append(args, string(arg[:length]))
+	}
+	return args
+}
+
+func (f *fakeRedis) exec(cmd []string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch cmd[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := f.strings[cmd[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		f.strings[cmd[1]] = cmd[2]
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.strings[cmd[1]]
+		delete(f.strings, cmd[1])
+		delete(f.sets, cmd[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SREM":
+		delete(f.sets[cmd[1]], cmd[2])
+		return ":1\r\n"
+	case "SMEMBERS":
+		out := fmt.Sprintf("*%d\r\n", len(f.sets[cmd[1]]))
+		for m := range f.sets[cmd[1]] {
+			out += fmt.Sprintf("$%d\r\n%s\r\n", len(m), m)
+		}
+		return out
+	case "EVAL":
+		switch cmd[1] {
+		case redisSessionSaveScript:
+			f.strings[cmd[3]] = cmd[5]
+			if f.sets[cmd[4]] == nil {
+				f.sets[cmd[4]] = map[string]bool{}
+			}
+			f.sets[cmd[4]][cmd[6]] = true
+			return ":1\r\n"
+		case redisSessionIndexScript:
+			if f.sets[cmd[3]] == nil {
+				f.sets[cmd[3]] = map[string]bool{}
+			}
+			f.sets[cmd[3]][cmd[4]] = true
+			return ":1\r\n"
+		case redisRequestCountScript:
+			n, _ := strconv.Atoi(f.strings[cmd[3]])
+			f.strings[cmd[3]] = strconv.Itoa(n + 1)
+			return fmt.Sprintf(":%d\r\n", n+1)
+		}
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	f, uri := startFakeRedis(t)
+
+	s, err := newRedisSessionStore(uri)
+	if err != nil {
+		t.Fatalf("Unable to create store: %s", err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	for i, id := range []string{"a", "b"} {
+		if err := s.Save(sessionInfo{ID: id, User: "jane", Created: now.Add(time.Duration(i) * time.Second)}, time.Hour); err != nil {
+			t.Fatalf("Unable to save session: %s", err)
+		}
+	}
+
+	if info, err := s.Get("a"); err != nil || info.User != "jane" {
+		t.Errorf("Expected session of jane, got %#v (%v)", info, err)
+	}
+	if _, err := s.Get("unknown"); err != errSessionNotFound {
+		t.Errorf("Expected unknown session to be not found, got %v", err)
+	}
+
+	// Expired sessions vanish from the index on listing
+	delete(f.strings, redisSessionKeyPrefix+"b")
+	if list, err := s.ListByUser("jane"); err != nil || len(list) != 1 || list[0].ID != "a" {
+		t.Errorf("Expected only session a, got %#v (%v)", list, err)
+	}
+	if f.sets[redisUserSessionKeyPrefix+"jane"]["b"] {
+		t.Error("Expected expired session to be removed from the index")
+	}
+
+	s.Save(sessionInfo{ID: "c", User: "jane"}, time.Hour)
+	if n, err := s.DeleteByUser("jane"); err != nil || n != 2 {
+		t.Errorf("Expected 2 deleted sessions, got %d (%v)", n, err)
+	}
+	if _, err := s.Get("a"); err != errSessionNotFound {
+		t.Errorf("Expected session to be deleted, got %v", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if n, err := s.Increment("quota|jane", time.Minute); err != nil || n != i {
+			t.Errorf("Expected count %d, got %d (%v)", i, n, err)
+		}
+	}
+
+	if err := (clusterChecker{uri}).CheckReadiness(); err != nil {
+		t.Errorf("Expected cluster store to be ready: %s", err)
+	}
+}
+
+func TestClusterValidation(t *testing.T) {
+	m := &mainConfig{}
+	m.Cluster.Store = "redis://127.0.0.1:6379"
+
+	if err := m.validateCluster(); err != nil {
+		t.Errorf("Expected cluster to be valid: %s", err)
+	}
+
+	m.SessionStore.Type = "memory"
+	if err := m.validateCluster(); err == nil {
+		t.Error("Expected memory session store to be rejected")
+	}
+
+	m.SessionStore.Type = "redis"
+	if c := m.sessionStoreConfig(); c.URI != m.Cluster.Store {
+		t.Errorf("Expected session store to use the cluster store, got %q", c.URI)
+	}
+
+	m.Cookie.KeyRotation.Interval = time.Hour
+	if err := m.validateCluster(); err == nil {
+		t.Error("Expected key rotation to be rejected")
+	}
+
+	if s := m.Cluster.storeFor("memory"); s != "memory" {
+		t.Errorf("Expected explicit store to be kept, got %q", s)
+	}
+	if s := m.Cluster.storeFor(""); s != m.Cluster.Store {
+		t.Errorf("Expected cluster store as default, got %q", s)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configSource is the configuration read from a file or a directory of
+// files merged into one document
+type configSource struct {
+	// Source is the (merged) YAML document
+	Source []byte
+	// Original is the document before it was migrated to the current
+	// schema version, only set for single files
+	Original []byte
+	// Dir is the directory relative ACL includes are resolved in
+	Dir string
+	// Files contains the files read (and the directory itself) to be
+	// watched for changes
+	Files []string
+}
+
+// readConfiguration reads the configuration at location. If location is
+// a directory all .yaml / .yml files directly inside it are read in
+// lexical order and deep-merged: Mappings are merged key by key, all
+// other values (including sequences) of later files replace the values
+// of earlier ones. Configurations of older schema versions are migrated
+// to the current version.
+func readConfiguration(location string) (configSource, error) {
+	stat, err := os.Stat(location)
+	if err != nil {
+		return configSource{}, err
+	}
+
+	if !stat.IsDir() {
+		original, err := readConfigFile(location)
+		if err != nil {
+			return configSource{}, err
+		}
+		source, err := migrateConfigSource(original)
+		return configSource{Source: source, Original: original, Dir: filepath.Dir(location), Files: []string{location}}, err
+	}
+
+	files, err := configDirFiles(location)
+	if err != nil {
+		return configSource{}, err
+	}
+
+	merged := map[interface{}]interface{}{}
+	for _, file := range files {
+		doc, err := readConfigDocument(file)
+		if err != nil {
+			return configSource{}, fmt.Errorf("Unable to read %q: %s", file, err)
+		}
+		mergeConfigMaps(merged, doc)
+	}
+
+	source, err := yaml.Marshal(merged)
+	if err != nil {
+		return configSource{}, fmt.Errorf("Unable to merge configuration files: %s", err)
+	}
+
+	if source, err = migrateConfigSource(source); err != nil {
+		return configSource{}, err
+	}
+
+	return configSource{Source: source, Dir: location, Files: append([]string{location}, files...)}, nil
+}
+
+// configDirFiles lists the YAML files in the directory in lexical
+// order. Hidden files (like the ..data link of Kubernetes ConfigMap
+// volumes) are skipped.
+func configDirFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		// Resolve links to decide whether this is a file
+		if stat, err := os.Stat(filepath.Join(dir, name)); err != nil || stat.IsDir() {
+			continue
+		}
+
+		files = append(files, filepath.Join(dir, name))
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func readConfigDocument(file string) (map[interface{}]interface{}, error) {
+	source, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := map[interface{}]interface{}{}
+	return doc, yaml.Unmarshal(source, &doc)
+}
+
+func mergeConfigMaps(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[k].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeConfigMaps(dstMap, srcMap)
+			continue
+		}
+
+		dst[k] = v
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestReadConfigurationDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-config-dir")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer initializePATStore(patConfig{})
+
+	for name, content := range map[string]string{
+		"00-main.yaml": "cookie:\n  domain: \".example.com\"\n  secure: true\ntrusted_proxies: [\"10.0.0.0/8\"]\n",
+		"10-acl.yml":   "acl:\n  rule_sets:\n  - rules:\n    - field: \"host\"\n      equals: \"a.example.com\"\n    allow: [\"alice\"]\n",
+		"20-prod.yaml": "cookie:\n  domain: \".example.org\"\ntrusted_proxies: [\"192.168.0.0/16\"]\n",
+		".hidden.yaml": "cookie:\n  domain: \"hidden\"\n",
+		"README.md":    "Not a configuration file",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+
+	config, err := readConfiguration(dir)
+	if err != nil {
+		t.Fatalf("Unable to read configuration directory: %s", err)
+	}
+
+	if config.Dir != dir || len(config.Files) != 4 || config.Files[0] != dir || config.Files[3] != filepath.Join(dir, "20-prod.yaml") {
+		t.Errorf("Unexpected files %v in %q", config.Files, config.Dir)
+	}
+
+	m := &mainConfig{}
+	if err := yaml.Unmarshal(config.Source, m); err != nil {
+		t.Fatalf("Unable to parse merged configuration: %s", err)
+	}
+	if m.Cookie.Domain != ".example.org" || !m.Cookie.Secure {
+		t.Errorf("Expected cookie settings to be merged, got %+v", m.Cookie)
+	}
+	if !reflect.DeepEqual(m.TrustedProxies, []string{"192.168.0.0/16"}) {
+		t.Errorf("Expected sequences to be replaced, got %v", m.TrustedProxies)
+	}
+
+	// Problems are reported in the file defining the broken setting
+	if err := ioutil.WriteFile(filepath.Join(dir, "30-cors.yaml"), []byte("# CORS\ncors:\n  allowed_origins: [\"*\"]\n  allow_credentials: true\n"), 0600); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	problems, err := checkConfiguration(dir)
+	if err != nil {
+		t.Fatalf("Unable to check configuration: %s", err)
+	}
+	if len(problems) == 0 || problems[0].File != filepath.Join(dir, "30-cors.yaml") || problems[0].Line != 2 {
+		t.Errorf("Expected CORS problem in 30-cors.yaml:2, got %v", problems)
+	}
+}
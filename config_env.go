@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// configEnvReference matches ${VAR} and ${VAR:-default} references,
+// $${VAR} is the escaped form of a literal ${VAR}
+var configEnvReference = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// readConfigFile reads a configuration file, decrypts it if it was
+// encrypted using sops and expands the references to environment
+// variables and secrets in it
+func readConfigFile(file string) ([]byte, error) {
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if isSOPSDocument(source) {
+		if source, err = decryptSOPSFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if source, err = expandConfigEnv(source); err != nil {
+		return nil, err
+	}
+	source = expandConfigSecretFiles(source)
+
+	return expandConfigSecrets(source)
+}
+
+// expandConfigEnv replaces ${VAR} by the value of the environment
+// variable and ${VAR:-default} by the value or the default if the
+// variable is unset or empty. References to unset variables without
+// default are an error to prevent starting with empty secrets. If
+// VAR is unset or empty but VAR_FILE is set the reference is replaced
+// by a reference to the file secret. Lines containing only a comment
+// are kept as they are.
+func expandConfigEnv(source []byte) ([]byte, error) {
+	lines := strings.Split(string(source), "\n")
+
+	var missing []string
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		lines[i] = configEnvReference.ReplaceAllStringFunc(line, func(ref string) string {
+			m := configEnvReference.FindStringSubmatch(ref)
+			if m[1] != "" {
+				// Escaped reference, remove the escaping $
+				return ref[1:]
+			}
+
+			value, ok := os.LookupEnv(m[2])
+			if file := os.Getenv(m[2] + "_FILE"); value == "" && file != "" {
+				// Container secret convention, resolved with the secrets
+				return "${file://" + file + "}"
+			}
+
+			switch {
+			case m[3] != "" && value == "":
+				return m[4]
+			case !ok:
+				missing = append(missing, fmt.Sprintf("%s (line %d)", m[2], i+1))
+			}
+			return value
+		})
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Environment variables referenced in configuration are not set: %s", strings.Join(missing, ", "))
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExpandConfigEnv(t *testing.T) {
+	os.Setenv("NSSO_TEST_SECRET", "s3cr3t")
+	os.Setenv("NSSO_TEST_EMPTY", "")
+	defer os.Unsetenv("NSSO_TEST_SECRET")
+	defer os.Unsetenv("NSSO_TEST_EMPTY")
+
+	out, err := expandConfigEnv([]byte(strings.Join([]string{
+		`secret: "${NSSO_TEST_SECRET}"`,
+		`default: "${NSSO_TEST_UNSET:-fallback}"`,
+		`empty: "${NSSO_TEST_EMPTY:-fallback}"`,
+		`escaped: "$${NSSO_TEST_SECRET}"`,
+		`hash: "$2a$10$abc"`,
+		`# ${NSSO_TEST_UNSET} in comments is ignored`,
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("Unable to expand configuration: %s", err)
+	}
+
+	expected := strings.Join([]string{
+		`secret: "s3cr3t"`,
+		`default: "fallback"`,
+		`empty: "fallback"`,
+		`escaped: "${NSSO_TEST_SECRET}"`,
+		`hash: "$2a$10$abc"`,
+		`# ${NSSO_TEST_UNSET} in comments is ignored`,
+	}, "\n")
+	if string(out) != expected {
+		t.Errorf("Unexpected expanded configuration:\n%s", out)
+	}
+
+	if _, err := expandConfigEnv([]byte("a: 1\nsecret: ${NSSO_TEST_UNSET}\n")); err == nil || !strings.Contains(err.Error(), "NSSO_TEST_UNSET (line 2)") {
+		t.Errorf("Expected unset variable to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// configSecretFileKeys lists the options holding secrets which accept
+// the <option>_file variant to read the secret from a file
+var configSecretFileKeys = []string{
+	"app_pass",
+	"authentication_key",
+	"encryption_key",
+	"ikey",
+	"manager_password",
+	"secret",
+	"secret_key",
+	"skey",
+	"token",
+}
+
+// configSecretFileOption matches "<option>_file: <path>" in block style,
+// optionally as first key of a list item
+var configSecretFileOption = regexp.MustCompile(`^(\s*(?:-\s+)?)(` + strings.Join(configSecretFileKeys, "|") + `)_file:\s*(.*?)\s*$`)
+
+// expandConfigSecretFiles rewrites the <option>_file variants of the
+// secret options into file secret references, so the files are read and
+// refreshed like ${file://...} references
+func expandConfigSecretFiles(source []byte) []byte {
+	lines := strings.Split(string(source), "\n")
+
+	for i, line := range lines {
+		m := configSecretFileOption.FindStringSubmatch(line)
+		if m == nil || m[3] == "" {
+			continue
+		}
+
+		path := m[3]
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			path = unquoted
+		} else if len(path) > 1 && path[0] == '\'' && path[len(path)-1] == '\'' {
+			path = strings.Replace(path[1:len(path)-1], "''", "'", -1)
+		}
+
+		lines[i] = m[1] + m[2] + `: "${file://` + path + `}"`
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-secret-files")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := filepath.Join(dir, "ldap_password")
+	ioutil.WriteFile(secret, []byte("from-file\n"), 0600)
+
+	os.Setenv("NSSO_TEST_COOKIE_KEY_FILE", secret)
+	defer os.Unsetenv("NSSO_TEST_COOKIE_KEY_FILE")
+
+	config := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(config, []byte(strings.Join([]string{
+		`cookie:`,
+		`  authentication_key: "${NSSO_TEST_COOKIE_KEY}"`,
+		`listen:`,
+		`  tls_key_file: /etc/ssl/key.pem`,
+		`providers:`,
+		`  ldap:`,
+		`    manager_password_file: "` + secret + `"`,
+		`webhooks:`,
+		`  - secret_file: '` + secret + `'`,
+	}, "\n")), 0644)
+
+	configSecrets.Begin()
+	out, err := readConfigFile(config)
+	if err != nil {
+		t.Fatalf("Unable to read configuration: %s", err)
+	}
+	configSecrets.Commit()
+
+	expected := strings.Join([]string{
+		`cookie:`,
+		`  authentication_key: "from-file"`,
+		`listen:`,
+		`  tls_key_file: /etc/ssl/key.pem`,
+		`providers:`,
+		`  ldap:`,
+		`    manager_password: "from-file"`,
+		`webhooks:`,
+		`  - secret: "from-file"`,
+	}, "\n")
+	if string(out) != expected {
+		t.Errorf("Unexpected configuration:\n%s", out)
+	}
+
+	ioutil.WriteFile(secret, []byte("rotated\n"), 0600)
+	if !configSecrets.Changed() {
+		t.Error("Expected rotated secret file to be detected")
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSecretRefreshInterval = 5 * time.Minute
+	secretFetchTimeout           = 10 * time.Second
+)
+
+var (
+	// configSecretReference matches ${file://...}, ${vault://...} and
+	// ${aws-sm://...} references, $${...} is the escaped form
+	configSecretReference = regexp.MustCompile(`\$(\$?)\{((?:file|vault|aws-sm)://[^}]*)\}`)
+
+	// configSecrets holds the values of the secrets referenced in the
+	// active configuration to detect changes
+	configSecrets = &secretSet{}
+
+	secretHTTPClient = &http.Client{Timeout: secretFetchTimeout}
+)
+
+// secretsConfig controls the refresh of secrets referenced in the
+// configuration
+type secretsConfig struct {
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// secretSet collects the secrets resolved while loading the
+// configuration. The collected secrets become active once the
+// configuration was loaded successfully.
+type secretSet struct {
+	active  map[string]string
+	loading map[string]string
+	lock    sync.Mutex
+}
+
+func (s *secretSet) Begin() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.loading = map[string]string{}
+}
+
+func (s *secretSet) Commit() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.active, s.loading = s.loading, nil
+}
+
+func (s *secretSet) record(ref, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.loading != nil {
+		s.loading[ref] = value
+	}
+}
+
+// Changed fetches all active secrets again and reports whether one of
+// them has a new value. Secrets which can't be fetched are treated as
+// unchanged.
+func (s *secretSet) Changed() bool {
+	s.lock.Lock()
+	active := s.active
+	s.lock.Unlock()
+
+	refs := []string{}
+	for ref := range active {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	for _, ref := range refs {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			log.WithError(err).WithField("secret", ref).Warn("Unable to refresh secret")
+			continue
+		}
+		if value != active[ref] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expandConfigSecrets replaces the secret references in the source by
+// the secret values. Like for environment variables lines containing
+// only a comment are kept as they are.
+func expandConfigSecrets(source []byte) ([]byte, error) {
+	lines := strings.Split(string(source), "\n")
+
+	var errs []string
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		lines[i] = configSecretReference.ReplaceAllStringFunc(line, func(ref string) string {
+			m := configSecretReference.FindStringSubmatch(ref)
+			if m[1] != "" {
+				// Escaped reference, remove the escaping $
+				return ref[1:]
+			}
+
+			value, err := resolveSecret(m[2])
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s (line %d)", err, i+1))
+				return ""
+			}
+
+			configSecrets.record(m[2], value)
+			return value
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Unable to resolve secrets referenced in configuration: %s", strings.Join(errs, ", "))
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// resolveSecret fetches the value of a reference in format
+// <scheme>://<location>[#<key>]
+func resolveSecret(ref string) (string, error) {
+	parts := strings.SplitN(ref, "://", 2)
+	location, key := parts[1], ""
+	if i := strings.LastIndex(location, "#"); i >= 0 {
+		location, key = location[:i], location[i+1:]
+	}
+
+	var (
+		value string
+		err   error
+	)
+
+	switch parts[0] {
+	case "file":
+		value, err = resolveFileSecret(location)
+	case "vault":
+		value, err = resolveVaultSecret(location, key)
+	case "aws-sm":
+		value, err = resolveAWSSecret(location, key)
+	}
+
+	return value, errors.Wrapf(err, "Secret %q", ref)
+}
+
+func resolveFileSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveVaultSecret reads the key of a secret using the Vault HTTP API
+// at VAULT_ADDR authenticated by VAULT_TOKEN. Secrets of the KV engine
+// in version 1 and 2 are supported.
+func resolveVaultSecret(path, key string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	if key == "" {
+		return "", errors.New("Vault references need a #key")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := fetchSecretJSON(req, &resp); err != nil {
+		return "", err
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		// KV version 2 wraps the secret into data and metadata
+		data = inner
+	}
+
+	v, ok := data[key]
+	if !ok {
+		return "", errors.Errorf("Key %q not found", key)
+	}
+
+	return secretString(v), nil
+}
+
+// resolveAWSSecret reads a secret from AWS Secrets Manager using the
+// credentials from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN variables. The region is taken from the ARN or the
+// AWS_REGION variable. With key the secret is parsed as JSON object.
+func resolveAWSSecret(secretID, key string) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if arn := strings.Split(secretID, ":"); len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+	if region == "" {
+		return "", errors.New("Region is neither part of the ARN nor set in AWS_REGION")
+	}
+
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return "", errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY need to be set")
+	}
+
+	endpoint := os.Getenv("AWS_SECRETSMANAGER_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": secretID})
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	creds.Sign(req, body, region, "secretsmanager", time.Now())
+
+	var resp struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := fetchSecretJSON(req, &resp); err != nil {
+		return "", err
+	}
+
+	if key == "" {
+		return resp.SecretString, nil
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(resp.SecretString), &values); err != nil {
+		return "", errors.Wrap(err, "Secret is no JSON object")
+	}
+
+	v, ok := values[key]
+	if !ok {
+		return "", errors.Errorf("Key %q not found", key)
+	}
+
+	return secretString(v), nil
+}
+
+func fetchSecretJSON(req *http.Request, target interface{}) error {
+	resp, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(target), "Unable to decode response")
+}
+
+func secretString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Sign adds the AWS signature version 4 to the request
+func (a awsCredentials) Sign(req *http.Request, body []byte, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+
+	names := []string{}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + a.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = awsHMAC(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.AccessKeyID, scope, signedHeaders, hex.EncodeToString(awsHMAC(key, stringToSign)),
+	))
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// watchConfigSecrets reloads the configuration when one of the
+// referenced secrets changed
+func watchConfigSecrets() {
+	for {
+		interval := getMainConfig().Secrets.RefreshInterval
+		if interval <= 0 {
+			// Refresh disabled, check again for changed configuration
+			interval = configWatchInterval
+		}
+		time.Sleep(interval)
+
+		if getMainConfig().Secrets.RefreshInterval <= 0 || !configSecrets.Changed() {
+			continue
+		}
+
+		log.Info("Referenced secrets changed, reloading configuration")
+		reloadConfiguration() // Errors are logged, the previous configuration is kept
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandConfigSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-secrets")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Unable to write secret: %s", err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/nginx-sso" || r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			return
+		}
+		res.Write([]byte(`{"data":{"data":{"client_secret":"from-vault"},"metadata":{"version":3}}}`))
+	}))
+	defer vault.Close()
+
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	configSecrets.Begin()
+	out, err := expandConfigSecrets([]byte(strings.Join([]string{
+		`file: "${file://` + file + `}"`,
+		`vault: "${vault://secret/data/nginx-sso#client_secret}"`,
+		`escaped: "$${vault://secret/data/nginx-sso#client_secret}"`,
+		`# ${vault://secret/data/missing#key} in comments is ignored`,
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("Unable to expand secrets: %s", err)
+	}
+	configSecrets.Commit()
+
+	expected := strings.Join([]string{
+		`file: "from-file"`,
+		`vault: "from-vault"`,
+		`escaped: "${vault://secret/data/nginx-sso#client_secret}"`,
+		`# ${vault://secret/data/missing#key} in comments is ignored`,
+	}, "\n")
+	if string(out) != expected {
+		t.Errorf("Unexpected expanded configuration:\n%s", out)
+	}
+
+	if _, err := expandConfigSecrets([]byte("a: 1\nb: ${vault://secret/data/missing#key}\n")); err == nil || !strings.Contains(err.Error(), "(line 2)") {
+		t.Errorf("Expected unresolvable secret to be reported, got %v", err)
+	}
+
+	if configSecrets.Changed() {
+		t.Error("Expected unchanged secrets to be reported as unchanged")
+	}
+	if err := ioutil.WriteFile(file, []byte("rotated\n"), 0600); err != nil {
+		t.Fatalf("Unable to write secret: %s", err)
+	}
+	if !configSecrets.Changed() {
+		t.Error("Expected rotated secret to be detected")
+	}
+}
+
+func TestAWSSignature(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	creds.Sign(req, nil, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Unexpected authorization header %q", auth)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultSOPSBinary  = "sops"
+	sopsDecryptTimeout = 30 * time.Second
+)
+
+// isSOPSDocument checks whether the file was encrypted by sops which
+// adds its metadata including the MAC of the document as sops key
+func isSOPSDocument(source []byte) bool {
+	var doc struct {
+		SOPS struct {
+			MAC string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+
+	if err := yaml.Unmarshal(source, &doc); err != nil {
+		return false
+	}
+
+	return doc.SOPS.MAC != ""
+}
+
+// decryptSOPSFile decrypts the file using the sops binary. Using the
+// binary supports all key types (age, PGP, cloud KMS) with the same
+// credentials and configuration the operators use to edit the file.
+func decryptSOPSFile(file string) ([]byte, error) {
+	binary := cfg.SOPSBinary
+	if binary == "" {
+		binary = defaultSOPSBinary
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sopsDecryptTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, "--decrypt", "--input-type", "yaml", "--output-type", "yaml", file)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Errorf("Unable to decrypt sops file: %s", msg)
+		}
+		return nil, errors.Wrap(err, "Unable to decrypt sops file")
+	}
+
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestReadSOPSConfigFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake sops binary is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "nsso-sops")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake binary prints the decrypted document and fails for
+	// files it was not given the keys for
+	binary := filepath.Join(dir, "sops")
+	ioutil.WriteFile(binary, []byte("#!/bin/sh\n"+
+		"case \"$6\" in *broken*) echo 'Failed to get the data key' >&2; exit 128;; esac\n"+
+		"printf 'cookie:\\n  authentication_key: \"${NSSO_TEST_SOPS:-decrypted}\"\\n'\n"), 0755)
+
+	prev := cfg.SOPSBinary
+	defer func() { cfg.SOPSBinary = prev }()
+	cfg.SOPSBinary = binary
+
+	encrypted := []byte("cookie:\n  authentication_key: ENC[AES256_GCM,data:abc,type:str]\nsops:\n  mac: ENC[AES256_GCM,data:def,type:str]\n  version: 3.8.1\n")
+	for _, name := range []string{"config.yaml", "broken.yaml"} {
+		ioutil.WriteFile(filepath.Join(dir, name), encrypted, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "plain.yaml"), []byte("cookie:\n  authentication_key: plain\n"), 0644)
+
+	out, err := readConfigFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Unable to read encrypted file: %s", err)
+	}
+	if string(out) != "cookie:\n  authentication_key: \"decrypted\"\n" {
+		t.Errorf("Unexpected decrypted content %q", out)
+	}
+
+	if _, err := readConfigFile(filepath.Join(dir, "broken.yaml")); err == nil || err.Error() != "Unable to decrypt sops file: Failed to get the data key" {
+		t.Errorf("Expected decryption error, got %v", err)
+	}
+
+	if out, err := readConfigFile(filepath.Join(dir, "plain.yaml")); err != nil || string(out) != "cookie:\n  authentication_key: plain\n" {
+		t.Errorf("Expected plain file to be read as it is, got %q (%v)", out, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// currentConfigVersion is the version of the configuration schema
+// expected by this version of nginx-sso. Configurations without version
+// are treated as version 1.
+const currentConfigVersion = 2
+
+// configMigration upgrades a configuration of the previous version to
+// the given version. Migrations work on the ordered document to keep the
+// layout of the file when written by migrate-config.
+type configMigration struct {
+	Version     int
+	Description string
+	Migrate     func(doc yaml.MapSlice) yaml.MapSlice
+}
+
+var configMigrations = []configMigration{
+	{Version: 2, Description: "Move cookie.authentication_key into the cookie.keys list", Migrate: migrateCookieKeys},
+}
+
+// configVersion reads the schema version of the document
+func configVersion(doc yaml.MapSlice) (int, error) {
+	v, _ := mapSliceGet(doc, "version")
+	switch v := v.(type) {
+	case nil:
+		return 1, nil
+	case int:
+		if v < 1 {
+			return 0, errors.Errorf("Configuration version %d is invalid", v)
+		}
+		if v > currentConfigVersion {
+			return 0, errors.Errorf("Configuration version %d is not supported, this version of nginx-sso supports up to version %d", v, currentConfigVersion)
+		}
+		return v, nil
+	default:
+		return 0, errors.Errorf("Configuration version %v is not a number", v)
+	}
+}
+
+// migrateConfig upgrades the document to the current version and
+// returns the source unchanged if it already is up to date
+func migrateConfig(source []byte) ([]byte, int, []string, error) {
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(source, &doc); err != nil {
+		// Reported by the regular parsing of the configuration
+		return source, currentConfigVersion, nil, nil
+	}
+
+	version, err := configVersion(doc)
+	if err != nil || version == currentConfigVersion {
+		return source, version, nil, err
+	}
+
+	applied := []string{}
+	for _, m := range configMigrations {
+		if m.Version <= version {
+			continue
+		}
+		doc = m.Migrate(doc)
+		applied = append(applied, fmt.Sprintf("%d: %s", m.Version, m.Description))
+	}
+	doc = mapSliceSet(doc, "version", currentConfigVersion)
+
+	// Keep the version in front of the other settings
+	if _, i := mapSliceGet(doc, "version"); i > 0 {
+		doc = append(yaml.MapSlice{doc[i]}, append(doc[:i:i], doc[i+1:]...)...)
+	}
+
+	out, err := yaml.Marshal(doc)
+	return out, version, applied, errors.Wrap(err, "Unable to encode migrated configuration")
+}
+
+// migrateConfigSource upgrades the configuration read on load in memory
+func migrateConfigSource(source []byte) ([]byte, error) {
+	out, version, applied, err := migrateConfig(source)
+	if err != nil || version == currentConfigVersion {
+		return out, err
+	}
+
+	log.WithFields(log.Fields{
+		"version":    version,
+		"migrations": len(applied),
+	}).Warnf("Configuration uses schema version %d, upgrade it to version %d using migrate-config", version, currentConfigVersion)
+	return out, nil
+}
+
+// migrateCookieKeys moves the legacy authentication_key into the keys
+// list where it already was treated as the last entry
+func migrateCookieKeys(doc yaml.MapSlice) yaml.MapSlice {
+	v, _ := mapSliceGet(doc, "cookie")
+	cookie, ok := v.(yaml.MapSlice)
+	if !ok {
+		return doc
+	}
+
+	key, i := mapSliceGet(cookie, "authentication_key")
+	if i < 0 {
+		return doc
+	}
+	cookie = append(cookie[:i:i], cookie[i+1:]...)
+
+	if key != nil && key != "" {
+		keys, _ := mapSliceGet(cookie, "keys")
+		list, _ := keys.([]interface{})
+		cookie = mapSliceSet(cookie, "keys", append(list, yaml.MapSlice{{Key: "authentication_key", Value: key}}))
+	}
+
+	return mapSliceSet(doc, "cookie", cookie)
+}
+
+// mapSliceGet returns the value of the key and its index or -1 if the
+// key is not present
+func mapSliceGet(m yaml.MapSlice, key string) (interface{}, int) {
+	for i, item := range m {
+		if k, ok := item.Key.(string); ok && k == key {
+			return item.Value, i
+		}
+	}
+	return nil, -1
+}
+
+// mapSliceSet replaces the value of the key or appends the key
+func mapSliceSet(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	if _, i := mapSliceGet(m, key); i >= 0 {
+		m[i].Value = value
+		return m
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
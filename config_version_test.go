@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	source := []byte(`---
+cookie:
+  domain: ".example.com"
+  authentication_key: "legacy"
+  keys:
+    - authentication_key: "current"
+listen:
+  port: 8082
+`)
+
+	out, version, applied, err := migrateConfig(source)
+	if err != nil || version != 1 || len(applied) != 1 {
+		t.Fatalf("Expected migration from version 1, got version %d with %v: %v", version, applied, err)
+	}
+
+	m := &mainConfig{}
+	if err := yaml.Unmarshal(out, m); err != nil {
+		t.Fatalf("Unable to parse migrated configuration: %s", err)
+	}
+	if keys := m.GetCookieKeys(); m.Cookie.AuthKey != "" || len(keys) != 2 || keys[0].AuthKey != "current" || keys[1].AuthKey != "legacy" {
+		t.Errorf("Expected legacy key to be the last of the keys, got %#v", keys)
+	}
+	if m.Cookie.Domain != ".example.com" || m.Listen.Port != 8082 {
+		t.Errorf("Expected other settings to be kept, got %#v", m)
+	}
+
+	doc := yaml.MapSlice{}
+	yaml.Unmarshal(out, &doc)
+	if doc[0].Key != "version" || doc[0].Value != currentConfigVersion {
+		t.Errorf("Expected current version in front of the configuration, got %v", doc[0])
+	}
+
+	// Up to date configurations are kept as they are
+	if migrated, version, _, err := migrateConfig(out); err != nil || version != currentConfigVersion || string(migrated) != string(out) {
+		t.Errorf("Expected configuration of the current version to be unchanged, got version %d: %v", version, err)
+	}
+
+	for _, src := range []string{"version: 99\n", "version: \"two\"\n", "version: 0\n"} {
+		if _, _, _, err := migrateConfig([]byte(src)); err == nil {
+			t.Errorf("Expected %q to be rejected", src)
+		}
+	}
+}
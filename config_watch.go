@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const configWatchInterval = 5 * time.Second
+
+var (
+	// configFiles contains the configuration file and all files
+	// included into it during the last successful load
+	configFiles      []string
+	configReloadLock sync.Mutex
+)
+
+// reloadConfiguration loads the configuration again. Reloads triggered
+// by the signal, the admin API and the file watcher are serialized. On
+// error the previous configuration stays active.
+func reloadConfiguration() error {
+	configReloadLock.Lock()
+	defer configReloadLock.Unlock()
+
+	if err := loadConfiguration(); err != nil {
+		log.WithError(err).Error("Unable to reload configuration, keeping previous configuration")
+		return err
+	}
+
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// handleAdminReloadRequest reloads the configuration on request of an
+// admin and reports validation errors of the new configuration
+func handleAdminReloadRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := reloadConfiguration(); err != nil {
+		http.Error(res, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	getMainConfig().AuditLog.Log(auditEventConfigReloaded, r, map[string]string{"admin": admin})
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// watchConfiguration polls the modification times of the configuration
+// files and reloads the configuration when one of them changed
+func watchConfiguration() {
+	last := configModTimes()
+
+	for range time.Tick(configWatchInterval) {
+		current := configModTimes()
+		if current == last {
+			continue
+		}
+
+		log.Debug("Configuration files changed, reloading")
+		reloadConfiguration() // Errors are logged, the watcher retries on the next change
+
+		// Read again as the list of included files might have changed
+		last = configModTimes()
+	}
+}
+
+func configModTimes() string {
+	configReloadLock.Lock()
+	files := configFiles
+	configReloadLock.Unlock()
+
+	fingerprint := ""
+	for _, f := range files {
+		stat, err := os.Stat(f)
+		if err != nil {
+			// Missing files are part of the fingerprint to detect them
+			// being created again
+			fingerprint += f + ":missing;"
+			continue
+		}
+		fingerprint += f + ":" + stat.ModTime().String() + ";"
+	}
+
+	return fingerprint
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadKeepsActiveConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-reload")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	prevFile, prevAuthenticators := cfg.ConfigFile, getAuthenticatorSnapshot()
+	defer func() {
+		cfg.ConfigFile = prevFile
+		authenticatorState.Store(prevAuthenticators)
+	}()
+
+	marker := &authToken{}
+	setAuthenticators([]authenticator{marker})
+
+	cfg.ConfigFile = filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfg.ConfigFile, []byte(`
+authorization:
+  engine: unknown
+providers:
+  simple:
+    users:
+      alice: "$2a$10$..."
+`), 0600); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	if err := reloadConfiguration(); err == nil {
+		t.Fatal("Expected broken configuration to be rejected")
+	}
+	if len(getAuthenticatorSnapshot().active) != 1 || getAuthenticatorSnapshot().active[0] != marker {
+		t.Errorf("Expected active authenticators to be kept, got %v", getAuthenticatorSnapshot().active)
+	}
+	if getMainConfig().Authorization.Engine != "" {
+		t.Errorf("Expected active configuration to be kept, got engine %q", getMainConfig().Authorization.Engine)
+	}
+}
+
+func TestReloadActivatesNothingOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-reload")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	prevFile, prevAuthenticators := cfg.ConfigFile, getAuthenticatorSnapshot()
+	defer func() {
+		cfg.ConfigFile = prevFile
+		authenticatorState.Store(prevAuthenticators)
+	}()
+
+	cookie, err := generateKey(genKeysTypeCookie, 0)
+	if err != nil {
+		t.Fatalf("Unable to generate cookie keys: %s", err)
+	}
+
+	// SCIM is prepared successfully before the session store fails
+	cfg.ConfigFile = filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(cfg.ConfigFile, append(cookie, []byte(`
+scim:
+  store: `+filepath.Join(dir, "scim.json")+`
+  tokens: ["token"]
+session_store:
+  type: unknown
+providers:
+  simple:
+    users:
+      alice: "$2a$10$..."
+`)...), 0600); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	active := getMainConfig()
+	if err := reloadConfiguration(); err == nil {
+		t.Fatal("Expected broken session store to be rejected")
+	}
+	if getMainConfig() != active {
+		t.Error("Expected active configuration to be kept")
+	}
+	if getSCIMStore() != nil {
+		t.Error("Expected SCIM not to be activated by the rejected configuration")
+	}
+}
+
+func TestConfigureAuthenticatorsUsesNewInstances(t *testing.T) {
+	defer initializePATStore(patConfig{})
+
+	authenticators, err := configureAuthenticators([]byte(`
+providers:
+  simple:
+    users:
+      alice: "$2a$10$..."
+`))
+	if err != nil {
+		t.Fatalf("Unable to configure authenticators: %s", err)
+	}
+
+	if len(authenticators) != 1 || authenticators[0].AuthenticatorID() != "simple" {
+		t.Fatalf("Expected only the simple authenticator, got %v", authenticators)
+	}
+
+	for _, a := range authenticatorRegistry.Authenticators() {
+		if a == authenticators[0] {
+			t.Error("Expected registered authenticator not to be configured")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+// requestHostHeaders are the forwarding headers checked for the host in
+// order of their precedence
+var requestHostHeaders = []string{"X-Forwarded-Host", "X-Host"}
+
+type cookieHostOverride struct {
+	Hosts  []string `yaml:"hosts"`
+	Domain string   `yaml:"domain"`
+	Prefix string   `yaml:"prefix"`
+}
+
+func (c cookieHostOverride) Matches(host string) bool {
+	return hostMatches(c.Hosts, host)
+}
+
+// hostMatches checks whether the host is contained in the list of
+// hosts. Entries prefixed with `*.` match all subdomains.
+func hostMatches(hosts []string, host string) bool {
+	return acl.HostMatches(hosts, host)
+}
+
+// requestHost determines the host the user is accessing: Forwarding
+// headers set by nginx take precedence over the Host header
+func requestHost(r *http.Request) string {
+	host := r.Host
+	for _, hdr := range requestHostHeaders {
+		if v := r.Header.Get(hdr); v != "" {
+			v, _, _ = strings.Cut(v, ",")
+			host = strings.TrimSpace(v)
+			break
+		}
+	}
+
+	// Only hosts with a port are split to not allocate the error of
+	// SplitHostPort for every call
+	if strings.LastIndexByte(host, ':') > strings.LastIndexByte(host, ']') {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+
+	return strings.ToLower(host)
+}
+
+func (m *mainConfig) getCookieHostOverride(r *http.Request) *cookieHostOverride {
+	if rl := getRealm(r); rl != nil && (rl.Cookie.Domain != "" || rl.Cookie.Prefix != "") {
+		// The cookie settings of the realm take precedence
+		return &cookieHostOverride{Hosts: rl.Hosts, Domain: rl.Cookie.Domain, Prefix: rl.Cookie.Prefix}
+	}
+
+	host := requestHost(r)
+
+	for i := range m.Cookie.Hosts {
+		if m.Cookie.Hosts[i].Matches(host) {
+			return &m.Cookie.Hosts[i]
+		}
+	}
+
+	return nil
+}
+
+// GetCookieName returns the name of the cookie for the given
+// authenticator respecting the host and provider overrides
+func (m *mainConfig) GetCookieName(r *http.Request, authenticatorID string) string {
+	prefix := m.Cookie.Prefix
+	if o := m.getCookieHostOverride(r); o != nil && o.Prefix != "" {
+		prefix = o.Prefix
+	}
+	if o, ok := m.Cookie.Providers[authenticatorID]; ok && o.Prefix != "" {
+		prefix = o.Prefix
+	}
+
+	return strings.Join([]string{prefix, authenticatorID}, "-")
+}
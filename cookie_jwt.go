@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cookieFormatJWT          = tokenFormatJWT
+	cookieFormatPASETOLocal  = tokenFormatPASETOLocal
+	cookieFormatPASETOPublic = tokenFormatPASETOPublic
+	cookieFormatSecureCookie = "securecookie"
+)
+
+// jwtCookieCodec implements the securecookie.Codec interface and
+// stores the session values inside a signed JWT or PASETO token. The
+// values of JWT and v4.public tokens are readable (but not modifiable)
+// by everyone having access to the cookie so upstream applications can
+// verify the identity using the published JWKS.
+type jwtCookieCodec struct {
+	issuer string
+	keys   tokenKeySet
+	maxAge time.Duration
+}
+
+// Encode creates a JWT from the session values
+func (j jwtCookieCodec) Encode(name string, value interface{}) (string, error) {
+	values, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return "", errors.Errorf("Unsupported value type %T", value)
+	}
+
+	sessionValues := map[string]interface{}{}
+	for k, v := range values {
+		sk, ok := k.(string)
+		if !ok {
+			return "", errors.Errorf("Unsupported session key type %T", k)
+		}
+		sessionValues[sk] = v
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"cookie":  name,
+		"exp":     now.Add(j.maxAge).Unix(),
+		"iat":     now.Unix(),
+		"session": sessionValues,
+	}
+
+	if j.issuer != "" {
+		claims["iss"] = j.issuer
+	}
+
+	if user, ok := sessionValues["user"].(string); ok {
+		claims["sub"] = user
+	}
+
+	return j.keys.Sign(claims)
+}
+
+// Decode verifies the JWT and fills the session values into dst
+func (j jwtCookieCodec) Decode(name, value string, dst interface{}) error {
+	values, ok := dst.(*map[interface{}]interface{})
+	if !ok {
+		return errors.Errorf("Unsupported destination type %T", dst)
+	}
+
+	claims, err := j.keys.Verify(value)
+	if err != nil {
+		return err
+	}
+
+	if claims["cookie"] != name {
+		// Token was issued for a different cookie
+		return errJWTInvalid
+	}
+
+	sessionValues, ok := claims["session"].(map[string]interface{})
+	if !ok {
+		return errJWTInvalid
+	}
+
+	if *values == nil {
+		*values = map[interface{}]interface{}{}
+	}
+
+	for k, v := range sessionValues {
+		if n, ok := v.(json.Number); ok {
+			// Restore integers as they were stored
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else if f, err := n.Float64(); err == nil {
+				v = f
+			}
+		}
+		(*values)[k] = v
+	}
+
+	return nil
+}
+
+func handleJWKSRequest(res http.ResponseWriter, r *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(cookieStore.JWKS()); err != nil {
+		requestLog(r).WithError(err).Error("Unable to encode JWKS")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+const (
+	cookiePrefixHost   = "__Host-"
+	cookiePrefixSecure = "__Secure-"
+)
+
+type cookieProviderOverride struct {
+	Expire   *int   `yaml:"expire"`
+	Prefix   string `yaml:"prefix"`
+	SameSite string `yaml:"same_site"`
+}
+
+func parseSameSite(v string) (http.SameSite, error) {
+	switch strings.ToLower(v) {
+	case "", "default":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return http.SameSiteDefaultMode, errors.Errorf("Invalid same_site value %q", v)
+	}
+}
+
+func (m *mainConfig) validateCookieSameSite() error {
+	if _, err := parseSameSite(m.Cookie.SameSite); err != nil {
+		return err
+	}
+
+	for id, o := range m.Cookie.Providers {
+		if _, err := parseSameSite(o.SameSite); err != nil {
+			return errors.Wrapf(err, "Cookie override for provider %q is invalid", id)
+		}
+	}
+
+	return nil
+}
+
+// getCookieSameSite returns the SameSite mode for the cookie with the
+// given name: Provider overrides take precedence over the global
+// setting which defaults to not sending the attribute.
+func (m *mainConfig) getCookieSameSite(r *http.Request, name string) http.SameSite {
+	mode, _ := parseSameSite(m.Cookie.SameSite)
+
+	for id, o := range m.Cookie.Providers {
+		if o.SameSite == "" || m.GetCookieName(r, id) != name {
+			continue
+		}
+
+		mode, _ = parseSameSite(o.SameSite)
+	}
+
+	return mode
+}
+
+// getCookieMaxExpire returns the longest lifetime any cookie might have
+func (m *mainConfig) getCookieMaxExpire() int {
+	expire := m.Cookie.Expire
+	for _, o := range m.Cookie.Providers {
+		if o.Expire != nil && *o.Expire > expire {
+			expire = *o.Expire
+		}
+	}
+
+	return expire
+}
+
+// getSessionOptsByName finds the options for the cookie with the given
+// name. It is used when there is no information about the provider
+// owning the cookie.
+func (m *mainConfig) getSessionOptsByName(r *http.Request, name string) *sessions.Options {
+	for id := range m.Cookie.Providers {
+		if m.GetCookieName(r, id) == name {
+			return m.GetSessionOpts(r, id)
+		}
+	}
+
+	return m.GetSessionOpts(r, "")
+}
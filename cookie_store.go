@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cookieRotatedAuthKeyLength       = 64
+	cookieRotatedEncryptionKeyLength = 32
+	cookieRotationDefaultKeep        = 2
+
+	// Decoded secure cookies are kept for a short time to not decode the
+	// cookie again for every request of the client
+	cookieDecodedMaxEntries = 10000
+	cookieDecodedTTL        = time.Minute
+)
+
+type cookieKey struct {
+	AuthKey       string `yaml:"authentication_key"`
+	EncryptionKey string `yaml:"encryption_key"`
+}
+
+func (c cookieKey) Validate() error {
+	if c.AuthKey == "" {
+		return errors.New("Authentication key is not set")
+	}
+
+	switch len(c.EncryptionKey) {
+	case 0, 16, 24, 32:
+		return nil
+	default:
+		return errors.New("Encryption key needs to have 16, 24 or 32 characters")
+	}
+}
+
+func (c cookieKey) pair() [][]byte {
+	var encryptionKey []byte
+	if c.EncryptionKey != "" {
+		encryptionKey = []byte(c.EncryptionKey)
+	}
+
+	return [][]byte{[]byte(c.AuthKey), encryptionKey}
+}
+
+// keyRotatingCookieStore is a sessions.Store storing the sessions
+// inside secure cookies or JWTs. In contrast to the sessions.CookieStore the
+// keys used to sign and encrypt the cookies can be exchanged at
+// runtime: The first key is used to create cookies, all keys are
+// accepted to read them.
+type keyRotatingCookieStore struct {
+	configured []securecookie.Codec
+	tokenKeys  tokenKeySet
+	rotated    []securecookie.Codec
+
+	lock sync.RWMutex
+
+	decoded     map[string]decodedCookie
+	decodedLock sync.Mutex
+}
+
+// decodedCookie holds the values of a cookie decoded before
+type decodedCookie struct {
+	values  map[interface{}]interface{}
+	expires time.Time
+}
+
+func newKeyRotatingCookieStore() *keyRotatingCookieStore {
+	return &keyRotatingCookieStore{}
+}
+
+// Configure replaces the configured codecs by the ones from the
+// cookie configuration. Keys generated by the automatic rotation are
+// kept in front of the configured keys.
+func (k *keyRotatingCookieStore) Configure(m *mainConfig) error {
+	var (
+		codecs    []securecookie.Codec
+		tokenKeys tokenKeySet
+	)
+
+	if err := m.validateCookieSameSite(); err != nil {
+		return err
+	}
+
+	switch m.Cookie.Format {
+	case "", cookieFormatSecureCookie:
+		keys := m.GetCookieKeys()
+		if len(keys) == 0 {
+			return errors.New("No cookie keys configured")
+		}
+
+		pairs := [][]byte{}
+		for i, key := range keys {
+			if err := key.Validate(); err != nil {
+				return errors.Wrapf(err, "Cookie key on position %d is invalid", i+1)
+			}
+			pairs = append(pairs, key.pair()...)
+		}
+		codecs = securecookie.CodecsFromPairs(pairs...)
+
+	case cookieFormatJWT:
+		var err error
+		if tokenKeys, err = loadTokenKeySet(tokenFormatJWT, m.Cookie.JWT.SigningKeys); err != nil {
+			return errors.Wrap(err, "Unable to load JWT signing keys")
+		}
+
+		codecs = []securecookie.Codec{jwtCookieCodec{
+			issuer: m.Cookie.JWT.Issuer,
+			keys:   tokenKeys,
+			maxAge: time.Duration(m.getCookieMaxExpire()) * time.Second,
+		}}
+
+	case cookieFormatPASETOLocal, cookieFormatPASETOPublic:
+		var err error
+		if tokenKeys, err = loadTokenKeySet(m.Cookie.Format, m.Cookie.PASETO.Keys); err != nil {
+			return errors.Wrap(err, "Unable to load PASETO keys")
+		}
+
+		codecs = []securecookie.Codec{jwtCookieCodec{
+			issuer: m.Cookie.PASETO.Issuer,
+			keys:   tokenKeys,
+			maxAge: time.Duration(m.getCookieMaxExpire()) * time.Second,
+		}}
+
+	default:
+		return errors.Errorf("Unsupported cookie format %q", m.Cookie.Format)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.configured = codecs
+	k.tokenKeys = tokenKeys
+	k.resetDecoded()
+	return nil
+}
+
+// JWKS returns the public keys used to sign JWT and PASETO cookies
+func (k *keyRotatingCookieStore) JWKS() map[string]interface{} {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if k.tokenKeys == nil {
+		return (*jwtKeySet)(nil).JWKS()
+	}
+	return k.tokenKeys.JWKS()
+}
+
+// Rotate generates a new random key pair and puts it in front of all
+// other keys. Only the latest `keep` generated keys are retained.
+func (k *keyRotatingCookieStore) Rotate(keep int) {
+	if keep < 1 {
+		keep = cookieRotationDefaultKeep
+	}
+
+	codec := securecookie.New(
+		securecookie.GenerateRandomKey(cookieRotatedAuthKeyLength),
+		securecookie.GenerateRandomKey(cookieRotatedEncryptionKeyLength),
+	)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.tokenKeys != nil {
+		// JWT and PASETO cookies are signed using the configured keys only
+		return
+	}
+
+	k.rotated = append([]securecookie.Codec{codec}, k.rotated...)
+	if len(k.rotated) > keep {
+		k.rotated = k.rotated[:keep]
+	}
+	// Cookies of the removed key must not be accepted anymore
+	k.resetDecoded()
+}
+
+// RotateEvery rotates the keys in the given interval until the
+// process exits. It is intended to be run as a go-routine.
+func (k *keyRotatingCookieStore) RotateEvery(interval time.Duration, keep int) {
+	for range time.Tick(interval) {
+		k.Rotate(keep)
+		log.Debug("Rotated cookie keys")
+	}
+}
+
+func (k *keyRotatingCookieStore) codecs() []securecookie.Codec {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	return append(append([]securecookie.Codec{}, k.rotated...), k.configured...)
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (k *keyRotatingCookieStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(k, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+func (k *keyRotatingCookieStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(k, name)
+	session.Options = getMainConfig().getSessionOptsByName(r, name)
+	session.IsNew = true
+
+	var err error
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		if values, ok := k.decodedValues(name, c.Value); ok {
+			session.Values = values
+			session.IsNew = false
+			return session, nil
+		}
+
+		err = securecookie.DecodeMulti(name, c.Value, &session.Values, k.codecs()...)
+		if err == nil {
+			session.IsNew = false
+			k.storeDecoded(name, c.Value, session.Values)
+		}
+	}
+
+	return session, err
+}
+
+// decodedValues returns a copy of the values of the cookie if it was
+// decoded within the cookieDecodedTTL
+func (k *keyRotatingCookieStore) decodedValues(name, value string) (map[interface{}]interface{}, bool) {
+	k.decodedLock.Lock()
+	defer k.decodedLock.Unlock()
+
+	d, ok := k.decoded[name+"="+value]
+	if !ok || d.expires.Before(time.Now()) {
+		return nil, false
+	}
+
+	// Sessions modify their values, every request gets its own copy
+	values := make(map[interface{}]interface{}, len(d.values))
+	for key, v := range d.values {
+		values[key] = v
+	}
+	return values, true
+}
+
+// storeDecoded keeps a copy of the values of a decoded secure cookie.
+// JWT and PASETO cookies are not kept as their expiry is checked on
+// every decode.
+func (k *keyRotatingCookieStore) storeDecoded(name, value string, values map[interface{}]interface{}) {
+	k.lock.RLock()
+	token := k.tokenKeys != nil
+	k.lock.RUnlock()
+	if token {
+		return
+	}
+
+	d := decodedCookie{values: make(map[interface{}]interface{}, len(values)), expires: time.Now().Add(cookieDecodedTTL)}
+	for key, v := range values {
+		d.values[key] = v
+	}
+
+	k.decodedLock.Lock()
+	defer k.decodedLock.Unlock()
+
+	if k.decoded == nil || len(k.decoded) >= cookieDecodedMaxEntries {
+		// Expired entries are dropped together with the others when the
+		// cache is full
+		k.decoded = map[string]decodedCookie{}
+	}
+	k.decoded[name+"="+value] = d
+}
+
+func (k *keyRotatingCookieStore) resetDecoded() {
+	k.decodedLock.Lock()
+	defer k.decodedLock.Unlock()
+
+	k.decoded = nil
+}
+
+// Save adds a single session to the response.
+func (k *keyRotatingCookieStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, k.codecs()...)
+	if err != nil {
+		return err
+	}
+
+	cookie := sessions.NewCookie(session.Name(), encoded, session.Options)
+	cookie.SameSite = getMainConfig().getCookieSameSite(r, session.Name())
+	http.SetCookie(w, cookie)
+	return nil
+}
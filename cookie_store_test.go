@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookieStoreDecodedCookies(t *testing.T) {
+	k := newKeyRotatingCookieStore()
+
+	m := mainConfig{}
+	m.Cookie.AuthKey = "cookie-key-for-the-cookie-store-test"
+	if err := k.Configure(&m); err != nil {
+		t.Fatalf("Unable to configure cookie store: %s", err)
+	}
+	k.Rotate(1)
+
+	sess, _ := k.New(httptest.NewRequest(http.MethodGet, "/", nil), "nginx-sso-simple")
+	sess.Values["user"] = "alice"
+	res := httptest.NewRecorder()
+	if err := k.Save(httptest.NewRequest(http.MethodGet, "/", nil), res, sess); err != nil {
+		t.Fatalf("Unable to save session: %s", err)
+	}
+
+	read := func() (map[interface{}]interface{}, bool) {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		for _, c := range res.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		sess, err := k.New(r, "nginx-sso-simple")
+		return sess.Values, err == nil && !sess.IsNew
+	}
+
+	values, ok := read()
+	if !ok || values["user"] != "alice" || len(k.decoded) != 1 {
+		t.Fatalf("Expected decoded session to be kept, got %v (%d kept)", values, len(k.decoded))
+	}
+
+	// Every session gets its own copy of the kept values
+	values["user"] = "mallory"
+	if values, ok = read(); !ok || values["user"] != "alice" {
+		t.Errorf("Expected kept values to be unchanged, got %v", values)
+	}
+
+	// Removing the key of the cookie by the rotation invalidates it
+	k.Rotate(1)
+	if _, ok = read(); ok {
+		t.Error("Expected cookie of the removed key to be rejected")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var corsDefaultAllowedHeaders = []string{"Content-Type"}
+
+// corsConfig allows frontends on other origins to call the login,
+// logout and userinfo endpoints using the browser fetch API
+type corsConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+func (c corsConfig) Validate() error {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("Wildcard origin is not allowed together with credentials")
+			}
+			continue
+		}
+
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("Origin %q needs to be in the form scheme://host[:port]", o)
+		}
+	}
+
+	return nil
+}
+
+// originAllowed checks the origin against the allowed origins. Hosts in
+// the allowed origins can be prefixed by `*.` to allow all subdomains.
+func (c corsConfig) originAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+
+		allowed, err := url.Parse(o)
+		if err != nil || !strings.EqualFold(allowed.Scheme, u.Scheme) {
+			continue
+		}
+
+		if hostMatches([]string{allowed.Host}, strings.ToLower(u.Host)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setHeaders adds the CORS headers for allowed origins and reports
+// whether the request was a preflight request which is fully answered
+func (c corsConfig) setHeaders(res http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(c.AllowedOrigins) == 0 {
+		return false
+	}
+
+	res.Header().Add("Vary", "Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	if !c.originAllowed(origin) {
+		if preflight {
+			// Answer without CORS headers, the browser blocks the request
+			res.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	res.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		res.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		return false
+	}
+
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = corsDefaultAllowedHeaders
+	}
+
+	res.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	res.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if c.MaxAge > 0 {
+		res.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+	res.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		if getMainConfig().CORS.setHeaders(res, r) {
+			return
+		}
+		h(res, r)
+	}
+}
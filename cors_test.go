@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSValidation(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   corsConfig
+		valid bool
+	}{
+		{corsConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com"}, AllowCredentials: true}, true},
+		{corsConfig{AllowedOrigins: []string{"*"}}, true},
+		{corsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, false},
+		{corsConfig{AllowedOrigins: []string{"app.example.com"}}, false},
+		{corsConfig{AllowedOrigins: []string{"https://app.example.com/path"}}, false},
+	} {
+		if err := tc.cfg.Validate(); (err == nil) != tc.valid {
+			t.Errorf("Config %+v: Expected valid=%v, got error %v", tc.cfg, tc.valid, err)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	cfg := corsConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	}
+
+	for _, tc := range []struct {
+		method    string
+		origin    string
+		preflight bool
+		allowed   bool
+	}{
+		{http.MethodGet, "https://app.example.com", false, true},
+		{http.MethodGet, "http://app.example.com", false, false},
+		{http.MethodGet, "https://app.example.org", false, false},
+		{http.MethodOptions, "https://app.example.com", true, true},
+		{http.MethodOptions, "https://evil.org", true, false},
+	} {
+		r := httptest.NewRequest(tc.method, "/userinfo", nil)
+		r.Header.Set("Origin", tc.origin)
+		if tc.preflight {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		rec := httptest.NewRecorder()
+
+		if handled := cfg.setHeaders(rec, r); handled != tc.preflight {
+			t.Errorf("%s %s: Expected handled=%v, got %v", tc.method, tc.origin, tc.preflight, handled)
+		}
+
+		if allowed := rec.Header().Get("Access-Control-Allow-Origin") == tc.origin; allowed != tc.allowed {
+			t.Errorf("%s %s: Expected allowed=%v, got %v", tc.method, tc.origin, tc.allowed, allowed)
+		}
+
+		if tc.preflight && tc.allowed && rec.Header().Get("Access-Control-Max-Age") != "3600" {
+			t.Errorf("%s %s: Expected max age to be set", tc.method, tc.origin)
+		}
+	}
+}
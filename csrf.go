@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+const (
+	csrfCookieSuffix = "csrf"
+	csrfFieldName    = "csrf_token"
+	csrfHeaderName   = "X-CSRF-Token"
+	csrfTokenLength  = 32
+)
+
+// csrfConfig controls the protection of the forms against cross-site
+// request forgery: The forms contain a token which needs to match the
+// token in a cookie only readable by nginx-sso (double-submit cookie)
+type csrfConfig struct {
+	Disable bool `yaml:"disable"`
+}
+
+// Token returns the token of the client to embed into the forms and
+// issues a new one if the client has none yet
+func (c csrfConfig) Token(res http.ResponseWriter, r *http.Request) string {
+	if c.Disable {
+		return ""
+	}
+
+	if token, ok := context.Get(r, csrfTokenContextKey).(string); ok {
+		return token
+	}
+	if token := c.cookieToken(r); token != "" {
+		return token
+	}
+
+	buf := make([]byte, csrfTokenLength)
+	if _, err := rand.Read(buf); err != nil {
+		requestLog(r).WithError(err).Error("Unable to generate CSRF token")
+		return ""
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	// Session cookie bound to the login host, it is only read by
+	// nginx-sso and therefore not shared with the cookie domain
+	http.SetCookie(res, &http.Cookie{
+		Name:     getMainConfig().GetCookieName(r, csrfCookieSuffix),
+		Value:    token,
+		Path:     "/",
+		Secure:   getMainConfig().Cookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	context.Set(r, csrfTokenContextKey, token)
+
+	return token
+}
+
+// Valid checks the token posted with the form or sent in the
+// X-CSRF-Token header by scripts against the cookie of the client.
+// Requests from origins allowed to send credentials in the
+// CORS configuration are trusted without token.
+func (c csrfConfig) Valid(r *http.Request) bool {
+	if c.Disable {
+		return true
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" && getMainConfig().CORS.AllowCredentials && getMainConfig().CORS.originAllowed(origin) {
+		return true
+	}
+
+	token := r.Header.Get(csrfHeaderName)
+	if token == "" {
+		token = r.PostFormValue(csrfFieldName)
+	}
+
+	expected := c.cookieToken(r)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// sameSite checks whether the browser reported the request was not
+// started by another site. Browsers without support for the fetch
+// metadata headers are treated as cross-site.
+func (c csrfConfig) sameSite(r *http.Request) bool {
+	if c.Disable {
+		return true
+	}
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "same-site", "none":
+		return true
+	}
+	return false
+}
+
+func (c csrfConfig) cookieToken(r *http.Request) string {
+	cookie, err := r.Cookie(getMainConfig().GetCookieName(r, csrfCookieSuffix))
+	if err != nil || len(cookie.Value) != base64.RawURLEncoding.EncodedLen(csrfTokenLength) {
+		return ""
+	}
+	return cookie.Value
+}
+
+// withCSRFProtection rejects posted forms without valid CSRF token and
+// issues the token on all other requests
+func withCSRFProtection(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			getMainConfig().CSRF.Token(res, r)
+		} else if !getMainConfig().CSRF.Valid(r) {
+			requestLog(r).Warn("Rejected form without valid CSRF token")
+			http.Error(res, "Invalid CSRF token, please reload the page", http.StatusForbidden)
+			return
+		}
+		h(res, r)
+	}
+}
+
+// withAdminCSRFProtection rejects requests to the admin API changing
+// state unless they carry a credential browsers do not send on their
+// own (like a token in the Authorization header) or a valid CSRF token.
+// Session cookies, basic auth and client certificates are attached to
+// cross-site requests by the browser and are therefore not sufficient.
+func withAdminCSRFProtection(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h(res, r)
+			return
+		}
+
+		scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if (scheme == "" || strings.EqualFold(scheme, "Basic")) && !getMainConfig().CSRF.Valid(r) {
+			requestLog(r).Warn("Rejected admin request without valid CSRF token")
+			http.Error(res, "Invalid CSRF token, send a token credential or the X-CSRF-Token header", http.StatusForbidden)
+			return
+		}
+		h(res, r)
+	}
+}
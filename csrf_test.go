@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	prevCORS, prevCSRF := getMainConfig().CORS, getMainConfig().CSRF
+	defer func() { getMainConfig().CORS, getMainConfig().CSRF = prevCORS, prevCSRF }()
+	getMainConfig().CORS = corsConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}
+
+	var handled int
+	h := withCSRFProtection(func(res http.ResponseWriter, r *http.Request) { handled++ })
+
+	// Issue the token
+	res := httptest.NewRecorder()
+	h(res, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Expected CSRF cookie to be issued, got %#v", cookies)
+	}
+	token := cookies[0].Value
+
+	post := func(form url.Values, cookie bool, header map[string]string) int {
+		r := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		if cookie {
+			r.AddCookie(cookies[0])
+		}
+
+		res := httptest.NewRecorder()
+		h(res, r)
+		return res.Code
+	}
+
+	for name, c := range map[string]struct {
+		form   url.Values
+		cookie bool
+		header map[string]string
+		expect int
+	}{
+		"valid token":      {url.Values{csrfFieldName: {token}}, true, nil, http.StatusOK},
+		"header token":     {nil, true, map[string]string{csrfHeaderName: token}, http.StatusOK},
+		"missing token":    {nil, true, nil, http.StatusForbidden},
+		"wrong token":      {url.Values{csrfFieldName: {strings.Repeat("x", len(token))}}, true, nil, http.StatusForbidden},
+		"missing cookie":   {url.Values{csrfFieldName: {token}}, false, nil, http.StatusForbidden},
+		"allowed origin":   {nil, false, map[string]string{"Origin": "https://app.example.com"}, http.StatusOK},
+		"forbidden origin": {nil, false, map[string]string{"Origin": "https://evil.example.org"}, http.StatusForbidden},
+	} {
+		if code := post(c.form, c.cookie, c.header); code != c.expect {
+			t.Errorf("Expected status %d for %s, got %d", c.expect, name, code)
+		}
+	}
+
+	getMainConfig().CSRF.Disable = true
+	if code := post(nil, false, nil); code != http.StatusOK {
+		t.Errorf("Expected disabled protection to allow the request, got status %d", code)
+	}
+}
+
+func TestCSRFLogout(t *testing.T) {
+	prevAuthenticators, prevFrontend := getAuthenticatorSnapshot(), getMainConfig().Frontend
+	defer func() {
+		getMainConfig().Frontend = prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authToken{Tokens: map[string]string{"admin": "secret"}}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	logout := func(fetchSite string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/logout?go=/sessions", nil)
+		r.Header.Set("Authorization", "Token secret")
+		if fetchSite != "" {
+			r.Header.Set("Sec-Fetch-Site", fetchSite)
+		}
+
+		res := httptest.NewRecorder()
+		handleLogoutRequest(res, r)
+		return res
+	}
+
+	if res := logout("same-site"); res.Code != http.StatusFound {
+		t.Errorf("Expected logout from the same site to redirect, got status %d", res.Code)
+	}
+
+	for _, site := range []string{"cross-site", ""} {
+		res := logout(site)
+		if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `<form action="/logout" method="post">`) {
+			t.Errorf("Expected logout from %q to be confirmed, got status %d", site, res.Code)
+		}
+	}
+}
+
+func TestAdminCSRFProtection(t *testing.T) {
+	prevCSRF := getMainConfig().CSRF
+	defer func() { getMainConfig().CSRF = prevCSRF }()
+	getMainConfig().CSRF = csrfConfig{}
+
+	h := withAdminCSRFProtection(func(res http.ResponseWriter, r *http.Request) {})
+
+	token := strings.Repeat("t", base64.RawURLEncoding.EncodedLen(csrfTokenLength))
+	cookie := &http.Cookie{Name: getMainConfig().GetCookieName(httptest.NewRequest(http.MethodGet, "/", nil), csrfCookieSuffix), Value: token}
+
+	for name, c := range map[string]struct {
+		method string
+		header map[string]string
+		cookie bool
+		expect int
+	}{
+		"read":               {http.MethodGet, nil, false, http.StatusOK},
+		"session cookie":     {http.MethodPost, nil, true, http.StatusForbidden},
+		"basic auth":         {http.MethodPost, map[string]string{"Authorization": "Basic YWRtaW46c2VjcmV0"}, false, http.StatusForbidden},
+		"token":              {http.MethodPost, map[string]string{"Authorization": "Token secret"}, false, http.StatusOK},
+		"csrf header":        {http.MethodDelete, map[string]string{csrfHeaderName: token}, true, http.StatusOK},
+		"delete with cookie": {http.MethodDelete, nil, true, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(c.method, "/admin/maintenance?mode=allow", nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if c.cookie {
+			r.AddCookie(cookie)
+		}
+
+		res := httptest.NewRecorder()
+		h(res, r)
+		if res.Code != c.expect {
+			t.Errorf("Expected status %d for %s, got %d", c.expect, name, res.Code)
+		}
+	}
+}
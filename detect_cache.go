@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	detectCacheKeyPrefix         = "nginx-sso:detect-cache:"
+	detectCacheNegativeKeyPrefix = "nginx-sso:detect-cache-negative:"
+	detectCacheUserKeyPrefix     = "nginx-sso:detect-cache-user:"
+)
+
+var (
+	// detectCacheStores keeps the stores by their URI to keep the cached
+	// users across reloads
+	detectCacheStores     = map[string]detectCacheStore{}
+	detectCacheStoresLock sync.Mutex
+
+	// cacheSalt is derived from the configuration to not use users and
+	// groups cached with a previous configuration
+	cacheSalt     string
+	cacheSaltLock sync.RWMutex
+)
+
+// detectCacheConfig enables caching the users detected from the session
+// cookies of a request to skip the authenticators and group providers
+// for following requests carrying the same cookies. Credentials no
+// authenticator detected a user from are cached for the NegativeTTL to
+// reject them without asking the authenticators again. Concurrent
+// requests carrying the same credentials share one detection unless
+// DisableCoalescing is set.
+type detectCacheConfig struct {
+	TTL               time.Duration `yaml:"ttl"`
+	NegativeTTL       time.Duration `yaml:"negative_ttl"`
+	Store             string        `yaml:"store"`
+	DisableCoalescing bool          `yaml:"disable_coalescing"`
+}
+
+func (d detectCacheConfig) Validate() error {
+	if d.TTL < 0 {
+		return errors.New("TTL must not be negative")
+	}
+
+	if d.NegativeTTL < 0 {
+		return errors.New("Negative TTL must not be negative")
+	}
+
+	if d.Store == "" || d.Store == "memory" {
+		return nil
+	}
+
+	_, err := parseRedisURI(d.Store)
+	return err
+}
+
+// detectCacheEntry is the result of detectUser with the groups before
+// the role mapping, which is applied on every request
+type detectCacheEntry struct {
+	User   string      `json:"user"`
+	Groups []string    `json:"groups"`
+	Meta   sessionMeta `json:"meta"`
+}
+
+// keyBuffers keeps the buffers the cache keys are assembled in to not
+// allocate them for every request
+var keyBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getKeyBuffer() *bytes.Buffer {
+	buf := keyBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putKeyBuffer(buf *bytes.Buffer) { keyBuffers.Put(buf) }
+
+// hashKeyBuffer returns the hex encoded SHA256 hash of the buffer
+func hashKeyBuffer(buf *bytes.Buffer) string {
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// setCacheSalt is called with the source of every loaded configuration
+func setCacheSalt(yamlSource []byte) {
+	sum := sha256.Sum256(yamlSource)
+
+	cacheSaltLock.Lock()
+	defer cacheSaltLock.Unlock()
+
+	cacheSalt = hex.EncodeToString(sum[:])
+}
+
+func getCacheSalt() string {
+	cacheSaltLock.RLock()
+	defer cacheSaltLock.RUnlock()
+
+	return cacheSalt
+}
+
+// key returns the cache key of the request or an empty string if the
+// request can't be cached: Only requests carrying session cookies of the
+// authenticators of the realm are cached, requests with credentials in
+// headers are always passed to the authenticators. Cookies set in the
+// response replace the ones of the request.
+func (d detectCacheConfig) key(r *http.Request, set []*http.Cookie) string {
+	if d.TTL <= 0 || r.Header.Get("Authorization") != "" || r.Header.Get(dpopHeader) != "" {
+		return ""
+	}
+
+	buf := getKeyBuffer()
+	defer putKeyBuffer(buf)
+
+	buf.WriteString(getCacheSalt())
+	buf.WriteByte(0)
+	buf.WriteString(getRealmName(r))
+
+	hasCookie := false
+	for _, a := range requestAuthenticators(r) {
+		name := getMainConfig().GetCookieName(r, a.AuthenticatorID())
+
+		var value string
+		if c, err := r.Cookie(name); err == nil {
+			value = c.Value
+		}
+		for _, c := range set {
+			if c.Name == name {
+				value = c.Value
+				if c.MaxAge < 0 {
+					value = ""
+				}
+			}
+		}
+
+		buf.WriteByte(0)
+		buf.WriteString(a.AuthenticatorID())
+		if value != "" {
+			buf.WriteByte('=')
+			buf.WriteString(value)
+			hasCookie = true
+		}
+	}
+	if !hasCookie {
+		return ""
+	}
+
+	if getMainConfig().SessionBinding.Enabled() {
+		// Bound sessions are only valid for the client they were issued to
+		buf.WriteByte(0)
+		buf.WriteString(getMainConfig().SessionBinding.Fingerprint(r))
+	}
+
+	return detectCacheKeyPrefix + hashKeyBuffer(buf)
+}
+
+// negativeKey returns the cache key of the credentials of the request
+// or an empty string if the request carries no credentials
+func (d detectCacheConfig) negativeKey(r *http.Request) string {
+	if d.NegativeTTL <= 0 {
+		return ""
+	}
+
+	hash := credentialsHash(r)
+	if hash == "" {
+		return ""
+	}
+	return detectCacheNegativeKeyPrefix + hash
+}
+
+// credentialsHash returns a hash of the credentials of the request or
+// an empty string if the request carries no credentials or a DPoP proof,
+// which differs for every request. The hash covers all cookies of the
+// request to not mix up valid cookies of authenticators using their own
+// cookie names sent together with other credentials.
+func credentialsHash(r *http.Request) string {
+	if r.Header.Get(dpopHeader) != "" {
+		return ""
+	}
+
+	hasCredentials := r.Header.Get("Authorization") != ""
+	for _, a := range requestAuthenticators(r) {
+		if c, err := r.Cookie(getMainConfig().GetCookieName(r, a.AuthenticatorID())); err == nil && c.Value != "" {
+			hasCredentials = true
+		}
+	}
+	if !hasCredentials {
+		return ""
+	}
+
+	buf := getKeyBuffer()
+	defer putKeyBuffer(buf)
+
+	for _, v := range [...]string{
+		getCacheSalt(),
+		getRealmName(r),
+		requestHost(r),
+		getMainConfig().trustedClientIP(r),
+		r.Header.Get("Authorization"),
+	} {
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	}
+	for i, c := range r.Header.Values("Cookie") {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(c)
+	}
+	buf.WriteByte(0)
+
+	if getMainConfig().SessionBinding.Enabled() {
+		buf.WriteString(getMainConfig().SessionBinding.Fingerprint(r))
+	}
+
+	return hashKeyBuffer(buf)
+}
+
+// IsNegative reports whether the credentials of the request were
+// rejected by all authenticators within the negative TTL
+func (d detectCacheConfig) IsNegative(r *http.Request) bool {
+	key := d.negativeKey(r)
+	if key == "" {
+		return false
+	}
+
+	store, err := getDetectCacheStore(getMainConfig().Cluster.storeFor(d.Store))
+	if err == nil {
+		var e *detectCacheEntry
+		if e, err = store.Get(key); err == nil {
+			if e != nil {
+				metricDetectCacheLookups.Inc("negative")
+			}
+			return e != nil
+		}
+	}
+
+	metricDetectCacheLookups.Inc("error")
+	requestLog(r).WithError(err).Error("Unable to read rejected credentials from cache")
+	return false
+}
+
+// SetNegative caches the credentials of the request as rejected by all
+// authenticators
+func (d detectCacheConfig) SetNegative(r *http.Request) {
+	key := d.negativeKey(r)
+	if key == "" {
+		return
+	}
+
+	store, err := getDetectCacheStore(getMainConfig().Cluster.storeFor(d.Store))
+	if err == nil {
+		err = store.Set(key, detectCacheEntry{}, d.NegativeTTL)
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to cache rejected credentials")
+	}
+}
+
+// Get returns the user cached for the cookies of the request. If the
+// store is not available the user is detected by the authenticators.
+func (d detectCacheConfig) Get(r *http.Request) (*detectCacheEntry, bool) {
+	key := d.key(r, nil)
+	if key == "" {
+		return nil, false
+	}
+
+	store, err := getDetectCacheStore(getMainConfig().Cluster.storeFor(d.Store))
+	if err == nil {
+		var e *detectCacheEntry
+		if e, err = store.Get(key); err == nil {
+			result := "miss"
+			if e != nil {
+				result = "hit"
+			}
+			metricDetectCacheLookups.Inc(result)
+			return e, e != nil
+		}
+	}
+
+	metricDetectCacheLookups.Inc("error")
+	requestLog(r).WithError(err).Error("Unable to read detected user from cache")
+	return nil, false
+}
+
+// Set caches the detected user for the TTL. Authenticators renewing the
+// session cookie change its value, so the user is cached for the cookie
+// sent with the response which is not renewed again while the user is
+// served from the cache.
+func (d detectCacheConfig) Set(res http.ResponseWriter, r *http.Request, e detectCacheEntry) {
+	key := d.key(r, (&http.Response{Header: res.Header()}).Cookies())
+	if key == "" {
+		return
+	}
+
+	store, err := getDetectCacheStore(getMainConfig().Cluster.storeFor(d.Store))
+	if err == nil {
+		err = store.Set(key, e, d.TTL)
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to cache detected user")
+	}
+}
+
+// Invalidate removes the user cached for the cookies of the request,
+// used when the user logs out
+func (d detectCacheConfig) Invalidate(r *http.Request) {
+	key := d.key(r, nil)
+	if key == "" {
+		return
+	}
+
+	store, err := getDetectCacheStore(getMainConfig().Cluster.storeFor(d.Store))
+	if err == nil {
+		err = store.Delete(key)
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to remove detected user from cache")
+	}
+}
+
+// InvalidateUser removes all users cached for the sessions of the user,
+// used when the sessions of the user are revoked or the user is disabled
+func (d detectCacheConfig) InvalidateUser(user string) {
+	if d.TTL <= 0 {
+		return
+	}
+
+	store, err := getDetectCacheStore(getMainConfig().Cluster.storeFor(d.Store))
+	if err == nil {
+		err = store.DeleteUser(user)
+	}
+	if err != nil {
+		log.WithError(err).WithField("user", user).Error("Unable to remove detected user from cache")
+	}
+}
+
+type detectCacheStore interface {
+	// Get returns the entry of the key or nil if it is not cached
+	Get(key string) (*detectCacheEntry, error)
+
+	// Set stores the entry for the given time and adds the key to the
+	// index of the entries of its user
+	Set(key string, e detectCacheEntry, ttl time.Duration) error
+
+	// Delete removes the entry of the key
+	Delete(key string) error
+
+	// DeleteUser removes all entries of the user
+	DeleteUser(user string) error
+}
+
+func getDetectCacheStore(store string) (detectCacheStore, error) {
+	detectCacheStoresLock.Lock()
+	defer detectCacheStoresLock.Unlock()
+
+	if s, ok := detectCacheStores[store]; ok {
+		return s, nil
+	}
+
+	var s detectCacheStore
+	if store == "" || store == "memory" {
+		s = newMemoryDetectCacheStore()
+	} else {
+		c, err := getRedisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		s = redisDetectCacheStore{c}
+	}
+
+	detectCacheStores[store] = s
+	return s, nil
+}
+
+type memoryDetectCacheEntry struct {
+	entry   detectCacheEntry
+	expires time.Time
+}
+
+type memoryDetectCacheStore struct {
+	entries map[string]memoryDetectCacheEntry
+	users   map[string]map[string]struct{}
+	lock    sync.Mutex
+}
+
+func newMemoryDetectCacheStore() *memoryDetectCacheStore {
+	m := &memoryDetectCacheStore{
+		entries: map[string]memoryDetectCacheEntry{},
+		users:   map[string]map[string]struct{}{},
+	}
+	go m.cleanup()
+	return m
+}
+
+func (m *memoryDetectCacheStore) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for key, e := range m.entries {
+			if e.expires.Before(time.Now()) {
+				m.delete(key)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+// delete removes the entry and its key from the index of its user, the
+// lock needs to be held
+func (m *memoryDetectCacheStore) delete(key string) {
+	e, ok := m.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(m.entries, key)
+	if keys := m.users[e.entry.User]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(m.users, e.entry.User)
+		}
+	}
+}
+
+func (m *memoryDetectCacheStore) Get(key string) (*detectCacheEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.expires.Before(time.Now()) {
+		return nil, nil
+	}
+	return &e.entry, nil
+}
+
+func (m *memoryDetectCacheStore) Set(key string, e detectCacheEntry, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.delete(key)
+	m.entries[key] = memoryDetectCacheEntry{entry: e, expires: time.Now().Add(ttl)}
+	if e.User == "" {
+		// Rejected credentials are not indexed
+		return nil
+	}
+
+	if m.users[e.User] == nil {
+		m.users[e.User] = map[string]struct{}{}
+	}
+	m.users[e.User][key] = struct{}{}
+	return nil
+}
+
+func (m *memoryDetectCacheStore) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.delete(key)
+	return nil
+}
+
+func (m *memoryDetectCacheStore) DeleteUser(user string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for key := range m.users[user] {
+		m.delete(key)
+	}
+	return nil
+}
+
+// redisDetectCacheStore keeps the entries as JSON in Redis to share the
+// detected users between all instances using the same Redis. The keys
+// of the entries of a user are indexed in a set living as long as the
+// longest living entry, the index uses the script of the session store.
+type redisDetectCacheStore struct {
+	client *redisClient
+}
+
+func (r redisDetectCacheStore) Get(key string) (*detectCacheEntry, error) {
+	reply, err := r.client.Do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return nil, errors.Errorf("Unexpected reply %v", reply)
+	}
+
+	e := &detectCacheEntry{}
+	if err := json.Unmarshal([]byte(data), e); err != nil {
+		return nil, errors.Wrap(err, "Unable to decode entry")
+	}
+	return e, nil
+}
+
+func (r redisDetectCacheStore) Set(key string, e detectCacheEntry, ttl time.Duration) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	px := strconv.Itoa(int(ttl / time.Millisecond))
+	if e.User == "" {
+		// Rejected credentials are not indexed
+		_, err = r.client.Do("SET", key, string(data), "PX", px)
+		return err
+	}
+
+	// The entry and the index live in different slots of a Cluster and
+	// are not stored by the same script
+	replies, err := r.client.Pipeline(
+		[]string{"SET", key, string(data), "PX", px},
+		[]string{"EVAL", redisSessionIndexScript, "1", detectCacheUserKeyPrefix + e.User, key, px},
+	)
+	if err != nil {
+		return err
+	}
+	return redisPipelineError(replies)
+}
+
+func (r redisDetectCacheStore) Delete(key string) error {
+	_, err := r.client.Do("DEL", key)
+	return err
+}
+
+func (r redisDetectCacheStore) DeleteUser(user string) error {
+	reply, err := r.client.Do("SMEMBERS", detectCacheUserKeyPrefix+user)
+	if err != nil {
+		return err
+	}
+
+	members, _ := reply.([]interface{})
+	cmds := make([][]string, 0, len(members)+1)
+	for _, m := range members {
+		if key, ok := m.(string); ok {
+			cmds = append(cmds, []string{"DEL", key})
+		}
+	}
+	cmds = append(cmds, []string{"DEL", detectCacheUserKeyPrefix + user})
+
+	replies, err := r.client.Pipeline(cmds...)
+	if err != nil {
+		return err
+	}
+	return redisPipelineError(replies)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testCountingAuthenticator struct {
+	authToken
+
+	detections int
+}
+
+func (t *testCountingAuthenticator) AuthenticatorID() string { return "counting" }
+
+func (t *testCountingAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	t.detections++
+	if _, err := r.Cookie("nginx-sso-counting"); err != nil {
+		return "", nil, errNoUser
+	}
+	return "alice", []string{"admins"}, nil
+}
+
+func TestDetectCache(t *testing.T) {
+	a := &testCountingAuthenticator{}
+
+	prev, prevCfg := getAuthenticatorSnapshot(), getMainConfig().DetectCache
+	setAuthenticators([]authenticator{a})
+	defer func() {
+		getMainConfig().DetectCache = prevCfg
+		authenticatorState.Store(prev)
+	}()
+	getMainConfig().DetectCache = detectCacheConfig{TTL: time.Minute}
+
+	request := func(cookie string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "nginx-sso-counting", Value: cookie})
+		}
+		return r
+	}
+
+	for i := 0; i < 3; i++ {
+		if user, groups, err := detectUser(httptest.NewRecorder(), request("session-1")); err != nil || user != "alice" || len(groups) != 1 {
+			t.Fatalf("Expected alice to be detected, got %q %v: %v", user, groups, err)
+		}
+	}
+	if a.detections != 1 {
+		t.Errorf("Expected the authenticator to be asked once, got %d detections", a.detections)
+	}
+
+	// Other sessions and requests without session are not served from
+	// the cache of the first session
+	detectUser(httptest.NewRecorder(), request("session-2"))
+	detectUser(httptest.NewRecorder(), request(""))
+	if a.detections != 3 {
+		t.Errorf("Expected other sessions to be detected, got %d detections", a.detections)
+	}
+
+	if err := logoutUser(httptest.NewRecorder(), request("session-1")); err != nil {
+		t.Fatalf("Unable to log out: %s", err)
+	}
+	detectUser(httptest.NewRecorder(), request("session-1"))
+	if a.detections != 4 {
+		t.Errorf("Expected the logout to remove the session from the cache, got %d detections", a.detections)
+	}
+
+	// A new configuration invalidates the cached users
+	setCacheSalt([]byte("detect_cache:\n  ttl: 1m\n"))
+	defer setCacheSalt(nil)
+	detectUser(httptest.NewRecorder(), request("session-1"))
+	if a.detections != 5 {
+		t.Errorf("Expected users of the previous configuration to be detected again, got %d detections", a.detections)
+	}
+
+	// Revoking the sessions of the user removes all of them from the cache
+	detectUser(httptest.NewRecorder(), request("session-2"))
+	revokeSessions("alice")
+	detectUser(httptest.NewRecorder(), request("session-1"))
+	detectUser(httptest.NewRecorder(), request("session-2"))
+	if a.detections != 8 {
+		t.Errorf("Expected the revocation to remove the sessions from the cache, got %d detections", a.detections)
+	}
+}
+
+func TestRedisDetectCacheStoreDeleteUser(t *testing.T) {
+	f, uri := startFakeRedis(t)
+
+	c, err := getRedisClient(uri)
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+	s := redisDetectCacheStore{c}
+
+	for key, user := range map[string]string{"a": "alice", "b": "alice", "c": "bob"} {
+		if err := s.Set(key, detectCacheEntry{User: user}, time.Minute); err != nil {
+			t.Fatalf("Unable to cache user: %s", err)
+		}
+	}
+
+	if err := s.DeleteUser("alice"); err != nil {
+		t.Fatalf("Unable to remove user: %s", err)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": false, "c": true} {
+		if e, _ := s.Get(key); (e != nil) != expected {
+			t.Errorf("Expected entry %s to be cached: %v", key, expected)
+		}
+	}
+	if _, ok := f.sets[detectCacheUserKeyPrefix+"alice"]; ok {
+		t.Error("Expected the index of the user to be removed")
+	}
+}
+
+func TestDetectCacheNegative(t *testing.T) {
+	a := &testCountingAuthenticator{}
+
+	prev, prevCfg := getAuthenticatorSnapshot(), getMainConfig().DetectCache
+	setAuthenticators([]authenticator{a})
+	defer func() {
+		getMainConfig().DetectCache = prevCfg
+		authenticatorState.Store(prev)
+	}()
+	getMainConfig().DetectCache = detectCacheConfig{NegativeTTL: time.Minute}
+
+	request := func(auth, ip string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.RemoteAddr = ip + ":1234"
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := detectUser(httptest.NewRecorder(), request("Token junk", "192.0.2.1")); err != errNoUser {
+			t.Fatalf("Expected junk token to be rejected, got %v", err)
+		}
+	}
+	if a.detections != 1 {
+		t.Errorf("Expected the authenticator to be asked once, got %d detections", a.detections)
+	}
+
+	// Other credentials, clients and requests without credentials are
+	// passed to the authenticators
+	detectUser(httptest.NewRecorder(), request("Token other", "192.0.2.1"))
+	detectUser(httptest.NewRecorder(), request("Token junk", "192.0.2.2"))
+	detectUser(httptest.NewRecorder(), request("", "192.0.2.1"))
+	detectUser(httptest.NewRecorder(), request("", "192.0.2.1"))
+	if a.detections != 5 {
+		t.Errorf("Expected uncached requests to be detected, got %d detections", a.detections)
+	}
+
+	// Valid cookies sent with rejected credentials are not rejected
+	r := request("Token junk", "192.0.2.1")
+	r.AddCookie(&http.Cookie{Name: "nginx-sso-counting", Value: "session-1"})
+	if user, _, err := detectUser(httptest.NewRecorder(), r); err != nil || user != "alice" {
+		t.Errorf("Expected alice to be detected from the cookie, got %q: %v", user, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// detectFlights coalesces the detection of concurrent requests carrying
+// the same credentials (like the requests for the assets of a page) so
+// the authenticators and group providers are asked once per burst
+var detectFlights singleflight.Group
+
+// detectFlightResult is the outcome of a detection shared by all
+// requests waiting for it
+type detectFlightResult struct {
+	user    string
+	groups  []string
+	meta    sessionMeta
+	hasMeta bool
+	header  http.Header
+}
+
+// detectUserCoalesced detects the user of the request, requests with the
+// same credentials arriving while the detection is running wait for it
+// and use its result including the cookies set by the authenticators.
+// The detection is not canceled when the request starting it is.
+func detectUserCoalesced(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	key := ""
+	if !getMainConfig().DetectCache.DisableCoalescing {
+		key = credentialsHash(r)
+	}
+	if key == "" {
+		return resolveUser(res, r)
+	}
+
+	leader := false
+	v, err, _ := detectFlights.Do(key, func() (interface{}, error) {
+		leader = true
+
+		fr := r.WithContext(context.WithoutCancel(r.Context()))
+		copyRequestValues(r, fr)
+		defer clearRequestValues(fr)
+
+		rec := &detectRecorder{header: http.Header{}}
+		result := detectFlightResult{header: rec.header}
+
+		var err error
+		result.user, result.groups, err = resolveUser(rec, fr)
+		result.meta, result.hasMeta = getSessionMeta(fr)
+		return result, err
+	})
+	if !leader {
+		metricDetectCoalesced.Inc()
+	}
+
+	result := v.(detectFlightResult)
+	copyHeader(res, result.header)
+	if result.hasMeta {
+		setSessionMeta(r, result.meta)
+	} else {
+		clearSessionMeta(r)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return result.user, append([]string{}, result.groups...), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testBlockingAuthenticator struct {
+	authToken
+
+	detections int32
+	release    chan struct{}
+}
+
+func (t *testBlockingAuthenticator) AuthenticatorID() string { return "blocking" }
+
+func (t *testBlockingAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	atomic.AddInt32(&t.detections, 1)
+	<-t.release
+
+	c, err := r.Cookie("nginx-sso-blocking")
+	if err != nil || c.Value == "invalid" {
+		return "", nil, errNoUser
+	}
+	http.SetCookie(res, &http.Cookie{Name: "nginx-sso-blocking", Value: c.Value + "-renewed"})
+	setSessionClaims(r, map[string]string{"email": "alice@example.com"})
+	return "alice", []string{"admins"}, nil
+}
+
+func TestDetectCoalescing(t *testing.T) {
+	a := &testBlockingAuthenticator{release: make(chan struct{})}
+
+	prev := getAuthenticatorSnapshot()
+	setAuthenticators([]authenticator{a})
+	defer authenticatorState.Store(prev)
+
+	detect := func(cookie string, n int) []*httptest.ResponseRecorder {
+		var (
+			recorders = make([]*httptest.ResponseRecorder, n)
+			wg        sync.WaitGroup
+		)
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(res *httptest.ResponseRecorder) {
+				defer wg.Done()
+
+				r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+				r.AddCookie(&http.Cookie{Name: "nginx-sso-blocking", Value: cookie})
+				defer clearRequestValues(r)
+
+				user, groups, err := detectUser(res, r)
+				meta, _ := getSessionMeta(r)
+				if cookie != "invalid" && (err != nil || user != "alice" || len(groups) != 1 || meta.Claims["email"] == "") {
+					t.Errorf("Expected alice with claims to be detected, got %q %v %v: %v", user, groups, meta, err)
+				}
+				if cookie == "invalid" && err != errNoUser {
+					t.Errorf("Expected invalid session to be rejected, got %v", err)
+				}
+			}(recorders[i])
+		}
+
+		// Let the requests join the running detection before finishing it
+		time.Sleep(100 * time.Millisecond)
+		a.release <- struct{}{}
+		wg.Wait()
+		return recorders
+	}
+
+	for _, res := range detect("session-1", 10) {
+		if res.Header().Get("Set-Cookie") != "nginx-sso-blocking=session-1-renewed" {
+			t.Errorf("Expected renewed cookie for every request, got %q", res.Header().Get("Set-Cookie"))
+		}
+	}
+	if n := atomic.LoadInt32(&a.detections); n != 1 {
+		t.Errorf("Expected one detection for concurrent requests, got %d", n)
+	}
+
+	detect("invalid", 5)
+	if n := atomic.LoadInt32(&a.detections); n != 2 {
+		t.Errorf("Expected one detection for rejected credentials, got %d", n)
+	}
+
+	// Without coalescing every request is detected on its own
+	prevCfg := getMainConfig().DetectCache
+	getMainConfig().DetectCache.DisableCoalescing = true
+	defer func() { getMainConfig().DetectCache = prevCfg }()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			a.release <- struct{}{}
+		}
+	}()
+	detect("session-1", 3)
+	if n := atomic.LoadInt32(&a.detections); n != 5 {
+		t.Errorf("Expected every request to be detected without coalescing, got %d", n)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const (
+	deviceDefaultCodeTTL  = 10 * time.Minute
+	deviceDefaultInterval = 5 * time.Second
+	deviceDefaultName     = "Device"
+	deviceGrantType       = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceSlowDownPenalty = 5 * time.Second
+
+	// Characters without vowels and ambiguous characters as recommended
+	// in RFC 8628 section 6.1
+	deviceUserCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+var devicePollErrors = map[string]string{
+	"access_denied":         "The authorization was denied",
+	"authorization_pending": "The authorization was not yet approved",
+	"expired_token":         "The device code has expired",
+	"invalid_grant":         "The device code is invalid",
+	"slow_down":             "Polling too fast, increase the interval",
+}
+
+// deviceFlowConfig enables the device authorization grant (RFC 8628)
+// issuing personal access tokens to CLIs and other devices without a
+// browser
+type deviceFlowConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	CodeTTL       time.Duration `yaml:"code_ttl"`
+	Interval      time.Duration `yaml:"interval"`
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
+// deviceAuthorization is a pending authorization waiting for the user
+// to approve it on the verification page
+type deviceAuthorization struct {
+	UserCode string
+	Name     string
+	Hosts    []string
+	Expires  time.Time
+
+	// thumbprint of the key of the DPoP proof sent with the device
+	// authorization request, the token is bound to it
+	jkt      string
+	interval time.Duration
+	lastPoll time.Time
+
+	approved bool
+	denied   bool
+	token    string
+}
+
+// deviceFlow keeps the pending authorizations in memory, they are lost
+// on restart and reload
+type deviceFlow struct {
+	config deviceFlowConfig
+	store  *patStore
+
+	// pending authorizations by the hash of the device code
+	pending map[string]*deviceAuthorization
+	lock    sync.Mutex
+}
+
+func newDeviceFlow(c deviceFlowConfig, store *patStore) *deviceFlow {
+	if c.CodeTTL == 0 {
+		c.CodeTTL = deviceDefaultCodeTTL
+	}
+	if c.Interval == 0 {
+		c.Interval = deviceDefaultInterval
+	}
+
+	return &deviceFlow{
+		config:  c,
+		store:   store,
+		pending: map[string]*deviceAuthorization{},
+	}
+}
+
+func newDeviceUserCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "Unable to read random bytes")
+	}
+
+	code := make([]byte, len(buf))
+	for i, b := range buf {
+		code[i] = deviceUserCodeCharset[int(b)%len(deviceUserCodeCharset)]
+	}
+
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// normalizeDeviceUserCode accepts user codes typed in lower case and
+// without or with additional dashes and spaces
+func normalizeDeviceUserCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// removeExpired drops expired authorizations. Must be called with the
+// lock held.
+func (d *deviceFlow) removeExpired() {
+	for k, a := range d.pending {
+		if a.Expires.Before(time.Now()) {
+			delete(d.pending, k)
+		}
+	}
+}
+
+// Start creates a new pending authorization and returns the device code
+func (d *deviceFlow) Start(name string, hosts []string, jkt string) (string, *deviceAuthorization, error) {
+	deviceCode, err := newSessionID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	userCode, err := newDeviceUserCode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	a := &deviceAuthorization{
+		UserCode: userCode,
+		Name:     name,
+		Hosts:    hosts,
+		Expires:  time.Now().Add(d.config.CodeTTL),
+		jkt:      jkt,
+		interval: d.config.Interval,
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.removeExpired()
+	d.pending[hashPAT(deviceCode)] = a
+
+	return deviceCode, a, nil
+}
+
+// Lookup returns a copy of the pending authorization for the user code
+func (d *deviceFlow) Lookup(userCode string) (deviceAuthorization, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, a := d.byUserCode(userCode); a != nil {
+		return *a, true
+	}
+	return deviceAuthorization{}, false
+}
+
+// byUserCode returns the pending authorization which was not yet
+// decided on. Must be called with the lock held.
+func (d *deviceFlow) byUserCode(userCode string) (string, *deviceAuthorization) {
+	userCode = normalizeDeviceUserCode(userCode)
+	for k, a := range d.pending {
+		if a.UserCode == userCode && !a.approved && !a.denied && a.Expires.After(time.Now()) {
+			return k, a
+		}
+	}
+	return "", nil
+}
+
+// Approve issues the token for the pending authorization to the user
+func (d *deviceFlow) Approve(userCode, user string, groups []string) (personalAccessToken, bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, a := d.byUserCode(userCode)
+	if a == nil {
+		return personalAccessToken{}, false, nil
+	}
+
+	token, pat, err := d.store.Create(user, a.Name, a.Hosts, groups, d.config.TokenLifetime, a.jkt)
+	if err != nil {
+		return personalAccessToken{}, false, err
+	}
+
+	a.approved, a.token = true, token
+	return pat, true, nil
+}
+
+// Deny rejects the pending authorization
+func (d *deviceFlow) Deny(userCode string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, a := d.byUserCode(userCode)
+	if a == nil {
+		return false
+	}
+
+	a.denied = true
+	return true
+}
+
+// Poll returns the token once the authorization was approved or the
+// error code defined in RFC 8628 section 3.5. Authorizations bound to
+// a key need to be polled with a proof of the same key.
+func (d *deviceFlow) Poll(deviceCode, jkt string) (string, string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := hashPAT(deviceCode)
+	a, ok := d.pending[key]
+	switch {
+	case !ok || a.jkt != "" && a.jkt != jkt:
+		return "", "invalid_grant"
+
+	case a.Expires.Before(time.Now()):
+		delete(d.pending, key)
+		return "", "expired_token"
+
+	case a.denied:
+		delete(d.pending, key)
+		return "", "access_denied"
+
+	case a.approved:
+		// The token is handed out only once
+		delete(d.pending, key)
+		return a.token, ""
+	}
+
+	if time.Since(a.lastPoll) < a.interval {
+		a.interval += deviceSlowDownPenalty
+		a.lastPoll = time.Now()
+		return "", "slow_down"
+	}
+
+	a.lastPoll = time.Now()
+	return "", "authorization_pending"
+}
+
+func getDeviceFlow() *deviceFlow {
+	store := getPATStore()
+	if store == nil {
+		return nil
+	}
+	return store.devices
+}
+
+// handleDeviceCodeRequest starts the device authorization for a client
+func handleDeviceCodeRequest(res http.ResponseWriter, r *http.Request) {
+	d := getDeviceFlow()
+	if d == nil {
+		oidcErrorResponse(res, http.StatusNotImplemented, "unsupported_grant_type", "Device authorization is not enabled")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		oidcErrorResponse(res, http.StatusMethodNotAllowed, "invalid_request", "Device authorization requests need to use POST")
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" {
+		name = deviceDefaultName
+	}
+
+	jkt, ok := deviceProofKey(res, r, "/device/code")
+	if !ok {
+		return
+	}
+
+	deviceCode, a, err := d.Start(name, strings.Fields(strings.Replace(r.PostFormValue("hosts"), ",", " ", -1)), jkt)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to start device authorization")
+		oidcErrorResponse(res, http.StatusInternalServerError, "server_error", "Unable to start device authorization")
+		return
+	}
+
+	verificationURI := requestScheme(r) + "://" + r.Host + "/device"
+	oidcJSONResponse(res, http.StatusOK, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 a.UserCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(a.UserCode),
+		"expires_in":                int(d.config.CodeTTL / time.Second),
+		"interval":                  int(d.config.Interval / time.Second),
+	})
+}
+
+// handleDeviceTokenRequest is polled by the client until the user
+// approved or denied the authorization
+func handleDeviceTokenRequest(res http.ResponseWriter, r *http.Request) {
+	d := getDeviceFlow()
+	if d == nil {
+		oidcErrorResponse(res, http.StatusNotImplemented, "unsupported_grant_type", "Device authorization is not enabled")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		oidcErrorResponse(res, http.StatusMethodNotAllowed, "invalid_request", "Token requests need to use POST")
+		return
+	}
+
+	if r.PostFormValue("grant_type") != deviceGrantType {
+		oidcErrorResponse(res, http.StatusBadRequest, "unsupported_grant_type", "Only the device code grant is supported")
+		return
+	}
+
+	jkt, ok := deviceProofKey(res, r, "/device/token")
+	if !ok {
+		return
+	}
+
+	token, errCode := d.Poll(r.PostFormValue("device_code"), jkt)
+	if errCode != "" {
+		oidcErrorResponse(res, http.StatusBadRequest, errCode, devicePollErrors[errCode])
+		return
+	}
+
+	tokenType := "Token"
+	if jkt != "" {
+		tokenType = "DPoP"
+	}
+
+	pat, _ := d.store.Lookup(token)
+	oidcJSONResponse(res, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   tokenType,
+		"expires_in":   int(time.Until(pat.Expires) / time.Second),
+	})
+}
+
+// deviceProofKey verifies the optional DPoP proof of the request and
+// returns the thumbprint of its key. An error response is written if
+// the proof is invalid.
+func deviceProofKey(res http.ResponseWriter, r *http.Request, path string) (string, bool) {
+	proof, err := verifyDPoPRequest(r, http.MethodPost, requestScheme(r)+"://"+r.Host+path, "")
+	if err != nil {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+		return "", false
+	}
+	if proof == nil {
+		return "", true
+	}
+	return proof.Thumbprint, true
+}
+
+// handleDeviceRequest renders the verification page on which the user
+// enters the user code and approves the authorization
+func handleDeviceRequest(res http.ResponseWriter, r *http.Request) {
+	d := getDeviceFlow()
+	if d == nil {
+		http.Error(res, "Device authorization is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	user, groups, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Let the user decide below
+
+	case errors.Is(err, errNoUser):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if !patInteractiveSession(r) {
+		http.Error(res, "Devices can only be authorized after logging in", http.StatusForbidden)
+		return
+	}
+
+	userCode := normalizeDeviceUserCode(r.FormValue("user_code"))
+	ctx := pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"login":      getMainConfig().Login,
+		"user":       user,
+		"user_code":  userCode,
+	}
+
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "approve":
+			pat, ok, err := d.Approve(userCode, user, groups)
+			if err != nil {
+				requestLog(r).WithError(err).Error("Unable to issue device token")
+				http.Error(res, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			if ok {
+				getMainConfig().AuditLog.Log(auditEventTokenCreated, r, map[string]string{"token": pat.ID, "token_name": pat.Name, "username": user, "grant": "device"})
+				ctx["result"] = "approved"
+			} else {
+				ctx["error"] = "Unknown or expired code"
+			}
+
+		case "deny":
+			if d.Deny(userCode) {
+				ctx["result"] = "denied"
+			} else {
+				ctx["error"] = "Unknown or expired code"
+			}
+
+		default:
+			http.Error(res, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	} else if userCode != "" {
+		if a, ok := d.Lookup(userCode); ok {
+			ctx["authorization"] = a
+		} else {
+			ctx["error"] = "Unknown or expired code"
+		}
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("device.html"))
+	if err := tpl.ExecuteWriter(ctx, res); err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	_, cleanup := testPATStore(t)
+	defer cleanup()
+
+	store := getPATStore()
+	store.devices = newDeviceFlow(deviceFlowConfig{Enabled: true, Interval: time.Hour}, store)
+
+	r := httptest.NewRequest(http.MethodPost, "/device/code", strings.NewReader(url.Values{"name": {"laptop"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handleDeviceCodeRequest(rec, r)
+
+	start := map[string]interface{}{}
+	json.NewDecoder(rec.Body).Decode(&start)
+	deviceCode, _ := start["device_code"].(string)
+	userCode, _ := start["user_code"].(string)
+	if rec.Code != http.StatusOK || deviceCode == "" || len(userCode) != 9 || start["verification_uri"] != "https://example.com/device" {
+		t.Fatalf("Unexpected device authorization response %d: %v", rec.Code, start)
+	}
+
+	poll := func() (int, map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(url.Values{
+			"grant_type":  {deviceGrantType},
+			"device_code": {deviceCode},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handleDeviceTokenRequest(rec, r)
+
+		result := map[string]interface{}{}
+		json.NewDecoder(rec.Body).Decode(&result)
+		return rec.Code, result
+	}
+
+	if _, result := poll(); result["error"] != "authorization_pending" {
+		t.Errorf("Expected pending authorization, got %v", result)
+	}
+	if _, result := poll(); result["error"] != "slow_down" {
+		t.Errorf("Expected client to be slowed down, got %v", result)
+	}
+
+	if _, ok := store.devices.Lookup(strings.ToLower(strings.Replace(userCode, "-", "", 1))); !ok {
+		t.Error("Expected user code to be found without dash and in lower case")
+	}
+
+	if _, ok, err := store.devices.Approve(userCode, "alice", []string{"admins"}); !ok || err != nil {
+		t.Fatalf("Unable to approve authorization: %v", err)
+	}
+
+	code, result := poll()
+	token, _ := result["access_token"].(string)
+	if code != http.StatusOK || result["token_type"] != "Token" {
+		t.Fatalf("Expected token to be issued, got status %d: %v", code, result)
+	}
+	if pat, ok := store.Lookup(token); !ok || pat.User != "alice" || pat.Name != "laptop" {
+		t.Errorf("Expected issued token to be a personal access token of alice, got %+v", pat)
+	}
+
+	if _, result := poll(); result["error"] != "invalid_grant" {
+		t.Errorf("Expected token to be handed out only once, got %v", result)
+	}
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	_, cleanup := testPATStore(t)
+	defer cleanup()
+
+	d := newDeviceFlow(deviceFlowConfig{Enabled: true}, getPATStore())
+	deviceCode, a, err := d.Start("laptop", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to start authorization: %s", err)
+	}
+
+	if !d.Deny(a.UserCode) {
+		t.Fatal("Expected authorization to be denied")
+	}
+	if _, ok, _ := d.Approve(a.UserCode, "alice", nil); ok {
+		t.Error("Expected denied authorization not to be approvable")
+	}
+	if _, errCode := d.Poll(deviceCode, ""); errCode != "access_denied" {
+		t.Errorf("Expected access_denied, got %q", errCode)
+	}
+}
+
+func TestDeviceFlowRequiresInteractiveSession(t *testing.T) {
+	_, cleanup := testPATStore(t)
+	defer cleanup()
+
+	store := getPATStore()
+	store.devices = newDeviceFlow(deviceFlowConfig{Enabled: true}, store)
+
+	prevAuthenticators, prevFrontend := getAuthenticatorSnapshot(), getMainConfig().Frontend
+	defer func() {
+		getMainConfig().Frontend = prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	for provider, expStatus := range map[string]int{
+		"simple":          http.StatusOK,
+		"service_account": http.StatusForbidden,
+	} {
+		setAuthenticators([]authenticator{&testDetectAuthenticator{id: provider, detect: func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+			return "alice", []string{"admins"}, nil
+		}}})
+
+		r := httptest.NewRequest(http.MethodGet, "/device", nil)
+		rec := httptest.NewRecorder()
+		handleDeviceRequest(rec, r)
+		clearSessionMeta(r)
+
+		if rec.Code != expStatus {
+			t.Errorf("Expected status %d for session of %s, got %d", expStatus, provider, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dpopHeader         = "DPoP"
+	dpopProofMaxAge    = time.Minute
+	dpopProofType      = "dpop+jwt"
+	dpopAlgorithmES256 = "ES256"
+)
+
+var (
+	dpopSigningAlgorithms = []string{jwtAlgorithmEdDSA, dpopAlgorithmES256, jwtAlgorithmRS256}
+
+	errDPoPInvalid  = errors.New("DPoP proof is invalid")
+	errDPoPRequired = errors.New("DPoP proof is required")
+
+	// dpopSeenProofs prevents proofs from being replayed while their
+	// iat is accepted
+	dpopSeenProofs     = map[string]time.Time{}
+	dpopSeenProofsLock sync.Mutex
+)
+
+// dpopProof is the verified proof of possession (RFC 9449) sent by
+// the client in the DPoP header
+type dpopProof struct {
+	// Thumbprint is the JWK thumbprint (RFC 7638) of the key used
+	// to sign the proof which tokens are bound to (cnf.jkt)
+	Thumbprint string
+}
+
+// dpopHTU returns the URI to compare with the htu claim: The query and
+// fragment are not part of the htu
+func dpopHTU(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
+
+// dpopAccessTokenHash calculates the ath claim of the proof
+func dpopAccessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyDPoPRequest verifies the DPoP header of the request for the
+// given method and URI. If accessToken is set the proof needs to be
+// bound to it. Without DPoP header nil is returned.
+func verifyDPoPRequest(r *http.Request, method, uri, accessToken string) (*dpopProof, error) {
+	values := r.Header[http.CanonicalHeaderKey(dpopHeader)]
+	switch len(values) {
+	case 0:
+		return nil, nil
+	case 1:
+		return verifyDPoPProof(values[0], method, uri, accessToken)
+	default:
+		return nil, errDPoPInvalid
+	}
+}
+
+func verifyDPoPProof(proof, method, uri, accessToken string) (*dpopProof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, errDPoPInvalid
+	}
+
+	var header struct {
+		Type      string            `json:"typ"`
+		Algorithm string            `json:"alg"`
+		JWK       map[string]string `json:"jwk"`
+	}
+	if err := dpopDecodeSegment(parts[0], &header); err != nil || header.Type != dpopProofType {
+		return nil, errDPoPInvalid
+	}
+
+	if _, private := header.JWK["d"]; private {
+		// Never accept proofs disclosing the private key
+		return nil, errDPoPInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errDPoPInvalid
+	}
+
+	if !dpopVerifySignature(header.Algorithm, header.JWK, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errDPoPInvalid
+	}
+
+	var claims struct {
+		JTI             string `json:"jti"`
+		Method          string `json:"htm"`
+		URI             string `json:"htu"`
+		IssuedAt        int64  `json:"iat"`
+		AccessTokenHash string `json:"ath"`
+	}
+	if err := dpopDecodeSegment(parts[1], &claims); err != nil {
+		return nil, errDPoPInvalid
+	}
+
+	issued := time.Unix(claims.IssuedAt, 0)
+	switch {
+	case claims.JTI == "":
+		return nil, errDPoPInvalid
+	case !strings.EqualFold(claims.Method, method):
+		return nil, errDPoPInvalid
+	case dpopHTU(claims.URI) != dpopHTU(uri):
+		return nil, errDPoPInvalid
+	case time.Since(issued) > dpopProofMaxAge || time.Until(issued) > dpopProofMaxAge:
+		return nil, errDPoPInvalid
+	case accessToken != "" && claims.AccessTokenHash != dpopAccessTokenHash(accessToken):
+		return nil, errDPoPInvalid
+	}
+
+	thumbprint := dpopThumbprint(header.JWK)
+	if !dpopMarkSeen(thumbprint + ":" + claims.JTI) {
+		return nil, errDPoPInvalid
+	}
+
+	return &dpopProof{Thumbprint: thumbprint}, nil
+}
+
+// dpopMarkSeen records the proof and returns false if it was already
+// used before
+func dpopMarkSeen(id string) bool {
+	dpopSeenProofsLock.Lock()
+	defer dpopSeenProofsLock.Unlock()
+
+	now := time.Now()
+	for k, expires := range dpopSeenProofs {
+		if expires.Before(now) {
+			delete(dpopSeenProofs, k)
+		}
+	}
+
+	if _, ok := dpopSeenProofs[id]; ok {
+		return false
+	}
+
+	// Proofs are accepted up to the max age in both directions
+	dpopSeenProofs[id] = now.Add(2 * dpopProofMaxAge)
+	return true
+}
+
+func dpopDecodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func dpopDecodeInt(v string) (*big.Int, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(data), true
+}
+
+func dpopVerifySignature(alg string, jwk map[string]string, data, sig []byte) bool {
+	switch {
+	case alg == jwtAlgorithmEdDSA && jwk["kty"] == "OKP" && jwk["crv"] == "Ed25519":
+		pub, err := base64.RawURLEncoding.DecodeString(jwk["x"])
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(pub), data, sig)
+
+	case alg == dpopAlgorithmES256 && jwk["kty"] == "EC" && jwk["crv"] == "P-256":
+		x, okX := dpopDecodeInt(jwk["x"])
+		y, okY := dpopDecodeInt(jwk["y"])
+		if !okX || !okY || len(sig) != 64 || !elliptic.P256().IsOnCurve(x, y) {
+			return false
+		}
+		sum := sha256.Sum256(data)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		return ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+
+	case alg == jwtAlgorithmRS256 && jwk["kty"] == "RSA":
+		n, okN := dpopDecodeInt(jwk["n"])
+		e, okE := dpopDecodeInt(jwk["e"])
+		if !okN || !okE || n.BitLen() < 2048 || !e.IsInt64() {
+			return false
+		}
+		sum := sha256.Sum256(data)
+		pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	}
+
+	return false
+}
+
+// dpopThumbprint calculates the JWK thumbprint (RFC 7638) using the
+// required members of the key type
+func dpopThumbprint(jwk map[string]string) string {
+	members := map[string][]string{
+		"EC":  {"crv", "kty", "x", "y"},
+		"OKP": {"crv", "kty", "x"},
+		"RSA": {"e", "kty", "n"},
+	}
+
+	required := map[string]string{}
+	for _, m := range members[jwk["kty"]] {
+		required[m] = jwk[m]
+	}
+
+	// json.Marshal sorts the map keys as required by RFC 7638
+	data, _ := json.Marshal(required)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// dpopBoundKey returns the thumbprint of the key the token claims are
+// bound to (cnf.jkt)
+func dpopBoundKey(claims map[string]interface{}) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
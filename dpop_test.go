@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dpopTestKey struct {
+	key ed25519.PrivateKey
+	jwk map[string]string
+}
+
+func newDPoPTestKey(t *testing.T) dpopTestKey {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate Ed25519 key: %s", err)
+	}
+
+	return dpopTestKey{key: key, jwk: map[string]string{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"x":   base64.RawURLEncoding.EncodeToString(pub),
+	}}
+}
+
+func (k dpopTestKey) proof(method, uri, accessToken string) string {
+	header, _ := json.Marshal(map[string]interface{}{"typ": dpopProofType, "alg": jwtAlgorithmEdDSA, "jwk": k.jwk})
+
+	jti, _ := newSessionID()
+	claims := map[string]interface{}{"jti": jti, "htm": method, "htu": uri, "iat": time.Now().Unix()}
+	if accessToken != "" {
+		claims["ath"] = dpopAccessTokenHash(accessToken)
+	}
+	payload, _ := json.Marshal(claims)
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return data + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(k.key, []byte(data)))
+}
+
+func TestDPoPProof(t *testing.T) {
+	k := newDPoPTestKey(t)
+
+	proof := k.proof(http.MethodGet, "https://api.example.com/items?page=2", "token")
+	p, err := verifyDPoPProof(proof, http.MethodGet, "https://api.example.com/items", "token")
+	if err != nil || p.Thumbprint != dpopThumbprint(k.jwk) {
+		t.Fatalf("Expected proof to be valid, got %v", err)
+	}
+
+	if _, err := verifyDPoPProof(proof, http.MethodGet, "https://api.example.com/items", "token"); err == nil {
+		t.Error("Expected replayed proof to be rejected")
+	}
+
+	for name, tc := range map[string]struct {
+		method, uri, token string
+	}{
+		"method": {http.MethodPost, "https://api.example.com/items", "token"},
+		"uri":    {http.MethodGet, "https://other.example.com/items", "token"},
+		"token":  {http.MethodGet, "https://api.example.com/items", "other"},
+	} {
+		proof := k.proof(http.MethodGet, "https://api.example.com/items", "token")
+		if _, err := verifyDPoPProof(proof, tc.method, tc.uri, tc.token); err == nil {
+			t.Errorf("Expected proof with mismatching %s to be rejected", name)
+		}
+	}
+
+	other := newDPoPTestKey(t)
+	forged := k.proof(http.MethodGet, "https://api.example.com/items", "")
+	parts := strings.Split(forged, ".")
+	header, _ := json.Marshal(map[string]interface{}{"typ": dpopProofType, "alg": jwtAlgorithmEdDSA, "jwk": other.jwk})
+	forged = base64.RawURLEncoding.EncodeToString(header) + "." + parts[1] + "." + parts[2]
+	if _, err := verifyDPoPProof(forged, http.MethodGet, "https://api.example.com/items", ""); err == nil {
+		t.Error("Expected proof signed by another key to be rejected")
+	}
+}
+
+func TestDPoPOIDCBinding(t *testing.T) {
+	p := oidcTestProvider(t)
+	k := newDPoPTestKey(t)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	code, _ := p.storeCode(oidcAuthorizationCode{
+		ClientID:      "spa",
+		RedirectURI:   "https://app.example.com/callback",
+		User:          "alice",
+		Scope:         "openid",
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+		AuthTime:      time.Now(),
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(url.Values{
+		"client_id":     {"spa"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(dpopHeader, k.proof(http.MethodPost, "https://login.example.com/oidc/token", ""))
+	rec := httptest.NewRecorder()
+	p.handleToken(rec, r)
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	json.NewDecoder(rec.Body).Decode(&tokens)
+	if rec.Code != http.StatusOK || tokens.TokenType != "DPoP" {
+		t.Fatalf("Expected DPoP token to be issued, got status %d: %+v", rec.Code, tokens)
+	}
+
+	userInfo := func(scheme, proof string) int {
+		r := httptest.NewRequest(http.MethodGet, "/oidc/userinfo", nil)
+		r.Header.Set("Authorization", scheme+" "+tokens.AccessToken)
+		if proof != "" {
+			r.Header.Set(dpopHeader, proof)
+		}
+		rec := httptest.NewRecorder()
+		p.handleUserInfo(rec, r)
+		return rec.Code
+	}
+
+	if code := userInfo("Bearer", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected bound token to be rejected as bearer token, got status %d", code)
+	}
+	if code := userInfo("DPoP", newDPoPTestKey(t).proof(http.MethodGet, "https://login.example.com/oidc/userinfo", tokens.AccessToken)); code != http.StatusUnauthorized {
+		t.Errorf("Expected proof of another key to be rejected, got status %d", code)
+	}
+	if code := userInfo("DPoP", k.proof(http.MethodGet, "https://login.example.com/oidc/userinfo", tokens.AccessToken)); code != http.StatusOK {
+		t.Errorf("Expected bound token with proof to be accepted, got status %d", code)
+	}
+
+	p.config.Clients["spa"] = oidcClientConfig{RedirectURIs: []string{"https://app.example.com/callback"}, RequireDPoP: true}
+	r = httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(url.Values{"client_id": {"spa"}, "grant_type": {"authorization_code"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	p.handleToken(rec, r)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_dpop_proof") {
+		t.Errorf("Expected token request without proof to be rejected, got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDPoPPersonalAccessToken(t *testing.T) {
+	_, cleanup := testPATStore(t)
+	defer cleanup()
+
+	k := newDPoPTestKey(t)
+	token, _, err := getPATStore().Create("alice", "cli", nil, nil, 0, dpopThumbprint(k.jwk))
+	if err != nil {
+		t.Fatalf("Unable to create token: %s", err)
+	}
+
+	a := &authToken{}
+	detect := func(scheme, proof string) error {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Host", "api.example.com")
+		r.Header.Set("X-Origin-URI", "/items?page=2")
+		r.Header.Set("Authorization", scheme+" "+token)
+		if proof != "" {
+			r.Header.Set(dpopHeader, proof)
+		}
+
+		_, _, err := a.DetectUser(context.Background(), httptest.NewRecorder(), r)
+		clearSessionMeta(r)
+		return err
+	}
+
+	if err := detect("Token", ""); err != errNoUser {
+		t.Errorf("Expected bound token without proof to be rejected, got %v", err)
+	}
+	if err := detect("DPoP", k.proof(http.MethodGet, "https://api.example.com/other", token)); err != errNoUser {
+		t.Errorf("Expected proof for another URI to be rejected, got %v", err)
+	}
+	if err := detect("DPoP", k.proof(http.MethodGet, "https://api.example.com/items", token)); err != nil {
+		t.Errorf("Expected bound token with proof to be accepted, got %v", err)
+	}
+}
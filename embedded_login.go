@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const (
+	embeddedLoginPath        = "/login/embedded"
+	embeddedLoginMessageType = "nginx-sso:login"
+)
+
+// embeddedLoginConfig allows single page applications to run the login
+// in a popup or iframe. When the session is established the opener or
+// parent window is notified using postMessage to the origin it passed.
+type embeddedLoginConfig struct {
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// Enabled returns whether any origin may use the embedded login
+func (e embeddedLoginConfig) Enabled() bool { return len(e.AllowedOrigins) > 0 }
+
+func (e embeddedLoginConfig) Validate() error {
+	for _, o := range e.AllowedOrigins {
+		if o == "*" {
+			// Any page opening the popup would be told about the login
+			return errors.New("Wildcard origin is not allowed")
+		}
+	}
+
+	return corsConfig{AllowedOrigins: e.AllowedOrigins}.Validate()
+}
+
+// originAllowed checks the origin the message is to be sent to. Hosts in
+// the allowed origins can be prefixed by `*.` to allow all subdomains.
+func (e embeddedLoginConfig) originAllowed(origin string) bool {
+	return corsConfig{AllowedOrigins: e.AllowedOrigins}.originAllowed(origin)
+}
+
+// handleEmbeddedLoginRequest sends users without a session through the
+// login and afterwards renders a page posting the completion to the
+// window which opened the popup or contains the iframe
+func handleEmbeddedLoginRequest(res http.ResponseWriter, r *http.Request) {
+	cfg := getMainConfig().EmbeddedLogin
+	if !cfg.Enabled() {
+		http.NotFound(res, r)
+		return
+	}
+
+	origin := r.FormValue("origin")
+	if !cfg.originAllowed(origin) {
+		requestLog(r).WithField("origin", origin).Warn("Rejected embedded login for origin")
+		http.Error(res, "Origin is not allowed", http.StatusBadRequest)
+		return
+	}
+
+	user, _, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Notify the opener below
+
+	case errors.Is(err, errNoUser):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if !getMainConfig().Terms.Accepted(r, user) {
+		// The session can't be used before the terms are accepted
+		http.Redirect(res, r, getMainConfig().Terms.Redirect(r, user, r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("embedded_login.html"))
+	body, err := tpl.ExecuteBytes(pongo2.Context{
+		"branding":     getMainConfig().Frontend.Branding(),
+		"csp_nonce":    cspNonce(r),
+		"login":        requestLoginSettings(r),
+		"message_type": embeddedLoginMessageType,
+		"origin":       origin,
+		"user":         user,
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Write(body)
+}
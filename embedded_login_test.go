@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEmbeddedLogin(t *testing.T) {
+	for name, cfg := range map[string]embeddedLoginConfig{
+		"wildcard": {AllowedOrigins: []string{"*"}},
+		"path":     {AllowedOrigins: []string{"https://app.example.com/login"}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected config with %s to be rejected", name)
+		}
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	prevEmbedded, prevFrontend, prevAuthenticators := getMainConfig().EmbeddedLogin, getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().EmbeddedLogin, getMainConfig().Frontend = prevEmbedded, prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{EnableBasicAuth: true, Users: map[string]string{"alice": string(hash)}}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().EmbeddedLogin = embeddedLoginConfig{AllowedOrigins: []string{"https://*.example.com"}}
+	if err := getMainConfig().EmbeddedLogin.Validate(); err != nil {
+		t.Fatalf("Unable to validate embedded login: %s", err)
+	}
+
+	request := func(origin string, login bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, embeddedLoginPath+"?origin="+origin, nil)
+		if login {
+			r.SetBasicAuth("alice", "secret")
+		}
+		res := httptest.NewRecorder()
+		handleEmbeddedLoginRequest(res, r)
+		return res
+	}
+
+	if res := request("https%3A%2F%2Fevil.example.org", true); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected foreign origin to be rejected, got %d", res.Code)
+	}
+
+	res := request("https%3A%2F%2Fapp.example.com", false)
+	if res.Code != http.StatusFound || res.Header().Get("Location") != "/login?go=%2Flogin%2Fembedded%3Forigin%3Dhttps%253A%252F%252Fapp.example.com" {
+		t.Errorf("Expected redirect to the login, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+
+	res = request("https%3A%2F%2Fapp.example.com", true)
+	if body := res.Body.String(); !strings.Contains(body, `data-origin="https://app.example.com" data-message-type="nginx-sso:login" data-user="alice"`) ||
+		!strings.Contains(body, "postMessage") {
+		t.Errorf("Expected completion page posting the message, got %d", res.Code)
+	}
+	if res.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected completion page not to be cached")
+	}
+}
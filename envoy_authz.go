@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+	log "github.com/sirupsen/logrus"
+)
+
+// gRPC status codes used in the responses
+const (
+	grpcStatusOK               = 0
+	grpcStatusInvalidArgument  = 3
+	grpcStatusPermissionDenied = 7
+	grpcStatusUnimplemented    = 12
+	grpcStatusInternal         = 13
+	grpcStatusUnavailable      = 14
+	grpcStatusUnauthenticated  = 16
+)
+
+var envoyAuthzCheckMethods = []string{
+	"/envoy.service.auth.v2.Authorization/Check",
+	"/envoy.service.auth.v3.Authorization/Check",
+}
+
+// envoyAuthzConfig configures the gRPC listener implementing the
+// Envoy external authorization (ext_authz) protocol
+type envoyAuthzConfig struct {
+	Listen      string `yaml:"listen"`
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+}
+
+func (e envoyAuthzConfig) Validate() error {
+	if e.Listen == "" {
+		return nil
+	}
+
+	if e.TLSCertFile == "" || e.TLSKeyFile == "" {
+		return fmt.Errorf("TLS certificate and key are required for the gRPC listener")
+	}
+
+	return nil
+}
+
+// envoyCheckRequest contains the parts of the CheckRequest message
+// required to judge the request
+type envoyCheckRequest struct {
+	SourceAddress string
+	Method        string
+	Headers       map[string]string
+	Path          string
+	Host          string
+	Scheme        string
+}
+
+// parseEnvoyCheckRequest decodes the CheckRequest message:
+// CheckRequest.attributes(1) -> AttributeContext.source(1) / request(4)
+func parseEnvoyCheckRequest(buf []byte) (envoyCheckRequest, error) {
+	req := envoyCheckRequest{Headers: map[string]string{}}
+
+	attrs, err := protoSubMessage(buf, 1)
+	if err != nil {
+		return req, err
+	}
+
+	// AttributeContext.source -> Peer.address(1) -> Address.socket_address(1)
+	// -> SocketAddress.address(2)
+	if source, err := protoSubMessage(attrs, 1, 1, 1); err == nil {
+		fields, _ := parseProtoMessage(source)
+		for _, f := range fields {
+			if f.Number == 2 {
+				req.SourceAddress = string(f.Bytes)
+			}
+		}
+	}
+
+	// AttributeContext.request -> Request.http(2)
+	httpReq, err := protoSubMessage(attrs, 4, 2)
+	if err != nil {
+		return req, err
+	}
+
+	fields, err := parseProtoMessage(httpReq)
+	if err != nil {
+		return req, err
+	}
+
+	for _, f := range fields {
+		switch f.Number {
+		case 2:
+			req.Method = string(f.Bytes)
+		case 3:
+			// map<string, string> entries
+			entry, err := parseProtoMessage(f.Bytes)
+			if err != nil {
+				return req, err
+			}
+			var k, v string
+			for _, ef := range entry {
+				switch ef.Number {
+				case 1:
+					k = string(ef.Bytes)
+				case 2:
+					v = string(ef.Bytes)
+				}
+			}
+			req.Headers[k] = v
+		case 4:
+			req.Path = string(f.Bytes)
+		case 5:
+			req.Host = string(f.Bytes)
+		case 6:
+			req.Scheme = string(f.Bytes)
+		}
+	}
+
+	return req, nil
+}
+
+// protoSubMessage follows the path of field numbers into nested
+// messages and returns the innermost message
+func protoSubMessage(buf []byte, path ...int) ([]byte, error) {
+	for _, number := range path {
+		fields, err := parseProtoMessage(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, f := range fields {
+			if f.Number == number {
+				buf, found = f.Bytes, true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Field %d not found", number)
+		}
+	}
+
+	return buf, nil
+}
+
+// HTTPRequest converts the check request into a request to the /auth
+// endpoint carrying the same information nginx would send
+func (e envoyCheckRequest) HTTPRequest() (*http.Request, error) {
+	r, err := http.NewRequest(e.Method, "/auth", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range e.Headers {
+		if strings.HasPrefix(k, ":") {
+			// HTTP/2 pseudo headers are passed in separate fields
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+
+	r.Host = e.Host
+	r.Header.Set("X-Host", e.Host)
+	r.Header.Set("X-Origin-URI", e.Path)
+	r.Header.Set("X-Origin-Method", e.Method)
+	if e.Scheme != "" {
+		r.Header.Set("X-Forwarded-Proto", e.Scheme)
+	}
+	if e.Scheme == "https" {
+		// The source address is the client itself and no trusted proxy
+		// so the scheme is taken from the connection state
+		r.TLS = &tls.ConnectionState{}
+	}
+	r.RemoteAddr = net.JoinHostPort(e.SourceAddress, "0")
+
+	return r, nil
+}
+
+// envoyAuthzRecorder captures the response of the auth handler
+type envoyAuthzRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func (e *envoyAuthzRecorder) Header() http.Header { return e.header }
+
+func (e *envoyAuthzRecorder) Write(p []byte) (int, error) {
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	return e.body.Write(p)
+}
+
+func (e *envoyAuthzRecorder) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+	}
+}
+
+// CheckResponse encodes the recorded response into a CheckResponse
+// message: Successful requests return the identity headers to be added
+// to the upstream request, failed ones a denied response
+func (e *envoyAuthzRecorder) CheckResponse() []byte {
+	var headers []protoMessage
+	for k := range e.header {
+		switch k {
+		case "Content-Type", "Content-Length", "X-Content-Type-Options":
+			continue
+		}
+
+		// HeaderValueOption.header(1) -> HeaderValue{key(1), value(2)}
+		hv := protoMessage{}.String(1, k).String(2, e.header.Get(k))
+		headers = append(headers, protoMessage{}.Bytes(1, hv))
+	}
+
+	code, msg := grpcStatusOK, ""
+	switch e.status {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		code, msg = grpcStatusUnauthenticated, "No valid user found"
+	case http.StatusForbidden:
+		code, msg = grpcStatusPermissionDenied, "Access denied for this resource"
+	default:
+		code, msg = grpcStatusInternal, "Something went wrong"
+	}
+
+	status := protoMessage{}.Varint(1, uint64(code))
+	if msg != "" {
+		status = status.String(2, msg)
+	}
+	resp := protoMessage{}.Bytes(1, status)
+
+	if code == grpcStatusOK {
+		// OkHttpResponse.headers(2)
+		ok := protoMessage{}
+		for _, h := range headers {
+			ok = ok.Bytes(2, h)
+		}
+		return resp.Bytes(3, ok)
+	}
+
+	// DeniedHttpResponse{status(1): HttpStatus{code(1)}, headers(2), body(3)}
+	denied := protoMessage{}.Bytes(1, protoMessage{}.Varint(1, uint64(e.status)))
+	for _, h := range headers {
+		denied = denied.Bytes(2, h)
+	}
+	denied = denied.String(3, e.body.String())
+
+	return resp.Bytes(2, denied)
+}
+
+func handleEnvoyAuthzRequest(res http.ResponseWriter, r *http.Request) {
+	res.Header().Set("Content-Type", "application/grpc")
+	res.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	writeStatus := func(code int, msg string) {
+		res.Header().Set("Grpc-Status", strconv.Itoa(code))
+		res.Header().Set("Grpc-Message", msg)
+	}
+
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(res, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if !isEnvoyAuthzCheckMethod(r.URL.Path) {
+		writeStatus(grpcStatusUnimplemented, "Unknown method")
+		return
+	}
+
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeStatus(grpcStatusInvalidArgument, err.Error())
+		return
+	}
+
+	check, err := parseEnvoyCheckRequest(msg)
+	if err != nil {
+		writeStatus(grpcStatusInvalidArgument, fmt.Sprintf("Invalid CheckRequest: %s", err))
+		return
+	}
+
+	authReq, err := check.HTTPRequest()
+	if err != nil {
+		writeStatus(grpcStatusInvalidArgument, fmt.Sprintf("Invalid request attributes: %s", err))
+		return
+	}
+	defer context.Clear(authReq)
+	assignRequestID(authReq)
+
+	rec := &envoyAuthzRecorder{header: http.Header{}}
+	withIPFilter(withTracing("auth", instrumentAuthRequest(handleAuthRequest))).ServeHTTP(rec, authReq)
+
+	if err := writeGRPCMessage(res, rec.CheckResponse()); err != nil {
+		requestLog(r).WithError(err).Error("Unable to write gRPC response")
+		return
+	}
+	writeStatus(grpcStatusOK, "")
+}
+
+func isEnvoyAuthzCheckMethod(path string) bool {
+	for _, m := range envoyAuthzCheckMethods {
+		if path == m {
+			return true
+		}
+	}
+	return false
+}
+
+// readGRPCMessage reads a length-prefixed gRPC message
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("Unable to read message prefix: %s", err)
+	}
+
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("Compressed messages are not supported")
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("Unable to read message: %s", err)
+	}
+
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// listenEnvoyAuthz starts the gRPC listener for Envoy. As gRPC requires
+// HTTP/2 and the Go HTTP server only supports HTTP/2 using TLS the
+// listener requires a certificate.
+func listenEnvoyAuthz(e envoyAuthzConfig) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleEnvoyAuthzRequest)
+
+	srv := trackServer(&http.Server{Addr: e.Listen, Handler: mux})
+	log.WithField("addr", e.Listen).Info("Starting Envoy ext_authz gRPC listener")
+	if err := srv.ListenAndServeTLS(e.TLSCertFile, e.TLSKeyFile); err != http.ErrServerClosed {
+		log.WithError(err).Fatal("Envoy ext_authz gRPC listener failed")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEnvoyCheckRequest(t *testing.T) {
+	header := func(k, v string) protoMessage { return protoMessage{}.String(1, k).String(2, v) }
+
+	httpReq := protoMessage{}.
+		String(2, "POST").
+		Bytes(3, header(":authority", "app.example.com")).
+		Bytes(3, header("user-agent", "curl/7.58.0")).
+		String(4, "/api/v1/users?page=2").
+		String(5, "app.example.com").
+		String(6, "https")
+	socketAddr := protoMessage{}.String(2, "10.1.2.3").Varint(3, 54321)
+	source := protoMessage{}.Bytes(1, protoMessage{}.Bytes(1, socketAddr))
+	attrs := protoMessage{}.
+		Bytes(1, source).
+		Bytes(4, protoMessage{}.Bytes(2, httpReq))
+	msg := protoMessage{}.Bytes(1, attrs)
+
+	check, err := parseEnvoyCheckRequest(msg)
+	if err != nil {
+		t.Fatalf("Unable to parse CheckRequest: %s", err)
+	}
+
+	r, err := check.HTTPRequest()
+	if err != nil {
+		t.Fatalf("Unable to build request: %s", err)
+	}
+
+	for hdr, expected := range map[string]string{
+		"X-Host":            "app.example.com",
+		"X-Origin-URI":      "/api/v1/users?page=2",
+		"X-Origin-Method":   "POST",
+		"X-Forwarded-Proto": "https",
+		"User-Agent":        "curl/7.58.0",
+	} {
+		if v := r.Header.Get(hdr); v != expected {
+			t.Errorf("Expected header %s to be %q, got %q", hdr, expected, v)
+		}
+	}
+
+	if r.Header.Get(":authority") != "" {
+		t.Error("Pseudo header was passed")
+	}
+
+	if r.RemoteAddr != "10.1.2.3:0" {
+		t.Errorf("Unexpected remote address %q", r.RemoteAddr)
+	}
+}
+
+func TestEnvoyCheckResponse(t *testing.T) {
+	rec := &envoyAuthzRecorder{header: http.Header{}}
+	rec.Header().Set("X-Username", aclTestUser)
+	rec.WriteHeader(http.StatusOK)
+
+	// CheckResponse.status(1).code(1) and ok_response(3).headers(2).header(1)
+	status, err := protoSubMessage(rec.CheckResponse(), 1)
+	if err != nil {
+		t.Fatalf("Status missing: %s", err)
+	}
+	if fields, _ := parseProtoMessage(status); len(fields) != 1 || fields[0].Varint != grpcStatusOK {
+		t.Errorf("Unexpected status %#v", fields)
+	}
+
+	hv, err := protoSubMessage(rec.CheckResponse(), 3, 2, 1)
+	if err != nil {
+		t.Fatalf("Header missing: %s", err)
+	}
+	if fields, _ := parseProtoMessage(hv); len(fields) != 2 || string(fields[1].Bytes) != aclTestUser {
+		t.Errorf("Unexpected header %#v", fields)
+	}
+
+	rec = &envoyAuthzRecorder{header: http.Header{}}
+	rec.WriteHeader(http.StatusForbidden)
+
+	code, err := protoSubMessage(rec.CheckResponse(), 2, 1)
+	if err != nil {
+		t.Fatalf("Denied response missing: %s", err)
+	}
+	if fields, _ := parseProtoMessage(code); len(fields) != 1 || fields[0].Varint != http.StatusForbidden {
+		t.Errorf("Unexpected denied status %#v", fields)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/pongo2"
+)
+
+const errorPagePathPrefix = "/error/"
+
+// errorPageStatuses lists the status codes nginx can request a page for
+// using the error_page directive
+var errorPageStatuses = map[int]bool{
+	http.StatusForbidden:           true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// errorPageKind returns the suffix of the translated title and text of
+// the error page for the status code
+func errorPageKind(status int) string {
+	switch {
+	case status == http.StatusForbidden, status == http.StatusTooManyRequests:
+		return strconv.Itoa(status)
+	case status >= http.StatusInternalServerError:
+		return "5xx"
+	default:
+		return "4xx"
+	}
+}
+
+// renderErrorPage answers the request with the error.html template of
+// the frontend. The message is shown as additional information, host
+// and uri describe the request which failed if it was not a request to
+// nginx-sso itself.
+func renderErrorPage(res http.ResponseWriter, r *http.Request, status int, message, host, uri string) {
+	var (
+		lang     = getMainConfig().Frontend.Language(r)
+		messages = getMainConfig().Frontend.Translations(lang)
+		kind     = errorPageKind(status)
+	)
+
+	ctx := pongo2.Context{
+		"branding":    getMainConfig().Frontend.Branding(),
+		"csp_nonce":   cspNonce(r),
+		"host":        host,
+		"lang":        lang,
+		"login":       requestLoginSettings(r),
+		"message":     message,
+		"retry_after": res.Header().Get("Retry-After"),
+		"status":      status,
+		"t":           messages,
+		"text":        messages["error_page_text_"+kind],
+		"title":       messages["error_page_title_"+kind],
+		"uri":         uri,
+	}
+	if status == http.StatusForbidden {
+		if user, _, err := detectUser(res, r); err == nil {
+			ctx["user"] = user
+		}
+	}
+
+	tpl, err := getMainConfig().Frontend.Template("error.html")
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to load error page")
+		http.Error(res, message, status)
+		return
+	}
+
+	body, err := tpl.ExecuteBytes(ctx)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render error page")
+		http.Error(res, message, status)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+// handleErrorPageRequest serves the error pages for nginx: The page of
+// /error/403 shows the host and URI passed in the X-Host and
+// X-Origin-URI headers like for the auth request.
+func handleErrorPageRequest(res http.ResponseWriter, r *http.Request) {
+	status, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, errorPagePathPrefix))
+	if err != nil || !errorPageStatuses[status] {
+		http.NotFound(res, r)
+		return
+	}
+
+	var host string
+	if r.Header.Get("X-Host") != "" || r.Header.Get("X-Forwarded-Host") != "" {
+		host = requestHost(r)
+	}
+	renderErrorPage(res, r, status, "", host, requestURI(r))
+}
+
+// errorPageWriter replaces the plain text errors of the wrapped handler
+// by the error page
+type errorPageWriter struct {
+	http.ResponseWriter
+
+	status      int
+	message     bytes.Buffer
+	wroteHeader bool
+}
+
+func (e *errorPageWriter) WriteHeader(status int) {
+	if e.wroteHeader {
+		return
+	}
+	e.wroteHeader = true
+
+	// Only the responses of http.Error are replaced, JSON and custom
+	// responses are kept
+	if status >= http.StatusBadRequest && strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.status = status
+		return
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorPageWriter) Write(p []byte) (int, error) {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.status != 0 {
+		return e.message.Write(p)
+	}
+	return e.ResponseWriter.Write(p)
+}
+
+// withErrorPages renders the errors of the wrapped handler using the
+// error page for browsers
+func withErrorPages(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			h(res, r)
+			return
+		}
+
+		w := &errorPageWriter{ResponseWriter: res}
+		h(w, r)
+
+		if w.status != 0 {
+			renderErrorPage(res, r, w.status, strings.TrimSpace(w.message.String()), "", "")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	prev := getMainConfig().Frontend
+	defer func() { getMainConfig().Frontend = prev }()
+
+	getMainConfig().Frontend = frontendConfig{Title: "ACME SSO"}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/error/403", nil)
+	r.Header.Set("X-Host", "app.example.com")
+	r.Header.Set("X-Origin-URI", "/admin")
+	res := httptest.NewRecorder()
+	handleErrorPageRequest(res, r)
+	if res.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", res.Code)
+	}
+	for _, expect := range []string{"<title>ACME SSO</title>", "Access denied", "<code>app.example.com/admin</code>"} {
+		if !strings.Contains(res.Body.String(), expect) {
+			t.Errorf("Expected %q in error page", expect)
+		}
+	}
+
+	res = httptest.NewRecorder()
+	handleErrorPageRequest(res, httptest.NewRequest(http.MethodGet, "/error/503", nil))
+	if res.Code != http.StatusServiceUnavailable || !strings.Contains(res.Body.String(), "Something went wrong") {
+		t.Errorf("Expected 5xx page, got status %d", res.Code)
+	}
+
+	for _, path := range []string{"/error/200", "/error/404", "/error/abc", "/error/"} {
+		res = httptest.NewRecorder()
+		handleErrorPageRequest(res, httptest.NewRequest(http.MethodGet, path, nil))
+		if res.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 for %s, got %d", path, res.Code)
+		}
+	}
+
+	failing := withErrorPages(func(res http.ResponseWriter, r *http.Request) {
+		http.Error(res, "Redirect target is not allowed", http.StatusBadRequest)
+	})
+
+	r = httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	res = httptest.NewRecorder()
+	failing(res, r)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "Redirect target is not allowed</div>") {
+		t.Errorf("Expected error to be rendered as page, got status %d: %s", res.Code, res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	failing(res, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if ct := res.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected plain text error without HTML accept header, got %q", ct)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.Header.Set("Accept", "text/html")
+	res = httptest.NewRecorder()
+	withErrorPages(func(res http.ResponseWriter, r *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusUnauthorized)
+		res.Write([]byte(`{"status":"error"}`))
+	})(res, r)
+	if res.Body.String() != `{"status":"error"}` {
+		t.Errorf("Expected JSON response to be kept, got %q", res.Body.String())
+	}
+}
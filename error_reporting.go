@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	errorReportingAttempts = 3
+	errorReportingFiltered = "[Filtered]"
+	errorReportingSink     = "error reporting"
+	errorReportingTimeout  = 5 * time.Second
+)
+
+var (
+	// errorReportingSensitive matches names of headers, query parameters
+	// and log fields whose values must not leave the instance
+	errorReportingSensitive = regexp.MustCompile(`(?i)auth|cookie|key|pass|secret|session|signature|token`)
+
+	errorReportingClient = &http.Client{Timeout: errorReportingTimeout}
+
+	// activeRequests maps the request IDs of the requests being handled
+	// to the requests to add their context to reported errors
+	activeRequests     = map[string]*http.Request{}
+	activeRequestsLock sync.RWMutex
+
+	errorReportingQueues     = map[string]*deliveryQueue{}
+	errorReportingQueuesLock sync.Mutex
+)
+
+// errorReportingConfig sends logged errors and panics to a Sentry
+// compatible server
+type errorReportingConfig struct {
+	DSN         string `yaml:"dsn"`
+	Environment string `yaml:"environment"`
+	Release     string `yaml:"release"`
+}
+
+func (e errorReportingConfig) Enabled() bool { return e.DSN != "" }
+
+func (e errorReportingConfig) Validate() error {
+	if !e.Enabled() {
+		return nil
+	}
+
+	_, err := e.envelopeURL()
+	return err
+}
+
+// envelopeURL derives the endpoint and the public key from the DSN in
+// the format https://<key>@<host>[/<path>]/<project>
+func (e errorReportingConfig) envelopeURL() (string, error) {
+	u, err := url.Parse(e.DSN)
+	switch {
+	case err != nil:
+		return "", errors.Wrap(err, "Unable to parse DSN")
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", errors.New("DSN needs to use http or https")
+	case u.User == nil || u.User.Username() == "":
+		return "", errors.New("DSN needs a public key")
+	}
+
+	path := strings.Trim(u.Path, "/")
+	project := path[strings.LastIndex(path, "/")+1:]
+	if project == "" {
+		return "", errors.New("DSN needs a project ID")
+	}
+	prefix := strings.TrimSuffix(path, project)
+
+	return fmt.Sprintf("%s://%s/%sapi/%s/envelope/", u.Scheme, u.Host, prefix, project), nil
+}
+
+func (e errorReportingConfig) queue() *deliveryQueue {
+	errorReportingQueuesLock.Lock()
+	defer errorReportingQueuesLock.Unlock()
+
+	if q, ok := errorReportingQueues[e.DSN]; ok {
+		return q
+	}
+
+	q := newRetryingDeliveryQueue(errorReportingSink, 1, errorReportingAttempts, func(attempt int) time.Duration {
+		return time.Duration(attempt) * time.Second
+	}, e.Deliver)
+	errorReportingQueues[e.DSN] = q
+	return q
+}
+
+// Deliver sends the events wrapped into envelopes
+func (e errorReportingConfig) Deliver(events [][]byte) error {
+	target, err := e.envelopeURL()
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(e.DSN)
+
+	for _, event := range events {
+		var head struct {
+			EventID string `json:"event_id"`
+		}
+		json.Unmarshal(event, &head)
+
+		body := new(bytes.Buffer)
+		json.NewEncoder(body).Encode(map[string]string{
+			"event_id": head.EventID,
+			"sent_at":  time.Now().UTC().Format(time.RFC3339),
+		})
+		json.NewEncoder(body).Encode(map[string]interface{}{"type": "event", "length": len(event)})
+		body.Write(event)
+		body.WriteString("\n")
+
+		req, err := http.NewRequest(http.MethodPost, target, body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-sentry-envelope")
+		req.Header.Set("User-Agent", "nginx-sso/"+version)
+		req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=nginx-sso/%s, sentry_key=%s", version, u.User.Username()))
+
+		resp, err := errorReportingClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return errors.Errorf("Error reporting server responded with status %d", resp.StatusCode)
+		}
+	}
+
+	return nil
+}
+
+// errorReportingHook reports all entries logged with error level or
+// above to the configured server
+type errorReportingHook struct{}
+
+func (errorReportingHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (errorReportingHook) Fire(entry *log.Entry) error {
+	cfg := getMainConfig().ErrorReporting
+	if !cfg.Enabled() || entry.Data["sink"] == errorReportingSink {
+		// Failed deliveries must not be reported again
+		return nil
+	}
+
+	event, err := json.Marshal(cfg.event(entry))
+	if err != nil {
+		return err
+	}
+
+	if entry.Level <= log.FatalLevel {
+		// The process exits after the hooks, the queue would be lost
+		return cfg.Deliver([][]byte{event})
+	}
+
+	return cfg.queue().Write(event)
+}
+
+func (e errorReportingConfig) event(entry *log.Entry) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	release := e.Release
+	if release == "" {
+		release = "nginx-sso@" + version
+	}
+
+	level := entry.Level.String()
+	if entry.Level <= log.FatalLevel {
+		level = "fatal"
+	}
+
+	event := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": entry.Time.UTC().Format(time.RFC3339Nano),
+		"level":     level,
+		"logger":    "nginx-sso",
+		"platform":  "go",
+		"release":   release,
+		"message":   map[string]string{"formatted": entry.Message},
+		"extra":     scrubLogFields(entry.Data),
+	}
+
+	if e.Environment != "" {
+		event["environment"] = e.Environment
+	}
+	if host, err := os.Hostname(); err == nil {
+		event["server_name"] = host
+	}
+
+	exception := map[string]interface{}{
+		"type":       entry.Message,
+		"value":      entry.Message,
+		"stacktrace": map[string]interface{}{"frames": errorReportingFrames()},
+	}
+	if err, ok := entry.Data[log.ErrorKey].(error); ok {
+		exception["value"] = err.Error()
+	}
+	if p, ok := entry.Data["panic"]; ok {
+		exception["type"] = "panic"
+		exception["value"] = fmt.Sprint(p)
+	}
+	event["exception"] = map[string]interface{}{"values": []interface{}{exception}}
+
+	if id, ok := entry.Data["request_id"].(string); ok {
+		event["tags"] = map[string]string{"request_id": id}
+
+		activeRequestsLock.RLock()
+		r := activeRequests[id]
+		activeRequestsLock.RUnlock()
+
+		if r != nil {
+			event["request"] = scrubbedRequest(r)
+		}
+	}
+
+	return event
+}
+
+// errorReportingFrames returns the stack of the logging goroutine,
+// oldest call first, without the frames of the logger and the hook
+func errorReportingFrames() []map[string]interface{} {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	out := []map[string]interface{}{}
+	for {
+		f, more := frames.Next()
+		if !strings.Contains(f.Function, "sirupsen/logrus") && !strings.Contains(f.Function, "errorReporting") {
+			out = append([]map[string]interface{}{{
+				"function": f.Function,
+				"abs_path": f.File,
+				"lineno":   f.Line,
+				"in_app":   strings.HasPrefix(f.Function, "main."),
+			}}, out...)
+		}
+		if !more {
+			break
+		}
+	}
+
+	return out
+}
+
+func scrubLogFields(fields log.Fields) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range fields {
+		switch {
+		case errorReportingSensitive.MatchString(k):
+			v = errorReportingFiltered
+		case k == log.ErrorKey:
+			v = fmt.Sprint(v)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// scrubbedRequest returns the request context of the event without
+// credentials: Sensitive headers and query parameters are filtered, the
+// body and the client IP are never sent.
+func scrubbedRequest(r *http.Request) map[string]interface{} {
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		value := strings.Join(values, ", ")
+		switch {
+		case errorReportingSensitive.MatchString(name):
+			value = errorReportingFiltered
+		case strings.EqualFold(name, "X-Origin-URI"):
+			value = scrubURI(value)
+		}
+		headers[name] = value
+	}
+
+	return map[string]interface{}{
+		"method":       r.Method,
+		"url":          "http://" + r.Host + r.URL.Path,
+		"query_string": scrubQuery(r.URL.RawQuery),
+		"headers":      headers,
+	}
+}
+
+func scrubURI(uri string) string {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return uri
+	}
+	return uri[:i+1] + scrubQuery(uri[i+1:])
+}
+
+func scrubQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return errorReportingFiltered
+	}
+
+	for k := range values {
+		if errorReportingSensitive.MatchString(k) {
+			values[k] = []string{errorReportingFiltered}
+		}
+	}
+	return values.Encode()
+}
+
+// withErrorReporting keeps track of the request to add its context to
+// errors logged while handling it and responds with status 500 instead
+// of dropping the connection on panics
+func withErrorReporting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		id := getRequestID(r)
+		if id != "" && getMainConfig().ErrorReporting.Enabled() {
+			activeRequestsLock.Lock()
+			activeRequests[id] = r
+			activeRequestsLock.Unlock()
+
+			defer func() {
+				activeRequestsLock.Lock()
+				delete(activeRequests, id)
+				activeRequestsLock.Unlock()
+			}()
+		}
+
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				requestLog(r).WithField("panic", p).Error("Panic while handling request")
+				http.Error(res, "Internal Server Error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(res, r)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+var (
+	eventSubscribers     []eventSubscriber
+	eventSubscribersLock sync.RWMutex
+)
+
+// authEvent describes a step in the lifecycle of an authentication like
+// a login, logout, denied request or created session. The handlers only
+// publish the events, the audit log, webhooks and metrics subscribe to
+// them on their own.
+type authEvent struct {
+	Type    auditEvent
+	Request *http.Request
+	// User is empty if the user is not known yet like for failed logins
+	User     string
+	Provider string
+	// Result is the outcome of the step, for example the reason of a
+	// failed login, and is used as the label of the metrics
+	Result string
+	// Fields are added to the audit log entry
+	Fields map[string]string
+}
+
+// eventSubscriber is called for every published event. Subscribers are
+// called synchronously in the order they subscribed and must not block.
+type eventSubscriber func(authEvent)
+
+// subscribeEvents adds a subscriber to the event bus, subscribers are
+// registered during the package initialization
+func subscribeEvents(s eventSubscriber) {
+	eventSubscribersLock.Lock()
+	defer eventSubscribersLock.Unlock()
+
+	eventSubscribers = append(eventSubscribers, s)
+}
+
+// publishEvent passes the event to all subscribers
+func publishEvent(e authEvent) {
+	eventSubscribersLock.RLock()
+	defer eventSubscribersLock.RUnlock()
+
+	for _, s := range eventSubscribers {
+		s(e)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestEventBus(t *testing.T) {
+	var (
+		events    []authEvent
+		lock      sync.Mutex
+		recording = true
+	)
+	subscribeEvents(func(e authEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		if recording {
+			events = append(events, e)
+		}
+	})
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		recording = false
+	}()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	prevAuthenticators := getAuthenticatorSnapshot()
+	defer authenticatorState.Store(prevAuthenticators)
+	setAuthenticators([]authenticator{&authSimple{Users: map[string]string{"alice": string(hash)}}})
+
+	m := mainConfig{}
+	m.Cookie.AuthKey = "cookie-key-for-the-event-bus-test"
+	if err := cookieStore.Configure(&m); err != nil {
+		t.Fatalf("Unable to configure cookie store: %s", err)
+	}
+
+	login := func(password string) loginOutcome {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{
+			"simple-username": {"alice"},
+			"simple-password": {password},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return attemptLogin(httptest.NewRecorder(), r, false)
+	}
+
+	if o := login("wrong"); o.Status != loginStatusInvalidCredentials {
+		t.Fatalf("Expected login to fail, got %s", o.Status)
+	}
+	if o := login("secret"); o.Status != loginStatusSuccess {
+		t.Fatalf("Expected login to succeed, got %s", o.Status)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var types []string
+	for _, e := range events {
+		types = append(types, string(e.Type))
+	}
+	if strings.Join(types, ",") != "login_failure,session_created,login_success" {
+		t.Fatalf("Unexpected events %v", types)
+	}
+
+	if e := events[0]; e.Result != "invalid_credentials" || e.Fields["reason"] != "invalid credentials" {
+		t.Errorf("Expected result and reason of the failed login, got %#v", e)
+	}
+	if e := events[1]; e.User != "alice" || e.Provider != "simple" || e.Fields["remember"] != "false" {
+		t.Errorf("Expected created session of alice, got %#v", e)
+	}
+	if e := events[2]; e.User != "alice" || e.Provider != "simple" || e.Result != "success" {
+		t.Errorf("Expected login of alice, got %#v", e)
+	}
+}
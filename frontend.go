@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+// frontendTemplateNames lists the pages rendered by nginx-sso
+var frontendTemplateNames = []string{"device.html", "embedded_login.html", "error.html", "index.html", "login_confirm.html", "logout.html", "password.html", "register.html", "reset.html", "sessions.html", "terms.html", "tokens.html"}
+
+// embeddedFrontend contains the default templates used for all files not
+// present in the frontend directory
+//
+//go:embed frontend
+var embeddedFrontend embed.FS
+
+// frontendConfig brands the embedded frontend and points to a directory
+// of templates, static assets and translations overriding it file by
+// file
+type frontendConfig struct {
+	Directory       string `yaml:"directory"`
+	DefaultLanguage string `yaml:"default_language"`
+
+	Title        string               `yaml:"title"`
+	LogoURL      string               `yaml:"logo_url"`
+	LogoFile     string               `yaml:"logo_file"`
+	PrimaryColor string               `yaml:"primary_color"`
+	FooterLinks  []frontendFooterLink `yaml:"footer_links"`
+
+	templates    *pongo2.TemplateSet
+	pages        map[string]*pongo2.Template
+	translations map[string]map[string]string
+	assets       map[string]*frontendAsset
+	logo         *frontendAsset
+}
+
+// directory returns the configured directory or the one passed on the
+// commandline
+func (f frontendConfig) directory() string {
+	if f.Directory != "" {
+		return f.Directory
+	}
+	return cfg.TemplateDir
+}
+
+// Load checks the directory, compiles the templates, reads the
+// translations and the static assets to reject broken overrides on load
+// instead of failing the requests and to serve them from memory
+func (f *frontendConfig) Load() error {
+	if f.Directory != "" {
+		if stat, err := os.Stat(f.Directory); err != nil {
+			return errors.Wrap(err, "Unable to access directory")
+		} else if !stat.IsDir() {
+			return errors.Errorf("%q is not a directory", f.Directory)
+		}
+	}
+
+	if err := f.validateBranding(); err != nil {
+		return err
+	}
+
+	f.templates = pongo2.NewSet("frontend", frontendLoader{dir: f.directory()})
+	f.pages = map[string]*pongo2.Template{}
+	for _, name := range frontendTemplateNames {
+		tpl, err := f.templates.FromCache(name)
+		if err != nil {
+			return errors.Wrapf(err, "Template %s is invalid", name)
+		}
+		f.pages[name] = tpl
+	}
+
+	var err error
+	if f.assets, err = loadFrontendAssets(f.directory()); err != nil {
+		return err
+	}
+	if f.LogoFile != "" {
+		if f.logo, err = loadFrontendLogo(f.LogoFile); err != nil {
+			return err
+		}
+	}
+
+	return f.loadTranslations()
+}
+
+// Template returns the compiled template from the directory or the
+// embedded frontend
+func (f frontendConfig) Template(name string) (*pongo2.Template, error) {
+	if f.templates == nil {
+		return nil, errors.New("Frontend is not loaded")
+	}
+	if tpl, ok := f.pages[name]; ok {
+		return tpl, nil
+	}
+	return f.templates.FromCache(name)
+}
+
+// frontendLoader reads the templates from the directory and falls back
+// to the embedded frontend for files not present in it
+type frontendLoader struct {
+	dir string
+}
+
+// Abs resolves all names relative to the frontend root, also the ones
+// included or extended from other templates
+func (frontendLoader) Abs(base, name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+func (f frontendLoader) Get(name string) (io.Reader, error) {
+	if f.dir != "" {
+		content, err := ioutil.ReadFile(filepath.Join(f.dir, filepath.FromSlash(name)))
+		switch {
+		case err == nil:
+			return bytes.NewReader(content), nil
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	content, err := embeddedFrontend.ReadFile(path.Join("frontend", name))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(content), nil
+}
+
+// handleStaticRequest serves the files below /static/ of the frontend
+// directory or the embedded frontend read on load
+func handleStaticRequest(res http.ResponseWriter, r *http.Request) {
+	asset, ok := getMainConfig().Frontend.assets[path.Clean(r.URL.Path)]
+	if !ok {
+		// Directory listings are not served
+		http.NotFound(res, r)
+		return
+	}
+
+	asset.ServeHTTP(res, r)
+}
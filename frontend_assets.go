@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+// frontendAssetCompressMaxSize limits the files compressed on load,
+// larger files are served uncompressed
+const frontendAssetCompressMaxSize = 4 << 20
+
+// frontendAsset is a static file served from memory together with its
+// precompressed variants
+type frontendAsset struct {
+	name        string
+	contentType string
+	modTime     time.Time
+	etag        string
+
+	content []byte
+	brotli  []byte
+	gzip    []byte
+}
+
+func newFrontendAsset(name string, content []byte, modTime time.Time) (*frontendAsset, error) {
+	sum := sha256.Sum256(content)
+	a := &frontendAsset{
+		name:        name,
+		contentType: mime.TypeByExtension(path.Ext(name)),
+		modTime:     modTime,
+		etag:        base64.RawURLEncoding.EncodeToString(sum[:12]),
+		content:     content,
+	}
+
+	if a.contentType == "" {
+		a.contentType = http.DetectContentType(content)
+	}
+
+	if len(content) > frontendAssetCompressMaxSize {
+		return a, nil
+	}
+
+	// Variants are only kept if they are smaller than the file, already
+	// compressed images and fonts are served as they are
+	var buf bytes.Buffer
+	bw := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := bw.Write(content); err != nil {
+		return nil, errors.Wrap(err, "Unable to compress using brotli")
+	}
+	if err := bw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Unable to compress using brotli")
+	}
+	if buf.Len() < len(content) {
+		a.brotli = append([]byte(nil), buf.Bytes()...)
+	}
+
+	buf.Reset()
+	gw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := gw.Write(content); err != nil {
+		return nil, errors.Wrap(err, "Unable to compress using gzip")
+	}
+	if err := gw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Unable to compress using gzip")
+	}
+	if buf.Len() < len(content) {
+		a.gzip = append([]byte(nil), buf.Bytes()...)
+	}
+
+	return a, nil
+}
+
+// ServeHTTP sends the variant accepted by the client, requests sending
+// the ETag of the variant are answered with 304
+func (a *frontendAsset) ServeHTTP(res http.ResponseWriter, r *http.Request) {
+	body, etag := a.content, a.etag
+	accept := r.Header.Get("Accept-Encoding")
+	switch {
+	case a.brotli != nil && acceptsEncoding(accept, "br"):
+		body, etag = a.brotli, etag+"-br"
+		res.Header().Set("Content-Encoding", "br")
+	case a.gzip != nil && acceptsEncoding(accept, "gzip"):
+		body, etag = a.gzip, etag+"-gzip"
+		res.Header().Set("Content-Encoding", "gzip")
+	}
+
+	if a.brotli != nil || a.gzip != nil {
+		res.Header().Add("Vary", "Accept-Encoding")
+	}
+	res.Header().Set("Content-Type", a.contentType)
+	res.Header().Set("ETag", strconv.Quote(etag))
+	// Clients revalidate the files as they change on configuration reloads
+	res.Header().Set("Cache-Control", "no-cache")
+
+	http.ServeContent(res, r, a.name, a.modTime, bytes.NewReader(body))
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header explicitly
+// lists the encoding without rejecting it using q=0
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if k != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// loadFrontendAssets reads the files below static/ of the embedded
+// frontend and the directory overriding them
+func loadFrontendAssets(dir string) (map[string]*frontendAsset, error) {
+	assets := map[string]*frontendAsset{}
+
+	add := func(fsys fs.FS, root string) error {
+		return fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil && name == root && errors.Is(err, fs.ErrNotExist):
+				return fs.SkipDir
+			case err != nil:
+				return err
+			case d.IsDir():
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			content, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return err
+			}
+
+			key := "/static" + strings.TrimPrefix(name, root)
+			if assets[key], err = newFrontendAsset(key, content, info.ModTime()); err != nil {
+				return errors.Wrapf(err, "Unable to load %s", name)
+			}
+			return nil
+		})
+	}
+
+	if err := add(embeddedFrontend, "frontend/static"); err != nil {
+		return nil, errors.Wrap(err, "Unable to read embedded assets")
+	}
+	if dir != "" {
+		if err := add(os.DirFS(dir), "static"); err != nil {
+			return nil, errors.Wrap(err, "Unable to read static assets")
+		}
+	}
+
+	return assets, nil
+}
+
+// loadFrontendLogo reads the logo_file to serve it from memory
+func loadFrontendLogo(file string) (*frontendAsset, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read logo_file")
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read logo_file")
+	}
+	return newFrontendAsset(filepath.Base(file), content, info.ModTime())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFrontendPrimaryColor = "darkcyan"
+	frontendLogoPath            = "/branding/logo"
+)
+
+// frontendColor restricts the primary color to values which are safe to
+// be inserted into the stylesheet of the pages: Hex codes and names
+var frontendColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+type frontendFooterLink struct {
+	Title string `yaml:"title"`
+	URL   string `yaml:"url"`
+}
+
+// frontendBranding is passed to the templates as branding, an empty
+// title is replaced by the title of the login form
+type frontendBranding struct {
+	Title        string
+	Logo         string
+	PrimaryColor string
+	FooterLinks  []frontendFooterLink
+}
+
+func (f frontendConfig) validateBranding() error {
+	switch {
+	case f.LogoURL != "" && f.LogoFile != "":
+		return errors.New("Only one of logo_url and logo_file can be set")
+	case f.PrimaryColor != "" && !frontendColor.MatchString(f.PrimaryColor):
+		return errors.Errorf("Primary color %q needs to be a hex code or a color name", f.PrimaryColor)
+	}
+
+	if f.LogoURL != "" {
+		if err := validateFrontendLink(f.LogoURL); err != nil {
+			return errors.Wrap(err, "Invalid logo URL")
+		}
+	}
+
+	if f.LogoFile != "" {
+		if stat, err := os.Stat(f.LogoFile); err != nil {
+			return errors.Wrap(err, "Unable to access logo file")
+		} else if stat.IsDir() {
+			return errors.Errorf("Logo file %q is a directory", f.LogoFile)
+		}
+	}
+
+	for i, l := range f.FooterLinks {
+		if l.Title == "" {
+			return errors.Errorf("Footer link #%d has no title", i+1)
+		}
+		if err := validateFrontendLink(l.URL); err != nil {
+			return errors.Wrapf(err, "Footer link #%d is invalid", i+1)
+		}
+	}
+
+	return nil
+}
+
+// validateFrontendLink only allows links to web pages and mails to
+// prevent script URLs from being injected into the pages
+func validateFrontendLink(link string) error {
+	u, err := url.Parse(link)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme == "" && strings.HasPrefix(link, "/") && !strings.HasPrefix(link, "//"):
+		return nil
+	case u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto":
+		return nil
+	}
+	return errors.Errorf("URL %q needs to use http, https or mailto or be a path", link)
+}
+
+// Branding returns the settings for the templates
+func (f frontendConfig) Branding() frontendBranding {
+	b := frontendBranding{
+		Title:        f.Title,
+		Logo:         f.LogoURL,
+		PrimaryColor: f.PrimaryColor,
+		FooterLinks:  f.FooterLinks,
+	}
+
+	if f.LogoFile != "" {
+		b.Logo = frontendLogoPath
+	}
+	if b.PrimaryColor == "" {
+		b.PrimaryColor = defaultFrontendPrimaryColor
+	}
+
+	return b
+}
+
+func handleBrandingLogoRequest(res http.ResponseWriter, r *http.Request) {
+	if getMainConfig().Frontend.logo == nil {
+		http.NotFound(res, r)
+		return
+	}
+
+	getMainConfig().Frontend.logo.ServeHTTP(res, r)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/flosch/pongo2"
+)
+
+func TestFrontendOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-frontend")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"index.html":          `{% include "partials/title.html" %}`,
+		"partials/title.html": `<h1>{{ login.Title }}</h1>`,
+		"static/logo.svg":     `<svg></svg>`,
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %s", name, err)
+		}
+	}
+
+	prev := getMainConfig().Frontend
+	defer func() { getMainConfig().Frontend = prev }()
+
+	getMainConfig().Frontend = frontendConfig{Directory: dir}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	tpl, err := getMainConfig().Frontend.Template("index.html")
+	if err != nil {
+		t.Fatalf("Unable to get template: %s", err)
+	}
+	if out, _ := tpl.Execute(pongo2.Context{"login": map[string]string{"Title": "ACME"}}); out != "<h1>ACME</h1>" {
+		t.Errorf("Expected overridden template, got %q", out)
+	}
+
+	tpl, err = getMainConfig().Frontend.Template("sessions.html")
+	if err != nil {
+		t.Fatalf("Unable to get template: %s", err)
+	}
+	if out, _ := tpl.Execute(pongo2.Context{}); !strings.Contains(out, "Sign out everywhere") {
+		t.Error("Expected embedded template to be used as fallback")
+	}
+
+	for path, expect := range map[string]int{
+		"/static/logo.svg":         http.StatusOK,
+		"/static/missing.css":      http.StatusNotFound,
+		"/static/":                 http.StatusNotFound,
+		"/static/../index.html":    http.StatusNotFound,
+		"/static/../../etc/passwd": http.StatusNotFound,
+	} {
+		res := httptest.NewRecorder()
+		handleStaticRequest(res, httptest.NewRequest(http.MethodGet, path, nil))
+		if res.Code != expect {
+			t.Errorf("Expected status %d for %s, got %d", expect, path, res.Code)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "tokens.html"), []byte(`{% if %}`), 0644); err != nil {
+		t.Fatalf("Unable to write template: %s", err)
+	}
+	if err := (&frontendConfig{Directory: dir}).Load(); err == nil {
+		t.Error("Expected broken template to be rejected")
+	}
+}
+
+func TestFrontendBranding(t *testing.T) {
+	logo, err := ioutil.TempFile("", "nginx-sso-logo")
+	if err != nil {
+		t.Fatalf("Unable to create logo: %s", err)
+	}
+	defer os.Remove(logo.Name())
+	logo.WriteString(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`)
+	logo.Close()
+
+	for name, f := range map[string]frontendConfig{
+		"both logos":      {LogoURL: "https://example.com/logo.png", LogoFile: logo.Name()},
+		"script color":    {PrimaryColor: "red;}</style><script>"},
+		"script link":     {FooterLinks: []frontendFooterLink{{Title: "Help", URL: "javascript:alert(1)"}}},
+		"untitled link":   {FooterLinks: []frontendFooterLink{{URL: "/help"}}},
+		"protocol url":    {LogoURL: "//example.com/logo.png"},
+		"missing logo":    {LogoFile: logo.Name() + ".missing"},
+		"directory logo":  {LogoFile: os.TempDir()},
+		"relative footer": {FooterLinks: []frontendFooterLink{{Title: "Help", URL: "help"}}},
+	} {
+		if err := f.Load(); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+
+	prev, prevAuthenticators := getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().Frontend = prev
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{}})
+
+	getMainConfig().Frontend = frontendConfig{
+		Title:        "ACME SSO",
+		LogoFile:     logo.Name(),
+		PrimaryColor: "#1d4ed8",
+		FooterLinks: []frontendFooterLink{
+			{Title: "Imprint", URL: "https://example.com/imprint"},
+			{Title: "Help", URL: "mailto:help@example.com"},
+		},
+	}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	res := httptest.NewRecorder()
+	handleLoginRequest(res, httptest.NewRequest(http.MethodGet, "/login", nil))
+	for _, expect := range []string{
+		"<title>ACME SSO</title>",
+		"background-color: #1d4ed8;",
+		`<img src="/branding/logo"`,
+		`<a href="https://example.com/imprint">Imprint</a>`,
+		`<a href="mailto:help@example.com">Help</a>`,
+	} {
+		if !strings.Contains(res.Body.String(), expect) {
+			t.Errorf("Expected %q in login page", expect)
+		}
+	}
+
+	res = httptest.NewRecorder()
+	handleBrandingLogoRequest(res, httptest.NewRequest(http.MethodGet, frontendLogoPath, nil))
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "<svg") {
+		t.Errorf("Expected logo to be served, got status %d", res.Code)
+	}
+}
+
+func TestFrontendAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-frontend")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	style := strings.Repeat("body { margin: 0; padding: 0; }\n", 100)
+	noise := make([]byte, 512)
+	rand.Read(noise)
+
+	os.MkdirAll(filepath.Join(dir, "static"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "static", "style.css"), []byte(style), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "static", "noise.bin"), noise, 0644)
+
+	prev := getMainConfig().Frontend
+	defer func() { getMainConfig().Frontend = prev }()
+
+	getMainConfig().Frontend = frontendConfig{Directory: dir}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	// Changes are only picked up on reload
+	ioutil.WriteFile(filepath.Join(dir, "static", "style.css"), []byte("changed"), 0644)
+
+	request := func(path, acceptEncoding, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		res := httptest.NewRecorder()
+		handleStaticRequest(res, r)
+		return res
+	}
+
+	decode := map[string]func(io.Reader) (io.Reader, error){
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	}
+
+	etags := map[string]bool{}
+	for accept, encoding := range map[string]string{
+		"":                  "",
+		"gzip, deflate, br": "br",
+		"gzip":              "gzip",
+		"br;q=0, gzip;q=1":  "gzip",
+		"identity":          "",
+	} {
+		res := request("/static/style.css", accept, "")
+		if res.Code != http.StatusOK || res.Header().Get("Content-Encoding") != encoding {
+			t.Errorf("Expected %q encoding for %q, got %d %q", encoding, accept, res.Code, res.Header().Get("Content-Encoding"))
+			continue
+		}
+		if !strings.HasPrefix(res.Header().Get("Content-Type"), "text/css") || res.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Unexpected headers %v", res.Header())
+		}
+
+		body, err := decode[encoding](res.Body)
+		if err != nil {
+			t.Fatalf("Unable to decode %q: %s", encoding, err)
+		}
+		if content, _ := ioutil.ReadAll(body); string(content) != style {
+			t.Errorf("Expected %q body to match the file", encoding)
+		}
+
+		etag := res.Header().Get("ETag")
+		etags[etag] = true
+		if res := request("/static/style.css", accept, etag); res.Code != http.StatusNotModified {
+			t.Errorf("Expected %q to be revalidated, got status %d", etag, res.Code)
+		}
+	}
+	if len(etags) != 3 {
+		t.Errorf("Expected one ETag per encoding, got %v", etags)
+	}
+
+	// Incompressible files are served as they are
+	res := request("/static/noise.bin", "br, gzip", "")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Encoding") != "" || !bytes.Equal(res.Body.Bytes(), noise) {
+		t.Errorf("Expected uncompressed file, got %d %q", res.Code, res.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const geoIPDefaultReloadInterval = time.Minute
+
+type geoIPConfig struct {
+	Database       string        `yaml:"database"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type geoIPDatabase struct {
+	config  geoIPConfig
+	modTime time.Time
+	reader  *mmdbReader
+	stop    chan struct{}
+
+	lock sync.RWMutex
+}
+
+var (
+	activeGeoIP      *geoIPDatabase
+	activeGeoIPMutex sync.Mutex
+)
+
+// initializeGeoIP opens the configured database and starts watching it
+// for changes. A previously opened database is closed.
+func initializeGeoIP(c geoIPConfig) error {
+	activate, err := prepareGeoIP(c)
+	if err != nil {
+		return err
+	}
+	activate()
+	return nil
+}
+
+// prepareGeoIP opens the configured database without replacing the
+// active one, the returned function activates it
+func prepareGeoIP(c geoIPConfig) (func(), error) {
+	activeGeoIPMutex.Lock()
+	defer activeGeoIPMutex.Unlock()
+
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = geoIPDefaultReloadInterval
+	}
+
+	if activeGeoIP != nil && activeGeoIP.config == c {
+		// Keep the watched database, only pick up a changed file
+		return func() {}, activeGeoIP.reload()
+	}
+
+	var db *geoIPDatabase
+	if c.Database != "" {
+		db = &geoIPDatabase{config: c, stop: make(chan struct{})}
+		if err := db.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() {
+		activeGeoIPMutex.Lock()
+		defer activeGeoIPMutex.Unlock()
+
+		if activeGeoIP != nil {
+			close(activeGeoIP.stop)
+		}
+		if db != nil {
+			go db.watch()
+		}
+		activeGeoIP = db
+	}, nil
+}
+
+// reload opens the database file if it was modified since it was
+// opened the last time
+func (g *geoIPDatabase) reload() error {
+	stat, err := os.Stat(g.config.Database)
+	if err != nil {
+		return errors.Wrap(err, "Unable to access GeoIP database")
+	}
+
+	g.lock.RLock()
+	unchanged := g.reader != nil && stat.ModTime().Equal(g.modTime)
+	g.lock.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	reader, err := openMMDB(g.config.Database)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open GeoIP database")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.reader = reader
+	g.modTime = stat.ModTime()
+
+	log.WithFields(log.Fields{
+		"database": g.config.Database,
+		"type":     reader.dbType,
+	}).Debug("Loaded GeoIP database")
+
+	return nil
+}
+
+func (g *geoIPDatabase) watch() {
+	t := time.NewTicker(g.config.ReloadInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-t.C:
+			if err := g.reload(); err != nil {
+				log.WithError(err).Error("Unable to reload GeoIP database, keeping previous version")
+			}
+		}
+	}
+}
+
+// Country returns the ISO code of the country the IP is located in
+// and an empty string if the IP is not contained in the database
+func (g *geoIPDatabase) Country(ip string) (string, error) {
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil {
+		return "", nil
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	record, err := g.reader.Lookup(addr)
+	if err != nil {
+		return "", err
+	}
+
+	// Prefer the country the IP is located in over the registered one
+	for _, key := range []string{"country", "registered_country"} {
+		if code := mmdbPath(record, key, "iso_code"); code != "" {
+			return code, nil
+		}
+	}
+
+	return "", nil
+}
+
+// geoIPCountry looks up the country of the client IP in the active
+// database. Errors are logged and result in an empty country to make
+// rules on the country not apply.
+func geoIPCountry(ip string) string {
+	activeGeoIPMutex.Lock()
+	db := activeGeoIP
+	activeGeoIPMutex.Unlock()
+
+	if db == nil {
+		return ""
+	}
+
+	country, err := db.Country(ip)
+	if err != nil {
+		log.WithError(err).WithField("ip", ip).Error("Unable to look up GeoIP country")
+		return ""
+	}
+
+	return country
+}
+
+func mmdbPath(record interface{}, keys ...string) string {
+	for _, k := range keys {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		record = m[k]
+	}
+
+	s, _ := record.(string)
+	return s
+}
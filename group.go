@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/go_helpers/str"
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/pkg/errors"
+)
+
+type groupProvider interface {
+	// GroupProviderID needs to return an unique string to identify
+	// this special group provider
+	GroupProviderID() (id string)
+
+	// Configure loads the configuration for the group provider from the
+	// global config.yaml file which is passed as a byte-slice.
+	// If no configuration for the group provider is supplied the function
+	// needs to return the errProviderUnconfigured
+	Configure(yamlSource []byte) (err error)
+
+	// GetUserGroups resolves the groups of the user detected by the
+	// given authenticator. If the user is not known to the group
+	// provider an empty list needs to be returned.
+	GetUserGroups(user, authenticatorID string) (groups []string, err error)
+}
+
+// groupCacheInvalidator is implemented by group providers caching the
+// groups of the users themselves to remove them through the admin API
+type groupCacheInvalidator interface {
+	InvalidateUserGroups(user string)
+}
+
+var (
+	groupProviderRegistry      = []groupProvider{}
+	groupProviderRegistryMutex sync.RWMutex
+
+	activeGroupProviders = []groupProvider{}
+)
+
+func registerGroupProvider(g groupProvider) {
+	groupProviderRegistryMutex.Lock()
+	defer groupProviderRegistryMutex.Unlock()
+
+	groupProviderRegistry = append(groupProviderRegistry, g)
+}
+
+// configureGroupProviders configures new instances of all registered
+// group providers, they need to be activated using setGroupProviders
+func configureGroupProviders(yamlSource []byte) ([]groupProvider, error) {
+	groupProviderRegistryMutex.RLock()
+	registry := groupProviderRegistry
+	groupProviderRegistryMutex.RUnlock()
+
+	tmp := []groupProvider{}
+	for _, proto := range registry {
+		g := auth.NewInstance(proto).(groupProvider)
+		err := g.Configure(yamlSource)
+
+		switch {
+		case err == nil:
+			tmp = append(tmp, g)
+			log.WithFields(log.Fields{"group_provider": g.GroupProviderID()}).Debug("Activated group provider")
+		case errors.Is(err, errProviderUnconfigured):
+			log.WithFields(log.Fields{"group_provider": g.GroupProviderID()}).Debug("Group provider unconfigured")
+			// This is okay.
+		default:
+			return nil, fmt.Errorf("Group provider configuration caused an error: %s", err)
+		}
+	}
+
+	return tmp, nil
+}
+
+func setGroupProviders(g []groupProvider) {
+	groupProviderRegistryMutex.Lock()
+	defer groupProviderRegistryMutex.Unlock()
+
+	activeGroupProviders = g
+}
+
+// resolveGroups merges the groups returned by the authenticator with
+// the groups of all group providers active for the request
+func resolveGroups(r *http.Request, user, authenticatorID string, groups []string) ([]string, error) {
+	groupProviderRegistryMutex.RLock()
+	defer groupProviderRegistryMutex.RUnlock()
+
+	result := append([]string{}, groups...)
+
+	providers := requestGroupProviders(r)
+	if len(providers) == 0 {
+		return result, nil
+	}
+
+	extra, stale, ok := getMainConfig().GroupCache.Get(r, user, authenticatorID)
+	switch {
+	case stale:
+		getMainConfig().GroupCache.Refresh(r, user, authenticatorID, providers)
+	case !ok:
+		var err error
+		if extra, err = lookupGroups(r.Context(), providers, user, authenticatorID); err != nil {
+			return nil, err
+		}
+		getMainConfig().GroupCache.Set(r, user, authenticatorID, extra)
+	}
+
+	for _, group := range extra {
+		if !str.StringInSlice(group, result) {
+			result = append(result, group)
+		}
+	}
+
+	return result, nil
+}
+
+// lookupGroups asks the group providers for the groups of the user
+func lookupGroups(ctx context.Context, providers []groupProvider, user, authenticatorID string) ([]string, error) {
+	extra := []string{}
+	for _, g := range providers {
+		release, err := acquireProvider(ctx, g.GroupProviderID())
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to resolve groups using %q", g.GroupProviderID())
+		}
+		groups, err := g.GetUserGroups(user, authenticatorID)
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve groups using %q: %s", g.GroupProviderID(), err)
+		}
+
+		for _, group := range groups {
+			if !str.StringInSlice(group, extra) {
+				extra = append(extra, group)
+			}
+		}
+	}
+	return extra, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const groupCacheKeyPrefix = "nginx-sso:group-cache:"
+
+var (
+	// groupCacheStores keeps the stores by their URI to keep the cached
+	// groups across reloads
+	groupCacheStores     = map[string]groupCacheStore{}
+	groupCacheStoresLock sync.Mutex
+
+	// groupCacheRefreshes runs one background refresh per user and scope
+	groupCacheRefreshes singleflight.Group
+)
+
+// groupCacheConfig enables caching the groups resolved by the group
+// providers for every user to not query them for every request. Groups
+// older than the TTL are served for up to the StaleTTL while they are
+// resolved again in the background.
+type groupCacheConfig struct {
+	TTL      time.Duration `yaml:"ttl"`
+	StaleTTL time.Duration `yaml:"stale_ttl"`
+	Store    string        `yaml:"store"`
+}
+
+func (g groupCacheConfig) Validate() error {
+	if g.TTL < 0 {
+		return errors.New("TTL must not be negative")
+	}
+	if g.StaleTTL < 0 {
+		return errors.New("Stale TTL must not be negative")
+	}
+
+	if g.Store == "" || g.Store == "memory" {
+		return nil
+	}
+
+	_, err := parseRedisURI(g.Store)
+	return err
+}
+
+// groupCacheEntry holds the groups of an user by the realm and the
+// authenticator which detected the user as the group providers may
+// resolve different groups for them
+type groupCacheEntry struct {
+	Scopes map[string]groupCacheScope `json:"scopes"`
+}
+
+type groupCacheScope struct {
+	Realm         string    `json:"realm"`
+	Authenticator string    `json:"authenticator"`
+	Groups        []string  `json:"groups"`
+	Stale         time.Time `json:"stale"`
+	Expires       time.Time `json:"expires"`
+}
+
+// isStale reports whether the groups need to be refreshed, entries
+// cached without stale time are stale when they expire
+func (s groupCacheScope) isStale(now time.Time) bool {
+	if s.Stale.IsZero() {
+		return !s.Expires.After(now)
+	}
+	return !s.Stale.After(now)
+}
+
+func (g groupCacheConfig) key(user string) string {
+	sum := sha256.Sum256([]byte(getCacheSalt() + "\x00" + user))
+	return groupCacheKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+func groupCacheScopeKey(realm, authenticatorID string) string {
+	return realm + "\x00" + authenticatorID
+}
+
+// Get returns the groups cached for the user detected by the given
+// authenticator in the realm of the request. Groups older than the TTL
+// are returned as stale until the stale_ttl passed.
+func (g groupCacheConfig) Get(r *http.Request, user, authenticatorID string) (groups []string, stale, ok bool) {
+	if g.TTL <= 0 {
+		return nil, false, false
+	}
+
+	e, err := g.entry(user)
+	if err != nil {
+		metricGroupCacheLookups.Inc("error")
+		requestLog(r).WithError(err).Error("Unable to read groups from cache")
+		return nil, false, false
+	}
+
+	now := time.Now()
+	s, ok := e.Scopes[groupCacheScopeKey(getRealmName(r), authenticatorID)]
+	switch {
+	case !ok || s.Expires.Before(now):
+		metricGroupCacheLookups.Inc("miss")
+		return nil, false, false
+	case s.isStale(now):
+		metricGroupCacheLookups.Inc("stale")
+		return s.Groups, true, true
+	}
+
+	metricGroupCacheLookups.Inc("hit")
+	return s.Groups, false, true
+}
+
+// Set caches the groups resolved for the user detected by the given
+// authenticator in the realm of the request
+func (g groupCacheConfig) Set(r *http.Request, user, authenticatorID string, groups []string) {
+	if g.TTL <= 0 {
+		return
+	}
+
+	if err := g.set(g.key(user), getRealmName(r), authenticatorID, groups); err != nil {
+		requestLog(r).WithError(err).Error("Unable to cache groups")
+	}
+}
+
+func (g groupCacheConfig) set(key, realm, authenticatorID string, groups []string) error {
+	store, err := getGroupCacheStore(getMainConfig().Cluster.storeFor(g.Store))
+	if err != nil {
+		return err
+	}
+
+	e, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		e = &groupCacheEntry{}
+	}
+
+	now := time.Now()
+	scopes := map[string]groupCacheScope{}
+	for k, s := range e.Scopes {
+		if s.Expires.After(now) {
+			scopes[k] = s
+		}
+	}
+	scopes[groupCacheScopeKey(realm, authenticatorID)] = groupCacheScope{
+		Realm:         realm,
+		Authenticator: authenticatorID,
+		Groups:        groups,
+		Stale:         now.Add(g.TTL),
+		Expires:       now.Add(g.TTL + g.StaleTTL),
+	}
+	e.Scopes = scopes
+
+	return store.Set(key, *e, g.TTL+g.StaleTTL)
+}
+
+// Refresh resolves the stale groups of the user again in the background
+// while the request is served the stale groups. Only one refresh per
+// user and scope runs at a time, if it fails the stale groups are kept
+// until they expire.
+func (g groupCacheConfig) Refresh(r *http.Request, user, authenticatorID string, providers []groupProvider) {
+	var (
+		key   = g.key(user)
+		realm = getRealmName(r)
+	)
+
+	go groupCacheRefreshes.Do(key+"\x00"+groupCacheScopeKey(realm, authenticatorID), func() (interface{}, error) {
+		logger := log.WithFields(log.Fields{"user": user, "authenticator": authenticatorID, "realm": realm})
+
+		groups, err := lookupGroups(context.Background(), providers, user, authenticatorID)
+		if err != nil {
+			logger.WithError(err).Warn("Unable to refresh cached groups, keeping stale groups")
+			return nil, err
+		}
+
+		if err := g.set(key, realm, authenticatorID, groups); err != nil {
+			logger.WithError(err).Error("Unable to cache groups")
+		}
+		return nil, nil
+	})
+}
+
+// List returns the groups cached for the user, ordered by realm and
+// authenticator
+func (g groupCacheConfig) List(user string) ([]groupCacheScope, error) {
+	e, err := g.entry(user)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []groupCacheScope{}
+	for _, s := range e.Scopes {
+		if s.Expires.After(time.Now()) {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return groupCacheScopeKey(out[i].Realm, out[i].Authenticator) < groupCacheScopeKey(out[j].Realm, out[j].Authenticator)
+	})
+
+	return out, nil
+}
+
+// Invalidate removes the cached groups of the user, including the ones
+// cached by the group providers themselves
+func (g groupCacheConfig) Invalidate(user string) error {
+	groupProviderRegistryMutex.RLock()
+	providers := append([]groupProvider{}, activeGroupProviders...)
+	groupProviderRegistryMutex.RUnlock()
+
+	activeRealmsLock.RLock()
+	for _, rl := range activeRealms {
+		providers = append(providers, rl.groupProviders...)
+	}
+	activeRealmsLock.RUnlock()
+
+	for _, p := range providers {
+		if c, ok := p.(groupCacheInvalidator); ok {
+			c.InvalidateUserGroups(user)
+		}
+	}
+
+	store, err := getGroupCacheStore(getMainConfig().Cluster.storeFor(g.Store))
+	if err != nil {
+		return err
+	}
+	return store.Delete(g.key(user))
+}
+
+func (g groupCacheConfig) entry(user string) (*groupCacheEntry, error) {
+	store, err := getGroupCacheStore(getMainConfig().Cluster.storeFor(g.Store))
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := store.Get(g.key(user))
+	if err != nil || e == nil {
+		return &groupCacheEntry{}, err
+	}
+	return e, nil
+}
+
+type groupCacheStore interface {
+	// Get returns the entry of the key or nil if it is not cached
+	Get(key string) (*groupCacheEntry, error)
+
+	// Set stores the entry for the given time
+	Set(key string, e groupCacheEntry, ttl time.Duration) error
+
+	// Delete removes the entry of the key
+	Delete(key string) error
+}
+
+func getGroupCacheStore(store string) (groupCacheStore, error) {
+	groupCacheStoresLock.Lock()
+	defer groupCacheStoresLock.Unlock()
+
+	if s, ok := groupCacheStores[store]; ok {
+		return s, nil
+	}
+
+	var s groupCacheStore
+	if store == "" || store == "memory" {
+		s = newMemoryGroupCacheStore()
+	} else {
+		c, err := getRedisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		s = redisGroupCacheStore{c}
+	}
+
+	groupCacheStores[store] = s
+	return s, nil
+}
+
+type memoryGroupCacheEntry struct {
+	entry   groupCacheEntry
+	expires time.Time
+}
+
+type memoryGroupCacheStore struct {
+	entries map[string]memoryGroupCacheEntry
+	lock    sync.Mutex
+}
+
+func newMemoryGroupCacheStore() *memoryGroupCacheStore {
+	m := &memoryGroupCacheStore{entries: map[string]memoryGroupCacheEntry{}}
+	go m.cleanup()
+	return m
+}
+
+func (m *memoryGroupCacheStore) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for key, e := range m.entries {
+			if e.expires.Before(time.Now()) {
+				delete(m.entries, key)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *memoryGroupCacheStore) Get(key string) (*groupCacheEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.expires.Before(time.Now()) {
+		return nil, nil
+	}
+	return &e.entry, nil
+}
+
+func (m *memoryGroupCacheStore) Set(key string, e groupCacheEntry, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.entries[key] = memoryGroupCacheEntry{entry: e, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryGroupCacheStore) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// redisGroupCacheStore keeps the entries as JSON in Redis to share the
+// cached groups between all instances using the same Redis
+type redisGroupCacheStore struct {
+	client *redisClient
+}
+
+func (r redisGroupCacheStore) Get(key string) (*groupCacheEntry, error) {
+	reply, err := r.client.Do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return nil, errors.Errorf("Unexpected reply %v", reply)
+	}
+
+	e := &groupCacheEntry{}
+	if err := json.Unmarshal([]byte(data), e); err != nil {
+		return nil, errors.Wrap(err, "Unable to decode entry")
+	}
+	return e, nil
+}
+
+func (r redisGroupCacheStore) Set(key string, e groupCacheEntry, ttl time.Duration) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Do("SET", key, string(data), "PX", strconv.Itoa(int(ttl/time.Millisecond)))
+	return err
+}
+
+func (r redisGroupCacheStore) Delete(key string) error {
+	_, err := r.client.Do("DEL", key)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type testCountingGroupProvider struct {
+	lookups, invalidations int
+}
+
+func (t *testCountingGroupProvider) GroupProviderID() string           { return "counting" }
+func (t *testCountingGroupProvider) Configure(yamlSource []byte) error { return nil }
+func (t *testCountingGroupProvider) InvalidateUserGroups(user string)  { t.invalidations++ }
+
+func (t *testCountingGroupProvider) GetUserGroups(user, authenticatorID string) ([]string, error) {
+	t.lookups++
+	return []string{"staff"}, nil
+}
+
+// testRefreshingGroupProvider returns a group named after the number of
+// the lookup and fails while failing is set
+type testRefreshingGroupProvider struct {
+	lookups, failing int32
+}
+
+func (t *testRefreshingGroupProvider) GroupProviderID() string           { return "refreshing" }
+func (t *testRefreshingGroupProvider) Configure(yamlSource []byte) error { return nil }
+func (t *testRefreshingGroupProvider) InvalidateUserGroups(user string)  {}
+
+func (t *testRefreshingGroupProvider) GetUserGroups(user, authenticatorID string) ([]string, error) {
+	n := atomic.AddInt32(&t.lookups, 1)
+	if atomic.LoadInt32(&t.failing) == 1 {
+		return nil, errors.New("directory unavailable")
+	}
+	return []string{"lookup-" + strconv.Itoa(int(n))}, nil
+}
+
+func TestGroupCache(t *testing.T) {
+	g := &testCountingGroupProvider{}
+
+	prevProviders, prevCfg := activeGroupProviders, getMainConfig().GroupCache
+	setGroupProviders([]groupProvider{g})
+	getMainConfig().GroupCache = groupCacheConfig{TTL: time.Minute}
+	defer func() {
+		setGroupProviders(prevProviders)
+		getMainConfig().GroupCache = prevCfg
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	for i := 0; i < 3; i++ {
+		groups, err := resolveGroups(r, "alice", "simple", []string{"admins"})
+		if err != nil || len(groups) != 2 || groups[1] != "staff" {
+			t.Fatalf("Expected groups to be merged, got %v: %v", groups, err)
+		}
+	}
+	if g.lookups != 1 {
+		t.Errorf("Expected the groups to be resolved once, got %d lookups", g.lookups)
+	}
+
+	// Users detected by other authenticators may have other groups
+	resolveGroups(r, "alice", "token", nil)
+	resolveGroups(r, "bob", "simple", nil)
+	if g.lookups != 3 {
+		t.Errorf("Expected other users and authenticators to be resolved, got %d lookups", g.lookups)
+	}
+
+	if scopes, err := getMainConfig().GroupCache.List("alice"); err != nil || len(scopes) != 2 || scopes[0].Authenticator != "simple" {
+		t.Errorf("Expected cached groups of both authenticators, got %v: %v", scopes, err)
+	}
+
+	if err := getMainConfig().GroupCache.Invalidate("alice"); err != nil {
+		t.Fatalf("Unable to invalidate groups: %s", err)
+	}
+	if g.invalidations != 1 {
+		t.Errorf("Expected the group provider to be invalidated, got %d invalidations", g.invalidations)
+	}
+	resolveGroups(r, "alice", "simple", nil)
+	resolveGroups(r, "bob", "simple", nil)
+	if g.lookups != 4 {
+		t.Errorf("Expected only the invalidated user to be resolved again, got %d lookups", g.lookups)
+	}
+}
+
+func TestGroupCacheStale(t *testing.T) {
+	g := &testRefreshingGroupProvider{}
+
+	prevProviders, prevCfg := activeGroupProviders, getMainConfig().GroupCache
+	setGroupProviders([]groupProvider{g})
+	getMainConfig().GroupCache = groupCacheConfig{TTL: 50 * time.Millisecond, StaleTTL: 150 * time.Millisecond}
+	defer func() {
+		setGroupProviders(prevProviders)
+		getMainConfig().GroupCache = prevCfg
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	resolve := func() string {
+		groups, err := resolveGroups(r, "carol", "simple", nil)
+		if err != nil || len(groups) != 1 {
+			return "error"
+		}
+		return groups[0]
+	}
+	waitLookups := func(n int32) {
+		for atomic.LoadInt32(&g.lookups) < n {
+			time.Sleep(time.Millisecond)
+		}
+		// Give the refresh the time to store its result
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if groups := resolve(); groups != "lookup-1" {
+		t.Fatalf("Expected groups to be resolved, got %s", groups)
+	}
+
+	// Stale groups are served while they are refreshed in the background
+	time.Sleep(60 * time.Millisecond)
+	if groups := resolve(); groups != "lookup-1" {
+		t.Errorf("Expected stale groups to be served, got %s", groups)
+	}
+	waitLookups(2)
+	if groups := resolve(); groups != "lookup-2" {
+		t.Errorf("Expected refreshed groups to be served, got %s", groups)
+	}
+
+	// Failing refreshes keep the stale groups until they expire
+	atomic.StoreInt32(&g.failing, 1)
+	time.Sleep(60 * time.Millisecond)
+	if groups := resolve(); groups != "lookup-2" {
+		t.Errorf("Expected stale groups to be served while the provider fails, got %s", groups)
+	}
+	waitLookups(3)
+
+	time.Sleep(150 * time.Millisecond)
+	if groups := resolve(); groups != "error" {
+		t.Errorf("Expected expired groups to not be served, got %s", groups)
+	}
+	if n := atomic.LoadInt32(&g.lookups); n != 4 {
+		t.Errorf("Expected expired groups to be resolved synchronously, got %d lookups", n)
+	}
+}
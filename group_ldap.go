@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/go_helpers/str"
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func init() {
+	registerGroupProvider(&groupLDAP{})
+}
+
+type groupLDAP struct {
+	authLDAP `yaml:",inline"`
+
+	Authenticators []string          `yaml:"authenticators"`
+	CacheTTL       time.Duration     `yaml:"cache_ttl"`
+	VirtualGroups  map[string]string `yaml:"virtual_groups"`
+
+	cache *groupLDAPCache
+}
+
+type groupLDAPCacheEntry struct {
+	expires time.Time
+	groups  []string
+}
+
+// groupLDAPCache holds the resolved groups of users to prevent querying
+// the directory for every request
+type groupLDAPCache struct {
+	entries map[string]groupLDAPCacheEntry
+	lock    sync.Mutex
+}
+
+func (c *groupLDAPCache) Get(user string) ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[user]
+	if !ok || e.expires.Before(time.Now()) {
+		delete(c.entries, user)
+		return nil, false
+	}
+
+	return e.groups, true
+}
+
+func (c *groupLDAPCache) Delete(user string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, user)
+}
+
+func (c *groupLDAPCache) Set(user string, groups []string, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[user] = groupLDAPCacheEntry{expires: time.Now().Add(ttl), groups: groups}
+}
+
+// GroupProviderID needs to return an unique string to identify
+// this special group provider
+func (g groupLDAP) GroupProviderID() string { return "ldap" }
+
+// Configure loads the configuration for the group provider from the
+// global config.yaml file which is passed as a byte-slice.
+// If no configuration for the group provider is supplied the function
+// needs to return the errProviderUnconfigured
+func (g *groupLDAP) Configure(yamlSource []byte) error {
+	envelope := struct {
+		GroupProviders struct {
+			LDAP *groupLDAP `yaml:"ldap"`
+		} `yaml:"group_providers"`
+	}{}
+
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+
+	if envelope.GroupProviders.LDAP == nil {
+		return errProviderUnconfigured
+	}
+
+	*g = *envelope.GroupProviders.LDAP
+	g.setDefaults()
+	g.configurePool()
+
+	for name, filter := range g.VirtualGroups {
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			return fmt.Errorf("Filter of virtual group %q is invalid: %s", name, err)
+		}
+	}
+
+	g.cache = &groupLDAPCache{entries: map[string]groupLDAPCacheEntry{}}
+
+	return nil
+}
+
+// GetUserGroups resolves the groups of the user detected by the
+// given authenticator. If the user is not known to the group
+// provider an empty list needs to be returned.
+func (g groupLDAP) GetUserGroups(user, authenticatorID string) ([]string, error) {
+	if len(g.Authenticators) > 0 && !str.StringInSlice(authenticatorID, g.Authenticators) {
+		return nil, nil
+	}
+
+	if groups, ok := g.cache.Get(user); ok {
+		return groups, nil
+	}
+
+	l, err := g.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	userDN, alias, err := g.searchUser(l, user, g.UsernameAttribute)
+	switch {
+	case err == nil:
+		// User found, resolve groups below
+	case errors.Is(err, errNoUser):
+		// User is not known in the directory
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	groups, err := g.getUserGroups(context.Background(), userDN, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, filter := range g.VirtualGroups {
+		member, err := g.matchesFilter(l, userDN, filter)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve virtual group %q: %s", name, err)
+		}
+
+		if member {
+			groups = append(groups, name)
+		}
+	}
+
+	if g.CacheTTL > 0 {
+		g.cache.Set(user, groups, g.CacheTTL)
+	}
+
+	return groups, nil
+}
+
+// InvalidateUserGroups removes the cached groups of the user
+func (g groupLDAP) InvalidateUserGroups(user string) {
+	g.cache.Delete(user)
+}
+
+// matchesFilter checks whether the directory entry of the user matches
+// the given LDAP filter
+func (g groupLDAP) matchesFilter(l *ldapPoolConn, userDN, filter string) (bool, error) {
+	sreq := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		filter,
+		[]string{"dn"},
+		nil,
+	)
+
+	sres, err := l.Search(sreq)
+	if err != nil {
+		return false, err
+	}
+
+	return len(sres.Entries) == 1, nil
+}
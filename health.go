@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const readinessCheckTimeout = 5 * time.Second
+
+// readinessChecker can be implemented by authenticators and group
+// providers depending on an external backend. CheckReadiness needs to
+// return an error if the backend is not reachable.
+type readinessChecker interface {
+	CheckReadiness() error
+}
+
+type readinessResult struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// collectReadinessCheckers returns the checkers of all active providers
+// implementing the readinessChecker interface, keyed by their kind and ID
+func collectReadinessCheckers() map[string]readinessChecker {
+	checkers := map[string]readinessChecker{}
+
+	for _, a := range getAuthenticatorSnapshot().active {
+		if c, ok := a.(readinessChecker); ok {
+			checkers["authenticator."+a.AuthenticatorID()] = c
+		}
+	}
+
+	groupProviderRegistryMutex.RLock()
+	for _, g := range activeGroupProviders {
+		if c, ok := g.(readinessChecker); ok {
+			checkers["group_provider."+g.GroupProviderID()] = c
+		}
+	}
+	groupProviderRegistryMutex.RUnlock()
+
+	if getMainConfig().Cluster.Enabled() {
+		checkers["cluster"] = clusterChecker{getMainConfig().Cluster.Store}
+	}
+
+	for name, c := range realmReadinessCheckers() {
+		checkers[name] = c
+	}
+
+	if isShuttingDown() {
+		checkers["shutdown"] = shutdownChecker{}
+	}
+
+	return checkers
+}
+
+// checkReadiness executes all checks in parallel. Checks not finishing
+// within the timeout are reported as failed.
+func checkReadiness(checkers map[string]readinessChecker, timeout time.Duration) readinessResult {
+	result := readinessResult{Status: "ok", Checks: map[string]string{}}
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+
+	for name, c := range checkers {
+		wg.Add(1)
+		go func(name string, c readinessChecker) {
+			defer wg.Done()
+
+			errC := make(chan error, 1)
+			go func() { errC <- c.CheckReadiness() }()
+
+			var err error
+			select {
+			case err = <-errC:
+			case <-time.After(timeout):
+				err = fmt.Errorf("Check timed out after %s", timeout)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if err != nil {
+				result.Status = "failed"
+				result.Checks[name] = err.Error()
+				return
+			}
+			result.Checks[name] = "ok"
+		}(name, c)
+	}
+
+	wg.Wait()
+
+	return result
+}
+
+// handleHealthzRequest reports the process is alive and serving requests
+func handleHealthzRequest(res http.ResponseWriter, r *http.Request) {
+	res.Header().Set("Cache-Control", "no-store")
+	http.Error(res, "OK", http.StatusOK)
+}
+
+// handleReadyzRequest reports whether all backends required to judge
+// requests are reachable
+func handleReadyzRequest(res http.ResponseWriter, r *http.Request) {
+	result := checkReadiness(collectReadinessCheckers(), readinessCheckTimeout)
+
+	status := http.StatusOK
+	if result.Status != "ok" {
+		status = http.StatusServiceUnavailable
+
+		failed := []string{}
+		for name, msg := range result.Checks {
+			if msg != "ok" {
+				failed = append(failed, name)
+			}
+		}
+		sort.Strings(failed)
+		requestLog(r).WithField("checks", failed).Warn("Readiness check failed")
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(result); err != nil {
+		requestLog(r).WithError(err).Error("Unable to encode readiness result")
+	}
+}
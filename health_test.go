@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type testReadinessChecker func() error
+
+func (t testReadinessChecker) CheckReadiness() error { return t() }
+
+func TestCheckReadiness(t *testing.T) {
+	ok := testReadinessChecker(func() error { return nil })
+	broken := testReadinessChecker(func() error { return errors.New("Connection refused") })
+	hanging := testReadinessChecker(func() error { time.Sleep(time.Second); return nil })
+
+	res := checkReadiness(map[string]readinessChecker{"ok": ok}, 100*time.Millisecond)
+	if res.Status != "ok" || res.Checks["ok"] != "ok" {
+		t.Errorf("Expected successful readiness, got %#v", res)
+	}
+
+	res = checkReadiness(map[string]readinessChecker{
+		"ok":      ok,
+		"broken":  broken,
+		"hanging": hanging,
+	}, 100*time.Millisecond)
+
+	if res.Status != "failed" {
+		t.Errorf("Expected failed readiness, got %q", res.Status)
+	}
+	if res.Checks["ok"] != "ok" {
+		t.Errorf("Expected working check to succeed, got %q", res.Checks["ok"])
+	}
+	if res.Checks["broken"] != "Connection refused" {
+		t.Errorf("Expected broken check to report its error, got %q", res.Checks["broken"])
+	}
+	if res.Checks["hanging"] == "ok" {
+		t.Errorf("Expected hanging check to time out")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/nginx-sso/pkg/script"
+)
+
+const (
+	hookStagePreAuth     = "pre_auth"
+	hookStagePostLogin   = "post_login"
+	hookStagePreResponse = "pre_response"
+
+	defaultHookTimeout = 5 * time.Second
+)
+
+// hookConfig calls a webhook or a script at one of the stages of the
+// authentication. The hook receives the request and the user as JSON
+// and can veto the decision, add groups and set headers.
+type hookConfig struct {
+	Stage   string            `yaml:"stage"`
+	URL     string            `yaml:"url"`
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	// Script is an inline Lua script receiving the input as global
+	// `input` and returning the result as table
+	Script  string        `yaml:"script"`
+	Timeout time.Duration `yaml:"timeout"`
+	// HTTPTransport names the transport used to call the webhook
+	HTTPTransport string `yaml:"http_transport"`
+	// FailOpen ignores errors of the hook instead of failing the request
+	FailOpen bool `yaml:"fail_open"`
+
+	script *script.Script
+}
+
+type hooksConfig []hookConfig
+
+// hookInput is passed to the hook, the request fields are the same as
+// the ones passed to OPA
+type hookInput struct {
+	Stage    string `json:"stage"`
+	Provider string `json:"provider,omitempty"`
+	opaInput
+}
+
+// hookResult is returned by the hook, an empty response keeps the
+// decision unchanged
+type hookResult struct {
+	Deny            bool              `json:"deny"`
+	Reason          string            `json:"reason"`
+	AddGroups       []string          `json:"add_groups"`
+	RequestHeaders  map[string]string `json:"request_headers"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+}
+
+// Validate checks the hooks and compiles their scripts
+func (h hooksConfig) Validate() error {
+	for i := range h {
+		if err := h[i].Validate(); err != nil {
+			return errors.Wrapf(err, "Hook #%d is invalid", i+1)
+		}
+	}
+	return nil
+}
+
+func (h *hookConfig) Validate() error {
+	switch h.Stage {
+	case hookStagePreAuth, hookStagePostLogin, hookStagePreResponse:
+	default:
+		return errors.Errorf("Unsupported stage %q, use pre_auth, post_login or pre_response", h.Stage)
+	}
+
+	targets := 0
+	for _, t := range []string{h.URL, h.Command, h.Script} {
+		if t != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return errors.New("Exactly one of url, command or script needs to be set")
+	}
+	if h.URL != "" {
+		// Same requirements as for the URLs of the audit webhooks
+		if err := (webhookConfig{URL: h.URL, Events: []string{string(auditEventValidate)}}).Validate(); err != nil {
+			return err
+		}
+	}
+	if h.Script != "" {
+		s, err := script.Compile("hook", h.Script)
+		if err != nil {
+			return err
+		}
+		h.script = s
+	}
+	if h.Timeout < 0 {
+		return errors.New("Timeout must not be negative")
+	}
+
+	return nil
+}
+
+// HasStage reports whether hooks are configured for the stage
+func (h hooksConfig) HasStage(stage string) bool {
+	for _, hook := range h {
+		if hook.Stage == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Run calls the hooks of the stage in the configured order, every hook
+// sees the groups added and request headers set by the hooks before it.
+// The first hook denying the request stops the chain.
+func (h hooksConfig) Run(r *http.Request, stage, user string, groups []string) (hookResult, error) {
+	result := hookResult{ResponseHeaders: map[string]string{}}
+	current := append([]string{}, groups...)
+
+	for i, hook := range h {
+		if hook.Stage != stage {
+			continue
+		}
+
+		in := hookInput{Stage: stage, opaInput: newOPAInput(user, current, r)}
+		if m, ok := getSessionMeta(r); ok {
+			in.Provider = m.Provider
+		}
+
+		res, err := hook.call(in)
+		if err != nil {
+			if hook.FailOpen {
+				requestLog(r).WithError(err).WithField("hook", i+1).Warn("Hook failed, ignoring it")
+				continue
+			}
+			return result, errors.Wrapf(err, "Hook #%d failed", i+1)
+		}
+
+		if res.Deny {
+			result.Deny, result.Reason = true, res.Reason
+			return result, nil
+		}
+
+		current = append(current, res.AddGroups...)
+		result.AddGroups = append(result.AddGroups, res.AddGroups...)
+		for k, v := range res.RequestHeaders {
+			r.Header.Set(k, v)
+		}
+		for k, v := range res.ResponseHeaders {
+			result.ResponseHeaders[k] = v
+		}
+	}
+
+	return result, nil
+}
+
+func (h hookConfig) call(in hookInput) (hookResult, error) {
+	result := hookResult{}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if h.script != nil {
+		return result, h.script.RunJSON(ctx, "input", in, &result)
+	}
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return result, errors.Wrap(err, "Unable to marshal hook input")
+	}
+
+	var out []byte
+	if h.URL != "" {
+		out, err = h.post(ctx, body)
+	} else {
+		out, err = h.exec(ctx, body)
+	}
+	if err != nil || len(bytes.TrimSpace(out)) == 0 {
+		return result, err
+	}
+
+	return result, errors.Wrap(json.Unmarshal(out, &result), "Unable to decode hook result")
+}
+
+// post sends the input to the webhook, signed the same way as the audit
+// webhooks if a secret is configured
+func (h hookConfig) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nginx-sso/"+version)
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if h.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(h.Secret, ts, body))
+	}
+
+	// The timeout is applied through the context
+	client := &http.Client{Transport: namedHTTPTransport(h.HTTPTransport)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to call hook")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		buf := new(bytes.Buffer)
+		_, err := buf.ReadFrom(resp.Body)
+		return buf.Bytes(), errors.Wrap(err, "Unable to read hook result")
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("Hook responded with unexpected status %d", resp.StatusCode)
+	}
+}
+
+// exec passes the input to the script on stdin and reads the result
+// from its stdout
+func (h hookConfig) exec(ctx context.Context, body []byte) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Errorf("Hook script failed: %s", msg)
+		}
+		return nil, errors.Wrap(err, "Hook script failed")
+	}
+
+	return out, nil
+}
+
+// applyHooks runs the hooks of an /auth stage and responds to the
+// request if it was denied or a hook failed. The returned groups
+// contain the groups added by the hooks.
+func applyHooks(res http.ResponseWriter, r *http.Request, stage, user string, groups []string) ([]string, bool) {
+	if !getMainConfig().Hooks.HasStage(stage) {
+		return groups, true
+	}
+
+	hook, err := getMainConfig().Hooks.Run(r, stage, user, groups)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to run hooks")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	for k, v := range hook.ResponseHeaders {
+		res.Header().Set(k, v)
+	}
+
+	if hook.Deny {
+		reason := hook.Reason
+		if reason == "" {
+			reason = "Access denied by hook"
+		}
+		publishEvent(authEvent{Type: auditEventAccessDenied, Request: r, User: user, Fields: map[string]string{"reason": reason}})
+		getMainConfig().AuthFailure.Respond(res, r, authFailureForbidden, user, http.StatusForbidden, reason)
+		return nil, false
+	}
+
+	return append(append([]string{}, groups...), hook.AddGroups...), true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	for name, h := range map[string]hookConfig{
+		"unknown stage":   {Stage: "post_logout", URL: "https://hooks.example.com/"},
+		"no target":       {Stage: hookStagePreAuth},
+		"url and command": {Stage: hookStagePreAuth, URL: "https://hooks.example.com/", Command: "/bin/true"},
+		"relative url":    {Stage: hookStagePreAuth, URL: "/hook"},
+	} {
+		if err := h.Validate(); err == nil {
+			t.Errorf("Expected hook with %s to be rejected", name)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		var in hookInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Stage != hookStagePreResponse || in.User != "alice" {
+			http.Error(res, "Unexpected input", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(res).Encode(hookResult{
+			AddGroups:       []string{"hooked"},
+			ResponseHeaders: map[string]string{"X-Hooked": "yes"},
+		})
+	}))
+	defer srv.Close()
+
+	prevHooks, prevFailure := getMainConfig().Hooks, getMainConfig().AuthFailure
+	defer func() { getMainConfig().Hooks, getMainConfig().AuthFailure = prevHooks, prevFailure }()
+	getMainConfig().AuthFailure = nil
+
+	getMainConfig().Hooks = hooksConfig{
+		{Stage: hookStagePreAuth, URL: srv.URL + "/broken", FailOpen: true},
+		{Stage: hookStagePreResponse, URL: srv.URL},
+	}
+	if err := getMainConfig().Hooks.Validate(); err != nil {
+		t.Fatalf("Unable to validate hooks: %s", err)
+	}
+
+	res := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	if _, ok := applyHooks(res, r, hookStagePreAuth, "", nil); !ok {
+		t.Errorf("Expected failing hook with fail_open to be ignored, got %d", res.Code)
+	}
+
+	groups, ok := applyHooks(res, r, hookStagePreResponse, "alice", []string{"users"})
+	if !ok || len(groups) != 2 || groups[1] != "hooked" || res.Header().Get("X-Hooked") != "yes" {
+		t.Errorf("Expected hook to add the group and header, got %v", groups)
+	}
+
+	// The next hook in the chain sees the added group and vetoes
+	getMainConfig().Hooks = append(getMainConfig().Hooks, hookConfig{
+		Stage:   hookStagePreResponse,
+		Command: "sh",
+		Args:    []string{"-c", `grep -q '"hooked"' && echo '{"deny": true, "reason": "Hooked users are blocked"}'`},
+	})
+	res = httptest.NewRecorder()
+	if _, ok := applyHooks(res, r, hookStagePreResponse, "alice", []string{"users"}); ok || res.Code != http.StatusForbidden {
+		t.Errorf("Expected request to be denied, got %d", res.Code)
+	}
+
+	// Failing hooks without fail_open fail the request
+	getMainConfig().Hooks = hooksConfig{{Stage: hookStagePostLogin, Command: "sh", Args: []string{"-c", "exit 1"}}}
+	if _, err := getMainConfig().Hooks.Run(r, hookStagePostLogin, "alice", nil); err == nil {
+		t.Error("Expected failing hook to return an error")
+	}
+}
+
+func TestHookScript(t *testing.T) {
+	prevHooks := getMainConfig().Hooks
+	defer func() { getMainConfig().Hooks = prevHooks }()
+	getMainConfig().Hooks = hooksConfig{{Stage: hookStagePreResponse, Script: strings.Join([]string{
+		`if input.headers["x-tenant"] == "blocked" then return { deny = true } end`,
+		`return { add_groups = { "tenant-" .. input.headers["x-tenant"] }, response_headers = { ["X-User"] = input.user } }`,
+	}, "\n")}}
+	if err := getMainConfig().Hooks.Validate(); err != nil {
+		t.Fatalf("Unable to validate hooks: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Tenant", "acme")
+	res, err := getMainConfig().Hooks.Run(r, hookStagePreResponse, "alice", []string{"users"})
+	if err != nil || len(res.AddGroups) != 1 || res.AddGroups[0] != "tenant-acme" || res.ResponseHeaders["X-User"] != "alice" {
+		t.Errorf("Expected script to add the group and header, got %#v %v", res, err)
+	}
+
+	r.Header.Set("X-Tenant", "blocked")
+	if res, err := getMainConfig().Hooks.Run(r, hookStagePreResponse, "alice", nil); err != nil || !res.Deny {
+		t.Errorf("Expected script to deny the request, got %#v %v", res, err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHTTPTransport = "default"
+
+	httpTransportDefaultDialTimeout         = 10 * time.Second
+	httpTransportDefaultKeepAlive           = 30 * time.Second
+	httpTransportDefaultIdleConnTimeout     = 90 * time.Second
+	httpTransportDefaultMaxIdleConns        = 100
+	httpTransportDefaultMaxIdleConnsPerHost = 16
+	httpTransportDefaultTLSHandshakeTimeout = 10 * time.Second
+
+	httpTransportProxyNone = "none"
+)
+
+var (
+	// httpTransports keeps the transports by their name, transports
+	// with an unchanged configuration are kept on reload to not close
+	// their connections
+	httpTransports     = map[string]*sharedHTTPTransport{}
+	httpTransportsLock sync.RWMutex
+)
+
+func init() {
+	// Outbound calls without their own transport (like the Crowd client
+	// and all clients not setting a transport) use the default transport
+	http.DefaultTransport = namedHTTPTransport(defaultHTTPTransport)
+}
+
+// httpTransportConfig tunes the connections of a transport shared by
+// all outbound calls referencing it by its name
+type httpTransportConfig struct {
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`
+	KeepAlive             time.Duration `yaml:"keep_alive"`
+	MaxConnsPerHost       int           `yaml:"max_conns_per_host"`
+	MaxIdleConns          int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"`
+	Proxy                 string        `yaml:"proxy"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+}
+
+func (t httpTransportConfig) Validate() error {
+	switch {
+	case t.DialTimeout < 0, t.IdleConnTimeout < 0, t.KeepAlive < 0, t.ResponseHeaderTimeout < 0, t.TLSHandshakeTimeout < 0:
+		return errors.New("Timeouts must not be negative")
+	case t.MaxConnsPerHost < 0, t.MaxIdleConns < 0, t.MaxIdleConnsPerHost < 0:
+		return errors.New("Connection limits must not be negative")
+	}
+
+	_, err := t.proxy()
+	return err
+}
+
+func (t httpTransportConfig) withDefaults() httpTransportConfig {
+	if t.DialTimeout == 0 {
+		t.DialTimeout = httpTransportDefaultDialTimeout
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = httpTransportDefaultIdleConnTimeout
+	}
+	if t.KeepAlive == 0 {
+		t.KeepAlive = httpTransportDefaultKeepAlive
+	}
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = httpTransportDefaultMaxIdleConns
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = httpTransportDefaultMaxIdleConnsPerHost
+	}
+	if t.TLSHandshakeTimeout == 0 {
+		t.TLSHandshakeTimeout = httpTransportDefaultTLSHandshakeTimeout
+	}
+	return t
+}
+
+// proxy returns the proxy function of the transport: Without a proxy
+// the environment (HTTPS_PROXY, NO_PROXY, ...) is used, "none" connects
+// directly
+func (t httpTransportConfig) proxy() (func(*http.Request) (*url.URL, error), error) {
+	switch t.Proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case httpTransportProxyNone:
+		return nil, nil
+	}
+
+	u, err := url.Parse(t.Proxy)
+	switch {
+	case err != nil:
+		return nil, errors.Wrap(err, "Unable to parse proxy URL")
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5":
+		return nil, errors.New("Proxy needs to use http, https or socks5")
+	case u.Host == "":
+		return nil, errors.New("Proxy URL needs a host")
+	}
+	return http.ProxyURL(u), nil
+}
+
+func (t httpTransportConfig) newTransport() *http.Transport {
+	t = t.withDefaults()
+	proxy, _ := t.proxy() // Validated on load
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   t.DialTimeout,
+			KeepAlive: t.KeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		IdleConnTimeout:       t.IdleConnTimeout,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   t.TLSHandshakeTimeout,
+	}
+}
+
+type httpTransportsConfig map[string]httpTransportConfig
+
+func (h httpTransportsConfig) Validate() error {
+	for name, t := range h {
+		if err := t.Validate(); err != nil {
+			return errors.Wrapf(err, "Transport %q is invalid", name)
+		}
+	}
+	return nil
+}
+
+// Has reports whether the transport can be referenced, the default
+// transport is always available
+func (h httpTransportsConfig) Has(name string) bool {
+	_, ok := h[name]
+	return ok || name == "" || name == defaultHTTPTransport
+}
+
+// validateHTTPTransports checks the transports and the references to
+// them
+func (m *mainConfig) validateHTTPTransports() error {
+	if err := m.HTTPTransports.Validate(); err != nil {
+		return err
+	}
+
+	for i, h := range m.Hooks {
+		if !m.HTTPTransports.Has(h.HTTPTransport) {
+			return errors.Errorf("Hook #%d references unknown transport %q", i+1, h.HTTPTransport)
+		}
+	}
+	for i, w := range m.Webhooks {
+		if !m.HTTPTransports.Has(w.HTTPTransport) {
+			return errors.Errorf("Webhook #%d references unknown transport %q", i+1, w.HTTPTransport)
+		}
+	}
+
+	return nil
+}
+
+type sharedHTTPTransport struct {
+	cfg       httpTransportConfig
+	transport *http.Transport
+}
+
+// setHTTPTransports activates the configured transports. Transports
+// removed or changed by the configuration close their idle connections,
+// requests in flight finish on the previous transport.
+func setHTTPTransports(h httpTransportsConfig) {
+	httpTransportsLock.Lock()
+	defer httpTransportsLock.Unlock()
+
+	configs := httpTransportsConfig{defaultHTTPTransport: {}}
+	for name, cfg := range h {
+		configs[name] = cfg
+	}
+
+	next := map[string]*sharedHTTPTransport{}
+	for name, cfg := range configs {
+		if t, ok := httpTransports[name]; ok && t.cfg == cfg {
+			next[name] = t
+			continue
+		}
+		next[name] = &sharedHTTPTransport{cfg: cfg, transport: cfg.newTransport()}
+	}
+
+	for name, t := range httpTransports {
+		if next[name] != t {
+			t.transport.CloseIdleConnections()
+		}
+	}
+	httpTransports = next
+}
+
+// getHTTPTransport returns the transport with the given name, unknown
+// names and the empty name return the default transport
+func getHTTPTransport(name string) *http.Transport {
+	if name == "" {
+		name = defaultHTTPTransport
+	}
+
+	httpTransportsLock.RLock()
+	t, ok := httpTransports[name]
+	if !ok {
+		t, ok = httpTransports[defaultHTTPTransport]
+	}
+	httpTransportsLock.RUnlock()
+
+	if ok {
+		return t.transport
+	}
+
+	httpTransportsLock.Lock()
+	defer httpTransportsLock.Unlock()
+
+	// Without a configured default transport it is created using the
+	// defaults on first use and kept until it is configured
+	if t, ok := httpTransports[defaultHTTPTransport]; ok {
+		return t.transport
+	}
+	t = &sharedHTTPTransport{transport: httpTransportConfig{}.newTransport()}
+	httpTransports[defaultHTTPTransport] = t
+	return t.transport
+}
+
+// namedHTTPTransport is a http.RoundTripper using the transport of the
+// name active at the time of the request
+type namedHTTPTransport string
+
+func (n namedHTTPTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return getHTTPTransport(string(n)).RoundTrip(r)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHTTPTransports(t *testing.T) {
+	defer setHTTPTransports(nil)
+
+	setHTTPTransports(httpTransportsConfig{"idp": {MaxIdleConnsPerHost: 32}})
+	def, idp := getHTTPTransport(""), getHTTPTransport("idp")
+	if def == idp || idp.MaxIdleConnsPerHost != 32 || def.MaxIdleConnsPerHost != httpTransportDefaultMaxIdleConnsPerHost {
+		t.Fatalf("Expected configured transports, got default %d and idp %d idle connections per host", def.MaxIdleConnsPerHost, idp.MaxIdleConnsPerHost)
+	}
+	if getHTTPTransport("unknown") != def {
+		t.Error("Expected unknown transports to use the default transport")
+	}
+
+	// Unchanged transports keep their connections on reload
+	setHTTPTransports(httpTransportsConfig{"idp": {MaxIdleConnsPerHost: 32}, "hooks": {IdleConnTimeout: time.Minute}})
+	if getHTTPTransport("") != def || getHTTPTransport("idp") != idp {
+		t.Error("Expected unchanged transports to be kept")
+	}
+
+	setHTTPTransports(httpTransportsConfig{"idp": {MaxIdleConnsPerHost: 8}})
+	if getHTTPTransport("idp") == idp || getHTTPTransport("hooks") != def {
+		t.Error("Expected changed transports to be replaced and removed ones to use the default")
+	}
+
+	m := &mainConfig{
+		HTTPTransports: httpTransportsConfig{"idp": {}},
+		Hooks:          hooksConfig{{HTTPTransport: "idp"}, {HTTPTransport: "hooks"}},
+	}
+	if err := m.validateHTTPTransports(); err == nil {
+		t.Error("Expected reference to unknown transport to be rejected")
+	}
+	if err := (httpTransportConfig{Proxy: "ftp://proxy"}).Validate(); err == nil {
+		t.Error("Expected unsupported proxy to be rejected")
+	}
+}
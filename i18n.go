@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultLanguage     = "en"
+	translationsDirName = "translations"
+)
+
+// loadTranslations reads the bundled translations and merges the files
+// of the translations directory within the frontend directory key by
+// key into them. Every language falls back to the messages of the
+// default language and to English for missing keys.
+func (f *frontendConfig) loadTranslations() error {
+	raw := map[string]map[string]string{}
+
+	read := func(name string, content []byte) error {
+		lang := strings.ToLower(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+
+		messages := map[string]string{}
+		if err := yaml.Unmarshal(content, &messages); err != nil {
+			return errors.Wrapf(err, "Unable to parse translation %s", name)
+		}
+
+		if raw[lang] == nil {
+			raw[lang] = map[string]string{}
+		}
+		for k, v := range messages {
+			raw[lang][k] = v
+		}
+		return nil
+	}
+
+	bundled, _ := fs.Glob(embeddedFrontend, path.Join("frontend", translationsDirName, "*.yaml"))
+	for _, name := range bundled {
+		content, err := embeddedFrontend.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := read(name, content); err != nil {
+			return err
+		}
+	}
+
+	if dir := f.directory(); dir != "" {
+		custom, _ := filepath.Glob(filepath.Join(dir, translationsDirName, "*.yaml"))
+		for _, name := range custom {
+			content, err := ioutil.ReadFile(name)
+			if err != nil {
+				return errors.Wrapf(err, "Unable to read translation %s", name)
+			}
+			if err := read(filepath.ToSlash(name), content); err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.DefaultLanguage == "" {
+		f.DefaultLanguage = defaultLanguage
+	}
+	if _, ok := raw[f.DefaultLanguage]; !ok {
+		return errors.Errorf("No translation found for default language %q", f.DefaultLanguage)
+	}
+
+	f.translations = map[string]map[string]string{}
+	for lang := range raw {
+		merged := map[string]string{}
+		for _, fallback := range []string{defaultLanguage, f.DefaultLanguage, lang} {
+			for k, v := range raw[fallback] {
+				merged[k] = v
+			}
+		}
+		f.translations[lang] = merged
+	}
+
+	return nil
+}
+
+// Language selects the language for the request: An available language
+// passed in the lang parameter takes precedence over the languages
+// accepted by the browser.
+func (f frontendConfig) Language(r *http.Request) string {
+	if lang := strings.ToLower(r.FormValue("lang")); lang != "" {
+		if _, ok := f.translations[lang]; ok {
+			return lang
+		}
+	}
+
+	if lang := negotiateLanguage(r.Header.Get("Accept-Language"), f.translations); lang != "" {
+		return lang
+	}
+
+	if f.DefaultLanguage == "" {
+		return defaultLanguage
+	}
+	return f.DefaultLanguage
+}
+
+// Translations returns the messages of the language
+func (f frontendConfig) Translations(lang string) map[string]string {
+	if messages, ok := f.translations[lang]; ok {
+		return messages
+	}
+	return f.translations[f.DefaultLanguage]
+}
+
+// Translate returns the message for the language of the request or the
+// key itself if no translation exists
+func (f frontendConfig) Translate(r *http.Request, key string) string {
+	if msg, ok := f.Translations(f.Language(r))[key]; ok {
+		return msg
+	}
+	return key
+}
+
+// translateLoginFields returns a copy of the login fields of all methods
+// with their labels and placeholders translated
+func translateLoginFields(messages map[string]string, methods map[string][]loginField) map[string][]loginField {
+	out := map[string][]loginField{}
+	for method, fields := range methods {
+		translated := make([]loginField, 0, len(fields))
+		for _, field := range fields {
+			key := "field_" + strings.Replace(field.Name, "-", "_", -1)
+			if msg, ok := messages[key]; ok {
+				field.Label = msg
+			}
+			if msg, ok := messages[key+"_placeholder"]; ok {
+				field.Placeholder = msg
+			}
+			translated = append(translated, field)
+		}
+		out[method] = translated
+	}
+	return out
+}
+
+// loginRedirect returns the URL of the login page showing the error
+// while keeping the target and the language of the login
+func loginRedirect(r *http.Request, errorKey string) string {
+	params := url.Values{"go": {r.FormValue("go")}}
+	if errorKey != "" {
+		params.Set("error", errorKey)
+	}
+	if lang := r.FormValue("lang"); lang != "" {
+		params.Set("lang", lang)
+	}
+	if method := r.FormValue("method"); method != "" {
+		// Show the form the user tried to log in with again
+		params.Set("method", method)
+	}
+	return "/login?" + params.Encode()
+}
+
+// negotiateLanguage returns the available language with the highest
+// quality in the Accept-Language header. Regional variants (de-AT) fall
+// back to the language (de).
+func negotiateLanguage(header string, available map[string]map[string]string) string {
+	type candidate struct {
+		lang    string
+		quality float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		c := candidate{lang: strings.ToLower(strings.TrimSpace(fields[0])), quality: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					c.quality = q
+				}
+			}
+		}
+		if c.lang != "" && c.lang != "*" && c.quality > 0 {
+			candidates = append(candidates, c)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].quality > candidates[j].quality })
+
+	for _, c := range candidates {
+		if _, ok := available[c.lang]; ok {
+			return c.lang
+		}
+		if i := strings.Index(c.lang, "-"); i > 0 {
+			if _, ok := available[c.lang[:i]]; ok {
+				return c.lang[:i]
+			}
+		}
+	}
+
+	return ""
+}
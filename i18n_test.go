@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	available := map[string]map[string]string{"de": nil, "en": nil, "fr": nil}
+
+	for header, expect := range map[string]string{
+		"":                          "",
+		"de":                        "de",
+		"de-AT,de;q=0.9,en;q=0.8":   "de",
+		"en-US;q=0.5,fr;q=0.8":      "fr",
+		"ja,*;q=0.5":                "",
+		"ja, FR-ca;q=0.7, de;q=0.6": "fr",
+		"de;q=0,en":                 "en",
+	} {
+		if lang := negotiateLanguage(header, available); lang != expect {
+			t.Errorf("Expected %q for header %q, got %q", expect, header, lang)
+		}
+	}
+}
+
+func TestLoginPageTranslations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-i18n")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, translationsDirName), 0755)
+	for name, content := range map[string]string{
+		"de.yaml": `remember_me: "Eingeloggt bleiben"`,
+		"nl.yaml": `login: "Inloggen"`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, translationsDirName, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write translation: %s", err)
+		}
+	}
+
+	prev, prevAuthenticators := getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().Frontend = prev
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{}})
+
+	getMainConfig().Frontend = frontendConfig{Directory: dir, DefaultLanguage: "de"}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	render := func(query, acceptLanguage string) string {
+		r := httptest.NewRequest(http.MethodGet, "/login"+query, nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+
+		res := httptest.NewRecorder()
+		handleLoginRequest(res, r)
+		return res.Body.String()
+	}
+
+	for _, c := range []struct {
+		query, acceptLanguage string
+		expect                []string
+	}{
+		// Custom key merged into the bundled translation
+		{"", "de-DE", []string{`lang="de"`, "Eingeloggt bleiben", ">Anmelden<", ">Benutzername<"}},
+		// Parameter takes precedence over the browser
+		{"?lang=fr", "de", []string{`lang="fr"`, "Se souvenir de moi"}},
+		// Custom language falls back to the default language
+		{"", "nl", []string{`lang="nl"`, ">Inloggen<", "Eingeloggt bleiben"}},
+		// Unknown languages use the default language
+		{"?lang=xx", "ja", []string{`lang="de"`}},
+		{"?error=error_invalid_credentials", "en", []string{"The login failed, please check your credentials"}},
+	} {
+		body := render(c.query, c.acceptLanguage)
+		for _, e := range c.expect {
+			if !strings.Contains(body, e) {
+				t.Errorf("Expected %q in login page for %q / %q", e, c.query, c.acceptLanguage)
+			}
+		}
+	}
+
+	if body := render("?error=<script>", "en"); strings.Contains(body, "alert-danger") {
+		t.Error("Expected unknown error to be ignored")
+	}
+
+	if err := (&frontendConfig{Directory: dir, DefaultLanguage: "xx"}).Load(); err == nil {
+		t.Error("Expected unknown default language to be rejected")
+	}
+}
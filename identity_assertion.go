@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultIdentityAssertionHeader = "X-Identity-Assertion"
+	defaultIdentityAssertionTTL    = 30 * time.Second
+)
+
+// identityAssertionConfig configures a signed JWT (or PASETO token)
+// passed to the upstream application on every request to let it verify
+// the identity of the user instead of trusting plain headers
+type identityAssertionConfig struct {
+	Format      string        `yaml:"format"`
+	Header      string        `yaml:"header"`
+	Issuer      string        `yaml:"issuer"`
+	SigningKeys []string      `yaml:"signing_keys"`
+	TTL         time.Duration `yaml:"ttl"`
+
+	keys tokenKeySet
+}
+
+func (i identityAssertionConfig) Enabled() bool { return len(i.SigningKeys) > 0 }
+
+// Load reads the signing keys if the assertion is enabled
+func (i *identityAssertionConfig) Load() error {
+	if !i.Enabled() {
+		i.keys = nil
+		return nil
+	}
+
+	if i.Header == "" {
+		i.Header = defaultIdentityAssertionHeader
+	}
+	if i.TTL == 0 {
+		i.TTL = defaultIdentityAssertionTTL
+	}
+
+	var err error
+	i.keys, err = loadTokenKeySet(i.Format, i.SigningKeys)
+	return err
+}
+
+// Set adds the assertion for the user to the response. The audience
+// is the host the user is accessing so tokens can not be replayed
+// against other applications. The claims of the claims mapping are
+// embedded additionally.
+func (i identityAssertionConfig) Set(res http.ResponseWriter, r *http.Request, user string, groups []string, extraClaims map[string]string) error {
+	if i.keys == nil {
+		return nil
+	}
+
+	if groups == nil {
+		groups = []string{}
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"aud":    requestHost(r),
+		"exp":    now.Add(i.TTL).Unix(),
+		"groups": groups,
+		"iat":    now.Unix(),
+		"sub":    user,
+	}
+
+	for k, v := range extraClaims {
+		claims[k] = v
+	}
+
+	if i.Issuer != "" {
+		claims["iss"] = i.Issuer
+	}
+
+	token, err := i.keys.Sign(claims)
+	if err != nil {
+		return err
+	}
+
+	res.Header().Set(i.Header, token)
+	return nil
+}
+
+func handleIdentityAssertionJWKSRequest(res http.ResponseWriter, r *http.Request) {
+	if !getMainConfig().IdentityAssertion.Enabled() {
+		http.NotFound(res, r)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(getMainConfig().IdentityAssertion.keys.JWKS()); err != nil {
+		requestLog(r).WithError(err).Error("Unable to encode JWKS")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdentityAssertion(t *testing.T) {
+	i := identityAssertionConfig{
+		Header: defaultIdentityAssertionHeader,
+		Issuer: "https://login.example.com",
+		TTL:    time.Minute,
+		keys:   jwtTestKeySet(t),
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Host", "grafana.example.com")
+	rec := httptest.NewRecorder()
+
+	if err := i.Set(rec, r, "alice", []string{"admins"}, map[string]string{"email": "alice@example.com"}); err != nil {
+		t.Fatalf("Unable to set assertion: %s", err)
+	}
+
+	claims, err := i.keys.Verify(rec.Header().Get(defaultIdentityAssertionHeader))
+	if err != nil {
+		t.Fatalf("Unable to verify assertion: %s", err)
+	}
+
+	if claims["sub"] != "alice" || claims["aud"] != "grafana.example.com" || claims["iss"] != "https://login.example.com" {
+		t.Errorf("Unexpected claims: %v", claims)
+	}
+
+	if groups, ok := claims["groups"].([]interface{}); !ok || len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("Unexpected groups claim: %v", claims["groups"])
+	}
+
+	if claims["email"] != "alice@example.com" {
+		t.Errorf("Expected mapped claim to be embedded, got %v", claims["email"])
+	}
+}
+
+func TestIdentityAssertionDisabled(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := (identityAssertionConfig{}).Set(rec, httptest.NewRequest(http.MethodGet, "/auth", nil), "alice", nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(rec.Header()) != 0 {
+		t.Errorf("Expected no headers, got %v", rec.Header())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+)
+
+// identityHeadersConfig configures the headers returned on successful
+// auth requests to be passed to the upstream application using the
+// auth_request_set directive of nginx
+type identityHeadersConfig struct {
+	Headers   map[string]string       `yaml:"headers"`
+	Hosts     []identityHeadersHost   `yaml:"hosts"`
+	Signature identitySignatureConfig `yaml:"signature"`
+
+	compiled map[string]*pongo2.Template
+}
+
+// identityHeadersHost replaces the set of headers for requests to the
+// given hosts
+type identityHeadersHost struct {
+	Hosts   []string          `yaml:"hosts"`
+	Headers map[string]string `yaml:"headers"`
+
+	compiled map[string]*pongo2.Template
+}
+
+var (
+	defaultIdentityHeaders = map[string]string{
+		"X-Username": "{{ user }}",
+	}
+
+	// lineBreakReplacer removes line breaks from rendered values which
+	// would allow to inject further headers
+	lineBreakReplacer = strings.NewReplacer("\r", "", "\n", " ")
+)
+
+func compileIdentityHeaders(headers map[string]string) (map[string]*pongo2.Template, error) {
+	compiled := map[string]*pongo2.Template{}
+
+	for name, tpl := range headers {
+		// Headers are no HTML, the values must not be escaped
+		t, err := pongo2.FromString("{% autoescape off %}" + tpl + "{% endautoescape %}")
+		if err != nil {
+			return nil, fmt.Errorf("Template for header %q is invalid: %s", name, err)
+		}
+		compiled[http.CanonicalHeaderKey(name)] = t
+	}
+
+	return compiled, nil
+}
+
+// Compile parses the header templates. Without configured headers the
+// X-Username header is returned.
+func (i *identityHeadersConfig) Compile() error {
+	headers := i.Headers
+	if len(headers) == 0 {
+		headers = defaultIdentityHeaders
+	}
+
+	var err error
+	if i.compiled, err = compileIdentityHeaders(headers); err != nil {
+		return err
+	}
+
+	for n := range i.Hosts {
+		if len(i.Hosts[n].Hosts) == 0 {
+			return fmt.Errorf("Host override on position %d has no hosts", n+1)
+		}
+
+		if i.Hosts[n].compiled, err = compileIdentityHeaders(i.Hosts[n].Headers); err != nil {
+			return fmt.Errorf("Host override on position %d is invalid: %s", n+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (i identityHeadersConfig) templatesForRequest(r *http.Request) map[string]*pongo2.Template {
+	host := requestHost(r)
+	for _, h := range i.Hosts {
+		if hostMatches(h.Hosts, host) {
+			return h.compiled
+		}
+	}
+
+	return i.compiled
+}
+
+// Set renders the headers for the request and adds them to the
+// response. Headers rendering to an empty string are omitted.
+func (i identityHeadersConfig) Set(res http.ResponseWriter, r *http.Request, user string, groups []string) error {
+	m, _ := getSessionMeta(r)
+
+	ctx := pongo2.Context{
+		"user":     user,
+		"groups":   groups,
+		"provider": m.Provider,
+		"mfa":      m.MFA,
+		"claims":   m.Claims,
+	}
+
+	var names []string
+	for name, tpl := range i.templatesForRequest(r) {
+		value, err := tpl.Execute(ctx)
+		if err != nil {
+			return fmt.Errorf("Unable to render header %q: %s", name, err)
+		}
+
+		// Line breaks would allow to inject further headers
+		value = strings.TrimSpace(lineBreakReplacer.Replace(value))
+		if value != "" {
+			res.Header().Set(name, value)
+		}
+
+		// Empty headers are signed too to detect them being added
+		names = append(names, name)
+	}
+
+	i.Signature.Set(res.Header(), r, names, time.Now())
+
+	return nil
+}
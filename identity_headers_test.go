@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdentityHeaders(t *testing.T) {
+	i := identityHeadersConfig{
+		Headers: map[string]string{
+			"X-User":   "{{ user }}",
+			"X-Groups": `{{ groups|join:"," }}`,
+			"X-Email":  "{{ claims.mail }}",
+		},
+		Hosts: []identityHeadersHost{
+			{Hosts: []string{"grafana.example.com"}, Headers: map[string]string{"X-WEBAUTH-USER": "{{ user }}"}},
+		},
+	}
+	if err := i.Compile(); err != nil {
+		t.Fatalf("Headers did not compile: %s", err)
+	}
+
+	req := aclTestRequest(map[string]string{"X-Host": "wiki.example.com"})
+	setSessionClaims(req, map[string]string{"mail": "test&dev@example.com"})
+
+	res := httptest.NewRecorder()
+	if err := i.Set(res, req, aclTestUser, aclTestGroups); err != nil {
+		t.Fatalf("Unable to set headers: %s", err)
+	}
+
+	for hdr, expected := range map[string]string{
+		"X-User":   aclTestUser,
+		"X-Groups": "group_a,group_b",
+		"X-Email":  "test&dev@example.com",
+	} {
+		if v := res.Header().Get(hdr); v != expected {
+			t.Errorf("Expected header %s to be %q, got %q", hdr, expected, v)
+		}
+	}
+
+	req = aclTestRequest(map[string]string{"X-Host": "grafana.example.com"})
+	res = httptest.NewRecorder()
+	if err := i.Set(res, req, aclTestUser, aclTestGroups); err != nil {
+		t.Fatalf("Unable to set headers: %s", err)
+	}
+
+	if res.Header().Get("X-Webauth-User") != aclTestUser || res.Header().Get("X-User") != "" {
+		t.Errorf("Host override was not applied: %v", res.Header())
+	}
+
+	i = identityHeadersConfig{}
+	if err := i.Compile(); err != nil {
+		t.Fatalf("Default headers did not compile: %s", err)
+	}
+
+	res = httptest.NewRecorder()
+	i.Set(res, req, aclTestUser, nil)
+	if res.Header().Get("X-Username") != aclTestUser {
+		t.Error("Default X-Username header was not set")
+	}
+}
+
+func TestIdentityHeadersSignature(t *testing.T) {
+	i := identityHeadersConfig{
+		Headers: map[string]string{
+			"X-User":   "{{ user }}",
+			"X-Groups": `{{ groups|join:"," }}`,
+		},
+		Signature: identitySignatureConfig{Secret: "verysecret"},
+	}
+	if err := i.Compile(); err != nil {
+		t.Fatalf("Headers did not compile: %s", err)
+	}
+
+	req := aclTestRequest(map[string]string{"X-Host": "wiki.example.com"})
+	res := httptest.NewRecorder()
+	if err := i.Set(res, req, aclTestUser, aclTestGroups); err != nil {
+		t.Fatalf("Unable to set headers: %s", err)
+	}
+
+	params := map[string]string{}
+	for _, part := range strings.Split(res.Header().Get(defaultIdentitySignatureHeader), ",") {
+		kv := strings.SplitN(part, "=", 2)
+		params[kv[0]] = kv[1]
+	}
+
+	if params["h"] != "x-groups;x-user" {
+		t.Errorf("Unexpected signed headers %q", params["h"])
+	}
+
+	mac := hmac.New(sha256.New, []byte("verysecret"))
+	mac.Write([]byte(strings.Join([]string{
+		params["t"],
+		"wiki.example.com",
+		"x-groups:group_a,group_b",
+		"x-user:" + aclTestUser,
+	}, "\n")))
+	if expected := hex.EncodeToString(mac.Sum(nil)); params["v1"] != expected {
+		t.Errorf("Expected signature %q, got %q", expected, params["v1"])
+	}
+}
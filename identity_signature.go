@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultIdentitySignatureHeader = "X-Identity-Signature"
+
+// identitySignatureConfig adds a HMAC signature covering the identity
+// headers, the accessed host and a timestamp to let upstreams unable to
+// verify JWTs detect spoofed headers
+type identitySignatureConfig struct {
+	Header string `yaml:"header"`
+	Secret string `yaml:"secret"`
+}
+
+func (i identitySignatureConfig) headerName() string {
+	if i.Header == "" {
+		return defaultIdentitySignatureHeader
+	}
+	return http.CanonicalHeaderKey(i.Header)
+}
+
+// identitySigningString builds the string covered by the signature: The
+// timestamp, the host and the signed headers in the given order with
+// one element per line
+func identitySigningString(timestamp int64, host string, headers []string, header http.Header) string {
+	lines := []string{strconv.FormatInt(timestamp, 10), host}
+	for _, name := range headers {
+		lines = append(lines, strings.ToLower(name)+":"+header.Get(name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (i identitySignatureConfig) sign(signingString string) string {
+	mac := hmac.New(sha256.New, []byte(i.Secret))
+	mac.Write([]byte(signingString))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Set signs the given headers of the response and adds the signature
+// in the form `t=<unix timestamp>,h=<header>;<header>,v1=<hex HMAC-SHA256>`
+func (i identitySignatureConfig) Set(header http.Header, r *http.Request, headers []string, now time.Time) {
+	if i.Secret == "" {
+		return
+	}
+
+	sort.Strings(headers)
+	ts := now.Unix()
+	sig := i.sign(identitySigningString(ts, requestHost(r), headers, header))
+
+	names := make([]string, len(headers))
+	for n, h := range headers {
+		names[n] = strings.ToLower(h)
+	}
+
+	header.Set(i.headerName(), strings.Join([]string{
+		"t=" + strconv.FormatInt(ts, 10),
+		"h=" + strings.Join(names, ";"),
+		"v1=" + sig,
+	}, ","))
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+const (
+	defaultIPBlocklistRefresh = time.Hour
+	ipBlocklistFetchTimeout   = 30 * time.Second
+	ipBlocklistCheckInterval  = 10 * time.Second
+)
+
+var (
+	// ipBlocklists keeps the fetched lists by their URL, lists which
+	// could not be refreshed keep their previous content
+	ipBlocklists     = map[string]*ipBlocklistState{}
+	ipBlocklistsLock sync.RWMutex
+
+	ipBlocklistClient = &http.Client{Timeout: ipBlocklistFetchTimeout}
+)
+
+// ipFilterConfig rejects requests from denied IPs before any
+// authentication work is done. If allow is set only the listed IPs are
+// accepted.
+type ipFilterConfig struct {
+	Allow           []string      `yaml:"allow"`
+	Deny            []string      `yaml:"deny"`
+	Blocklists      []string      `yaml:"blocklists"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+type ipBlocklistState struct {
+	nets    []*net.IPNet
+	fetched time.Time
+}
+
+func (i *ipFilterConfig) Compile() (err error) {
+	if i.allowNets, err = acl.ParseCIDRs(i.Allow); err != nil {
+		return errors.Wrap(err, "Invalid allow list")
+	}
+	if i.denyNets, err = acl.ParseCIDRs(i.Deny); err != nil {
+		return errors.Wrap(err, "Invalid deny list")
+	}
+
+	for _, list := range i.Blocklists {
+		u, err := url.Parse(list)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to parse blocklist %q", list)
+		}
+		switch u.Scheme {
+		case "http", "https", "file":
+		default:
+			return errors.Errorf("Unsupported scheme of blocklist %q", list)
+		}
+	}
+
+	if i.RefreshInterval < 0 {
+		return errors.New("Refresh interval must not be negative")
+	}
+
+	return nil
+}
+
+// Rejects returns the name of the list the IP is rejected by or an
+// empty string if the IP is accepted
+func (i ipFilterConfig) Rejects(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	if len(i.allowNets) > 0 && !ipInNets(ip, i.allowNets) {
+		return "allow"
+	}
+	if ipInNets(ip, i.denyNets) {
+		return "deny"
+	}
+
+	ipBlocklistsLock.RLock()
+	defer ipBlocklistsLock.RUnlock()
+
+	for _, list := range i.Blocklists {
+		if s, ok := ipBlocklists[list]; ok && ipInNets(ip, s.nets) {
+			return list
+		}
+	}
+
+	return ""
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withIPFilter drops requests of rejected clients. The health checks
+// are not filtered to not break probes of orchestrators.
+func withIPFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(res, r)
+			return
+		}
+
+		if list := getMainConfig().IPFilter.Rejects(net.ParseIP(getMainConfig().trustedClientIP(r))); list != "" {
+			metricIPFilterRejections.Inc(list)
+			requestLog(r).WithField("list", list).Debug("Request rejected by IP filter")
+			http.Error(res, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(res, r)
+	})
+}
+
+// watchIPBlocklists fetches the configured blocklists when they are
+// due. Lists which are no longer configured are dropped.
+func watchIPBlocklists() {
+	for {
+		refreshIPBlocklists(time.Now())
+		time.Sleep(ipBlocklistCheckInterval)
+	}
+}
+
+func refreshIPBlocklists(now time.Time) {
+	interval := getMainConfig().IPFilter.RefreshInterval
+	if interval == 0 {
+		interval = defaultIPBlocklistRefresh
+	}
+
+	configured := map[string]bool{}
+	for _, list := range getMainConfig().IPFilter.Blocklists {
+		configured[list] = true
+
+		ipBlocklistsLock.RLock()
+		s, ok := ipBlocklists[list]
+		ipBlocklistsLock.RUnlock()
+		if ok && now.Sub(s.fetched) < interval {
+			continue
+		}
+
+		nets, err := fetchIPBlocklist(list)
+		if err != nil {
+			// Keep the previous content and retry after the interval
+			log.WithError(err).WithField("blocklist", list).Error("Unable to fetch IP blocklist")
+			var previous []*net.IPNet
+			if ok {
+				previous = s.nets
+			}
+			s = &ipBlocklistState{nets: previous}
+		} else {
+			s = &ipBlocklistState{nets: nets}
+			log.WithFields(log.Fields{
+				"blocklist": list,
+				"entries":   len(nets),
+			}).Debug("Fetched IP blocklist")
+		}
+		s.fetched = now
+
+		ipBlocklistsLock.Lock()
+		ipBlocklists[list] = s
+		ipBlocklistsLock.Unlock()
+	}
+
+	ipBlocklistsLock.Lock()
+	for list := range ipBlocklists {
+		if !configured[list] {
+			delete(ipBlocklists, list)
+		}
+	}
+	ipBlocklistsLock.Unlock()
+}
+
+// fetchIPBlocklist reads a list of IPs and CIDRs, one per line. Comments
+// starting with # or ; (used by the Spamhaus DROP lists) are ignored.
+func fetchIPBlocklist(list string) ([]*net.IPNet, error) {
+	u, err := url.Parse(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.ReadCloser
+	if u.Scheme == "file" {
+		if body, err = os.Open(u.Path); err != nil {
+			return nil, err
+		}
+	} else {
+		resp, err := ipBlocklistClient.Get(list)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("Server responded with status %d", resp.StatusCode)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	entries := []string{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			entries = append(entries, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return acl.ParseCIDRs(entries)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-ip-filter")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	list := filepath.Join(dir, "drop.txt")
+	ioutil.WriteFile(list, []byte("; Spamhaus style comment\n192.0.2.0/24 ; SBL123\n2001:db8::1\n"), 0644)
+
+	prev := getMainConfig().IPFilter
+	defer func() { getMainConfig().IPFilter = prev }()
+
+	getMainConfig().IPFilter = ipFilterConfig{
+		Deny:       []string{"198.51.100.7"},
+		Blocklists: []string{"file://" + list},
+	}
+	if err := getMainConfig().IPFilter.Compile(); err != nil {
+		t.Fatalf("Unable to compile IP filter: %s", err)
+	}
+	refreshIPBlocklists(time.Now())
+
+	for ip, expect := range map[string]string{
+		"192.0.2.44":   "file://" + list,
+		"2001:db8::1":  "file://" + list,
+		"198.51.100.7": "deny",
+		"203.0.113.1":  "",
+	} {
+		if list := getMainConfig().IPFilter.Rejects(net.ParseIP(ip)); list != expect {
+			t.Errorf("Expected %s to be rejected by %q, got %q", ip, expect, list)
+		}
+	}
+
+	// A broken list keeps the previous content
+	ioutil.WriteFile(list, []byte("not an IP\n"), 0644)
+	refreshIPBlocklists(time.Now().Add(2 * defaultIPBlocklistRefresh))
+	if getMainConfig().IPFilter.Rejects(net.ParseIP("192.0.2.44")) == "" {
+		t.Error("Expected previous blocklist content to be kept")
+	}
+
+	h := withIPFilter(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {}))
+	for path, expect := range map[string]int{"/auth": http.StatusForbidden, "/healthz": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = "198.51.100.7:1234"
+		// Not passed by a trusted proxy, must not be used
+		r.Header.Set("X-Forwarded-For", "10.1.2.3")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, r)
+		if res.Code != expect {
+			t.Errorf("Expected status %d for %s, got %d", expect, path, res.Code)
+		}
+	}
+
+	getMainConfig().IPFilter = ipFilterConfig{Allow: []string{"10.0.0.0/8"}}
+	getMainConfig().IPFilter.Compile()
+	if getMainConfig().IPFilter.Rejects(net.ParseIP("10.1.2.3")) != "" || getMainConfig().IPFilter.Rejects(net.ParseIP("192.0.2.1")) != "allow" {
+		t.Error("Expected only IPs of the allow list to be accepted")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	jwtAlgorithmEdDSA = "EdDSA"
+	jwtAlgorithmRS256 = "RS256"
+)
+
+var errJWTInvalid = errors.New("Token is invalid")
+
+type jwtSigningKey struct {
+	ID        string
+	Algorithm string
+
+	signer crypto.Signer
+}
+
+func parseJWTSigningKey(pemData []byte) (jwtSigningKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return jwtSigningKey{}, errors.New("No PEM data found")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return jwtSigningKey{}, errors.Errorf("Unsupported PEM block type %q", block.Type)
+	}
+
+	if err != nil {
+		return jwtSigningKey{}, errors.Wrap(err, "Unable to parse private key")
+	}
+
+	k := jwtSigningKey{}
+	switch pk := key.(type) {
+	case *rsa.PrivateKey:
+		k.Algorithm = jwtAlgorithmRS256
+		k.signer = pk
+	case ed25519.PrivateKey:
+		k.Algorithm = jwtAlgorithmEdDSA
+		k.signer = pk
+	default:
+		return jwtSigningKey{}, errors.Errorf("Unsupported key type %T", key)
+	}
+
+	k.ID = k.thumbprint()
+	return k, nil
+}
+
+// jwk returns the public part of the key in JWK format (RFC 7517)
+func (j jwtSigningKey) jwk() map[string]string {
+	switch pub := j.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		}
+	}
+
+	return nil
+}
+
+// thumbprint calculates the JWK thumbprint (RFC 7638) of the public key
+func (j jwtSigningKey) thumbprint() string {
+	// json.Marshal sorts the map keys which is exactly what RFC 7638
+	// requires for the required members of the key
+	data, _ := json.Marshal(j.jwk())
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (j jwtSigningKey) sign(data []byte) ([]byte, error) {
+	switch j.Algorithm {
+	case jwtAlgorithmEdDSA:
+		return j.signer.Sign(rand.Reader, data, crypto.Hash(0))
+	case jwtAlgorithmRS256:
+		sum := sha256.Sum256(data)
+		return j.signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+
+	return nil, errors.Errorf("Unsupported algorithm %q", j.Algorithm)
+}
+
+func (j jwtSigningKey) verify(data, signature []byte) bool {
+	switch pub := j.signer.Public().(type) {
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, signature)
+	}
+
+	return false
+}
+
+// jwtKeySet holds a list of signing keys: The first one is used to
+// sign new tokens, all of them are accepted to verify tokens.
+type jwtKeySet struct {
+	keys []jwtSigningKey
+}
+
+func loadJWTKeySet(files []string) (*jwtKeySet, error) {
+	if len(files) == 0 {
+		return nil, errors.New("No signing keys configured")
+	}
+
+	ks := &jwtKeySet{}
+	for _, fn := range files {
+		pemData, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read signing key %q", fn)
+		}
+
+		k, err := parseJWTSigningKey(pemData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to load signing key %q", fn)
+		}
+
+		ks.keys = append(ks.keys, k)
+	}
+
+	return ks, nil
+}
+
+// JWKS returns the public keys of the set in JWK Set format
+func (j *jwtKeySet) JWKS() map[string]interface{} {
+	keys := []map[string]string{}
+
+	if j != nil {
+		for _, k := range j.keys {
+			jwk := k.jwk()
+			jwk["kid"] = k.ID
+			jwk["alg"] = k.Algorithm
+			jwk["use"] = "sig"
+			keys = append(keys, jwk)
+		}
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+// Sign creates a compact serialized JWT from the given claims using
+// the first key of the set
+func (j *jwtKeySet) Sign(claims map[string]interface{}) (string, error) {
+	if j == nil || len(j.keys) == 0 {
+		return "", errors.New("No signing keys configured")
+	}
+
+	key := j.keys[0]
+
+	header, err := json.Marshal(map[string]string{
+		"alg": key.Algorithm,
+		"kid": key.ID,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to marshal header")
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to marshal claims")
+	}
+
+	signingInput := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(payload),
+	}, ".")
+
+	sig, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to sign token")
+	}
+
+	return strings.Join([]string{signingInput, base64.RawURLEncoding.EncodeToString(sig)}, "."), nil
+}
+
+// Verify checks the signature and the time based claims of the token
+// and returns its claims. Numeric claims are returned as json.Number.
+func (j *jwtKeySet) Verify(token string) (map[string]interface{}, error) {
+	if j == nil {
+		return nil, errJWTInvalid
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTInvalid
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := j.decodeSegment(parts[0], &header); err != nil {
+		return nil, errJWTInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTInvalid
+	}
+
+	var valid bool
+	for _, k := range j.keys {
+		// Never trust the algorithm of the token without the key matching it
+		if k.ID != header.KeyID || k.Algorithm != header.Algorithm {
+			continue
+		}
+
+		valid = k.verify([]byte(parts[0]+"."+parts[1]), sig)
+		break
+	}
+
+	if !valid {
+		return nil, errJWTInvalid
+	}
+
+	claims := map[string]interface{}{}
+	if err := j.decodeSegment(parts[1], &claims); err != nil {
+		return nil, errJWTInvalid
+	}
+
+	now := time.Now().Unix()
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if v, err := exp.Int64(); err != nil || v < now {
+			return nil, errJWTInvalid
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if v, err := nbf.Int64(); err != nil || v > now {
+			return nil, errJWTInvalid
+		}
+	}
+
+	return claims, nil
+}
+
+func (j *jwtKeySet) decodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(target)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func jwtTestKeySet(t *testing.T) *jwtKeySet {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate Ed25519 key: %s", err)
+	}
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate RSA key: %s", err)
+	}
+
+	ks := &jwtKeySet{}
+	for _, block := range []*pem.Block{
+		{Type: "PRIVATE KEY", Bytes: edDER},
+		{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+	} {
+		k, err := parseJWTSigningKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", block.Type, err)
+		}
+		ks.keys = append(ks.keys, k)
+	}
+
+	return ks
+}
+
+func TestJWTSignVerify(t *testing.T) {
+	ks := jwtTestKeySet(t)
+
+	for _, keys := range [][]jwtSigningKey{ks.keys, {ks.keys[1], ks.keys[0]}} {
+		ks := &jwtKeySet{keys: keys}
+
+		token, err := ks.Sign(map[string]interface{}{"sub": "test", "exp": time.Now().Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatalf("Unable to sign token with %s: %s", keys[0].Algorithm, err)
+		}
+
+		claims, err := ks.Verify(token)
+		if err != nil {
+			t.Fatalf("Unable to verify %s token: %s", keys[0].Algorithm, err)
+		}
+
+		if claims["sub"] != "test" {
+			t.Errorf("Unexpected subject %v", claims["sub"])
+		}
+
+		parts := strings.Split(token, ".")
+		tampered := strings.Join([]string{parts[0], "eyJzdWIiOiJhZG1pbiJ9", parts[2]}, ".")
+		if _, err := ks.Verify(tampered); err == nil {
+			t.Errorf("Tampered %s token was accepted", keys[0].Algorithm)
+		}
+	}
+}
+
+func TestJWTExpired(t *testing.T) {
+	ks := jwtTestKeySet(t)
+
+	token, err := ks.Sign(map[string]interface{}{"sub": "test", "exp": time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+
+	if _, err := ks.Verify(token); err == nil {
+		t.Error("Expired token was accepted")
+	}
+}
+
+func TestJWTCookieCodec(t *testing.T) {
+	c := jwtCookieCodec{keys: jwtTestKeySet(t), maxAge: time.Minute}
+
+	encoded, err := c.Encode("nginx-sso-simple", map[interface{}]interface{}{"user": "test", "login": int64(1234)})
+	if err != nil {
+		t.Fatalf("Unable to encode session: %s", err)
+	}
+
+	values := map[interface{}]interface{}{}
+	if err := c.Decode("nginx-sso-simple", encoded, &values); err != nil {
+		t.Fatalf("Unable to decode session: %s", err)
+	}
+
+	if values["user"] != "test" || values["login"] != int64(1234) {
+		t.Errorf("Unexpected session values %#v", values)
+	}
+
+	if err := c.Decode("nginx-sso-ldap", encoded, &values); err == nil {
+		t.Error("Session was accepted for another cookie")
+	}
+}
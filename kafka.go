@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Minimal Kafka producer speaking the wire protocol (Metadata v1,
+// Produce v3 with record batches v2) to send audit events without
+// pulling in a full client library. Compression, SASL and idempotence
+// are not supported.
+
+const (
+	kafkaAPIProduce  int16 = 0
+	kafkaAPIMetadata int16 = 3
+
+	kafkaClientID = "nginx-sso"
+	kafkaTimeout  = 10 * time.Second
+)
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaProducer struct {
+	brokers []string
+	topic   string
+	acks    int16
+	tls     *tls.Config
+
+	conns         map[string]*kafkaConn
+	partitions    []kafkaPartition
+	nextPartition int
+	lock          sync.Mutex
+}
+
+// kafkaPartition is a partition of the topic with the address of its
+// leader
+type kafkaPartition struct {
+	ID     int32
+	Leader string
+}
+
+// newKafkaProducer creates a producer from an URI in the format
+// kafka://broker1:9092,broker2:9092/topic?acks=all&tls=true
+func newKafkaProducer(u *url.URL) (*kafkaProducer, error) {
+	p := &kafkaProducer{
+		brokers: strings.Split(u.Host, ","),
+		topic:   strings.Trim(u.Path, "/"),
+		acks:    -1,
+		conns:   map[string]*kafkaConn{},
+	}
+
+	if u.Host == "" || p.topic == "" {
+		return nil, errors.New("Kafka target needs brokers and topic")
+	}
+
+	switch v := u.Query().Get("acks"); v {
+	case "", "all", "-1":
+	case "0", "1":
+		p.acks = int16(v[0] - '0')
+	default:
+		return nil, errors.Errorf("Invalid acks %q, use 0, 1 or all", v)
+	}
+
+	if useTLS, _ := strconv.ParseBool(u.Query().Get("tls")); useTLS {
+		p.tls = &tls.Config{}
+	}
+
+	return p, nil
+}
+
+// Produce sends the values as records of one batch to the next
+// partition. On errors the connections and the metadata are dropped to
+// be refreshed on the next call.
+func (k *kafkaProducer) Produce(values [][]byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	err := k.produce(values)
+	if err != nil {
+		for addr, c := range k.conns {
+			c.Close()
+			delete(k.conns, addr)
+		}
+		k.partitions = nil
+	}
+
+	return err
+}
+
+func (k *kafkaProducer) produce(values [][]byte) error {
+	if k.partitions == nil {
+		if err := k.refreshMetadata(); err != nil {
+			return errors.Wrap(err, "Unable to fetch metadata")
+		}
+	}
+
+	partition := k.partitions[k.nextPartition%len(k.partitions)]
+	k.nextPartition++
+
+	conn, err := k.conn(partition.Leader)
+	if err != nil {
+		return err
+	}
+
+	req := &kafkaEncoder{}
+	req.Int16(-1) // transactional_id: null
+	req.Int16(k.acks)
+	req.Int32(int32(kafkaTimeout / time.Millisecond))
+	req.Int32(1)
+	req.String(k.topic)
+	req.Int32(1)
+	req.Int32(partition.ID)
+	req.Bytes(kafkaRecordBatch(values, time.Now()))
+
+	if k.acks == 0 {
+		// The broker does not answer requests without acks
+		return conn.Send(kafkaAPIProduce, 3, req.buf.Bytes())
+	}
+
+	resp, err := conn.Request(kafkaAPIProduce, 3, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for topics := resp.Int32(); topics > 0; topics-- {
+		resp.Text()
+		for partitions := resp.Int32(); partitions > 0; partitions-- {
+			resp.Int32()
+			if code := resp.Int16(); code != 0 {
+				return errors.Errorf("Broker rejected records with error code %d", code)
+			}
+			resp.Int64()
+			resp.Int64()
+		}
+	}
+
+	return resp.err
+}
+
+func (k *kafkaProducer) refreshMetadata() error {
+	var lastErr error
+
+	for _, broker := range k.brokers {
+		conn, err := k.conn(broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		req := &kafkaEncoder{}
+		req.Int32(1)
+		req.String(k.topic)
+
+		resp, err := conn.Request(kafkaAPIMetadata, 1, req.buf.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return k.parseMetadata(resp)
+	}
+
+	return lastErr
+}
+
+func (k *kafkaProducer) parseMetadata(resp *kafkaDecoder) error {
+	brokers := map[int32]string{}
+	for n := resp.Int32(); n > 0 && resp.err == nil; n-- {
+		id := resp.Int32()
+		host := resp.Text()
+		port := resp.Int32()
+		resp.NullableString() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.Int32() // controller_id
+
+	partitions := []kafkaPartition{}
+	for n := resp.Int32(); n > 0 && resp.err == nil; n-- {
+		if code := resp.Int16(); code != 0 {
+			return errors.Errorf("Topic %q is not available (error code %d)", k.topic, code)
+		}
+		resp.Text()
+		resp.Int8() // is_internal
+
+		for p := resp.Int32(); p > 0 && resp.err == nil; p-- {
+			resp.Int16()
+			id := resp.Int32()
+			leader := resp.Int32()
+			resp.Int32Array() // replicas
+			resp.Int32Array() // isr
+
+			// Partitions without leader are skipped until the next refresh
+			if addr, ok := brokers[leader]; ok {
+				partitions = append(partitions, kafkaPartition{id, addr})
+			}
+		}
+	}
+
+	if resp.err != nil {
+		return resp.err
+	}
+	if len(partitions) == 0 {
+		return errors.Errorf("Topic %q has no partitions with leader", k.topic)
+	}
+
+	k.partitions = partitions
+	return nil
+}
+
+func (k *kafkaProducer) conn(addr string) (*kafkaConn, error) {
+	if c, ok := k.conns[addr]; ok {
+		return c, nil
+	}
+
+	dialer := &net.Dialer{Timeout: kafkaTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if k.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, k.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to connect to broker %s", addr)
+	}
+
+	c := &kafkaConn{Conn: conn}
+	k.conns[addr] = c
+	return c, nil
+}
+
+type kafkaConn struct {
+	net.Conn
+	correlationID int32
+}
+
+func (c *kafkaConn) Send(apiKey, apiVersion int16, body []byte) error {
+	c.correlationID++
+
+	req := &kafkaEncoder{}
+	req.Int32(0) // size, set below
+	req.Int16(apiKey)
+	req.Int16(apiVersion)
+	req.Int32(c.correlationID)
+	req.String(kafkaClientID)
+	req.buf.Write(body)
+
+	data := req.buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+
+	c.SetDeadline(time.Now().Add(kafkaTimeout))
+	_, err := c.Write(data)
+	return err
+}
+
+func (c *kafkaConn) Request(apiKey, apiVersion int16, body []byte) (*kafkaDecoder, error) {
+	if err := c.Send(apiKey, apiVersion, body); err != nil {
+		return nil, err
+	}
+
+	var size int32
+	if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+		return nil, errors.Wrap(err, "Unable to read response")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, errors.Wrap(err, "Unable to read response")
+	}
+
+	resp := &kafkaDecoder{r: bytes.NewReader(data)}
+	if id := resp.Int32(); id != c.correlationID {
+		return nil, errors.Errorf("Response for request %d received, expected %d", id, c.correlationID)
+	}
+
+	return resp, nil
+}
+
+// kafkaRecordBatch encodes the values as records of a batch (magic 2)
+func kafkaRecordBatch(values [][]byte, now time.Time) []byte {
+	records := &kafkaEncoder{}
+	for i, v := range values {
+		rec := &kafkaEncoder{}
+		rec.Int8(0)          // attributes
+		rec.Varint(0)        // timestamp delta
+		rec.Varint(int64(i)) // offset delta
+		rec.Varint(-1)       // key: null
+		rec.Varint(int64(len(v)))
+		rec.buf.Write(v)
+		rec.Varint(0) // headers
+
+		records.Varint(int64(rec.buf.Len()))
+		records.buf.Write(rec.buf.Bytes())
+	}
+
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	// The CRC covers everything from the attributes to the end
+	body := &kafkaEncoder{}
+	body.Int16(0) // attributes: no compression
+	body.Int32(int32(len(values) - 1))
+	body.Int64(timestamp)
+	body.Int64(timestamp)
+	body.Int64(-1) // producer_id
+	body.Int16(-1) // producer_epoch
+	body.Int32(-1) // base_sequence
+	body.Int32(int32(len(values)))
+	body.buf.Write(records.buf.Bytes())
+
+	batch := &kafkaEncoder{}
+	batch.Int64(0) // base_offset
+	batch.Int32(int32(4 + 1 + 4 + body.buf.Len()))
+	batch.Int32(-1) // partition_leader_epoch
+	batch.Int8(2)   // magic
+	batch.Int32(int32(crc32.Checksum(body.buf.Bytes(), kafkaCRCTable)))
+	batch.buf.Write(body.buf.Bytes())
+
+	return batch.buf.Bytes()
+}
+
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (k *kafkaEncoder) Int8(v int8)   { k.buf.WriteByte(byte(v)) }
+func (k *kafkaEncoder) Int16(v int16) { binary.Write(&k.buf, binary.BigEndian, v) }
+func (k *kafkaEncoder) Int32(v int32) { binary.Write(&k.buf, binary.BigEndian, v) }
+func (k *kafkaEncoder) Int64(v int64) { binary.Write(&k.buf, binary.BigEndian, v) }
+
+func (k *kafkaEncoder) String(v string) {
+	k.Int16(int16(len(v)))
+	k.buf.WriteString(v)
+}
+
+func (k *kafkaEncoder) Bytes(v []byte) {
+	k.Int32(int32(len(v)))
+	k.buf.Write(v)
+}
+
+// Varint writes a zig-zag encoded variable length integer
+func (k *kafkaEncoder) Varint(v int64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	k.buf.Write(buf[:binary.PutVarint(buf, v)])
+}
+
+// kafkaDecoder reads responses, the first error is kept and all
+// following reads return zero values
+type kafkaDecoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (k *kafkaDecoder) read(v interface{}) {
+	if k.err == nil {
+		k.err = binary.Read(k.r, binary.BigEndian, v)
+	}
+}
+
+func (k *kafkaDecoder) Int8() (v int8)   { k.read(&v); return v }
+func (k *kafkaDecoder) Int16() (v int16) { k.read(&v); return v }
+func (k *kafkaDecoder) Int32() (v int32) { k.read(&v); return v }
+func (k *kafkaDecoder) Int64() (v int64) { k.read(&v); return v }
+
+// Text reads a string, String is avoided to not look like a Stringer
+func (k *kafkaDecoder) Text() string {
+	return k.NullableString()
+}
+
+func (k *kafkaDecoder) NullableString() string {
+	l := k.Int16()
+	if l <= 0 || k.err != nil {
+		return ""
+	}
+
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(k.r, buf); err != nil {
+		k.err = err
+	}
+	return string(buf)
+}
+
+func (k *kafkaDecoder) Int32Array() []int32 {
+	out := []int32{}
+	for n := k.Int32(); n > 0 && k.err == nil; n-- {
+		out = append(out, k.Int32())
+	}
+	return out
+}
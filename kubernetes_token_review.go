@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gorilla/context"
+
+	"github.com/Luzifer/go_helpers/str"
+	"github.com/pkg/errors"
+)
+
+const (
+	kubernetesTokenReviewPath       = "/kubernetes/token-review"
+	kubernetesTokenReviewAPIVersion = "authentication.k8s.io/v1"
+)
+
+// kubernetesTokenReviewConfig configures the endpoint implementing the
+// Kubernetes authentication webhook. The API server authenticates using
+// one of the tokens, the reviewed tokens are the tokens issued by the
+// OIDC provider and the tokens accepted by the providers.
+type kubernetesTokenReviewConfig struct {
+	Tokens    []string `yaml:"tokens"`
+	Audiences []string `yaml:"audiences"`
+	Host      string   `yaml:"host"`
+}
+
+func (k kubernetesTokenReviewConfig) Enabled() bool { return len(k.Tokens) > 0 }
+
+type kubernetesTokenReview struct {
+	APIVersion string                      `json:"apiVersion"`
+	Kind       string                      `json:"kind"`
+	Spec       kubernetesTokenReviewSpec   `json:"spec"`
+	Status     kubernetesTokenReviewStatus `json:"status"`
+}
+
+type kubernetesTokenReviewSpec struct {
+	Token     string   `json:"token,omitempty"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type kubernetesTokenReviewStatus struct {
+	Authenticated bool                       `json:"authenticated"`
+	User          *kubernetesTokenReviewUser `json:"user,omitempty"`
+	Audiences     []string                   `json:"audiences,omitempty"`
+	Error         string                     `json:"error,omitempty"`
+}
+
+type kubernetesTokenReviewUser struct {
+	Username string              `json:"username"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+func (k kubernetesTokenReviewConfig) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return false
+	}
+
+	for _, t := range k.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Review validates the token of the review and returns the status to
+// report to the API server
+func (k kubernetesTokenReviewConfig) Review(r *http.Request, spec kubernetesTokenReviewSpec) (kubernetesTokenReviewStatus, error) {
+	unauthenticated := func(reason string) (kubernetesTokenReviewStatus, error) {
+		return kubernetesTokenReviewStatus{Error: reason}, nil
+	}
+
+	if spec.Token == "" {
+		return unauthenticated("No token given")
+	}
+
+	// Tokens issued by the OIDC provider already carry the forwarded
+	// identity and are bound to their audience
+	if p := getOIDCProvider(); p != nil {
+		if claims, err := p.keys.Verify(spec.Token); err == nil {
+			if claims["iss"] != p.config.Issuer {
+				return unauthenticated("Token was not issued by nginx-sso")
+			}
+
+			// The API server can't pass a proof of the key
+			if dpopBoundKey(claims) != "" {
+				return unauthenticated("Token is bound to a key")
+			}
+
+			audience, _ := claims["aud"].(string)
+			if len(spec.Audiences) > 0 && !str.StringInSlice(audience, spec.Audiences) {
+				return unauthenticated("Token is not valid for the requested audiences")
+			}
+
+			user, _ := claims["sub"].(string)
+			var groups []string
+			if rawGroups, ok := claims["groups"].([]interface{}); ok {
+				for _, g := range rawGroups {
+					if group, ok := g.(string); ok {
+						groups = append(groups, group)
+					}
+				}
+			}
+
+			mapped := map[string]string{}
+			for name := range getMainConfig().ClaimsMapping.Claims {
+				if v, ok := claims[name].(string); ok {
+					mapped[name] = v
+				}
+			}
+
+			status := kubernetesTokenReviewStatus{Authenticated: true, User: kubernetesReviewUser(user, groups, mapped)}
+			if len(spec.Audiences) > 0 {
+				status.Audiences = []string{audience}
+			}
+			return status, nil
+		}
+	}
+
+	audiences := []string{}
+	for _, a := range spec.Audiences {
+		if str.StringInSlice(a, k.Audiences) {
+			audiences = append(audiences, a)
+		}
+	}
+	if len(spec.Audiences) > 0 && len(audiences) == 0 {
+		return unauthenticated("Token is not valid for the requested audiences")
+	}
+
+	// Other tokens are passed to the token based providers like on an
+	// auth request for the configured host
+	authReq, err := http.NewRequest(http.MethodGet, "/auth", nil)
+	if err != nil {
+		return kubernetesTokenReviewStatus{}, err
+	}
+	defer context.Clear(authReq)
+
+	authReq.RemoteAddr = r.RemoteAddr
+	authReq.Header.Set("Authorization", "Token "+spec.Token)
+	if k.Host != "" {
+		authReq.Host = k.Host
+		authReq.Header.Set("X-Host", k.Host)
+	}
+
+	user, groups, err := detectUser(httptest.NewRecorder(), authReq)
+	switch {
+	case err == nil:
+		// Valid token
+	case errors.Is(err, errNoUser):
+		return unauthenticated("Token is invalid")
+	default:
+		return kubernetesTokenReviewStatus{}, err
+	}
+
+	if k.Host != "" {
+		allowed, err := hasAccess(user, groups, authReq, buildACLFieldSet(authReq))
+		if err != nil {
+			return kubernetesTokenReviewStatus{}, err
+		}
+		if !allowed {
+			return unauthenticated("Access denied for the cluster")
+		}
+	}
+
+	mappedUser, mappedGroups, claims, err := getMainConfig().ClaimsMapping.Apply(authReq, user, groups)
+	if err != nil {
+		return kubernetesTokenReviewStatus{}, fmt.Errorf("Unable to map claims: %s", err)
+	}
+
+	tokenGroups, err := getMainConfig().TokenGroups.Resolve(authReq, user, mappedGroups)
+	if err != nil {
+		return kubernetesTokenReviewStatus{}, fmt.Errorf("Unable to resolve token groups: %s", err)
+	}
+
+	status := kubernetesTokenReviewStatus{Authenticated: true, User: kubernetesReviewUser(mappedUser, tokenGroups, claims)}
+	if len(spec.Audiences) > 0 {
+		status.Audiences = audiences
+	}
+	return status, nil
+}
+
+func kubernetesReviewUser(user string, groups []string, claims map[string]string) *kubernetesTokenReviewUser {
+	u := &kubernetesTokenReviewUser{Username: user, Groups: groups}
+
+	if len(claims) > 0 {
+		u.Extra = map[string][]string{}
+		for name, v := range claims {
+			u.Extra[name] = []string{v}
+		}
+	}
+
+	return u
+}
+
+// handleKubernetesTokenReviewRequest implements the TokenReview
+// contract of the Kubernetes authentication webhook
+func handleKubernetesTokenReviewRequest(res http.ResponseWriter, r *http.Request) {
+	k := getMainConfig().KubernetesTokenReview
+	if !k.Enabled() {
+		http.NotFound(res, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !k.authorized(r) {
+		res.Header().Set("WWW-Authenticate", `Bearer realm="nginx-sso"`)
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	review := kubernetesTokenReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Kind != "TokenReview" {
+		http.Error(res, "Invalid TokenReview", http.StatusBadRequest)
+		return
+	}
+
+	status, err := k.Review(r, review.Spec)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to review token")
+		status = kubernetesTokenReviewStatus{Error: "Unable to review token"}
+	}
+
+	if review.APIVersion == "" {
+		review.APIVersion = kubernetesTokenReviewAPIVersion
+	}
+	review.Spec = kubernetesTokenReviewSpec{}
+	review.Status = status
+
+	if status.Authenticated {
+		getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "token review", "username": status.User.Username})
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(res).Encode(review); err != nil {
+		requestLog(r).WithError(err).Error("Unable to encode TokenReview")
+	}
+}
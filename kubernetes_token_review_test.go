@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKubernetesTokenReview(t *testing.T) {
+	p := oidcTestProvider(t)
+
+	activeOIDCProviderMutex.Lock()
+	prev := activeOIDCProvider
+	activeOIDCProvider = p
+	activeOIDCProviderMutex.Unlock()
+
+	prevCfg := getMainConfig().KubernetesTokenReview
+	getMainConfig().KubernetesTokenReview = kubernetesTokenReviewConfig{Tokens: []string{"apiserver"}}
+
+	defer func() {
+		activeOIDCProviderMutex.Lock()
+		activeOIDCProvider = prev
+		activeOIDCProviderMutex.Unlock()
+		getMainConfig().KubernetesTokenReview = prevCfg
+	}()
+
+	token, err := p.issueAccessToken("alice", []string{"admins"}, nil, "kubernetes", "openid groups", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+
+	review := func(auth, body string) (int, kubernetesTokenReview) {
+		r := httptest.NewRequest(http.MethodPost, kubernetesTokenReviewPath, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+auth)
+		rec := httptest.NewRecorder()
+		handleKubernetesTokenReviewRequest(rec, r)
+
+		result := kubernetesTokenReview{}
+		json.NewDecoder(rec.Body).Decode(&result)
+		return rec.Code, result
+	}
+
+	if code, _ := review("wrong", `{"kind":"TokenReview"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized API server to be rejected, got status %d", code)
+	}
+
+	code, result := review("apiserver", `{"apiVersion":"authentication.k8s.io/v1beta1","kind":"TokenReview","spec":{"token":"`+token+`","audiences":["kubernetes"]}}`)
+	if code != http.StatusOK || !result.Status.Authenticated {
+		t.Fatalf("Expected token to be authenticated, got status %d: %+v", code, result.Status)
+	}
+	if result.APIVersion != "authentication.k8s.io/v1beta1" || result.Spec.Token != "" {
+		t.Errorf("Expected API version to be kept and token to be omitted, got %+v", result)
+	}
+	if u := result.Status.User; u.Username != "alice" || len(u.Groups) != 1 || u.Groups[0] != "admins" {
+		t.Errorf("Unexpected user %+v", u)
+	}
+	if len(result.Status.Audiences) != 1 || result.Status.Audiences[0] != "kubernetes" {
+		t.Errorf("Expected audience to be returned, got %v", result.Status.Audiences)
+	}
+
+	if _, result := review("apiserver", `{"kind":"TokenReview","spec":{"token":"`+token+`","audiences":["other"]}}`); result.Status.Authenticated {
+		t.Error("Expected token for other audience to be rejected")
+	}
+
+	if _, result := review("apiserver", `{"kind":"TokenReview","spec":{"token":"invalid"}}`); result.Status.Authenticated || result.Status.Error == "" {
+		t.Errorf("Expected invalid token to be rejected, got %+v", result.Status)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v2"
+)
+
+const (
+	ldapPoolDefaultMaxIdle             = 8
+	ldapPoolDefaultIdleTimeout         = 5 * time.Minute
+	ldapPoolDefaultHealthCheckInterval = 30 * time.Second
+
+	// ldapPoolMinBackoff is the time to wait before connecting again after
+	// the first failed attempt, every further failure doubles the time up
+	// to ldapPoolMaxBackoff
+	ldapPoolMinBackoff = time.Second
+	ldapPoolMaxBackoff = 30 * time.Second
+)
+
+// ldapPoolConfig configures how connections to the LDAP server bound as
+// manager_dn are kept open for reuse
+type ldapPoolConfig struct {
+	MaxIdle             int           `yaml:"max_idle"`
+	IdleTimeout         time.Duration `yaml:"idle_timeout"`
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+}
+
+func (c *ldapPoolConfig) setDefaults() {
+	if c.MaxIdle == 0 {
+		c.MaxIdle = ldapPoolDefaultMaxIdle
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = ldapPoolDefaultIdleTimeout
+	}
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = ldapPoolDefaultHealthCheckInterval
+	}
+}
+
+// ldapPool keeps connections bound as manager_dn to not connect to the
+// server for every request. After a failed connect attempt further
+// attempts fail without connecting until the backoff passed.
+type ldapPool struct {
+	cfg ldapPoolConfig
+	// connect opens a new connection which is not yet bound
+	connect func(ctx context.Context) (*ldap.Conn, error)
+	// bind authenticates the connection as manager_dn
+	bind func(l *ldap.Conn) error
+
+	idle     []*ldapPoolConn
+	closed   bool
+	failures uint
+	retryAt  time.Time
+	lock     sync.Mutex
+}
+
+func newLDAPPool(cfg ldapPoolConfig, connect func(ctx context.Context) (*ldap.Conn, error), bind func(l *ldap.Conn) error) *ldapPool {
+	p := &ldapPool{
+		cfg:     cfg,
+		connect: connect,
+		bind:    bind,
+	}
+
+	// The connections are not needed anymore after the provider was
+	// replaced by a reload of the configuration
+	runtime.SetFinalizer(p, (*ldapPool).Close)
+
+	return p
+}
+
+// ldapPoolConn is a connection taken from the pool which is returned to
+// the pool using Close
+type ldapPoolConn struct {
+	*ldap.Conn
+
+	pool *ldapPool
+	// broken is set when an operation failed on network level
+	broken bool
+	// rebind is set when the connection was bound as another user and
+	// needs to be bound as manager_dn before using it again
+	rebind bool
+	// ctx is the context the connection is used for, stop cancels closing
+	// the connection when it ends
+	ctx  context.Context
+	stop func() bool
+	// used is the time the connection was returned to the pool
+	used time.Time
+}
+
+// Get returns an idle connection or connects to the server. The
+// connection is closed when the context ends which aborts pending
+// operations, the deadline of the context also applies to every
+// operation on the connection.
+func (p *ldapPool) Get(ctx context.Context) (*ldapPoolConn, error) {
+	for c := p.takeIdle(); c != nil; c = p.takeIdle() {
+		c.use(ctx)
+
+		var err error
+		switch {
+		case c.rebind:
+			err = p.bind(c.Conn)
+			c.rebind = false
+		case time.Since(c.used) > p.cfg.HealthCheckInterval:
+			err = c.ping()
+		}
+
+		if err == nil {
+			metricLDAPConnections.Inc("reused")
+			return c, nil
+		}
+		c.discard()
+	}
+
+	if err := p.checkBackoff(); err != nil {
+		metricLDAPConnections.Inc("failed")
+		return nil, err
+	}
+
+	l, err := p.connect(ctx)
+	if err != nil {
+		p.setConnectResult(false)
+		metricLDAPConnections.Inc("failed")
+		return nil, backendUnavailable(errors.Wrap(err, "Unable to connect to LDAP"))
+	}
+	p.setConnectResult(true)
+
+	c := &ldapPoolConn{Conn: l, pool: p}
+	c.use(ctx)
+	if err := p.bind(l); err != nil {
+		c.discard()
+		metricLDAPConnections.Inc("failed")
+		return nil, backendUnavailable(errors.Wrap(err, "Unable to authenticate with manager_dn"))
+	}
+
+	metricLDAPConnections.Inc("dialed")
+	return c, nil
+}
+
+// Close closes the idle connections, connections in use are closed when
+// they are returned
+func (p *ldapPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+
+	for _, c := range p.idle {
+		c.Conn.Close()
+	}
+	p.idle = nil
+}
+
+func (p *ldapPool) checkBackoff() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if wait := time.Until(p.retryAt); wait > 0 {
+		return backendUnavailable(errors.Errorf("Unable to connect to LDAP, retrying in %s", wait.Round(time.Millisecond)))
+	}
+	return nil
+}
+
+func (p *ldapPool) setConnectResult(success bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if success {
+		p.failures = 0
+		p.retryAt = time.Time{}
+		return
+	}
+
+	backoff := ldapPoolMaxBackoff
+	if p.failures < 5 {
+		backoff = ldapPoolMinBackoff << p.failures
+	}
+	p.failures++
+	p.retryAt = time.Now().Add(backoff)
+}
+
+// takeIdle returns the most recently used connection which did not
+// exceed the idle timeout
+func (p *ldapPool) takeIdle() *ldapPoolConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closeExpired()
+
+	if len(p.idle) == 0 {
+		return nil
+	}
+
+	c := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return c
+}
+
+func (p *ldapPool) put(c *ldapPoolConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closeExpired()
+
+	if p.closed || len(p.idle) >= p.cfg.MaxIdle {
+		c.Conn.Close()
+		return
+	}
+
+	c.used = time.Now()
+	p.idle = append(p.idle, c)
+}
+
+// closeExpired closes the connections exceeding the idle timeout, the
+// caller needs to hold the lock
+func (p *ldapPool) closeExpired() {
+	var n int
+	for n < len(p.idle) && time.Since(p.idle[n].used) > p.cfg.IdleTimeout {
+		p.idle[n].Conn.Close()
+		n++
+	}
+	p.idle = p.idle[n:]
+}
+
+// use applies the context to the connection
+func (c *ldapPoolConn) use(ctx context.Context) {
+	timeout := ldap.DefaultTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	c.Conn.SetTimeout(timeout)
+
+	c.ctx = ctx
+	if ctx.Done() != nil {
+		// Closing an already closed connection is a no-op
+		c.stop = context.AfterFunc(ctx, c.Conn.Close)
+	}
+}
+
+// ping checks the connection is still usable by reading the root DSE
+func (c *ldapPoolConn) ping() error {
+	_, err := c.Conn.Search(ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	))
+	return err
+}
+
+func (c *ldapPoolConn) discard() {
+	if c.stop != nil {
+		c.stop()
+	}
+	c.Conn.Close()
+}
+
+// Bind authenticates the connection as another user, the connection
+// is bound as manager_dn again before it is reused
+func (c *ldapPoolConn) Bind(username, password string) error {
+	c.rebind = true
+	err := c.Conn.Bind(username, password)
+	c.checkError(err)
+	return err
+}
+
+// Search executes the search on the connection
+func (c *ldapPoolConn) Search(sreq *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	sres, err := c.Conn.Search(sreq)
+	c.checkError(err)
+	return sres, err
+}
+
+func (c *ldapPoolConn) checkError(err error) {
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		c.broken = true
+	}
+}
+
+// Close returns the connection to the pool unless it was closed by the
+// context or is broken
+func (c *ldapPoolConn) Close() {
+	if c.stop != nil && !c.stop() {
+		// Context ended and closed the connection
+		return
+	}
+	c.stop = nil
+
+	if c.broken || c.ctx.Err() != nil {
+		c.Conn.Close()
+		return
+	}
+
+	c.pool.put(c)
+}
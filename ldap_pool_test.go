@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// testLDAPServer answers binds and searches with success and records the
+// operations done by the clients
+type testLDAPServer struct {
+	ln net.Listener
+
+	conns, searches int
+	binds           []string
+	lock            sync.Mutex
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	s := &testLDAPServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns++
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+
+		var resultTag ber.Tag
+		switch req := p.Children[1]; req.Tag {
+		case ldap.ApplicationBindRequest:
+			s.lock.Lock()
+			s.binds = append(s.binds, req.Children[1].Value.(string))
+			s.lock.Unlock()
+			resultTag = ldap.ApplicationBindResponse
+		case ldap.ApplicationSearchRequest:
+			s.lock.Lock()
+			s.searches++
+			s.lock.Unlock()
+			resultTag = ldap.ApplicationSearchResultDone
+		default:
+			return
+		}
+
+		res := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, p.Children[0].Value, "MessageID"))
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, resultTag, nil, "Result")
+		result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "Result Code"))
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+		res.AppendChild(result)
+
+		if _, err := conn.Write(res.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) stats() (int, int, []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.conns, s.searches, append([]string{}, s.binds...)
+}
+
+func TestLDAPPool(t *testing.T) {
+	s := newTestLDAPServer(t)
+	defer s.ln.Close()
+
+	a := &authLDAP{}
+	if err := a.Configure([]byte("providers:\n  ldap:\n    server: ldap://" + s.ln.Addr().String() + "\n    manager_dn: cn=manager\n    pool:\n      health_check_interval: 1h\n")); err != nil {
+		t.Fatalf("Unable to configure: %s", err)
+	}
+	defer a.pool.Close()
+
+	for i := 0; i < 3; i++ {
+		l, err := a.dial(context.Background())
+		if err != nil {
+			t.Fatalf("Unable to get connection: %s", err)
+		}
+		l.Close()
+	}
+	if conns, _, binds := s.stats(); conns != 1 || len(binds) != 1 {
+		t.Errorf("Expected one connection to be reused, got %d connections with binds %v", conns, binds)
+	}
+
+	// Connections bound as a user are bound as manager again on reuse
+	l, _ := a.dial(context.Background())
+	if err := l.Bind("uid=alice", "secret"); err != nil {
+		t.Fatalf("Unable to bind as user: %s", err)
+	}
+	l.Close()
+	l, _ = a.dial(context.Background())
+	l.Close()
+	if _, _, binds := s.stats(); strings.Join(binds, ",") != "cn=manager,uid=alice,cn=manager" {
+		t.Errorf("Expected connection to be bound as manager again, got binds %v", binds)
+	}
+
+	// Connections closed by their context are not reused
+	ctx, cancel := context.WithCancel(context.Background())
+	l, _ = a.dial(ctx)
+	cancel()
+	l.Close()
+	l, _ = a.dial(context.Background())
+	l.Close()
+	if conns, _, _ := s.stats(); conns != 2 {
+		t.Errorf("Expected new connection after context ended, got %d connections", conns)
+	}
+
+	// Idle connections are checked before reuse after the interval
+	a.pool.cfg.HealthCheckInterval = time.Nanosecond
+	l, _ = a.dial(context.Background())
+	l.Close()
+	if conns, searches, _ := s.stats(); conns != 2 || searches != 1 {
+		t.Errorf("Expected idle connection to be checked and reused, got %d connections and %d searches", conns, searches)
+	}
+
+	// Failed connects are not retried until the backoff passed
+	var attempts int
+	p := &ldapPool{
+		cfg: ldapPoolConfig{MaxIdle: 1},
+		connect: func(ctx context.Context) (*ldap.Conn, error) {
+			attempts++
+			return nil, errBackendUnavailable
+		},
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(context.Background()); err == nil {
+			t.Fatal("Expected connect to fail")
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("Expected one connect attempt during backoff, got %d", attempts)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// listenConfig describes where the HTTP listener is bound to: Either a
+// TCP address and port, an unix socket or a socket passed by systemd
+type listenConfig struct {
+	Addr          string `yaml:"addr"`
+	H2C           bool   `yaml:"h2c"`
+	Port          int    `yaml:"port"`
+	ProxyProtocol bool   `yaml:"proxy_protocol"`
+	ReusePort     bool   `yaml:"reuse_port"`
+	Socket        string `yaml:"socket"`
+	SocketGroup   string `yaml:"socket_group"`
+	SocketMode    string `yaml:"socket_mode"`
+	SystemdSocket string `yaml:"systemd_socket"`
+	TLSCertFile   string `yaml:"tls_cert_file"`
+	TLSKeyFile    string `yaml:"tls_key_file"`
+}
+
+func (l listenConfig) Validate() error {
+	if (l.TLSCertFile == "") != (l.TLSKeyFile == "") {
+		return fmt.Errorf("TLS certificate and key need to be set together")
+	}
+
+	if l.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(l.TLSCertFile, l.TLSKeyFile); err != nil {
+			return errors.Wrap(err, "Unable to load TLS certificate")
+		}
+	}
+
+	if l.SystemdSocket != "" && l.Socket != "" {
+		return fmt.Errorf("Socket and systemd socket are mutually exclusive")
+	}
+
+	if l.ReusePort && (l.Socket != "" || l.SystemdSocket != "") {
+		return fmt.Errorf("Port reuse is only supported on TCP listeners")
+	}
+
+	if l.Socket == "" {
+		return nil
+	}
+
+	if _, err := l.socketMode(); err != nil {
+		return err
+	}
+
+	if l.SocketGroup != "" {
+		if _, err := user.LookupGroup(l.SocketGroup); err != nil {
+			return errors.Wrap(err, "Unable to find socket group")
+		}
+	}
+
+	return nil
+}
+
+// TLSConfig returns the configuration to serve the listener using TLS
+// or nil if no certificate is configured. The certificate is reloaded
+// when the files change to pick up renewed certificates.
+func (l listenConfig) TLSConfig() (*tls.Config, error) {
+	if l.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := newTLSCertificateReloader(l.TLSCertFile, l.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+}
+
+// Serve opens the listener and serves the handler on it until the
+// listener fails or http.ErrServerClosed is returned after shutdown
+func (l listenConfig) Serve(handler http.Handler, tlsConfig *tls.Config) error {
+	listener, err := l.Listen()
+	if err != nil {
+		return errors.Wrap(err, "Unable to open listener")
+	}
+
+	return l.ServeListener(listener, handler, tlsConfig)
+}
+
+// ServeListener serves the handler on the already opened listener
+func (l listenConfig) ServeListener(listener net.Listener, handler http.Handler, tlsConfig *tls.Config) error {
+	srv := trackServer(&http.Server{Handler: handler, TLSConfig: tlsConfig, Protocols: l.protocols()})
+	if tlsConfig != nil {
+		// Certificates are provided by the TLS config
+		return srv.ServeTLS(listener, "", "")
+	}
+
+	return srv.Serve(listener)
+}
+
+// protocols returns the HTTP versions to serve: HTTP/2 is always served
+// on TLS listeners and additionally without TLS (h2c with prior
+// knowledge) if enabled
+func (l listenConfig) protocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(l.H2C)
+	return p
+}
+
+func (l listenConfig) socketMode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Socket mode %q is no valid octal permission", l.SocketMode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// String returns the address of the listener in a human readable form
+func (l listenConfig) String() string {
+	if l.Socket != "" {
+		return "unix:" + l.Socket
+	}
+
+	if l.SystemdSocket != "" {
+		return "systemd:" + l.SystemdSocket
+	}
+
+	return fmt.Sprintf("%s:%d", l.Addr, l.Port)
+}
+
+// Listen opens the configured TCP port or unix socket and enables the
+// PROXY protocol on it if configured
+func (l listenConfig) Listen() (net.Listener, error) {
+	listener, err := l.listen()
+	if err != nil || !l.ProxyProtocol {
+		return listener, err
+	}
+
+	return proxyProtocolListener{listener}, nil
+}
+
+// listen opens the configured TCP port or unix socket. A stale socket
+// left by a previous instance is removed before.
+func (l listenConfig) listen() (net.Listener, error) {
+	if l.SystemdSocket != "" {
+		return systemdListener(l.SystemdSocket)
+	}
+
+	if l.Socket == "" {
+		lc := net.ListenConfig{}
+		if l.ReusePort {
+			lc.Control = reusePortControl
+		}
+		return lc.Listen(context.Background(), "tcp", fmt.Sprintf("%s:%d", l.Addr, l.Port))
+	}
+
+	if stat, err := os.Stat(l.Socket); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Socket path %q exists and is no socket", l.Socket)
+		}
+		if err := os.Remove(l.Socket); err != nil {
+			return nil, errors.Wrap(err, "Unable to remove stale socket")
+		}
+	}
+
+	listener, err := net.Listen("unix", l.Socket)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.applySocketPermissions(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (l listenConfig) applySocketPermissions() error {
+	if l.SocketGroup != "" {
+		group, err := user.LookupGroup(l.SocketGroup)
+		if err != nil {
+			return errors.Wrap(err, "Unable to find socket group")
+		}
+
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			return errors.Wrap(err, "Unable to parse socket group ID")
+		}
+
+		if err := os.Chown(l.Socket, -1, gid); err != nil {
+			return errors.Wrap(err, "Unable to change socket group")
+		}
+	}
+
+	mode, err := l.socketMode()
+	if err != nil || mode == 0 {
+		return err
+	}
+
+	return errors.Wrap(os.Chmod(l.Socket, mode), "Unable to change socket mode")
+}
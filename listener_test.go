@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestH2CListener(t *testing.T) {
+	l := listenConfig{Addr: "127.0.0.1", H2C: true}
+
+	listener, err := l.Listen()
+	if err != nil {
+		t.Fatalf("Unable to open listener: %s", err)
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+			res.Write([]byte(r.Proto))
+		}),
+		Protocols: l.protocols(),
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	protos := new(http.Protocols)
+	protos.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protos}}
+
+	resp, err := client.Get("http://" + listener.Addr().String() + "/auth")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 response, got %s", resp.Proto)
+	}
+}
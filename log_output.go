@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultLogOutput = "fd://stderr"
+
+var (
+	// logOutputs keeps the opened outputs by their target to share them
+	// between the application and the audit log and to keep the state of
+	// the rotation across writes
+	logOutputs     = map[string]logOutput{}
+	logOutputsLock sync.Mutex
+)
+
+// logOutput is a destination for log lines. The level is used by
+// outputs having a notion of severity (like syslog).
+type logOutput interface {
+	WriteLevel(level log.Level, line []byte) error
+}
+
+// getLogOutput returns the output for the target URI:
+//
+//	fd://stdout, fd://stderr
+//	file:///var/log/nginx-sso.log?max_size=100M&max_age=24h&max_backups=7
+//	syslog://, syslog://logs.example.com:514?network=tcp&facility=auth&tag=nginx-sso
+func getLogOutput(target string) (logOutput, error) {
+	logOutputsLock.Lock()
+	defer logOutputsLock.Unlock()
+
+	if out, ok := logOutputs[target]; ok {
+		return out, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse target")
+	}
+
+	var out logOutput
+	switch u.Scheme {
+	case "fd":
+		out, err = newFDLogOutput(u.Host)
+	case "file":
+		out, err = newFileLogOutput(u.Path, u.Query())
+	case "syslog":
+		out, err = newSyslogLogOutput(u.Host, u.Query())
+	default:
+		err = errors.Errorf("Unsupported target scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logOutputs[target] = out
+	return out, nil
+}
+
+// configureLogOutput sends the application log to the comma separated
+// list of targets
+func configureLogOutput(targets string) error {
+	if targets == "" || targets == defaultLogOutput {
+		return nil
+	}
+
+	hook := &logOutputHook{}
+	for _, target := range strings.Split(targets, ",") {
+		out, err := getLogOutput(strings.TrimSpace(target))
+		if err != nil {
+			return errors.Wrapf(err, "Log output %q", target)
+		}
+		hook.outputs = append(hook.outputs, out)
+	}
+
+	log.SetOutput(ioutil.Discard)
+	log.AddHook(hook)
+	return nil
+}
+
+// logOutputHook writes the formatted entries to the outputs
+type logOutputHook struct {
+	outputs []logOutput
+}
+
+func (l *logOutputHook) Levels() []log.Level { return log.AllLevels }
+
+func (l *logOutputHook) Fire(entry *log.Entry) error {
+	line, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	for _, out := range l.outputs {
+		if err := out.WriteLevel(entry.Level, line); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write log entry: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+type fdLogOutput struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func newFDLogOutput(descriptor string) (*fdLogOutput, error) {
+	switch descriptor {
+	case "stdout":
+		return &fdLogOutput{w: os.Stdout}, nil
+	case "stderr":
+		return &fdLogOutput{w: os.Stderr}, nil
+	default:
+		return nil, errors.Errorf("Unsupported file descriptor %q", descriptor)
+	}
+}
+
+func (f *fdLogOutput) WriteLevel(_ log.Level, line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, err := f.w.Write(line)
+	return err
+}
+
+// fileLogOutput appends to a file and rotates it when it exceeds
+// maxSize or is older than maxAge. Without rotation settings the file
+// is reopened when it was moved (for example by logrotate).
+type fileLogOutput struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	lock   sync.Mutex
+}
+
+func newFileLogOutput(path string, params url.Values) (*fileLogOutput, error) {
+	f := &fileLogOutput{path: path}
+
+	if v := params.Get("max_size"); v != "" {
+		size, err := parseByteSize(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid max_size")
+		}
+		f.maxSize = size
+	}
+
+	if v := params.Get("max_age"); v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid max_age")
+		}
+		f.maxAge = age
+	}
+
+	if v := params.Get("max_backups"); v != "" {
+		backups, err := strconv.Atoi(v)
+		if err != nil || backups < 0 {
+			return nil, errors.Errorf("Invalid max_backups %q", v)
+		}
+		f.maxBackups = backups
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "Unable to create required paths")
+	}
+
+	return f, nil
+}
+
+func (f *fileLogOutput) WriteLevel(_ log.Level, line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.prepare(int64(len(line))); err != nil {
+		return err
+	}
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// prepare ensures an opened file able to take the next n bytes
+func (f *fileLogOutput) prepare(n int64) error {
+	if f.file != nil {
+		rotate := (f.maxSize > 0 && f.size > 0 && f.size+n > f.maxSize) ||
+			(f.maxAge > 0 && time.Since(f.opened) > f.maxAge)
+
+		switch {
+		case rotate:
+			if err := f.rotate(); err != nil {
+				return errors.Wrap(err, "Unable to rotate log file")
+			}
+		case f.maxSize == 0 && f.maxAge == 0 && f.moved():
+			f.file.Close()
+			f.file = nil
+		default:
+			return nil
+		}
+	}
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open log file")
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "Unable to stat log file")
+	}
+
+	f.file, f.size, f.opened = file, stat.Size(), time.Now()
+	return nil
+}
+
+func (f *fileLogOutput) moved() bool {
+	current, err := os.Stat(f.path)
+	if err != nil {
+		return true
+	}
+
+	opened, err := f.file.Stat()
+	return err != nil || !os.SameFile(current, opened)
+}
+
+// rotate moves the current file aside using the time of rotation as
+// suffix and removes the backups exceeding maxBackups
+func (f *fileLogOutput) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	if err := os.Rename(f.path, f.path+"."+time.Now().Format("20060102-150405.000")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if f.maxBackups == 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(f.path + ".[0-9]*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// parseByteSize parses sizes like 1024, 512K, 100M or 1G
+func parseByteSize(v string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, errors.Errorf("Size %q is invalid", v)
+	}
+
+	return size * multiplier, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestFileLogOutputRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-log-output")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "logs", "audit.jsonl")
+	out, err := newFileLogOutput(file, url.Values{"max_size": {"20"}, "max_backups": {"2"}})
+	if err != nil {
+		t.Fatalf("Unable to create output: %s", err)
+	}
+
+	for _, line := range []string{"0123456789\n", "abcdefghij\n", "klmnopqrst\n", "uvwxyz\n", "last\n"} {
+		if err := out.WriteLevel(log.InfoLevel, []byte(line)); err != nil {
+			t.Fatalf("Unable to write line: %s", err)
+		}
+		// Backups are named by the time of rotation
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if content, _ := ioutil.ReadFile(file); string(content) != "last\n" {
+		t.Errorf("Unexpected content of current file %q", content)
+	}
+	if backups, _ := filepath.Glob(file + ".*"); len(backups) != 2 {
+		t.Errorf("Expected 2 backups to be kept, got %v", backups)
+	}
+
+	for size, valid := range map[string]bool{"1024": true, "100M": true, "1g": true, "M": false, "-5": false} {
+		if _, err := parseByteSize(size); (err == nil) != valid {
+			t.Errorf("Unexpected result for size %q: %v", size, err)
+		}
+	}
+}
+
+func TestSyslogLogOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Syslog is not supported on windows")
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	out, err := newSyslogLogOutput(conn.LocalAddr().String(), url.Values{"facility": {"auth"}, "tag": {"sso-test"}})
+	if err != nil {
+		t.Fatalf("Unable to create output: %s", err)
+	}
+
+	if err := out.WriteLevel(log.WarnLevel, []byte("Login failed\n")); err != nil {
+		t.Fatalf("Unable to write: %s", err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Unable to read message: %s", err)
+	}
+
+	// auth (4) * 8 + warning (4)
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<36>") || !strings.Contains(msg, "sso-test") || !strings.Contains(msg, "Login failed") {
+		t.Errorf("Unexpected syslog message %q", msg)
+	}
+}
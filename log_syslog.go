@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/syslog"
+	"net/url"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"authpriv": syslog.LOG_AUTHPRIV, "local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogLogOutput sends log lines to the local syslog daemon (empty
+// address) or a remote one, the severity is derived from the log level
+type syslogLogOutput struct {
+	w *syslog.Writer
+}
+
+func newSyslogLogOutput(addr string, params url.Values) (*syslogLogOutput, error) {
+	facility := syslog.LOG_DAEMON
+	if v := params.Get("facility"); v != "" {
+		f, ok := syslogFacilities[v]
+		if !ok {
+			return nil, errors.Errorf("Unknown syslog facility %q", v)
+		}
+		facility = f
+	}
+
+	tag := params.Get("tag")
+	if tag == "" {
+		tag = "nginx-sso"
+	}
+
+	network := ""
+	if addr != "" {
+		network = params.Get("network")
+		if network == "" {
+			network = "udp"
+		}
+	}
+
+	w, err := syslog.Dial(network, addr, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to connect to syslog")
+	}
+
+	return &syslogLogOutput{w: w}, nil
+}
+
+func (s *syslogLogOutput) WriteLevel(level log.Level, line []byte) error {
+	msg := string(line)
+
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return s.w.Crit(msg)
+	case log.ErrorLevel:
+		return s.w.Err(msg)
+	case log.WarnLevel:
+		return s.w.Warning(msg)
+	case log.InfoLevel:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
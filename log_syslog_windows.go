@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type syslogLogOutput struct{}
+
+func newSyslogLogOutput(addr string, params url.Values) (*syslogLogOutput, error) {
+	return nil, fmt.Errorf("Syslog is not supported on windows")
+}
+
+func (s *syslogLogOutput) WriteLevel(level log.Level, line []byte) error { return nil }
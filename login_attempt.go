@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/pkg/errors"
+)
+
+const (
+	loginStatusSuccess            = "success"
+	loginStatusAccountLocked      = "account_locked"
+	loginStatusCaptchaRequired    = "captcha_required"
+	loginStatusDenied             = "denied"
+	loginStatusError              = "error"
+	loginStatusInvalidCredentials = "invalid_credentials"
+	loginStatusMFARequired        = "mfa_required"
+	loginStatusRateLimited        = "rate_limited"
+	loginStatusUnavailable        = "unavailable"
+
+	// loginResultMFAFailed is the result of logins with valid credentials
+	// rejected by the MFA validation
+	loginResultMFAFailed = "mfa_failed"
+)
+
+// loginOutcome describes the result of a login attempt independent of
+// the way it is presented to the client
+type loginOutcome struct {
+	Status string
+	User   string
+	// Wait is set for rate limited logins, locked accounts and providers
+	// at their concurrency limit
+	Wait time.Duration
+	// MFAProviders lists the providers of the MFA configs of the user
+	// if the status is mfa_required
+	MFAProviders []string
+	// Message is the translation key of the message attached to the
+	// error by the provider
+	Message string
+}
+
+// ErrorKey returns the key of the translated message describing the
+// failed login
+func (l loginOutcome) ErrorKey() string {
+	switch {
+	case l.Status == loginStatusSuccess:
+		return ""
+	case l.Message != "":
+		return l.Message
+	case l.Status == loginStatusError:
+		return "error_unexpected"
+	default:
+		return "error_" + l.Status
+	}
+}
+
+// errorMessage returns the message attached to the error by the
+// provider if it is a translated error message
+func errorMessage(r *http.Request, err error) string {
+	key := plugins.ErrorMessage(err)
+	if !strings.HasPrefix(key, "error_") {
+		return ""
+	}
+	if _, ok := getMainConfig().Frontend.Translations(getMainConfig().Frontend.Language(r))[key]; !ok {
+		return ""
+	}
+	return key
+}
+
+// attemptLogin checks the credentials and MFA tokens posted to the login
+// and sets the login cookie on success. When mfaStep is set a login of a
+// user with MFA configs without an MFA token does not fail but reports
+// the mfa_required status to let the client ask for the token and post
+// the credentials again.
+func attemptLogin(res http.ResponseWriter, r *http.Request, mfaStep bool) loginOutcome {
+	auditFields := map[string]string{
+		"go": r.FormValue("go"),
+	}
+
+	// fail publishes the failed login, the result is the label of the
+	// metric and the reason is written to the audit log
+	fail := func(user, provider, result, reason string) {
+		auditFields["reason"] = reason
+		publishEvent(authEvent{Type: auditEventLoginFailure, Request: r, User: user, Provider: provider, Result: result, Fields: auditFields})
+	}
+
+	if wait := getMainConfig().LoginRateLimit.Check(r); wait > 0 {
+		fail("", "", "rate_limited", "rate limited")
+		return loginOutcome{Status: loginStatusRateLimited, Wait: wait}
+	}
+
+	attemptedUser, provider := loginAttempt(r)
+	if wait := getMainConfig().AccountLockout.Locked(r, attemptedUser); wait > 0 {
+		fail("", "", "locked", "account locked")
+		getMainConfig().LoginFailureLog.Log(r, attemptedUser, provider, loginFailureAccountLocked)
+		return loginOutcome{Status: loginStatusAccountLocked, Wait: wait}
+	}
+
+	if getMainConfig().Captcha.Required(r, attemptedUser) {
+		if err := getMainConfig().Captcha.Verify(r); err != nil {
+			fail("", "", "captcha_failed", "captcha required")
+			requestLog(r).WithError(err).Debug("Login without solved CAPTCHA")
+			return loginOutcome{Status: loginStatusCaptchaRequired}
+		}
+	}
+
+	// Simple authentication
+	user, mfaCfgs, err := loginUser(res, r)
+	switch {
+	case errors.Is(err, errNoUser):
+		fail("", "", "invalid_credentials", "invalid credentials")
+		getMainConfig().LoginFailureLog.Log(r, attemptedUser, provider, loginFailureInvalidCredentials)
+		getMainConfig().AccountLockout.RecordFailure(r, attemptedUser)
+		getMainConfig().Captcha.RecordFailure(r, attemptedUser)
+		return loginOutcome{Status: loginStatusInvalidCredentials, Message: errorMessage(r, err)}
+	case errors.Is(err, errBackendUnavailable):
+		// Not counted as failed attempt as the user can't do anything about it
+		auditFields["error"] = err.Error()
+		fail("", "", "unavailable", "backend unavailable")
+		requestLog(r).WithError(err).Error("Login failed as the backend is not available")
+		return loginOutcome{Status: loginStatusUnavailable, Message: errorMessage(r, err), Wait: providerRetryAfter(err)}
+	case err == nil:
+		// Don't handle for now, MFA validation comes first
+	default:
+		auditFields["error"] = err.Error()
+		fail("", "", "error", "error")
+		requestLog(r).WithError(err).Error("Login failed with unexpected error")
+		return loginOutcome{Status: loginStatusError}
+	}
+
+	m, _ := getSessionMeta(r)
+
+	// MFA validation against configs from login
+	err = validateMFA(res, r, user, mfaCfgs)
+	switch {
+	case errors.Is(err, errMFARequired) && mfaStep:
+		publishEvent(authEvent{Type: auditEventMFARequired, Request: r, User: user, Provider: m.Provider, Result: "mfa_required", Fields: auditFields})
+		res.Header().Del("Set-Cookie") // Remove login cookie
+		return loginOutcome{Status: loginStatusMFARequired, MFAProviders: mfaProviderIDs(mfaCfgs)}
+
+	case errors.Is(err, errNoUser):
+		fail(user, m.Provider, loginResultMFAFailed, "invalid credentials")
+		getMainConfig().LoginFailureLog.Log(r, user, m.Provider, loginFailureInvalidMFA)
+		getMainConfig().AccountLockout.RecordFailure(r, attemptedUser)
+		getMainConfig().Captcha.RecordFailure(r, attemptedUser)
+		res.Header().Del("Set-Cookie") // Remove login cookie
+		return loginOutcome{Status: loginStatusInvalidCredentials, Message: errorMessage(r, err)}
+
+	case errors.Is(err, errBackendUnavailable):
+		auditFields["error"] = err.Error()
+		fail(user, m.Provider, "unavailable", "backend unavailable")
+		requestLog(r).WithError(err).Error("MFA validation failed as the backend is not available")
+		res.Header().Del("Set-Cookie") // Remove login cookie
+		return loginOutcome{Status: loginStatusUnavailable, Message: errorMessage(r, err), Wait: providerRetryAfter(err)}
+
+	case err == nil:
+		hook, err := getMainConfig().Hooks.Run(r, hookStagePostLogin, user, nil)
+		switch {
+		case err != nil:
+			auditFields["error"] = err.Error()
+			fail(user, m.Provider, "error", "error")
+			requestLog(r).WithError(err).Error("Unable to run post-login hooks")
+			res.Header().Del("Set-Cookie") // Remove login cookie
+			return loginOutcome{Status: loginStatusError}
+
+		case hook.Deny:
+			reason := hook.Reason
+			if reason == "" {
+				reason = "denied by hook"
+			}
+			fail(user, m.Provider, "denied", reason)
+			res.Header().Del("Set-Cookie") // Remove login cookie
+			return loginOutcome{Status: loginStatusDenied}
+		}
+		for k, v := range hook.ResponseHeaders {
+			res.Header().Set(k, v)
+		}
+
+		getMainConfig().AccountLockout.RecordSuccess(r, attemptedUser)
+		getMainConfig().Captcha.RecordSuccess(r, attemptedUser)
+		publishEvent(authEvent{Type: auditEventLoginSuccess, Request: r, User: user, Provider: m.Provider, Result: "success", Fields: auditFields})
+		return loginOutcome{Status: loginStatusSuccess, User: user}
+
+	default:
+		auditFields["error"] = err.Error()
+		fail(user, m.Provider, "error", "error")
+		requestLog(r).WithError(err).Error("Login failed with unexpected error")
+		res.Header().Del("Set-Cookie") // Remove login cookie
+		return loginOutcome{Status: loginStatusError}
+	}
+}
+
+// hasMFAToken checks whether an MFA token was posted for any of the
+// login methods
+func hasMFAToken(r *http.Request) bool {
+	for key, values := range r.PostForm {
+		if strings.HasSuffix(key, mfaLoginFieldName) && len(values) > 0 && values[0] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// mfaProviderIDs returns the distinct providers of the MFA configs
+func mfaProviderIDs(mfaCfgs []mfaConfig) []string {
+	var (
+		ids  []string
+		seen = map[string]bool{}
+	)
+	for _, c := range mfaCfgs {
+		if !seen[c.Provider] {
+			seen[c.Provider] = true
+			ids = append(ids, c.Provider)
+		}
+	}
+	return ids
+}
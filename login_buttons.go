@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// loginButtonConfig controls how an external login provider is shown on
+// the login page
+type loginButtonConfig struct {
+	Icon  string `yaml:"icon"`
+	Order int    `yaml:"order"`
+}
+
+// validateLoginButtons ensures the icons can't be used to inject links
+// into the login page
+func validateLoginButtons(buttons map[string]loginButtonConfig) error {
+	for id, b := range buttons {
+		if b.Icon == "" {
+			continue
+		}
+		if err := validateFrontendLink(b.Icon); err != nil {
+			return errors.Wrapf(err, "Icon of %q is invalid", id)
+		}
+	}
+	return nil
+}
+
+// loginButton is passed to the login template for every active external
+// login provider
+type loginButton struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Icon string `json:"icon,omitempty"`
+	URL  string `json:"url"`
+}
+
+// getLoginButtons returns the buttons of the external login providers
+// of the request ordered by their configured order and their ID
+func getLoginButtons(r *http.Request) []loginButton {
+	var (
+		names   = requestLoginNames(r)
+		buttons = []loginButton{}
+		order   = map[string]int{}
+	)
+
+	for _, a := range requestAuthenticators(r) {
+		if _, ok := a.(externalLoginProvider); !ok {
+			continue
+		}
+
+		id := a.AuthenticatorID()
+		b := loginButton{
+			ID:   id,
+			Name: id,
+			Icon: getMainConfig().Login.Buttons[id].Icon,
+			URL: "/login?" + url.Values{
+				"go":       {r.URL.Query().Get("go")},
+				"provider": {id},
+			}.Encode(),
+		}
+		if name, ok := names[id]; ok {
+			b.Name = name
+		}
+
+		buttons = append(buttons, b)
+		order[id] = getMainConfig().Login.Buttons[id].Order
+	}
+
+	sort.Slice(buttons, func(i, j int) bool {
+		if oi, oj := order[buttons[i].ID], order[buttons[j].ID]; oi != oj {
+			return oi < oj
+		}
+		return buttons[i].ID < buttons[j].ID
+	})
+
+	return buttons
+}
+
+// startExternalLogin sends the user to the identity provider of the
+// external login provider selected by its button
+func startExternalLogin(res http.ResponseWriter, r *http.Request, id string) {
+	var provider externalLoginProvider
+	for _, a := range requestAuthenticators(r) {
+		if p, ok := a.(externalLoginProvider); ok && a.AuthenticatorID() == id {
+			provider = p
+			break
+		}
+	}
+
+	if provider == nil {
+		http.Error(res, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	target, err := provider.ExternalLoginURL(res, r, r.URL.Query().Get("go"))
+	if err != nil {
+		requestLog(r).WithError(err).WithField("provider", id).Error("Unable to start external login")
+		http.Redirect(res, r, loginRedirect(r, "error_unexpected"), http.StatusFound)
+		return
+	}
+
+	http.Redirect(res, r, target, http.StatusFound)
+}
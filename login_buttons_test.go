@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testExternalLogin struct {
+	authToken
+	id string
+}
+
+func (t testExternalLogin) AuthenticatorID() string { return t.id }
+
+func (t testExternalLogin) ExternalLoginURL(res http.ResponseWriter, r *http.Request, returnTo string) (string, error) {
+	if t.id == "broken" {
+		return "", errors.New("IdP unreachable")
+	}
+	return "https://" + t.id + ".example.com/authorize?state=" + returnTo, nil
+}
+
+func TestLoginButtons(t *testing.T) {
+	prevLogin, prevFrontend, prevAuthenticators := getMainConfig().Login, getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().Login, getMainConfig().Frontend = prevLogin, prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+
+	setAuthenticators([]authenticator{
+		&authSimple{},
+		&testExternalLogin{id: "github"},
+		&testExternalLogin{id: "google"},
+		&testExternalLogin{id: "broken"},
+	})
+	getMainConfig().Login.Names = map[string]string{"github": "GitHub", "google": "Google"}
+	getMainConfig().Login.Buttons = map[string]loginButtonConfig{
+		"google": {Icon: "/static/google.svg", Order: -1},
+	}
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/login?go=https://app.example.com/", nil)
+	buttons := getLoginButtons(r)
+	if len(buttons) != 3 {
+		t.Fatalf("Expected 3 buttons, got %d", len(buttons))
+	}
+	for i, id := range []string{"google", "broken", "github"} {
+		if buttons[i].ID != id {
+			t.Errorf("Expected button %d to be %s, got %s", i, id, buttons[i].ID)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	handleLoginRequest(res, r)
+	for _, expect := range []string{
+		`<img src="/static/google.svg"`,
+		"Sign in with Google",
+		"Sign in with GitHub",
+		`href="/login?go=https%3A%2F%2Fapp.example.com%2F&amp;provider=github"`,
+		"simple-username",
+	} {
+		if !strings.Contains(res.Body.String(), expect) {
+			t.Errorf("Expected %q in login page", expect)
+		}
+	}
+
+	for query, expect := range map[string]string{
+		"go=https://app.example.com/&provider=github": "https://github.example.com/authorize?state=https://app.example.com/",
+		"go=https://app.example.com/&provider=broken": "/login?error=error_unexpected&go=https%3A%2F%2Fapp.example.com%2F",
+	} {
+		res := httptest.NewRecorder()
+		handleLoginRequest(res, httptest.NewRequest(http.MethodGet, "/login?"+query, nil))
+		if res.Code != http.StatusFound || res.Header().Get("Location") != expect {
+			t.Errorf("Expected redirect to %q for %s, got status %d to %q", expect, query, res.Code, res.Header().Get("Location"))
+		}
+	}
+
+	res = httptest.NewRecorder()
+	handleLoginRequest(res, httptest.NewRequest(http.MethodGet, "/login?provider=simple", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected form provider to be rejected, got status %d", res.Code)
+	}
+
+	if err := validateLoginButtons(map[string]loginButtonConfig{"github": {Icon: "javascript:alert(1)"}}); err == nil {
+		t.Error("Expected script icon to be rejected")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const loginConfirmPath = "/login/confirm"
+
+// postLoginRedirect returns where to send the user after the login: The
+// confirmation page if enabled, otherwise the terms if they need to be
+// accepted or the target itself
+func postLoginRedirect(r *http.Request, user, target string) string {
+	if getMainConfig().Login.ConfirmIdentity {
+		return loginConfirmPath + "?go=" + url.QueryEscape(target)
+	}
+	return getMainConfig().Terms.Redirect(r, user, target)
+}
+
+// handleLoginConfirmRequest shows the logged in user, their groups and
+// the host they are about to be sent to so users of shared devices can
+// switch to their own account instead of continuing with a foreign one
+func handleLoginConfirmRequest(res http.ResponseWriter, r *http.Request) {
+	if !getMainConfig().Login.ConfirmIdentity {
+		http.NotFound(res, r)
+		return
+	}
+
+	if !validateRedirect(res, r) {
+		return
+	}
+	target := r.FormValue("go")
+
+	user, groups, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Show the confirmation below
+
+	case errors.Is(err, errNoUser):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(target), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	host := requestHost(r)
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("login_confirm.html"))
+	body, err := tpl.ExecuteBytes(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"continue":   getMainConfig().Terms.Redirect(r, user, target),
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"groups":     groups,
+		"host":       host,
+		"login":      requestLoginSettings(r),
+		"switch":     "/login?go=" + url.QueryEscape(target),
+		"user":       user,
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The page shows the identity and must not be kept on shared devices
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Write(body)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginConfirm(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	prevLogin, prevFrontend, prevAuthenticators := getMainConfig().Login, getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().Login, getMainConfig().Frontend = prevLogin, prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{
+		EnableBasicAuth: true,
+		Users:           map[string]string{"alice": string(hash)},
+		Groups:          map[string][]string{"admins": {"alice"}},
+	}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	target := "https://app.example.com/dashboard"
+	r := httptest.NewRequest(http.MethodGet, loginConfirmPath+"?go=https%3A%2F%2Fapp.example.com%2Fdashboard", nil)
+	r.SetBasicAuth("alice", "secret")
+
+	if u := postLoginRedirect(r, "alice", target); u != target {
+		t.Errorf("Expected target without confirmation, got %s", u)
+	}
+	res := httptest.NewRecorder()
+	handleLoginConfirmRequest(res, r)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("Expected disabled confirmation page to be missing, got %d", res.Code)
+	}
+
+	getMainConfig().Login.ConfirmIdentity = true
+	if u := postLoginRedirect(r, "alice", target); u != loginConfirmPath+"?go=https%3A%2F%2Fapp.example.com%2Fdashboard" {
+		t.Errorf("Expected redirect to the confirmation page, got %s", u)
+	}
+
+	res = httptest.NewRecorder()
+	handleLoginConfirmRequest(res, r)
+	body := res.Body.String()
+	for _, expect := range []string{
+		"<strong>alice</strong>",
+		`<span class="label label-default">admins</span>`,
+		"<strong>app.example.com</strong>",
+		`href="https://app.example.com/dashboard"`,
+		`name="go" value="/login?go=https%3A%2F%2Fapp.example.com%2Fdashboard"`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("Expected confirmation page to contain %s", expect)
+		}
+	}
+	if res.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected confirmation page not to be cached")
+	}
+
+	res = httptest.NewRecorder()
+	handleLoginConfirmRequest(res, httptest.NewRequest(http.MethodGet, loginConfirmPath+"?go=%2Fsessions", nil))
+	if res.Code != http.StatusFound || res.Header().Get("Location") != "/login?go=%2Fsessions" {
+		t.Errorf("Expected redirect to the login without user, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+}
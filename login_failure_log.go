@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	loginFailureAccountLocked      = "account_locked"
+	loginFailureInvalidCredentials = "invalid_credentials"
+	loginFailureInvalidMFA         = "invalid_mfa"
+)
+
+// loginFailureLog writes failed logins in a stable single line
+// format to be parsed by tools like fail2ban or CrowdSec:
+//
+//	2006-01-02T15:04:05Z nginx-sso login failure: ip=203.0.113.7 user="alice" provider=simple reason=invalid_credentials
+type loginFailureLog struct {
+	Target string `yaml:"target"`
+}
+
+// Validate checks the target, only local targets are supported as the
+// line format is meant to be read by tools on the same host
+func (l loginFailureLog) Validate() error {
+	if l.Target == "" {
+		return nil
+	}
+
+	u, err := url.Parse(l.Target)
+	if err != nil {
+		return errors.Wrap(err, "Unable to parse target")
+	}
+
+	switch u.Scheme {
+	case "fd", "file", "syslog":
+		return nil
+	default:
+		return errors.Errorf("Unsupported target scheme %q", u.Scheme)
+	}
+}
+
+// Log writes the failure of the user to log in. The IP is determined
+// like for the audit log, configure trusted_proxies to prevent clients
+// from getting others banned by sending forged headers.
+func (l loginFailureLog) Log(r *http.Request, user, provider, reason string) {
+	if l.Target == "" {
+		return
+	}
+
+	if provider == "" {
+		provider = "-"
+	}
+
+	line := fmt.Sprintf("%s nginx-sso login failure: ip=%s user=%s provider=%s reason=%s\n",
+		time.Now().UTC().Format(time.RFC3339),
+		getMainConfig().AuditLog.findIP(r),
+		strconv.Quote(user),
+		provider,
+		reason,
+	)
+
+	out, err := getLogOutput(l.Target)
+	if err == nil {
+		err = out.WriteLevel(log.WarnLevel, []byte(line))
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to write login failure")
+	}
+}
+
+// loginAttempt returns the user and the provider the login form was
+// submitted for. The user is empty for providers without username (like
+// yubikey).
+func loginAttempt(r *http.Request) (string, string) {
+	for _, a := range requestAuthenticators(r) {
+		prefix := a.AuthenticatorID() + "-"
+		if user := r.PostFormValue(prefix + "username"); user != "" {
+			return user, a.AuthenticatorID()
+		}
+
+		for field, values := range r.PostForm {
+			if strings.HasPrefix(field, prefix) && len(values) > 0 && values[0] != "" {
+				return "", a.AuthenticatorID()
+			}
+		}
+	}
+
+	return "", ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLoginFailureLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-failure-log")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	prev := getAuthenticatorSnapshot()
+	setAuthenticators([]authenticator{&authToken{}, &authSimple{}})
+	defer authenticatorState.Store(prev)
+
+	file := filepath.Join(dir, "failures.log")
+	l := loginFailureLog{Target: "file://" + file}
+	if err := l.Validate(); err != nil {
+		t.Fatalf("Unable to validate target: %s", err)
+	}
+
+	form := url.Values{"simple-username": {"bob\nip=198.51.100.1"}, "simple-password": {"wrong"}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "203.0.113.7:51234"
+
+	user, provider := loginAttempt(r)
+	if provider != "simple" {
+		t.Errorf("Expected login attempt for simple provider, got %q", provider)
+	}
+	l.Log(r, user, provider, loginFailureInvalidCredentials)
+
+	content, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected the failure on one line, got %q", content)
+	}
+
+	// Pattern of a fail2ban filter with <HOST> replaced
+	filter := regexp.MustCompile(`^\S+ nginx-sso login failure: ip=(\S+) user=".*" provider=simple reason=invalid_credentials$`)
+	if m := filter.FindStringSubmatch(lines[0]); m == nil || m[1] != "203.0.113.7" {
+		t.Errorf("Unexpected failure line %q", lines[0])
+	}
+
+	if err := (loginFailureLog{Target: "https://example.com"}).Validate(); err == nil {
+		t.Error("Expected remote target to be rejected")
+	}
+}
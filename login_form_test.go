@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginFormWithoutJavaScript(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	prevLogin, prevFrontend, prevAuthenticators := getMainConfig().Login, getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().Login, getMainConfig().Frontend = prevLogin, prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{Users: map[string]string{"alice": string(hash)}}, &authYubikey{}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().Login.DefaultMethod = "unknown"
+	getMainConfig().Login.Names = map[string]string{"simple": "Username / Password", "yubikey": "Yubikey"}
+
+	render := func(target string) string {
+		res := httptest.NewRecorder()
+		handleLoginRequest(res, httptest.NewRequest(http.MethodGet, target, nil))
+		return res.Body.String()
+	}
+
+	// Without a usable default method the first one is shown instead of none
+	if body := render("/login"); !strings.Contains(body, `class="tab-pane active" id="simple"`) {
+		t.Error("Expected first method to be shown")
+	}
+
+	getMainConfig().Login.DefaultMethod = "yubikey"
+	body := render("/login?go=https%3A%2F%2Fapp.example.com%2F")
+	if !strings.Contains(body, `class="tab-pane active" id="yubikey"`) {
+		t.Error("Expected default method to be shown")
+	}
+	if !strings.Contains(body, `href="/login?method=simple&amp;go=https%3A%2F%2Fapp.example.com%2F&amp;lang=en"`) {
+		t.Error("Expected tabs to link to the page showing the method")
+	}
+
+	// A failed login shows the form used for the attempt again
+	csrf := strings.Repeat("c", 43)
+	form := url.Values{
+		csrfFieldName:     {csrf},
+		"method":          {"simple"},
+		"simple-username": {"alice"},
+		"simple-password": {"wrong"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: getMainConfig().GetCookieName(r, csrfCookieSuffix), Value: csrf})
+	res := httptest.NewRecorder()
+	handleLoginRequest(res, r)
+
+	location := res.Header().Get("Location")
+	if res.Code != http.StatusFound || !strings.Contains(location, "method=simple") {
+		t.Fatalf("Expected redirect keeping the method, got %d %s", res.Code, location)
+	}
+	if body := render(location); !strings.Contains(body, `class="tab-pane active" id="simple"`) {
+		t.Error("Expected method of the failed attempt to be shown")
+	}
+}
+
+func TestLoginFormAccessibility(t *testing.T) {
+	prevLogin, prevFrontend, prevAuthenticators := getMainConfig().Login, getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().Login, getMainConfig().Frontend = prevLogin, prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{}, &authYubikey{}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().Login.Names = map[string]string{"simple": "Username / Password", "yubikey": "Yubikey"}
+
+	res := httptest.NewRecorder()
+	handleLoginRequest(res, httptest.NewRequest(http.MethodGet, "/login?error=error_invalid_credentials&method=simple", nil))
+	body := res.Body.String()
+
+	for _, expect := range []string{
+		// The failure is part of the title and announced as alert
+		"<title>The login failed, please check your credentials - ",
+		`role="alert" id="login-error"`,
+		`id="tab-simple" aria-controls="simple" aria-selected="true"`,
+		`id="tab-yubikey" aria-controls="yubikey" aria-selected="false"`,
+		`aria-labelledby="tab-yubikey"`,
+		`autocomplete="current-password"`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("Expected login page to contain %s", expect)
+		}
+	}
+
+	// The focus is placed on the first field of the failed form
+	focus := strings.Index(body, `autofocus aria-invalid="true" aria-describedby="login-error"`)
+	if strings.Count(body, "autofocus") != 1 || focus < strings.Index(body, `id="simple-username"`) || focus > strings.Index(body, `id="simple-password"`) {
+		t.Error("Expected the username field to be focused")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	loginJSONMaxBodySize = 64 * 1024
+
+	loginStatusInvalidRequest = "invalid_request"
+	loginStatusLoginRequired  = "login_required"
+)
+
+// loginJSONResponse is sent to clients using the JSON login API
+type loginJSONResponse struct {
+	Status       string                  `json:"status"`
+	Error        string                  `json:"error,omitempty"`
+	User         string                  `json:"user,omitempty"`
+	Redirect     string                  `json:"redirect,omitempty"`
+	RetryAfter   int                     `json:"retry_after,omitempty"`
+	MFAProviders []string                `json:"mfa_providers,omitempty"`
+	Methods      map[string][]loginField `json:"methods,omitempty"`
+	Buttons      []loginButton           `json:"buttons,omitempty"`
+	Captcha      *loginJSONCaptcha       `json:"captcha,omitempty"`
+}
+
+// loginJSONCaptcha describes the challenge the client needs to render
+// and the field to post its response in
+type loginJSONCaptcha struct {
+	Script  string `json:"script"`
+	Class   string `json:"class"`
+	SiteKey string `json:"site_key"`
+	Field   string `json:"field"`
+}
+
+var loginJSONStatusCodes = map[string]int{
+	loginStatusSuccess:            http.StatusOK,
+	loginStatusLoginRequired:      http.StatusOK,
+	loginStatusAccountLocked:      http.StatusTooManyRequests,
+	loginStatusCaptchaRequired:    http.StatusForbidden,
+	loginStatusDenied:             http.StatusForbidden,
+	loginStatusError:              http.StatusInternalServerError,
+	loginStatusInvalidCredentials: http.StatusUnauthorized,
+	loginStatusInvalidRequest:     http.StatusBadRequest,
+	loginStatusMFARequired:        http.StatusUnauthorized,
+	loginStatusRateLimited:        http.StatusTooManyRequests,
+	loginStatusUnavailable:        http.StatusServiceUnavailable,
+}
+
+// isJSONRequest checks whether the client drives the login or password
+// change through the JSON API instead of the forms
+func isJSONRequest(r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return mediaType == "application/json"
+	}
+	return wantsJSON(r)
+}
+
+// handleLoginJSONRequest lists the login methods on GET and logs the
+// user in using the credentials posted as JSON object on POST
+func handleLoginJSONRequest(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		res.Header().Set("Allow", "GET, POST")
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := parseJSONLoginForm(r); err != nil {
+			writeLoginJSON(res, loginJSONResponse{Status: loginStatusInvalidRequest, Error: err.Error()})
+			return
+		}
+	}
+
+	target := r.FormValue("go")
+	if err := getMainConfig().Redirect.Validate(target); err != nil {
+		requestLog(r).WithError(err).WithField("go", target).Warn("Rejected redirect target")
+		writeLoginJSON(res, loginJSONResponse{Status: loginStatusInvalidRequest, Error: "Invalid redirect target"})
+		return
+	}
+
+	if user, _, err := detectUser(res, r); err == nil {
+		// There is already a valid user
+		writeLoginJSON(res, loginJSONResponse{Status: loginStatusSuccess, User: user, Redirect: postLoginRedirect(r, user, target)})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeLoginJSON(res, loginJSONResponse{
+			Status:  loginStatusLoginRequired,
+			Methods: translateLoginFields(getMainConfig().Frontend.Translations(getMainConfig().Frontend.Language(r)), getFrontendAuthenticators(r)),
+			Buttons: getLoginButtons(r),
+			Captcha: loginCaptcha(r, false),
+		})
+		return
+	}
+
+	o := attemptLogin(res, r, true)
+	resp := loginJSONResponse{
+		Status:       o.Status,
+		User:         o.User,
+		MFAProviders: o.MFAProviders,
+		Captcha:      loginCaptcha(r, o.Status == loginStatusCaptchaRequired),
+	}
+
+	switch o.Status {
+	case loginStatusSuccess:
+		resp.Redirect = postLoginRedirect(r, o.User, target)
+	case loginStatusRateLimited, loginStatusAccountLocked, loginStatusUnavailable:
+		if o.Wait > 0 {
+			resp.RetryAfter = int(math.Ceil(o.Wait.Seconds()))
+			res.Header().Set("Retry-After", strconv.Itoa(resp.RetryAfter))
+		}
+	}
+
+	if key := o.ErrorKey(); key != "" {
+		resp.Error = getMainConfig().Frontend.Translate(r, key)
+	}
+
+	writeLoginJSON(res, resp)
+}
+
+// loginCaptcha returns the challenge the client needs to solve for the
+// next login or nil if there is none (yet)
+func loginCaptcha(r *http.Request, required bool) *loginJSONCaptcha {
+	if getMainConfig().Captcha.Provider == "" || (!required && getMainConfig().Captcha.Widget(r) == nil) {
+		return nil
+	}
+
+	p := getMainConfig().Captcha.provider()
+	return &loginJSONCaptcha{Script: p.Script, Class: p.Class, SiteKey: getMainConfig().Captcha.SiteKey, Field: p.Field}
+}
+
+// parseJSONLoginForm fills the form of the request from the JSON object
+// in its body to let the authenticators read the credentials from the
+// same fields as in the login form
+func parseJSONLoginForm(r *http.Request) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, loginJSONMaxBodySize))
+	dec.UseNumber()
+
+	var body map[string]interface{}
+	if err := dec.Decode(&body); err != nil {
+		return errors.Wrap(err, "Unable to parse body")
+	}
+
+	form := url.Values{}
+	for key, value := range body {
+		switch v := value.(type) {
+		case string:
+			form.Set(key, v)
+		case bool:
+			form.Set(key, strconv.FormatBool(v))
+		case json.Number:
+			form.Set(key, v.String())
+		case nil:
+			// Treated as not set
+		default:
+			return errors.Errorf("Field %q needs to be a string, number or boolean", key)
+		}
+	}
+
+	// Posted values take precedence over the query as in ParseForm
+	r.PostForm = form
+	r.Form = url.Values{}
+	for key, values := range form {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+	for key, values := range r.URL.Query() {
+		r.Form[key] = append(r.Form[key], values...)
+	}
+
+	return nil
+}
+
+func writeLoginJSON(res http.ResponseWriter, resp loginJSONResponse) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(loginJSONStatusCodes[resp.Status])
+	json.NewEncoder(res).Encode(resp)
+}
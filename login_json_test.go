@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginJSON(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	totp := newMFAConfig("google", map[string]interface{}{"secret": "JBSWY3DPEHPK3PXP"})
+
+	prevAuthenticators, prevMFA := getAuthenticatorSnapshot(), activeMFAProviders
+	defer func() {
+		activeMFAProviders = prevMFA
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{
+		Users: map[string]string{"alice": string(hash), "bob": string(hash)},
+		MFA:   map[string][]mfaConfig{"bob": {totp}},
+	}})
+	activeMFAProviders = []mfaProvider{mfaGoogle{}}
+
+	m := mainConfig{}
+	m.Cookie.AuthKey = "cookie-key-for-the-login-api-test"
+	if err := cookieStore.Configure(&m); err != nil {
+		t.Fatalf("Unable to configure cookie store: %s", err)
+	}
+
+	login := func(method, contentType, body string) (*httptest.ResponseRecorder, loginJSONResponse) {
+		r := httptest.NewRequest(method, "/login?go=https://app.example.com/", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Accept", "application/json")
+
+		res := httptest.NewRecorder()
+		handleLoginRequest(res, r)
+
+		var resp loginJSONResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatalf("Unable to decode response to %s %s: %s", method, body, err)
+		}
+		return res, resp
+	}
+
+	res, resp := login(http.MethodGet, "", "")
+	if resp.Status != loginStatusLoginRequired || len(resp.Methods["simple"]) != 3 || resp.Methods["simple"][0].Name != "username" {
+		t.Errorf("Expected login methods, got %#v", resp)
+	}
+
+	for body, expect := range map[string]struct {
+		code   int
+		status string
+	}{
+		`{"simple-username":"alice","simple-password":"wrong"}`:                       {http.StatusUnauthorized, loginStatusInvalidCredentials},
+		`{"simple-username":"alice","simple-password":"secret","remember-me":true}`:   {http.StatusOK, loginStatusSuccess},
+		`{"simple-username":"bob","simple-password":"secret"}`:                        {http.StatusUnauthorized, loginStatusMFARequired},
+		`{"simple-username":"bob","simple-password":"secret","simple-mfa-token":"1"}`: {http.StatusUnauthorized, loginStatusInvalidCredentials},
+		`{"simple-username":["alice"]}`:                                               {http.StatusBadRequest, loginStatusInvalidRequest},
+		`{"simple-username":`:                                                         {http.StatusBadRequest, loginStatusInvalidRequest},
+	} {
+		res, resp := login(http.MethodPost, "application/json; charset=utf-8", body)
+		if res.Code != expect.code || resp.Status != expect.status {
+			t.Errorf("Expected status %d / %s for %s, got %d / %#v", expect.code, expect.status, body, res.Code, resp)
+		}
+		if resp.Status != loginStatusSuccess && res.Header().Get("Set-Cookie") != "" {
+			t.Errorf("Expected no login cookie for %s", body)
+		}
+
+		switch resp.Status {
+		case loginStatusSuccess:
+			if resp.User != "alice" || resp.Redirect != "https://app.example.com/" {
+				t.Errorf("Unexpected successful login %#v", resp)
+			}
+		case loginStatusMFARequired:
+			if len(resp.MFAProviders) != 1 || resp.MFAProviders[0] != "google" || resp.Error == "" {
+				t.Errorf("Expected MFA providers of bob, got %#v", resp)
+			}
+		}
+	}
+
+	token, _ := mfaGoogle{}.exec(totp)
+	res, resp = login(http.MethodPost, "application/json", `{"simple-username":"bob","simple-password":"secret","simple-mfa-token":"`+token+`"}`)
+	if res.Code != http.StatusOK || resp.User != "bob" || res.Header().Get("Set-Cookie") == "" {
+		t.Errorf("Expected login with MFA token to succeed, got %d / %#v", res.Code, resp)
+	}
+
+	// Form logins keep failing without the intermediate MFA state
+	csrfToken := strings.Repeat("a", 43)
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("simple-username=bob&simple-password=secret&csrf_token="+csrfToken))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: getMainConfig().GetCookieName(r, csrfCookieSuffix), Value: csrfToken})
+	res = httptest.NewRecorder()
+	handleLoginRequest(res, r)
+	if res.Code != http.StatusFound || !strings.Contains(res.Header().Get("Location"), "error_invalid_credentials") {
+		t.Errorf("Expected form login to redirect with an error, got %d to %q", res.Code, res.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const loginRateLimitKeyPrefix = "nginx-sso:login-rate-limit:"
+
+var (
+	// loginRateLimitStores keeps the stores by their URI to keep buckets
+	// and connections across reloads
+	loginRateLimitStores     = map[string]rateLimitStore{}
+	loginRateLimitStoresLock sync.Mutex
+)
+
+// loginRateLimit limits the login attempts per client IP and per
+// attempted username using token buckets
+type loginRateLimit struct {
+	Store   string       `yaml:"store"`
+	PerIP   *tokenBucket `yaml:"per_ip"`
+	PerUser *tokenBucket `yaml:"per_user"`
+}
+
+// tokenBucket allows Burst attempts at once, afterwards Rate attempts
+// per Interval are allowed
+type tokenBucket struct {
+	Rate     int           `yaml:"rate"`
+	Interval time.Duration `yaml:"interval"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (t tokenBucket) Validate() error {
+	if t.Rate < 1 {
+		return errors.New("Rate must be at least 1")
+	}
+	if t.Interval <= 0 {
+		return errors.New("Interval must be set")
+	}
+	if t.Burst < 0 {
+		return errors.New("Burst must not be negative")
+	}
+	return nil
+}
+
+func (t tokenBucket) size() float64 {
+	if t.Burst == 0 {
+		return float64(t.Rate)
+	}
+	return float64(t.Burst)
+}
+
+// tokensPerSecond returns the refill rate of the bucket
+func (t tokenBucket) tokensPerSecond() float64 {
+	return float64(t.Rate) / t.Interval.Seconds()
+}
+
+// ttl returns the time an empty bucket needs to be full again, after
+// that its state can be forgotten
+func (t tokenBucket) ttl() time.Duration {
+	return time.Duration(t.size() / t.tokensPerSecond() * float64(time.Second))
+}
+
+func (l loginRateLimit) Validate() error {
+	if l.PerIP != nil {
+		if err := l.PerIP.Validate(); err != nil {
+			return errors.Wrap(err, "Invalid per_ip limit")
+		}
+	}
+	if l.PerUser != nil {
+		if err := l.PerUser.Validate(); err != nil {
+			return errors.Wrap(err, "Invalid per_user limit")
+		}
+	}
+
+	if l.Store == "" || l.Store == "memory" {
+		return nil
+	}
+
+	_, err := parseRedisURI(l.Store)
+	return err
+}
+
+// Check takes a token from the buckets of the client IP and the
+// attempted username and returns the time the client needs to wait if
+// one of them is empty. If the store is not available the attempt is
+// not limited.
+func (l loginRateLimit) Check(r *http.Request) time.Duration {
+	if l.PerIP == nil && l.PerUser == nil {
+		return 0
+	}
+
+	store, err := getRateLimitStore(getMainConfig().Cluster.storeFor(l.Store))
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to access login rate limit store")
+		return 0
+	}
+
+	type check struct {
+		key    string
+		bucket *tokenBucket
+	}
+
+	checks := []check{{"ip:" + getMainConfig().trustedClientIP(r), l.PerIP}}
+	if user, _ := loginAttempt(r); user != "" {
+		// Usernames are matched case-insensitive by most providers
+		checks = append(checks, check{"user:" + strings.ToLower(user), l.PerUser})
+	}
+
+	for _, c := range checks {
+		if c.bucket == nil {
+			continue
+		}
+
+		wait, err := store.Take(loginRateLimitKeyPrefix+c.key, *c.bucket, time.Now())
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to check login rate limit")
+			return 0
+		}
+		if wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// writeTooManyRequests answers the request with a 429 status and the
+// Retry-After header in seconds
+func writeTooManyRequests(res http.ResponseWriter, wait time.Duration, message string) {
+	res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(res, message, http.StatusTooManyRequests)
+}
+
+type rateLimitStore interface {
+	// Take removes a token from the bucket of the key and returns zero
+	// or, if the bucket is empty, the time until the next token is
+	// available
+	Take(key string, bucket tokenBucket, now time.Time) (time.Duration, error)
+}
+
+func getRateLimitStore(store string) (rateLimitStore, error) {
+	loginRateLimitStoresLock.Lock()
+	defer loginRateLimitStoresLock.Unlock()
+
+	if s, ok := loginRateLimitStores[store]; ok {
+		return s, nil
+	}
+
+	var s rateLimitStore
+	if store == "" || store == "memory" {
+		s = newMemoryRateLimitStore()
+	} else {
+		c, err := getRedisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		s = redisRateLimitStore{c}
+	}
+
+	loginRateLimitStores[store] = s
+	return s, nil
+}
+
+type memoryRateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	expires time.Time
+}
+
+type memoryRateLimitStore struct {
+	buckets map[string]memoryRateLimitBucket
+	lock    sync.Mutex
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	m := &memoryRateLimitStore{buckets: map[string]memoryRateLimitBucket{}}
+	go m.cleanup()
+	return m
+}
+
+func (m *memoryRateLimitStore) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for key, b := range m.buckets {
+			if b.expires.Before(time.Now()) {
+				delete(m.buckets, key)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *memoryRateLimitStore) Take(key string, bucket tokenBucket, now time.Time) (time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = memoryRateLimitBucket{tokens: bucket.size(), updated: now}
+	}
+
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(bucket.size(), b.tokens+elapsed.Seconds()*bucket.tokensPerSecond())
+		b.updated = now
+	}
+
+	var wait time.Duration
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		wait = time.Duration(math.Ceil((1-b.tokens)/bucket.tokensPerSecond()*1000)) * time.Millisecond
+	}
+
+	b.expires = now.Add(bucket.ttl())
+	m.buckets[key] = b
+
+	return wait, nil
+}
+
+// redisRateLimitScript implements the same token bucket as the memory
+// store atomically within Redis, times are passed in milliseconds
+const redisRateLimitScript = `
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local size, rate, now, ttl = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local tokens = tonumber(state[1]) or size
+local updated = tonumber(state[2]) or now
+if now > updated then
+  tokens = math.min(size, tokens + (now - updated) * rate)
+  updated = now
+end
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(updated))
+redis.call('PEXPIRE', KEYS[1], ttl)
+return wait
+`
+
+// redisRateLimitStore keeps the buckets in Redis to share the limits
+// between all instances using the same Redis
+type redisRateLimitStore struct {
+	client *redisClient
+}
+
+func (r redisRateLimitStore) Take(key string, bucket tokenBucket, now time.Time) (time.Duration, error) {
+	reply, err := r.client.Do("EVAL", redisRateLimitScript, "1", key,
+		strconv.FormatFloat(bucket.size(), 'f', -1, 64),
+		strconv.FormatFloat(bucket.tokensPerSecond()/1000, 'f', -1, 64),
+		strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+		strconv.FormatInt(int64(bucket.ttl()/time.Millisecond)+1, 10),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	wait, ok := reply.(int64)
+	if !ok {
+		return 0, errors.Errorf("Unexpected reply %v", reply)
+	}
+
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginRateLimitMemory(t *testing.T) {
+	bucket := tokenBucket{Rate: 1, Interval: time.Minute, Burst: 2}
+	store := newMemoryRateLimitStore()
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := store.Take("ip:203.0.113.7", bucket, now); wait != 0 {
+			t.Errorf("Expected attempt %d within burst to be allowed", i+1)
+		}
+	}
+
+	if wait, _ := store.Take("ip:203.0.113.7", bucket, now); wait != time.Minute {
+		t.Errorf("Expected to wait a minute for the next token, got %s", wait)
+	}
+	if wait, _ := store.Take("ip:198.51.100.1", bucket, now); wait != 0 {
+		t.Error("Expected other clients not to be limited")
+	}
+	if wait, _ := store.Take("ip:203.0.113.7", bucket, now.Add(time.Minute)); wait != 0 {
+		t.Error("Expected the bucket to be refilled after the interval")
+	}
+}
+
+func TestLoginRateLimitCheck(t *testing.T) {
+	prev := getAuthenticatorSnapshot()
+	setAuthenticators([]authenticator{&authSimple{}})
+	defer authenticatorState.Store(prev)
+
+	l := loginRateLimit{
+		PerIP:   &tokenBucket{Rate: 10, Interval: time.Minute},
+		PerUser: &tokenBucket{Rate: 1, Interval: time.Hour},
+	}
+	if err := l.Validate(); err != nil {
+		t.Fatalf("Unable to validate rate limit: %s", err)
+	}
+
+	attempt := func(user string) time.Duration {
+		form := url.Values{"simple-username": {user}, "simple-password": {"wrong"}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.10:51234"
+		return l.Check(r)
+	}
+
+	if wait := attempt("Mallory"); wait != 0 {
+		t.Fatal("Expected first attempt to be allowed")
+	}
+	if wait := attempt("mallory"); wait <= 59*time.Minute {
+		t.Errorf("Expected username to be limited regardless of case, got wait %s", wait)
+	}
+	if wait := attempt("trent"); wait != 0 {
+		t.Error("Expected other username to be allowed")
+	}
+
+	// Rotating a header not passed by a trusted proxy does not reset the
+	// limit of the IP
+	l = loginRateLimit{PerIP: &tokenBucket{Rate: 1, Interval: time.Hour}}
+	for i, expectLimited := range []bool{false, true} {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = "192.0.2.11:51234"
+		r.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i+1))
+		if limited := l.Check(r) > 0; limited != expectLimited {
+			t.Errorf("Expected attempt %d limited=%v, got %v", i+1, expectLimited, limited)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	writeTooManyRequests(res, 1500*time.Millisecond, "Too many login attempts")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "2" {
+		t.Errorf("Unexpected response %d with Retry-After %q", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	if err := (loginRateLimit{Store: "memcache://localhost"}).Validate(); err == nil {
+		t.Error("Expected unsupported store to be rejected")
+	}
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	var (
+		commands = make(chan []string, 3)
+		replies  = []string{"+OK\r\n", "+OK\r\n", ":1500\r\n"}
+	)
+	addr, closeServer := serveFakeRedis(t, func(cmd []string) string {
+		commands <- cmd
+		reply := replies[0]
+		replies = replies[1:]
+		return reply
+	})
+	defer closeServer()
+
+	u, _ := url.Parse("redis://:secret@" + addr + "/2")
+	c, err := newRedisClient(u)
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+
+	wait, err := redisRateLimitStore{c}.Take("ip:203.0.113.7", tokenBucket{Rate: 5, Interval: time.Minute}, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("Unable to take token: %s", err)
+	}
+	if wait != 1500*time.Millisecond {
+		t.Errorf("Expected wait of 1.5s, got %s", wait)
+	}
+
+	for _, expect := range []string{"AUTH secret", "SELECT 2", "EVAL"} {
+		if cmd := strings.Join(<-commands, " "); !strings.HasPrefix(cmd, expect) {
+			t.Errorf("Expected command %q, got %q", expect, cmd)
+		}
+	}
+}
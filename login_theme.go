@@ -0,0 +1,21 @@
+package main
+
+import "github.com/pkg/errors"
+
+const (
+	loginThemeAuto  = "auto"
+	loginThemeLight = "light"
+	loginThemeDark  = "dark"
+)
+
+// validateLoginTheme ensures the default theme of the login page is one
+// the page knows how to render. An empty theme follows the preference
+// of the operating system like auto does.
+func validateLoginTheme(theme string) error {
+	switch theme {
+	case "", loginThemeAuto, loginThemeLight, loginThemeDark:
+		return nil
+	default:
+		return errors.Errorf("Unsupported theme %q, use auto, light or dark", theme)
+	}
+}
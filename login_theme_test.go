@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const loginThemeTestConfig = `
+realms:
+  a:
+    hosts: ["a.example.com"]
+    login:
+      theme: %q
+    providers:
+      simple:
+        users:
+          jane: "$2a$04$CN2vDCYsRmNTxJFH1sJB3eYPiKPSYZi6iVR0h0lmfF2fS0.ybD9cW"
+`
+
+func TestLoginTheme(t *testing.T) {
+	if err := validateLoginTheme("sepia"); err == nil {
+		t.Error("Expected unknown theme to be rejected")
+	}
+	if _, err := loadRealms([]byte(fmt.Sprintf(loginThemeTestConfig, "black")), ""); err == nil {
+		t.Error("Expected unknown realm theme to be rejected")
+	}
+
+	realms, err := loadRealms([]byte(fmt.Sprintf(loginThemeTestConfig, "dark")), "")
+	if err != nil {
+		t.Fatalf("Unable to load realms: %s", err)
+	}
+	setRealms(realms)
+	defer setRealms(nil)
+
+	prevFrontend := getMainConfig().Frontend
+	defer func() { getMainConfig().Frontend = prevFrontend }()
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	for host, theme := range map[string]string{
+		"login.example.com": `data-theme="auto"`,
+		"a.example.com":     `data-theme="dark"`,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/login", nil)
+		r.Header.Set("X-Host", host)
+		res := httptest.NewRecorder()
+		handleLoginRequest(res, r)
+		if !strings.Contains(res.Body.String(), theme) {
+			t.Errorf("Expected login page of %s to use %s, got %d", host, theme, res.Code)
+		}
+	}
+}
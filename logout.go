@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/flosch/pongo2"
+)
+
+// logoutConfig controls where the user is sent after logging out and
+// whether sessions at upstream identity providers are terminated
+type logoutConfig struct {
+	DefaultRedirect string `yaml:"default_redirect"`
+	Upstream        bool   `yaml:"upstream"`
+}
+
+func (l logoutConfig) Validate(redirect redirectConfig) error {
+	return redirect.Validate(l.DefaultRedirect)
+}
+
+// upstreamEnabled returns whether the upstream session should be
+// terminated for this request: The `upstream` parameter overrides the
+// configured default
+func (l logoutConfig) upstreamEnabled(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.FormValue("upstream")); err == nil {
+		return v
+	}
+	return l.Upstream
+}
+
+// redirectTarget returns the validated `go` parameter of the request or
+// the configured default redirect
+func (l logoutConfig) redirectTarget(r *http.Request) string {
+	if target := r.FormValue("go"); target != "" {
+		return target
+	}
+	return l.DefaultRedirect
+}
+
+// upstreamLogoutUser terminates the sessions of the user at the
+// identity providers backing the active authenticators. Failures are
+// logged but do not prevent the local logout. If a provider requires
+// the user to visit its logout endpoint the URL is returned.
+func upstreamLogoutUser(res http.ResponseWriter, r *http.Request, returnTo string) string {
+	var redirect string
+	for _, a := range requestAuthenticators(r) {
+		u, ok := a.(upstreamLogouter)
+		if !ok {
+			continue
+		}
+
+		target, err := u.UpstreamLogout(res, r, returnTo)
+		if err != nil {
+			requestLog(r).WithError(err).WithField("provider", a.AuthenticatorID()).Error("Failed to terminate upstream session")
+			continue
+		}
+
+		if target != "" && redirect == "" {
+			redirect = target
+		}
+	}
+
+	return redirect
+}
+
+// confirmLogout protects the logout against forged requests: Posted
+// logouts need a valid CSRF token, logins of users following a logout
+// link from another site are only terminated after they confirmed the
+// logout. It reports whether the logout may continue.
+func confirmLogout(res http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		if !getMainConfig().CSRF.Valid(r) {
+			requestLog(r).Warn("Rejected logout without valid CSRF token")
+			http.Error(res, "Invalid CSRF token, please reload the page", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	if getMainConfig().CSRF.sameSite(r) {
+		return true
+	}
+
+	if _, _, err := detectUser(res, r); err != nil {
+		// There is no login to protect
+		return true
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("logout.html"))
+	if err := tpl.ExecuteWriter(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"everywhere": r.FormValue("everywhere") == "true",
+		"go":         r.FormValue("go"),
+		"login":      getMainConfig().Login,
+		"upstream":   r.FormValue("upstream"),
+	}, res); err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testUpstreamAuthenticator struct {
+	authToken
+
+	called   bool
+	returnTo string
+}
+
+func (t *testUpstreamAuthenticator) UpstreamLogout(res http.ResponseWriter, r *http.Request, returnTo string) (string, error) {
+	t.called = true
+	t.returnTo = returnTo
+	return "https://idp.example.com/logout", nil
+}
+
+func TestLogoutTarget(t *testing.T) {
+	cfg := logoutConfig{DefaultRedirect: "https://example.com/bye", Upstream: true}
+
+	for _, tc := range []struct {
+		url      string
+		target   string
+		upstream bool
+	}{
+		{"/logout", "https://example.com/bye", true},
+		{"/logout?go=/dashboard", "/dashboard", true},
+		{"/logout?upstream=false", "https://example.com/bye", false},
+		{"/logout?upstream=invalid", "https://example.com/bye", true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if target := cfg.redirectTarget(r); target != tc.target {
+			t.Errorf("URL %q: Expected target %q, got %q", tc.url, tc.target, target)
+		}
+		if upstream := cfg.upstreamEnabled(r); upstream != tc.upstream {
+			t.Errorf("URL %q: Expected upstream=%v, got %v", tc.url, tc.upstream, upstream)
+		}
+	}
+}
+
+func TestUpstreamLogout(t *testing.T) {
+	a := &testUpstreamAuthenticator{}
+
+	prev := getAuthenticatorSnapshot()
+	setAuthenticators([]authenticator{&authToken{}, a})
+	defer authenticatorState.Store(prev)
+
+	r := httptest.NewRequest(http.MethodGet, "/logout", nil)
+	redirect := upstreamLogoutUser(httptest.NewRecorder(), r, "https://example.com/bye")
+
+	if !a.called || a.returnTo != "https://example.com/bye" {
+		t.Errorf("Expected upstream logout to be called with return target, got called=%v returnTo=%q", a.called, a.returnTo)
+	}
+	if redirect != "https://idp.example.com/logout" {
+		t.Errorf("Expected redirect to upstream logout, got %q", redirect)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	smtpTLSStartTLS = "starttls"
+	smtpTLSImplicit = "tls"
+	smtpTLSNone     = "none"
+
+	smtpDialTimeout = 10 * time.Second
+)
+
+// smtpConfig describes the mail server used to send mails to the users
+type smtpConfig struct {
+	Server   string `yaml:"server"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	TLS      string `yaml:"tls"`
+}
+
+func (s smtpConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(s.Server); err != nil {
+		return errors.Wrap(err, "Server needs to be in host:port format")
+	}
+
+	switch s.TLS {
+	case "", smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return errors.Errorf("Unsupported TLS mode %q, use starttls, tls or none", s.TLS)
+	}
+
+	if s.Username != "" && s.TLS == smtpTLSNone {
+		return errors.New("Credentials must not be sent without TLS")
+	}
+
+	return nil
+}
+
+// Send delivers a plain text mail to the recipient
+func (s smtpConfig) Send(from *mail.Address, to, subject, body string) error {
+	host, _, _ := net.SplitHostPort(s.Server)
+	tlsConfig := &tls.Config{ServerName: host}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	if s.TLS == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.Server)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to connect to mail server")
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "Unable to start SMTP session")
+	}
+	defer c.Close()
+
+	if s.TLS == "" || s.TLS == smtpTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("Mail server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return errors.Wrap(err, "Unable to start TLS")
+		}
+	}
+
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return errors.Wrap(err, "Unable to authenticate at mail server")
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return errors.Wrap(err, "Mail server rejected sender")
+	}
+	if err := c.Rcpt(to); err != nil {
+		return errors.Wrap(err, "Mail server rejected recipient")
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrap(err, "Unable to send mail")
+	}
+	if _, err := w.Write(buildMail(from, to, subject, body)); err != nil {
+		return errors.Wrap(err, "Unable to send mail")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "Unable to send mail")
+	}
+
+	return c.Quit()
+}
+
+// buildMail creates the message including the headers with the body
+// encoded as quoted-printable
+func buildMail(from *mail.Address, to, subject, body string) []byte {
+	msgID := make([]byte, 16)
+	rand.Read(msgID)
+
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	buf := new(bytes.Buffer)
+	for _, h := range [][2]string{
+		{"From", from.String()},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(msgID), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+		{"Auto-Submitted", "auto-generated"},
+	} {
+		fmt.Fprintf(buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+
+	return buf.Bytes()
+}
+
+// signMailToken encodes the claims into a token for links sent by mail.
+// The purpose is part of the signature to keep tokens of one flow from
+// being accepted by another one sharing the secret.
+func signMailToken(secret, purpose string, claims interface{}) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to marshal claims")
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + mailTokenSignature(secret, purpose, payload), nil
+}
+
+// verifyMailToken checks the signature of the token and decodes the
+// claims into the target
+func verifyMailToken(secret, purpose, token string, claims interface{}) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(mailTokenSignature(secret, purpose, parts[0])), []byte(parts[1])) {
+		return false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Unmarshal(data, claims) == nil
+}
+
+func mailTokenSignature(secret, purpose, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
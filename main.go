@@ -2,74 +2,204 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/flosch/pongo2"
 	"github.com/gorilla/context"
 	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/Luzifer/rconfig"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
 )
 
 type mainConfig struct {
-	ACL      acl         `yaml:"acl"`
-	AuditLog auditLogger `yaml:"audit_log"`
-	Cookie   struct {
-		Domain  string `yaml:"domain"`
-		AuthKey string `yaml:"authentication_key"`
-		Expire  int    `yaml:"expire"`
-		Prefix  string `yaml:"prefix"`
-		Secure  bool   `yaml:"secure"`
-	}
-	Listen struct {
-		Addr string `yaml:"addr"`
-		Port int    `yaml:"port"`
-	} `yaml:"listen"`
-	Login struct {
-		Title         string            `yaml:"title"`
-		DefaultMethod string            `yaml:"default_method"`
-		HideMFAField  bool              `yaml:"hide_mfa_field"`
-		Names         map[string]string `yaml:"names"`
+	AccountLockout     accountLockoutConfig     `yaml:"account_lockout"`
+	Admin              adminConfig              `yaml:"admin"`
+	AuditLog           auditLogger              `yaml:"audit_log"`
+	AuthCache          authCacheConfig          `yaml:"auth_cache"`
+	AuthFailure        authFailureConfig        `yaml:"auth_failure"`
+	Authorization      authorizationConfig      `yaml:"authorization"`
+	Banner             bannerConfig             `yaml:"banner"`
+	BasicAuthChallenge basicAuthChallengeConfig `yaml:"basic_auth_challenge"`
+	Captcha            captchaConfig            `yaml:"captcha"`
+	CORS               corsConfig               `yaml:"cors"`
+	CSRF               csrfConfig               `yaml:"csrf"`
+	ClaimsMapping      claimsMappingConfig      `yaml:"claims_mapping"`
+	Cluster            clusterConfig            `yaml:"cluster"`
+	Cookie             struct {
+		Domain      string      `yaml:"domain"`
+		AuthKey     string      `yaml:"authentication_key"`
+		Keys        []cookieKey `yaml:"keys"`
+		KeyRotation struct {
+			Interval time.Duration `yaml:"interval"`
+			Keep     int           `yaml:"keep"`
+		} `yaml:"key_rotation"`
+		Expire int                  `yaml:"expire"`
+		Format string               `yaml:"format"`
+		Hosts  []cookieHostOverride `yaml:"hosts"`
+		JWT    struct {
+			Issuer      string   `yaml:"issuer"`
+			SigningKeys []string `yaml:"signing_keys"`
+		} `yaml:"jwt"`
+		PASETO struct {
+			Issuer string   `yaml:"issuer"`
+			Keys   []string `yaml:"keys"`
+		} `yaml:"paseto"`
+		Prefix    string                            `yaml:"prefix"`
+		Providers map[string]cookieProviderOverride `yaml:"providers"`
+		SameSite  string                            `yaml:"same_site"`
+		Secure    bool                              `yaml:"secure"`
+	}
+	DetectCache           detectCacheConfig           `yaml:"detect_cache"`
+	EmbeddedLogin         embeddedLoginConfig         `yaml:"embedded_login"`
+	EnvoyAuthz            envoyAuthzConfig            `yaml:"envoy_ext_authz"`
+	ErrorReporting        errorReportingConfig        `yaml:"error_reporting"`
+	Frontend              frontendConfig              `yaml:"frontend"`
+	GeoIP                 geoIPConfig                 `yaml:"geoip"`
+	GroupCache            groupCacheConfig            `yaml:"group_cache"`
+	Hooks                 hooksConfig                 `yaml:"hooks"`
+	HTTPTransports        httpTransportsConfig        `yaml:"http_transports"`
+	IdentityAssertion     identityAssertionConfig     `yaml:"identity_assertion"`
+	IdentityHeaders       identityHeadersConfig       `yaml:"identity_headers"`
+	IPFilter              ipFilterConfig              `yaml:"ip_filter"`
+	KubernetesTokenReview kubernetesTokenReviewConfig `yaml:"kubernetes_token_review"`
+	Listen                mainListenConfig            `yaml:"listen"`
+	Login                 struct {
+		Title             string                       `yaml:"title"`
+		Buttons           map[string]loginButtonConfig `yaml:"buttons"`
+		ConfirmIdentity   bool                         `yaml:"confirm_identity"`
+		DefaultMethod     string                       `yaml:"default_method"`
+		HideMFAField      bool                         `yaml:"hide_mfa_field"`
+		HideRememberMe    bool                         `yaml:"hide_remember_me"`
+		Names             map[string]string            `yaml:"names"`
+		RememberMeDefault bool                         `yaml:"remember_me_default"`
+		Theme             string                       `yaml:"theme"`
 	} `yaml:"login"`
+	LoginFailureLog    loginFailureLog       `yaml:"login_failure_log"`
+	LoginRateLimit     loginRateLimit        `yaml:"login_rate_limit"`
+	Logout             logoutConfig          `yaml:"logout"`
+	Metrics            metricsConfig         `yaml:"metrics"`
+	OIDCProvider       oidcProviderConfig    `yaml:"oidc_provider"`
+	PasswordPolicy     passwordPolicyConfig  `yaml:"password_policy"`
+	PasswordReset      passwordResetConfig   `yaml:"password_reset"`
+	Plugins            pluginsConfig         `yaml:"plugins"`
+	ProviderLimits     providerLimitsConfig  `yaml:"provider_limits"`
+	ProviderTimeout    time.Duration         `yaml:"provider_timeout"`
+	Redirect           redirectConfig        `yaml:"redirect"`
+	Registration       registrationConfig    `yaml:"registration"`
+	Roles              acl.RoleMapping       `yaml:"roles"`
+	SCIM               scimConfig            `yaml:"scim"`
+	Secrets            secretsConfig         `yaml:"secrets"`
+	SecurityHeaders    securityHeadersConfig `yaml:"security_headers"`
+	SessionBinding     sessionBindingConfig  `yaml:"session_binding"`
+	SessionHeaders     bool                  `yaml:"session_headers"`
+	SessionStore       sessionStoreConfig    `yaml:"session_store"`
+	ShutdownTimeout    time.Duration         `yaml:"shutdown_timeout"`
+	Terms              termsConfig           `yaml:"terms"`
+	TokenGroups        tokenGroupsConfig     `yaml:"token_groups"`
+	Tracing            tracingConfig         `yaml:"tracing"`
+	TrustedProxies     []string              `yaml:"trusted_proxies"`
+	TrustedProxyHeader string                `yaml:"trusted_proxy_header"`
+	Webhooks           webhooksConfig        `yaml:"webhooks"`
+
+	trustedProxyNets []*net.IPNet
 }
 
-func (m *mainConfig) GetSessionOpts() *sessions.Options {
-	return &sessions.Options{
+// GetCookieKeys returns the list of keys to use for the cookie store.
+// The legacy authentication_key is treated as the last entry of the
+// keys list.
+func (m *mainConfig) GetCookieKeys() []cookieKey {
+	keys := append([]cookieKey{}, m.Cookie.Keys...)
+	if m.Cookie.AuthKey != "" {
+		keys = append(keys, cookieKey{AuthKey: m.Cookie.AuthKey})
+	}
+	return keys
+}
+
+// GetSessionOpts returns the cookie options for the given
+// authenticator respecting the host and provider overrides
+func (m *mainConfig) GetSessionOpts(r *http.Request, authenticatorID string) *sessions.Options {
+	opts := &sessions.Options{
 		Path:     "/",
 		Domain:   m.Cookie.Domain,
 		MaxAge:   m.Cookie.Expire,
 		Secure:   m.Cookie.Secure,
 		HttpOnly: true,
 	}
+
+	if o := m.getCookieHostOverride(r); o != nil && o.Domain != "" {
+		opts.Domain = o.Domain
+	}
+
+	if o, ok := m.Cookie.Providers[authenticatorID]; ok && o.Expire != nil {
+		opts.MaxAge = *o.Expire
+	}
+
+	name := m.GetCookieName(r, authenticatorID)
+	switch {
+	case strings.HasPrefix(name, cookiePrefixHost):
+		// __Host- cookies must not have a domain and must be secure
+		opts.Domain = ""
+		opts.Secure = true
+	case strings.HasPrefix(name, cookiePrefixSecure):
+		opts.Secure = true
+	}
+
+	return opts
 }
 
 var (
 	cfg = struct {
-		ConfigFile     string `flag:"config,c" default:"config.yaml" env:"CONFIG" description:"Location of the configuration file"`
+		ConfigFile     string `flag:"config,c" default:"config.yaml" env:"CONFIG" description:"Location of the configuration file or directory"`
+		LogFormat      string `flag:"log-format" default:"text" env:"LOG_FORMAT" description:"Format of the logs (text, json)"`
+		LogOutput      string `flag:"log-output" default:"fd://stderr" env:"LOG_OUTPUT" description:"Comma separated targets to write the logs to (fd://, file://, syslog://)"`
 		LogLevel       string `flag:"log-level" default:"info" description:"Level of logs to display (debug, info, warn, error)"`
+		SOPSBinary     string `flag:"sops-binary" default:"sops" env:"SOPS_BINARY" description:"Binary to decrypt sops encrypted configuration files with"`
 		TemplateDir    string `flag:"frontend-dir" default:"./frontend/" env:"FRONTEND_DIR" description:"Location of the directory containing the web assets"`
 		VersionAndExit bool   `flag:"version" default:"false" description:"Prints current version and exits"`
+		WatchConfig    bool   `flag:"watch-config" default:"false" env:"WATCH_CONFIG" description:"Reload the configuration when the file changes"`
 	}{}
 
-	mainCfg     = mainConfig{}
-	cookieStore *sessions.CookieStore
+	// mainConfigState holds the active *mainConfig. Reloads build a new
+	// configuration and replace it as a whole, it is never modified
+	// while requests read it.
+	mainConfigState atomic.Value
+	cookieStore     = newKeyRotatingCookieStore()
 
 	version = "dev"
 )
 
 func init() {
-	if err := rconfig.Parse(&cfg); err != nil {
+	if isSubcommand, err := parseSubcommand(os.Args[1:]); err != nil {
 		log.WithError(err).Fatal("Unable to parse commandline options")
+	} else if !isSubcommand {
+		if err := rconfig.Parse(&cfg); err != nil {
+			log.WithError(err).Fatal("Unable to parse commandline options")
+		}
 	}
 
+	if err := configureLogFormat(cfg.LogFormat); err != nil {
+		log.WithError(err).Fatal("Unable to configure log format")
+	}
+
+	if err := configureLogOutput(cfg.LogOutput); err != nil {
+		log.WithError(err).Fatal("Unable to configure log output")
+	}
+	log.AddHook(errorReportingHook{})
+
 	if l, err := log.ParseLevel(cfg.LogLevel); err != nil {
 		log.WithError(err).Fatal("Unable to parse log level")
 	} else {
@@ -81,61 +211,360 @@ func init() {
 		os.Exit(0)
 	}
 
-	// Set sane defaults for main configuration
-	mainCfg.Cookie.Prefix = "nginx-sso"
-	mainCfg.Cookie.Expire = 3600
-	mainCfg.Listen.Addr = "127.0.0.1"
-	mainCfg.Listen.Port = 8082
-	mainCfg.AuditLog.TrustedIPHeaders = []string{"X-Forwarded-For", "RemoteAddr", "X-Real-IP"}
-	mainCfg.AuditLog.Headers = []string{"x-origin-uri"}
+	m := &mainConfig{}
+	setMainConfigDefaults(m)
+	setMainConfig(m)
+}
+
+// getMainConfig returns the active main configuration
+func getMainConfig() *mainConfig {
+	return mainConfigState.Load().(*mainConfig)
 }
 
+func setMainConfig(m *mainConfig) { mainConfigState.Store(m) }
+
+// setMainConfigDefaults sets sane defaults for the main configuration
+func setMainConfigDefaults(m *mainConfig) {
+	m.Cookie.Prefix = "nginx-sso"
+	m.Cookie.Expire = 3600
+	m.Login.RememberMeDefault = true
+	m.Listen.Addr = "127.0.0.1"
+	m.Listen.Port = 8082
+	m.ShutdownTimeout = defaultShutdownTimeout
+	m.ProviderTimeout = defaultProviderTimeout
+	m.AuthCache.TTL = defaultAuthCacheTTL
+	m.AuditLog.TrustedIPHeaders = []string{"X-Forwarded-For", "RemoteAddr", "X-Real-IP"}
+	m.TrustedProxyHeader = "X-Forwarded-For"
+	m.AuditLog.Headers = []string{"x-origin-uri"}
+	m.AuditLog.DecisionSampleRate = 1
+	m.SessionBinding.IPv4Prefix = 24
+	m.SessionBinding.IPv6Prefix = 64
+	m.Secrets.RefreshInterval = defaultSecretRefreshInterval
+	m.AccountLockout.Duration = defaultAccountLockoutDuration
+	m.AccountLockout.MaxDuration = defaultAccountLockoutMaxDuration
+	m.AccountLockout.ResetAfter = defaultAccountLockoutResetAfter
+	m.Captcha.ResetAfter = defaultCaptchaResetAfter
+	m.Tracing.SampleRate = 1
+	m.Tracing.ServiceName = "nginx-sso"
+	m.Metrics.StatsD.Format = "dogstatsd"
+	m.Metrics.StatsD.Prefix = "nginx_sso."
+}
+
+// load parses the configuration into m and validates it. Only state
+// kept in m is touched, global state is initialized by
+// loadConfiguration. m needs to be a new configuration, it is not
+// reset before parsing.
+func (m *mainConfig) load(yamlSource []byte) error {
+	if err := yaml.Unmarshal(yamlSource, m); err != nil {
+		return fmt.Errorf("Unable to load configuration file: %s", err)
+	}
+
+	for _, v := range m.validations() {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("Unable to configure %s: %s", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// configValidation checks the section of the main configuration found
+// at the given yaml key
+type configValidation struct {
+	Key      string
+	Name     string
+	Validate func() error
+}
+
+// validations lists the checks of the parsed configuration in the
+// order they are executed on load
+func (m *mainConfig) validations() []configValidation {
+	return []configValidation{
+		{"trusted_proxies", "trusted proxies", func() (err error) {
+			m.trustedProxyNets, err = acl.ParseCIDRs(m.TrustedProxies)
+			return err
+		}},
+		{"trusted_proxy_header", "trusted proxy header", m.validateTrustedProxyHeader},
+		{"cluster", "cluster mode", m.validateCluster},
+		{"account_lockout", "account lockout", m.AccountLockout.Validate},
+		{"admin", "admin listener", m.Admin.Listener.Validate},
+		{"audit_log", "audit log", m.AuditLog.Validate},
+		{"auth_failure", "auth failure responses", m.AuthFailure.Compile},
+		{"banner", "banner", m.Banner.Validate},
+		{"captcha", "CAPTCHA", m.Captcha.Validate},
+		{"cors", "CORS", m.CORS.Validate},
+		{"claims_mapping", "claims mapping", m.ClaimsMapping.Compile},
+		{"detect_cache", "detect cache", m.DetectCache.Validate},
+		{"embedded_login", "embedded login", m.EmbeddedLogin.Validate},
+		{"envoy_ext_authz", "Envoy ext_authz", m.EnvoyAuthz.Validate},
+		{"error_reporting", "error reporting", m.ErrorReporting.Validate},
+		{"frontend", "frontend", m.Frontend.Load},
+		{"group_cache", "group cache", m.GroupCache.Validate},
+		{"hooks", "hooks", m.Hooks.Validate},
+		{"http_transports", "HTTP transports", m.validateHTTPTransports},
+		{"listen", "listener", m.Listen.Validate},
+		{"identity_assertion", "identity assertion", m.IdentityAssertion.Load},
+		{"identity_headers", "identity headers", m.IdentityHeaders.Compile},
+		{"ip_filter", "IP filter", m.IPFilter.Compile},
+		{"token_groups", "token groups", m.TokenGroups.Validate},
+		{"authorization", "authorization", m.Authorization.Load},
+		{"login", "login buttons", func() error { return validateLoginButtons(m.Login.Buttons) }},
+		{"login", "login theme", func() error { return validateLoginTheme(m.Login.Theme) }},
+		{"login_failure_log", "login failure log", m.LoginFailureLog.Validate},
+		{"login_rate_limit", "login rate limit", m.LoginRateLimit.Validate},
+		{"logout", "logout", func() error { return m.Logout.Validate(m.Redirect) }},
+		{"metrics", "StatsD metrics", m.Metrics.StatsD.Validate},
+		{"oidc_provider", "OIDC provider", m.OIDCProvider.Validate},
+		{"password_policy", "password policy", m.PasswordPolicy.Validate},
+		{"password_reset", "password reset", m.PasswordReset.Load},
+		{"plugins", "plugins", m.Plugins.Validate},
+		{"provider_limits", "provider limits", m.ProviderLimits.Validate},
+		{"registration", "registration", func() error { return m.Registration.Load(m.SCIM) }},
+		{"security_headers", "security headers", m.SecurityHeaders.Validate},
+		{"session_binding", "session binding", m.SessionBinding.Validate},
+		{"terms", "terms of service", m.Terms.Load},
+		{"tracing", "tracing", m.Tracing.Validate},
+		{"webhooks", "webhooks", m.Webhooks.Validate},
+		{"cookie", "cookie keys", func() error { return newKeyRotatingCookieStore().Configure(m) }},
+	}
+}
+
+// loadConfiguration loads the configuration file and activates it. The
+// new configuration is validated as a whole before it is applied: If
+// it is broken the active configuration stays in place.
 func loadConfiguration() error {
-	yamlSource, err := ioutil.ReadFile(cfg.ConfigFile)
+	configSecrets.Begin()
+
+	config, err := readConfiguration(cfg.ConfigFile)
 	if err != nil {
 		return fmt.Errorf("Unable to read configuration file: %s", err)
 	}
+	yamlSource := config.Source
 
-	if err := yaml.Unmarshal(yamlSource, &mainCfg); err != nil {
-		return fmt.Errorf("Unable to load configuration file: %s", err)
+	// Load the ACL before applying anything else: A broken ACL rejects
+	// the whole configuration and keeps the active ACL in place
+	newACL, err := loadACL(yamlSource, config.Dir)
+	if err != nil {
+		return fmt.Errorf("Unable to load ACL: %s", err)
+	}
+
+	candidate := &mainConfig{}
+	setMainConfigDefaults(candidate)
+	if err := candidate.load(yamlSource); err != nil {
+		return err
+	}
+
+	// Plugins need to register their providers before they are configured
+	if err := loadPlugins(candidate.Plugins.Directory); err != nil {
+		return fmt.Errorf("Unable to load plugins: %s", err)
+	}
+	if err := loadExternalPlugins(candidate.Plugins.External); err != nil {
+		return fmt.Errorf("Unable to load external plugins: %s", err)
+	}
+	if err := loadWASMPlugins(candidate.Plugins.WASM); err != nil {
+		return fmt.Errorf("Unable to load WASM plugins: %s", err)
 	}
 
-	if err := initializeAuthenticators(yamlSource); err != nil {
+	authenticators, err := configureAuthenticators(yamlSource)
+	if err != nil {
 		return fmt.Errorf("Unable to configure authentication: %s", err)
 	}
 
-	if err = initializeMFAProviders(yamlSource); err != nil {
-		log.WithError(err).Fatal("Unable to configure MFA providers")
+	groupProviders, err := configureGroupProviders(yamlSource)
+	if err != nil {
+		return fmt.Errorf("Unable to configure group providers: %s", err)
+	}
+
+	mfaProviders, err := configureMFAProviders(yamlSource)
+	if err != nil {
+		return fmt.Errorf("Unable to configure MFA providers: %s", err)
+	}
+
+	realms, err := loadRealms(yamlSource, config.Dir)
+	if err != nil {
+		return fmt.Errorf("Unable to configure realms: %s", err)
 	}
 
+	// Dependent objects are built from the candidate but only activated
+	// after everything was loaded successfully
+	activateGeoIP, err := prepareGeoIP(candidate.GeoIP)
+	if err != nil {
+		return fmt.Errorf("Unable to configure GeoIP: %s", err)
+	}
+
+	activateOIDCProvider, err := prepareOIDCProvider(candidate.OIDCProvider)
+	if err != nil {
+		return fmt.Errorf("Unable to configure OIDC provider: %s", err)
+	}
+
+	activateSCIM, err := prepareSCIM(candidate.SCIM)
+	if err != nil {
+		return fmt.Errorf("Unable to configure SCIM: %s", err)
+	}
+
+	activateSessionStore, err := prepareSessionStore(candidate.sessionStoreConfig())
+	if err != nil {
+		return fmt.Errorf("Unable to configure session store: %s", err)
+	}
+
+	// Fails before changing the cookie store if the keys are invalid
+	if err := cookieStore.Configure(candidate); err != nil {
+		return fmt.Errorf("Unable to configure cookie keys: %s", err)
+	}
+
+	// Nothing below fails: The candidate becomes the active configuration
+	// together with the objects built from it
+	activateGeoIP()
+	activateOIDCProvider()
+	activateSCIM()
+	activateSessionStore()
+
+	setMainConfig(candidate)
+	setCacheSalt(yamlSource)
+	setHTTPTransports(candidate.HTTPTransports)
+	setProviderLimits(candidate.ProviderLimits)
+
+	setAuthenticators(authenticators)
+	setGroupProviders(groupProviders)
+	setMFAProviders(mfaProviders)
+	setACL(newACL)
+	setRealms(realms)
+	configFiles = append(config.Files, newACL.IncludedFiles()...)
+	configSecrets.Commit()
+
 	return nil
 }
 
 func main() {
-	if err := loadConfiguration(); err != nil {
-		log.WithError(err).Fatal("Unable to load configuration")
+	if activeSubcommand == nil || !activeSubcommand.SkipConfig {
+		if err := loadConfiguration(); err != nil {
+			log.WithError(err).Fatal("Unable to load configuration")
+		}
 	}
 
-	cookieStore = sessions.NewCookieStore([]byte(mainCfg.Cookie.AuthKey))
+	if activeSubcommand != nil {
+		if err := activeSubcommand.Run(); err != nil {
+			log.WithError(err).Fatal("Subcommand failed")
+		}
+		return
+	}
 
-	http.HandleFunc("/auth", handleAuthRequest)
-	http.HandleFunc("/login", handleLoginRequest)
-	http.HandleFunc("/logout", handleLogoutRequest)
+	if getMainConfig().Cookie.KeyRotation.Interval > 0 && (getMainConfig().Cookie.Format == "" || getMainConfig().Cookie.Format == cookieFormatSecureCookie) {
+		go cookieStore.RotateEvery(getMainConfig().Cookie.KeyRotation.Interval, getMainConfig().Cookie.KeyRotation.Keep)
+	}
 
-	go http.ListenAndServe(
-		fmt.Sprintf("%s:%d", mainCfg.Listen.Addr, mainCfg.Listen.Port),
-		context.ClearHandler(http.DefaultServeMux),
-	)
+	if cfg.WatchConfig {
+		go watchConfiguration()
+	}
+
+	go watchConfigSecrets()
+	go watchIPBlocklists()
+
+	// A separate mux is used to not expose handlers registering
+	// themselves on the default mux (like net/http/pprof)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jwks.json", handleJWKSRequest)
+	mux.HandleFunc("/.well-known/openid-configuration", withOIDCProvider((*oidcProvider).handleDiscovery))
+	mux.HandleFunc("/auth", withTracing("auth", instrumentAuthRequest(withAuthCacheHeaders(handleAuthRequest))))
+	mux.HandleFunc(frontendLogoPath, withSecurityHeaders(handleBrandingLogoRequest))
+	mux.HandleFunc("/device", withSecurityHeaders(withErrorPages(withCSRFProtection(handleDeviceRequest))))
+	mux.HandleFunc("/device/code", handleDeviceCodeRequest)
+	mux.HandleFunc("/device/token", handleDeviceTokenRequest)
+	mux.HandleFunc(errorPagePathPrefix, withSecurityHeaders(handleErrorPageRequest))
+	mux.HandleFunc("/healthz", handleHealthzRequest)
+	mux.HandleFunc("/identity/jwks.json", handleIdentityAssertionJWKSRequest)
+	mux.HandleFunc(kubernetesTokenReviewPath, handleKubernetesTokenReviewRequest)
+	mux.HandleFunc("/login", withTracing("login", withCORS(withSecurityHeaders(withErrorPages(handleLoginRequest)))))
+	mux.HandleFunc(embeddedLoginPath, withSecurityHeaders(withErrorPages(handleEmbeddedLoginRequest)))
+	mux.HandleFunc(loginConfirmPath, withSecurityHeaders(withErrorPages(withCSRFProtection(handleLoginConfirmRequest))))
+	mux.HandleFunc("/logout", withCORS(withSecurityHeaders(withErrorPages(handleLogoutRequest))))
+	mux.HandleFunc(oidcPathAuthorize, withOIDCProvider((*oidcProvider).handleAuthorize))
+	mux.HandleFunc(oidcPathIntrospect, withOIDCProvider((*oidcProvider).handleIntrospect))
+	mux.HandleFunc(oidcPathJWKS, withOIDCProvider((*oidcProvider).handleJWKS))
+	mux.HandleFunc(oidcPathToken, withOIDCProvider((*oidcProvider).handleToken))
+	mux.HandleFunc(oidcPathUserInfo, withOIDCProvider((*oidcProvider).handleUserInfo))
+	mux.HandleFunc(passwordChangePath, withSecurityHeaders(withErrorPages(handlePasswordRequest)))
+	mux.HandleFunc(passwordResetPath, withSecurityHeaders(withErrorPages(withCSRFProtection(handlePasswordResetRequest))))
+	mux.HandleFunc("/readyz", handleReadyzRequest)
+	mux.HandleFunc(registrationPath, withSecurityHeaders(withErrorPages(withCSRFProtection(handleRegistrationRequest))))
+	mux.HandleFunc(scimPathPrefix, handleSCIMRequest)
+	mux.HandleFunc("/sessions", withSecurityHeaders(withErrorPages(withCSRFProtection(handleSessionsRequest))))
+	mux.HandleFunc("/static/", withSecurityHeaders(handleStaticRequest))
+	mux.HandleFunc(termsPath, withSecurityHeaders(withErrorPages(withCSRFProtection(handleTermsRequest))))
+	mux.HandleFunc("/tokens", withSecurityHeaders(withErrorPages(withCSRFProtection(handleTokensRequest))))
+	mux.HandleFunc("/userinfo", withCORS(handleUserInfoRequest))
+
+	// Operational endpoints are moved to the admin listener if it is
+	// configured to keep them off the public login vhost
+	adminMux := mux
+	if getMainConfig().Admin.Listener.Enabled() {
+		adminMux = http.NewServeMux()
+		adminMux.HandleFunc("/healthz", handleHealthzRequest)
+		adminMux.HandleFunc("/readyz", handleReadyzRequest)
+		go listenAdmin(getMainConfig().Admin.Listener, adminMux)
+	}
+	adminMux.HandleFunc("/admin/audit", withAdminCSRFProtection(handleAdminAuditRequest))
+	adminMux.HandleFunc("/admin/banner", withAdminCSRFProtection(handleAdminBannerRequest))
+	adminMux.HandleFunc("/admin/groups", withAdminCSRFProtection(handleAdminGroupsRequest))
+	adminMux.HandleFunc("/admin/lockouts", withAdminCSRFProtection(handleAdminLockoutsRequest))
+	adminMux.HandleFunc("/admin/maintenance", withAdminCSRFProtection(handleAdminMaintenanceRequest))
+	adminMux.HandleFunc("/admin/providers", withAdminCSRFProtection(handleAdminProvidersRequest))
+	adminMux.HandleFunc("/admin/registrations", withAdminCSRFProtection(handleAdminRegistrationsRequest))
+	adminMux.HandleFunc("/admin/reload", withAdminCSRFProtection(handleAdminReloadRequest))
+	adminMux.HandleFunc("/admin/service-accounts", withAdminCSRFProtection(handleAdminServiceAccountsRequest))
+	adminMux.HandleFunc("/admin/sessions", withAdminCSRFProtection(handleAdminSessionsRequest))
+	adminMux.HandleFunc("/debug/pprof/", handlePprofRequest)
+	adminMux.HandleFunc("/metrics", handleMetricsRequest)
+
+	tlsConfig, err := getMainConfig().Listen.TLSConfig()
+	if err != nil {
+		log.WithError(err).Fatal("Unable to configure TLS")
+	}
+
+	listener, err := getMainConfig().Listen.Listen()
+	if err != nil {
+		log.WithError(err).WithField("addr", getMainConfig().Listen.String()).Fatal("Unable to open HTTP listener")
+	}
+
+	go func() {
+		err := getMainConfig().Listen.ServeListener(listener, context.ClearHandler(withRequestID(withErrorReporting(withIPFilter(mux)))), tlsConfig)
+		if err != http.ErrServerClosed {
+			log.WithError(err).WithField("addr", getMainConfig().Listen.String()).Fatal("HTTP listener failed")
+		}
+	}()
+
+	go watchSystemd(listenerSelfCheck(listener.Addr(), tlsConfig != nil, getMainConfig().Listen.ProxyProtocol))
+
+	if getMainConfig().Listen.HTTPRedirectPort != 0 {
+		go func() {
+			addr := fmt.Sprintf("%s:%d", getMainConfig().Listen.Addr, getMainConfig().Listen.HTTPRedirectPort)
+			srv := trackServer(&http.Server{Addr: addr, Handler: getMainConfig().Listen.Handler(getMainConfig().Listen.Port)})
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.WithError(err).WithField("addr", addr).Fatal("HTTP redirect listener failed")
+			}
+		}()
+	}
+
+	if getMainConfig().EnvoyAuthz.Listen != "" {
+		go listenEnvoyAuthz(getMainConfig().EnvoyAuthz)
+	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 	for sig := range sigChan {
 		switch sig {
 		case syscall.SIGHUP:
-			if err := loadConfiguration(); err != nil {
-				log.WithError(err).Error("Unable to reload configuration")
+			reloadConfiguration() // Errors are logged, keeps the previous configuration
+
+		case syscall.SIGINT, syscall.SIGTERM:
+			log.WithField("timeout", getMainConfig().ShutdownTimeout).Info("Shutting down, waiting for active requests to finish")
+			if err := systemdNotify("STOPPING=1"); err != nil {
+				log.WithError(err).Error("Unable to notify systemd about shutdown")
 			}
+			shutdownServers(getMainConfig().ShutdownTimeout)
+			stopExternalPlugins()
+			return
 
 		default:
 			log.Fatalf("Received unexpected signal: %v", sig)
@@ -144,101 +573,317 @@ func main() {
 }
 
 func handleAuthRequest(res http.ResponseWriter, r *http.Request) {
+	if state, ok := maintenanceFor(r); ok {
+		respondMaintenance(res, r, state)
+		return
+	}
+
+	if _, ok := applyHooks(res, r, hookStagePreAuth, "", nil); !ok {
+		return
+	}
+
+	if basicUser, _, ok := r.BasicAuth(); ok && getMainConfig().AccountLockout.Locked(r, basicUser) > 0 {
+		getMainConfig().LoginFailureLog.Log(r, basicUser, "basic_auth", loginFailureAccountLocked)
+		getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "account locked"})
+		getMainConfig().BasicAuthChallenge.SetChallenge(res, r)
+		getMainConfig().AuthFailure.Respond(res, r, authFailureUnauthenticated, "", http.StatusUnauthorized, "Account is temporarily locked")
+		return
+	}
+
+	// The fields of the request are built once (including the GeoIP
+	// lookup) and shared by all checks judging the request
+	setACLRequestFields(r, buildACLRequestFields(r))
+
 	user, groups, err := detectUser(res, r)
+	fields := aclFieldSet(r)
 
-	switch err {
-	case errNoValidUserFound:
-		mainCfg.AuditLog.Log(auditEventValidate, r, map[string]string{"result": "no valid user found"})
-		http.Error(res, "No valid user found", http.StatusUnauthorized)
+	switch {
+	case errors.Is(err, errNoUser):
+		if requestACL(r).AllowsAnonymous(fields) {
+			getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "anonymous access"})
+			res.WriteHeader(http.StatusOK)
+			return
+		}
 
-	case nil:
-		if !mainCfg.ACL.HasAccess(user, groups, r) {
-			mainCfg.AuditLog.Log(auditEventAccessDenied, r, map[string]string{"username": user})
-			http.Error(res, "Access denied for this resource", http.StatusForbidden)
+		if basicUser, _, ok := r.BasicAuth(); ok {
+			getMainConfig().LoginFailureLog.Log(r, basicUser, "basic_auth", loginFailureInvalidCredentials)
+			getMainConfig().AccountLockout.RecordFailure(r, basicUser)
+		}
+		getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "no valid user found"})
+		getMainConfig().BasicAuthChallenge.SetChallenge(res, r)
+		getMainConfig().AuthFailure.Respond(res, r, authFailureUnauthenticated, "", http.StatusUnauthorized, "No valid user found")
+
+	case err == nil:
+		if !getMainConfig().Terms.Accepted(r, user) {
+			// The login page sends users with a session on to the terms
+			getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "terms not accepted", "username": user})
+			getMainConfig().AuthFailure.Respond(res, r, authFailureUnauthenticated, user, http.StatusUnauthorized, "Terms of service not accepted")
 			return
 		}
 
-		mainCfg.AuditLog.Log(auditEventValidate, r, map[string]string{"result": "valid user found", "username": user})
+		var ok bool
+		if groups, ok = applyHooks(res, r, hookStagePreResponse, user, groups); !ok {
+			return
+		}
+		if getMainConfig().Hooks.HasStage(hookStagePreResponse) {
+			// Hooks may have set request headers the rules match against
+			fields = buildACLFieldSet(r)
+		}
+
+		allowed, err := hasAccess(user, groups, r, fields)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to authorize request")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
 
-		res.Header().Set("X-Username", user)
+		if !allowed && !requestACL(r).AllowsAnonymous(fields) {
+			publishEvent(authEvent{Type: auditEventAccessDenied, Request: r, User: user})
+			getMainConfig().AuthFailure.Respond(res, r, authFailureForbidden, user, http.StatusForbidden, "Access denied for this resource")
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "valid user found", "username": user})
+
+		mappedUser, mappedGroups, claims, err := getMainConfig().ClaimsMapping.Apply(r, user, groups)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to map claims")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		tokenGroups, err := getMainConfig().TokenGroups.Resolve(r, user, mappedGroups)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to resolve token groups")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		if err := getMainConfig().IdentityHeaders.Set(res, r, mappedUser, mappedGroups); err != nil {
+			requestLog(r).WithError(err).Error("Unable to set identity headers")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if err := getMainConfig().IdentityAssertion.Set(res, r, mappedUser, tokenGroups, claims); err != nil {
+			requestLog(r).WithError(err).Error("Unable to sign identity assertion")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if err := setUpstreamToken(res, r, mappedUser, tokenGroups, claims); err != nil {
+			requestLog(r).WithError(err).Error("Unable to sign upstream token")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if m, ok := getSessionMeta(r); ok && getMainConfig().SessionHeaders {
+			m.SetHeaders(res)
+		}
 		res.WriteHeader(http.StatusOK)
 
+	case errors.Is(err, errBackendUnavailable):
+		requestLog(r).WithError(err).Error("Authentication backend unavailable")
+		setRetryAfter(res, providerRetryAfter(err))
+		http.Error(res, "Authentication backend unavailable", http.StatusServiceUnavailable)
+
 	default:
-		log.WithError(err).Error("Error while handling auth request")
+		requestLog(r).WithError(err).Error("Error while handling auth request")
 		http.Error(res, "Something went wrong", http.StatusInternalServerError)
 	}
 }
 
 func handleLoginRequest(res http.ResponseWriter, r *http.Request) {
-	if _, _, err := detectUser(res, r); err == nil {
+	if isJSONRequest(r) {
+		handleLoginJSONRequest(res, r)
+		return
+	}
+
+	if !validateRedirect(res, r) {
+		return
+	}
+
+	if user, _, err := detectUser(res, r); err == nil {
 		// There is already a valid user
-		http.Redirect(res, r, r.URL.Query().Get("go"), http.StatusFound)
+		http.Redirect(res, r, postLoginRedirect(r, user, r.URL.Query().Get("go")), http.StatusFound)
 		return
 	}
 
-	auditFields := map[string]string{
-		"go": r.FormValue("go"),
+	if id := r.URL.Query().Get("provider"); id != "" && r.Method == http.MethodGet {
+		startExternalLogin(res, r, id)
+		return
 	}
 
 	if r.Method == "POST" {
-		// Simple authentication
-		user, mfaCfgs, err := loginUser(res, r)
-		switch err {
-		case errNoValidUserFound:
-			http.Redirect(res, r, "/login?go="+url.QueryEscape(r.FormValue("go")), http.StatusFound)
-			return
-		case nil:
-			// Don't handle for now, MFA validation comes first
-		default:
-			log.WithError(err).Error("Login failed with unexpected error")
-			http.Redirect(res, r, "/login?go="+url.QueryEscape(r.FormValue("go")), http.StatusFound)
+		if !getMainConfig().CSRF.Valid(r) {
+			requestLog(r).Warn("Rejected login without valid CSRF token")
+			http.Redirect(res, r, loginRedirect(r, "error_csrf_failed"), http.StatusFound)
 			return
 		}
 
-		// MFA validation against configs from login
-		err = validateMFA(res, r, user, mfaCfgs)
-		switch err {
-		case errNoValidUserFound:
-			auditFields["reason"] = "invalid credentials"
-			mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields)
-			res.Header().Del("Set-Cookie") // Remove login cookie
-			http.Redirect(res, r, "/login?go="+url.QueryEscape(r.FormValue("go")), http.StatusFound)
-			return
-
-		case nil:
-			mainCfg.AuditLog.Log(auditEventLoginSuccess, r, auditFields)
-			http.Redirect(res, r, r.FormValue("go"), http.StatusFound)
-			return
-
+		switch o := attemptLogin(res, r, false); o.Status {
+		case loginStatusSuccess:
+			http.Redirect(res, r, postLoginRedirect(r, o.User, r.FormValue("go")), http.StatusFound)
+		case loginStatusRateLimited, loginStatusAccountLocked:
+			writeTooManyRequests(res, o.Wait, getMainConfig().Frontend.Translate(r, o.ErrorKey()))
+		case loginStatusCaptchaRequired:
+			http.Redirect(res, r, loginRedirect(r, o.ErrorKey())+"&captcha=required", http.StatusFound)
 		default:
-			auditFields["reason"] = "error"
-			auditFields["error"] = err.Error()
-			mainCfg.AuditLog.Log(auditEventLoginFailure, r, auditFields)
-			log.WithError(err).Error("Login failed with unexpected error")
-			res.Header().Del("Set-Cookie") // Remove login cookie
-			http.Redirect(res, r, "/login?go="+url.QueryEscape(r.FormValue("go")), http.StatusFound)
-			return
+			http.Redirect(res, r, loginRedirect(r, o.ErrorKey()), http.StatusFound)
 		}
+		return
+	}
+
+	var (
+		lang     = getMainConfig().Frontend.Language(r)
+		messages = getMainConfig().Frontend.Translations(lang)
+		errorMsg string
+	)
+	if key := r.URL.Query().Get("error"); strings.HasPrefix(key, "error_") {
+		// Only messages of the translations are shown, never the parameter itself
+		errorMsg = messages[key]
 	}
 
-	tpl := pongo2.Must(pongo2.FromFile(path.Join(cfg.TemplateDir, "index.html")))
+	methods := translateLoginFields(messages, getFrontendAuthenticators(r))
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("index.html"))
 	if err := tpl.ExecuteWriter(pongo2.Context{
-		"active_methods": getFrontendAuthenticators(),
+		"active_method":  selectLoginMethod(r, methods),
+		"active_methods": methods,
+		"banner":         visibleBanner(r),
+		"branding":       getMainConfig().Frontend.Branding(),
+		"buttons":        getLoginButtons(r),
+		"captcha":        getMainConfig().Captcha.Widget(r),
+		"csp_nonce":      cspNonce(r),
+		"csrf_token":     getMainConfig().CSRF.Token(res, r),
+		"error":          errorMsg,
 		"go":             r.URL.Query().Get("go"),
-		"login":          mainCfg.Login,
+		"lang":           lang,
+		"login":          requestLoginSettings(r),
+		"password_reset": getMainConfig().PasswordReset.Enabled(),
+		"registration":   getMainConfig().Registration.Enabled(),
+		"t":              messages,
 	}, res); err != nil {
-		log.WithError(err).Error("Unable to render template")
+		requestLog(r).WithError(err).Error("Unable to render template")
 		http.Error(res, "Something went wrong", http.StatusInternalServerError)
 	}
 }
 
 func handleLogoutRequest(res http.ResponseWriter, r *http.Request) {
-	mainCfg.AuditLog.Log(auditEventLogout, r, nil)
+	if !validateRedirect(res, r) || !confirmLogout(res, r) {
+		return
+	}
+
+	if r.FormValue("everywhere") == "true" {
+		// Revoke the sessions on all other devices before removing
+		// the cookies of the current one
+		user, _, err := detectUser(res, r)
+		switch {
+		case err == nil:
+			n, err := revokeUserSessions(user)
+			if err == errSessionTrackingDisabled {
+				http.Error(res, errSessionTrackingDisabled.Error(), http.StatusNotImplemented)
+				return
+			}
+			if err != nil {
+				requestLog(r).WithError(err).Error("Failed to revoke sessions")
+				http.Error(res, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			getMainConfig().AuditLog.Log(auditEventSessionsRevoked, r, map[string]string{"count": strconv.Itoa(n), "username": user})
+
+		case errors.Is(err, errNoUser):
+			// Nothing to revoke, continue with regular logout
+
+		default:
+			requestLog(r).WithError(err).Error("Failed to detect user")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	target := getMainConfig().Logout.redirectTarget(r)
+	if getMainConfig().Logout.upstreamEnabled(r) {
+		// Needs to happen before the local logout removes the cookies
+		// identifying the upstream session
+		if upstream := upstreamLogoutUser(res, r, target); upstream != "" {
+			target = upstream
+		}
+	}
+
+	publishEvent(authEvent{Type: auditEventLogout, Request: r})
 	if err := logoutUser(res, r); err != nil {
-		log.WithError(err).Error("Failed to logout user")
+		requestLog(r).WithError(err).Error("Failed to logout user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(res, r, target, http.StatusFound)
+}
+
+func handleSessionsRequest(res http.ResponseWriter, r *http.Request) {
+	user, _, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Render the sessions below
+
+	case errors.Is(err, errNoUser):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape("/sessions"), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	store := getSessionStore()
+	if store == nil {
+		http.Error(res, errSessionTrackingDisabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == "POST" {
+		id := r.FormValue("id")
+
+		// Users must only be able to revoke their own sessions
+		if info, err := store.Get(id); err == nil && info.User == user {
+			if err := store.Delete(id); err != nil {
+				requestLog(r).WithError(err).Error("Unable to revoke session")
+				http.Error(res, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			getMainConfig().AuditLog.Log(auditEventSessionsRevoked, r, map[string]string{"count": "1", "session": id, "username": user})
+		}
+
+		http.Redirect(res, r, "/sessions", http.StatusFound)
+		return
+	}
+
+	userSessions, err := store.ListByUser(user)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to list sessions")
 		http.Error(res, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	http.Redirect(res, r, r.URL.Query().Get("go"), http.StatusFound)
+	type sessionView struct {
+		Session sessionInfo
+		Current bool
+	}
+
+	views := []sessionView{}
+	for _, s := range userSessions {
+		views = append(views, sessionView{Session: s, Current: currentSessionID(r, s.Provider) == s.ID})
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("sessions.html"))
+	if err := tpl.ExecuteWriter(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"login":      getMainConfig().Login,
+		"sessions":   views,
+		"user":       user,
+	}, res); err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maintenanceAllow = "allow"
+	maintenanceDeny  = "deny"
+
+	defaultMaintenanceMessage = "Service is under maintenance"
+	maintenanceCacheTTL       = time.Second
+	maintenanceRedisKey       = "nginx-sso:maintenance"
+)
+
+var (
+	// maintenance is kept outside of the config to survive reloads, in
+	// cluster mode it is a cache of the state kept in the cluster store
+	maintenance        maintenanceState
+	maintenanceFetched time.Time
+	maintenanceLock    sync.RWMutex
+)
+
+// maintenanceState is switched through the admin API to answer all
+// requests to /auth with a fixed decision while the providers are not
+// usable
+type maintenanceState struct {
+	Mode    string     `json:"mode"`
+	Message string     `json:"message,omitempty"`
+	Hosts   []string   `json:"hosts,omitempty"`
+	Admin   string     `json:"admin,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// Active checks whether the maintenance mode applies to the request
+func (m maintenanceState) Active(r *http.Request) bool {
+	switch {
+	case m.Mode == "":
+		return false
+	case m.Until != nil && !time.Now().Before(*m.Until):
+		return false
+	case len(m.Hosts) > 0 && !hostMatches(m.Hosts, requestHost(r)):
+		return false
+	}
+	return true
+}
+
+// getMaintenance returns the current state. In cluster mode the state is
+// read from the cluster store at most once per maintenanceCacheTTL, if
+// the store is not reachable the last known state is used.
+func getMaintenance() (maintenanceState, error) {
+	maintenanceLock.RLock()
+	state, fetched := maintenance, maintenanceFetched
+	maintenanceLock.RUnlock()
+
+	if !getMainConfig().Cluster.Enabled() || time.Since(fetched) < maintenanceCacheTTL {
+		return state, nil
+	}
+
+	client, err := getRedisClient(getMainConfig().Cluster.Store)
+	if err != nil {
+		return state, err
+	}
+
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	// Do not retry on every request while the store is unreachable
+	maintenanceFetched = time.Now()
+
+	reply, err := client.Do("GET", maintenanceRedisKey)
+	if err != nil {
+		return maintenance, errors.Wrap(err, "Unable to read maintenance mode")
+	}
+
+	maintenance = maintenanceState{}
+	if v, ok := reply.(string); ok {
+		if err := json.Unmarshal([]byte(v), &maintenance); err != nil {
+			return maintenance, errors.Wrap(err, "Unable to decode maintenance mode")
+		}
+	}
+
+	return maintenance, nil
+}
+
+// setMaintenance activates the state or disables the maintenance mode if
+// the state has no mode set
+func setMaintenance(state maintenanceState) error {
+	if getMainConfig().Cluster.Enabled() {
+		client, err := getRedisClient(getMainConfig().Cluster.Store)
+		if err != nil {
+			return err
+		}
+
+		if state.Mode == "" {
+			_, err = client.Do("DEL", maintenanceRedisKey)
+		} else {
+			v, _ := json.Marshal(state)
+			args := []string{"SET", maintenanceRedisKey, string(v)}
+			if state.Until != nil {
+				// Let the store expire the state together with the mode
+				args = append(args, "PX", strconv.FormatInt(int64(time.Until(*state.Until)/time.Millisecond)+1, 10))
+			}
+			_, err = client.Do(args...)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Unable to store maintenance mode")
+		}
+	}
+
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	maintenance, maintenanceFetched = state, time.Now()
+	return nil
+}
+
+// maintenanceFor returns the state if the maintenance mode applies to the
+// request
+func maintenanceFor(r *http.Request) (maintenanceState, bool) {
+	state, err := getMaintenance()
+	if err != nil {
+		requestLog(r).WithError(err).Warn("Unable to update maintenance mode, using last known state")
+	}
+
+	return state, state.Active(r)
+}
+
+// respondMaintenance answers the request to /auth with the decision of
+// the maintenance mode without asking any provider
+func respondMaintenance(res http.ResponseWriter, r *http.Request, state maintenanceState) {
+	getMainConfig().AuditLog.Log(auditEventValidate, r, map[string]string{"result": "maintenance mode " + state.Mode})
+
+	if state.Mode == maintenanceAllow {
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	msg := state.Message
+	if msg == "" {
+		msg = defaultMaintenanceMessage
+	}
+
+	if state.Until != nil {
+		res.Header().Set("Retry-After", strconv.Itoa(int(time.Until(*state.Until)/time.Second)+1))
+	}
+	getMainConfig().AuthFailure.Respond(res, r, authFailureMaintenance, "", http.StatusServiceUnavailable, msg)
+}
+
+func handleAdminMaintenanceRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := getMaintenance()
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to read maintenance mode")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		if state.Until != nil && !time.Now().Before(*state.Until) {
+			state = maintenanceState{}
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(state); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode maintenance mode")
+		}
+
+	case http.MethodPost:
+		now := time.Now()
+		state := maintenanceState{
+			Mode:    r.FormValue("mode"),
+			Message: r.FormValue("message"),
+			Admin:   admin,
+			Since:   &now,
+		}
+
+		if state.Mode != maintenanceAllow && state.Mode != maintenanceDeny {
+			http.Error(res, "Parameter mode must be allow or deny", http.StatusBadRequest)
+			return
+		}
+
+		for _, h := range strings.Split(r.FormValue("hosts"), ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				state.Hosts = append(state.Hosts, h)
+			}
+		}
+
+		if v := r.FormValue("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(res, "Parameter duration must be a positive duration", http.StatusBadRequest)
+				return
+			}
+			until := now.Add(d)
+			state.Until = &until
+		}
+
+		if err := setMaintenance(state); err != nil {
+			requestLog(r).WithError(err).Error("Unable to enable maintenance mode")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		log.WithFields(log.Fields{"admin": admin, "mode": state.Mode}).Warn("Maintenance mode enabled")
+		getMainConfig().AuditLog.Log(auditEventMaintenanceChanged, r, map[string]string{
+			"admin": admin,
+			"hosts": strings.Join(state.Hosts, ","),
+			"mode":  state.Mode,
+		})
+		res.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := setMaintenance(maintenanceState{}); err != nil {
+			requestLog(r).WithError(err).Error("Unable to disable maintenance mode")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		log.WithField("admin", admin).Warn("Maintenance mode disabled")
+		getMainConfig().AuditLog.Log(auditEventMaintenanceChanged, r, map[string]string{"admin": admin, "mode": "off"})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
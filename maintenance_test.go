@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	prevFailure := getMainConfig().AuthFailure
+	defer func() {
+		getMainConfig().AuthFailure = prevFailure
+		setMaintenance(maintenanceState{})
+	}()
+
+	getMainConfig().AuthFailure = authFailureConfig{{
+		Hosts:       []string{"app.example.com"},
+		Maintenance: &authFailureResponse{Status: http.StatusForbidden, ContentType: "text/html", Body: "<p>{{ error }}</p>"},
+	}}
+	if err := getMainConfig().AuthFailure.Compile(); err != nil {
+		t.Fatalf("Unable to compile auth failure responses: %s", err)
+	}
+
+	admin := func(method string, form url.Values) int {
+		r := httptest.NewRequest(method, "/admin/maintenance", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		context.Set(r, adminUserContextKey, "admin")
+		defer context.Clear(r)
+
+		res := httptest.NewRecorder()
+		handleAdminMaintenanceRequest(res, r)
+		return res.Code
+	}
+
+	auth := func(host string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Host", host)
+
+		res := httptest.NewRecorder()
+		handleAuthRequest(res, r)
+		return res
+	}
+
+	if code := admin(http.MethodPost, url.Values{"mode": {"maybe"}}); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid mode to be rejected, got status %d", code)
+	}
+
+	if code := admin(http.MethodPost, url.Values{"mode": {"allow"}, "hosts": {"*.example.com"}}); code != http.StatusNoContent {
+		t.Fatalf("Unable to enable maintenance mode, got status %d", code)
+	}
+	if res := auth("app.example.com"); res.Code != http.StatusOK {
+		t.Errorf("Expected anonymous request to be allowed, got status %d", res.Code)
+	}
+	if res := auth("other.example.org"); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected hosts outside maintenance to be unaffected, got status %d", res.Code)
+	}
+
+	if code := admin(http.MethodPost, url.Values{"mode": {"deny"}, "message": {"IdP is down"}, "duration": {"1h"}}); code != http.StatusNoContent {
+		t.Fatalf("Unable to enable maintenance mode, got status %d", code)
+	}
+	res := auth("app.example.com")
+	if res.Code != http.StatusForbidden || res.Body.String() != "<p>IdP is down</p>" {
+		t.Errorf("Expected configured maintenance response, got status %d with %q", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Unexpected Retry-After header %q", res.Header().Get("Retry-After"))
+	}
+	if res := auth("other.example.org"); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected default maintenance response, got status %d", res.Code)
+	}
+
+	if code := admin(http.MethodDelete, nil); code != http.StatusNoContent {
+		t.Fatalf("Unable to disable maintenance mode, got status %d", code)
+	}
+	if res := auth("app.example.com"); res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected maintenance mode to be disabled, got status %d", res.Code)
+	}
+}
+
+func TestMaintenanceModeCluster(t *testing.T) {
+	f, uri := startFakeRedis(t)
+
+	prev := getMainConfig().Cluster
+	defer func() {
+		setMaintenance(maintenanceState{})
+		getMainConfig().Cluster = prev
+	}()
+	getMainConfig().Cluster = clusterConfig{Store: uri}
+
+	if err := setMaintenance(maintenanceState{Mode: maintenanceDeny, Admin: "admin"}); err != nil {
+		t.Fatalf("Unable to enable maintenance mode: %s", err)
+	}
+	if !strings.Contains(f.strings[maintenanceRedisKey], `"mode":"deny"`) {
+		t.Errorf("Expected state in cluster store, got %q", f.strings[maintenanceRedisKey])
+	}
+
+	// Another instance disabled the maintenance mode
+	f.lock.Lock()
+	delete(f.strings, maintenanceRedisKey)
+	f.lock.Unlock()
+
+	if state, _ := getMaintenance(); state.Mode != maintenanceDeny {
+		t.Errorf("Expected cached state to be used, got %#v", state)
+	}
+
+	maintenanceLock.Lock()
+	maintenanceFetched = time.Time{}
+	maintenanceLock.Unlock()
+
+	state, err := getMaintenance()
+	if err != nil {
+		t.Fatalf("Unable to read maintenance mode: %s", err)
+	}
+	if state.Mode != "" {
+		t.Errorf("Expected maintenance mode to be disabled, got %#v", state)
+	}
+}
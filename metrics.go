@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal implementation of the Prometheus text exposition format for
+// the few counters and histograms nginx-sso exposes
+
+var metricsDefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type metricsConfig struct {
+	Enable bool                `yaml:"enable"`
+	StatsD metricsStatsDConfig `yaml:"statsd"`
+}
+
+type metricCollector interface {
+	Expose(w io.Writer)
+}
+
+var (
+	metricAuthRequestDuration = newMetricHistogram(
+		"nginx_sso_auth_request_duration_seconds",
+		"Duration of requests to the /auth endpoint by response status",
+		metricsDefaultBuckets, "status",
+	)
+	metricAccessDecisions = newMetricCounter(
+		"nginx_sso_access_decisions_total",
+		"Access decisions by authorization engine, result and deciding ACL rule set",
+		"engine", "result", "rule",
+	)
+	metricDetectCacheLookups = newMetricCounter(
+		"nginx_sso_detect_cache_lookups_total",
+		"Lookups of detected users in the detect cache by result",
+		"result",
+	)
+	metricDetectCoalesced = newMetricCounter(
+		"nginx_sso_detect_coalesced_total",
+		"Requests sharing the user detection of a concurrent request with the same credentials",
+	)
+	metricGroupCacheLookups = newMetricCounter(
+		"nginx_sso_group_cache_lookups_total",
+		"Lookups of groups in the group cache by result",
+		"result",
+	)
+	metricIPFilterRejections = newMetricCounter(
+		"nginx_sso_ip_filter_rejections_total",
+		"Requests rejected by the IP filter by list",
+		"list",
+	)
+	metricLDAPConnections = newMetricCounter(
+		"nginx_sso_ldap_connections_total",
+		"Connections taken from the LDAP connection pool by result",
+		"result",
+	)
+	metricLogins = newMetricCounter(
+		"nginx_sso_logins_total",
+		"Login attempts by authenticator and result",
+		"provider", "result",
+	)
+	metricMFAFailures = newMetricCounter(
+		"nginx_sso_mfa_failures_total",
+		"Logins with valid credentials rejected by the MFA validation",
+		"provider",
+	)
+	metricProviderLimitRejections = newMetricCounter(
+		"nginx_sso_provider_limit_rejections_total",
+		"Calls to providers rejected because the provider reached its concurrency limit",
+		"provider",
+	)
+	metricSessionStoreOperations = newMetricHistogram(
+		"nginx_sso_session_store_operation_duration_seconds",
+		"Duration of session store operations by operation and result",
+		metricsDefaultBuckets, "operation", "result",
+	)
+
+	metricsRegistry = []metricCollector{
+		metricAuthRequestDuration,
+		metricAccessDecisions,
+		metricDetectCacheLookups,
+		metricDetectCoalesced,
+		metricGroupCacheLookups,
+		metricIPFilterRejections,
+		metricLDAPConnections,
+		metricLogins,
+		metricMFAFailures,
+		metricProviderLimitRejections,
+		metricSessionStoreOperations,
+	}
+)
+
+func init() {
+	subscribeEvents(func(e authEvent) {
+		switch e.Type {
+		case auditEventLoginSuccess, auditEventLoginFailure, auditEventMFARequired:
+			metricLogins.Inc(e.Provider, e.Result)
+			if e.Result == loginResultMFAFailed {
+				metricMFAFailures.Inc(e.Provider)
+			}
+		}
+	})
+}
+
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+func newMetricCounter(name, help string, labels ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (m *metricCounter) Inc(labelValues ...string) {
+	key := metricLabelKey(labelValues)
+
+	m.lock.Lock()
+	m.values[key]++
+	m.lock.Unlock()
+
+	statsdCount(m.name, m.labels, labelValues)
+}
+
+func (m *metricCounter) Expose(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	for _, key := range metricSortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, metricLabelString(m.labels, key), metricFormatFloat(m.values[key]))
+	}
+}
+
+type metricHistogramValue struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	values map[string]*metricHistogramValue
+	lock   sync.Mutex
+}
+
+func newMetricHistogram(name, help string, buckets []float64, labels ...string) *metricHistogram {
+	return &metricHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*metricHistogramValue{},
+	}
+}
+
+func (m *metricHistogram) Observe(v float64, labelValues ...string) {
+	key := metricLabelKey(labelValues)
+
+	m.lock.Lock()
+	hv, ok := m.values[key]
+	if !ok {
+		hv = &metricHistogramValue{buckets: make([]uint64, len(m.buckets))}
+		m.values[key] = hv
+	}
+
+	for i, upper := range m.buckets {
+		if v <= upper {
+			hv.buckets[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+	m.lock.Unlock()
+
+	statsdTiming(m.name, v, m.labels, labelValues)
+}
+
+// ObserveSince records the time passed since the given start in seconds
+func (m *metricHistogram) ObserveSince(start time.Time, labelValues ...string) {
+	m.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (m *metricHistogram) Expose(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	for _, key := range keys {
+		hv := m.values[key]
+		labels := append(append([]string{}, m.labels...), "le")
+
+		for i, upper := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, metricLabelString(labels, key+"\x00"+metricFormatFloat(upper)), hv.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, metricLabelString(labels, key+"\x00+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, metricLabelString(m.labels, key), metricFormatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, metricLabelString(m.labels, key), hv.count)
+	}
+}
+
+func metricLabelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+func metricSortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabelString(labels []string, key string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\x00")
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf(`%s="%s"`, l, metricLabelEscaper.Replace(v))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func metricFormatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsStatusRecorder captures the status code written by the wrapped
+// handler
+type metricsStatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (m *metricsStatusRecorder) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsStatusRecorder) Write(p []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	return m.ResponseWriter.Write(p)
+}
+
+// instrumentAuthRequest records the duration and response status of the
+// handler in the auth request metrics
+func instrumentAuthRequest(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &metricsStatusRecorder{ResponseWriter: res}
+
+		h(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metricAuthRequestDuration.ObserveSince(start, strconv.Itoa(rec.status))
+	}
+}
+
+func handleMetricsRequest(res http.ResponseWriter, r *http.Request) {
+	if !getMainConfig().Metrics.Enable {
+		http.NotFound(res, r)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+
+	for _, c := range metricsRegistry {
+		c.Expose(res)
+	}
+}
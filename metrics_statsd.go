@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statsdFlushInterval = time.Second
+	statsdMaxPacketSize = 1432 // Fits into the MTU of most networks
+	statsdQueueSize     = 10000
+)
+
+var (
+	statsdLines     = make(chan statsdLine, statsdQueueSize)
+	statsdStartOnce sync.Once
+
+	statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", ":", "_")
+)
+
+// metricsStatsDConfig pushes every counter increment and observation of
+// the metrics to a StatsD server in addition to exposing them for
+// Prometheus
+type metricsStatsDConfig struct {
+	Address string            `yaml:"address"`
+	Format  string            `yaml:"format"`
+	Prefix  string            `yaml:"prefix"`
+	Tags    map[string]string `yaml:"tags"`
+}
+
+func (s metricsStatsDConfig) Validate() error {
+	if s.Address == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return errors.Wrap(err, "Invalid address")
+	}
+
+	switch s.Format {
+	case "dogstatsd", "statsd":
+	default:
+		return errors.Errorf("Unsupported format %q, use dogstatsd or statsd", s.Format)
+	}
+
+	return nil
+}
+
+// name converts the Prometheus name of the metric into a StatsD
+// name: The common prefix and the unit suffixes are replaced by the
+// configured prefix and the type of the metric.
+func (s metricsStatsDConfig) name(metric string) string {
+	metric = strings.TrimPrefix(metric, "nginx_sso_")
+	for _, suffix := range []string{"_total", "_seconds"} {
+		metric = strings.TrimSuffix(metric, suffix)
+	}
+	return s.Prefix + metric
+}
+
+func (s metricsStatsDConfig) line(metric, value, metricType string, labels, labelValues []string) string {
+	line := s.name(metric) + ":" + value + "|" + metricType
+	if s.Format != "dogstatsd" {
+		// Plain StatsD does not support tags
+		return line
+	}
+
+	tags := []string{}
+	for k, v := range s.Tags {
+		tags = append(tags, statsdTagEscaper.Replace(k)+":"+statsdTagEscaper.Replace(v))
+	}
+	sort.Strings(tags)
+
+	for i, l := range labels {
+		if i < len(labelValues) && labelValues[i] != "" {
+			tags = append(tags, l+":"+statsdTagEscaper.Replace(labelValues[i]))
+		}
+	}
+
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdLine is a line queued for the address configured when the
+// metric was recorded
+type statsdLine struct {
+	addr, line string
+}
+
+// statsdCount sends an increment of the counter
+func statsdCount(metric string, labels, labelValues []string) {
+	statsdSend(getMainConfig().Metrics.StatsD, metric, "1", "c", labels, labelValues)
+}
+
+// statsdTiming sends an observation given in seconds as timing in
+// milliseconds
+func statsdTiming(metric string, seconds float64, labels, labelValues []string) {
+	statsdSend(getMainConfig().Metrics.StatsD, metric, metricFormatFloat(seconds*1000), "ms", labels, labelValues)
+}
+
+func statsdSend(s metricsStatsDConfig, metric, value, metricType string, labels, labelValues []string) {
+	if s.Address == "" {
+		return
+	}
+
+	statsdStartOnce.Do(func() { go statsdFlushLoop() })
+
+	select {
+	case statsdLines <- statsdLine{s.Address, s.line(metric, value, metricType, labels, labelValues)}:
+	default:
+		// Metrics must never block requests, drop the line
+	}
+}
+
+// statsdFlushLoop collects the lines into packets and sends them to the
+// address they were recorded for every statsdFlushInterval, when a
+// packet is full or when the address changed by a reload
+func statsdFlushLoop() {
+	var (
+		conn    net.Conn
+		addr    string
+		target  string
+		packet  []string
+		size    int
+		flushes = time.NewTicker(statsdFlushInterval)
+	)
+
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+
+		if conn == nil || target != addr {
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+
+			var err error
+			if conn, err = net.Dial("udp", target); err != nil {
+				log.WithError(err).WithField("address", target).Error("Unable to connect to StatsD")
+				packet, size = nil, 0
+				return
+			}
+			addr = target
+		}
+
+		if _, err := conn.Write([]byte(strings.Join(packet, "\n"))); err != nil {
+			log.WithError(err).Debug("Unable to send metrics to StatsD")
+		}
+		packet, size = nil, 0
+	}
+
+	for {
+		select {
+		case l := <-statsdLines:
+			if l.addr != target || size+len(l.line)+1 > statsdMaxPacketSize {
+				flush()
+			}
+			target = l.addr
+			packet = append(packet, l.line)
+			size += len(l.line) + 1
+
+		case <-flushes.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDEmitter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	prev := getMainConfig().Metrics.StatsD
+	defer func() { getMainConfig().Metrics.StatsD = prev }()
+
+	getMainConfig().Metrics.StatsD = metricsStatsDConfig{
+		Address: conn.LocalAddr().String(),
+		Format:  "dogstatsd",
+		Prefix:  "sso.",
+		Tags:    map[string]string{"env": "test"},
+	}
+	if err := getMainConfig().Metrics.StatsD.Validate(); err != nil {
+		t.Fatalf("Unable to validate StatsD config: %s", err)
+	}
+
+	metricLogins.Inc("simple", "success")
+	metricAuthRequestDuration.Observe(0.25, "200")
+
+	buf := make([]byte, statsdMaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No metrics received: %s", err)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	for i, expect := range []string{
+		"sso.logins:1|c|#env:test,provider:simple,result:success",
+		"sso.auth_request_duration:250|ms|#env:test,status:200",
+	} {
+		if i >= len(lines) || lines[i] != expect {
+			t.Errorf("Expected line %q, got %q", expect, lines)
+		}
+	}
+
+	plain := metricsStatsDConfig{Format: "statsd", Prefix: "sso."}
+	if l := plain.line("nginx_sso_mfa_failures_total", "1", "c", []string{"provider"}, []string{"totp"}); l != "sso.mfa_failures:1|c" {
+		t.Errorf("Unexpected plain StatsD line %q", l)
+	}
+}
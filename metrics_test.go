@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	c := newMetricCounter("test_total", "Test counter", "result")
+	c.Inc("allow")
+	c.Inc("allow")
+	c.Inc(`say "hi"`)
+
+	h := newMetricHistogram("test_seconds", "Test histogram", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(2, "get")
+
+	buf := new(bytes.Buffer)
+	c.Expose(buf)
+	h.Expose(buf)
+
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{result="allow"} 2`,
+		`test_total{result="say \"hi\""} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{op="get",le="0.1"} 1`,
+		`test_seconds_bucket{op="get",le="1"} 2`,
+		`test_seconds_bucket{op="get",le="+Inf"} 3`,
+		`test_seconds_sum{op="get"} 2.55`,
+		`test_seconds_count{op="get"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected line %q in output:\n%s", line, buf.String())
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/pkg/auth"
 )
 
 const mfaLoginFieldName = "mfa-token"
@@ -17,23 +21,10 @@ var mfaLoginField = loginField{
 	Type:        "text",
 }
 
-type mfaConfig struct {
-	Provider   string                 `yaml:"provider"`
-	Attributes map[string]interface{} `yaml:"attributes"`
-}
+type mfaConfig = auth.MFAConfig
 
 func newMFAConfig(provider string, attrs map[string]interface{}) mfaConfig {
-	return mfaConfig{Provider: provider, Attributes: attrs}
-}
-
-func (m mfaConfig) AttributeString(key string) string {
-	if v, ok := m.Attributes[key]; ok {
-		if sv, ok := v.(string); ok {
-			return sv
-		}
-	}
-
-	return ""
+	return auth.NewMFAConfig(provider, attrs)
 }
 
 type mfaProvider interface {
@@ -49,7 +40,7 @@ type mfaProvider interface {
 
 	// ValidateMFA takes the user from the login cookie and performs a
 	// validation against the provided MFA configuration for this user
-	ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error
+	ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error
 }
 
 var (
@@ -66,26 +57,38 @@ func registerMFAProvider(m mfaProvider) {
 	mfaRegistry = append(mfaRegistry, m)
 }
 
-func initializeMFAProviders(yamlSource []byte) error {
-	mfaRegistryMutex.Lock()
-	defer mfaRegistryMutex.Unlock()
+// configureMFAProviders configures new instances of all registered
+// MFA providers, they need to be activated using setMFAProviders
+func configureMFAProviders(yamlSource []byte) ([]mfaProvider, error) {
+	mfaRegistryMutex.RLock()
+	registry := mfaRegistry
+	mfaRegistryMutex.RUnlock()
 
-	for _, m := range mfaRegistry {
+	tmp := []mfaProvider{}
+	for _, proto := range registry {
+		m := auth.NewInstance(proto).(mfaProvider)
 		err := m.Configure(yamlSource)
 
-		switch err {
-		case nil:
-			activeMFAProviders = append(activeMFAProviders, m)
+		switch {
+		case err == nil:
+			tmp = append(tmp, m)
 			log.WithFields(log.Fields{"mfa_provider": m.ProviderID()}).Debug("Activated MFA provider")
-		case errProviderUnconfigured:
+		case errors.Is(err, errProviderUnconfigured):
 			log.WithFields(log.Fields{"mfa_provider": m.ProviderID()}).Debug("MFA provider unconfigured")
 			// This is okay.
 		default:
-			return fmt.Errorf("MFA provider configuration caused an error: %s", err)
+			return nil, fmt.Errorf("MFA provider configuration caused an error: %s", err)
 		}
 	}
 
-	return nil
+	return tmp, nil
+}
+
+func setMFAProviders(m []mfaProvider) {
+	mfaRegistryMutex.Lock()
+	defer mfaRegistryMutex.Unlock()
+
+	activeMFAProviders = m
 }
 
 func validateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
@@ -97,19 +100,39 @@ func validateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs
 	mfaRegistryMutex.RLock()
 	defer mfaRegistryMutex.RUnlock()
 
-	for _, m := range activeMFAProviders {
-		err := m.ValidateMFA(res, r, user, mfaCfgs)
-		switch err {
-		case nil:
+	meta, _ := getSessionMeta(r)
+	publish := func(event auditEvent, result string, fields map[string]string) {
+		publishEvent(authEvent{Type: event, Request: r, User: user, Provider: meta.Provider, Result: result, Fields: fields})
+	}
+
+	for _, m := range requestMFAProviders(r) {
+		s := startSpan(r, "validate_mfa "+m.ProviderID())
+		ctx, cancel := providerContext(r)
+		release, err := acquireProvider(ctx, m.ProviderID())
+		if err == nil {
+			err = providerError(ctx, m.ValidateMFA(ctx, res, r, user, mfaCfgs))
+			release()
+		}
+		cancel()
+		s.Finish(err)
+
+		switch {
+		case err == nil:
 			// Validated successfully
+			publish(auditEventMFASuccess, "success", map[string]string{"mfa_provider": m.ProviderID()})
 			return nil
-		case errNoValidUserFound:
+		case errors.Is(err, errNoUser):
 			// This is fine for now
 		default:
+			publish(auditEventMFAFailure, "error", map[string]string{"reason": "error", "error": err.Error()})
 			return err
 		}
 	}
 
 	// No method could verify the user
-	return errNoValidUserFound
+	publish(auditEventMFAFailure, "invalid_token", map[string]string{"reason": "invalid token"})
+	if !hasMFAToken(r) {
+		return errMFARequired
+	}
+	return errWrongCredentials
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 	"time"
@@ -57,7 +58,7 @@ func (m *mfaDuo) Configure(yamlSource []byte) (err error) {
 
 // ValidateMFA takes the user from the login cookie and performs a
 // validation against the provided MFA configuration for this user
-func (m mfaDuo) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
+func (m mfaDuo) ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
 	var keyInput string
 	// Look for mfaConfigs with own provider name
 	for _, c := range mfaCfgs {
@@ -73,17 +74,25 @@ func (m mfaDuo) ValidateMFA(res http.ResponseWriter, r *http.Request, user strin
 		}
 		//Check if MFA token provided and fallover to push if not supplied
 		if keyInput != "" {
-			auth, err := duo.Auth("passcode", authapi.AuthUsername(user), authapi.AuthPasscode(keyInput), authapi.AuthIpAddr(remoteIP))
+			var auth *authapi.AuthResult
+			err := callWithContext(ctx, func() (err error) {
+				auth, err = duo.Auth("passcode", authapi.AuthUsername(user), authapi.AuthPasscode(keyInput), authapi.AuthIpAddr(remoteIP))
+				return err
+			})
 			if err != nil {
-				return errors.Wrap(err, "Unable to authenticate with Duo.")
+				return backendUnavailable(errors.Wrap(err, "Unable to authenticate with Duo."))
 			}
 			if auth.Response.Result == mfaDuoResponseAllow {
 				return nil
 			}
 		} else {
-			auth, err := duo.Auth("auto", authapi.AuthUsername(user), authapi.AuthDevice("auto"), authapi.AuthIpAddr(remoteIP))
+			var auth *authapi.AuthResult
+			err := callWithContext(ctx, func() (err error) {
+				auth, err = duo.Auth("auto", authapi.AuthUsername(user), authapi.AuthDevice("auto"), authapi.AuthIpAddr(remoteIP))
+				return err
+			})
 			if err != nil {
-				return errors.Wrap(err, "Unable to authenticate with Duo.")
+				return backendUnavailable(errors.Wrap(err, "Unable to authenticate with Duo."))
 			}
 			if auth.Response.Result == mfaDuoResponseAllow {
 				return nil
@@ -92,5 +101,5 @@ func (m mfaDuo) ValidateMFA(res http.ResponseWriter, r *http.Request, user strin
 	}
 
 	// Report this provider was not able to verify the MFA request
-	return errNoValidUserFound
+	return errNoUser
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 	"time"
@@ -29,7 +30,7 @@ func (m mfaGoogle) Configure(yamlSource []byte) (err error) { return nil }
 
 // ValidateMFA takes the user from the login cookie and performs a
 // validation against the provided MFA configuration for this user
-func (m mfaGoogle) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
+func (m mfaGoogle) ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
 	// Look for mfaConfigs with own provider name
 	for _, c := range mfaCfgs {
 		if c.Provider != m.ProviderID() {
@@ -49,7 +50,7 @@ func (m mfaGoogle) ValidateMFA(res http.ResponseWriter, r *http.Request, user st
 	}
 
 	// Report this provider was not able to verify the MFA request
-	return errNoValidUserFound
+	return errNoUser
 }
 
 func (m mfaGoogle) exec(c mfaConfig) (string, error) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -49,7 +50,7 @@ func (m *mfaYubikey) Configure(yamlSource []byte) (err error) {
 
 // ValidateMFA takes the user from the login cookie and performs a
 // validation against the provided MFA configuration for this user
-func (m mfaYubikey) ValidateMFA(res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
+func (m mfaYubikey) ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
 	var keyInput string
 
 	yubiAuth, err := yubigo.NewYubiAuth(m.ClientID, m.SecretKey)
@@ -72,9 +73,13 @@ func (m mfaYubikey) ValidateMFA(res http.ResponseWriter, r *http.Request, user s
 			continue
 		}
 
-		_, ok, err := yubiAuth.Verify(keyInput)
+		var ok bool
+		err := callWithContext(ctx, func() (err error) {
+			_, ok, err = yubiAuth.Verify(keyInput)
+			return err
+		})
 		if err != nil && !strings.Contains(err.Error(), "OTP has wrong length.") {
-			return errors.Wrap(err, "OTP verification failed")
+			return backendUnavailable(errors.Wrap(err, "OTP verification failed"))
 		}
 
 		if ok {
@@ -83,5 +88,5 @@ func (m mfaYubikey) ValidateMFA(res http.ResponseWriter, r *http.Request, user s
 	}
 
 	// Not a valid authentication
-	return errNoValidUserFound
+	return errNoUser
 }
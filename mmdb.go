@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker separates the data section from the metadata of
+// a MaxMind DB file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbDataSectionSeparator = 16
+
+// mmdbReader is a minimal reader for MaxMind DB (GeoLite2 / GeoIP2)
+// database files as described in the MaxMind DB file format spec
+type mmdbReader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+
+	ipv4Start uint
+}
+
+func openMMDB(filename string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMMDBReader(buf)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	idx := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("Metadata marker not found, file is no MaxMind DB")
+	}
+
+	metaStart := idx + len(mmdbMetadataMarker)
+	rawMeta, _, err := (mmdbDecoder{buf: buf[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode metadata: %s", err)
+	}
+
+	meta, ok := rawMeta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Metadata is no map")
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount = mmdbUint(meta["node_count"])
+	r.recordSize = mmdbUint(meta["record_size"])
+	r.ipVersion = mmdbUint(meta["ip_version"])
+	r.dbType, _ = meta["database_type"].(string)
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("Unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSectionSeparator > uint(idx) {
+		return nil, fmt.Errorf("Search tree exceeds file size")
+	}
+	r.data = buf[treeSize+mmdbDataSectionSeparator : idx]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are stored in the ::/96 subtree
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup searches the record for the given IP and returns nil if the
+// IP is not contained in the database
+func (r *mmdbReader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+
+	if v4 := ip.To4(); v4 != nil {
+		bits = v4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		// IPv6 addresses are not part of an IPv4 database
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+		node = r.readRecord(node, uint(bit))
+	}
+
+	switch {
+	case node == r.nodeCount:
+		// Empty record, IP is not contained in the database
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, fmt.Errorf("Invalid search tree for IP %s", ip)
+	}
+
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	v, _, err := (mmdbDecoder{buf: r.data}).decode(offset)
+	return v, err
+}
+
+func (r *mmdbReader) readRecord(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.buf[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+
+	case 28:
+		b := r.buf[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+
+	default:
+		return uint(binary.BigEndian.Uint32(r.buf[node*8+bit*4:]))
+	}
+}
+
+const (
+	mmdbTypeExtended uint = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+// mmdbMaxDepth limits the nesting of maps, arrays and pointers to not
+// overflow the stack on malformed databases referencing themselves
+const mmdbMaxDepth = 64
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode reads the value at the given offset and returns it together
+// with the offset of the next value
+func (d mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeValue(offset, 0)
+}
+
+func (d mmdbDecoder) decodeValue(offset, depth uint) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("Value at offset %d exceeds maximum nesting depth", offset)
+	}
+
+	typ, size, offset, err := d.readControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == mmdbTypePointer {
+		ptr, next, err := d.readPointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Pointers must not point to pointers
+		if target, _, _, err := d.readControl(ptr); err == nil && target == mmdbTypePointer {
+			return nil, 0, fmt.Errorf("Pointer at offset %d points to another pointer", offset)
+		}
+		v, _, err := d.decodeValue(ptr, depth+1)
+		return v, next, err
+	}
+
+	// Array entries take at least one byte, map entries two for the key
+	// and the value: Larger sizes are not allocated
+	remaining := uint(len(d.buf)) - offset
+	switch {
+	case typ == mmdbTypeMap && size > remaining/2, typ == mmdbTypeArray && size > remaining:
+		return nil, 0, fmt.Errorf("Container at offset %d exceeds data section", offset)
+	}
+
+	switch typ {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("Map key at offset %d is no string", offset)
+			}
+
+			m[key], offset, err = d.decodeValue(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+
+	case mmdbTypeArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], offset, err = d.decodeValue(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("Value at offset %d exceeds data section", offset)
+	}
+	raw := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typ {
+	case mmdbTypeString:
+		return string(raw), next, nil
+	case mmdbTypeBytes:
+		return append([]byte{}, raw...), next, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("Invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("Invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		var v uint64
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+		return v, next, nil
+	case mmdbTypeInt32:
+		var v uint32
+		for _, b := range raw {
+			v = v<<8 | uint32(b)
+		}
+		return int64(int32(v)), next, nil
+	case mmdbTypeUint128:
+		// Not required for country lookups, returned as raw bytes
+		return append([]byte{}, raw...), next, nil
+	default:
+		return nil, 0, fmt.Errorf("Unsupported data type %d at offset %d", typ, offset)
+	}
+}
+
+func (d mmdbDecoder) readControl(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, fmt.Errorf("Offset %d exceeds data section", offset)
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+
+	typ = uint(ctrl >> 5)
+	if typ == mmdbTypeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, fmt.Errorf("Offset %d exceeds data section", offset)
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size = uint(ctrl & 0x1f)
+	if typ == mmdbTypePointer {
+		return typ, size, offset, nil
+	}
+
+	var extra uint
+	switch size {
+	case 29:
+		extra = 1
+	case 30:
+		extra = 2
+	case 31:
+		extra = 3
+	}
+
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, 0, fmt.Errorf("Offset %d exceeds data section", offset)
+	}
+
+	var v uint
+	for _, b := range d.buf[offset : offset+extra] {
+		v = v<<8 | uint(b)
+	}
+
+	switch size {
+	case 29:
+		size = 29 + v
+	case 30:
+		size = 285 + v
+	case 31:
+		size = 65821 + v
+	}
+
+	return typ, size, offset + extra, nil
+}
+
+func (d mmdbDecoder) readPointer(size, offset uint) (uint, uint, error) {
+	ptrSize := (size >> 3) & 0x3
+	n := ptrSize + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("Pointer at offset %d exceeds data section", offset)
+	}
+
+	var v uint
+	if ptrSize < 3 {
+		v = size & 0x7
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(b)
+	}
+
+	switch ptrSize {
+	case 1:
+		v += 2048
+	case 2:
+		v += 526336
+	}
+
+	return v, offset + n, nil
+}
+
+func mmdbUint(v interface{}) uint {
+	u, _ := v.(uint64)
+	return uint(u)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func mmdbTestString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func mmdbTestUint16(v uint16) []byte {
+	return []byte{0xa0 | 2, byte(v >> 8), byte(v)}
+}
+
+// mmdbTestDatabase builds an IPv4 database containing only the network
+// 10.0.0.0/8 located in Germany
+func mmdbTestDatabase() []byte {
+	const nodeCount = 8
+	network := byte(10)
+
+	buf := new(bytes.Buffer)
+	for i := uint(0); i < nodeCount; i++ {
+		next := i + 1
+		if next == nodeCount {
+			// Pointer to the first record in the data section
+			next = nodeCount + mmdbDataSectionSeparator
+		}
+
+		records := [2]uint{nodeCount, nodeCount}
+		records[(network>>(7-i))&1] = next
+		for _, rec := range records {
+			buf.Write([]byte{byte(rec >> 16), byte(rec >> 8), byte(rec)})
+		}
+	}
+
+	buf.Write(make([]byte, mmdbDataSectionSeparator))
+
+	buf.WriteByte(0xe0 | 1)
+	buf.Write(mmdbTestString("country"))
+	buf.WriteByte(0xe0 | 1)
+	buf.Write(mmdbTestString("iso_code"))
+	buf.Write(mmdbTestString("DE"))
+
+	buf.Write(mmdbMetadataMarker)
+	buf.WriteByte(0xe0 | 4)
+	buf.Write(mmdbTestString("node_count"))
+	buf.Write(mmdbTestUint16(nodeCount))
+	buf.Write(mmdbTestString("record_size"))
+	buf.Write(mmdbTestUint16(24))
+	buf.Write(mmdbTestString("ip_version"))
+	buf.Write(mmdbTestUint16(4))
+	buf.Write(mmdbTestString("database_type"))
+	buf.Write(mmdbTestString("Test-Country"))
+
+	return buf.Bytes()
+}
+
+func TestMMDBLookup(t *testing.T) {
+	r, err := newMMDBReader(mmdbTestDatabase())
+	if err != nil {
+		t.Fatalf("Unable to read database: %s", err)
+	}
+
+	if r.dbType != "Test-Country" {
+		t.Errorf("Unexpected database type %q", r.dbType)
+	}
+
+	for ip, expCountry := range map[string]string{
+		"10.1.2.3":    "DE",
+		"10.255.0.1":  "DE",
+		"11.0.0.1":    "",
+		"192.168.0.1": "",
+		"fd00::1":     "",
+	} {
+		record, err := r.Lookup(net.ParseIP(ip))
+		if err != nil {
+			t.Errorf("Lookup of %s caused an error: %s", ip, err)
+			continue
+		}
+
+		if country := mmdbPath(record, "country", "iso_code"); country != expCountry {
+			t.Errorf("Expected country %q for %s, got %q", expCountry, ip, country)
+		}
+	}
+}
+
+func TestMMDBMalformed(t *testing.T) {
+	for name, metadata := range map[string][]byte{
+		"pointer to itself":        {0x20, 0x00},
+		"map containing itself":    {0xe1, 0x41, 'a', 0x20, 0x00},
+		"array exceeding the file": {0x1f, 0x04, 0xff, 0xff, 0xff},
+		"map exceeding the file":   {0xfd, 0xff, 0xff, 0xff, 0x41, 'a'},
+	} {
+		if _, err := newMMDBReader(append(append([]byte{}, mmdbMetadataMarker...), metadata...)); err == nil {
+			t.Errorf("Expected database with %s to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/go_helpers/str"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	oidcDefaultCodeTTL  = time.Minute
+	oidcDefaultTokenTTL = time.Hour
+
+	oidcPathAuthorize  = "/oidc/authorize"
+	oidcPathIntrospect = "/oidc/introspect"
+	oidcPathJWKS       = "/oidc/jwks.json"
+	oidcPathToken      = "/oidc/token"
+	oidcPathUserInfo   = "/oidc/userinfo"
+)
+
+// oidcProviderConfig lets nginx-sso act as OpenID Connect provider for
+// applications speaking OIDC natively
+type oidcProviderConfig struct {
+	Issuer         string                      `yaml:"issuer"`
+	SigningKeys    []string                    `yaml:"signing_keys"`
+	CodeTTL        time.Duration               `yaml:"code_ttl"`
+	TokenTTL       time.Duration               `yaml:"token_ttl"`
+	Clients        map[string]oidcClientConfig `yaml:"clients"`
+	UpstreamTokens []oidcUpstreamToken         `yaml:"upstream_tokens"`
+}
+
+type oidcClientConfig struct {
+	// Secret contains the bcrypt hash of the client secret, clients
+	// without secret are public clients and need to use PKCE
+	Secret       string   `yaml:"secret"`
+	RedirectURIs []string `yaml:"redirect_uris"`
+	// ExchangeAudiences lists the audiences the client may request
+	// tokens for using the token exchange
+	ExchangeAudiences []string `yaml:"exchange_audiences"`
+	// ExchangeSubjectAudiences lists the audiences of subject tokens the
+	// client may exchange in addition to the tokens issued to itself
+	ExchangeSubjectAudiences []string `yaml:"exchange_subject_audiences"`
+	// RequireDPoP rejects token requests without DPoP proof so all
+	// access tokens of the client are bound to the key of the client
+	RequireDPoP bool `yaml:"require_dpop"`
+}
+
+func (o oidcProviderConfig) Enabled() bool { return o.Issuer != "" }
+
+func (o oidcProviderConfig) Validate() error {
+	if !o.Enabled() {
+		return nil
+	}
+
+	if u, err := url.Parse(o.Issuer); err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("Issuer needs to be an https URL without query and fragment")
+	}
+
+	if len(o.SigningKeys) == 0 {
+		return fmt.Errorf("At least one signing key is required")
+	}
+
+	for id, c := range o.Clients {
+		if len(c.RedirectURIs) == 0 && len(c.ExchangeAudiences) == 0 {
+			return fmt.Errorf("Client %q has no redirect URIs", id)
+		}
+		if len(c.ExchangeAudiences) > 0 && c.Secret == "" {
+			return fmt.Errorf("Client %q needs a secret to exchange tokens", id)
+		}
+	}
+
+	for n, u := range o.UpstreamTokens {
+		if err := u.Validate(); err != nil {
+			return fmt.Errorf("Upstream token on position %d is invalid: %s", n+1, err)
+		}
+	}
+
+	return nil
+}
+
+// oidcAuthorizationCode holds the result of the authorization request
+// until the client exchanges the code for tokens
+type oidcAuthorizationCode struct {
+	ClientID      string
+	RedirectURI   string
+	User          string
+	Groups        []string
+	Claims        map[string]string
+	Nonce         string
+	Scope         string
+	CodeChallenge string
+	AuthTime      time.Time
+	Expires       time.Time
+}
+
+type oidcProvider struct {
+	config oidcProviderConfig
+	keys   *jwtKeySet
+
+	codes     map[string]oidcAuthorizationCode
+	codesLock sync.Mutex
+}
+
+var (
+	activeOIDCProvider      *oidcProvider
+	activeOIDCProviderMutex sync.RWMutex
+)
+
+// initializeOIDCProvider loads the signing keys of the provider.
+// Pending authorization codes are kept on reload.
+func initializeOIDCProvider(c oidcProviderConfig) error {
+	activate, err := prepareOIDCProvider(c)
+	if err != nil {
+		return err
+	}
+	activate()
+	return nil
+}
+
+// prepareOIDCProvider loads the signing keys without replacing the
+// active provider, the returned function activates it
+func prepareOIDCProvider(c oidcProviderConfig) (func(), error) {
+	var p *oidcProvider
+	if c.Enabled() {
+		if c.CodeTTL == 0 {
+			c.CodeTTL = oidcDefaultCodeTTL
+		}
+		if c.TokenTTL == 0 {
+			c.TokenTTL = oidcDefaultTokenTTL
+		}
+
+		keys, err := loadJWTKeySet(c.SigningKeys)
+		if err != nil {
+			return nil, err
+		}
+		p = &oidcProvider{config: c, keys: keys, codes: map[string]oidcAuthorizationCode{}}
+	}
+
+	return func() {
+		activeOIDCProviderMutex.Lock()
+		defer activeOIDCProviderMutex.Unlock()
+
+		if p != nil && activeOIDCProvider != nil {
+			activeOIDCProvider.codesLock.Lock()
+			p.codes = activeOIDCProvider.codes
+			activeOIDCProvider.codesLock.Unlock()
+		}
+		activeOIDCProvider = p
+	}, nil
+}
+
+func getOIDCProvider() *oidcProvider {
+	activeOIDCProviderMutex.RLock()
+	defer activeOIDCProviderMutex.RUnlock()
+
+	return activeOIDCProvider
+}
+
+// withOIDCProvider responds with 404 if the provider is not configured
+func withOIDCProvider(h func(*oidcProvider, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		p := getOIDCProvider()
+		if p == nil {
+			http.NotFound(res, r)
+			return
+		}
+		h(p, res, r)
+	}
+}
+
+func (p *oidcProvider) endpoint(path string) string {
+	return strings.TrimRight(p.config.Issuer, "/") + path
+}
+
+func (p *oidcProvider) storeCode(c oidcAuthorizationCode) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(buf)
+
+	p.codesLock.Lock()
+	defer p.codesLock.Unlock()
+
+	now := time.Now()
+	for k, v := range p.codes {
+		if v.Expires.Before(now) {
+			delete(p.codes, k)
+		}
+	}
+
+	c.Expires = now.Add(p.config.CodeTTL)
+	p.codes[code] = c
+
+	return code, nil
+}
+
+// redeemCode returns the authorization code and removes it as every
+// code can only be used once
+func (p *oidcProvider) redeemCode(code string) (oidcAuthorizationCode, bool) {
+	p.codesLock.Lock()
+	defer p.codesLock.Unlock()
+
+	c, ok := p.codes[code]
+	delete(p.codes, code)
+
+	if !ok || c.Expires.Before(time.Now()) {
+		return oidcAuthorizationCode{}, false
+	}
+
+	return c, true
+}
+
+// authenticateClient checks the client credentials passed using HTTP
+// basic auth or in the form body. Public clients only need to pass
+// their ID.
+func (p *oidcProvider) authenticateClient(r *http.Request) (string, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	client, ok := p.config.Clients[clientID]
+	if !ok {
+		return "", false
+	}
+
+	if client.Secret == "" {
+		return clientID, true
+	}
+
+	return clientID, bcrypt.CompareHashAndPassword([]byte(client.Secret), []byte(secret)) == nil
+}
+
+func (p *oidcProvider) handleDiscovery(res http.ResponseWriter, r *http.Request) {
+	oidcJSONResponse(res, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.config.Issuer,
+		"authorization_endpoint":                p.endpoint(oidcPathAuthorize),
+		"token_endpoint":                        p.endpoint(oidcPathToken),
+		"userinfo_endpoint":                     p.endpoint(oidcPathUserInfo),
+		"introspection_endpoint":                p.endpoint(oidcPathIntrospect),
+		"jwks_uri":                              p.endpoint(oidcPathJWKS),
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", oidcGrantTypeTokenExchange},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": p.signingAlgorithms(),
+		"scopes_supported":                      []string{"openid", "profile", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported":                      []string{"sub", "preferred_username", "groups", "auth_time", "nonce"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"dpop_signing_alg_values_supported":     dpopSigningAlgorithms,
+	})
+}
+
+func (p *oidcProvider) signingAlgorithms() []string {
+	var algs []string
+	for _, k := range p.keys.keys {
+		if !str.StringInSlice(k.Algorithm, algs) {
+			algs = append(algs, k.Algorithm)
+		}
+	}
+	return algs
+}
+
+func (p *oidcProvider) handleJWKS(res http.ResponseWriter, r *http.Request) {
+	oidcJSONResponse(res, http.StatusOK, p.keys.JWKS())
+}
+
+func (p *oidcProvider) handleAuthorize(res http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	clientID := q.Get("client_id")
+	redirectURI := q.Get("redirect_uri")
+
+	client, ok := p.config.Clients[clientID]
+	if !ok || !str.StringInSlice(redirectURI, client.RedirectURIs) {
+		// Never redirect to an unverified target
+		http.Error(res, "Invalid client or redirect URI", http.StatusBadRequest)
+		return
+	}
+
+	fail := func(code, description string) {
+		target, _ := url.Parse(redirectURI)
+		params := target.Query()
+		params.Set("error", code)
+		params.Set("error_description", description)
+		if state := q.Get("state"); state != "" {
+			params.Set("state", state)
+		}
+		target.RawQuery = params.Encode()
+		http.Redirect(res, r, target.String(), http.StatusFound)
+	}
+
+	switch {
+	case q.Get("response_type") != "code":
+		fail("unsupported_response_type", "Only the authorization code flow is supported")
+		return
+	case !str.StringInSlice("openid", strings.Fields(q.Get("scope"))):
+		fail("invalid_scope", "The openid scope is required")
+		return
+	case q.Get("code_challenge") != "" && q.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "Only the S256 code challenge method is supported")
+		return
+	case client.Secret == "" && q.Get("code_challenge") == "":
+		fail("invalid_request", "Public clients need to use PKCE")
+		return
+	}
+
+	user, groups, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// User is logged in, continue below
+
+	case errors.Is(err, errNoUser):
+		if q.Get("prompt") == "none" {
+			fail("login_required", "The user is not logged in")
+			return
+		}
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Unable to detect user")
+		fail("server_error", "Unable to detect user")
+		return
+	}
+
+	if !getMainConfig().Terms.Accepted(r, user) {
+		if q.Get("prompt") == "none" {
+			fail("consent_required", "The user needs to accept the terms of service")
+			return
+		}
+		http.Redirect(res, r, termsPath+"?go="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+
+	authTime := time.Now()
+	if m, ok := getSessionMeta(r); ok && !m.LoginTime.IsZero() {
+		authTime = m.LoginTime
+	}
+
+	mappedUser, mappedGroups, claims, err := getMainConfig().ClaimsMapping.Apply(r, user, groups)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to map claims")
+		fail("server_error", "Unable to map claims")
+		return
+	}
+
+	tokenGroups, err := getMainConfig().TokenGroups.Resolve(r, user, mappedGroups)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to resolve token groups")
+		fail("server_error", "Unable to resolve groups")
+		return
+	}
+
+	code, err := p.storeCode(oidcAuthorizationCode{
+		ClientID:      clientID,
+		RedirectURI:   redirectURI,
+		User:          mappedUser,
+		Groups:        tokenGroups,
+		Claims:        claims,
+		Nonce:         q.Get("nonce"),
+		Scope:         q.Get("scope"),
+		CodeChallenge: q.Get("code_challenge"),
+		AuthTime:      authTime,
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to create authorization code")
+		fail("server_error", "Unable to create authorization code")
+		return
+	}
+
+	target, _ := url.Parse(redirectURI)
+	params := target.Query()
+	params.Set("code", code)
+	if state := q.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	target.RawQuery = params.Encode()
+
+	http.Redirect(res, r, target.String(), http.StatusFound)
+}
+
+func (p *oidcProvider) handleToken(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		oidcErrorResponse(res, http.StatusMethodNotAllowed, "invalid_request", "Token requests need to use POST")
+		return
+	}
+
+	clientID, ok := p.authenticateClient(r)
+	if !ok {
+		res.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+		oidcErrorResponse(res, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	// Access tokens are bound to the key of the DPoP proof
+	proof, err := verifyDPoPRequest(r, http.MethodPost, p.endpoint(oidcPathToken), "")
+	if err == nil && proof == nil && p.config.Clients[clientID].RequireDPoP {
+		err = errDPoPRequired
+	}
+	if err != nil {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		// Handled below
+
+	case oidcGrantTypeTokenExchange:
+		p.handleTokenExchange(res, r, clientID, proof)
+		return
+
+	default:
+		oidcErrorResponse(res, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code and token exchange grants are supported")
+		return
+	}
+
+	code, ok := p.redeemCode(r.PostFormValue("code"))
+	if !ok || code.ClientID != clientID || code.RedirectURI != r.PostFormValue("redirect_uri") {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_grant", "Authorization code is invalid")
+		return
+	}
+
+	if code.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(code.CodeChallenge)) != 1 {
+			oidcErrorResponse(res, http.StatusBadRequest, "invalid_grant", "Code verifier does not match")
+			return
+		}
+	}
+
+	now := time.Now()
+	claims := func(tokenUse string) map[string]interface{} {
+		return map[string]interface{}{
+			"aud":       clientID,
+			"exp":       now.Add(p.config.TokenTTL).Unix(),
+			"iat":       now.Unix(),
+			"iss":       p.config.Issuer,
+			"sub":       code.User,
+			"token_use": tokenUse,
+		}
+	}
+
+	// The access token carries the groups as the userinfo endpoint has
+	// no access to the session of the user
+	accessClaims := claims("access")
+	accessClaims["scope"] = code.Scope
+	accessClaims["groups"] = code.Groups
+	for k, v := range code.Claims {
+		accessClaims[k] = v
+	}
+	tokenType := "Bearer"
+	if proof != nil {
+		accessClaims["cnf"] = map[string]string{"jkt": proof.Thumbprint}
+		tokenType = "DPoP"
+	}
+	accessToken, err := p.keys.Sign(accessClaims)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to sign access token")
+		oidcErrorResponse(res, http.StatusInternalServerError, "server_error", "Unable to sign token")
+		return
+	}
+
+	idClaims := claims("id")
+	idClaims["auth_time"] = code.AuthTime.Unix()
+	for k, v := range p.userClaims(code.User, code.Groups, code.Claims, code.Scope) {
+		idClaims[k] = v
+	}
+	if code.Nonce != "" {
+		idClaims["nonce"] = code.Nonce
+	}
+	idToken, err := p.keys.Sign(idClaims)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to sign ID token")
+		oidcErrorResponse(res, http.StatusInternalServerError, "server_error", "Unable to sign token")
+		return
+	}
+
+	oidcJSONResponse(res, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"expires_in":   int(p.config.TokenTTL / time.Second),
+		"id_token":     idToken,
+		"token_type":   tokenType,
+	})
+}
+
+// userClaims returns the claims describing the user depending on the
+// requested scopes. The claims of the claims mapping are part of the
+// profile scope.
+func (p *oidcProvider) userClaims(user string, groups []string, mapped map[string]string, scope string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	scopes := strings.Fields(scope)
+
+	if str.StringInSlice("profile", scopes) {
+		claims["preferred_username"] = user
+		for k, v := range mapped {
+			claims[k] = v
+		}
+	}
+
+	if str.StringInSlice("groups", scopes) {
+		if groups == nil {
+			groups = []string{}
+		}
+		claims["groups"] = groups
+	}
+
+	return claims
+}
+
+func (p *oidcProvider) handleUserInfo(res http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	scheme := "Bearer"
+	if strings.HasPrefix(auth, "DPoP ") {
+		scheme = "DPoP"
+	}
+	token := strings.TrimPrefix(auth, scheme+" ")
+
+	claims, err := p.keys.Verify(token)
+	if err == nil && (claims["token_use"] != "access" || claims["iss"] != p.config.Issuer) {
+		err = errJWTInvalid
+	}
+
+	if err == nil {
+		// Bound tokens need to be presented with a proof of the key,
+		// unbound tokens must not use the DPoP scheme
+		jkt := dpopBoundKey(claims)
+		if (jkt != "") != (scheme == "DPoP") {
+			err = errJWTInvalid
+		} else if jkt != "" {
+			proof, perr := verifyDPoPRequest(r, r.Method, p.endpoint(oidcPathUserInfo), token)
+			if perr != nil || proof == nil || proof.Thumbprint != jkt {
+				err = errDPoPInvalid
+			}
+		}
+	}
+
+	if err != nil {
+		res.Header().Set("WWW-Authenticate", scheme+` error="invalid_token"`)
+		oidcErrorResponse(res, http.StatusUnauthorized, "invalid_token", "Access token is invalid")
+		return
+	}
+
+	user, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+
+	var groups []string
+	if rawGroups, ok := claims["groups"].([]interface{}); ok {
+		for _, g := range rawGroups {
+			if group, ok := g.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	// Mapped claims are carried by the access token
+	mapped := map[string]string{}
+	for name := range getMainConfig().ClaimsMapping.Claims {
+		if v, ok := claims[name].(string); ok {
+			mapped[name] = v
+		}
+	}
+
+	info := p.userClaims(user, groups, mapped, scope)
+	info["sub"] = user
+
+	oidcJSONResponse(res, http.StatusOK, info)
+}
+
+// handleIntrospect implements token introspection (RFC 7662) for
+// confidential clients. Tokens issued by the provider and IDs of
+// tracked sessions are accepted.
+func (p *oidcProvider) handleIntrospect(res http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		oidcErrorResponse(res, http.StatusMethodNotAllowed, "invalid_request", "Introspection requests need to use POST")
+		return
+	}
+
+	clientID, ok := p.authenticateClient(r)
+	if !ok || p.config.Clients[clientID].Secret == "" {
+		res.Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+		oidcErrorResponse(res, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	inactive := map[string]interface{}{"active": false}
+
+	if claims, err := p.keys.Verify(token); err == nil {
+		// ID tokens must not be accepted as access tokens
+		if claims["iss"] != p.config.Issuer || claims["token_use"] != "access" {
+			oidcJSONResponse(res, http.StatusOK, inactive)
+			return
+		}
+
+		result := map[string]interface{}{
+			"active":     true,
+			"token_type": "Bearer",
+			"client_id":  claims["aud"],
+			"username":   claims["sub"],
+		}
+		if dpopBoundKey(claims) != "" {
+			result["token_type"] = "DPoP"
+		}
+		for _, k := range []string{"aud", "cnf", "exp", "groups", "iat", "iss", "scope", "sub"} {
+			if v, ok := claims[k]; ok {
+				result[k] = v
+			}
+		}
+
+		oidcJSONResponse(res, http.StatusOK, result)
+		return
+	}
+
+	store := getSessionStore()
+	if store == nil || token == "" {
+		oidcJSONResponse(res, http.StatusOK, inactive)
+		return
+	}
+
+	sess, err := store.Get(token)
+	switch err {
+	case nil:
+		oidcJSONResponse(res, http.StatusOK, map[string]interface{}{
+			"active":     true,
+			"token_type": "session",
+			"sub":        sess.User,
+			"username":   sess.User,
+			"iat":        sess.Created.Unix(),
+			"provider":   sess.Provider,
+		})
+
+	case errSessionNotFound:
+		oidcJSONResponse(res, http.StatusOK, inactive)
+
+	default:
+		requestLog(r).WithError(err).Error("Unable to fetch session")
+		oidcErrorResponse(res, http.StatusInternalServerError, "server_error", "Unable to fetch session")
+	}
+}
+
+func oidcJSONResponse(res http.ResponseWriter, status int, data interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Pragma", "no-cache")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(data); err != nil {
+		log.WithError(errors.Wrap(err, "Unable to encode response")).Error("OIDC request failed")
+	}
+}
+
+func oidcErrorResponse(res http.ResponseWriter, status int, code, description string) {
+	oidcJSONResponse(res, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
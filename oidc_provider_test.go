@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func oidcTestProvider(t *testing.T) *oidcProvider {
+	return &oidcProvider{
+		config: oidcProviderConfig{
+			Issuer:   "https://login.example.com",
+			CodeTTL:  time.Minute,
+			TokenTTL: time.Hour,
+			Clients: map[string]oidcClientConfig{
+				"spa": {RedirectURIs: []string{"https://app.example.com/callback"}},
+			},
+		},
+		keys:  jwtTestKeySet(t),
+		codes: map[string]oidcAuthorizationCode{},
+	}
+}
+
+func TestOIDCAuthorizeRejectsUnknownRedirect(t *testing.T) {
+	p := oidcTestProvider(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/oidc/authorize?"+url.Values{
+		"client_id":     {"spa"},
+		"redirect_uri":  {"https://evil.example.org/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}.Encode(), nil)
+	rec := httptest.NewRecorder()
+
+	p.handleAuthorize(rec, r)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestOIDCTokenExchange(t *testing.T) {
+	p := oidcTestProvider(t)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+
+	code, err := p.storeCode(oidcAuthorizationCode{
+		ClientID:      "spa",
+		RedirectURI:   "https://app.example.com/callback",
+		User:          "alice",
+		Groups:        []string{"admins"},
+		Nonce:         "n-0S6_WzA2Mj",
+		Scope:         "openid groups",
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+		AuthTime:      time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Unable to store code: %s", err)
+	}
+
+	exchange := func(verifier string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(url.Values{
+			"client_id":     {"spa"},
+			"code":          {code},
+			"code_verifier": {verifier},
+			"grant_type":    {"authorization_code"},
+			"redirect_uri":  {"https://app.example.com/callback"},
+		}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		p.handleToken(rec, r)
+		return rec
+	}
+
+	rec := exchange(verifier)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&tokens); err != nil {
+		t.Fatalf("Unable to decode token response: %s", err)
+	}
+
+	claims, err := p.keys.Verify(tokens.IDToken)
+	if err != nil {
+		t.Fatalf("Unable to verify ID token: %s", err)
+	}
+	if claims["sub"] != "alice" || claims["aud"] != "spa" || claims["nonce"] != "n-0S6_WzA2Mj" {
+		t.Errorf("Unexpected ID token claims: %v", claims)
+	}
+
+	if rec := exchange(verifier); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected code to be usable only once, got status %d", rec.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/oidc/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	rec = httptest.NewRecorder()
+	p.handleUserInfo(rec, r)
+
+	var info struct {
+		Sub    string   `json:"sub"`
+		Groups []string `json:"groups"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("Unable to decode userinfo response: %s", err)
+	}
+	if info.Sub != "alice" || len(info.Groups) != 1 || info.Groups[0] != "admins" {
+		t.Errorf("Unexpected userinfo: %+v", info)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/oidc/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens.IDToken)
+	rec = httptest.NewRecorder()
+	p.handleUserInfo(rec, r)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected ID token to be rejected by userinfo, got status %d", rec.Code)
+	}
+}
+
+func TestOIDCTokenRejectsInvalidVerifier(t *testing.T) {
+	p := oidcTestProvider(t)
+
+	sum := sha256.Sum256([]byte("correct"))
+	code, _ := p.storeCode(oidcAuthorizationCode{
+		ClientID:      "spa",
+		RedirectURI:   "https://app.example.com/callback",
+		User:          "alice",
+		Scope:         "openid",
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]),
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(url.Values{
+		"client_id":     {"spa"},
+		"code":          {code},
+		"code_verifier": {"wrong"},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	p.handleToken(rec, r)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestOIDCIntrospection(t *testing.T) {
+	p := oidcTestProvider(t)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("backend-secret"), bcrypt.MinCost)
+	p.config.Clients["backend"] = oidcClientConfig{Secret: string(hash), RedirectURIs: []string{"https://backend.example.com/cb"}}
+
+	token, err := p.keys.Sign(map[string]interface{}{
+		"aud":       "spa",
+		"exp":       time.Now().Add(time.Minute).Unix(),
+		"iss":       p.config.Issuer,
+		"sub":       "alice",
+		"token_use": "access",
+	})
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+
+	introspect := func(client, secret, token string) (int, map[string]interface{}) {
+		r := httptest.NewRequest(http.MethodPost, "/oidc/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client, secret)
+		rec := httptest.NewRecorder()
+		p.handleIntrospect(rec, r)
+
+		result := map[string]interface{}{}
+		json.NewDecoder(rec.Body).Decode(&result)
+		return rec.Code, result
+	}
+
+	if code, _ := introspect("spa", "", token); code != http.StatusUnauthorized {
+		t.Errorf("Expected public client to be rejected, got status %d", code)
+	}
+
+	if code, result := introspect("backend", "backend-secret", token); code != http.StatusOK || result["active"] != true || result["sub"] != "alice" {
+		t.Errorf("Expected active token, got status %d: %v", code, result)
+	}
+
+	if code, result := introspect("backend", "backend-secret", "invalid"); code != http.StatusOK || result["active"] != false {
+		t.Errorf("Expected inactive token, got status %d: %v", code, result)
+	}
+
+	idToken, _ := p.keys.Sign(map[string]interface{}{
+		"aud":       "spa",
+		"exp":       time.Now().Add(time.Minute).Unix(),
+		"iss":       p.config.Issuer,
+		"sub":       "alice",
+		"token_use": "id",
+	})
+	if code, result := introspect("backend", "backend-secret", idToken); code != http.StatusOK || result["active"] != false {
+		t.Errorf("Expected ID token to be inactive, got status %d: %v", code, result)
+	}
+}
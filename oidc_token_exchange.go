@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+const (
+	oidcDefaultUpstreamTokenHeader = "X-Upstream-Token"
+	oidcDefaultUpstreamTokenTTL    = 5 * time.Minute
+
+	oidcGrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	oidcTokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	oidcTokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// oidcUpstreamToken configures an access token for the given audience
+// to be returned on auth requests to the hosts. The proxy can pass the
+// token to the API instead of a generic identity header.
+type oidcUpstreamToken struct {
+	Hosts    []string      `yaml:"hosts"`
+	Audience string        `yaml:"audience"`
+	Scope    string        `yaml:"scope"`
+	Header   string        `yaml:"header"`
+	TTL      time.Duration `yaml:"ttl"`
+}
+
+func (u oidcUpstreamToken) Validate() error {
+	if len(u.Hosts) == 0 || u.Audience == "" {
+		return fmt.Errorf("Upstream tokens need hosts and an audience")
+	}
+	return nil
+}
+
+// issueAccessToken signs an access token for the user with the given
+// audience. Mapped claims are embedded like in the token endpoint.
+func (p *oidcProvider) issueAccessToken(user string, groups []string, claims map[string]string, audience, scope string, ttl time.Duration, extra map[string]interface{}) (string, error) {
+	if groups == nil {
+		groups = []string{}
+	}
+
+	now := time.Now()
+	token := map[string]interface{}{
+		"aud":       audience,
+		"exp":       now.Add(ttl).Unix(),
+		"groups":    groups,
+		"iat":       now.Unix(),
+		"iss":       p.config.Issuer,
+		"scope":     scope,
+		"sub":       user,
+		"token_use": "access",
+	}
+	for k, v := range claims {
+		token[k] = v
+	}
+	for k, v := range extra {
+		token[k] = v
+	}
+
+	return p.keys.Sign(token)
+}
+
+// handleTokenExchange exchanges an access token issued by nginx-sso
+// for an access token of another audience (RFC 8693). Only confidential
+// clients may exchange tokens issued to them (or to the subject
+// audiences allowed for them) for the audiences allowed for them.
+// The exchanged token is bound to the key of the DPoP proof if given.
+func (p *oidcProvider) handleTokenExchange(res http.ResponseWriter, r *http.Request, clientID string, proof *dpopProof) {
+	client := p.config.Clients[clientID]
+	if client.Secret == "" || len(client.ExchangeAudiences) == 0 {
+		oidcErrorResponse(res, http.StatusBadRequest, "unauthorized_client", "Client is not allowed to exchange tokens")
+		return
+	}
+
+	switch r.PostFormValue("subject_token_type") {
+	case oidcTokenTypeAccessToken, oidcTokenTypeJWT:
+		// Both identify the access tokens issued by nginx-sso
+	default:
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_request", "Unsupported subject token type")
+		return
+	}
+
+	if t := r.PostFormValue("requested_token_type"); t != "" && t != oidcTokenTypeAccessToken {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_request", "Only access tokens can be requested")
+		return
+	}
+
+	audience := r.PostFormValue("audience")
+	if audience == "" {
+		audience = r.PostFormValue("resource")
+	}
+	if !str.StringInSlice(audience, client.ExchangeAudiences) {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_target", "Audience is not allowed for this client")
+		return
+	}
+
+	subject, err := p.keys.Verify(r.PostFormValue("subject_token"))
+	if err != nil || subject["token_use"] != "access" || subject["iss"] != p.config.Issuer {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_grant", "Subject token is invalid")
+		return
+	}
+
+	// Clients may only exchange tokens issued to them or to audiences
+	// they are allowed to act for
+	subjectAudience, _ := subject["aud"].(string)
+	subjectClient, _ := subject["client_id"].(string)
+	if subjectAudience != clientID && subjectClient != clientID && !str.StringInSlice(subjectAudience, client.ExchangeSubjectAudiences) {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_grant", "Subject token was not issued to this client")
+		return
+	}
+
+	// Bound tokens must not be exchanged into unbound ones
+	if jkt := dpopBoundKey(subject); jkt != "" && (proof == nil || proof.Thumbprint != jkt) {
+		oidcErrorResponse(res, http.StatusBadRequest, "invalid_grant", "Subject token is bound to another key")
+		return
+	}
+
+	user, _ := subject["sub"].(string)
+	var groups []string
+	if rawGroups, ok := subject["groups"].([]interface{}); ok {
+		for _, g := range rawGroups {
+			if group, ok := g.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	claims := map[string]string{}
+	for name := range getMainConfig().ClaimsMapping.Claims {
+		if v, ok := subject[name].(string); ok {
+			claims[name] = v
+		}
+	}
+
+	// The scope can only be narrowed down
+	subjectScope, _ := subject["scope"].(string)
+	subjectScopes := strings.Fields(subjectScope)
+	scope := strings.Join(subjectScopes, " ")
+	if requested := r.PostFormValue("scope"); requested != "" {
+		for _, s := range strings.Fields(requested) {
+			if !str.StringInSlice(s, subjectScopes) {
+				oidcErrorResponse(res, http.StatusBadRequest, "invalid_scope", "Requested scope exceeds the scope of the subject token")
+				return
+			}
+		}
+		scope = requested
+	}
+
+	extra := map[string]interface{}{
+		"act":       map[string]string{"sub": clientID},
+		"client_id": clientID,
+	}
+	tokenType := "Bearer"
+	if proof != nil {
+		extra["cnf"] = map[string]string{"jkt": proof.Thumbprint}
+		tokenType = "DPoP"
+	}
+
+	token, err := p.issueAccessToken(user, groups, claims, audience, scope, p.config.TokenTTL, extra)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to sign exchanged token")
+		oidcErrorResponse(res, http.StatusInternalServerError, "server_error", "Unable to sign token")
+		return
+	}
+
+	oidcJSONResponse(res, http.StatusOK, map[string]interface{}{
+		"access_token":      token,
+		"expires_in":        int(p.config.TokenTTL / time.Second),
+		"issued_token_type": oidcTokenTypeAccessToken,
+		"scope":             scope,
+		"token_type":        tokenType,
+	})
+}
+
+// setUpstreamToken adds the access token configured for the host of
+// the request to the auth response
+func setUpstreamToken(res http.ResponseWriter, r *http.Request, user string, groups []string, claims map[string]string) error {
+	p := getOIDCProvider()
+	if p == nil {
+		return nil
+	}
+
+	host := requestHost(r)
+	for _, u := range p.config.UpstreamTokens {
+		if !hostMatches(u.Hosts, host) {
+			continue
+		}
+
+		ttl, header := u.TTL, u.Header
+		if ttl == 0 {
+			ttl = oidcDefaultUpstreamTokenTTL
+		}
+		if header == "" {
+			header = oidcDefaultUpstreamTokenHeader
+		}
+
+		token, err := p.issueAccessToken(user, groups, claims, u.Audience, u.Scope, ttl, nil)
+		if err != nil {
+			return err
+		}
+
+		res.Header().Set(header, token)
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestOIDCTokenExchangeGrant(t *testing.T) {
+	p := oidcTestProvider(t)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("gateway-secret"), bcrypt.MinCost)
+	p.config.Clients["gateway"] = oidcClientConfig{Secret: string(hash), ExchangeAudiences: []string{"https://api.example.com"}, ExchangeSubjectAudiences: []string{"spa"}}
+	p.config.Clients["reporting"] = oidcClientConfig{Secret: string(hash), ExchangeAudiences: []string{"https://api.example.com"}}
+
+	subject, err := p.keys.Sign(map[string]interface{}{
+		"aud":       "spa",
+		"exp":       time.Now().Add(time.Minute).Unix(),
+		"groups":    []string{"admins"},
+		"iss":       p.config.Issuer,
+		"scope":     "openid groups",
+		"sub":       "alice",
+		"token_use": "access",
+	})
+	if err != nil {
+		t.Fatalf("Unable to sign token: %s", err)
+	}
+
+	exchange := func(client, secret string, params url.Values) (int, map[string]interface{}) {
+		params.Set("grant_type", oidcGrantTypeTokenExchange)
+		params.Set("subject_token_type", oidcTokenTypeAccessToken)
+
+		r := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client, secret)
+		rec := httptest.NewRecorder()
+		p.handleToken(rec, r)
+
+		result := map[string]interface{}{}
+		json.NewDecoder(rec.Body).Decode(&result)
+		return rec.Code, result
+	}
+
+	if code, result := exchange("spa", "", url.Values{"subject_token": {subject}, "audience": {"https://api.example.com"}}); code != http.StatusBadRequest || result["error"] != "unauthorized_client" {
+		t.Errorf("Expected public client to be rejected, got status %d: %v", code, result)
+	}
+
+	if code, result := exchange("gateway", "gateway-secret", url.Values{"subject_token": {subject}, "audience": {"https://other.example.com"}}); code != http.StatusBadRequest || result["error"] != "invalid_target" {
+		t.Errorf("Expected unknown audience to be rejected, got status %d: %v", code, result)
+	}
+
+	if code, result := exchange("gateway", "gateway-secret", url.Values{"subject_token": {subject}, "audience": {"https://api.example.com"}, "scope": {"openid profile"}}); code != http.StatusBadRequest || result["error"] != "invalid_scope" {
+		t.Errorf("Expected scope escalation to be rejected, got status %d: %v", code, result)
+	}
+
+	if code, result := exchange("reporting", "gateway-secret", url.Values{"subject_token": {subject}, "audience": {"https://api.example.com"}}); code != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("Expected token issued to another client to be rejected, got status %d: %v", code, result)
+	}
+
+	own, _ := p.keys.Sign(map[string]interface{}{
+		"aud":       "reporting",
+		"exp":       time.Now().Add(time.Minute).Unix(),
+		"iss":       p.config.Issuer,
+		"sub":       "alice",
+		"token_use": "access",
+	})
+	if code, result := exchange("reporting", "gateway-secret", url.Values{"subject_token": {own}, "audience": {"https://api.example.com"}}); code != http.StatusOK {
+		t.Errorf("Expected token issued to the client to be exchanged, got status %d: %v", code, result)
+	}
+
+	if code, result := exchange("gateway", "gateway-secret", url.Values{"subject_token": {"invalid"}, "audience": {"https://api.example.com"}}); code != http.StatusBadRequest || result["error"] != "invalid_grant" {
+		t.Errorf("Expected invalid subject token to be rejected, got status %d: %v", code, result)
+	}
+
+	code, result := exchange("gateway", "gateway-secret", url.Values{"subject_token": {subject}, "audience": {"https://api.example.com"}, "scope": {"groups"}})
+	if code != http.StatusOK || result["issued_token_type"] != oidcTokenTypeAccessToken {
+		t.Fatalf("Expected token to be exchanged, got status %d: %v", code, result)
+	}
+
+	claims, err := p.keys.Verify(result["access_token"].(string))
+	if err != nil {
+		t.Fatalf("Unable to verify exchanged token: %s", err)
+	}
+
+	if claims["aud"] != "https://api.example.com" || claims["sub"] != "alice" || claims["scope"] != "groups" || claims["client_id"] != "gateway" {
+		t.Errorf("Unexpected claims: %v", claims)
+	}
+	if groups, ok := claims["groups"].([]interface{}); !ok || len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("Expected groups to be carried over, got %v", claims["groups"])
+	}
+}
+
+func TestOIDCUpstreamToken(t *testing.T) {
+	p := oidcTestProvider(t)
+	p.config.UpstreamTokens = []oidcUpstreamToken{{Hosts: []string{"api.example.com"}, Audience: "https://api.example.com"}}
+
+	activeOIDCProviderMutex.Lock()
+	prev := activeOIDCProvider
+	activeOIDCProvider = p
+	activeOIDCProviderMutex.Unlock()
+	defer func() {
+		activeOIDCProviderMutex.Lock()
+		activeOIDCProvider = prev
+		activeOIDCProviderMutex.Unlock()
+	}()
+
+	for host, expectToken := range map[string]bool{"api.example.com": true, "www.example.com": false} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Host", host)
+		rec := httptest.NewRecorder()
+
+		if err := setUpstreamToken(rec, r, "alice", nil, nil); err != nil {
+			t.Fatalf("Unable to set upstream token: %s", err)
+		}
+
+		token := rec.Header().Get(oidcDefaultUpstreamTokenHeader)
+		if !expectToken {
+			if token != "" {
+				t.Errorf("Host %q: Expected no token", host)
+			}
+			continue
+		}
+
+		claims, err := p.keys.Verify(token)
+		if err != nil || claims["aud"] != "https://api.example.com" || claims["sub"] != "alice" {
+			t.Errorf("Host %q: Unexpected token claims %v (%v)", host, claims, err)
+		}
+	}
+}
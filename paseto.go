@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+const (
+	tokenFormatJWT          = "jwt"
+	tokenFormatPASETOLocal  = "paseto.v4.local"
+	tokenFormatPASETOPublic = "paseto.v4.public"
+
+	pasetoHeaderLocal  = "v4.local."
+	pasetoHeaderPublic = "v4.public."
+	pasetoNonceSize    = 32
+	pasetoMACSize      = 32
+)
+
+// pasetoEncoding decodes the parts of tokens rejecting non-canonical
+// encodings which would allow to modify tokens without invalidating them
+var pasetoEncoding = base64.RawURLEncoding.Strict()
+
+// pasetoTimeClaims are encoded as RFC 3339 strings in PASETO tokens
+// while the rest of nginx-sso uses Unix timestamps like in JWTs
+var pasetoTimeClaims = []string{"exp", "iat", "nbf"}
+
+// tokenKeySet is implemented by the JWT and PASETO key sets to sign
+// and verify tokens independent of their format
+type tokenKeySet interface {
+	JWKS() map[string]interface{}
+	Sign(claims map[string]interface{}) (string, error)
+	Verify(token string) (map[string]interface{}, error)
+}
+
+// loadTokenKeySet loads the key files for the given token format
+func loadTokenKeySet(format string, files []string) (tokenKeySet, error) {
+	var (
+		ks  tokenKeySet
+		err error
+	)
+
+	// Typed nil pointers must not end up in the interface
+	switch format {
+	case "", tokenFormatJWT:
+		var jwtKeys *jwtKeySet
+		if jwtKeys, err = loadJWTKeySet(files); err == nil {
+			ks = jwtKeys
+		}
+	case tokenFormatPASETOLocal, tokenFormatPASETOPublic:
+		var pasetoKeys *pasetoKeySet
+		if pasetoKeys, err = loadPASETOKeySet(format, files); err == nil {
+			ks = pasetoKeys
+		}
+	default:
+		err = errors.Errorf("Unsupported token format %q", format)
+	}
+
+	return ks, err
+}
+
+// pasetoKeySet holds the keys of PASETO v4 tokens (local: symmetric
+// XChaCha20 + BLAKE2b, public: Ed25519). The first key is used to
+// create tokens, all of them are accepted to verify tokens.
+type pasetoKeySet struct {
+	format string
+	local  [][]byte
+	public []jwtSigningKey
+}
+
+func loadPASETOKeySet(format string, files []string) (*pasetoKeySet, error) {
+	if len(files) == 0 {
+		return nil, errors.New("No keys configured")
+	}
+
+	ks := &pasetoKeySet{format: format}
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read key %q", fn)
+		}
+
+		if format == tokenFormatPASETOLocal {
+			key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(key) != 32 {
+				return nil, errors.Errorf("Key %q needs to contain 32 hex encoded bytes", fn)
+			}
+			ks.local = append(ks.local, key)
+			continue
+		}
+
+		k, err := parseJWTSigningKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to load key %q", fn)
+		}
+		if k.Algorithm != jwtAlgorithmEdDSA {
+			return nil, errors.Errorf("Key %q needs to be an Ed25519 key", fn)
+		}
+		ks.public = append(ks.public, k)
+	}
+
+	return ks, nil
+}
+
+// JWKS returns the public keys of v4.public tokens in JWK Set format,
+// local keys are never published
+func (p *pasetoKeySet) JWKS() map[string]interface{} {
+	keys := []map[string]string{}
+
+	if p != nil {
+		for _, k := range p.public {
+			jwk := k.jwk()
+			jwk["kid"] = k.ID
+			jwk["use"] = "sig"
+			keys = append(keys, jwk)
+		}
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+// Sign creates a token from the claims using the first key of the set
+func (p *pasetoKeySet) Sign(claims map[string]interface{}) (string, error) {
+	if p == nil || len(p.local)+len(p.public) == 0 {
+		return "", errors.New("No keys configured")
+	}
+
+	encoded := map[string]interface{}{}
+	for k, v := range claims {
+		if ts, ok := v.(int64); ok && str.StringInSlice(k, pasetoTimeClaims) {
+			v = time.Unix(ts, 0).UTC().Format(time.RFC3339)
+		}
+		encoded[k] = v
+	}
+
+	payload, err := json.Marshal(encoded)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to marshal claims")
+	}
+
+	if p.format == tokenFormatPASETOLocal {
+		return pasetoEncrypt(p.local[0], payload)
+	}
+
+	key := p.public[0]
+	footer, _ := json.Marshal(map[string]string{"kid": key.ID})
+
+	return pasetoSign(key, payload, footer, nil)
+}
+
+// pasetoSign creates a v4.public token signing the payload, the footer
+// and the implicit assertion
+func pasetoSign(key jwtSigningKey, payload, footer, implicit []byte) (string, error) {
+	sig, err := key.sign(pasetoPAE([]byte(pasetoHeaderPublic), payload, footer, implicit))
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to sign token")
+	}
+	body := append(append([]byte{}, payload...), sig...)
+
+	token := pasetoHeaderPublic + base64.RawURLEncoding.EncodeToString(body)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token, nil
+}
+
+// Verify checks the token and its time based claims and returns its
+// claims. Time claims are returned as Unix timestamps in json.Number
+// format like the claims of JWTs.
+func (p *pasetoKeySet) Verify(token string) (map[string]interface{}, error) {
+	if p == nil {
+		return nil, errJWTInvalid
+	}
+
+	var (
+		payload []byte
+		err     error
+	)
+
+	switch p.format {
+	case tokenFormatPASETOLocal:
+		for _, key := range p.local {
+			if payload, err = pasetoDecrypt(key, token); err == nil {
+				break
+			}
+		}
+
+	case tokenFormatPASETOPublic:
+		payload, err = p.verifyPublic(token, nil)
+	}
+
+	if err != nil || payload == nil {
+		return nil, errJWTInvalid
+	}
+
+	claims := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errJWTInvalid
+	}
+
+	now := time.Now()
+	for _, name := range pasetoTimeClaims {
+		v, ok := claims[name]
+		if !ok {
+			continue
+		}
+
+		s, _ := v.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, errJWTInvalid
+		}
+
+		if (name == "exp" && t.Before(now)) || (name == "nbf" && t.After(now)) {
+			return nil, errJWTInvalid
+		}
+
+		claims[name] = json.Number(strconv.FormatInt(t.Unix(), 10))
+	}
+
+	return claims, nil
+}
+
+// verifyPublic checks the signature of the v4.public token including the
+// implicit assertion and returns its payload
+func (p *pasetoKeySet) verifyPublic(token string, implicit []byte) ([]byte, error) {
+	if !strings.HasPrefix(token, pasetoHeaderPublic) {
+		return nil, errJWTInvalid
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, pasetoHeaderPublic), ".")
+	if len(parts) > 2 {
+		return nil, errJWTInvalid
+	}
+
+	body, err := pasetoEncoding.DecodeString(parts[0])
+	if err != nil || len(body) < ed25519.SignatureSize {
+		return nil, errJWTInvalid
+	}
+
+	var footer []byte
+	if len(parts) == 2 {
+		if footer, err = pasetoEncoding.DecodeString(parts[1]); err != nil {
+			return nil, errJWTInvalid
+		}
+	}
+
+	var kid struct {
+		KeyID string `json:"kid"`
+	}
+	if len(footer) > 0 {
+		json.Unmarshal(footer, &kid)
+	}
+
+	payload, sig := body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:]
+	for _, k := range p.public {
+		if kid.KeyID != "" && k.ID != kid.KeyID {
+			continue
+		}
+
+		if k.verify(pasetoPAE([]byte(pasetoHeaderPublic), payload, footer, implicit), sig) {
+			return payload, nil
+		}
+	}
+
+	return nil, errJWTInvalid
+}
+
+// pasetoEncrypt creates a v4.local token without footer
+func pasetoEncrypt(key, payload []byte) (string, error) {
+	nonce := make([]byte, pasetoNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "Unable to read random bytes")
+	}
+
+	return pasetoSeal(key, nonce, payload, nil, nil)
+}
+
+// pasetoSeal encrypts the payload into a v4.local token using the given
+// nonce, the footer and the implicit assertion are authenticated
+func pasetoSeal(key, nonce, payload, footer, implicit []byte) (string, error) {
+	encKey, counterNonce, authKey := pasetoSplitKey(key, nonce)
+
+	c, err := chacha20.NewUnauthenticatedCipher(encKey, counterNonce)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to create cipher")
+	}
+	ciphertext := make([]byte, len(payload))
+	c.XORKeyStream(ciphertext, payload)
+
+	mac := pasetoHash(authKey, pasetoMACSize, pasetoPAE([]byte(pasetoHeaderLocal), nonce, ciphertext, footer, implicit))
+
+	token := pasetoHeaderLocal + base64.RawURLEncoding.EncodeToString(append(append(append([]byte{}, nonce...), ciphertext...), mac...))
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token, nil
+}
+
+// pasetoDecrypt verifies and decrypts a v4.local token
+func pasetoDecrypt(key []byte, token string) ([]byte, error) {
+	return pasetoOpen(key, token, nil)
+}
+
+// pasetoOpen verifies the v4.local token including its footer and the
+// implicit assertion and returns the decrypted payload
+func pasetoOpen(key []byte, token string, implicit []byte) ([]byte, error) {
+	if !strings.HasPrefix(token, pasetoHeaderLocal) {
+		return nil, errJWTInvalid
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, pasetoHeaderLocal), ".")
+	if len(parts) > 2 {
+		return nil, errJWTInvalid
+	}
+
+	body, err := pasetoEncoding.DecodeString(parts[0])
+	if err != nil || len(body) < pasetoNonceSize+pasetoMACSize {
+		return nil, errJWTInvalid
+	}
+
+	var footer []byte
+	if len(parts) == 2 {
+		if footer, err = pasetoEncoding.DecodeString(parts[1]); err != nil {
+			return nil, errJWTInvalid
+		}
+	}
+
+	nonce := body[:pasetoNonceSize]
+	ciphertext := body[pasetoNonceSize : len(body)-pasetoMACSize]
+	mac := body[len(body)-pasetoMACSize:]
+
+	encKey, counterNonce, authKey := pasetoSplitKey(key, nonce)
+
+	expected := pasetoHash(authKey, pasetoMACSize, pasetoPAE([]byte(pasetoHeaderLocal), nonce, ciphertext, footer, implicit))
+	if subtle.ConstantTimeCompare(mac, expected) != 1 {
+		return nil, errJWTInvalid
+	}
+
+	c, err := chacha20.NewUnauthenticatedCipher(encKey, counterNonce)
+	if err != nil {
+		return nil, errJWTInvalid
+	}
+	payload := make([]byte, len(ciphertext))
+	c.XORKeyStream(payload, ciphertext)
+	return payload, nil
+}
+
+// pasetoSplitKey derives the encryption key, the XChaCha20 nonce and
+// the authentication key from the key and the nonce of the token
+func pasetoSplitKey(key, nonce []byte) ([]byte, []byte, []byte) {
+	tmp := pasetoHash(key, 56, []byte("paseto-encryption-key"), nonce)
+	return tmp[:32], tmp[32:], pasetoHash(key, 32, []byte("paseto-auth-key-for-aead"), nonce)
+}
+
+// pasetoHash calculates the keyed BLAKE2b hash of the concatenated data
+func pasetoHash(key []byte, size int, data ...[]byte) []byte {
+	h, err := blake2b.New(size, key)
+	if err != nil {
+		// Only happens for invalid sizes or keys longer than 64 bytes
+		panic(err)
+	}
+
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// pasetoPAE implements the pre-authentication encoding of the
+// PASETO specification. Nil pieces are encoded as empty pieces.
+func pasetoPAE(pieces ...[]byte) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(len(pieces)))
+
+	for _, p := range pieces {
+		l := make([]byte, 8)
+		binary.LittleEndian.PutUint64(l, uint64(len(p))&^(1<<63))
+		buf = append(append(buf, l...), p...)
+	}
+
+	return buf
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pasetoTestKeySets(t *testing.T) []*pasetoKeySet {
+	localKey := make([]byte, 32)
+	rand.Read(localKey)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate Ed25519 key: %s", err)
+	}
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	publicKey, err := parseJWTSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}))
+	if err != nil {
+		t.Fatalf("Unable to parse key: %s", err)
+	}
+
+	return []*pasetoKeySet{
+		{format: tokenFormatPASETOLocal, local: [][]byte{localKey}},
+		{format: tokenFormatPASETOPublic, public: []jwtSigningKey{publicKey}},
+	}
+}
+
+func TestPASETOSignVerify(t *testing.T) {
+	for _, ks := range pasetoTestKeySets(t) {
+		token, err := ks.Sign(map[string]interface{}{"sub": "test", "exp": time.Now().Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatalf("Unable to create %s token: %s", ks.format, err)
+		}
+
+		if !strings.HasPrefix(token, strings.TrimPrefix(ks.format, "paseto.")+".") {
+			t.Errorf("Unexpected %s token header: %s", ks.format, token)
+		}
+
+		claims, err := ks.Verify(token)
+		if err != nil {
+			t.Fatalf("Unable to verify %s token: %s", ks.format, err)
+		}
+		if claims["sub"] != "test" || claims["exp"] == nil {
+			t.Errorf("Unexpected %s claims %v", ks.format, claims)
+		}
+
+		// Flip a character in the middle of the token
+		tampered := []byte(token)
+		i := len(tampered) / 2
+		if tampered[i] == 'A' {
+			tampered[i] = 'B'
+		} else {
+			tampered[i] = 'A'
+		}
+		if _, err := ks.Verify(string(tampered)); err == nil {
+			t.Errorf("Expected tampered %s token to be rejected", ks.format)
+		}
+
+		expired, _ := ks.Sign(map[string]interface{}{"sub": "test", "exp": time.Now().Add(-time.Minute).Unix()})
+		if _, err := ks.Verify(expired); err == nil {
+			t.Errorf("Expected expired %s token to be rejected", ks.format)
+		}
+	}
+
+	sets := pasetoTestKeySets(t)
+	local, _ := sets[0].Sign(map[string]interface{}{"sub": "test"})
+	if _, err := sets[1].Verify(local); err == nil {
+		t.Error("Expected local token to be rejected by public key set")
+	}
+	if _, err := pasetoTestKeySets(t)[0].Verify(local); err == nil {
+		t.Error("Expected local token to be rejected using another key")
+	}
+}
+
+func TestPASETOPrimitives(t *testing.T) {
+	if pae := pasetoPAE([]byte("test")); !bytes.Equal(pae, []byte("\x01\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00test")) {
+		t.Errorf("Unexpected PAE %q", pae)
+	}
+}
+
+// TestPASETOVectors checks the official test vectors of the PASETO
+// specification (github.com/paseto-standard/test-vectors)
+func TestPASETOVectors(t *testing.T) {
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", "paseto", "v4.json"))
+	if err != nil {
+		t.Fatalf("Unable to read test vectors: %s", err)
+	}
+
+	var vectors struct {
+		Tests []struct {
+			Name       string  `json:"name"`
+			ExpectFail bool    `json:"expect-fail"`
+			Key        string  `json:"key"`
+			Nonce      string  `json:"nonce"`
+			PublicKey  string  `json:"public-key"`
+			SecretKey  string  `json:"secret-key-pem"`
+			Token      string  `json:"token"`
+			Payload    *string `json:"payload"`
+			Footer     string  `json:"footer"`
+			Implicit   string  `json:"implicit-assertion"`
+		} `json:"tests"`
+	}
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatalf("Unable to parse test vectors: %s", err)
+	}
+
+	for _, tc := range vectors.Tests {
+		footer, implicit := []byte(tc.Footer), []byte(tc.Implicit)
+
+		var (
+			payload []byte
+			err     error
+		)
+		if tc.Key != "" {
+			key, _ := hex.DecodeString(tc.Key)
+			payload, err = pasetoOpen(key, tc.Token, implicit)
+
+			if !tc.ExpectFail {
+				nonce, _ := hex.DecodeString(tc.Nonce)
+				if token, _ := pasetoSeal(key, nonce, []byte(*tc.Payload), footer, implicit); token != tc.Token {
+					t.Errorf("%s: Expected token %s, got %s", tc.Name, tc.Token, token)
+				}
+			}
+		} else {
+			key, kerr := parseJWTSigningKey([]byte(tc.SecretKey))
+			if kerr != nil {
+				t.Fatalf("%s: Unable to parse key: %s", tc.Name, kerr)
+			}
+			// The footers of the vectors contain the ID of the key
+			var kid struct {
+				KeyID string `json:"kid"`
+			}
+			json.Unmarshal(footer, &kid)
+			key.ID = kid.KeyID
+			ks := &pasetoKeySet{format: tokenFormatPASETOPublic, public: []jwtSigningKey{key}}
+			payload, err = ks.verifyPublic(tc.Token, implicit)
+
+			if !tc.ExpectFail {
+				if token, _ := pasetoSign(key, []byte(*tc.Payload), footer, implicit); token != tc.Token {
+					t.Errorf("%s: Expected token %s, got %s", tc.Name, tc.Token, token)
+				}
+			}
+		}
+
+		switch {
+		case tc.ExpectFail && err == nil:
+			t.Errorf("%s: Expected token to be rejected", tc.Name)
+		case !tc.ExpectFail && err != nil:
+			t.Errorf("%s: Unable to verify token: %s", tc.Name, err)
+		case !tc.ExpectFail && string(payload) != *tc.Payload:
+			t.Errorf("%s: Expected payload %s, got %s", tc.Name, *tc.Payload, payload)
+		}
+	}
+}
+
+func TestPASETOCookieCodec(t *testing.T) {
+	c := jwtCookieCodec{keys: pasetoTestKeySets(t)[0], maxAge: time.Minute}
+
+	encoded, err := c.Encode("sso", map[interface{}]interface{}{"user": "alice", "login": int64(42)})
+	if err != nil {
+		t.Fatalf("Unable to encode cookie: %s", err)
+	}
+	if strings.Contains(encoded, "alice") {
+		t.Error("Expected local token to be encrypted")
+	}
+
+	values := map[interface{}]interface{}{}
+	if err := c.Decode("sso", encoded, &values); err != nil {
+		t.Fatalf("Unable to decode cookie: %s", err)
+	}
+	if values["user"] != "alice" || values["login"] != int64(42) {
+		t.Errorf("Unexpected session values %v", values)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const (
+	passwordChangePath = "/password"
+
+	passwordStatusPolicyViolation = "policy_violation"
+	passwordStatusUnsupported     = "unsupported"
+
+	defaultPasswordMinLength = 8
+	defaultPasswordMaxLength = 128
+)
+
+var (
+	errPasswordChangeUnsupported = errors.New("Password can not be changed for this account")
+	errPasswordTooLongForBcrypt  = passwordPolicyViolation("Password must not be longer than 72 bytes")
+
+	passwordStatusCodes = map[string]int{
+		loginStatusSuccess:            http.StatusOK,
+		loginStatusAccountLocked:      http.StatusTooManyRequests,
+		loginStatusError:              http.StatusInternalServerError,
+		loginStatusInvalidCredentials: http.StatusForbidden,
+		loginStatusInvalidRequest:     http.StatusBadRequest,
+		loginStatusRateLimited:        http.StatusTooManyRequests,
+		passwordStatusPolicyViolation: http.StatusBadRequest,
+		passwordStatusUnsupported:     http.StatusForbidden,
+	}
+
+	passwordStatusMessages = map[string]string{
+		loginStatusAccountLocked:      "Too many failed attempts, please try again later",
+		loginStatusError:              "Something went wrong, please try again",
+		loginStatusInvalidCredentials: "The current password is not correct",
+		loginStatusRateLimited:        "Too many attempts, please try again later",
+		passwordStatusUnsupported:     errPasswordChangeUnsupported.Error(),
+	}
+)
+
+// passwordPolicyViolation describes why a new password was rejected,
+// the message is shown to the user
+type passwordPolicyViolation string
+
+func (p passwordPolicyViolation) Error() string { return string(p) }
+
+// passwordPolicyConfig contains the rules new passwords set through the
+// password change page need to follow
+type passwordPolicyConfig struct {
+	MinLength           int  `yaml:"min_length"`
+	MaxLength           int  `yaml:"max_length"`
+	MinCharacterClasses int  `yaml:"min_character_classes"`
+	AllowUsername       bool `yaml:"allow_username"`
+}
+
+func (p passwordPolicyConfig) Validate() error {
+	if p.MinLength < 0 || p.MaxLength < 0 {
+		return errors.New("Password lengths must not be negative")
+	}
+	if p.minLength() > p.maxLength() {
+		return errors.New("Minimum password length must not exceed the maximum length")
+	}
+	if p.MinCharacterClasses < 0 || p.MinCharacterClasses > 4 {
+		return errors.New("Minimum character classes must be between 0 and 4")
+	}
+	return nil
+}
+
+func (p passwordPolicyConfig) minLength() int {
+	if p.MinLength == 0 {
+		return defaultPasswordMinLength
+	}
+	return p.MinLength
+}
+
+func (p passwordPolicyConfig) maxLength() int {
+	if p.MaxLength == 0 {
+		return defaultPasswordMaxLength
+	}
+	return p.MaxLength
+}
+
+// Check returns a passwordPolicyViolation if the new password of the
+// user does not follow the policy
+func (p passwordPolicyConfig) Check(user, oldPassword, newPassword string) error {
+	length := utf8.RuneCountInString(newPassword)
+	switch {
+	case length < p.minLength():
+		return passwordPolicyViolation("Password must be at least " + strconv.Itoa(p.minLength()) + " characters long")
+	case length > p.maxLength():
+		return passwordPolicyViolation("Password must not be longer than " + strconv.Itoa(p.maxLength()) + " characters")
+	case newPassword == oldPassword:
+		return passwordPolicyViolation("New password must differ from the current password")
+	case !p.AllowUsername && user != "" && strings.Contains(strings.ToLower(newPassword), strings.ToLower(user)):
+		return passwordPolicyViolation("Password must not contain the username")
+	}
+
+	var classes [4]bool
+	for _, c := range newPassword {
+		switch {
+		case unicode.IsLower(c):
+			classes[0] = true
+		case unicode.IsUpper(c):
+			classes[1] = true
+		case unicode.IsDigit(c):
+			classes[2] = true
+		default:
+			classes[3] = true
+		}
+	}
+
+	var found int
+	for _, ok := range classes {
+		if ok {
+			found++
+		}
+	}
+	if found < p.MinCharacterClasses {
+		return passwordPolicyViolation("Password must contain at least " + strconv.Itoa(p.MinCharacterClasses) +
+			" of lowercase letters, uppercase letters, digits and symbols")
+	}
+
+	return nil
+}
+
+// getPasswordChanger returns the authenticator the user logged in with
+// if it is able to change the password of the user
+func getPasswordChanger(r *http.Request, user string) passwordChanger {
+	m, _ := getSessionMeta(r)
+	for _, a := range requestAuthenticators(r) {
+		if a.AuthenticatorID() != m.Provider {
+			continue
+		}
+		if c, ok := a.(passwordChanger); ok && c.CanChangePassword(r, user) {
+			return c
+		}
+	}
+	return nil
+}
+
+// passwordChangeResponse is sent to clients changing the password
+// through the JSON API
+type passwordChangeResponse struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+
+	Policy *passwordPolicyView `json:"policy,omitempty"`
+}
+
+// passwordPolicyView describes the policy for custom frontends
+type passwordPolicyView struct {
+	MinLength           int  `json:"min_length"`
+	MaxLength           int  `json:"max_length"`
+	MinCharacterClasses int  `json:"min_character_classes"`
+	AllowUsername       bool `json:"allow_username"`
+}
+
+func (p passwordPolicyConfig) view() *passwordPolicyView {
+	return &passwordPolicyView{
+		MinLength:           p.minLength(),
+		MaxLength:           p.maxLength(),
+		MinCharacterClasses: p.MinCharacterClasses,
+		AllowUsername:       p.AllowUsername,
+	}
+}
+
+// handlePasswordRequest shows the password change form to the logged in
+// user and changes the password on POST. Clients posting a JSON object
+// with old_password and new_password get a JSON response.
+func handlePasswordRequest(res http.ResponseWriter, r *http.Request) {
+	jsonAPI := isJSONRequest(r)
+
+	user, _, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Change the password below
+
+	case errors.Is(err, errNoUser):
+		if jsonAPI {
+			http.Error(res, "No valid user found", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(passwordChangePath), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	changer := getPasswordChanger(r, user)
+	if changer == nil {
+		if jsonAPI {
+			writePasswordJSON(res, passwordChangeResponse{Status: passwordStatusUnsupported, Error: passwordStatusMessages[passwordStatusUnsupported]})
+			return
+		}
+		http.Error(res, errPasswordChangeUnsupported.Error(), http.StatusForbidden)
+		return
+	}
+
+	var resp passwordChangeResponse
+	if r.Method == http.MethodPost {
+		switch {
+		case jsonAPI:
+			// JSON requests can't be sent cross-site without a preflight
+			if err := parseJSONLoginForm(r); err != nil {
+				writePasswordJSON(res, passwordChangeResponse{Status: loginStatusInvalidRequest, Error: err.Error()})
+				return
+			}
+
+		case !getMainConfig().CSRF.Valid(r):
+			requestLog(r).Warn("Rejected password change without valid CSRF token")
+			http.Error(res, "Invalid CSRF token, please reload the page", http.StatusForbidden)
+			return
+
+		case r.PostFormValue("new_password") != r.PostFormValue("new_password_confirm"):
+			resp = passwordChangeResponse{Status: passwordStatusPolicyViolation, Error: "The new passwords do not match"}
+		}
+
+		if resp.Status == "" {
+			resp = changePassword(r, changer, user, r.PostFormValue("old_password"), r.PostFormValue("new_password"))
+		}
+
+		if jsonAPI {
+			if resp.RetryAfter > 0 {
+				res.Header().Set("Retry-After", strconv.Itoa(resp.RetryAfter))
+			}
+			writePasswordJSON(res, resp)
+			return
+		}
+	} else if jsonAPI {
+		writePasswordJSON(res, passwordChangeResponse{Status: loginStatusSuccess, Policy: getMainConfig().PasswordPolicy.view()})
+		return
+	}
+
+	status := http.StatusOK
+	if resp.Status != "" {
+		status = passwordStatusCodes[resp.Status]
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("password.html"))
+	body, err := tpl.ExecuteBytes(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"changed":    resp.Status == loginStatusSuccess,
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"error":      resp.Error,
+		"login":      getMainConfig().Login,
+		"policy":     getMainConfig().PasswordPolicy.view(),
+		"user":       user,
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+// changePassword checks the policy and changes the password of the
+// user. Failed attempts count towards the login rate limit and account
+// lockout as they verify the current password.
+func changePassword(r *http.Request, changer passwordChanger, user, oldPassword, newPassword string) passwordChangeResponse {
+	fail := func(status string) passwordChangeResponse {
+		return passwordChangeResponse{Status: status, Error: passwordStatusMessages[status]}
+	}
+
+	if wait := getMainConfig().LoginRateLimit.Check(r); wait > 0 {
+		resp := fail(loginStatusRateLimited)
+		resp.RetryAfter = int(math.Ceil(wait.Seconds()))
+		return resp
+	}
+	if wait := getMainConfig().AccountLockout.Locked(r, user); wait > 0 {
+		resp := fail(loginStatusAccountLocked)
+		resp.RetryAfter = int(math.Ceil(wait.Seconds()))
+		return resp
+	}
+
+	err := getMainConfig().PasswordPolicy.Check(user, oldPassword, newPassword)
+	if err == nil {
+		err = changer.ChangePassword(r, user, oldPassword, newPassword)
+	}
+
+	switch err.(type) {
+	case nil:
+		getMainConfig().AccountLockout.RecordSuccess(r, user)
+		getMainConfig().AuditLog.Log(auditEventPasswordChanged, r, map[string]string{"username": user})
+		return passwordChangeResponse{Status: loginStatusSuccess}
+
+	case passwordPolicyViolation:
+		return passwordChangeResponse{Status: passwordStatusPolicyViolation, Error: err.Error()}
+	}
+
+	switch err {
+	case errPasswordMismatch:
+		getMainConfig().AccountLockout.RecordFailure(r, user)
+		return fail(loginStatusInvalidCredentials)
+
+	case errPasswordChangeUnsupported:
+		return fail(passwordStatusUnsupported)
+
+	default:
+		requestLog(r).WithError(err).Error("Unable to change password")
+		return fail(loginStatusError)
+	}
+}
+
+func writePasswordJSON(res http.ResponseWriter, resp passwordChangeResponse) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(passwordStatusCodes[resp.Status])
+	json.NewEncoder(res).Encode(resp)
+}
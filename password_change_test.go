@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	p := passwordPolicyConfig{MinLength: 10, MinCharacterClasses: 3}
+
+	for password, valid := range map[string]bool{
+		"Short1!":                 false,
+		"alllowercaseletters":     false,
+		"lowerUPPER123":           true,
+		"with alice inside!A":     false,
+		"Old-Password-1":          false,
+		strings.Repeat("aA1", 50): false,
+	} {
+		err := p.Check("alice", "Old-Password-1", password)
+		if _, ok := err.(passwordPolicyViolation); err != nil && !ok {
+			t.Errorf("Expected policy violation for %q, got %T", password, err)
+		}
+		if (err == nil) != valid {
+			t.Errorf("Expected %q to be valid=%v, got %v", password, valid, err)
+		}
+	}
+
+	for name, p := range map[string]passwordPolicyConfig{
+		"negative length":  {MinLength: -1},
+		"min above max":    {MinLength: 20, MaxLength: 10},
+		"too many classes": {MinCharacterClasses: 5},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestPasswordChangeSimple(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-password")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("old-secret"), bcrypt.MinCost)
+	source := []byte(`providers:
+  simple:
+    enable_basic_auth: true
+    users:
+      alice: "` + string(hash) + `"
+      bob: "` + string(hash) + `"
+    password_file: "` + filepath.Join(dir, "passwords.yaml") + `"
+`)
+
+	a := &authSimple{}
+	if err := a.Configure(source); err != nil {
+		t.Fatalf("Unable to configure provider: %s", err)
+	}
+
+	prevAuthenticators, prevFrontend := getAuthenticatorSnapshot(), getMainConfig().Frontend
+	defer func() {
+		getMainConfig().Frontend = prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{a})
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	change := func(user, password, body string) (int, passwordChangeResponse) {
+		r := httptest.NewRequest(http.MethodPost, passwordChangePath, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.SetBasicAuth(user, password)
+
+		res := httptest.NewRecorder()
+		handlePasswordRequest(res, r)
+
+		var resp passwordChangeResponse
+		json.NewDecoder(res.Body).Decode(&resp)
+		return res.Code, resp
+	}
+
+	for body, status := range map[string]string{
+		`{"old_password": "wrong", "new_password": "new-secret-1"}`:        loginStatusInvalidCredentials,
+		`{"old_password": "old-secret", "new_password": "short"}`:          passwordStatusPolicyViolation,
+		`{"old_password": "old-secret", "new_password": ["new-secret-1"]}`: loginStatusInvalidRequest,
+	} {
+		if _, resp := change("alice", "old-secret", body); resp.Status != status {
+			t.Errorf("Expected status %s for %s, got %#v", status, body, resp)
+		}
+	}
+
+	code, resp := change("alice", "old-secret", `{"old_password": "old-secret", "new_password": "new-secret-1"}`)
+	if code != http.StatusOK || resp.Status != loginStatusSuccess {
+		t.Fatalf("Expected password to be changed, got %d %#v", code, resp)
+	}
+
+	if comparePasswordHash(a.passwordHash("alice"), "new-secret-1") != nil {
+		t.Error("Expected new password to be active")
+	}
+	if comparePasswordHash(a.passwordHash("bob"), "old-secret") != nil {
+		t.Error("Expected password of other users to be kept")
+	}
+
+	// The changed password is kept across reloads of the configuration
+	reloaded := &authSimple{}
+	if err := reloaded.Configure(source); err != nil {
+		t.Fatalf("Unable to configure provider: %s", err)
+	}
+	if comparePasswordHash(reloaded.passwordHash("alice"), "new-secret-1") != nil {
+		t.Error("Expected new password to be persisted")
+	}
+
+	// Forms need a CSRF token and matching new passwords
+	token := strings.Repeat("a", 43)
+	form := url.Values{
+		csrfFieldName:          {token},
+		"old_password":         {"new-secret-1"},
+		"new_password":         {"newer-secret-2"},
+		"new_password_confirm": {"newer-secret-3"},
+	}
+	r := httptest.NewRequest(http.MethodPost, passwordChangePath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: getMainConfig().GetCookieName(r, csrfCookieSuffix), Value: token})
+	r.SetBasicAuth("alice", "new-secret-1")
+	res := httptest.NewRecorder()
+	handlePasswordRequest(res, r)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "The new passwords do not match") {
+		t.Errorf("Expected mismatching passwords to be rejected, got %d", res.Code)
+	}
+
+	// Without password file the password can't be changed
+	setAuthenticators([]authenticator{&authSimple{EnableBasicAuth: true, Users: map[string]string{"alice": string(hash)}}})
+	if code, resp := change("alice", "old-secret", `{"old_password": "old-secret", "new_password": "new-secret-1"}`); code != http.StatusForbidden || resp.Status != passwordStatusUnsupported {
+		t.Errorf("Expected unsupported password change, got %d %#v", code, resp)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordHashBcrypt   = "bcrypt"
+	passwordHashArgon2ID = "argon2id"
+
+	// Parameters recommended by RFC 9106 for memory constrained
+	// environments
+	argon2IDMemory    = 64 * 1024
+	argon2IDTime      = 3
+	argon2IDThreads   = 4
+	argon2IDKeyLength = 32
+	argon2IDSaltSize  = 16
+
+	// bcryptMaxPasswordLength is the number of bytes bcrypt is able to
+	// hash, longer passwords are rejected
+	bcryptMaxPasswordLength = 72
+)
+
+var errPasswordMismatch = errors.New("Password does not match hash")
+
+// hashPassword creates a hash of the password usable in the simple
+// provider. bcrypt hashes use the given cost, argon2id hashes are
+// created in the PHC string format.
+func hashPassword(algorithm, password string, cost int) (string, error) {
+	switch algorithm {
+	case "", passwordHashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		return string(hash), err
+
+	case passwordHashArgon2ID:
+		salt := make([]byte, argon2IDSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return "", errors.Wrap(err, "Unable to generate salt")
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argon2IDTime, argon2IDMemory, argon2IDThreads, argon2IDKeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2IDMemory, argon2IDTime, argon2IDThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+
+	default:
+		return "", errors.Errorf("Unsupported hash algorithm %q, use bcrypt or argon2id", algorithm)
+	}
+}
+
+// rehashPassword hashes the new password using the algorithm and cost
+// of the existing hash to keep the format of the configured passwords
+func rehashPassword(hash, password string) (string, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return hashPassword(passwordHashArgon2ID, password, 0)
+	}
+
+	if len(password) > bcryptMaxPasswordLength {
+		return "", errPasswordTooLongForBcrypt
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil || cost < bcrypt.DefaultCost {
+		cost = bcrypt.DefaultCost
+	}
+	return hashPassword(passwordHashBcrypt, password, cost)
+}
+
+// comparePasswordHash checks the password against a bcrypt or argon2id
+// hash and returns nil if they match
+func comparePasswordHash(hash, password string) error {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+
+	// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("Invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errors.New("Unsupported argon2id version")
+	}
+
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return errors.Wrap(err, "Invalid argon2id parameters")
+	}
+	if time < 1 || threads < 1 {
+		// Would cause argon2 to panic
+		return errors.New("Invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errors.Wrap(err, "Invalid argon2id salt")
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return errors.Wrap(err, "Invalid argon2id key")
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	if subtle.ConstantTimeCompare(key, expected) != 1 {
+		return errPasswordMismatch
+	}
+
+	return nil
+}
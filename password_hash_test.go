@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHash(t *testing.T) {
+	for _, algorithm := range []string{passwordHashBcrypt, passwordHashArgon2ID} {
+		hash, err := hashPassword(algorithm, "secret", bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Unable to create %s hash: %s", algorithm, err)
+		}
+
+		if err := comparePasswordHash(hash, "secret"); err != nil {
+			t.Errorf("Expected %s hash %q to match: %s", algorithm, hash, err)
+		}
+		if err := comparePasswordHash(hash, "wrong"); err == nil {
+			t.Errorf("Expected %s hash to reject wrong password", algorithm)
+		}
+	}
+
+	if err := comparePasswordHash("$argon2id$v=19$m=65536,t=0,p=0$AAAA$AAAA", "secret"); err == nil {
+		t.Error("Expected invalid argon2id parameters to be rejected")
+	}
+
+	if _, err := hashPassword("md5", "secret", 0); err == nil {
+		t.Error("Expected unsupported algorithm to be rejected")
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	cookie, err := generateKey(genKeysTypeCookie, 0)
+	if err != nil {
+		t.Fatalf("Unable to generate cookie keys: %s", err)
+	}
+	m := &mainConfig{}
+	if err := m.load(cookie); err != nil {
+		t.Fatalf("Unable to load generated cookie keys: %s", err)
+	}
+	if keys := m.GetCookieKeys(); len(keys) != 1 || keys[0].Validate() != nil || len(keys[0].EncryptionKey) != cookieRotatedEncryptionKeyLength {
+		t.Errorf("Expected valid cookie keys, got %q", cookie)
+	}
+
+	for _, keyType := range []string{genKeysTypeEd25519, genKeysTypeRSA} {
+		key, err := generateKey(keyType, 2048)
+		if err != nil {
+			t.Fatalf("Unable to generate %s key: %s", keyType, err)
+		}
+		if _, err := parseJWTSigningKey(key); err != nil {
+			t.Errorf("Unable to parse generated %s key: %s", keyType, err)
+		}
+	}
+
+	local, err := generateKey(genKeysTypePASETOLocal, 0)
+	if err != nil {
+		t.Fatalf("Unable to generate PASETO key: %s", err)
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(local))); err != nil || len(key) != 32 {
+		t.Errorf("Expected 32 hex encoded bytes, got %q", local)
+	}
+}
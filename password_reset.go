@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const (
+	passwordResetPath      = "/password/reset"
+	passwordResetKeyPrefix = "nginx-sso:password-reset:"
+
+	defaultPasswordResetLifetime = time.Hour
+	defaultPasswordResetSubject  = "Reset your password"
+	defaultPasswordResetBody     = `Hello {{ user }},
+
+a reset of your password was requested. Open the link below to choose a new password:
+
+{{ url }}
+
+The link is valid until {{ expires }} and can only be used once. If you did not request the reset you can ignore this mail, your password stays unchanged.
+`
+
+	passwordResetMinSecretLength = 32
+)
+
+var (
+	errPasswordResetInvalid = errors.New("The reset link is invalid or has expired")
+	errPasswordResetUsed    = errors.New("The reset link was already used")
+
+	defaultPasswordResetRateLimit = tokenBucket{Rate: 3, Interval: time.Hour}
+
+	// sendPasswordResetMail delivers the reset link, replaced in tests
+	sendPasswordResetMail = func(p passwordResetConfig, to, body string) error {
+		return p.SMTP.Send(p.from, to, p.subject(), body)
+	}
+)
+
+// passwordResetConfig enables resetting forgotten passwords using a
+// signed link sent by mail
+type passwordResetConfig struct {
+	URL       string        `yaml:"url"`
+	Secret    string        `yaml:"secret"`
+	Lifetime  time.Duration `yaml:"lifetime"`
+	From      string        `yaml:"from"`
+	Subject   string        `yaml:"subject"`
+	Body      string        `yaml:"body"`
+	SMTP      smtpConfig    `yaml:"smtp"`
+	Store     string        `yaml:"store"`
+	RateLimit *tokenBucket  `yaml:"rate_limit"`
+
+	from *mail.Address
+	body *pongo2.Template
+}
+
+// Enabled returns whether a mail server to send the links is configured
+func (p passwordResetConfig) Enabled() bool { return p.SMTP.Server != "" }
+
+// Load checks the configuration and compiles the mail template
+func (p *passwordResetConfig) Load() error {
+	if !p.Enabled() {
+		return nil
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// The host of the request can be chosen by the client and must
+		// not be used to build the links
+		return errors.New("URL of the login needs to be an absolute http or https URL")
+	}
+
+	if len(p.Secret) < passwordResetMinSecretLength {
+		return errors.Errorf("Secret needs to be at least %d characters long", passwordResetMinSecretLength)
+	}
+
+	if p.Lifetime < 0 {
+		return errors.New("Lifetime must not be negative")
+	}
+
+	if p.from, err = mail.ParseAddress(p.From); err != nil {
+		return errors.Wrap(err, "Invalid sender address")
+	}
+
+	if err := p.SMTP.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid SMTP config")
+	}
+
+	if p.RateLimit != nil {
+		if err := p.RateLimit.Validate(); err != nil {
+			return errors.Wrap(err, "Invalid rate limit")
+		}
+	}
+
+	if p.Store != "" && p.Store != "memory" {
+		if _, err := parseRedisURI(p.Store); err != nil {
+			return err
+		}
+	}
+
+	body := p.Body
+	if body == "" {
+		body = defaultPasswordResetBody
+	}
+	p.body, err = pongo2.FromString("{% autoescape off %}" + body + "{% endautoescape %}")
+	return errors.Wrap(err, "Invalid body template")
+}
+
+func (p passwordResetConfig) lifetime() time.Duration {
+	if p.Lifetime == 0 {
+		return defaultPasswordResetLifetime
+	}
+	return p.Lifetime
+}
+
+func (p passwordResetConfig) rateLimit() tokenBucket {
+	if p.RateLimit == nil {
+		return defaultPasswordResetRateLimit
+	}
+	return *p.RateLimit
+}
+
+func (p passwordResetConfig) subject() string {
+	if p.Subject == "" {
+		return defaultPasswordResetSubject
+	}
+	return p.Subject
+}
+
+// passwordResetClaims are signed into the link sent to the user
+type passwordResetClaims struct {
+	Provider string `json:"p"`
+	Account  string `json:"a"`
+	User     string `json:"u"`
+	Expires  int64  `json:"e"`
+	Nonce    string `json:"n"`
+}
+
+// issueToken creates the token for the link, the nonce makes the token
+// usable only once
+func (p passwordResetConfig) issueToken(c passwordResetClaims, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "Unable to generate nonce")
+	}
+	c.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	c.Expires = now.Add(p.lifetime()).Unix()
+
+	return signMailToken(p.Secret, "password-reset", c)
+}
+
+// parseToken verifies the signature and expiry of the token
+func (p passwordResetConfig) parseToken(token string, now time.Time) (passwordResetClaims, error) {
+	var c passwordResetClaims
+
+	if !verifyMailToken(p.Secret, "password-reset", token, &c) {
+		return c, errPasswordResetInvalid
+	}
+
+	if now.Unix() > c.Expires || c.Nonce == "" {
+		return c, errPasswordResetInvalid
+	}
+
+	return c, nil
+}
+
+// consumeToken marks the token as used. The nonce takes the only token
+// of a bucket refilling after the lifetime of the link which works with
+// the memory and the shared Redis store of the rate limits.
+func (p passwordResetConfig) consumeToken(c passwordResetClaims, now time.Time) error {
+	store, err := getRateLimitStore(getMainConfig().Cluster.storeFor(p.Store))
+	if err != nil {
+		return err
+	}
+
+	wait, err := store.Take(passwordResetKeyPrefix+"used:"+c.Nonce, tokenBucket{Rate: 1, Interval: p.lifetime()}, now)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return errPasswordResetUsed
+	}
+	return nil
+}
+
+// checkRateLimit takes a token from the buckets of the client IP and the
+// username and returns the time to wait if one of them is empty
+func (p passwordResetConfig) checkRateLimit(r *http.Request, username string) time.Duration {
+	store, err := getRateLimitStore(getMainConfig().Cluster.storeFor(p.Store))
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to access password reset rate limit store")
+		return 0
+	}
+
+	for _, key := range []string{"ip:" + getMainConfig().trustedClientIP(r), "user:" + strings.ToLower(username)} {
+		wait, err := store.Take(passwordResetKeyPrefix+key, p.rateLimit(), time.Now())
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to check password reset rate limit")
+			return 0
+		}
+		if wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// findPasswordResetAccount looks up the user in the authenticators able
+// to reset passwords
+func findPasswordResetAccount(r *http.Request, username string) (passwordResetClaims, string, bool) {
+	for _, a := range requestAuthenticators(r) {
+		p, ok := a.(passwordResetter)
+		if !ok {
+			continue
+		}
+
+		account, email, err := p.PasswordResetAccount(username)
+		switch {
+		case err == nil:
+			return passwordResetClaims{Provider: a.AuthenticatorID(), Account: account, User: username}, email, true
+		case errors.Is(err, errNoUser):
+			// This is okay.
+		default:
+			requestLog(r).WithError(err).WithField("provider", a.AuthenticatorID()).Error("Unable to look up user for password reset")
+		}
+	}
+
+	return passwordResetClaims{}, "", false
+}
+
+func getPasswordResetter(r *http.Request, provider string) passwordResetter {
+	for _, a := range requestAuthenticators(r) {
+		if p, ok := a.(passwordResetter); ok && a.AuthenticatorID() == provider {
+			return p
+		}
+	}
+	return nil
+}
+
+// handlePasswordResetRequest sends the reset link to the user entering
+// their username and sets the new password when the link is opened
+func handlePasswordResetRequest(res http.ResponseWriter, r *http.Request) {
+	cfg := getMainConfig().PasswordReset
+	if !cfg.Enabled() {
+		http.NotFound(res, r)
+		return
+	}
+
+	var (
+		status = http.StatusOK
+		step   = "request"
+		token  = r.FormValue("token")
+		errMsg string
+	)
+
+	if token != "" {
+		step = "reset"
+	}
+
+	switch {
+	case token == "" && r.Method == http.MethodPost:
+		username := strings.TrimSpace(r.PostFormValue("username"))
+		if username == "" {
+			status, errMsg = http.StatusBadRequest, "Please enter your username"
+			break
+		}
+
+		if wait := cfg.checkRateLimit(r, username); wait > 0 {
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			status, errMsg = http.StatusTooManyRequests, "Too many reset requests, please try again later"
+			break
+		}
+
+		requestPasswordReset(r, cfg, username)
+		// The response does not reveal whether the user exists
+		step = "sent"
+
+	case token != "":
+		claims, err := cfg.parseToken(token, time.Now())
+		if err != nil {
+			status, step, errMsg = http.StatusBadRequest, "request", err.Error()
+			break
+		}
+
+		if r.Method != http.MethodPost {
+			break
+		}
+
+		if r.PostFormValue("new_password") != r.PostFormValue("new_password_confirm") {
+			status, errMsg = http.StatusBadRequest, "The new passwords do not match"
+			break
+		}
+
+		if err := resetPassword(r, cfg, claims, r.PostFormValue("new_password")); err != nil {
+			status, errMsg = http.StatusBadRequest, err.Error()
+			if _, ok := err.(passwordPolicyViolation); !ok && err != errPasswordResetUsed {
+				requestLog(r).WithError(err).Error("Unable to reset password")
+				status, errMsg = http.StatusInternalServerError, "Something went wrong, please try again"
+			}
+			if err == errPasswordResetUsed {
+				step = "request"
+			}
+			break
+		}
+		step = "done"
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("reset.html"))
+	body, err := tpl.ExecuteBytes(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"error":      errMsg,
+		"login":      getMainConfig().Login,
+		"policy":     getMainConfig().PasswordPolicy.view(),
+		"step":       step,
+		"token":      token,
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+// requestPasswordReset sends the link to the address of the user if one
+// of the authenticators knows the user. The mail is sent in the
+// background to not reveal the existence of the user by the time the
+// response takes.
+func requestPasswordReset(r *http.Request, cfg passwordResetConfig, username string) {
+	claims, email, ok := findPasswordResetAccount(r, username)
+	getMainConfig().AuditLog.Log(auditEventPasswordResetRequested, r, map[string]string{
+		"username": username,
+		"found":    strconv.FormatBool(ok),
+	})
+	if !ok {
+		return
+	}
+
+	logger := requestLog(r).WithField("username", username)
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		logger.WithError(err).Error("User has an invalid email address")
+		return
+	}
+
+	now := time.Now()
+	token, err := cfg.issueToken(claims, now)
+	if err != nil {
+		logger.WithError(err).Error("Unable to issue password reset token")
+		return
+	}
+
+	body, err := cfg.body.Execute(pongo2.Context{
+		"expires": now.Add(cfg.lifetime()).Format("2006-01-02 15:04 MST"),
+		"url":     strings.TrimRight(cfg.URL, "/") + passwordResetPath + "?token=" + url.QueryEscape(token),
+		"user":    username,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Unable to render password reset mail")
+		return
+	}
+
+	go func() {
+		if err := sendPasswordResetMail(cfg, addr.Address, body); err != nil {
+			logger.WithError(err).Error("Unable to send password reset mail")
+			return
+		}
+		logger.Info("Sent password reset mail")
+	}()
+}
+
+// resetPassword checks the policy, consumes the token and sets the new
+// password of the account in the token
+func resetPassword(r *http.Request, cfg passwordResetConfig, claims passwordResetClaims, newPassword string) error {
+	if err := getMainConfig().PasswordPolicy.Check(claims.User, "", newPassword); err != nil {
+		return err
+	}
+
+	resetter := getPasswordResetter(r, claims.Provider)
+	if resetter == nil {
+		return errors.Errorf("Provider %q is not able to reset passwords", claims.Provider)
+	}
+
+	if err := cfg.consumeToken(claims, time.Now()); err != nil {
+		return err
+	}
+
+	if err := resetter.ResetPassword(claims.Account, newPassword); err != nil {
+		return err
+	}
+
+	// The user proved to control the mail address, failed logins before
+	// the reset must not keep the account locked
+	if _, err := getMainConfig().AccountLockout.Unlock(claims.User); err != nil {
+		requestLog(r).WithError(err).Error("Unable to reset account lockout")
+	}
+	getMainConfig().AuditLog.Log(auditEventPasswordReset, r, map[string]string{"username": claims.User})
+
+	return nil
+}
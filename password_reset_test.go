@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordResetToken(t *testing.T) {
+	p := passwordResetConfig{Secret: strings.Repeat("s", 32)}
+	now := time.Now()
+
+	token, err := p.issueToken(passwordResetClaims{Provider: "simple", Account: "alice", User: "alice"}, now)
+	if err != nil {
+		t.Fatalf("Unable to issue token: %s", err)
+	}
+
+	if c, err := p.parseToken(token, now); err != nil || c.Account != "alice" || c.Nonce == "" {
+		t.Errorf("Expected token to be valid, got %#v: %v", c, err)
+	}
+
+	for name, tok := range map[string]string{
+		"expired":  token,
+		"tampered": "x" + token,
+		"unsigned": strings.SplitN(token, ".", 2)[0],
+	} {
+		at := now
+		if name == "expired" {
+			at = now.Add(defaultPasswordResetLifetime + time.Minute)
+		}
+		if _, err := p.parseToken(tok, at); err != errPasswordResetInvalid {
+			t.Errorf("Expected %s token to be rejected, got %v", name, err)
+		}
+	}
+
+	other := passwordResetConfig{Secret: strings.Repeat("o", 32)}
+	if _, err := other.parseToken(token, now); err != errPasswordResetInvalid {
+		t.Errorf("Expected token signed with another secret to be rejected, got %v", err)
+	}
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-reset")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("forgotten"), bcrypt.MinCost)
+	a := &authSimple{}
+	if err := a.Configure([]byte(`providers:
+  simple:
+    users:
+      alice: "` + string(hash) + `"
+    attributes:
+      alice:
+        email: "alice@example.com"
+    password_file: "` + filepath.Join(dir, "passwords.yaml") + `"
+`)); err != nil {
+		t.Fatalf("Unable to configure provider: %s", err)
+	}
+
+	mails := make(chan [2]string, 1)
+	prevSend, prevAuthenticators, prevFrontend, prevReset := sendPasswordResetMail, getAuthenticatorSnapshot(), getMainConfig().Frontend, getMainConfig().PasswordReset
+	defer func() {
+		sendPasswordResetMail, getMainConfig().Frontend, getMainConfig().PasswordReset = prevSend, prevFrontend, prevReset
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	sendPasswordResetMail = func(p passwordResetConfig, to, body string) error {
+		mails <- [2]string{to, body}
+		return nil
+	}
+	setAuthenticators([]authenticator{a})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().PasswordReset = passwordResetConfig{
+		URL:    "https://login.example.com/",
+		Secret: strings.Repeat("s", 32),
+		From:   "SSO <sso@example.com>",
+		SMTP:   smtpConfig{Server: "mail.example.com:587"},
+	}
+	if err := getMainConfig().PasswordReset.Load(); err != nil {
+		t.Fatalf("Unable to load password reset: %s", err)
+	}
+
+	csrf := strings.Repeat("c", 43)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		form.Set(csrfFieldName, csrf)
+		r := httptest.NewRequest(http.MethodPost, passwordResetPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: getMainConfig().GetCookieName(r, csrfCookieSuffix), Value: csrf})
+
+		res := httptest.NewRecorder()
+		withCSRFProtection(handlePasswordResetRequest)(res, r)
+		return res
+	}
+
+	res := post(url.Values{"username": {"mallory"}})
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "If an account with this username exists") {
+		t.Errorf("Expected unknown user to get the same response, got %d", res.Code)
+	}
+
+	res = post(url.Values{"username": {"alice"}})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected reset to be requested, got %d", res.Code)
+	}
+
+	var mail [2]string
+	select {
+	case mail = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected reset mail to be sent")
+	}
+	if mail[0] != "alice@example.com" {
+		t.Errorf("Expected mail to alice@example.com, got %s", mail[0])
+	}
+	link := regexp.MustCompile(`https://login\.example\.com/password/reset\?token=(\S+)`).FindStringSubmatch(mail[1])
+	if link == nil {
+		t.Fatalf("Expected link in mail: %s", mail[1])
+	}
+	token, _ := url.QueryUnescape(link[1])
+
+	res = httptest.NewRecorder()
+	handlePasswordResetRequest(res, httptest.NewRequest(http.MethodGet, passwordResetPath+"?token="+link[1], nil))
+	if !strings.Contains(res.Body.String(), `name="new_password"`) {
+		t.Errorf("Expected form for the new password, got %d", res.Code)
+	}
+
+	if res = post(url.Values{"token": {token}, "new_password": {"short"}, "new_password_confirm": {"short"}}); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected policy violation, got %d", res.Code)
+	}
+
+	res = post(url.Values{"token": {token}, "new_password": {"remembered-1"}, "new_password_confirm": {"remembered-1"}})
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "Your password has been changed") {
+		t.Fatalf("Expected password to be reset, got %d", res.Code)
+	}
+	if comparePasswordHash(a.passwordHash("alice"), "remembered-1") != nil {
+		t.Error("Expected new password to be active")
+	}
+
+	res = post(url.Values{"token": {token}, "new_password": {"remembered-2"}, "new_password_confirm": {"remembered-2"}})
+	if !strings.Contains(res.Body.String(), errPasswordResetUsed.Error()) {
+		t.Errorf("Expected link to be usable only once, got %d", res.Code)
+	}
+
+	select {
+	case mail = <-mails:
+		t.Errorf("Expected no mail for unknown user, got one to %s", mail[0])
+	default:
+	}
+}
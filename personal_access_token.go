@@ -0,0 +1,436 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+const (
+	patDefaultMaxLifetime = 90 * 24 * time.Hour
+	patTokenPrefix        = "nsso_"
+)
+
+var errPATNotEnabled = errors.New("Personal access tokens are not enabled")
+
+// patInteractiveProviders are the providers logging in users through
+// the login page into a session cookie. Only their sessions can create
+// tokens: Stolen tokens or credentials of the other providers must not
+// be usable to create further tokens.
+var patInteractiveProviders = []string{"crowd", "ldap", "simple", "yubikey"}
+
+// patInteractiveSession checks whether the user of the request was
+// detected from the session of an interactive login
+func patInteractiveSession(r *http.Request) bool {
+	m, _ := getSessionMeta(r)
+	return str.StringInSlice(m.Provider, patInteractiveProviders)
+}
+
+// patConfig enables users to create their own tokens for the token
+// authenticator. Tokens are stored hashed in the given file.
+type patConfig struct {
+	Store       string           `yaml:"store"`
+	MaxLifetime time.Duration    `yaml:"max_lifetime"`
+	DeviceFlow  deviceFlowConfig `yaml:"device_flow"`
+}
+
+// personalAccessToken is a token created by a user. The groups of the
+// user are captured on creation and the token can be restricted to a
+// set of hosts.
+type personalAccessToken struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Hosts   []string  `json:"hosts"`
+	Groups  []string  `json:"groups"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// JKT is the thumbprint of the key the token is bound to using
+	// DPoP proofs
+	JKT string `json:"jkt,omitempty"`
+}
+
+type patStore struct {
+	config  patConfig
+	tokens  []personalAccessToken
+	devices *deviceFlow
+
+	lock sync.RWMutex
+}
+
+var (
+	activePATStore      *patStore
+	activePATStoreMutex sync.RWMutex
+)
+
+// initializePATStore loads the tokens from the store file. Without
+// configured store personal access tokens are disabled.
+func initializePATStore(c patConfig) error {
+	activePATStoreMutex.Lock()
+	defer activePATStoreMutex.Unlock()
+
+	if c.Store == "" {
+		activePATStore = nil
+		return nil
+	}
+
+	if c.MaxLifetime == 0 {
+		c.MaxLifetime = patDefaultMaxLifetime
+	}
+
+	s := &patStore{config: c}
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	if c.DeviceFlow.Enabled {
+		s.devices = newDeviceFlow(c.DeviceFlow, s)
+	}
+
+	activePATStore = s
+	return nil
+}
+
+func getPATStore() *patStore {
+	activePATStoreMutex.RLock()
+	defer activePATStoreMutex.RUnlock()
+
+	return activePATStore
+}
+
+func hashPAT(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *patStore) load() error {
+	data, err := ioutil.ReadFile(p.config.Store)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "Unable to read token store")
+	}
+
+	return errors.Wrap(json.Unmarshal(data, &p.tokens), "Unable to parse token store")
+}
+
+// save writes the tokens to the store. Must be called with the lock
+// held.
+func (p *patStore) save() error {
+	data, err := json.MarshalIndent(p.tokens, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal tokens")
+	}
+
+	return writeFileAtomic(p.config.Store, data)
+}
+
+// writeFileAtomic writes the data to a temporary file and moves it
+// over the target to never leave a partially written file
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return errors.Wrap(err, "Unable to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Unable to write temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Unable to write temporary file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), filename), "Unable to replace file")
+}
+
+// Create issues a new token and returns it in plain text. The plain
+// token is never stored and can not be retrieved later.
+func (p *patStore) Create(user, name string, hosts, groups []string, lifetime time.Duration, jkt string) (string, personalAccessToken, error) {
+	if lifetime <= 0 || lifetime > p.config.MaxLifetime {
+		lifetime = p.config.MaxLifetime
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", personalAccessToken{}, errors.Wrap(err, "Unable to read random bytes")
+	}
+	token := patTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	id, err := newSessionID()
+	if err != nil {
+		return "", personalAccessToken{}, err
+	}
+
+	now := time.Now()
+	pat := personalAccessToken{
+		ID:      id,
+		User:    user,
+		Name:    name,
+		Hash:    hashPAT(token),
+		Hosts:   hosts,
+		Groups:  groups,
+		Created: now,
+		Expires: now.Add(lifetime),
+		JKT:     jkt,
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.removeExpired()
+	p.tokens = append(p.tokens, pat)
+
+	return token, pat, p.save()
+}
+
+// removeExpired drops expired tokens. Must be called with the lock held.
+func (p *patStore) removeExpired() {
+	active := p.tokens[:0]
+	for _, t := range p.tokens {
+		if t.Expires.After(time.Now()) {
+			active = append(active, t)
+		}
+	}
+	p.tokens = active
+}
+
+// Lookup returns the token matching the plain text token if it is not
+// expired
+func (p *patStore) Lookup(token string) (personalAccessToken, bool) {
+	if !strings.HasPrefix(token, patTokenPrefix) {
+		return personalAccessToken{}, false
+	}
+
+	hash := hashPAT(token)
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, t := range p.tokens {
+		if t.Hash == hash && t.Expires.After(time.Now()) {
+			return t, true
+		}
+	}
+
+	return personalAccessToken{}, false
+}
+
+// ListByUser returns the active tokens of the user sorted by creation
+func (p *patStore) ListByUser(user string) []personalAccessToken {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	result := []personalAccessToken{}
+	for _, t := range p.tokens {
+		if t.User == user && t.Expires.After(time.Now()) {
+			result = append(result, t)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result
+}
+
+// Delete revokes the token of the user with the given ID
+func (p *patStore) Delete(user, id string) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for n, t := range p.tokens {
+		if t.User == user && t.ID == id {
+			p.tokens = append(p.tokens[:n], p.tokens[n+1:]...)
+			return true, p.save()
+		}
+	}
+
+	return false, nil
+}
+
+// ExpireByUser shortens the lifetime of all tokens of the user to end
+// at the given time at the latest
+func (p *patStore) ExpireByUser(user string, at time.Time) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var n int
+	for i := range p.tokens {
+		if p.tokens[i].User == user && p.tokens[i].Expires.After(at) {
+			p.tokens[i].Expires = at
+			n++
+		}
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+	return n, p.save()
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func handleTokensRequest(res http.ResponseWriter, r *http.Request) {
+	user, groups, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Manage the tokens below
+
+	case errors.Is(err, errNoUser):
+		if wantsJSON(r) {
+			http.Error(res, "No valid user found", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(res, r, "/login?go="+url.QueryEscape("/tokens"), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	store := getPATStore()
+	if store == nil {
+		http.Error(res, errPATNotEnabled.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	if !patInteractiveSession(r) {
+		http.Error(res, "Tokens can only be managed after logging in", http.StatusForbidden)
+		return
+	}
+
+	var created string
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "create":
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" {
+				http.Error(res, "Token name is required", http.StatusBadRequest)
+				return
+			}
+
+			var lifetime time.Duration
+			if v := r.FormValue("lifetime"); v != "" {
+				if lifetime, err = time.ParseDuration(v); err != nil {
+					http.Error(res, "Invalid token lifetime", http.StatusBadRequest)
+					return
+				}
+			}
+
+			// Tokens created by clients sending a DPoP proof are bound
+			// to their key
+			var jkt string
+			proof, err := verifyDPoPRequest(r, http.MethodPost, requestScheme(r)+"://"+r.Host+"/tokens", "")
+			if err != nil {
+				http.Error(res, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if proof != nil {
+				jkt = proof.Thumbprint
+			}
+
+			token, pat, err := store.Create(user, name, strings.Fields(strings.Replace(r.FormValue("hosts"), ",", " ", -1)), groups, lifetime, jkt)
+			if err != nil {
+				requestLog(r).WithError(err).Error("Unable to create personal access token")
+				http.Error(res, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			getMainConfig().AuditLog.Log(auditEventTokenCreated, r, map[string]string{"token": pat.ID, "token_name": pat.Name, "username": user})
+
+			if wantsJSON(r) {
+				res.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(res).Encode(map[string]interface{}{
+					"id":      pat.ID,
+					"token":   token,
+					"expires": pat.Expires,
+					"bound":   pat.JKT != "",
+				})
+				return
+			}
+			created = token
+
+		case "revoke":
+			id := r.FormValue("id")
+			ok, err := store.Delete(user, id)
+			if err != nil {
+				requestLog(r).WithError(err).Error("Unable to revoke personal access token")
+				http.Error(res, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			if ok {
+				getMainConfig().AuditLog.Log(auditEventTokenRevoked, r, map[string]string{"token": id, "username": user})
+			}
+
+			if wantsJSON(r) {
+				res.WriteHeader(http.StatusNoContent)
+				return
+			}
+			http.Redirect(res, r, "/tokens", http.StatusFound)
+			return
+
+		default:
+			http.Error(res, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tokens := store.ListByUser(user)
+
+	if wantsJSON(r) {
+		type tokenView struct {
+			ID      string    `json:"id"`
+			Name    string    `json:"name"`
+			Hosts   []string  `json:"hosts"`
+			Created time.Time `json:"created"`
+			Expires time.Time `json:"expires"`
+		}
+
+		views := []tokenView{}
+		for _, t := range tokens {
+			views = append(views, tokenView{ID: t.ID, Name: t.Name, Hosts: t.Hosts, Created: t.Created, Expires: t.Expires})
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(views); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode tokens")
+		}
+		return
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("tokens.html"))
+	if err := tpl.ExecuteWriter(pongo2.Context{
+		"branding":     getMainConfig().Frontend.Branding(),
+		"created":      created,
+		"csp_nonce":    cspNonce(r),
+		"csrf_token":   getMainConfig().CSRF.Token(res, r),
+		"login":        getMainConfig().Login,
+		"max_lifetime": store.config.MaxLifetime,
+		"tokens":       tokens,
+		"user":         user,
+	}, res); err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPATStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "nsso-pat")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+
+	store := filepath.Join(dir, "tokens.json")
+	if err := initializePATStore(patConfig{Store: store, MaxLifetime: time.Hour}); err != nil {
+		t.Fatalf("Unable to initialize store: %s", err)
+	}
+
+	return store, func() {
+		initializePATStore(patConfig{})
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPATStoreLifecycle(t *testing.T) {
+	store, cleanup := testPATStore(t)
+	defer cleanup()
+
+	s := getPATStore()
+	token, pat, err := s.Create("alice", "cli", nil, []string{"admins"}, 24*time.Hour, "")
+	if err != nil {
+		t.Fatalf("Unable to create token: %s", err)
+	}
+
+	if d := pat.Expires.Sub(pat.Created); d != time.Hour {
+		t.Errorf("Expected lifetime to be capped to 1h, got %s", d)
+	}
+
+	// Reload from disk to ensure the token was persisted
+	if err := initializePATStore(patConfig{Store: store, MaxLifetime: time.Hour}); err != nil {
+		t.Fatalf("Unable to reload store: %s", err)
+	}
+	s = getPATStore()
+
+	if found, ok := s.Lookup(token); !ok || found.User != "alice" {
+		t.Fatalf("Expected token to be found for alice, got %v / %#v", ok, found)
+	}
+	if _, ok := s.Lookup(token + "x"); ok {
+		t.Error("Expected modified token not to be found")
+	}
+	if l := s.ListByUser("bob"); len(l) != 0 {
+		t.Errorf("Expected no tokens for bob, got %d", len(l))
+	}
+
+	if ok, _ := s.Delete("bob", pat.ID); ok {
+		t.Error("Expected bob not to be able to revoke the token of alice")
+	}
+	if ok, err := s.Delete("alice", pat.ID); !ok || err != nil {
+		t.Fatalf("Expected token to be revoked, got %v / %v", ok, err)
+	}
+	if _, ok := s.Lookup(token); ok {
+		t.Error("Expected revoked token not to be found")
+	}
+
+	s.tokens = append(s.tokens, personalAccessToken{User: "alice", Hash: hashPAT("nsso_expired"), Expires: time.Now().Add(-time.Minute)})
+	if _, ok := s.Lookup("nsso_expired"); ok {
+		t.Error("Expected expired token not to be found")
+	}
+}
+
+func TestPATDetectUser(t *testing.T) {
+	_, cleanup := testPATStore(t)
+	defer cleanup()
+
+	token, _, err := getPATStore().Create("alice", "deploy", []string{"ci.example.com"}, []string{"admins"}, 0, "")
+	if err != nil {
+		t.Fatalf("Unable to create token: %s", err)
+	}
+
+	a := &authToken{EnableBasicAuth: true}
+
+	for _, tc := range []struct {
+		host     string
+		user     string
+		expectOK bool
+	}{
+		{"ci.example.com", "", true},
+		{"ci.example.com", "alice", true},
+		{"ci.example.com", "bob", false},
+		{"www.example.com", "", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Host", tc.host)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, token)
+		} else {
+			r.Header.Set("Authorization", "Token "+token)
+		}
+
+		user, groups, err := a.DetectUser(context.Background(), httptest.NewRecorder(), r)
+		clearSessionMeta(r)
+
+		if !tc.expectOK {
+			if err != errNoUser {
+				t.Errorf("Host %q / user %q: Expected errNoUser, got %v", tc.host, tc.user, err)
+			}
+			continue
+		}
+
+		if err != nil || user != "alice" || len(groups) != 1 || groups[0] != "admins" {
+			t.Errorf("Host %q / user %q: Expected alice (admins), got %q %v (%v)", tc.host, tc.user, user, groups, err)
+		}
+	}
+}
+
+func TestPATRequiresInteractiveSession(t *testing.T) {
+	_, cleanup := testPATStore(t)
+	defer cleanup()
+
+	prevAuthenticators := getAuthenticatorSnapshot()
+	defer authenticatorState.Store(prevAuthenticators)
+
+	for provider, expStatus := range map[string]int{
+		"simple":          http.StatusOK,
+		"service_account": http.StatusForbidden,
+		"token":           http.StatusForbidden,
+	} {
+		setAuthenticators([]authenticator{&testDetectAuthenticator{id: provider, detect: func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+			return "alice", []string{"admins"}, nil
+		}}})
+
+		r := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+		r.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		handleTokensRequest(res, r)
+		clearSessionMeta(r)
+
+		if res.Code != expStatus {
+			t.Errorf("Expected status %d for session of %s, got %d", expStatus, provider, res.Code)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package acl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// HostDefault overrides the default policy for the given hosts
+type HostDefault struct {
+	Hosts  []string `yaml:"hosts"`
+	Policy string   `yaml:"policy"`
+}
+
+type ACL struct {
+	Default      string        `yaml:"default"`
+	Groups       RoleMapping   `yaml:"groups"`
+	HostDefaults []HostDefault `yaml:"host_defaults"`
+	Include      []string      `yaml:"include"`
+	RuleSets     []RuleSet     `yaml:"rule_sets"`
+
+	hostIndex     *hostIndex
+	includedFiles []string
+}
+
+// hostIndex holds the positions of the rule sets which can apply to the
+// requests for a host: Rule sets limited to hosts are only listed for
+// those, rule sets without host limitation are listed for all hosts
+type hostIndex struct {
+	hosts map[string][]int
+	any   []int
+}
+
+func newHostIndex(ruleSets []RuleSet) *hostIndex {
+	var (
+		idx     = &hostIndex{hosts: map[string][]int{}}
+		limited = make([][]string, len(ruleSets))
+	)
+
+	for i, rs := range ruleSets {
+		limited[i] = rs.indexHosts()
+		if limited[i] == nil {
+			idx.any = append(idx.any, i)
+		}
+		for _, host := range limited[i] {
+			idx.hosts[host] = nil
+		}
+	}
+
+	// Keep the order of the rule sets as it matters for the decision
+	for host := range idx.hosts {
+		positions := []int{}
+		for i := range ruleSets {
+			if limited[i] == nil || str.StringInSlice(host, limited[i]) {
+				positions = append(positions, i)
+			}
+		}
+		idx.hosts[host] = positions
+	}
+
+	return idx
+}
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case "", PolicyAllow, PolicyDeny:
+		return nil
+	default:
+		return fmt.Errorf("Policy %q is invalid, use %q or %q", policy, PolicyAllow, PolicyDeny)
+	}
+}
+
+// HostMatches checks whether the host is contained in the list of
+// hosts. Entries prefixed with `*.` match all subdomains.
+func HostMatches(hosts []string, host string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DefaultPolicy returns the result for requests not judged by any rule
+// set: The first host default matching the host is used, if none
+// matches the global default applies. Without configuration requests
+// are denied.
+func (a ACL) DefaultPolicy(host string) Result {
+	policy := a.Default
+
+	for _, hd := range a.HostDefaults {
+		if HostMatches(hd.Hosts, host) {
+			policy = hd.Policy
+			break
+		}
+	}
+
+	if policy == PolicyAllow {
+		return Allow
+	}
+	return Deny
+}
+
+func (a ACL) Validate() error {
+	if err := validatePolicy(a.Default); err != nil {
+		return fmt.Errorf("Default is invalid: %s", err)
+	}
+
+	for i, hd := range a.HostDefaults {
+		if len(hd.Hosts) == 0 {
+			return fmt.Errorf("Host default on position %d has no hosts", i+1)
+		}
+		if err := validatePolicy(hd.Policy); err != nil {
+			return fmt.Errorf("Host default on position %d is invalid: %s", i+1, err)
+		}
+	}
+
+	ids := map[string]bool{}
+	for i, r := range a.RuleSets {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("RuleSet on position %d is invalid: %s", i+1, err)
+		}
+
+		if r.ID == "" {
+			continue
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("RuleSet on position %d uses duplicate ID %q", i+1, r.ID)
+		}
+		ids[r.ID] = true
+	}
+
+	return nil
+}
+
+// Compile validates all rule sets and prepares them for evaluation
+func (a *ACL) Compile() error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	for i := range a.RuleSets {
+		if err := a.RuleSets[i].Compile(); err != nil {
+			return fmt.Errorf("RuleSet on position %d is invalid: %s", i+1, err)
+		}
+	}
+
+	a.hostIndex = newHostIndex(a.RuleSets)
+
+	return nil
+}
+
+// ruleSetsFor returns the positions of the rule sets which can apply to
+// the request with the given fields in their configured order. ACLs
+// not compiled have no index and return all rule sets.
+func (a ACL) ruleSetsFor(fields map[string]string) []int {
+	if a.hostIndex == nil {
+		positions := make([]int, len(a.RuleSets))
+		for i := range positions {
+			positions[i] = i
+		}
+		return positions
+	}
+
+	if positions, ok := a.hostIndex.hosts[fields["host"]]; ok {
+		return positions
+	}
+	return a.hostIndex.any
+}
+
+// Evaluate expands the composite groups of the user, judges the
+// request and returns the result together with the position of the
+// rule set responsible for it. If no rule set judged the request the
+// default policy for the `host` field is returned with position -1.
+func (a ACL) Evaluate(req Request) (Result, int) {
+	result, decidedBy := Dunno, -1
+	req.Groups = a.Groups.Expand(req.Groups)
+
+	for _, i := range a.ruleSetsFor(req.Fields) {
+		rs := a.RuleSets[i]
+		if rs.Shadow {
+			// Shadow rule sets must not influence the decision
+			continue
+		}
+
+		intermediateResult := rs.HasAccess(req)
+		if intermediateResult > result {
+			result = intermediateResult
+			decidedBy = i
+		}
+
+		if rs.Final && intermediateResult != Dunno {
+			// Rule set judged the request, ignore all following rule sets
+			break
+		}
+	}
+
+	if decidedBy < 0 {
+		return a.DefaultPolicy(strings.ToLower(req.Fields["host"])), decidedBy
+	}
+
+	return result, decidedBy
+}
+
+// ShadowResult contains the result of a shadow rule set
+type ShadowResult struct {
+	Position int
+	Result   Result
+}
+
+// EvaluateShadow judges the request using all rule sets marked as
+// shadow and returns the results of those which judged the request
+func (a ACL) EvaluateShadow(req Request) []ShadowResult {
+	var results []ShadowResult
+	req.Groups = a.Groups.Expand(req.Groups)
+
+	for _, i := range a.ruleSetsFor(req.Fields) {
+		rs := a.RuleSets[i]
+		if !rs.Shadow {
+			continue
+		}
+
+		if res := rs.HasAccess(req); res != Dunno {
+			results = append(results, ShadowResult{Position: i, Result: res})
+		}
+	}
+
+	return results
+}
+
+// RuleSetID returns the identifier of the rule set on the given
+// position as returned by Evaluate: The configured ID or the position
+// if no ID is set. Decisions of the default policy are identified as
+// "default".
+func (a ACL) RuleSetID(idx int) string {
+	switch {
+	case idx < 0 || idx >= len(a.RuleSets):
+		return "default"
+	case a.RuleSets[idx].ID != "":
+		return a.RuleSets[idx].ID
+	default:
+		return "#" + strconv.Itoa(idx+1)
+	}
+}
+
+// HasAccess reports whether Evaluate allows the request
+func (a ACL) HasAccess(req Request) bool {
+	result, _ := a.Evaluate(req)
+	return result == Allow
+}
+
+// AllowsAnonymous checks whether a rule set applying to the request
+// permits access without a logged in user
+func (a ACL) AllowsAnonymous(fields map[string]string) bool {
+	for _, i := range a.ruleSetsFor(fields) {
+		if rs := a.RuleSets[i]; rs.AllowAnonymous && rs.AppliesToFields(fields) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SkipsSessionBinding checks whether a rule set applying to the request
+// exempts it from the session binding
+func (a ACL) SkipsSessionBinding(fields map[string]string) bool {
+	for _, i := range a.ruleSetsFor(fields) {
+		if rs := a.RuleSets[i]; rs.SkipSessionBinding && rs.AppliesToFields(fields) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IncludedFiles returns the files loaded by LoadIncludes
+func (a ACL) IncludedFiles() []string {
+	return a.includedFiles
+}
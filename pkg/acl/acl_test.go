@@ -0,0 +1,708 @@
+package acl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testUser   = "test"
+	testGroups = []string{"group_a", "group_b"}
+)
+
+func testRequest(fields map[string]string) Request {
+	return Request{User: testUser, Groups: testGroups, Fields: fields}
+}
+
+func testString(in string) *string { return &in }
+func testBool(in bool) *bool       { return &in }
+
+// testCounter counts the requests within one test
+type testCounter map[string]int
+
+func (t testCounter) Increment(key string, window time.Duration) (int, error) {
+	t[key]++
+	return t[key], nil
+}
+
+func TestEmptyACL(t *testing.T) {
+	a := ACL{}
+
+	if a.HasAccess(testRequest(map[string]string{})) {
+		t.Fatal("Empty ACL (= default action) was ALLOW instead of DENY")
+	}
+}
+
+func TestRuleSetMatcher(t *testing.T) {
+	r := RuleSet{
+		Rules: []Rule{
+			{
+				Field:       "field_a",
+				MatchString: testString("expected"),
+			},
+			{
+				Field:       "field_c",
+				MatchString: testString("expected"),
+			},
+		},
+		Allow: []string{testUser},
+	}
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+		"field_c": "expected",
+	}
+
+	if r.HasAccess(testRequest(fields)) != Allow {
+		t.Error("Access was denied")
+	}
+
+	delete(fields, "field_c")
+	if r.HasAccess(testRequest(fields)) != Dunno {
+		t.Error("Access was not unknown")
+	}
+}
+
+func TestInvertedRegexMatcher(t *testing.T) {
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+	}
+
+	ar := Rule{
+		Field:      "field_a",
+		Invert:     true,
+		MatchRegex: testString("^expected$"),
+	}
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+
+	fields["field_a"] = "unexpected"
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+}
+
+func TestRegexMatcher(t *testing.T) {
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+	}
+
+	ar := Rule{
+		Field:      "field_a",
+		MatchRegex: testString("^expected$"),
+	}
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+
+	fields["field_a"] = "unexpected"
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+}
+
+func TestInvertedEqualsMatcher(t *testing.T) {
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+	}
+
+	ar := Rule{
+		Field:       "field_a",
+		Invert:      true,
+		MatchString: testString("expected"),
+	}
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+
+	fields["field_a"] = "unexpected"
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+}
+
+func TestEqualsMatcher(t *testing.T) {
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+	}
+
+	ar := Rule{
+		Field:       "field_a",
+		MatchString: testString("expected"),
+	}
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+
+	fields["field_a"] = "unexpected"
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+}
+
+func TestInvertedIsPresentMatcher(t *testing.T) {
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+	}
+
+	ar := Rule{
+		Field:     "field_a",
+		Invert:    true,
+		IsPresent: testBool(true),
+	}
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+
+	ar.IsPresent = testBool(false)
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+
+	ar.IsPresent = testBool(true)
+	delete(fields, "field_a")
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+
+	ar.IsPresent = testBool(false)
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+}
+
+func TestIsPresentMatcher(t *testing.T) {
+	fields := map[string]string{
+		"field_a": "expected",
+		"field_b": "unchecked",
+	}
+
+	ar := Rule{
+		Field:     "field_a",
+		IsPresent: testBool(true),
+	}
+
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+
+	ar.IsPresent = testBool(false)
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+
+	ar.IsPresent = testBool(true)
+	delete(fields, "field_a")
+
+	if ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v matches fields %#v", ar, fields)
+	}
+
+	ar.IsPresent = testBool(false)
+	if !ar.AppliesToFields(fields) {
+		t.Errorf("Rule %#v does not match fields %#v", ar, fields)
+	}
+}
+
+func TestSkipSessionBinding(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{
+			Rules: []Rule{
+				{Field: "field_a", MatchString: testString("expected")},
+			},
+			SkipSessionBinding: true,
+		},
+	}}
+
+	if !a.SkipsSessionBinding(map[string]string{"field_a": "expected"}) {
+		t.Error("Session binding was not skipped for matching request")
+	}
+
+	if a.SkipsSessionBinding(map[string]string{"field_a": "unexpected"}) {
+		t.Error("Session binding was skipped for non-matching request")
+	}
+}
+
+func TestCompileACL(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{
+			Rules: []Rule{
+				{Field: "x-origin-uri", MatchRegex: testString("^/api/v[0-9]+/")},
+			},
+			Allow: []string{testUser},
+		},
+	}}
+
+	if err := a.Compile(); err != nil {
+		t.Fatalf("Valid ACL was not compiled: %s", err)
+	}
+
+	if a.RuleSets[0].Rules[0].matchRegex == nil {
+		t.Error("Regexp was not pre-compiled")
+	}
+
+	if !a.HasAccess(testRequest(map[string]string{"x-origin-uri": "/api/v2/users"})) {
+		t.Error("Access was denied")
+	}
+
+	a.RuleSets[0].Rules[0].MatchRegex = testString("^/api/(v[0-9]+/")
+	if err := a.Compile(); err == nil {
+		t.Error("Invalid regexp was accepted")
+	}
+}
+
+func TestCIDRMatcher(t *testing.T) {
+	r := Rule{Field: "client.ip", MatchCIDR: []string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"}}
+	if err := r.Compile(); err != nil {
+		t.Fatalf("Valid rule was not compiled: %s", err)
+	}
+
+	for ip, expected := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"fd00::1":     true,
+		"2001:db8::1": false,
+		"invalid":     false,
+	} {
+		if r.AppliesToFields(map[string]string{"client.ip": ip}) != expected {
+			t.Errorf("Unexpected result for IP %q", ip)
+		}
+	}
+
+	r.MatchCIDR = []string{"10.0.0.0/33"}
+	if err := r.Compile(); err == nil {
+		t.Error("Invalid CIDR was accepted")
+	}
+}
+
+func TestScriptRule(t *testing.T) {
+	rule := Rule{Script: `return fields["x-origin-uri"]:find("^/api/") ~= nil and fields["method"] ~= "DELETE"`}
+	if err := rule.Compile(); err != nil {
+		t.Fatalf("Unable to compile rule: %s", err)
+	}
+	for fields, expected := range map[[2]string]bool{
+		{"/api/users", "GET"}:    true,
+		{"/api/users", "DELETE"}: false,
+		{"/admin", "GET"}:        false,
+	} {
+		if rule.AppliesToFields(map[string]string{"x-origin-uri": fields[0], "method": fields[1]}) != expected {
+			t.Errorf("Expected rule to apply to %v: %v", fields, expected)
+		}
+	}
+
+	rule = Rule{Field: "x-tenant", Script: `return value:upper() == "ACME"`}
+	if !rule.AppliesToFields(map[string]string{"x-tenant": "acme"}) {
+		t.Error("Expected rule to apply to the value of the field")
+	}
+
+	// Failing scripts never apply
+	rule = Rule{Script: `return fields.missing:len() > 0`}
+	if rule.AppliesToFields(map[string]string{}) {
+		t.Error("Expected failing script not to apply")
+	}
+}
+
+func TestACLIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-acl")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.yaml"), []byte(`---
+hosts: ["app.example.com"]
+rule_sets:
+- rules:
+  - field: "x-origin-uri"
+    regexp: "^/"
+  allow: ["test"]
+`), 0644); err != nil {
+		t.Fatalf("Unable to write include: %s", err)
+	}
+
+	a := ACL{Include: []string{"*.yaml"}}
+	if err := a.LoadIncludes(dir, ioutil.ReadFile); err != nil {
+		t.Fatalf("Unable to load includes: %s", err)
+	}
+
+	if err := a.Compile(); err != nil {
+		t.Fatalf("Included ACL is invalid: %s", err)
+	}
+
+	if files := a.IncludedFiles(); len(files) != 1 || files[0] != filepath.Join(dir, "app.yaml") {
+		t.Errorf("Unexpected included files: %v", files)
+	}
+
+	if !a.HasAccess(testRequest(map[string]string{"host": "app.example.com", "x-origin-uri": "/"})) {
+		t.Error("Access was denied on included host")
+	}
+
+	if a.HasAccess(testRequest(map[string]string{"host": "other.example.com", "x-origin-uri": "/"})) {
+		t.Error("Access was granted on other host")
+	}
+}
+
+func TestGroupDenyPrecedence(t *testing.T) {
+	r := RuleSet{
+		Allow: []string{"@group_a"},
+		Deny:  []string{"@group_b"},
+	}
+
+	if r.HasAccess(testRequest(map[string]string{})) != Deny {
+		t.Error("Group deny did not take precedence over group allow")
+	}
+
+	r.Allow = []string{testUser}
+	if r.HasAccess(testRequest(map[string]string{})) != Deny {
+		t.Error("Group deny did not take precedence over user allow")
+	}
+}
+
+func TestFinalRuleSet(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{Allow: []string{testUser}, Final: true},
+		{Deny: []string{"@group_a"}},
+	}}
+
+	if !a.HasAccess(testRequest(map[string]string{})) {
+		t.Error("Final rule set did not stop evaluation")
+	}
+
+	a.RuleSets[0].Final = false
+	if a.HasAccess(testRequest(map[string]string{})) {
+		t.Error("Deny in later rule set was ignored")
+	}
+}
+
+func TestAllowAnonymous(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{
+			Rules: []Rule{
+				{Field: "x-origin-uri", MatchRegex: testString("^/public/")},
+			},
+			AllowAnonymous: true,
+		},
+	}}
+
+	if !a.AllowsAnonymous(map[string]string{"x-origin-uri": "/public/index.html"}) {
+		t.Error("Anonymous access was denied on public path")
+	}
+
+	if a.AllowsAnonymous(map[string]string{"x-origin-uri": "/private/"}) {
+		t.Error("Anonymous access was granted on private path")
+	}
+}
+
+func TestGlobMatcher(t *testing.T) {
+	for pattern, cases := range map[string]map[string]bool{
+		"/api/*/admin/**": {
+			"/api/v1/admin":         true,
+			"/api/v1/admin/users/1": true,
+			"/api/v1/users":         false,
+			"/api/v1/v2/admin":      false,
+		},
+		"**/*.css": {
+			"/static/css/main.css": true,
+			"main.css":             true,
+			"/main.js":             false,
+		},
+		"/file-?.txt": {
+			"/file-1.txt":  true,
+			"/file-12.txt": false,
+		},
+		"/search**": {
+			"/search?q=test": true,
+			"/find":          false,
+		},
+	} {
+		r := Rule{Field: "x-origin-uri", MatchGlob: testString(pattern)}
+		if err := r.Compile(); err != nil {
+			t.Fatalf("Glob %q did not compile: %s", pattern, err)
+		}
+
+		for uri, expected := range cases {
+			if r.AppliesToFields(map[string]string{"x-origin-uri": uri}) != expected {
+				t.Errorf("Glob %q on %q expected to match = %v", pattern, uri, expected)
+			}
+		}
+	}
+}
+
+func TestNegatedValues(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{
+			Rules: []Rule{
+				{Field: "host", MatchString: testString("not:status.example.com")},
+				{Field: "x-origin-uri", MatchGlob: testString("not:/public/**")},
+			},
+			Allow: []string{"not:@contractors"},
+		},
+	}}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
+	}
+
+	for _, tc := range []struct {
+		Host, URI string
+		Groups    []string
+		Expected  bool
+	}{
+		{"test.example.com", "/", testGroups, true},
+		{"status.example.com", "/", testGroups, false},
+		{"test.example.com", "/public/index.html", testGroups, false},
+		{"test.example.com", "/", []string{"contractors"}, false},
+	} {
+		req := Request{User: testUser, Groups: tc.Groups, Fields: map[string]string{"host": tc.Host, "x-origin-uri": tc.URI}}
+		if a.HasAccess(req) != tc.Expected {
+			t.Errorf("Access for %s%s with groups %v expected to be %v", tc.Host, tc.URI, tc.Groups, tc.Expected)
+		}
+	}
+
+	if listMatchesUser([]string{"not:" + testUser}, testUser) {
+		t.Error("Negated user entry matched the user")
+	}
+
+	if !listMatchesUser([]string{"not:" + testUser}, "mike") {
+		t.Error("Negated user entry did not match other user")
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	a := ACL{
+		HostDefaults: []HostDefault{
+			{Hosts: []string{"legacy.example.com", "*.intranet.example.com"}, Policy: "allow"},
+		},
+		RuleSets: []RuleSet{
+			{
+				Rules: []Rule{{Field: "x-origin-uri", MatchString: testString("/admin")}},
+				Deny:  []string{testUser},
+			},
+		},
+	}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
+	}
+
+	for host, expected := range map[string]bool{
+		"legacy.example.com":        true,
+		"wiki.intranet.example.com": true,
+		"new.example.com":           false,
+	} {
+		if a.HasAccess(testRequest(map[string]string{"host": host})) != expected {
+			t.Errorf("Access to %s expected to be %v", host, expected)
+		}
+	}
+
+	if a.HasAccess(testRequest(map[string]string{"host": "legacy.example.com", "x-origin-uri": "/admin"})) {
+		t.Error("Default policy overruled an explicit deny")
+	}
+
+	a.Default = "allow"
+	if !a.HasAccess(testRequest(map[string]string{"host": "new.example.com"})) {
+		t.Error("Global default policy was not applied")
+	}
+
+	a.Default = "permit"
+	if err := a.Compile(); err == nil {
+		t.Error("Invalid default policy was accepted")
+	}
+}
+
+func TestRuleSetID(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{ID: "api", Rules: []Rule{{Field: "x-origin-uri", MatchString: testString("/api")}}, Allow: []string{testUser}},
+		{Rules: []Rule{{Field: "x-origin-uri", MatchString: testString("/admin")}}, Deny: []string{testUser}},
+	}}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
+	}
+
+	for uri, expID := range map[string]string{
+		"/api":   "api",
+		"/admin": "#2",
+		"/":      "default",
+	} {
+		_, decidedBy := a.Evaluate(testRequest(map[string]string{"x-origin-uri": uri}))
+		if id := a.RuleSetID(decidedBy); id != expID {
+			t.Errorf("Expected decision on %s by %q, got %q", uri, expID, id)
+		}
+	}
+
+	a.RuleSets[1].ID = "api"
+	if err := a.Compile(); err == nil {
+		t.Error("Duplicate rule set ID was accepted")
+	}
+}
+
+func TestAuthContextRequirements(t *testing.T) {
+	r := RuleSet{
+		Rules:         []Rule{{Field: "x-host", MatchString: testString("wiki.example.com")}},
+		Allow:         []string{testUser},
+		AuthMethod:    "not:token",
+		MaxSessionAge: time.Hour,
+		RequireMFA:    true,
+	}
+
+	for _, tc := range []struct {
+		Session  Session
+		Expected Result
+	}{
+		{Session{Provider: "simple", MFA: true, LoginTime: time.Now().Add(-time.Minute)}, Allow},
+		{Session{Provider: "token", MFA: true, LoginTime: time.Now()}, Deny},
+		{Session{Provider: "simple", MFA: false, LoginTime: time.Now()}, Deny},
+		{Session{Provider: "simple", MFA: true, LoginTime: time.Now().Add(-2 * time.Hour)}, Deny},
+		{Session{Provider: "simple", MFA: true}, Deny},
+	} {
+		req := testRequest(map[string]string{"x-host": "wiki.example.com"})
+		req.Session = tc.Session
+
+		if res := r.HasAccess(req); res != tc.Expected {
+			t.Errorf("Expected %s for session %#v, got %s", tc.Expected, tc.Session, res)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{
+			ID:    "quota-test",
+			Rules: []Rule{{Field: "x-host", MatchString: testString("api.example.com")}},
+			Allow: []string{testUser, "mike"},
+			Deny:  []string{"@blocked"},
+			Quota: &Quota{Requests: 2, Window: time.Minute},
+		},
+	}}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
+	}
+
+	counter := testCounter{}
+	request := func(user string, groups []string) Request {
+		return Request{User: user, Groups: groups, Fields: map[string]string{"x-host": "api.example.com"}, Counter: counter}
+	}
+
+	// Denied requests do not count against the quota
+	for i := 0; i < 3; i++ {
+		a.HasAccess(request(testUser, []string{"blocked"}))
+	}
+
+	for i, expected := range []bool{true, true, false} {
+		if a.HasAccess(request(testUser, testGroups)) != expected {
+			t.Errorf("Request %d expected access = %v", i+1, expected)
+		}
+	}
+
+	if !a.HasAccess(request("mike", testGroups)) {
+		t.Error("Quota of one user was applied to another user")
+	}
+
+	// Without counter the quota is not enforced
+	if !a.HasAccess(testRequest(map[string]string{"x-host": "api.example.com"})) {
+		t.Error("Quota was enforced without counter")
+	}
+
+	a.RuleSets[0].ID = ""
+	if err := a.Compile(); err == nil {
+		t.Error("Quota without rule set ID was accepted")
+	}
+}
+
+func TestCompositeGroups(t *testing.T) {
+	a := ACL{
+		Groups: RoleMapping{
+			"engineering": {"backend", "frontend"},
+			"tech":        {"engineering", "it"},
+		},
+		RuleSets: []RuleSet{
+			{
+				Rules: []Rule{{Field: "x-host", IsPresent: testBool(true)}},
+				Allow: []string{"@tech"},
+			},
+		},
+	}
+
+	fields := map[string]string{"x-host": "ci.example.com"}
+	if !a.HasAccess(Request{User: testUser, Groups: []string{"backend"}, Fields: fields}) {
+		t.Error("Nested composite group did not grant access")
+	}
+
+	if a.HasAccess(Request{User: testUser, Groups: []string{"sales"}, Fields: fields}) {
+		t.Error("Access was granted to user not in composite group")
+	}
+}
+
+func TestShadowRuleSet(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{
+			Rules: []Rule{{Field: "x-host", IsPresent: testBool(true)}},
+			Allow: []string{testUser},
+		},
+		{
+			Rules:  []Rule{{Field: "x-host", IsPresent: testBool(true)}},
+			Deny:   []string{testUser},
+			Shadow: true,
+		},
+	}}
+
+	req := testRequest(map[string]string{"x-host": "wiki.example.com"})
+	if !a.HasAccess(req) {
+		t.Error("Shadow rule set influenced the decision")
+	}
+
+	shadow := a.EvaluateShadow(req)
+	if len(shadow) != 1 || shadow[0].Position != 1 || shadow[0].Result != Deny {
+		t.Errorf("Unexpected shadow results: %#v", shadow)
+	}
+}
+
+func TestACLHostIndex(t *testing.T) {
+	a := ACL{RuleSets: []RuleSet{
+		{Rules: []Rule{{Field: "host", MatchString: testString("a.example.com")}}, Deny: []string{testUser}},
+		{Rules: []Rule{{Field: "x-origin-uri", MatchString: testString("/")}}, Allow: []string{testUser}},
+		{Rules: []Rule{{Field: "Host", MatchString: testString("b.example.com")}}, Allow: []string{testUser}},
+		{Rules: []Rule{{Field: "host", MatchString: testString("not:a.example.com")}}, Allow: []string{testUser}},
+	}}
+	if err := a.Compile(); err != nil {
+		t.Fatalf("ACL did not compile: %s", err)
+	}
+
+	for host, expected := range map[string]string{
+		"a.example.com":     "[0 1 3]",
+		"b.example.com":     "[1 2 3]",
+		"other.example.com": "[1 3]",
+	} {
+		if positions := fmt.Sprint(a.ruleSetsFor(map[string]string{"host": host})); positions != expected {
+			t.Errorf("Expected rule sets %s for %s, got %s", expected, host, positions)
+		}
+	}
+
+	if a.HasAccess(testRequest(map[string]string{"host": "a.example.com", "x-origin-uri": "/"})) {
+		t.Error("Indexed deny was not applied")
+	}
+	if !a.HasAccess(testRequest(map[string]string{"host": "b.example.com"})) {
+		t.Error("Indexed allow was not applied")
+	}
+}
@@ -0,0 +1,86 @@
+package acl
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ReadFunc reads the content of an included file
+type ReadFunc func(file string) ([]byte, error)
+
+// include is the content of a file included into the ACL. The rule
+// sets of the file can be limited to a list of hosts.
+type include struct {
+	Hosts    []string  `yaml:"hosts"`
+	RuleSets []RuleSet `yaml:"rule_sets"`
+}
+
+// LoadIncludes reads all files matching the include patterns and appends
+// their rule sets to the ACL. Relative patterns are resolved against the
+// given directory. Files are loaded in lexical order.
+func (a *ACL) LoadIncludes(baseDir string, read ReadFunc) error {
+	for _, pattern := range a.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Include pattern %q is invalid: %s", pattern, err)
+		}
+		sort.Strings(files)
+
+		for _, file := range files {
+			ruleSets, err := LoadInclude(file, read)
+			if err != nil {
+				return fmt.Errorf("Unable to load ACL include %q: %s", file, err)
+			}
+
+			a.RuleSets = append(a.RuleSets, ruleSets...)
+			a.includedFiles = append(a.includedFiles, file)
+		}
+	}
+
+	return nil
+}
+
+// LoadInclude reads the rule sets of the included file, rule sets of a
+// file limited to hosts get a rule matching those hosts prepended
+func LoadInclude(file string, read ReadFunc) ([]RuleSet, error) {
+	raw, err := read(file)
+	if err != nil {
+		return nil, err
+	}
+
+	inc := include{}
+	if err := yaml.Unmarshal(raw, &inc); err != nil {
+		return nil, err
+	}
+
+	if len(inc.Hosts) == 0 {
+		return inc.RuleSets, nil
+	}
+
+	hosts := []string{}
+	for _, h := range inc.Hosts {
+		hosts = append(hosts, regexp.QuoteMeta(h))
+	}
+	hostRule := Rule{
+		Field:      "host",
+		MatchRegex: stringPtr("^(?:" + strings.Join(hosts, "|") + ")$"),
+		indexHosts: inc.Hosts,
+	}
+
+	for i := range inc.RuleSets {
+		inc.RuleSets[i].Rules = append([]Rule{hostRule}, inc.RuleSets[i].Rules...)
+	}
+
+	return inc.RuleSets, nil
+}
+
+func stringPtr(in string) *string { return &in }
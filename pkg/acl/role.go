@@ -0,0 +1,41 @@
+package acl
+
+import "github.com/Luzifer/go_helpers/str"
+
+// RoleMapping maps internal role names to the provider specific groups
+// granting the role
+type RoleMapping map[string][]string
+
+// Apply adds the roles granted by one of the groups to the list of
+// groups. The original groups are kept to be usable in the ACL.
+func (r RoleMapping) Apply(groups []string) []string {
+	result := append([]string{}, groups...)
+
+	for role, members := range r {
+		if str.StringInSlice(role, result) {
+			continue
+		}
+
+		for _, group := range groups {
+			if str.StringInSlice(group, members) {
+				result = append(result, role)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// Expand applies the mapping repeatedly so mapped groups can be members
+// of other mapped groups
+func (r RoleMapping) Expand(groups []string) []string {
+	result := groups
+	for {
+		expanded := r.Apply(result)
+		if len(expanded) == len(result) {
+			return expanded
+		}
+		result = expanded
+	}
+}
@@ -0,0 +1,314 @@
+// Package acl contains the ACL engine of nginx-sso: Rules matching the
+// fields of a request, rule sets granting or denying access to users
+// and groups and the ACL judging requests using them. The engine does
+// not read requests or global state, everything is passed in through
+// the fields and the Request to be embeddable into other services.
+package acl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Luzifer/nginx-sso/pkg/script"
+)
+
+// NegationPrefix can be prepended to matcher values and allow / deny
+// entries to negate them
+const NegationPrefix = "not:"
+
+// Rule matches one field of the request (or all of them using a script)
+type Rule struct {
+	Field       string   `yaml:"field"`
+	Invert      bool     `yaml:"invert"`
+	IsPresent   *bool    `yaml:"present"`
+	MatchCIDR   []string `yaml:"cidr"`
+	MatchGlob   *string  `yaml:"glob"`
+	MatchRegex  *string  `yaml:"regexp"`
+	MatchString *string  `yaml:"equals"`
+	// Script is a Lua script returning whether the rule applies, it can
+	// be used without a field to match on multiple fields
+	Script string `yaml:"script"`
+
+	matchCIDR   []*net.IPNet
+	matchGlob   *regexp.Regexp
+	matchRegex  *regexp.Regexp
+	matchScript *script.Script
+	// indexHosts are the only hosts the rule can apply to, set for rules
+	// matching the host exactly to index their rule set by the host
+	indexHosts []string
+}
+
+func (a Rule) Validate() error {
+	if a.Field == "" && a.Script == "" {
+		return fmt.Errorf("Field is not set")
+	}
+
+	if a.IsPresent == nil && a.MatchCIDR == nil && a.MatchGlob == nil && a.MatchRegex == nil && a.MatchString == nil && a.Script == "" {
+		return fmt.Errorf("No matcher (present, cidr, glob, regexp, equals, script) is set")
+	}
+
+	if _, err := ParseCIDRs(a.MatchCIDR); err != nil {
+		return err
+	}
+
+	if a.MatchGlob != nil {
+		if _, err := CompileGlob(matchValue(*a.MatchGlob)); err != nil {
+			return fmt.Errorf("Glob is invalid: %s", err)
+		}
+	}
+
+	if a.MatchRegex != nil {
+		if _, err := regexp.Compile(matchValue(*a.MatchRegex)); err != nil {
+			return fmt.Errorf("Regexp is invalid: %s", err)
+		}
+	}
+
+	if a.Script != "" {
+		if _, err := script.Compile("acl", a.Script); err != nil {
+			return fmt.Errorf("Script is invalid: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Compile validates the rule and pre-compiles its regexp and glob to
+// avoid compiling them for every request
+func (a *Rule) Compile() error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+
+	if a.MatchGlob != nil {
+		a.matchGlob, _ = CompileGlob(matchValue(*a.MatchGlob))
+	}
+
+	if a.MatchRegex != nil {
+		a.matchRegex = regexp.MustCompile(matchValue(*a.MatchRegex))
+	}
+
+	a.matchCIDR, _ = ParseCIDRs(a.MatchCIDR)
+
+	if a.Script != "" {
+		a.matchScript, _ = script.Compile("acl", a.Script)
+	}
+
+	if a.indexHosts == nil && strings.ToLower(a.Field) == "host" && a.IsPresent == nil && !a.Invert &&
+		a.MatchString != nil && !strings.HasPrefix(*a.MatchString, NegationPrefix) {
+		a.indexHosts = []string{*a.MatchString}
+	}
+
+	return nil
+}
+
+func (a Rule) AppliesToFields(fields map[string]string) bool {
+	var field, value string
+
+	for f, v := range fields {
+		if strings.ToLower(a.Field) == f {
+			field = f
+			value = v
+			break
+		}
+	}
+
+	if a.IsPresent != nil {
+		if !a.Invert && *a.IsPresent && field == "" {
+			// Field is expected to be present but isn't, rule does not apply
+			return false
+		}
+		if !a.Invert && !*a.IsPresent && field != "" {
+			// Field is expected not to be present but is, rule does not apply
+			return false
+		}
+		if a.Invert && *a.IsPresent && field != "" {
+			// Field is expected not to be present but is, rule does not apply
+			return false
+		}
+		if a.Invert && !*a.IsPresent && field == "" {
+			// Field is expected to be present but isn't, rule does not apply
+			return false
+		}
+
+		return true
+	}
+
+	if a.Field == "" {
+		// Script only rule
+		return a.scriptMatches("", fields)
+	}
+
+	if field == "" {
+		// We found a rule which has no matching field, rule does not apply
+		return false
+	}
+
+	if a.MatchString != nil {
+		if (matchValue(*a.MatchString) != value) == !a.invertMatcher(*a.MatchString) {
+			// Value does not match expected string, rule does not apply
+			return false
+		}
+	}
+
+	if a.MatchCIDR != nil {
+		nets := a.matchCIDR
+		if nets == nil {
+			nets, _ = ParseCIDRs(a.MatchCIDR)
+		}
+
+		if IPInNetworks(value, nets) == a.Invert {
+			// Value is not within the expected networks, rule does not apply
+			return false
+		}
+	}
+
+	if a.MatchGlob != nil {
+		re := a.matchGlob
+		if re == nil {
+			re, _ = CompileGlob(matchValue(*a.MatchGlob))
+		}
+
+		if re.MatchString(value) == a.invertMatcher(*a.MatchGlob) {
+			// Value does not match expected glob, rule does not apply
+			return false
+		}
+	}
+
+	if a.MatchRegex != nil {
+		re := a.matchRegex
+		if re == nil {
+			re = regexp.MustCompile(matchValue(*a.MatchRegex))
+		}
+
+		if re.MatchString(value) == a.invertMatcher(*a.MatchRegex) {
+			// Value does not match expected regexp, rule does not apply
+			return false
+		}
+	}
+
+	if a.Script != "" && !a.scriptMatches(value, fields) {
+		// Script did not return true, rule does not apply
+		return false
+	}
+
+	return true
+}
+
+// scriptMatches runs the script with the `fields` of the request and
+// the `value` of the selected field (nil for rules without field). A
+// failing script does not match.
+func (a Rule) scriptMatches(value string, fields map[string]string) bool {
+	s := a.matchScript
+	if s == nil {
+		var err error
+		if s, err = script.Compile("acl", a.Script); err != nil {
+			return false
+		}
+	}
+
+	globals := map[string]interface{}{"fields": fields}
+	if a.Field != "" {
+		globals["value"] = value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), script.DefaultTimeout)
+	defer cancel()
+
+	res, err := s.Run(ctx, globals)
+	if err != nil {
+		log.WithError(err).WithField("field", a.Field).Warn("ACL script failed, rule does not apply")
+		return false
+	}
+
+	return (res == true) != a.Invert
+}
+
+// matchValue strips the negation prefix from the given value
+func matchValue(v string) string {
+	return strings.TrimPrefix(v, NegationPrefix)
+}
+
+// invertMatcher determines whether the result of the matcher with the
+// given value needs to be inverted: A negated value inverts the result
+// in addition to the invert flag of the rule.
+func (a Rule) invertMatcher(v string) bool {
+	return a.Invert != strings.HasPrefix(v, NegationPrefix)
+}
+
+// CompileGlob converts a glob pattern into an anchored regexp: `*` and
+// `?` match any characters / a single character except `/` while `**`
+// also matches across path segments. A `/**` suffix matches the path
+// itself and everything below it.
+func CompileGlob(pattern string) (*regexp.Regexp, error) {
+	expr := new(strings.Builder)
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			expr.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// ParseCIDRs parses the networks, single IP addresses are accepted as
+// networks containing only the address
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			// Single IP address
+			if strings.Contains(c, ":") {
+				c += "/128"
+			} else {
+				c += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("CIDR %q is invalid: %s", c, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// IPInNetworks checks whether the value is an IP address contained in
+// one of the networks
+func IPInNetworks(value string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(strings.TrimSpace(value))
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,253 @@
+package acl
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Luzifer/go_helpers/str"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result is the decision of a rule set or the ACL on a request
+type Result uint
+
+const (
+	Dunno Result = iota
+	Allow
+	Deny
+)
+
+func (a Result) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return "no decision"
+	}
+}
+
+// Session describes the session the user was detected from, the rule
+// sets can require properties of it
+type Session struct {
+	Provider  string
+	MFA       bool
+	LoginTime time.Time
+}
+
+// Counter counts the requests for the quotas of the rule sets
+type Counter interface {
+	// Increment increases the counter for the given key and returns the
+	// number of requests counted within the current window
+	Increment(key string, window time.Duration) (int, error)
+}
+
+// Request contains everything the ACL judges a request by
+type Request struct {
+	User   string
+	Groups []string
+	// Fields are the fields of the request the rules are matched
+	// against, their names need to be lower case
+	Fields map[string]string
+	// Session is the session the user was detected from
+	Session Session
+	// Counter counts the requests for the quotas, without counter the
+	// quotas are not enforced
+	Counter Counter
+}
+
+type RuleSet struct {
+	ID    string `yaml:"id"`
+	Rules []Rule `yaml:"rules"`
+
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	Final bool     `yaml:"final"`
+
+	AllowAnonymous     bool `yaml:"allow_anonymous"`
+	SkipSessionBinding bool `yaml:"skip_session_binding"`
+
+	AuthMethod    string        `yaml:"auth_method"`
+	MaxSessionAge time.Duration `yaml:"max_session_age"`
+	RequireMFA    bool          `yaml:"require_mfa"`
+
+	Quota *Quota `yaml:"quota"`
+
+	Shadow bool `yaml:"shadow"`
+}
+
+// authContextSatisfied checks the requirements of the rule set on the
+// session the user was detected from
+func (a RuleSet) authContextSatisfied(s Session) bool {
+	if a.AuthMethod != "" && (s.Provider == matchValue(a.AuthMethod)) == strings.HasPrefix(a.AuthMethod, NegationPrefix) {
+		return false
+	}
+
+	if a.RequireMFA && !s.MFA {
+		return false
+	}
+
+	if a.MaxSessionAge > 0 && (s.LoginTime.IsZero() || time.Since(s.LoginTime) > a.MaxSessionAge) {
+		return false
+	}
+
+	return true
+}
+
+func (a RuleSet) AppliesToFields(fields map[string]string) bool {
+	for _, rule := range a.Rules {
+		if !rule.AppliesToFields(fields) {
+			// At least one rule does not match the request
+			return false
+		}
+	}
+
+	return true
+}
+
+// HasAccess judges the request using the groups of the request as they
+// are, the composite groups of the ACL are expanded by its Evaluate
+func (a RuleSet) HasAccess(req Request) Result {
+	if !a.AppliesToFields(req.Fields) {
+		return Dunno
+	}
+
+	// All rules do apply to this request, we can judge
+
+	if !a.authContextSatisfied(req.Session) {
+		// The session does not fulfill the requirements, final result
+		return Deny
+	}
+
+	if listMatchesUser(a.Deny, req.User) || listMatchesGroups(a.Deny, req.Groups) {
+		// Explicit deny of the user or through group, final result
+		return Deny
+	}
+
+	if !listMatchesUser(a.Allow, req.User) && !listMatchesGroups(a.Allow, req.Groups) {
+		// Neither user nor group are handled
+		return Dunno
+	}
+
+	// Only allowed requests count against the quota
+	if a.Quota != nil && a.Quota.Exceeded(req.Counter, a.ID, req.User) {
+		// User issued too many requests, final result
+		return Deny
+	}
+
+	return Allow
+}
+
+// listMatchesUser checks whether the user entries (not prefixed with
+// `@`) of the allow / deny list match the user. A negated entry matches
+// all users except the given one.
+func listMatchesUser(list []string, user string) bool {
+	for _, entry := range list {
+		name := matchValue(entry)
+		if strings.HasPrefix(name, "@") {
+			continue
+		}
+
+		if (name == user) != strings.HasPrefix(entry, NegationPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listMatchesGroups checks whether the group entries (prefixed with `@`)
+// of the allow / deny list match one of the groups. A negated entry
+// matches if the user is not member of the given group.
+func listMatchesGroups(list []string, groups []string) bool {
+	for _, entry := range list {
+		name := matchValue(entry)
+		if !strings.HasPrefix(name, "@") {
+			continue
+		}
+
+		if str.StringInSlice(name[1:], groups) != strings.HasPrefix(entry, NegationPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a RuleSet) Validate() error {
+	for i, r := range a.Rules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("Rule on position %d is invalid: %s", i+1, err)
+		}
+	}
+
+	if a.Quota != nil {
+		if a.ID == "" {
+			return fmt.Errorf("Rule sets with quota need an ID")
+		}
+		if err := a.Quota.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *RuleSet) Compile() error {
+	for i := range a.Rules {
+		if err := a.Rules[i].Compile(); err != nil {
+			return fmt.Errorf("Rule on position %d is invalid: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// indexHosts returns the hosts the rule set is limited to or nil if it
+// can apply to every host
+func (a RuleSet) indexHosts() []string {
+	for _, rule := range a.Rules {
+		if rule.indexHosts != nil {
+			return rule.indexHosts
+		}
+	}
+	return nil
+}
+
+// Quota limits the number of requests a user may issue within the
+// given window to the resources matched by a rule set
+type Quota struct {
+	Requests int           `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+}
+
+func (q Quota) Validate() error {
+	if q.Requests < 1 {
+		return fmt.Errorf("Quota requests must be at least 1")
+	}
+
+	if q.Window <= 0 {
+		return fmt.Errorf("Quota window must be set")
+	}
+
+	return nil
+}
+
+// Exceeded counts the request of the user and checks whether the user
+// issued more requests than allowed within the current window. Without
+// counter or if the counter fails the request is not limited.
+func (q Quota) Exceeded(c Counter, ruleSetID, user string) bool {
+	if c == nil {
+		return false
+	}
+
+	n, err := c.Increment(ruleSetID+"|"+user, q.Window)
+	if err != nil {
+		log.WithError(err).WithField("rule_set", ruleSetID).Error("Unable to count request for quota")
+		return false
+	}
+
+	return n > q.Requests
+}
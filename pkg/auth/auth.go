@@ -0,0 +1,99 @@
+// Package auth contains the interface of the authenticators of nginx-sso
+// and the registry creating and configuring their instances.
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+var (
+	// The errors are shared with the providers loaded as plugins, see
+	// the plugins package for their meaning
+	ErrProviderUnconfigured = plugins.ErrProviderUnconfigured
+	ErrNoUser               = plugins.ErrNoUser
+	ErrWrongCredentials     = plugins.ErrWrongCredentials
+	ErrMFARequired          = plugins.ErrMFARequired
+	ErrBackendUnavailable   = plugins.ErrBackendUnavailable
+)
+
+// Authenticator detects and logs in users
+type Authenticator interface {
+	// AuthenticatorID needs to return an unique string to identify
+	// this special authenticator
+	AuthenticatorID() (id string)
+
+	// Configure loads the configuration for the Authenticator from the
+	// global config.yaml file which is passed as a byte-slice.
+	// If no configuration for the Authenticator is supplied the function
+	// needs to return the ErrProviderUnconfigured
+	Configure(yamlSource []byte) (err error)
+
+	// DetectUser is used to detect a user without a login form from
+	// a cookie, header or other methods
+	// If no user was detected the ErrNoUser needs to be
+	// returned
+	// Calls to backends need to honor the context which ends when the
+	// request is canceled or the provider_timeout is exceeded. This
+	// applies to Login and Logout as well.
+	DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (user string, groups []string, err error)
+
+	// Login is called when the user submits the login form and needs
+	// to authenticate the user or throw an error. If the user has
+	// successfully logged in the persistent cookie should be written
+	// in order to use DetectUser for the next login.
+	// With the login result an array of MFAConfig must be returned. In
+	// case there is no MFA config or the provider does not support MFA
+	// return nil.
+	// If the user did not login correctly the ErrNoUser
+	// needs to be returned
+	Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (user string, mfaConfigs []MFAConfig, err error)
+
+	// LoginFields needs to return the fields required for this login
+	// method. If no login using this method is possible the function
+	// needs to return nil.
+	LoginFields() (fields []LoginField)
+
+	// Logout is called when the user visits the logout endpoint and
+	// needs to destroy any persistent stored cookies
+	Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) (err error)
+
+	// SupportsMFA returns the MFA detection capabilities of the login
+	// provider. If the provider can provide MFAConfig objects from its
+	// configuration return true. If this is true the login interface
+	// will display an additional field for this provider for the user
+	// to fill in their MFA token.
+	SupportsMFA() bool
+}
+
+// LoginField describes a field of the login form of an authenticator
+type LoginField struct {
+	Label       string `json:"label"`
+	Name        string `json:"name"`
+	Placeholder string `json:"placeholder"`
+	Type        string `json:"type"`
+}
+
+// MFAConfig is returned by the authenticator for every MFA method of
+// the user and passed to the MFA provider matching the Provider
+type MFAConfig struct {
+	Provider   string                 `yaml:"provider"`
+	Attributes map[string]interface{} `yaml:"attributes"`
+}
+
+func NewMFAConfig(provider string, attrs map[string]interface{}) MFAConfig {
+	return MFAConfig{Provider: provider, Attributes: attrs}
+}
+
+// AttributeString returns the attribute if it is a string
+func (m MFAConfig) AttributeString(key string) string {
+	if v, ok := m.Attributes[key]; ok {
+		if sv, ok := v.(string); ok {
+			return sv
+		}
+	}
+
+	return ""
+}
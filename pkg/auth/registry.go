@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Factory is implemented by registered providers which can't be created
+// from their zero value like the adapters of plugins
+type Factory interface {
+	NewInstance() interface{}
+}
+
+// NewInstance creates a new zero value of the type of the registered
+// provider. Providers are configured as new instances on every load to
+// keep the active instances untouched until the whole configuration was
+// loaded successfully.
+func NewInstance(p interface{}) interface{} {
+	if f, ok := p.(Factory); ok {
+		return f.NewInstance()
+	}
+	return reflect.New(reflect.TypeOf(p).Elem()).Interface()
+}
+
+// Registry holds the registered authenticators. They are only used as
+// prototypes: Configure creates and configures new instances of them.
+type Registry struct {
+	authenticators []Authenticator
+	lock           sync.RWMutex
+}
+
+// NewRegistry creates a registry containing the given authenticators
+func NewRegistry(a ...Authenticator) *Registry {
+	return &Registry{authenticators: a}
+}
+
+// Register adds the authenticator to the registry
+func (r *Registry) Register(a Authenticator) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.authenticators = append(r.authenticators, a)
+}
+
+// Registered returns whether an authenticator with the ID is registered
+func (r *Registry) Registered(id string) bool {
+	for _, a := range r.Authenticators() {
+		if a.AuthenticatorID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticators returns the registered authenticators
+func (r *Registry) Authenticators() []Authenticator {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return append([]Authenticator(nil), r.authenticators...)
+}
+
+// Configure configures new instances of all registered authenticators.
+// Authenticators returning ErrProviderUnconfigured are skipped, at least
+// one of them needs to be configured.
+func (r *Registry) Configure(yamlSource []byte) ([]Authenticator, error) {
+	tmp := []Authenticator{}
+	for _, proto := range r.Authenticators() {
+		a := NewInstance(proto).(Authenticator)
+		err := a.Configure(yamlSource)
+
+		switch {
+		case err == nil:
+			tmp = append(tmp, a)
+			log.WithFields(log.Fields{"authenticator": a.AuthenticatorID()}).Debug("Activated authenticator")
+		case errors.Is(err, ErrProviderUnconfigured):
+			log.WithFields(log.Fields{"authenticator": a.AuthenticatorID()}).Debug("Authenticator unconfigured")
+			// This is okay.
+		default:
+			return nil, fmt.Errorf("Authenticator configuration caused an error: %s", err)
+		}
+	}
+
+	if len(tmp) == 0 {
+		return nil, fmt.Errorf("No authenticator configurations supplied")
+	}
+
+	return tmp, nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type testAuthenticator struct {
+	Config string
+}
+
+func (t *testAuthenticator) AuthenticatorID() string { return "test" }
+
+func (t *testAuthenticator) Configure(yamlSource []byte) error {
+	if !strings.Contains(string(yamlSource), "test") {
+		return errors.Wrap(ErrProviderUnconfigured, "No test section found")
+	}
+	t.Config = string(yamlSource)
+	return nil
+}
+
+func (t *testAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	return "", nil, ErrNoUser
+}
+
+func (t *testAuthenticator) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []MFAConfig, error) {
+	return "", nil, ErrNoUser
+}
+
+func (t *testAuthenticator) LoginFields() []LoginField { return nil }
+
+func (t *testAuthenticator) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (t *testAuthenticator) SupportsMFA() bool { return false }
+
+func TestRegistryConfigure(t *testing.T) {
+	proto := &testAuthenticator{}
+	reg := NewRegistry()
+	reg.Register(proto)
+
+	if !reg.Registered("test") || reg.Registered("simple") {
+		t.Error("Unexpected registered authenticators")
+	}
+
+	if _, err := reg.Configure([]byte("providers: {}")); err == nil {
+		t.Error("Expected an error without configured authenticators")
+	}
+
+	authenticators, err := reg.Configure([]byte("providers:\n  test: {}"))
+	if err != nil {
+		t.Fatalf("Unable to configure authenticators: %s", err)
+	}
+
+	if len(authenticators) != 1 || authenticators[0] == proto {
+		t.Fatalf("Expected a new instance of the authenticator, got %v", authenticators)
+	}
+	if proto.Config != "" {
+		t.Error("Expected the registered prototype not to be configured")
+	}
+}
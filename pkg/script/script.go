@@ -0,0 +1,199 @@
+// Package script runs the Lua scripts embedded into the configuration of
+// nginx-sso (ACL rules and hooks) in a sandbox.
+package script
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	// DefaultTimeout limits the runtime of scripts called for every
+	// request without a configured timeout
+	DefaultTimeout = 100 * time.Millisecond
+
+	luaCallStackSize = 64
+	luaRegistrySize  = 1024 * 16
+)
+
+// luaSandboxRemoved lists the functions of the base library giving
+// access to the filesystem or loading further code
+var luaSandboxRemoved = []string{"collectgarbage", "dofile", "load", "loadfile", "loadstring", "module", "require"}
+
+// Script is a Lua chunk embedded into the configuration. It is
+// compiled once and executed in a fresh sandboxed state for every call:
+// Only the base, string, table and math libraries are available, there
+// is no access to files, processes or the network.
+type Script struct {
+	name  string
+	proto *lua.FunctionProto
+}
+
+// Compile parses the source of the script, the name is used in errors
+// and the log messages of the script
+func Compile(name, source string) (*Script, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse script")
+	}
+
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to compile script")
+	}
+
+	return &Script{name: name, proto: proto}, nil
+}
+
+// Run executes the script with the given globals and returns the first
+// value returned by the script converted to Go values
+func (s *Script) Run(ctx context.Context, globals map[string]interface{}) (interface{}, error) {
+	L := lua.NewState(lua.Options{
+		CallStackSize: luaCallStackSize,
+		RegistrySize:  luaRegistrySize,
+		SkipOpenLibs:  true,
+	})
+	defer L.Close()
+
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.MathLibName:   lua.OpenMath,
+		lua.StringLibName: lua.OpenString,
+		lua.TabLibName:    lua.OpenTable,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range luaSandboxRemoved {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(s.print))
+
+	for k, v := range globals {
+		L.SetGlobal(k, luaValue(L, v))
+	}
+
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, errors.Wrap(err, "Script failed")
+	}
+
+	return goValue(L.Get(-1)), nil
+}
+
+// RunJSON passes the global as JSON compatible Lua values and decodes
+// the result of the script into out. A script returning nothing leaves
+// out unchanged.
+func (s *Script) RunJSON(ctx context.Context, name string, in, out interface{}) error {
+	var global interface{}
+	if err := jsonRoundTrip(in, &global); err != nil {
+		return errors.Wrap(err, "Unable to convert script input")
+	}
+
+	res, err := s.Run(ctx, map[string]interface{}{name: global})
+	if err != nil || res == nil {
+		return err
+	}
+
+	return errors.Wrap(jsonRoundTrip(res, out), "Unable to decode script result")
+}
+
+// print writes the arguments to the log instead of stdout
+func (s *Script) print(L *lua.LState) int {
+	args := make([]string, L.GetTop())
+	for i := range args {
+		args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	log.WithField("script", s.name).Info(strings.Join(args, " "))
+	return 0
+}
+
+func jsonRoundTrip(in, out interface{}) error {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// luaValue converts the JSON compatible Go value into a Lua value
+func luaValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []string:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(lua.LString(e))
+		}
+		return t
+	case map[string]string:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSetString(k, lua.LString(e))
+		}
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, e := range v {
+			t.Append(luaValue(L, e))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, e := range v {
+			t.RawSetString(k, luaValue(L, e))
+		}
+		return t
+	default:
+		return lua.LNil
+	}
+}
+
+// goValue converts the Lua value into a JSON compatible Go value:
+// Tables with consecutive integer keys become lists, other tables
+// objects and empty tables nil as Lua can't tell both apart.
+func goValue(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 && n == v.Len() {
+			list := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				list = append(list, goValue(v.RawGetInt(i)))
+			}
+			return list
+		}
+
+		obj := map[string]interface{}{}
+		v.ForEach(func(k, e lua.LValue) {
+			obj[k.String()] = goValue(e)
+		})
+		if len(obj) == 0 {
+			return nil
+		}
+		return obj
+	default:
+		return nil
+	}
+}
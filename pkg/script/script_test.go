@@ -0,0 +1,35 @@
+package script
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScript(t *testing.T) {
+	if _, err := Compile("test", "return ("); err == nil {
+		t.Error("Expected invalid script to be rejected")
+	}
+
+	for _, src := range []string{
+		`return io.open("/etc/passwd")`,
+		`return os.execute("true")`,
+		`return dofile("/etc/passwd")`,
+		`return require("os")`,
+	} {
+		s, err := Compile("test", src)
+		if err != nil {
+			t.Fatalf("Unable to compile script: %s", err)
+		}
+		if _, err := s.Run(context.Background(), nil); err == nil {
+			t.Errorf("Expected sandbox to prevent %q", src)
+		}
+	}
+
+	s, _ := Compile("test", "while true do end")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Run(ctx, nil); err == nil {
+		t.Error("Expected endless script to be aborted")
+	}
+}
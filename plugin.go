@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"plugin"
+	"reflect"
+	"sync"
+
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const pluginRegisterSymbol = "Register"
+
+var (
+	// loadedPlugins contains the paths of all opened plugins, Go plugins
+	// can't be unloaded so they are opened and registered only once
+	loadedPlugins     = map[string]bool{}
+	loadedPluginsLock sync.Mutex
+)
+
+// pluginsConfig points to a directory containing authenticators and MFA
+// providers built as Go plugins and lists the authenticators running as
+// external processes or compiled to WebAssembly
+type pluginsConfig struct {
+	Directory string                 `yaml:"directory"`
+	External  []externalPluginConfig `yaml:"external"`
+	WASM      []wasmPluginConfig     `yaml:"wasm"`
+}
+
+// loadPlugins opens all plugins in the directory which were not opened
+// before and lets them register their providers. Plugins removed from
+// the directory stay registered until the next restart.
+func loadPlugins(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return errors.Wrap(err, "Unable to list plugins")
+	}
+
+	loadedPluginsLock.Lock()
+	defer loadedPluginsLock.Unlock()
+
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to resolve path of plugin %s", file)
+		}
+		if loadedPlugins[path] {
+			continue
+		}
+
+		p, err := plugin.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to open plugin %s", file)
+		}
+		// Opening the same path again returns the same plugin which must
+		// not register its providers twice
+		loadedPlugins[path] = true
+
+		sym, err := p.Lookup(pluginRegisterSymbol)
+		if err != nil {
+			return errors.Wrapf(err, "Plugin %s does not export %s", file, pluginRegisterSymbol)
+		}
+
+		register, ok := sym.(func(plugins.RegisterAuthenticatorFunc, plugins.RegisterMFAProviderFunc) error)
+		if !ok {
+			return errors.Errorf("%s of plugin %s has the wrong type %T", pluginRegisterSymbol, file, sym)
+		}
+
+		if err := registerPlugin(register); err != nil {
+			return errors.Wrapf(err, "Unable to register plugin %s", file)
+		}
+		log.WithField("plugin", file).Info("Loaded plugin")
+	}
+
+	return nil
+}
+
+// registerPlugin calls the register function of a plugin and adds the
+// providers passed by the plugin to the registries
+func registerPlugin(register plugins.RegisterFunc) error {
+	var regErr error
+
+	err := register(
+		func(a plugins.Authenticator) {
+			if err := validatePluginProvider(a); err != nil {
+				regErr = err
+				return
+			}
+			if authenticatorRegistry.Registered(a.AuthenticatorID()) {
+				regErr = errors.Errorf("Authenticator %q is already registered", a.AuthenticatorID())
+				return
+			}
+			registerAuthenticator(&pluginAuthenticator{a})
+		},
+		func(m plugins.MFAProvider) {
+			if err := validatePluginProvider(m); err != nil {
+				regErr = err
+				return
+			}
+			if mfaProviderRegistered(m.ProviderID()) {
+				regErr = errors.Errorf("MFA provider %q is already registered", m.ProviderID())
+				return
+			}
+			registerMFAProvider(&pluginMFAProvider{m})
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	return regErr
+}
+
+// validatePluginProvider ensures new instances of the provider can be
+// created for every load of the configuration
+func validatePluginProvider(p interface{}) error {
+	t := reflect.TypeOf(p)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("Provider %T needs to be a pointer to a struct", p)
+	}
+	return nil
+}
+
+func mfaProviderRegistered(id string) bool {
+	mfaRegistryMutex.RLock()
+	defer mfaRegistryMutex.RUnlock()
+
+	for _, m := range mfaRegistry {
+		if m.ProviderID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginAuthenticator adapts an authenticator of a plugin to the
+// interface of the built-in authenticators
+type pluginAuthenticator struct {
+	plugins.Authenticator
+}
+
+func (p *pluginAuthenticator) NewInstance() interface{} {
+	return &pluginAuthenticator{auth.NewInstance(p.Authenticator).(plugins.Authenticator)}
+}
+
+func (p *pluginAuthenticator) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+	user, cfgs, err := p.Authenticator.Login(ctx, res, r)
+
+	var mfaCfgs []mfaConfig
+	for _, c := range cfgs {
+		mfaCfgs = append(mfaCfgs, mfaConfig(c))
+	}
+	return user, mfaCfgs, err
+}
+
+func (p *pluginAuthenticator) LoginFields() []loginField {
+	var fields []loginField
+	for _, f := range p.Authenticator.LoginFields() {
+		fields = append(fields, loginField(f))
+	}
+	return fields
+}
+
+// pluginMFAProvider adapts an MFA provider of a plugin to the interface
+// of the built-in MFA providers
+type pluginMFAProvider struct {
+	plugins.MFAProvider
+}
+
+func (p *pluginMFAProvider) NewInstance() interface{} {
+	return &pluginMFAProvider{auth.NewInstance(p.MFAProvider).(plugins.MFAProvider)}
+}
+
+func (p *pluginMFAProvider) ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []mfaConfig) error {
+	cfgs := make([]plugins.MFAConfig, 0, len(mfaCfgs))
+	for _, c := range mfaCfgs {
+		cfgs = append(cfgs, plugins.MFAConfig(c))
+	}
+	return p.MFAProvider.ValidateMFA(ctx, res, r, user, cfgs)
+}
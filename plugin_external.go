@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	externalPluginCallTimeout    = 30 * time.Second
+	externalPluginRestartDelay   = 5 * time.Second
+	externalPluginStartTimeout   = time.Minute
+	externalPluginStopTimeout    = 2 * time.Second
+	externalPluginCoreProtocol   = "1"
+	externalPluginControllerPath = "/plugin.GRPCController/Shutdown"
+
+	grpcStatusFailedPrecondition = 9
+)
+
+var (
+	// externalPlugins contains the started plugins by their command, they
+	// are started and registered only once
+	externalPlugins     = map[string]*externalPlugin{}
+	externalPluginsLock sync.Mutex
+)
+
+// externalPluginConfig describes the command to start an authenticator
+// running as an external process
+type externalPluginConfig struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
+func (e externalPluginConfig) key() string {
+	return strings.Join(append([]string{e.Command}, e.Args...), "\x00")
+}
+
+// Validate checks the commands of the external plugins and the paths
+// of the WASM plugins
+func (p pluginsConfig) Validate() error {
+	for i, e := range p.External {
+		if e.Command == "" {
+			return errors.Errorf("Command of external plugin %d is required", i+1)
+		}
+	}
+	for i, w := range p.WASM {
+		if w.Path == "" {
+			return errors.Errorf("Path of WASM plugin %d is required", i+1)
+		}
+	}
+	return nil
+}
+
+// loadExternalPlugins starts all external plugins which were not started
+// before and registers their authenticators. Plugins removed from the
+// configuration keep running until nginx-sso is restarted.
+func loadExternalPlugins(cfgs []externalPluginConfig) error {
+	externalPluginsLock.Lock()
+	defer externalPluginsLock.Unlock()
+
+	for _, cfg := range cfgs {
+		if _, ok := externalPlugins[cfg.key()]; ok {
+			continue
+		}
+
+		p := &externalPlugin{cfg: cfg}
+		info, err := p.getInfo()
+		if err == nil && authenticatorRegistry.Registered(info.ID) {
+			err = errors.Errorf("Authenticator %q is already registered", info.ID)
+		}
+		if err != nil {
+			p.stop()
+			return errors.Wrapf(err, "Unable to start plugin %s", cfg.Command)
+		}
+
+		externalPlugins[cfg.key()] = p
+		registerAuthenticator(&externalAuthenticator{plugin: p, info: info})
+		log.WithFields(log.Fields{"plugin": cfg.Command, "authenticator": info.ID}).Info("Started external plugin")
+	}
+
+	return nil
+}
+
+// stopExternalPlugins stops the processes of all external plugins
+func stopExternalPlugins() {
+	externalPluginsLock.Lock()
+	defer externalPluginsLock.Unlock()
+
+	for _, p := range externalPlugins {
+		p.stop()
+	}
+}
+
+// externalPluginStatusError is a gRPC status returned by the plugin
+type externalPluginStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e externalPluginStatusError) Error() string {
+	return fmt.Sprintf("Plugin returned status %d: %s", e.Code, e.Message)
+}
+
+// externalPlugin manages the process of an external plugin. Crashed
+// processes are started again on the next call.
+type externalPlugin struct {
+	cfg externalPluginConfig
+
+	lock      sync.Mutex
+	process   *externalPluginProcess
+	lastStart time.Time
+}
+
+// running returns the running process or starts a new one
+func (p *externalPlugin) running() (*externalPluginProcess, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.process != nil {
+		select {
+		case <-p.process.exited:
+			p.process = nil
+		default:
+			return p.process, nil
+		}
+	}
+
+	// Do not restart plugins crashing on every call in a tight loop
+	if wait := externalPluginRestartDelay - time.Since(p.lastStart); wait > 0 {
+		return nil, errors.Errorf("Plugin exited, restarting in %s", wait.Round(time.Second))
+	}
+	p.lastStart = time.Now()
+
+	proc, err := startExternalPluginProcess(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.process = proc
+
+	return proc, nil
+}
+
+func (p *externalPlugin) call(ctx context.Context, method string, msg []byte) ([]byte, error) {
+	proc, err := p.running()
+	if err != nil {
+		return nil, err
+	}
+	return proc.call(ctx, "/"+plugins.ServiceName+"/"+method, msg)
+}
+
+func (p *externalPlugin) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.process != nil {
+		p.process.stop()
+		p.process = nil
+	}
+}
+
+type externalPluginInfo struct {
+	ID          string
+	SupportsMFA bool
+	LoginFields []loginField
+}
+
+func (p *externalPlugin) getInfo() (externalPluginInfo, error) {
+	info := externalPluginInfo{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalPluginCallTimeout)
+	defer cancel()
+
+	resp, err := p.call(ctx, "GetInfo", nil)
+	if err != nil {
+		return info, err
+	}
+
+	fields, err := parseProtoMessage(resp)
+	if err != nil {
+		return info, errors.Wrap(err, "Invalid GetInfoResponse")
+	}
+
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			info.ID = string(f.Bytes)
+		case 2:
+			info.SupportsMFA = f.Varint != 0
+		case 3:
+			field := loginField{}
+			sub, err := parseProtoMessage(f.Bytes)
+			if err != nil {
+				return info, errors.Wrap(err, "Invalid LoginField")
+			}
+			for _, s := range sub {
+				switch s.Number {
+				case 1:
+					field.Label = string(s.Bytes)
+				case 2:
+					field.Name = string(s.Bytes)
+				case 3:
+					field.Placeholder = string(s.Bytes)
+				case 4:
+					field.Type = string(s.Bytes)
+				}
+			}
+			info.LoginFields = append(info.LoginFields, field)
+		}
+	}
+
+	if info.ID == "" {
+		return info, errors.New("Plugin did not return an authenticator ID")
+	}
+
+	return info, nil
+}
+
+// externalPluginProcess is a started plugin process and the client to
+// talk to it
+type externalPluginProcess struct {
+	cmd      *exec.Cmd
+	client   *http.Client
+	exited   chan struct{}
+	stopping int32
+}
+
+// startExternalPluginProcess starts the plugin using the handshake of
+// github.com/hashicorp/go-plugin with automatic mutual TLS: The client
+// certificate is passed in the environment and the plugin announces its
+// address and server certificate on the first line of its output.
+func startExternalPluginProcess(cfg externalPluginConfig) (*externalPluginProcess, error) {
+	clientCert, clientCertPEM, err := generateExternalPluginCert()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to generate client certificate")
+	}
+
+	logger := log.WithField("plugin", cfg.Command)
+	stdout, stdoutWriter := io.Pipe()
+
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = append(os.Environ(),
+		plugins.MagicCookieKey+"="+plugins.MagicCookieValue,
+		"PLUGIN_PROTOCOL_VERSIONS="+strconv.Itoa(plugins.ProtocolVersion),
+		"PLUGIN_MIN_PORT=10000",
+		"PLUGIN_MAX_PORT=25000",
+		"PLUGIN_CLIENT_CERT="+string(clientCertPEM),
+	)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = externalPluginLogWriter{logger}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "Unable to start plugin")
+	}
+
+	proc := &externalPluginProcess{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		stdoutWriter.Close()
+		if atomic.LoadInt32(&proc.stopping) == 0 {
+			logger.WithError(err).Error("External plugin exited")
+		}
+		close(proc.exited)
+	}()
+
+	handshake := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for first := true; scanner.Scan(); first = false {
+			if first {
+				handshake <- scanner.Text()
+				continue
+			}
+			logger.Info(scanner.Text())
+		}
+	}()
+
+	var line string
+	select {
+	case line = <-handshake:
+	case <-proc.exited:
+		return nil, errors.New("Plugin exited before the handshake")
+	case <-time.After(externalPluginStartTimeout):
+		proc.kill()
+		return nil, errors.New("Plugin did not complete the handshake in time")
+	}
+
+	if proc.client, err = newExternalPluginClient(line, clientCert); err != nil {
+		proc.kill()
+		return nil, err
+	}
+
+	return proc, nil
+}
+
+// newExternalPluginClient parses the handshake line
+// CORE-PROTOCOL|APP-PROTOCOL|NETWORK|ADDRESS|PROTOCOL|SERVER-CERT and
+// creates a client for the announced address
+func newExternalPluginClient(line string, clientCert tls.Certificate) (*http.Client, error) {
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	switch {
+	case len(parts) < 4:
+		return nil, errors.Errorf("Invalid handshake %q", line)
+	case parts[0] != externalPluginCoreProtocol:
+		return nil, errors.Errorf("Unsupported core protocol version %s", parts[0])
+	case parts[1] != strconv.Itoa(plugins.ProtocolVersion):
+		return nil, errors.Errorf("Unsupported protocol version %s, nginx-sso supports %d", parts[1], plugins.ProtocolVersion)
+	case len(parts) < 5 || parts[4] != "grpc":
+		return nil, errors.New("Plugin needs to use the gRPC protocol")
+	case len(parts) < 6 || parts[5] == "":
+		return nil, errors.New("Plugin needs to support automatic mutual TLS")
+	}
+
+	network, addr := parts[2], parts[3]
+	if network != "unix" && network != "tcp" {
+		return nil, errors.Errorf("Unsupported network %s", network)
+	}
+
+	der, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to decode server certificate")
+	}
+	serverCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse server certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCert)
+
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2: true,
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			MinVersion:   tls.VersionTLS12,
+			RootCAs:      pool,
+			ServerName:   "localhost",
+		},
+	}}, nil
+}
+
+// call executes an unary gRPC call
+func (p *externalPluginProcess) call(ctx context.Context, path string, msg []byte) ([]byte, error) {
+	body := new(bytes.Buffer)
+	if err := writeGRPCMessage(body, msg); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://localhost"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to call plugin")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		return nil, errors.Errorf("Unexpected response %s using %s", res.Status, res.Proto)
+	}
+
+	resp, readErr := readGRPCMessage(res.Body)
+	// Trailers are available after the body was read completely
+	io.Copy(ioutil.Discard, res.Body)
+
+	status, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Errors may be sent as headers without a body
+		status, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	if code, err := strconv.Atoi(status); err != nil {
+		return nil, errors.Errorf("Invalid gRPC status %q", status)
+	} else if code != grpcStatusOK {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return nil, externalPluginStatusError{code, message}
+	}
+
+	return resp, readErr
+}
+
+// stop asks the plugin to shut down and kills it if it does not exit in
+// time or does not implement the controller service of go-plugin
+func (p *externalPluginProcess) stop() {
+	atomic.StoreInt32(&p.stopping, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalPluginStopTimeout)
+	defer cancel()
+
+	if _, err := p.call(ctx, externalPluginControllerPath, nil); err != nil {
+		p.kill()
+		return
+	}
+
+	select {
+	case <-p.exited:
+	case <-time.After(externalPluginStopTimeout):
+		p.kill()
+	}
+}
+
+func (p *externalPluginProcess) kill() {
+	atomic.StoreInt32(&p.stopping, 1)
+	p.cmd.Process.Kill()
+	<-p.exited
+	if p.client != nil {
+		p.client.CloseIdleConnections()
+	}
+}
+
+// generateExternalPluginCert creates the self-signed certificate used as
+// client certificate and passed to the plugin as trusted CA
+func generateExternalPluginCert() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost", Organization: []string{"nginx-sso"}},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// externalPluginLogWriter logs the output of the plugin line by line
+type externalPluginLogWriter struct {
+	logger *log.Entry
+}
+
+func (w externalPluginLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Info(line)
+	}
+	return len(p), nil
+}
+
+// externalAuthenticator adapts an authenticator of an external plugin to
+// the interface of the built-in authenticators. The instance is derived
+// from the configuration to let the plugin keep the configurations of
+// all active realms apart.
+type externalAuthenticator struct {
+	plugin *externalPlugin
+	info   externalPluginInfo
+
+	instance   string
+	yamlSource []byte
+}
+
+func (e *externalAuthenticator) NewInstance() interface{} {
+	return &externalAuthenticator{plugin: e.plugin, info: e.info}
+}
+
+func (e *externalAuthenticator) AuthenticatorID() string { return e.info.ID }
+
+func (e *externalAuthenticator) Configure(yamlSource []byte) error {
+	sum := sha256.Sum256(yamlSource)
+	e.instance, e.yamlSource = hex.EncodeToString(sum[:]), yamlSource
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalPluginCallTimeout)
+	defer cancel()
+
+	return e.configure(ctx)
+}
+
+func (e *externalAuthenticator) configure(ctx context.Context) error {
+	resp, err := e.plugin.call(ctx, "Configure", protoMessage{}.String(1, e.instance).Bytes(2, e.yamlSource))
+	if err != nil {
+		return err
+	}
+
+	fields, err := parseProtoMessage(resp)
+	if err != nil {
+		return errors.Wrap(err, "Invalid ConfigureResponse")
+	}
+	for _, f := range fields {
+		if f.Number == 1 && f.Varint != 0 {
+			return errProviderUnconfigured
+		}
+	}
+
+	return nil
+}
+
+// call executes the method for the request and configures the instance
+// again if the plugin lost it, for example after a restart
+func (e *externalAuthenticator) call(ctx context.Context, r *http.Request, method string) ([]protoField, error) {
+	ctx, cancel := context.WithTimeout(ctx, externalPluginCallTimeout)
+	defer cancel()
+
+	req := e.encodeRequest(r)
+	resp, err := e.plugin.call(ctx, method, req)
+	if s, ok := err.(externalPluginStatusError); ok && s.Code == grpcStatusFailedPrecondition {
+		if err = e.configure(ctx); err == nil {
+			resp, err = e.plugin.call(ctx, method, req)
+		}
+	}
+
+	switch s, ok := err.(externalPluginStatusError); {
+	case err == nil:
+		return parseProtoMessage(resp)
+
+	case ok && s.Code == grpcStatusUnauthenticated:
+		return nil, errNoUser
+
+	case ok && s.Code == grpcStatusUnavailable:
+		return nil, backendUnavailable(err)
+
+	case ok:
+		return nil, err
+
+	default:
+		// An unavailable plugin must not prevent the other authenticators
+		// from detecting the user
+		requestLog(r).WithError(err).WithField("authenticator", e.info.ID).Error("External plugin unavailable")
+		return nil, errNoUser
+	}
+}
+
+func (e *externalAuthenticator) encodeRequest(r *http.Request) []byte {
+	header := func(name, value string) []byte {
+		return protoMessage{}.String(1, name).String(2, value)
+	}
+
+	msg := protoMessage{}.
+		String(1, e.instance).
+		String(2, r.Method).
+		String(3, r.URL.RequestURI()).
+		String(4, r.Host).
+		String(5, getMainConfig().trustedClientIP(r))
+
+	for name, values := range r.Header {
+		for _, v := range values {
+			msg = msg.Bytes(6, header(name, v))
+		}
+	}
+
+	r.ParseForm()
+	for name, values := range r.Form {
+		for _, v := range values {
+			msg = msg.Bytes(7, header(name, v))
+		}
+	}
+
+	return msg
+}
+
+// setHeader adds the Header message to the response
+func (e *externalAuthenticator) setHeader(res http.ResponseWriter, buf []byte) error {
+	fields, err := parseProtoMessage(buf)
+	if err != nil {
+		return errors.Wrap(err, "Invalid Header")
+	}
+
+	var name, value string
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			name = string(f.Bytes)
+		case 2:
+			value = string(f.Bytes)
+		}
+	}
+
+	if name != "" {
+		res.Header().Add(name, value)
+	}
+	return nil
+}
+
+// userResponse decodes the UserResponse and sets its headers
+func (e *externalAuthenticator) userResponse(res http.ResponseWriter, fields []protoField) (string, []string, []mfaConfig, error) {
+	var (
+		user    string
+		groups  []string
+		mfaCfgs []mfaConfig
+	)
+
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			user = string(f.Bytes)
+
+		case 2:
+			groups = append(groups, string(f.Bytes))
+
+		case 3:
+			cfg, err := parseExternalMFAConfig(f.Bytes)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			mfaCfgs = append(mfaCfgs, cfg)
+
+		case 4:
+			if err := e.setHeader(res, f.Bytes); err != nil {
+				return "", nil, nil, err
+			}
+		}
+	}
+
+	if user == "" {
+		return "", nil, nil, errNoUser
+	}
+
+	return user, groups, mfaCfgs, nil
+}
+
+func parseExternalMFAConfig(buf []byte) (mfaConfig, error) {
+	cfg := mfaConfig{Attributes: map[string]interface{}{}}
+
+	fields, err := parseProtoMessage(buf)
+	if err != nil {
+		return cfg, errors.Wrap(err, "Invalid MFAConfig")
+	}
+
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			cfg.Provider = string(f.Bytes)
+
+		case 2:
+			// Map entries are messages with the key as field 1 and the value
+			// as field 2
+			entry, err := parseProtoMessage(f.Bytes)
+			if err != nil {
+				return cfg, errors.Wrap(err, "Invalid attribute")
+			}
+			var key, value string
+			for _, e := range entry {
+				switch e.Number {
+				case 1:
+					key = string(e.Bytes)
+				case 2:
+					value = string(e.Bytes)
+				}
+			}
+			cfg.Attributes[key] = value
+		}
+	}
+
+	return cfg, nil
+}
+
+func (e *externalAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	fields, err := e.call(ctx, r, "DetectUser")
+	if err != nil {
+		return "", nil, err
+	}
+
+	user, groups, _, err := e.userResponse(res, fields)
+	return user, groups, err
+}
+
+func (e *externalAuthenticator) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+	fields, err := e.call(ctx, r, "Login")
+	if err != nil {
+		return "", nil, err
+	}
+
+	user, _, mfaCfgs, err := e.userResponse(res, fields)
+	return user, mfaCfgs, err
+}
+
+func (e *externalAuthenticator) LoginFields() []loginField { return e.info.LoginFields }
+
+func (e *externalAuthenticator) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	fields, err := e.call(ctx, r, "Logout")
+	if err != nil {
+		if errors.Is(err, errNoUser) {
+			// Nothing to log out from
+			return nil
+		}
+		return err
+	}
+
+	for _, f := range fields {
+		if f.Number == 1 {
+			if err := e.setHeader(res, f.Bytes); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *externalAuthenticator) SupportsMFA() bool { return e.info.SupportsMFA }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+// TestExternalPluginHelper is started as plugin process by
+// TestExternalPlugin and serves an authenticator for the user alice
+func TestExternalPluginHelper(t *testing.T) {
+	if os.Getenv(plugins.MagicCookieKey) != plugins.MagicCookieValue {
+		t.Skip("Only used as plugin process")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(os.Getenv("PLUGIN_CLIENT_CERT")))
+	cert, _, err := generateExternalPluginCert()
+	if err != nil {
+		t.Fatalf("Unable to generate certificate: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "nginx-sso-plugin")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "plugin.sock"))
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	instances := map[string]bool{}
+	srv := &http.Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool},
+		Handler: http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+			res.Header().Set("Content-Type", "application/grpc")
+			res.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+			msg, _ := readGRPCMessage(r.Body)
+			req := map[int][]string{}
+			fields, _ := parseProtoMessage(msg)
+			for _, f := range fields {
+				if sub, err := parseProtoMessage(f.Bytes); err == nil && (f.Number == 6 || f.Number == 7) {
+					req[f.Number] = append(req[f.Number], string(sub[0].Bytes)+"="+string(sub[1].Bytes))
+					continue
+				}
+				req[f.Number] = append(req[f.Number], string(f.Bytes))
+			}
+			has := func(number int, v string) bool {
+				for _, s := range req[number] {
+					if s == v {
+						return true
+					}
+				}
+				return false
+			}
+
+			code, resp := grpcStatusOK, protoMessage{}
+			switch strings.TrimPrefix(r.URL.Path, "/"+plugins.ServiceName+"/") {
+			case "GetInfo":
+				resp = resp.String(1, "external").Bytes(3, protoMessage{}.String(2, "password").String(4, "password"))
+
+			case "Configure":
+				if strings.Contains(req[2][0], "external:") {
+					instances[req[1][0]] = true
+				} else {
+					resp = resp.Varint(1, 1)
+				}
+
+			case "DetectUser", "Login", "Logout":
+				switch {
+				case !instances[req[1][0]]:
+					code = grpcStatusFailedPrecondition
+				case has(7, "password=crash"):
+					os.Exit(1)
+				case has(6, "X-User=alice"), has(7, "password=secret"):
+					resp = resp.String(1, "alice").String(2, "admins").
+						Bytes(4, protoMessage{}.String(1, "Set-Cookie").String(2, "plugin=alice"))
+				default:
+					code = grpcStatusUnauthenticated
+				}
+
+			case "/plugin.GRPCController/Shutdown":
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					os.Exit(0)
+				}()
+
+			default:
+				code = grpcStatusUnimplemented
+			}
+
+			writeGRPCMessage(res, resp)
+			res.Header().Set("Grpc-Status", strconv.Itoa(code))
+		}),
+	}
+
+	fmt.Printf("1|%d|unix|%s|grpc|%s\n", plugins.ProtocolVersion, l.Addr(), base64.RawStdEncoding.EncodeToString(cert.Certificate[0]))
+	srv.ServeTLS(l, "", "")
+}
+
+func TestExternalPlugin(t *testing.T) {
+	prevAuthenticators := authenticatorRegistry
+	authenticatorRegistry = auth.NewRegistry(prevAuthenticators.Authenticators()...)
+	defer func() {
+		stopExternalPlugins()
+		externalPlugins = map[string]*externalPlugin{}
+		authenticatorRegistry = prevAuthenticators
+	}()
+
+	cfg := externalPluginConfig{Command: os.Args[0], Args: []string{"-test.run=^TestExternalPluginHelper$"}}
+	if err := loadExternalPlugins([]externalPluginConfig{cfg}); err != nil {
+		t.Fatalf("Unable to load external plugin: %s", err)
+	}
+	p := externalPlugins[cfg.key()]
+
+	authenticators, err := configureAuthenticators([]byte("providers:\n  external: {}\n"))
+	if err != nil {
+		t.Fatalf("Unable to configure authenticators: %s", err)
+	}
+	if len(authenticators) != 1 || authenticators[0].AuthenticatorID() != "external" {
+		t.Fatalf("Expected only the external authenticator to be configured, got %v", authenticators)
+	}
+	a := authenticators[0]
+
+	if f := a.LoginFields(); len(f) != 1 || f[0].Name != "password" {
+		t.Errorf("Expected login fields of the plugin, got %v", f)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-User", "alice")
+	if user, groups, err := a.DetectUser(context.Background(), httptest.NewRecorder(), r); err != nil || user != "alice" || len(groups) != 1 {
+		t.Errorf("Expected user to be detected, got %q %v %v", user, groups, err)
+	}
+	if _, _, err := a.DetectUser(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/auth", nil)); err != errNoUser {
+		t.Errorf("Expected no user to be detected, got %v", err)
+	}
+
+	login := func(password string) (*httptest.ResponseRecorder, string, error) {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"password": {password}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		user, _, err := a.Login(context.Background(), res, r)
+		return res, user, err
+	}
+
+	// A crashing plugin fails the login but is started again
+	if _, _, err := login("crash"); err != errNoUser {
+		t.Errorf("Expected login to fail while the plugin crashed, got %v", err)
+	}
+	select {
+	case <-p.process.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected plugin process to exit")
+	}
+	if _, _, err := login("secret"); err != errNoUser {
+		t.Errorf("Expected plugin not to be restarted immediately, got %v", err)
+	}
+
+	p.lastStart = time.Time{}
+	res, user, err := login("secret")
+	if err != nil || user != "alice" || res.Header().Get("Set-Cookie") != "plugin=alice" {
+		t.Errorf("Expected login after restart of the plugin, got %q %v", user, err)
+	}
+
+	proc := p.process
+	stopExternalPlugins()
+	select {
+	case <-proc.exited:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected plugin process to be stopped")
+	}
+}
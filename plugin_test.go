@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/Luzifer/nginx-sso/plugins"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type testPluginAuthenticator struct {
+	User string
+}
+
+func (t *testPluginAuthenticator) AuthenticatorID() string { return "test_plugin" }
+
+func (t *testPluginAuthenticator) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			TestPlugin *testPluginAuthenticator `yaml:"test_plugin"`
+		} `yaml:"providers"`
+	}{}
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+	if envelope.Providers.TestPlugin == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+	t.User = envelope.Providers.TestPlugin.User
+	return nil
+}
+
+func (t *testPluginAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	return "", nil, plugins.ErrNoValidUserFound
+}
+
+func (t *testPluginAuthenticator) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	return t.User, []plugins.MFAConfig{{Provider: "test_plugin", Attributes: map[string]interface{}{"secret": "s"}}}, nil
+}
+
+func (t *testPluginAuthenticator) LoginFields() []plugins.LoginField {
+	return []plugins.LoginField{{Label: "Code", Name: "code", Type: "text"}}
+}
+
+func (t *testPluginAuthenticator) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (t *testPluginAuthenticator) SupportsMFA() bool { return true }
+
+type testPluginMFAProvider struct{}
+
+func (t testPluginMFAProvider) ProviderID() string { return "test_plugin" }
+
+func (t testPluginMFAProvider) Configure(yamlSource []byte) error { return nil }
+
+func (t testPluginMFAProvider) ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []plugins.MFAConfig) error {
+	return nil
+}
+
+func TestPluginProviders(t *testing.T) {
+	prevAuthenticators := authenticatorRegistry
+	authenticatorRegistry = auth.NewRegistry(prevAuthenticators.Authenticators()...)
+	mfaRegistryMutex.RLock()
+	prevMFAProviders := mfaRegistry
+	mfaRegistryMutex.RUnlock()
+	defer func() {
+		authenticatorRegistry = prevAuthenticators
+		mfaRegistryMutex.Lock()
+		mfaRegistry = prevMFAProviders
+		mfaRegistryMutex.Unlock()
+	}()
+
+	if err := registerPlugin(func(a plugins.RegisterAuthenticatorFunc, m plugins.RegisterMFAProviderFunc) error {
+		m(testPluginMFAProvider{})
+		return nil
+	}); err == nil {
+		t.Error("Expected provider which is no pointer to be rejected")
+	}
+
+	register := func(a plugins.RegisterAuthenticatorFunc, m plugins.RegisterMFAProviderFunc) error {
+		a(&testPluginAuthenticator{})
+		m(&testPluginMFAProvider{})
+		return nil
+	}
+	if err := registerPlugin(register); err != nil {
+		t.Fatalf("Unable to register plugin: %s", err)
+	}
+	if err := registerPlugin(register); err == nil {
+		t.Error("Expected providers with registered IDs to be rejected")
+	}
+
+	authenticators, err := configureAuthenticators([]byte("providers:\n  test_plugin:\n    user: jane\n"))
+	if err != nil {
+		t.Fatalf("Unable to configure authenticators: %s", err)
+	}
+	if len(authenticators) != 1 || authenticators[0].AuthenticatorID() != "test_plugin" {
+		t.Fatalf("Expected only the plugin authenticator to be configured, got %v", authenticators)
+	}
+
+	user, mfaCfgs, err := authenticators[0].Login(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/login", nil))
+	if err != nil || user != "jane" || len(mfaCfgs) != 1 || mfaCfgs[0].AttributeString("secret") != "s" {
+		t.Errorf("Expected login through the plugin, got %q %v %v", user, mfaCfgs, err)
+	}
+	if f := authenticators[0].LoginFields(); len(f) != 1 || f[0].Name != "code" {
+		t.Errorf("Expected login fields of the plugin, got %v", f)
+	}
+	if _, _, err := authenticators[0].DetectUser(context.Background(), nil, nil); err != errNoUser {
+		t.Errorf("Expected the shared error, got %v", err)
+	}
+
+	// The prototype stays unconfigured, every load uses a new instance
+	registered := authenticatorRegistry.Authenticators()
+	if p := registered[len(registered)-1].(*pluginAuthenticator); p.Authenticator.(*testPluginAuthenticator).User != "" {
+		t.Error("Expected the registered prototype not to be configured")
+	}
+
+	mfaProviders, err := configureMFAProviders(nil)
+	if err != nil {
+		t.Fatalf("Unable to configure MFA providers: %s", err)
+	}
+	found := false
+	for _, m := range mfaProviders {
+		if m.ProviderID() == "test_plugin" {
+			found = m.ValidateMFA(context.Background(), nil, nil, "jane", mfaCfgs) == nil
+		}
+	}
+	if !found {
+		t.Error("Expected MFA provider of the plugin to validate the token")
+	}
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	wasmPluginCallTimeout = 30 * time.Second
+	// wasmPluginMemoryLimitPages limits the memory of every instance to
+	// 64 MiB (pages of 64 KiB)
+	wasmPluginMemoryLimitPages = 1024
+	wasmPluginMaxIdleInstances = 4
+)
+
+var (
+	// wasmPlugins contains the compiled modules by their path, they are
+	// compiled and registered only once
+	wasmPlugins     = map[string]*wasmPlugin{}
+	wasmPluginsLock sync.Mutex
+	// wasmRuntime is shared by all modules and created with the first one
+	wasmRuntime wazero.Runtime
+
+	wasmPluginExports = []string{
+		"nginx_sso_abi_version",
+		"nginx_sso_malloc",
+		"nginx_sso_info",
+		"nginx_sso_configure",
+		"nginx_sso_detect_user",
+		"nginx_sso_login",
+		"nginx_sso_logout",
+	}
+)
+
+// wasmPluginConfig points to an authenticator compiled to WebAssembly
+type wasmPluginConfig struct {
+	Path string `yaml:"path"`
+}
+
+// loadWASMPlugins compiles all modules which were not loaded before and
+// registers their authenticators. Modules removed from the configuration
+// stay registered until nginx-sso is restarted.
+func loadWASMPlugins(cfgs []wasmPluginConfig) error {
+	wasmPluginsLock.Lock()
+	defer wasmPluginsLock.Unlock()
+
+	for _, cfg := range cfgs {
+		if _, ok := wasmPlugins[cfg.Path]; ok {
+			continue
+		}
+
+		p, err := loadWASMPlugin(cfg)
+		if err == nil && authenticatorRegistry.Registered(p.info.ID) {
+			p.module.Close(context.Background())
+			err = errors.Errorf("Authenticator %q is already registered", p.info.ID)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Unable to load plugin %s", cfg.Path)
+		}
+
+		wasmPlugins[cfg.Path] = p
+		registerAuthenticator(&wasmAuthenticator{plugin: p})
+		log.WithFields(log.Fields{"plugin": cfg.Path, "authenticator": p.info.ID}).Info("Loaded WASM plugin")
+	}
+
+	return nil
+}
+
+// newWASMRuntime creates the runtime providing WASI without file system
+// access and the functions of the host module. Calls are aborted when
+// their context is done.
+func newWASMRuntime(ctx context.Context) (wazero.Runtime, error) {
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmPluginMemoryLimitPages))
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, errors.Wrap(err, "Unable to instantiate WASI")
+	}
+
+	i32 := api.ValueTypeI32
+	host := rt.NewHostModuleBuilder(plugins.WASMHostModule)
+	for _, fn := range []struct {
+		name    string
+		fn      func(context.Context, api.Module, []uint64)
+		params  []api.ValueType
+		results []api.ValueType
+	}{
+		{"request_info", wasmRequestInfo, []api.ValueType{i32, i32, i32}, []api.ValueType{i32}},
+		{"request_header", wasmRequestValue(wasmRequestHeader), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}},
+		{"request_cookie", wasmRequestValue(wasmRequestCookie), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}},
+		{"request_form_value", wasmRequestValue(wasmRequestFormValue), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}},
+		{"add_response_header", wasmAddResponseHeader, []api.ValueType{i32, i32, i32, i32}, nil},
+		{"set_info", wasmStringSetter(func(c *wasmCall, v string) { c.info = v }), []api.ValueType{i32, i32}, nil},
+		{"set_user", wasmStringSetter(func(c *wasmCall, v string) { c.user = v }), []api.ValueType{i32, i32}, nil},
+		{"add_group", wasmStringSetter(func(c *wasmCall, v string) { c.groups = append(c.groups, v) }), []api.ValueType{i32, i32}, nil},
+		{"add_mfa_config", wasmStringSetter((*wasmCall).addMFAConfig), []api.ValueType{i32, i32}, nil},
+		{"set_message", wasmStringSetter(func(c *wasmCall, v string) { c.message = v }), []api.ValueType{i32, i32}, nil},
+		{"log", wasmLog, []api.ValueType{i32, i32, i32}, nil},
+	} {
+		host = host.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(fn.fn), fn.params, fn.results).
+			Export(fn.name)
+	}
+	if _, err := host.Instantiate(ctx); err != nil {
+		rt.Close(ctx)
+		return nil, errors.Wrap(err, "Unable to instantiate host module")
+	}
+
+	return rt, nil
+}
+
+type wasmPluginInfo struct {
+	ID          string       `json:"id"`
+	SupportsMFA bool         `json:"supports_mfa"`
+	LoginFields []loginField `json:"login_fields"`
+}
+
+// wasmPlugin is a compiled module, instances of it are created by the
+// authenticators
+type wasmPlugin struct {
+	cfg    wasmPluginConfig
+	module wazero.CompiledModule
+	info   wasmPluginInfo
+}
+
+func loadWASMPlugin(cfg wasmPluginConfig) (*wasmPlugin, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wasmPluginCallTimeout)
+	defer cancel()
+
+	if wasmRuntime == nil {
+		rt, err := newWASMRuntime(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		wasmRuntime = rt
+	}
+
+	bin, err := ioutil.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read module")
+	}
+
+	module, err := wasmRuntime.CompileModule(ctx, bin)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to compile module")
+	}
+
+	p := &wasmPlugin{cfg: cfg, module: module}
+	if err := p.loadInfo(ctx); err != nil {
+		module.Close(context.Background())
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// loadInfo checks the module implements the ABI and reads the
+// description of its authenticator
+func (p *wasmPlugin) loadInfo(ctx context.Context) error {
+	if _, ok := p.module.ExportedMemories()["memory"]; !ok {
+		return errors.New("Module does not export its memory")
+	}
+	exports := p.module.ExportedFunctions()
+	for _, name := range wasmPluginExports {
+		if _, ok := exports[name]; !ok {
+			return errors.Errorf("Module does not export %s", name)
+		}
+	}
+
+	mod, err := p.instantiate(ctx)
+	if err != nil {
+		return err
+	}
+	defer mod.Close(context.Background())
+
+	call := &wasmCall{logger: log.WithField("plugin", p.cfg.Path)}
+	if version, err := p.call(ctx, mod, "nginx_sso_abi_version", call); err != nil {
+		return err
+	} else if version != plugins.WASMABIVersion {
+		return errors.Errorf("Unsupported ABI version %d, nginx-sso supports %d", version, plugins.WASMABIVersion)
+	}
+
+	if status, err := p.call(ctx, mod, "nginx_sso_info", call); err != nil {
+		return err
+	} else if status != plugins.WASMStatusOK {
+		return wasmStatusError(status, call)
+	}
+
+	if err := json.Unmarshal([]byte(call.info), &p.info); err != nil {
+		return errors.Wrap(err, "Invalid info")
+	}
+	if p.info.ID == "" {
+		return errors.New("Module did not return an authenticator ID")
+	}
+
+	return nil
+}
+
+// instantiate creates a new instance of the module without file system
+// access, its output is logged
+func (p *wasmPlugin) instantiate(ctx context.Context) (api.Module, error) {
+	logger := externalPluginLogWriter{log.WithField("plugin", p.cfg.Path)}
+
+	mod, err := wasmRuntime.InstantiateModule(ctx, p.module, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStdout(logger).
+		WithStderr(logger).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader))
+	return mod, errors.Wrap(err, "Unable to instantiate module")
+}
+
+// call executes the exported function with the state of the call
+// available to the host functions
+func (p *wasmPlugin) call(ctx context.Context, mod api.Module, name string, call *wasmCall, params ...uint64) (uint32, error) {
+	res, err := mod.ExportedFunction(name).Call(context.WithValue(ctx, wasmCallKey{}, call), params...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Call of %s failed", name)
+	}
+	if len(res) != 1 {
+		return 0, errors.Errorf("Function %s needs to return one value", name)
+	}
+	return api.DecodeU32(res[0]), nil
+}
+
+// write copies the data into a buffer allocated by the module
+func (p *wasmPlugin) write(ctx context.Context, mod api.Module, data []byte) (uint32, error) {
+	ptr, err := p.call(ctx, mod, "nginx_sso_malloc", &wasmCall{}, api.EncodeU32(uint32(len(data))))
+	if err != nil {
+		return 0, err
+	}
+	if !mod.Memory().Write(ptr, data) {
+		return 0, errors.New("Module returned buffer out of range")
+	}
+	return ptr, nil
+}
+
+// wasmStatusError converts the status returned by the module into the
+// errors of the providers, the message is attached to them
+func wasmStatusError(status uint32, call *wasmCall) error {
+	kind := func(err error) error {
+		if call.message == "" {
+			return err
+		}
+		return &plugins.AuthError{Kind: err, Message: call.message}
+	}
+
+	switch status {
+	case plugins.WASMStatusOK:
+		return nil
+	case plugins.WASMStatusNoUser:
+		return errNoUser
+	case plugins.WASMStatusWrongCredentials:
+		return kind(errWrongCredentials)
+	case plugins.WASMStatusMFARequired:
+		return kind(errMFARequired)
+	case plugins.WASMStatusUnavailable:
+		return kind(errBackendUnavailable)
+	case plugins.WASMStatusUnconfigured:
+		return errProviderUnconfigured
+	case plugins.WASMStatusError:
+		return errors.Errorf("Module returned an error: %s", call.message)
+	default:
+		return errors.Errorf("Module returned unknown status %d", status)
+	}
+}
+
+// wasmCallKey is the context key of the wasmCall
+type wasmCallKey struct{}
+
+// wasmCall is the state of a call of the module: The request it may read
+// and the results it reported through the host functions
+type wasmCall struct {
+	res    http.ResponseWriter
+	r      *http.Request
+	logger *log.Entry
+
+	info    string
+	user    string
+	groups  []string
+	mfaCfgs []mfaConfig
+	message string
+	// err is set if the module passed invalid values
+	err error
+}
+
+func wasmCallFromContext(ctx context.Context) *wasmCall {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	return call
+}
+
+func (c *wasmCall) addMFAConfig(v string) {
+	cfg := mfaConfig{}
+	if err := json.Unmarshal([]byte(v), &cfg); err != nil {
+		c.err = errors.Wrap(err, "Invalid MFA config")
+		return
+	}
+	c.mfaCfgs = append(c.mfaCfgs, cfg)
+}
+
+// wasmString reads the string at ptr with the length from the memory of
+// the module
+func wasmString(mod api.Module, ptr, length uint64) (string, bool) {
+	buf, ok := mod.Memory().Read(api.DecodeU32(ptr), api.DecodeU32(length))
+	return string(buf), ok
+}
+
+// wasmReturnValue copies the value into the buffer of the module and
+// returns its length, or -1 if the value is not set
+func wasmReturnValue(mod api.Module, stack []uint64, value string, ok bool, buf, capacity uint64) {
+	if !ok {
+		stack[0] = api.EncodeI32(-1)
+		return
+	}
+	n := len(value)
+	if n > int(api.DecodeU32(capacity)) {
+		n = int(api.DecodeU32(capacity))
+	}
+	if !mod.Memory().Write(api.DecodeU32(buf), []byte(value[:n])) {
+		stack[0] = api.EncodeI32(-1)
+		return
+	}
+	stack[0] = api.EncodeI32(int32(len(value)))
+}
+
+func wasmRequestInfo(ctx context.Context, mod api.Module, stack []uint64) {
+	call := wasmCallFromContext(ctx)
+	if call == nil || call.r == nil {
+		stack[0] = api.EncodeI32(-1)
+		return
+	}
+
+	var value string
+	switch api.DecodeI32(stack[0]) {
+	case plugins.WASMRequestMethod:
+		value = call.r.Method
+	case plugins.WASMRequestURI:
+		value = call.r.URL.RequestURI()
+	case plugins.WASMRequestHost:
+		value = call.r.Host
+	case plugins.WASMRequestClientIP:
+		value = getMainConfig().trustedClientIP(call.r)
+	default:
+		stack[0] = api.EncodeI32(-1)
+		return
+	}
+	wasmReturnValue(mod, stack, value, true, stack[1], stack[2])
+}
+
+func wasmRequestHeader(r *http.Request, name string) (string, bool) {
+	values, ok := r.Header[http.CanonicalHeaderKey(name)]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func wasmRequestCookie(r *http.Request, name string) (string, bool) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	return c.Value, true
+}
+
+func wasmRequestFormValue(r *http.Request, name string) (string, bool) {
+	values, ok := r.Form[name]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// wasmRequestValue creates the host function looking up the named value
+// of the request
+func wasmRequestValue(lookup func(*http.Request, string) (string, bool)) func(context.Context, api.Module, []uint64) {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		call := wasmCallFromContext(ctx)
+		name, ok := wasmString(mod, stack[0], stack[1])
+		if call == nil || call.r == nil || !ok {
+			stack[0] = api.EncodeI32(-1)
+			return
+		}
+		value, ok := lookup(call.r, name)
+		wasmReturnValue(mod, stack, value, ok, stack[2], stack[3])
+	}
+}
+
+func wasmAddResponseHeader(ctx context.Context, mod api.Module, stack []uint64) {
+	call := wasmCallFromContext(ctx)
+	name, nameOK := wasmString(mod, stack[0], stack[1])
+	value, valueOK := wasmString(mod, stack[2], stack[3])
+	if call == nil || call.res == nil || !nameOK || !valueOK || name == "" {
+		return
+	}
+	call.res.Header().Add(name, value)
+}
+
+// wasmStringSetter creates the host function passing a string to the
+// state of the call
+func wasmStringSetter(set func(*wasmCall, string)) func(context.Context, api.Module, []uint64) {
+	return func(ctx context.Context, mod api.Module, stack []uint64) {
+		call := wasmCallFromContext(ctx)
+		if call == nil {
+			return
+		}
+		v, ok := wasmString(mod, stack[0], stack[1])
+		if !ok {
+			call.err = errors.New("Module passed string out of range")
+			return
+		}
+		set(call, v)
+	}
+}
+
+func wasmLog(ctx context.Context, mod api.Module, stack []uint64) {
+	call := wasmCallFromContext(ctx)
+	msg, ok := wasmString(mod, stack[1], stack[2])
+	if call == nil || call.logger == nil || !ok {
+		return
+	}
+
+	switch api.DecodeI32(stack[0]) {
+	case plugins.WASMLogDebug:
+		call.logger.Debug(msg)
+	case plugins.WASMLogWarn:
+		call.logger.Warn(msg)
+	case plugins.WASMLogError:
+		call.logger.Error(msg)
+	default:
+		call.logger.Info(msg)
+	}
+}
+
+// wasmAuthenticator adapts the authenticator of a module to the
+// interface of the built-in authenticators. Every instance of the
+// authenticator keeps a pool of configured instances of the module.
+type wasmAuthenticator struct {
+	plugin     *wasmPlugin
+	yamlSource []byte
+
+	idle     []api.Module
+	idleLock sync.Mutex
+}
+
+func (w *wasmAuthenticator) NewInstance() interface{} {
+	return &wasmAuthenticator{plugin: w.plugin}
+}
+
+func (w *wasmAuthenticator) AuthenticatorID() string { return w.plugin.info.ID }
+
+func (w *wasmAuthenticator) Configure(yamlSource []byte) error {
+	w.yamlSource = yamlSource
+
+	ctx, cancel := context.WithTimeout(context.Background(), wasmPluginCallTimeout)
+	defer cancel()
+
+	// Configure the first instance to know whether the module is
+	// configured at all
+	mod, err := w.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	w.release(mod)
+
+	// The instances are not needed anymore after the authenticator was
+	// replaced by a reload of the configuration
+	runtime.SetFinalizer(w, (*wasmAuthenticator).closeIdle)
+
+	return nil
+}
+
+// acquire takes an idle instance of the module or creates and configures
+// a new one
+func (w *wasmAuthenticator) acquire(ctx context.Context) (api.Module, error) {
+	w.idleLock.Lock()
+	if n := len(w.idle); n > 0 {
+		mod := w.idle[n-1]
+		w.idle = w.idle[:n-1]
+		w.idleLock.Unlock()
+		return mod, nil
+	}
+	w.idleLock.Unlock()
+
+	mod, err := w.plugin.instantiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	call := &wasmCall{logger: log.WithFields(log.Fields{"plugin": w.plugin.cfg.Path, "authenticator": w.plugin.info.ID})}
+	ptr, err := w.plugin.write(ctx, mod, w.yamlSource)
+	if err == nil {
+		var status uint32
+		if status, err = w.plugin.call(ctx, mod, "nginx_sso_configure", call, api.EncodeU32(ptr), api.EncodeU32(uint32(len(w.yamlSource)))); err == nil {
+			err = wasmStatusError(status, call)
+		}
+	}
+	if err != nil {
+		mod.Close(context.Background())
+		return nil, err
+	}
+
+	return mod, nil
+}
+
+func (w *wasmAuthenticator) release(mod api.Module) {
+	w.idleLock.Lock()
+	defer w.idleLock.Unlock()
+
+	if len(w.idle) >= wasmPluginMaxIdleInstances {
+		mod.Close(context.Background())
+		return
+	}
+	w.idle = append(w.idle, mod)
+}
+
+func (w *wasmAuthenticator) closeIdle() {
+	w.idleLock.Lock()
+	defer w.idleLock.Unlock()
+
+	for _, mod := range w.idle {
+		mod.Close(context.Background())
+	}
+	w.idle = nil
+}
+
+// run executes the function of the module for the request
+func (w *wasmAuthenticator) run(ctx context.Context, res http.ResponseWriter, r *http.Request, name string) (*wasmCall, error) {
+	mod, err := w.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ParseForm()
+	call := &wasmCall{res: res, r: r, logger: requestLog(r).WithField("authenticator", w.plugin.info.ID)}
+	status, err := w.plugin.call(ctx, mod, name, call)
+	if err != nil {
+		// Traps and calls aborted by the context leave the instance in
+		// an unknown state
+		mod.Close(context.Background())
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// A broken module must not prevent the other authenticators from
+		// detecting the user
+		call.logger.WithError(err).Error("WASM plugin failed")
+		return nil, errNoUser
+	}
+	w.release(mod)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call, wasmStatusError(status, call)
+}
+
+func (w *wasmAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	call, err := w.run(ctx, res, r, "nginx_sso_detect_user")
+	if err != nil {
+		return "", nil, err
+	}
+	if call.user == "" {
+		return "", nil, errNoUser
+	}
+	return call.user, call.groups, nil
+}
+
+func (w *wasmAuthenticator) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
+	call, err := w.run(ctx, res, r, "nginx_sso_login")
+	if err != nil {
+		return "", nil, err
+	}
+	if call.user == "" {
+		return "", nil, errNoUser
+	}
+	return call.user, call.mfaCfgs, nil
+}
+
+func (w *wasmAuthenticator) LoginFields() []loginField { return w.plugin.info.LoginFields }
+
+func (w *wasmAuthenticator) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	_, err := w.run(ctx, res, r, "nginx_sso_logout")
+	if errors.Is(err, errNoUser) {
+		// Nothing to log out from
+		return nil
+	}
+	return err
+}
+
+func (w *wasmAuthenticator) SupportsMFA() bool { return w.plugin.info.SupportsMFA }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/pkg/errors"
+)
+
+func TestWASMPlugin(t *testing.T) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("Go toolchain is required to build the module")
+	}
+
+	dir, err := ioutil.TempDir("", "nginx-sso-wasm")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := wasmPluginConfig{Path: filepath.Join(dir, "plugin.wasm")}
+	build := exec.Command(goBin, "build", "-buildmode=c-shared", "-o", cfg.Path, ".")
+	build.Dir = filepath.Join("testdata", "wasm_plugin")
+	build.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "GO111MODULE=off", "GOFLAGS=")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Unable to build module: %s\n%s", err, out)
+	}
+
+	prevAuthenticators := authenticatorRegistry
+	authenticatorRegistry = auth.NewRegistry(prevAuthenticators.Authenticators()...)
+	defer func() {
+		wasmPlugins = map[string]*wasmPlugin{}
+		authenticatorRegistry = prevAuthenticators
+	}()
+
+	if err := loadWASMPlugins([]wasmPluginConfig{cfg}); err != nil {
+		t.Fatalf("Unable to load WASM plugin: %s", err)
+	}
+
+	if _, err := configureAuthenticators([]byte("providers:\n  wasm: {}\n")); err == nil || !strings.Contains(err.Error(), "password is required") {
+		t.Errorf("Expected error of the module to be returned, got %v", err)
+	}
+	authenticators, err := configureAuthenticators([]byte("providers:\n  wasm:\n    password: secret\n"))
+	if err != nil {
+		t.Fatalf("Unable to configure authenticators: %s", err)
+	}
+	if len(authenticators) != 1 || authenticators[0].AuthenticatorID() != "wasm" {
+		t.Fatalf("Expected only the WASM authenticator to be configured, got %v", authenticators)
+	}
+	a := authenticators[0]
+
+	if f := a.LoginFields(); len(f) != 2 || f[1].Name != "password" {
+		t.Errorf("Expected login fields of the module, got %v", f)
+	}
+
+	login := func(password string) (*httptest.ResponseRecorder, string, error) {
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("wasm-username=alice&wasm-password="+password))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		user, _, err := a.Login(context.Background(), res, r)
+		return res, user, err
+	}
+
+	if _, _, err := login("wrong"); !errors.Is(err, errWrongCredentials) || plugins.ErrorMessage(err) != "error_invalid_credentials" {
+		t.Errorf("Expected wrong credentials with message, got %v", err)
+	}
+	if _, _, err := login("unavailable"); !errors.Is(err, errBackendUnavailable) {
+		t.Errorf("Expected unavailable backend, got %v", err)
+	}
+	res, user, err := login("secret")
+	if err != nil || user != "alice" {
+		t.Fatalf("Expected login of alice, got %q: %v", user, err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if user, groups, err := a.DetectUser(context.Background(), httptest.NewRecorder(), r); err != nil || user != "alice" || len(groups) != 1 {
+		t.Errorf("Expected user to be detected from the cookie, got %q %v %v", user, groups, err)
+	}
+	if _, _, err := a.DetectUser(context.Background(), httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/auth", nil)); err != errNoUser {
+		t.Errorf("Expected no user to be detected, got %v", err)
+	}
+
+	// Modules running too long are aborted with the context of the call
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r.Header.Set("X-Hang", "1")
+	start := time.Now()
+	if _, _, err := a.DetectUser(ctx, httptest.NewRecorder(), r); err == nil {
+		t.Error("Expected hanging call to fail")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Expected call to be aborted with the context, took %s", d)
+	}
+
+	res = httptest.NewRecorder()
+	if err := a.Logout(context.Background(), res, httptest.NewRequest(http.MethodGet, "/logout", nil)); err != nil || !strings.Contains(res.Header().Get("Set-Cookie"), "Max-Age=0") {
+		t.Errorf("Expected logout to remove the cookie, got %q: %v", res.Header().Get("Set-Cookie"), err)
+	}
+}
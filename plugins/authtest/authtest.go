@@ -0,0 +1,161 @@
+// Package authtest contains helpers to test authenticators implementing
+// the interfaces of the plugins package without running nginx or
+// nginx-sso: Requests as sent by the nginx auth_request module and the
+// login form, a cookie jar carrying the login cookie to the following
+// requests, configuration fixtures and a conformance suite checking the
+// behavior nginx-sso relies on:
+//
+//	func TestConformance(t *testing.T) {
+//		authtest.RunConformance(t, authtest.Conformance{
+//			New:    func() plugins.Authenticator { return &myAuthenticator{} },
+//			Config: authtest.ProviderConfig("my_authenticator", map[string]interface{}{"users": ...}),
+//			Login:  map[string]string{"username": "jane", "password": "secret"},
+//			User:   "jane",
+//		})
+//	}
+package authtest
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LoginHost is the host the login requests are sent to and the cookies
+// are stored for
+const LoginHost = "login.example.com"
+
+var updateGolden = flag.Bool("authtest.update", false, "Write the golden files instead of comparing against them")
+
+// NewAuthRequest returns a request for the /auth endpoint carrying the
+// headers the nginx configuration of the README passes for a request of
+// the client to the given host and URI
+func NewAuthRequest(host, uri string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://"+LoginHost+"/auth", nil)
+	r.Header.Set("X-Origin-URI", uri)
+	r.Header.Set("X-Origin-Method", http.MethodGet)
+	r.Header.Set("X-Host", host)
+	r.Header.Set("X-Real-IP", "192.0.2.1")
+	r.Header.Set("X-Forwarded-For", "192.0.2.1")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	return r
+}
+
+// NewLoginRequest returns the submission of the login form with the
+// values of the login fields of the authenticator. The names of the
+// fields are prefixed with the ID of the authenticator like in the form
+// rendered by nginx-sso.
+func NewLoginRequest(authenticatorID string, fields map[string]string) *http.Request {
+	form := url.Values{}
+	for name, value := range fields {
+		form.Set(authenticatorID+"-"+name, value)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "https://"+LoginHost+"/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Real-IP", "192.0.2.1")
+	r.ParseForm()
+	return r
+}
+
+// NewLogoutRequest returns a request for the logout endpoint
+func NewLogoutRequest() *http.Request {
+	return httptest.NewRequest(http.MethodGet, "https://"+LoginHost+"/logout", nil)
+}
+
+// Jar stores the cookies set in the responses like a browser and adds
+// them to the following requests
+type Jar struct {
+	jar *cookiejar.Jar
+	url *url.URL
+}
+
+// NewJar returns an empty jar for the LoginHost
+func NewJar() *Jar {
+	jar, _ := cookiejar.New(nil) // Never fails without options
+	return &Jar{jar: jar, url: &url.URL{Scheme: "https", Host: LoginHost, Path: "/"}}
+}
+
+// Store takes the cookies set by the response, expired cookies are
+// removed from the jar
+func (j *Jar) Store(res *httptest.ResponseRecorder) {
+	j.jar.SetCookies(j.url, res.Result().Cookies())
+}
+
+// Apply adds the cookies of the jar to the request
+func (j *Jar) Apply(r *http.Request) *http.Request {
+	for _, c := range j.jar.Cookies(j.url) {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// Cookies returns the cookies currently stored
+func (j *Jar) Cookies() []*http.Cookie {
+	return j.jar.Cookies(j.url)
+}
+
+// ProviderConfig returns a configuration file containing the given
+// configuration of the provider in the providers section as nginx-sso
+// passes it to Configure
+func ProviderConfig(id string, config interface{}) []byte {
+	return marshalConfig(map[string]interface{}{"providers": map[string]interface{}{id: config}})
+}
+
+// MFAConfig returns a configuration file containing the given
+// configuration of the MFA provider in the mfa section
+func MFAConfig(id string, config interface{}) []byte {
+	return marshalConfig(map[string]interface{}{"mfa": map[string]interface{}{id: config}})
+}
+
+func marshalConfig(v interface{}) []byte {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		// Only possible for values which can't be represented in YAML
+		panic(err)
+	}
+	return out
+}
+
+// ReadFixture reads the file from the testdata directory of the package
+// under test
+func ReadFixture(t testing.TB, name string) []byte {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Unable to read fixture: %s", err)
+	}
+	return content
+}
+
+// AssertGolden compares the output against the golden file in the
+// testdata directory. When running the tests with -authtest.update the
+// golden file is written instead.
+func AssertGolden(t testing.TB, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("Unable to write golden file: %s", err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read golden file (create it using -authtest.update): %s", err)
+	}
+	if string(expected) != string(got) {
+		t.Errorf("Output does not match %s:\n--- expected\n%s\n--- got\n%s", path, expected, got)
+	}
+}
@@ -0,0 +1,79 @@
+package authtest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// cookieAuthenticator logs in users with a password and keeps the name
+// of the user in a plain cookie
+type cookieAuthenticator struct {
+	Users map[string]string `yaml:"users"`
+}
+
+func (c *cookieAuthenticator) AuthenticatorID() string { return "cookie" }
+
+func (c *cookieAuthenticator) Configure(yamlSource []byte) error {
+	envelope := struct {
+		Providers struct {
+			Cookie *cookieAuthenticator `yaml:"cookie"`
+		} `yaml:"providers"`
+	}{}
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return err
+	}
+	if envelope.Providers.Cookie == nil {
+		return plugins.ErrProviderUnconfigured
+	}
+	c.Users = envelope.Providers.Cookie.Users
+	return nil
+}
+
+func (c *cookieAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	cookie, err := r.Cookie("cookie-user")
+	if err != nil || c.Users[cookie.Value] == "" {
+		return "", nil, plugins.ErrNoUser
+	}
+	return cookie.Value, nil, nil
+}
+
+func (c *cookieAuthenticator) Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []plugins.MFAConfig, error) {
+	user := r.FormValue("cookie-username")
+	if pass, ok := c.Users[user]; !ok || pass != r.FormValue("cookie-password") {
+		return "", nil, plugins.ErrWrongCredentials
+	}
+	http.SetCookie(res, &http.Cookie{Name: "cookie-user", Value: user, Path: "/"})
+	return user, nil, nil
+}
+
+func (c *cookieAuthenticator) LoginFields() []plugins.LoginField {
+	return []plugins.LoginField{
+		{Label: "Username", Name: "username", Type: "text"},
+		{Label: "Password", Name: "password", Type: "password"},
+	}
+}
+
+func (c *cookieAuthenticator) Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(res, &http.Cookie{Name: "cookie-user", Path: "/", MaxAge: -1})
+	return nil
+}
+
+func (c *cookieAuthenticator) SupportsMFA() bool { return false }
+
+func TestConformance(t *testing.T) {
+	RunConformance(t, Conformance{
+		New:          func() plugins.Authenticator { return &cookieAuthenticator{} },
+		Config:       ReadFixture(t, "config.yaml"),
+		Login:        map[string]string{"username": "jane", "password": "secret"},
+		InvalidLogin: map[string]string{"username": "jane", "password": "wrong"},
+		User:         "jane",
+	})
+
+	AssertGolden(t, "config.yaml", ProviderConfig("cookie", map[string]interface{}{
+		"users": map[string]string{"jane": "secret"},
+	}))
+}
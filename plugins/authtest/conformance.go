@@ -0,0 +1,152 @@
+package authtest
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/plugins"
+)
+
+// canceledCallTimeout is the time an authenticator may take to return
+// from a call with a canceled context
+const canceledCallTimeout = time.Second
+
+// Conformance describes the authenticator checked by RunConformance
+type Conformance struct {
+	// New returns a new zero value of the authenticator like it is
+	// created for every load of the configuration
+	New func() plugins.Authenticator
+	// Config is the configuration file containing the section of the
+	// authenticator, see ProviderConfig
+	Config []byte
+
+	// Login contains the values of the login fields (without the prefix
+	// of the authenticator) of a valid login of User. Authenticators
+	// without login form leave it empty to skip the login checks.
+	Login map[string]string
+	// InvalidLogin contains values rejected by the authenticator, the
+	// login fields are left empty if not set
+	InvalidLogin map[string]string
+	User         string
+}
+
+// RunConformance checks the authenticator behaves like nginx-sso expects
+// it to: It needs to report a missing configuration, must not detect a
+// user in requests without credentials, needs to detect the user logged
+// in by Login from the cookies set by Login and must not detect the user
+// anymore after Logout. Calls with a canceled context need to return
+// quickly.
+func RunConformance(t *testing.T, c Conformance) {
+	t.Helper()
+
+	a := c.New()
+
+	t.Run("AuthenticatorID", func(t *testing.T) {
+		if a.AuthenticatorID() == "" {
+			t.Fatal("Expected authenticator to have an ID")
+		}
+		if id := c.New().AuthenticatorID(); id != a.AuthenticatorID() {
+			t.Errorf("Expected ID to be stable, got %q and %q", a.AuthenticatorID(), id)
+		}
+	})
+
+	t.Run("Unconfigured", func(t *testing.T) {
+		if err := c.New().Configure([]byte("listen:\n  port: 8082\n")); !errors.Is(err, plugins.ErrProviderUnconfigured) {
+			t.Errorf("Expected configuration without section to return ErrProviderUnconfigured, got %v", err)
+		}
+	})
+
+	if err := a.Configure(c.Config); err != nil {
+		t.Fatalf("Unable to configure authenticator: %s", err)
+	}
+
+	t.Run("LoginFields", func(t *testing.T) {
+		seen := map[string]bool{}
+		for _, f := range a.LoginFields() {
+			if f.Name == "" || f.Type == "" {
+				t.Errorf("Expected field %#v to have a name and a type", f)
+			}
+			if seen[f.Name] {
+				t.Errorf("Expected field name %q to be unique", f.Name)
+			}
+			seen[f.Name] = true
+		}
+		for name := range c.Login {
+			if !seen[name] {
+				t.Errorf("Expected login value %q to belong to a login field", name)
+			}
+		}
+	})
+
+	t.Run("DetectWithoutCredentials", func(t *testing.T) {
+		if user, _, err := a.DetectUser(context.Background(), httptest.NewRecorder(), NewAuthRequest("app.example.com", "/")); !errors.Is(err, plugins.ErrNoUser) {
+			t.Errorf("Expected request without credentials to return ErrNoUser, got user %q: %v", user, err)
+		}
+	})
+
+	t.Run("CanceledContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			a.DetectUser(ctx, httptest.NewRecorder(), NewAuthRequest("app.example.com", "/"))
+			if len(c.Login) > 0 {
+				a.Login(ctx, httptest.NewRecorder(), NewLoginRequest(a.AuthenticatorID(), c.Login))
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(canceledCallTimeout):
+			t.Errorf("Expected calls with canceled context to return within %s", canceledCallTimeout)
+		}
+	})
+
+	if len(c.Login) == 0 {
+		return
+	}
+
+	t.Run("InvalidLogin", func(t *testing.T) {
+		jar := NewJar()
+		res := httptest.NewRecorder()
+		if user, _, err := a.Login(context.Background(), res, NewLoginRequest(a.AuthenticatorID(), c.InvalidLogin)); !errors.Is(err, plugins.ErrNoUser) {
+			t.Errorf("Expected invalid login to return ErrNoUser, got user %q: %v", user, err)
+		}
+		jar.Store(res)
+
+		if user, _, err := a.DetectUser(context.Background(), httptest.NewRecorder(), jar.Apply(NewAuthRequest("app.example.com", "/"))); err == nil {
+			t.Errorf("Expected no user to be detected after invalid login, got %q", user)
+		}
+	})
+
+	t.Run("LoginLogout", func(t *testing.T) {
+		jar := NewJar()
+		res := httptest.NewRecorder()
+		user, _, err := a.Login(context.Background(), res, NewLoginRequest(a.AuthenticatorID(), c.Login))
+		if err != nil || user != c.User {
+			t.Fatalf("Expected login of %q, got %q: %v", c.User, user, err)
+		}
+		jar.Store(res)
+
+		res = httptest.NewRecorder()
+		if user, _, err := a.DetectUser(context.Background(), res, jar.Apply(NewAuthRequest("app.example.com", "/"))); err != nil || user != c.User {
+			t.Fatalf("Expected %q to be detected after the login, got %q: %v", c.User, user, err)
+		}
+		jar.Store(res)
+
+		res = httptest.NewRecorder()
+		if err := a.Logout(context.Background(), res, jar.Apply(NewLogoutRequest())); err != nil {
+			t.Fatalf("Unable to log out: %s", err)
+		}
+		jar.Store(res)
+
+		if user, _, err := a.DetectUser(context.Background(), httptest.NewRecorder(), jar.Apply(NewAuthRequest("app.example.com", "/"))); !errors.Is(err, plugins.ErrNoUser) {
+			t.Errorf("Expected no user to be detected after the logout, got %q: %v", user, err)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package plugins
+
+// Authenticators can also run as external processes written in any
+// language. nginx-sso starts them using the handshake of
+// github.com/hashicorp/go-plugin with automatic mutual TLS and talks to
+// the Authenticator service defined in authenticator.proto using gRPC.
+// Plugins written in Go can use go-plugin with this handshake config:
+//
+//	plugin.HandshakeConfig{
+//		ProtocolVersion:  plugins.ProtocolVersion,
+//		MagicCookieKey:   plugins.MagicCookieKey,
+//		MagicCookieValue: plugins.MagicCookieValue,
+//	}
+const (
+	// ProtocolVersion is the version of the gRPC contract
+	ProtocolVersion = 1
+
+	// MagicCookieKey and MagicCookieValue are set in the environment of
+	// the plugin processes to detect they were started by nginx-sso
+	MagicCookieKey   = "NGINX_SSO_PLUGIN"
+	MagicCookieValue = "b2a6f6c1-5d0e-4f57-9c51-3d0f1f7e2c8a"
+
+	// ServiceName is the full name of the Authenticator gRPC service
+	ServiceName = "nginxsso.plugins.v1.Authenticator"
+)
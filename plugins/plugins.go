@@ -0,0 +1,182 @@
+// Package plugins contains the interfaces and types to implement
+// authenticators and MFA providers outside of the nginx-sso source
+// tree. Plugins are built using `go build -buildmode=plugin` against the
+// same version of nginx-sso and its dependencies and need to export a
+// Register function of type RegisterFunc:
+//
+//	func Register(registerAuthenticator plugins.RegisterAuthenticatorFunc, registerMFAProvider plugins.RegisterMFAProviderFunc) error
+//
+// The interfaces mirror the ones of the built-in providers, see their
+// documentation in README.md for the expected behavior.
+package plugins
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrProviderUnconfigured needs to be returned by Configure if the
+	// configuration does not contain a section for the provider
+	ErrProviderUnconfigured = errors.New("No valid configuration found for this provider")
+
+	// ErrNoUser needs to be returned by DetectUser and Login if no user
+	// was detected or the login failed. The next authenticator is asked
+	// for errors matching ErrNoUser using errors.Is.
+	ErrNoUser = errors.New("No valid users found")
+
+	// ErrNoValidUserFound is the previous name of ErrNoUser
+	ErrNoValidUserFound = ErrNoUser
+
+	// ErrWrongCredentials can be returned by Login and ValidateMFA if the
+	// user is known but the password or token is wrong. It matches
+	// ErrNoUser.
+	ErrWrongCredentials error = &errorKind{"Wrong credentials", ErrNoUser}
+
+	// ErrMFARequired is returned if the user needs to enter a MFA token
+	// to log in. It matches ErrNoUser.
+	ErrMFARequired error = &errorKind{"MFA token required", ErrNoUser}
+
+	// ErrBackendUnavailable needs to be wrapped around the errors of
+	// backends which can't be reached or don't respond to let the user
+	// know the login is unavailable instead of reporting a wrong password
+	ErrBackendUnavailable = errors.New("Backend unavailable")
+)
+
+// errorKind is a sentinel error matching its parent
+type errorKind struct {
+	msg    string
+	parent error
+}
+
+func (e *errorKind) Error() string { return e.msg }
+func (e *errorKind) Unwrap() error { return e.parent }
+
+// AuthError attaches the kind of the failure and a message to show to
+// the user to the error returned by a provider:
+//
+//	return "", nil, &plugins.AuthError{Kind: plugins.ErrBackendUnavailable, Err: err}
+//
+// errors.Is(err, kind) matches the Kind and the wrapped Err. The Message
+// is the key of a translation of the frontend starting with "error_"
+// which is shown instead of the generic message of the kind.
+type AuthError struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+func (e *AuthError) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Is reports whether the kind of the error matches the target
+func (e *AuthError) Is(target error) bool { return errors.Is(e.Kind, target) }
+
+// Unwrap returns the wrapped error
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// ErrorMessage returns the message of the outermost AuthError wrapped
+// into err carrying one
+func ErrorMessage(err error) string {
+	for err != nil {
+		if a, ok := err.(*AuthError); ok && a.Message != "" {
+			return a.Message
+		}
+		err = errors.Unwrap(err)
+	}
+	return ""
+}
+
+// RegisterFunc is the type of the Register symbol every plugin exports.
+// It is called once when the plugin is loaded.
+type RegisterFunc func(RegisterAuthenticatorFunc, RegisterMFAProviderFunc) error
+
+// RegisterAuthenticatorFunc adds an authenticator to the registry
+type RegisterAuthenticatorFunc func(Authenticator)
+
+// RegisterMFAProviderFunc adds an MFA provider to the registry
+type RegisterMFAProviderFunc func(MFAProvider)
+
+// LoginField describes a field of the login form of an authenticator
+type LoginField struct {
+	Label       string `json:"label"`
+	Name        string `json:"name"`
+	Placeholder string `json:"placeholder"`
+	Type        string `json:"type"`
+}
+
+// MFAConfig is returned by the authenticator for every MFA method of
+// the user and passed to the MFA provider matching the Provider
+type MFAConfig struct {
+	Provider   string                 `yaml:"provider"`
+	Attributes map[string]interface{} `yaml:"attributes"`
+}
+
+// Authenticator detects and logs in users. The registered value needs to
+// be a pointer to a struct, every load of the configuration uses a new
+// zero value of the struct.
+type Authenticator interface {
+	// AuthenticatorID needs to return an unique string to identify
+	// this special authenticator
+	AuthenticatorID() (id string)
+
+	// Configure loads the configuration for the Authenticator from the
+	// global config.yaml file which is passed as a byte-slice.
+	// If no configuration for the Authenticator is supplied the function
+	// needs to return the ErrProviderUnconfigured
+	Configure(yamlSource []byte) (err error)
+
+	// DetectUser is used to detect a user without a login form from
+	// a cookie, header or other methods
+	// If no user was detected the ErrNoUser needs to be
+	// returned
+	// Calls to backends need to honor the context which ends when the
+	// request is canceled or the provider_timeout is exceeded. This
+	// applies to Login, Logout and ValidateMFA as well.
+	DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (user string, groups []string, err error)
+
+	// Login is called when the user submits the login form and needs
+	// to authenticate the user or throw an error. If the user has
+	// successfully logged in the persistent cookie should be written
+	// in order to use DetectUser for the next login.
+	// If the user did not login correctly the ErrNoUser
+	// needs to be returned
+	Login(ctx context.Context, res http.ResponseWriter, r *http.Request) (user string, mfaConfigs []MFAConfig, err error)
+
+	// LoginFields needs to return the fields required for this login
+	// method. If no login using this method is possible the function
+	// needs to return nil.
+	LoginFields() (fields []LoginField)
+
+	// Logout is called when the user visits the logout endpoint and
+	// needs to destroy any persistent stored cookies
+	Logout(ctx context.Context, res http.ResponseWriter, r *http.Request) (err error)
+
+	// SupportsMFA returns whether Login returns MFA configs, if true the
+	// login form shows an additional field for the MFA token
+	SupportsMFA() bool
+}
+
+// MFAProvider validates the MFA token of a user. The registered value
+// needs to be a pointer to a struct, every load of the configuration
+// uses a new zero value of the struct.
+type MFAProvider interface {
+	// ProviderID needs to return an unique string to identify
+	// this special MFA provider
+	ProviderID() (id string)
+
+	// Configure loads the configuration for the MFA provider from the
+	// global config.yaml file which is passed as a byte-slice.
+	// If no configuration for the provider is supplied the function
+	// needs to return the ErrProviderUnconfigured
+	Configure(yamlSource []byte) (err error)
+
+	// ValidateMFA takes the user from the login cookie and performs a
+	// validation against the provided MFA configuration for this user
+	ValidateMFA(ctx context.Context, res http.ResponseWriter, r *http.Request, user string, mfaCfgs []MFAConfig) error
+}
@@ -0,0 +1,75 @@
+package plugins
+
+// Authenticators can also be compiled to WebAssembly and are run by
+// nginx-sso inside of a wazero runtime. The modules are sandboxed: They
+// get no access to the file system or the network and only see the
+// request through the functions nginx-sso provides to them. Modules need
+// to be WASI reactors (for Go `GOOS=wasip1 GOARCH=wasm go build
+// -buildmode=c-shared`) and export:
+//
+//	memory
+//	nginx_sso_abi_version() i32               returns WASMABIVersion
+//	nginx_sso_malloc(size i32) i32            returns a buffer of size bytes for the host to write to
+//	nginx_sso_info() i32                      reports the authenticator by calling set_info
+//	nginx_sso_configure(ptr, len i32) i32     receives the configuration file
+//	nginx_sso_detect_user() i32
+//	nginx_sso_login() i32
+//	nginx_sso_logout() i32
+//
+// All exported functions except abi_version and malloc return one of the
+// WASMStatus codes. Every call gets a fresh view of the request through
+// these functions imported from the module WASMHostModule:
+//
+//	request_info(kind, buf, cap i32) i32                   one of the WASMRequest values
+//	request_header(name, name_len, buf, cap i32) i32
+//	request_cookie(name, name_len, buf, cap i32) i32
+//	request_form_value(name, name_len, buf, cap i32) i32
+//	add_response_header(name, name_len, value, value_len i32)
+//	set_info(ptr, len i32)                                 JSON: {"id", "supports_mfa", "login_fields": [{"label", "name", "placeholder", "type"}]}
+//	set_user(ptr, len i32)
+//	add_group(ptr, len i32)
+//	add_mfa_config(ptr, len i32)                           JSON: {"provider", "attributes"}
+//	set_message(ptr, len i32)                              key of a translation shown to the user or the error
+//	log(level, ptr, len i32)                               one of the WASMLog levels
+//
+// The request functions copy up to cap bytes of the value into buf and
+// return the full length of the value, or -1 if it is not set. Strings
+// are passed as pointer and length into the memory of the module.
+// Instances of the module are reused for calls of the same configuration
+// but never used concurrently.
+const (
+	// WASMABIVersion is the version of the functions exchanged between
+	// nginx-sso and the modules
+	WASMABIVersion = 1
+
+	// WASMHostModule is the name of the module providing the functions
+	// imported by the modules
+	WASMHostModule = "nginx_sso"
+)
+
+// Status codes returned by the functions exported by WASM modules
+const (
+	WASMStatusOK = iota
+	WASMStatusNoUser
+	WASMStatusWrongCredentials
+	WASMStatusMFARequired
+	WASMStatusUnavailable
+	WASMStatusUnconfigured
+	WASMStatusError
+)
+
+// Kinds of request information available through request_info
+const (
+	WASMRequestMethod = iota
+	WASMRequestURI
+	WASMRequestHost
+	WASMRequestClientIP
+)
+
+// Log levels of the log function
+const (
+	WASMLogDebug = iota
+	WASMLogInfo
+	WASMLogWarn
+	WASMLogError
+)
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// handlePprofRequest exposes the runtime profiles to users allowed to
+// use the admin API if enabled in the configuration
+func handlePprofRequest(res http.ResponseWriter, r *http.Request) {
+	if !getMainConfig().Admin.Pprof {
+		http.NotFound(res, r)
+		return
+	}
+
+	if _, ok := detectAdmin(res, r); !ok {
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/debug/pprof/") {
+	case "cmdline":
+		pprof.Cmdline(res, r)
+	case "profile":
+		pprof.Profile(res, r)
+	case "symbol":
+		pprof.Symbol(res, r)
+	case "trace":
+		pprof.Trace(res, r)
+	default:
+		// Serves the index and the named profiles (heap, goroutine, ...)
+		pprof.Index(res, r)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Minimal protocol buffers wire format helpers used to speak the Envoy
+// ext_authz protocol without pulling in the full protobuf runtime
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+type protoField struct {
+	Number int
+	Varint uint64
+	Bytes  []byte
+}
+
+// parseProtoMessage splits the message into its fields. Fields of the
+// fixed size types are skipped as they are not used.
+func parseProtoMessage(buf []byte) ([]protoField, error) {
+	var fields []protoField
+
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("Invalid field tag")
+		}
+		buf = buf[n:]
+
+		f := protoField{Number: int(tag >> 3)}
+		switch tag & 0x7 {
+		case protoWireVarint:
+			if f.Varint, n = binary.Uvarint(buf); n <= 0 {
+				return nil, fmt.Errorf("Invalid varint in field %d", f.Number)
+			}
+			buf = buf[n:]
+
+		case protoWireBytes:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < l {
+				return nil, fmt.Errorf("Invalid length of field %d", f.Number)
+			}
+			f.Bytes = buf[n : n+int(l)]
+			buf = buf[n+int(l):]
+
+		case protoWireFixed64:
+			if len(buf) < 8 {
+				return nil, fmt.Errorf("Invalid fixed64 in field %d", f.Number)
+			}
+			buf = buf[8:]
+			continue
+
+		case protoWireFixed32:
+			if len(buf) < 4 {
+				return nil, fmt.Errorf("Invalid fixed32 in field %d", f.Number)
+			}
+			buf = buf[4:]
+			continue
+
+		default:
+			return nil, fmt.Errorf("Unsupported wire type %d in field %d", tag&0x7, f.Number)
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// protoMessage builds an encoded protocol buffers message
+type protoMessage []byte
+
+func (p protoMessage) appendTag(number, wireType int) protoMessage {
+	return appendUvarint(p, uint64(number)<<3|uint64(wireType))
+}
+
+func (p protoMessage) Varint(number int, v uint64) protoMessage {
+	p = p.appendTag(number, protoWireVarint)
+	return appendUvarint(p, v)
+}
+
+func (p protoMessage) Bytes(number int, v []byte) protoMessage {
+	p = p.appendTag(number, protoWireBytes)
+	p = appendUvarint(p, uint64(len(v)))
+	return append(p, v...)
+}
+
+func (p protoMessage) String(number int, v string) protoMessage {
+	return p.Bytes(number, []byte(v))
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, v)
+	return append(buf, tmp[:n]...)
+}
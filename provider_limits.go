@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultProviderQueueTimeout = time.Second
+	defaultProviderRetryAfter   = time.Second
+)
+
+var (
+	// providerLimiters keeps the limiter of every provider, limiters with
+	// an unchanged configuration are kept on reload to not lose track of
+	// the calls in flight
+	providerLimiters     = map[string]*providerLimiter{}
+	providerLimitersCfg  providerLimitsConfig
+	providerLimitersLock sync.RWMutex
+)
+
+// providerLimit bounds the concurrent calls to the backend of a provider
+type providerLimit struct {
+	MaxConcurrent int           `yaml:"max_concurrent"`
+	MaxQueue      int           `yaml:"max_queue"`
+	QueueTimeout  time.Duration `yaml:"queue_timeout"`
+	RetryAfter    time.Duration `yaml:"retry_after"`
+}
+
+func (p providerLimit) Validate() error {
+	switch {
+	case p.MaxConcurrent < 0, p.MaxQueue < 0:
+		return errors.New("Limits must not be negative")
+	case p.QueueTimeout < 0, p.RetryAfter < 0:
+		return errors.New("Durations must not be negative")
+	case p.MaxConcurrent == 0 && (p.MaxQueue > 0 || p.QueueTimeout > 0 || p.RetryAfter > 0):
+		return errors.New("Queue settings need max_concurrent")
+	}
+	return nil
+}
+
+// providerLimitsConfig limits the calls to the authenticators, MFA and
+// group providers by their ID, the default applies to every provider
+// without its own limit
+type providerLimitsConfig struct {
+	Default   providerLimit            `yaml:"default"`
+	Providers map[string]providerLimit `yaml:"providers"`
+}
+
+func (p providerLimitsConfig) Validate() error {
+	if err := p.Default.Validate(); err != nil {
+		return errors.Wrap(err, "Default limit is invalid")
+	}
+	for id, l := range p.Providers {
+		if err := l.Validate(); err != nil {
+			return errors.Wrapf(err, "Limit of provider %q is invalid", id)
+		}
+	}
+	return nil
+}
+
+func (p providerLimitsConfig) limitFor(id string) providerLimit {
+	if l, ok := p.Providers[id]; ok {
+		return l
+	}
+	return p.Default
+}
+
+// providerSaturatedError rejects calls to a provider having reached its
+// limit, it is handled like an unavailable backend
+type providerSaturatedError struct {
+	Provider   string
+	RetryAfter time.Duration
+}
+
+func (p providerSaturatedError) Error() string {
+	return fmt.Sprintf("Provider %q is at its concurrency limit", p.Provider)
+}
+
+func (p providerSaturatedError) Is(target error) bool { return target == errBackendUnavailable }
+
+// providerRetryAfter returns the time the client should wait before
+// retrying a request which failed because of a saturated provider
+func providerRetryAfter(err error) time.Duration {
+	var sat providerSaturatedError
+	if errors.As(err, &sat) {
+		return sat.RetryAfter
+	}
+	return 0
+}
+
+// setRetryAfter sets the Retry-After header in seconds if the wait is
+// known
+func setRetryAfter(res http.ResponseWriter, wait time.Duration) {
+	if wait > 0 {
+		res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
+
+// providerLimiter is a semaphore with a bounded queue in front of it
+type providerLimiter struct {
+	id    string
+	cfg   providerLimit
+	slots chan struct{}
+
+	maxQueue     int64
+	queueTimeout time.Duration
+	retryAfter   time.Duration
+	waiting      int64
+}
+
+func newProviderLimiter(id string, cfg providerLimit) *providerLimiter {
+	p := &providerLimiter{
+		id:           id,
+		cfg:          cfg,
+		slots:        make(chan struct{}, cfg.MaxConcurrent),
+		maxQueue:     int64(cfg.MaxQueue),
+		queueTimeout: cfg.QueueTimeout,
+		retryAfter:   cfg.RetryAfter,
+	}
+	if p.queueTimeout == 0 {
+		p.queueTimeout = defaultProviderQueueTimeout
+	}
+	if p.retryAfter == 0 {
+		p.retryAfter = defaultProviderRetryAfter
+	}
+	return p
+}
+
+// acquire takes a slot, waiting up to the queue_timeout if all slots
+// are taken and the queue is not full. The returned function releases
+// the slot.
+func (p *providerLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-p.slots }
+
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&p.waiting, 1) > p.maxQueue {
+		atomic.AddInt64(&p.waiting, -1)
+		return nil, p.saturated()
+	}
+	defer atomic.AddInt64(&p.waiting, -1)
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, p.saturated()
+	case <-ctx.Done():
+		return nil, backendUnavailable(ctx.Err())
+	}
+}
+
+func (p *providerLimiter) saturated() error {
+	metricProviderLimitRejections.Inc(p.id)
+	return providerSaturatedError{Provider: p.id, RetryAfter: p.retryAfter}
+}
+
+// setProviderLimits activates the limits of the configuration, calls in
+// flight finish on the limiter they were started on
+func setProviderLimits(p providerLimitsConfig) {
+	providerLimitersLock.Lock()
+	defer providerLimitersLock.Unlock()
+
+	next := map[string]*providerLimiter{}
+	for id, l := range providerLimiters {
+		if p.limitFor(id) == l.cfg {
+			next[id] = l
+		}
+	}
+
+	providerLimiters = next
+	providerLimitersCfg = p
+}
+
+// acquireProvider takes a slot of the provider, the returned function
+// needs to be called when the call to the provider finished
+func acquireProvider(ctx context.Context, id string) (func(), error) {
+	providerLimitersLock.RLock()
+	l, ok := providerLimiters[id]
+	unlimited := providerLimitersCfg.limitFor(id).MaxConcurrent == 0
+	providerLimitersLock.RUnlock()
+
+	if !ok && !unlimited {
+		// The limiter is created on first use, the configuration might
+		// have changed in the meantime
+		providerLimitersLock.Lock()
+		cfg := providerLimitersCfg.limitFor(id)
+		if l, ok = providerLimiters[id]; !ok && cfg.MaxConcurrent > 0 {
+			l = newProviderLimiter(id, cfg)
+			providerLimiters[id] = l
+		}
+		providerLimitersLock.Unlock()
+	}
+
+	if l == nil {
+		return func() {}, nil
+	}
+	return l.acquire(ctx)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestProviderLimits(t *testing.T) {
+	a := &testBlockingAuthenticator{release: make(chan struct{})}
+
+	prev := getAuthenticatorSnapshot()
+	setAuthenticators([]authenticator{a})
+	defer authenticatorState.Store(prev)
+
+	if err := (providerLimitsConfig{Providers: map[string]providerLimit{"ldap": {MaxQueue: 5}}}).Validate(); err == nil {
+		t.Error("Expected queue without max_concurrent to be rejected")
+	}
+
+	setProviderLimits(providerLimitsConfig{Providers: map[string]providerLimit{
+		"blocking": {MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: 50 * time.Millisecond, RetryAfter: 3 * time.Second},
+	}})
+	defer setProviderLimits(providerLimitsConfig{})
+
+	detect := func(cookie string) error {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.AddCookie(&http.Cookie{Name: "nginx-sso-blocking", Value: cookie})
+		defer clearRequestValues(r)
+
+		_, _, err := detectUser(httptest.NewRecorder(), r)
+		return err
+	}
+
+	// The first call takes the slot, the second one waits in the queue
+	first, queued := make(chan error, 1), make(chan error, 1)
+	go func() { first <- detect("session-1") }()
+	for atomic.LoadInt32(&a.detections) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { queued <- detect("session-2") }()
+	for {
+		providerLimitersLock.RLock()
+		waiting := atomic.LoadInt64(&providerLimiters["blocking"].waiting)
+		providerLimitersLock.RUnlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// With a full queue further calls fail fast
+	start := time.Now()
+	err := detect("session-3")
+	if !errors.Is(err, errBackendUnavailable) || providerRetryAfter(err) != 3*time.Second {
+		t.Errorf("Expected saturated provider, got %v", err)
+	}
+	if time.Since(start) > 25*time.Millisecond {
+		t.Error("Expected call to be rejected without waiting")
+	}
+
+	res := httptest.NewRecorder()
+	setRetryAfter(res, providerRetryAfter(err))
+	if res.Header().Get("Retry-After") != "3" {
+		t.Errorf("Expected Retry-After of 3 seconds, got %q", res.Header().Get("Retry-After"))
+	}
+
+	// Queued calls give up after the queue timeout
+	if err := <-queued; !errors.Is(err, errBackendUnavailable) {
+		t.Errorf("Expected queued call to time out, got %v", err)
+	}
+
+	a.release <- struct{}{}
+	if err := <-first; err != nil {
+		t.Errorf("Expected first call to succeed, got %v", err)
+	}
+	if n := atomic.LoadInt32(&a.detections); n != 1 {
+		t.Errorf("Expected rejected calls to not reach the provider, got %d detections", n)
+	}
+
+	// Without limits calls are not queued
+	setProviderLimits(providerLimitsConfig{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			a.release <- struct{}{}
+		}
+	}()
+	results := make(chan error, 2)
+	for _, cookie := range []string{"session-1", "session-2"} {
+		go func(cookie string) { results <- detect(cookie) }(cookie)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Expected unlimited calls to succeed, got %v", err)
+		}
+	}
+}
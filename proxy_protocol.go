@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener expects every accepted connection to start with
+// a PROXY protocol (v1 or v2) header and reports the client address
+// contained in it as remote address of the connection
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (p proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the header on first use instead of within
+// Accept to not block accepting other connections
+type proxyProtocolConn struct {
+	net.Conn
+
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+	once       sync.Once
+}
+
+func (p *proxyProtocolConn) readHeader() {
+	p.once.Do(func() {
+		p.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		defer p.Conn.SetReadDeadline(time.Time{})
+
+		p.remoteAddr, p.err = readProxyProtocolHeader(p.reader)
+		if p.err != nil {
+			log.WithError(p.err).WithField("remote_addr", p.Conn.RemoteAddr().String()).Warn("Rejected connection with invalid PROXY protocol header")
+			p.Conn.Close()
+		}
+	})
+}
+
+func (p *proxyProtocolConn) Read(b []byte) (int, error) {
+	p.readHeader()
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.reader.Read(b)
+}
+
+func (p *proxyProtocolConn) RemoteAddr() net.Addr {
+	p.readHeader()
+	if p.remoteAddr != nil {
+		return p.remoteAddr
+	}
+	return p.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader parses the header and returns the source
+// address. For LOCAL / UNKNOWN connections (health checks of the load
+// balancer) nil is returned to use the address of the connection.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+
+	if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+		return readProxyProtocolV1(r)
+	}
+
+	return nil, fmt.Errorf("Connection does not start with a PROXY protocol header")
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY v1 header is not terminated")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid source address in PROXY v1 header")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0xf {
+	case 0x0:
+		// LOCAL command: Connection made by the proxy itself
+		return nil, nil
+	case 0x1:
+		// PROXY command
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY v2 command %d", header[12]&0xf)
+	}
+
+	switch header[13] >> 4 {
+	case 0x1:
+		// AF_INET: src addr (4), dst addr (4), src port (2), dst port (2)
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("PROXY v2 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x2:
+		// AF_INET6: src addr (16), dst addr (16), src port (2), dst port (2)
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("PROXY v2 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX, no usable client address
+		return nil, nil
+	}
+}
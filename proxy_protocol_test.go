@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, addrs ...byte) []byte {
+		h := append([]byte{}, proxyProtocolV2Signature...)
+		h = append(h, 0x20|cmd, fam, 0, byte(len(addrs)))
+		return append(h, addrs...)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		header  []byte
+		expAddr string
+		expErr  bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n"), expAddr: "192.0.2.10:56324"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), expAddr: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unterminated", header: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\n"), expErr: true},
+		{name: "v1 invalid ip", header: []byte("PROXY TCP4 foo 198.51.100.1 56324 443\r\n"), expErr: true},
+		{name: "v2 inet", header: v2(1, 0x11, 192, 0, 2, 10, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb), expAddr: "192.0.2.10:56324"},
+		{name: "v2 local", header: v2(0, 0x00)},
+		{name: "v2 short", header: v2(1, 0x11, 192, 0, 2, 10), expErr: true},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n"), expErr: true},
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(tc.header, []byte("payload")...)))
+
+		addr, err := readProxyProtocolHeader(r)
+		if tc.expErr {
+			if err == nil {
+				t.Errorf("%s: Expected error, got address %v", tc.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", tc.name, err)
+			continue
+		}
+
+		var got string
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.expAddr {
+			t.Errorf("%s: Expected address %q, got %q", tc.name, tc.expAddr, got)
+		}
+
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%s: Expected remaining payload, got %q", tc.name, rest)
+		}
+	}
+}
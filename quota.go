@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+var localRequestCounter = newMemoryRequestCounter()
+
+// getRequestCounter returns the counter of the session store if it is
+// able to count requests (and therefore shares quotas between instances
+// using the same store) or a counter local to this instance
+func getRequestCounter() acl.Counter {
+	store := getSessionStore()
+	if i, ok := store.(instrumentedSessionStore); ok {
+		store = i.sessionStore
+	}
+
+	if c, ok := store.(acl.Counter); ok {
+		return c
+	}
+
+	return localRequestCounter
+}
+
+type memoryRequestCounterWindow struct {
+	expires time.Time
+	count   int
+}
+
+type memoryRequestCounter struct {
+	windows map[string]memoryRequestCounterWindow
+	lock    sync.Mutex
+}
+
+func newMemoryRequestCounter() *memoryRequestCounter {
+	m := &memoryRequestCounter{windows: map[string]memoryRequestCounterWindow{}}
+	go m.cleanup()
+	return m
+}
+
+func (m *memoryRequestCounter) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for key, w := range m.windows {
+			if w.expires.Before(time.Now()) {
+				delete(m.windows, key)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *memoryRequestCounter) Increment(key string, window time.Duration) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	w, ok := m.windows[key]
+	if !ok || w.expires.Before(time.Now()) {
+		w = memoryRequestCounterWindow{expires: time.Now().Add(window)}
+	}
+
+	w.count++
+	m.windows[key] = w
+
+	return w.count, nil
+}
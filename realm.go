@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+var (
+	activeRealms     []*realm
+	activeRealmsLock sync.RWMutex
+)
+
+// realmConfig contains the settings of a realm besides the providers
+// and the ACL which are read from the same keys as in the main
+// configuration
+type realmConfig struct {
+	Hosts  []string `yaml:"hosts"`
+	Cookie struct {
+		Domain string `yaml:"domain"`
+		Prefix string `yaml:"prefix"`
+	} `yaml:"cookie"`
+	Login struct {
+		Title         string            `yaml:"title"`
+		DefaultMethod string            `yaml:"default_method"`
+		Names         map[string]string `yaml:"names"`
+		Theme         string            `yaml:"theme"`
+	} `yaml:"login"`
+}
+
+// realm is an independent set of providers, cookie settings, branding
+// and ACL selected by the host of the request. Requests for hosts not
+// belonging to any realm use the main configuration.
+type realm struct {
+	Name string
+	realmConfig
+
+	acl            acl.ACL
+	authenticators []authenticator
+	groupProviders []groupProvider
+	mfaProviders   []mfaProvider
+}
+
+// loadRealms configures new instances of the providers and the ACL of
+// all realms, they need to be activated using setRealms
+func loadRealms(yamlSource []byte, baseDir string) ([]*realm, error) {
+	envelope := struct {
+		Realms map[string]map[string]interface{} `yaml:"realms"`
+	}{}
+	if err := yaml.Unmarshal(yamlSource, &envelope); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range envelope.Realms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	realms := []*realm{}
+	hostRealm := map[string]string{}
+	for _, name := range names {
+		rl, err := loadRealm(name, envelope.Realms[name], baseDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Realm %q", name)
+		}
+
+		for _, h := range rl.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hostRealm[h]; ok {
+				return nil, errors.Errorf("Host %q is used by realms %q and %q", h, other, name)
+			}
+			hostRealm[h] = name
+		}
+
+		realms = append(realms, rl)
+	}
+
+	return realms, nil
+}
+
+// loadRealm reads the realm from its section of the configuration. The
+// section uses the same keys as the main configuration for providers,
+// group_providers, mfa and acl so it is passed to the same loaders.
+func loadRealm(name string, section map[string]interface{}, baseDir string) (*realm, error) {
+	source, err := yaml.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &realm{Name: name}
+	if err := yaml.Unmarshal(source, &rl.realmConfig); err != nil {
+		return nil, err
+	}
+
+	if len(rl.Hosts) == 0 {
+		return nil, errors.New("No hosts configured")
+	}
+
+	if err := validateLoginTheme(rl.Login.Theme); err != nil {
+		return nil, errors.Wrap(err, "Invalid login theme")
+	}
+
+	if rl.acl, err = loadACL(source, baseDir); err != nil {
+		return nil, errors.Wrap(err, "Unable to load ACL")
+	}
+
+	if rl.authenticators, err = configureAuthenticators(source); err != nil {
+		return nil, errors.Wrap(err, "Unable to configure authentication")
+	}
+
+	if rl.groupProviders, err = configureGroupProviders(source); err != nil {
+		return nil, errors.Wrap(err, "Unable to configure group providers")
+	}
+
+	if rl.mfaProviders, err = configureMFAProviders(source); err != nil {
+		return nil, errors.Wrap(err, "Unable to configure MFA providers")
+	}
+
+	return rl, nil
+}
+
+func setRealms(realms []*realm) {
+	activeRealmsLock.Lock()
+	defer activeRealmsLock.Unlock()
+
+	activeRealms = realms
+}
+
+// getRealm returns the realm the host of the request belongs to or nil
+// if the main configuration is used
+func getRealm(r *http.Request) *realm {
+	activeRealmsLock.RLock()
+	defer activeRealmsLock.RUnlock()
+
+	if len(activeRealms) == 0 {
+		return nil
+	}
+
+	host := requestHost(r)
+	for _, rl := range activeRealms {
+		if hostMatches(rl.Hosts, host) {
+			return rl
+		}
+	}
+
+	return nil
+}
+
+// getRealmName returns the name of the realm of the request or an empty
+// string for the main configuration
+func getRealmName(r *http.Request) string {
+	if rl := getRealm(r); rl != nil {
+		return rl.Name
+	}
+	return ""
+}
+
+// The following accessors return the state of the realm of the request
+// or the active state of the main configuration. The authenticators are
+// read from their snapshot, for the other state the callers need to hold
+// the lock of the respective registry.
+
+func requestAuthenticators(r *http.Request) []authenticator {
+	if rl := getRealm(r); rl != nil {
+		return rl.authenticators
+	}
+	return getAuthenticatorSnapshot().active
+}
+
+func requestGroupProviders(r *http.Request) []groupProvider {
+	if rl := getRealm(r); rl != nil {
+		return rl.groupProviders
+	}
+	return activeGroupProviders
+}
+
+func requestMFAProviders(r *http.Request) []mfaProvider {
+	if rl := getRealm(r); rl != nil {
+		return rl.mfaProviders
+	}
+	return activeMFAProviders
+}
+
+func requestACL(r *http.Request) acl.ACL {
+	if rl := getRealm(r); rl != nil {
+		return rl.acl
+	}
+	return getACL()
+}
+
+// requestLoginSettings returns the settings of the login form with the
+// branding of the realm applied
+func requestLoginSettings(r *http.Request) interface{} {
+	l := getMainConfig().Login
+
+	rl := getRealm(r)
+	if rl == nil {
+		return l
+	}
+
+	if rl.Login.Title != "" {
+		l.Title = rl.Login.Title
+	}
+	if rl.Login.DefaultMethod != "" {
+		l.DefaultMethod = rl.Login.DefaultMethod
+	}
+	if len(rl.Login.Names) > 0 {
+		l.Names = rl.Login.Names
+	}
+	if rl.Login.Theme != "" {
+		l.Theme = rl.Login.Theme
+	}
+
+	return l
+}
+
+// requestLoginNames returns the names of the login methods shown to the
+// user of the realm
+func requestLoginNames(r *http.Request) map[string]string {
+	if rl := getRealm(r); rl != nil && len(rl.Login.Names) > 0 {
+		return rl.Login.Names
+	}
+	return getMainConfig().Login.Names
+}
+
+// realmReadinessCheckers returns the checkers of the providers of all
+// realms prefixed by the realm name
+func realmReadinessCheckers() map[string]readinessChecker {
+	activeRealmsLock.RLock()
+	defer activeRealmsLock.RUnlock()
+
+	checkers := map[string]readinessChecker{}
+	for _, rl := range activeRealms {
+		for _, a := range rl.authenticators {
+			if c, ok := a.(readinessChecker); ok {
+				checkers[fmt.Sprintf("realm.%s.authenticator.%s", rl.Name, a.AuthenticatorID())] = c
+			}
+		}
+		for _, g := range rl.groupProviders {
+			if c, ok := g.(readinessChecker); ok {
+				checkers[fmt.Sprintf("realm.%s.group_provider.%s", rl.Name, g.GroupProviderID())] = c
+			}
+		}
+	}
+
+	return checkers
+}
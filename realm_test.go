@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+)
+
+const realmTestConfig = `
+realms:
+  customer-a:
+    hosts: ["customer-a.example.com", "*.customer-a.example.com"]
+    cookie:
+      prefix: "customer-a"
+    login:
+      title: "Customer A"
+    acl:
+      rule_sets:
+      - rules: [{ field: "host", equals: "app.customer-a.example.com" }]
+        allow: ["@staff"]
+    providers:
+      simple:
+        users:
+          jane: "$2a$04$CN2vDCYsRmNTxJFH1sJB3eYPiKPSYZi6iVR0h0lmfF2fS0.ybD9cW"
+        groups:
+          staff: ["jane"]
+  customer-b:
+    hosts: ["customer-b.example.com"]
+    providers:
+      simple:
+        users:
+          john: "$2a$04$CN2vDCYsRmNTxJFH1sJB3eYPiKPSYZi6iVR0h0lmfF2fS0.ybD9cW"
+`
+
+func TestRealms(t *testing.T) {
+	realms, err := loadRealms([]byte(realmTestConfig), "")
+	if err != nil {
+		t.Fatalf("Unable to load realms: %s", err)
+	}
+	setRealms(realms)
+	defer setRealms(nil)
+
+	for host, expect := range map[string]string{
+		"customer-a.example.com":     "customer-a",
+		"app.customer-a.example.com": "customer-a",
+		"customer-b.example.com":     "customer-b",
+		"other.example.com":          "",
+	} {
+		r := httptest.NewRequest("GET", "/auth", nil)
+		r.Header.Set("X-Host", host)
+		if name := getRealmName(r); name != expect {
+			t.Errorf("Expected host %s to select realm %q, got %q", host, expect, name)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	r.Header.Set("X-Host", "app.customer-a.example.com")
+
+	if a := requestAuthenticators(r); len(a) != 1 || a[0].AuthenticatorID() != "simple" {
+		t.Errorf("Expected the simple provider of the realm, got %v", a)
+	}
+	login := getMainConfig().Login
+	login.Title = "Customer A"
+	if l := requestLoginSettings(r); !reflect.DeepEqual(l, login) {
+		t.Errorf("Expected the title of the realm, got %#v", l)
+	}
+	if o := getMainConfig().getCookieHostOverride(r); o == nil || o.Prefix != "customer-a" {
+		t.Errorf("Expected the cookie prefix of the realm, got %#v", o)
+	}
+
+	a := requestACL(r)
+	if res, _ := a.Evaluate(newACLRequest("jane", []string{"staff"}, r, buildACLFieldSet(r))); res != acl.Allow {
+		t.Errorf("Expected the realm ACL to allow staff, got %s", res)
+	}
+	if res, _ := a.Evaluate(newACLRequest("john", nil, r, buildACLFieldSet(r))); res == acl.Allow {
+		t.Errorf("Expected the realm ACL to deny other users")
+	}
+}
+
+func TestRealmsRejectDuplicateHosts(t *testing.T) {
+	_, err := loadRealms([]byte(`
+realms:
+  a:
+    hosts: ["example.com"]
+  b:
+    hosts: ["Example.com"]
+`), "")
+	if err == nil {
+		t.Error("Expected duplicate hosts to be rejected")
+	}
+
+	if _, err = loadRealms([]byte("realms:\n  a: {}\n"), ""); err == nil {
+		t.Error("Expected a realm without hosts to be rejected")
+	}
+}
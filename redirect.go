@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+var redirectDefaultSchemes = []string{"http", "https"}
+
+// redirectConfig restricts the targets the user can be sent to after
+// login and logout using the `go` parameter
+type redirectConfig struct {
+	AllowedHosts   []string `yaml:"allowed_hosts"`
+	AllowedSchemes []string `yaml:"allowed_schemes"`
+}
+
+// Validate checks the target against the allowed hosts and schemes.
+// Relative targets on the login host are always allowed.
+func (c redirectConfig) Validate(target string) error {
+	if target == "" {
+		return nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("Redirect target is no valid URL")
+	}
+
+	if u.Scheme == "" && u.Host == "" {
+		// Browsers treat //host and /\host as protocol relative URLs
+		if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+			return fmt.Errorf("Relative redirect target needs to start with a single slash")
+		}
+		return nil
+	}
+
+	schemes := c.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = redirectDefaultSchemes
+	}
+	if !str.StringInSlice(strings.ToLower(u.Scheme), schemes) {
+		return fmt.Errorf("Redirect scheme %q is not allowed", u.Scheme)
+	}
+
+	if u.Host == "" || u.User != nil {
+		return fmt.Errorf("Redirect target has an invalid host")
+	}
+
+	if len(c.AllowedHosts) > 0 && !hostMatches(c.AllowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("Redirect host %q is not allowed", u.Hostname())
+	}
+
+	return nil
+}
+
+// validateRedirect checks the `go` parameter of the request and writes
+// an error response if it is not allowed
+func validateRedirect(res http.ResponseWriter, r *http.Request) bool {
+	target := r.FormValue("go")
+
+	if err := getMainConfig().Redirect.Validate(target); err != nil {
+		requestLog(r).WithError(err).WithField("go", target).Warn("Rejected redirect target")
+		http.Error(res, "Invalid redirect target", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestRedirectValidation(t *testing.T) {
+	open := redirectConfig{}
+	restricted := redirectConfig{
+		AllowedHosts:   []string{"example.com", "*.example.com"},
+		AllowedSchemes: []string{"https"},
+	}
+
+	for _, tc := range []struct {
+		cfg    redirectConfig
+		target string
+		valid  bool
+	}{
+		{open, "", true},
+		{open, "/dashboard?tab=1", true},
+		{open, "https://evil.example.org/", true},
+		{open, "javascript:alert(1)", false},
+		{open, "//evil.example.org/", false},
+		{open, "/\\evil.example.org/", false},
+		{open, "dashboard", false},
+		{restricted, "/dashboard", true},
+		{restricted, "https://example.com/", true},
+		{restricted, "https://kibana.EXAMPLE.com/app", true},
+		{restricted, "http://kibana.example.com/", false},
+		{restricted, "https://example.com.evil.org/", false},
+		{restricted, "https://evilexample.com/", false},
+		{restricted, "https://user@example.com/", false},
+	} {
+		err := tc.cfg.Validate(tc.target)
+		if (err == nil) != tc.valid {
+			t.Errorf("Target %q: Expected valid=%v, got error %v", tc.target, tc.valid, err)
+		}
+	}
+}
@@ -0,0 +1,834 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Minimal Redis client speaking RESP2 to share state between instances
+// without pulling in a full client library. Single nodes, Sentinel and
+// Cluster deployments are supported and commands can be pipelined, there
+// is no pub/sub.
+
+const (
+	redisTimeout = 5 * time.Second
+
+	redisDefaultPort         = "6379"
+	redisSentinelDefaultPort = "26379"
+
+	redisClusterSlots  = 16384
+	redisMaxRedirects  = 3
+	redisTopologyTTL   = time.Minute
+	redisReplicaPrefix = "replica:"
+
+	redisTopologySingle   = "single"
+	redisTopologySentinel = "sentinel"
+	redisTopologyCluster  = "cluster"
+)
+
+var (
+	// redisClients shares the connections to the same Redis between the
+	// features using it
+	redisClients     = map[string]*redisClient{}
+	redisClientsLock sync.Mutex
+
+	// redisSchemes maps the supported URI schemes to the topology and
+	// whether TLS is used
+	redisSchemes = map[string]struct {
+		topology string
+		tls      bool
+	}{
+		"redis":           {redisTopologySingle, false},
+		"rediss":          {redisTopologySingle, true},
+		"redis+sentinel":  {redisTopologySentinel, false},
+		"rediss+sentinel": {redisTopologySentinel, true},
+		"redis+cluster":   {redisTopologyCluster, false},
+		"rediss+cluster":  {redisTopologyCluster, true},
+	}
+)
+
+// redisClient sends the commands to the node responsible for them: The
+// single node, the master announced by the Sentinels or the owner of the
+// slot of the key in a Cluster. Reads can be sent to replicas.
+type redisClient struct {
+	topology string
+	// addrs are the node, the Sentinels or the Cluster nodes to discover
+	// the other nodes from
+	addrs []string
+	// master is the name of the master monitored by the Sentinels
+	master string
+
+	username         string
+	password         string
+	sentinelPassword string
+	db               int
+	tls              bool
+	readFromReplica  bool
+
+	conns     map[string]*redisConn
+	connsLock sync.Mutex
+
+	// state is discovered from the Sentinels or the Cluster nodes and
+	// dropped when a node fails or a command is redirected
+	state     *redisTopologyState
+	stateLock sync.Mutex
+}
+
+type redisTopologyState struct {
+	primary  string
+	replicas []string
+	slots    []redisSlotRange
+	expires  time.Time
+}
+
+type redisSlotRange struct {
+	start, end int
+	primary    string
+	replicas   []string
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (r redisError) Error() string { return "Redis error: " + string(r) }
+
+// getRedisClient returns the shared client for the URI
+func getRedisClient(uri string) (*redisClient, error) {
+	redisClientsLock.Lock()
+	defer redisClientsLock.Unlock()
+
+	if c, ok := redisClients[uri]; ok {
+		return c, nil
+	}
+
+	c, err := parseRedisURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	redisClients[uri] = c
+	return c, nil
+}
+
+// isRedisURI reports whether the store is one of the supported Redis URIs
+func isRedisURI(store string) bool {
+	scheme, _, ok := strings.Cut(store, "://")
+	_, supported := redisSchemes[scheme]
+	return ok && supported
+}
+
+func parseRedisURI(uri string) (*redisClient, error) {
+	// Sentinel and Cluster URIs list multiple hosts which are not
+	// accepted by url.Parse, only the first one is parsed
+	var hosts string
+	if scheme, rest, ok := strings.Cut(uri, "://"); ok {
+		end := strings.IndexAny(rest, "/?#")
+		if end < 0 {
+			end = len(rest)
+		}
+		authority := rest[:end]
+
+		userinfo := ""
+		if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+			userinfo, authority = authority[:at+1], authority[at+1:]
+		}
+
+		hosts = authority
+		first, _, _ := strings.Cut(authority, ",")
+		uri = scheme + "://" + userinfo + first + rest[end:]
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse Redis URI")
+	}
+	if hosts != "" {
+		u.Host = hosts
+	}
+	return newRedisClient(u)
+}
+
+// newRedisClient creates a client from an URI in one of the formats
+//
+//	redis://[[user]:password@]host[:port][/db]
+//	redis+sentinel://[[user]:password@]host[:port][,host[:port]...]/master[/db]
+//	redis+cluster://[[user]:password@]host[:port][,host[:port]...]
+//
+// use rediss:// (rediss+sentinel://, rediss+cluster://) for TLS. The
+// hosts of the Sentinel URI are the Sentinels, the ones of the Cluster
+// URI are used to discover the Cluster. The hosts are separated by commas
+// in the Host of the URL.
+func newRedisClient(u *url.URL) (*redisClient, error) {
+	scheme, ok := redisSchemes[u.Scheme]
+	if !ok {
+		return nil, errors.Errorf("Unsupported Redis scheme %q", u.Scheme)
+	}
+	c := &redisClient{topology: scheme.topology, tls: scheme.tls, conns: map[string]*redisConn{}}
+
+	if u.Host == "" {
+		return nil, errors.New("Redis URI needs a host")
+	}
+	hosts := strings.Split(u.Host, ",")
+	if len(hosts) > 1 && c.topology == redisTopologySingle {
+		return nil, errors.New("Redis URI needs a single host, use redis+sentinel:// or redis+cluster:// for multiple hosts")
+	}
+
+	defaultPort := redisDefaultPort
+	if c.topology == redisTopologySentinel {
+		defaultPort = redisSentinelDefaultPort
+	}
+	for _, h := range hosts {
+		if h == "" {
+			return nil, errors.New("Redis URI contains an empty host")
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(strings.Trim(h, "[]"), defaultPort)
+		}
+		c.addrs = append(c.addrs, h)
+	}
+
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	path := strings.Trim(u.Path, "/")
+	switch c.topology {
+	case redisTopologySentinel:
+		c.master, path, _ = strings.Cut(path, "/")
+		if c.master == "" {
+			return nil, errors.New("Redis Sentinel URI needs the name of the master")
+		}
+	case redisTopologyCluster:
+		if path != "" {
+			return nil, errors.New("Redis Cluster does not support databases")
+		}
+	}
+
+	if path != "" {
+		var err error
+		if c.db, err = strconv.Atoi(path); err != nil || c.db < 0 {
+			return nil, errors.Errorf("Invalid Redis database %q", path)
+		}
+	}
+
+	query := u.Query()
+	for param := range query {
+		switch param {
+		case "read_from_replica":
+			if c.topology == redisTopologySingle {
+				return nil, errors.New("Reading from replicas needs a Sentinel or Cluster URI")
+			}
+			var err error
+			if c.readFromReplica, err = strconv.ParseBool(query.Get(param)); err != nil {
+				return nil, errors.Errorf("Invalid value %q for read_from_replica", query.Get(param))
+			}
+		case "sentinel_password":
+			if c.topology != redisTopologySentinel {
+				return nil, errors.New("The sentinel_password needs a Sentinel URI")
+			}
+			c.sentinelPassword = query.Get(param)
+		default:
+			return nil, errors.Errorf("Unsupported Redis URI parameter %q", param)
+		}
+	}
+
+	return c, nil
+}
+
+// Cluster reports whether the client talks to a Redis Cluster, where
+// commands and scripts can only use keys of the same slot
+func (c *redisClient) Cluster() bool { return c.topology == redisTopologyCluster }
+
+// Do executes the command and returns its reply: string, int64, nil or
+// []interface{} of those. On network errors the connection is dropped
+// to be re-established on the next call.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	return c.single(false, args)
+}
+
+// Read executes a command only reading data, with read_from_replica it
+// is sent to a replica which might not have received the latest writes
+func (c *redisClient) Read(args ...string) (interface{}, error) {
+	return c.single(c.readFromReplica, args)
+}
+
+// Pipeline sends the commands in one batch per node and returns their
+// replies in order, error replies are returned as redisError values
+func (c *redisClient) Pipeline(cmds ...[]string) ([]interface{}, error) {
+	return c.run(false, cmds)
+}
+
+// ReadPipeline is the Pipeline of commands only reading data, see Read
+func (c *redisClient) ReadPipeline(cmds ...[]string) ([]interface{}, error) {
+	return c.run(c.readFromReplica, cmds)
+}
+
+func (c *redisClient) single(replica bool, args []string) (interface{}, error) {
+	replies, err := c.run(replica, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := replies[0].(redisError); ok {
+		return nil, rerr
+	}
+	return replies[0], nil
+}
+
+func (c *redisClient) run(replica bool, cmds [][]string) ([]interface{}, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	switch c.topology {
+	case redisTopologySentinel:
+		return c.runSentinel(replica, cmds)
+	case redisTopologyCluster:
+		return c.runCluster(replica, cmds)
+	default:
+		return c.node(c.addrs[0], false).Do(cmds...)
+	}
+}
+
+func (c *redisClient) runSentinel(replica bool, cmds [][]string) ([]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		st, err := c.topologyState()
+		if err != nil {
+			return nil, err
+		}
+
+		if replica && len(st.replicas) > 0 {
+			replies, err := c.node(st.replicas[rand.Intn(len(st.replicas))], false).Do(cmds...)
+			if err == nil {
+				return replies, nil
+			}
+			// Replicas being unavailable are no reason to fail the read
+			c.resetState()
+		}
+
+		replies, err := c.node(st.primary, false).Do(cmds...)
+		if err != nil {
+			c.resetState()
+			return nil, err
+		}
+
+		// A master demoted by a failover rejects writes, the commands were
+		// not executed and are sent to the new master once
+		if attempt == 0 && redisHasReply(replies, "READONLY ") {
+			c.resetState()
+			continue
+		}
+		return replies, nil
+	}
+}
+
+func (c *redisClient) runCluster(replica bool, cmds [][]string) ([]interface{}, error) {
+	st, err := c.topologyState()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		order   []string
+		batches = map[string][]int{}
+	)
+	for i, cmd := range cmds {
+		addr := st.nodeFor(cmd, replica)
+		if _, ok := batches[addr]; !ok {
+			order = append(order, addr)
+		}
+		batches[addr] = append(batches[addr], i)
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for _, addr := range order {
+		batch := make([][]string, len(batches[addr]))
+		for n, i := range batches[addr] {
+			batch[n] = cmds[i]
+		}
+
+		batchReplies, err := c.node(addr, false).Do(batch...)
+		if err != nil {
+			c.resetState()
+			return nil, err
+		}
+		for n, i := range batches[addr] {
+			replies[i] = batchReplies[n]
+		}
+	}
+
+	// Slots moved to other nodes, commands redirected ones are sent
+	// again one by one
+	for i := range replies {
+		if rerr, ok := replies[i].(redisError); ok && redisRedirect(rerr) != "" {
+			if replies[i], err = c.redirect(cmds[i], rerr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return replies, nil
+}
+
+// redirect follows the MOVED and ASK replies of the Cluster
+func (c *redisClient) redirect(cmd []string, rerr redisError) (interface{}, error) {
+	var reply interface{} = rerr
+	for n := 0; n < redisMaxRedirects; n++ {
+		rerr, ok := reply.(redisError)
+		if !ok || redisRedirect(rerr) == "" {
+			return reply, nil
+		}
+
+		addr := redisRedirect(rerr)
+		if strings.HasPrefix(string(rerr), "ASK ") {
+			// The slot is being migrated, only this command is sent to the
+			// target node
+			replies, err := c.node(addr, false).Do([]string{"ASKING"}, cmd)
+			if err != nil {
+				return nil, err
+			}
+			reply = replies[1]
+			continue
+		}
+
+		c.resetState()
+		replies, err := c.node(addr, false).Do(cmd)
+		if err != nil {
+			return nil, err
+		}
+		reply = replies[0]
+	}
+
+	return reply, nil
+}
+
+// redisRedirect returns the node of a MOVED or ASK reply
+func redisRedirect(rerr redisError) string {
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return ""
+	}
+	return fields[2]
+}
+
+// redisPipelineError returns the first error reply of a pipeline
+func redisPipelineError(replies []interface{}) error {
+	for _, r := range replies {
+		if rerr, ok := r.(redisError); ok {
+			return rerr
+		}
+	}
+	return nil
+}
+
+func redisHasReply(replies []interface{}, prefix string) bool {
+	for _, r := range replies {
+		if rerr, ok := r.(redisError); ok && strings.HasPrefix(string(rerr), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// topologyState returns the discovered nodes, discovering them again
+// after errors and once the redisTopologyTTL passed
+func (c *redisClient) topologyState() (*redisTopologyState, error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.state != nil && c.state.expires.After(time.Now()) {
+		return c.state, nil
+	}
+
+	var (
+		st  *redisTopologyState
+		err error
+	)
+	for _, addr := range c.addrs {
+		if c.topology == redisTopologySentinel {
+			st, err = c.discoverSentinel(addr)
+		} else {
+			st, err = c.discoverCluster(addr)
+		}
+		if err == nil {
+			st.expires = time.Now().Add(redisTopologyTTL)
+			c.state = st
+			return st, nil
+		}
+	}
+
+	return nil, errors.Wrap(err, "Unable to discover Redis nodes")
+}
+
+func (c *redisClient) resetState() {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.state = nil
+}
+
+func (c *redisClient) discoverSentinel(addr string) (*redisTopologyState, error) {
+	cmds := [][]string{{"SENTINEL", "get-master-addr-by-name", c.master}}
+	if c.readFromReplica {
+		cmds = append(cmds, []string{"SENTINEL", "replicas", c.master})
+	}
+
+	replies, err := c.sentinel(addr).Do(cmds...)
+	if err != nil {
+		return nil, err
+	}
+
+	master, ok := replies[0].([]interface{})
+	if !ok || len(master) != 2 {
+		return nil, errors.Errorf("Sentinel %s does not know master %q", addr, c.master)
+	}
+	host, _ := master[0].(string)
+	port, _ := master[1].(string)
+	st := &redisTopologyState{primary: net.JoinHostPort(host, port)}
+
+	if len(replies) > 1 {
+		replicas, _ := replies[1].([]interface{})
+		for _, r := range replicas {
+			fields := redisFields(r)
+			if strings.Contains(fields["flags"], "down") || strings.Contains(fields["flags"], "disconnected") {
+				continue
+			}
+			st.replicas = append(st.replicas, net.JoinHostPort(fields["ip"], fields["port"]))
+		}
+	}
+
+	return st, nil
+}
+
+func (c *redisClient) discoverCluster(addr string) (*redisTopologyState, error) {
+	replies, err := c.node(addr, false).Do([]string{"CLUSTER", "SLOTS"})
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := replies[0].(redisError); ok {
+		return nil, rerr
+	}
+
+	seedHost, _, _ := net.SplitHostPort(addr)
+	nodeAddr := func(v interface{}) string {
+		node, _ := v.([]interface{})
+		if len(node) < 2 {
+			return ""
+		}
+		host, _ := node[0].(string)
+		port, _ := node[1].(int64)
+		if host == "" || host == "?" {
+			// The node did not announce its address, it is the one asked
+			host = seedHost
+		}
+		return net.JoinHostPort(host, strconv.FormatInt(port, 10))
+	}
+
+	st := &redisTopologyState{}
+	ranges, _ := replies[0].([]interface{})
+	for _, v := range ranges {
+		r, _ := v.([]interface{})
+		if len(r) < 3 {
+			continue
+		}
+		start, _ := r[0].(int64)
+		end, _ := r[1].(int64)
+
+		slots := redisSlotRange{start: int(start), end: int(end), primary: nodeAddr(r[2])}
+		for _, replica := range r[3:] {
+			if a := nodeAddr(replica); a != "" {
+				slots.replicas = append(slots.replicas, a)
+			}
+		}
+		st.slots = append(st.slots, slots)
+	}
+
+	if len(st.slots) == 0 {
+		return nil, errors.Errorf("Cluster node %s has no slots assigned", addr)
+	}
+	return st, nil
+}
+
+// nodeFor returns the node the command is sent to: The owner of the slot
+// of its key or any node for commands without key
+func (s *redisTopologyState) nodeFor(cmd []string, replica bool) string {
+	slots := s.slots[0]
+	if key, ok := redisCommandKey(cmd); ok {
+		slot := redisKeySlot(key)
+		for _, r := range s.slots {
+			if slot >= r.start && slot <= r.end {
+				slots = r
+				break
+			}
+		}
+	}
+
+	if replica && len(slots.replicas) > 0 {
+		return redisReplicaPrefix + slots.replicas[rand.Intn(len(slots.replicas))]
+	}
+	return slots.primary
+}
+
+// redisCommandKey returns the first key of the command, all commands
+// used by nginx-sso have their key as first argument except for scripts
+func redisCommandKey(cmd []string) (string, bool) {
+	switch strings.ToUpper(cmd[0]) {
+	case "EVAL", "EVALSHA":
+		if len(cmd) > 3 && cmd[2] != "0" {
+			return cmd[3], true
+		}
+		return "", false
+	case "PING", "CLUSTER", "ASKING", "READONLY":
+		return "", false
+	}
+
+	if len(cmd) > 1 {
+		return cmd[1], true
+	}
+	return "", false
+}
+
+// redisKeySlot returns the Cluster slot of the key (CRC16 of the key or
+// its hash tag modulo the number of slots)
+func redisKeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return int(crc) % redisClusterSlots
+}
+
+// redisFields converts a reply of alternating field names and values
+// into a map
+func redisFields(reply interface{}) map[string]string {
+	values, _ := reply.([]interface{})
+	fields := map[string]string{}
+	for i := 0; i+1 < len(values); i += 2 {
+		k, _ := values[i].(string)
+		v, _ := values[i+1].(string)
+		fields[k] = v
+	}
+	return fields
+}
+
+// node returns the connection to a data node, addresses prefixed with
+// redisReplicaPrefix are Cluster replicas accepting reads
+func (c *redisClient) node(addr string, sentinel bool) *redisConn {
+	key := addr
+	if sentinel {
+		key = "sentinel:" + addr
+	}
+
+	c.connsLock.Lock()
+	defer c.connsLock.Unlock()
+
+	if conn, ok := c.conns[key]; ok {
+		return conn
+	}
+
+	conn := &redisConn{addr: strings.TrimPrefix(addr, redisReplicaPrefix)}
+	if c.tls {
+		host, _, _ := net.SplitHostPort(conn.addr)
+		conn.tls = &tls.Config{ServerName: host}
+	}
+
+	username, password := c.username, c.password
+	if sentinel {
+		username, password = "", c.sentinelPassword
+	}
+	switch {
+	case username != "" && password != "":
+		conn.setup = append(conn.setup, []string{"AUTH", username, password})
+	case password != "":
+		conn.setup = append(conn.setup, []string{"AUTH", password})
+	}
+	if c.db > 0 && !sentinel {
+		conn.setup = append(conn.setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if strings.HasPrefix(addr, redisReplicaPrefix) {
+		conn.setup = append(conn.setup, []string{"READONLY"})
+	}
+
+	c.conns[key] = conn
+	return conn
+}
+
+func (c *redisClient) sentinel(addr string) *redisConn { return c.node(addr, true) }
+
+// redisConn is a connection to a single node
+type redisConn struct {
+	addr  string
+	tls   *tls.Config
+	setup [][]string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+// Do sends the commands in one batch and returns their replies, error
+// replies are returned as redisError values. On network errors the
+// connection is dropped to be re-established on the next call.
+func (c *redisConn) Do(cmds ...[]string) ([]interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := c.do(cmds...)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return replies, err
+}
+
+func (c *redisConn) connect() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to connect to Redis %s", c.addr)
+	}
+
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+
+	if len(c.setup) == 0 {
+		return nil
+	}
+
+	replies, err := c.do(c.setup...)
+	if err == nil {
+		for i, reply := range replies {
+			if rerr, ok := reply.(redisError); ok {
+				err = errors.Wrapf(rerr, "Unable to execute %s", c.setup[i][0])
+				break
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (c *redisConn) do(cmds ...[]string) ([]interface{}, error) {
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, "*"+strconv.Itoa(len(args))+"\r\n"...)
+		for _, a := range args {
+			buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"+a+"\r\n"...)
+		}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		reply, err := c.readReply()
+		if rerr, ok := err.(redisError); ok {
+			reply = rerr
+		} else if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+
+	return replies, nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("Invalid empty Redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			// Error replies within arrays are returned as values
+			v, err := c.readReply()
+			if rerr, ok := err.(redisError); ok {
+				v = rerr
+			} else if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+
+	default:
+		return nil, errors.Errorf("Invalid Redis reply type %q", line[0])
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedisKeySlot(t *testing.T) {
+	if slot := redisKeySlot("123456789"); slot != 12739 {
+		t.Errorf("Expected slot 12739, got %d", slot)
+	}
+	if redisKeySlot("{user1000}.following") != redisKeySlot("{user1000}.followers") {
+		t.Error("Expected keys with the same hash tag to share the slot")
+	}
+	if redisKeySlot("foo{}{bar}") == redisKeySlot("bar") {
+		t.Error("Expected empty hash tag to be ignored")
+	}
+}
+
+func TestParseRedisURI(t *testing.T) {
+	for uri, expect := range map[string]string{
+		"redis://localhost":                                              "single [localhost:6379] db=0",
+		"rediss://:pw@redis.example.com:6380/3":                          "single [redis.example.com:6380] db=3 tls",
+		"redis+sentinel://s1,s2:26380,[::1]/mymaster/2":                  "sentinel [s1:26379 s2:26380 [::1]:26379] master=mymaster db=2",
+		"redis+sentinel://:pw@s1/mymaster?sentinel_password=sp":          "sentinel [s1:26379] master=mymaster db=0",
+		"rediss+cluster://:pw@a:7000,b:7001,c/?read_from_replica=true":   "cluster [a:7000 b:7001 c:6379] db=0 tls replica",
+		"redis+cluster://a:7000,b:7001":                                  "cluster [a:7000 b:7001] db=0",
+		"redis://a,b":                                                    "error",
+		"redis://localhost?read_from_replica=true":                       "error",
+		"redis+sentinel://s1":                                            "error",
+		"redis+cluster://a:7000/1":                                       "error",
+		"redis+cluster://a:7000?sentinel_password=sp":                    "error",
+		"redis+cluster://a:7000,,b:7001":                                 "error",
+		"memcache://localhost":                                           "error",
+		"redis+sentinel://:pw@s1/mymaster?read_from_replica=maybe":       "error",
+		"redis+sentinel://user:pw@s1,s2/mymaster?read_from_replica=true": "sentinel [s1:26379 s2:26379] master=mymaster db=0 replica",
+	} {
+		c, err := parseRedisURI(uri)
+		if err != nil {
+			if expect != "error" {
+				t.Errorf("Unable to parse %q: %s", uri, err)
+			}
+			continue
+		}
+
+		desc := fmt.Sprintf("%s %v", c.topology, c.addrs)
+		if c.master != "" {
+			desc += " master=" + c.master
+		}
+		desc += fmt.Sprintf(" db=%d", c.db)
+		if c.tls {
+			desc += " tls"
+		}
+		if c.readFromReplica {
+			desc += " replica"
+		}
+		if desc != expect {
+			t.Errorf("Expected %q to be parsed to %q, got %q", uri, expect, desc)
+		}
+	}
+}
+
+func TestRedisSentinel(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		commands = map[string][]string{}
+		record   = func(node string, cmd []string) {
+			lock.Lock()
+			defer lock.Unlock()
+			commands[node] = append(commands[node], strings.Join(cmd, " "))
+		}
+		nodeReply = func(node string) func([]string) string {
+			return func(cmd []string) string {
+				record(node, cmd)
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case cmd[0] == "AUTH":
+					return "+OK\r\n"
+				case node == "old" && cmd[0] == "SET":
+					return "-READONLY You can't write against a read only replica.\r\n"
+				case cmd[0] == "GET":
+					return "$" + fmt.Sprint(len(node)) + "\r\n" + node + "\r\n"
+				}
+				return "+OK\r\n"
+			}
+		}
+	)
+
+	oldAddr, closeOld := serveFakeRedis(t, nodeReply("old"))
+	defer closeOld()
+	newAddr, closeNew := serveFakeRedis(t, nodeReply("new"))
+	defer closeNew()
+
+	asked := 0
+	sentinelAddr, closeSentinel := serveFakeRedis(t, func(cmd []string) string {
+		record("sentinel", cmd)
+		if cmd[0] == "AUTH" {
+			return "+OK\r\n"
+		}
+		if cmd[1] == "replicas" {
+			host, port, _ := net.SplitHostPort(newAddr)
+			return fmt.Sprintf("*1\r\n*6\r\n$2\r\nip\r\n$%d\r\n%s\r\n$4\r\nport\r\n$%d\r\n%s\r\n$5\r\nflags\r\n$5\r\nslave\r\n", len(host), host, len(port), port)
+		}
+
+		// The first answer is the master before the failover
+		addr := oldAddr
+		if asked++; asked > 1 {
+			addr = newAddr
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+	})
+	defer closeSentinel()
+
+	c, err := parseRedisURI("redis+sentinel://:secret@127.0.0.1:1," + sentinelAddr + "/mymaster?sentinel_password=sp&read_from_replica=true")
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+
+	// Reads are sent to the replica
+	if reply, err := c.Read("GET", "key"); err != nil || reply != "new" {
+		t.Errorf("Expected read from replica, got %v: %v", reply, err)
+	}
+	if reply, err := c.Do("GET", "key"); err != nil || reply != "old" {
+		t.Errorf("Expected read from master, got %v: %v", reply, err)
+	}
+
+	// Writes rejected by the demoted master are sent to the new one
+	if _, err := c.Do("SET", "key", "value"); err != nil {
+		t.Fatalf("Expected write to succeed after failover: %s", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if cmds := commands["sentinel"]; len(cmds) < 2 || cmds[0] != "AUTH sp" || !strings.HasPrefix(cmds[1], "SENTINEL get-master-addr-by-name mymaster") {
+		t.Errorf("Unexpected commands sent to the sentinel: %v", cmds)
+	}
+	if cmds := commands["new"]; len(cmds) != 3 || cmds[0] != "AUTH secret" || cmds[2] != "SET key value" {
+		t.Errorf("Unexpected commands sent to the new master: %v", cmds)
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		commands = map[string][]string{}
+		addrs    = map[string]string{}
+	)
+
+	// Node a owns the lower half of the slots but migrates the "ask-"
+	// keys to b, node b owns the upper half with the "moved-" keys having
+	// been moved to a
+	node := func(name string) func([]string) string {
+		return func(cmd []string) string {
+			lock.Lock()
+			defer lock.Unlock()
+			commands[name] = append(commands[name], strings.Join(cmd, " "))
+
+			switch cmd[0] {
+			case "CLUSTER":
+				entry := func(start, end int, addr string) string {
+					host, port, _ := net.SplitHostPort(addr)
+					return fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", start, end, len(host), host, port)
+				}
+				return "*2\r\n" + entry(0, 8191, addrs["a"]) + entry(8192, 16383, addrs["b"])
+			case "GET":
+				switch {
+				case name == "b" && strings.HasPrefix(cmd[1], "moved-"):
+					return fmt.Sprintf("-MOVED %d %s\r\n", redisKeySlot(cmd[1]), addrs["a"])
+				case name == "a" && strings.HasPrefix(cmd[1], "ask-") && commands[name][len(commands[name])-2] != "ASKING":
+					return fmt.Sprintf("-ASK %d %s\r\n", redisKeySlot(cmd[1]), addrs["b"])
+				}
+				return fmt.Sprintf("$%d\r\n%s\r\n", len(name), name)
+			}
+			return "+OK\r\n"
+		}
+	}
+
+	addrA, closeA := serveFakeRedis(t, node("a"))
+	defer closeA()
+	addrB, closeB := serveFakeRedis(t, node("b"))
+	defer closeB()
+	lock.Lock()
+	addrs["a"], addrs["b"] = addrA, addrB
+	lock.Unlock()
+
+	c, err := parseRedisURI("redis+cluster://" + addrB)
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+
+	// keyFor returns a key with the prefix owned by node a or b
+	keyFor := func(prefix string, lower bool) string {
+		for i := 0; ; i++ {
+			if key := fmt.Sprintf("%s%d", prefix, i); (redisKeySlot(key) < 8192) == lower {
+				return key
+			}
+		}
+	}
+	keyA, keyB := keyFor("key-", true), keyFor("key-", false)
+
+	replies, err := c.Pipeline(
+		[]string{"GET", keyA},
+		[]string{"GET", keyB},
+		[]string{"GET", keyFor("moved-", false)},
+		[]string{"GET", keyFor("ask-", true)},
+		[]string{"EVAL", "return 1", "1", keyB},
+	)
+	if err != nil {
+		t.Fatalf("Unable to execute pipeline: %s", err)
+	}
+	if fmt.Sprint(replies) != "[a b a b OK]" {
+		t.Errorf("Unexpected replies %v", replies)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if cmds := commands["b"]; len(cmds) != 6 || cmds[0] != "CLUSTER SLOTS" || cmds[4] != "ASKING" {
+		t.Errorf("Unexpected commands sent to node b: %v", cmds)
+	}
+}
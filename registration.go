@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const (
+	registrationPath      = "/register"
+	registrationKeyPrefix = "nginx-sso:registration:"
+
+	registrationStateUnverified = "unverified"
+	registrationStatePending    = "pending"
+	registrationStateApproved   = "approved"
+	registrationStateRejected   = "rejected"
+
+	defaultRegistrationLifetime = 24 * time.Hour
+	defaultRegistrationSubject  = "Confirm your mail address"
+	defaultRegistrationBody     = `Hello {{ user }},
+
+thank you for signing up. Open the link below to confirm your mail address:
+
+{{ url }}
+
+The link is valid until {{ expires }}. After the confirmation your account needs to be approved by an administrator before you can log in. If you did not sign up you can ignore this mail.
+`
+)
+
+var (
+	errRegistrationInvalid       = errors.New("The confirmation link is invalid or has expired")
+	errRegistrationNotFound      = errors.New("Registration not found")
+	errRegistrationDecided       = errors.New("Registration is not pending")
+	errRegistrationUsernameTaken = registrationInputError("This username is already taken")
+
+	registrationUsernameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{1,63}$`)
+
+	defaultRegistrationRateLimit = tokenBucket{Rate: 5, Interval: time.Hour}
+
+	// sendRegistrationMail delivers the confirmation link, replaced in tests
+	sendRegistrationMail = func(c registrationConfig, to, body string) error {
+		return c.SMTP.Send(c.from, to, c.subject(), body)
+	}
+
+	registrationStores     = map[string]*registrationStore{}
+	registrationStoresLock sync.Mutex
+)
+
+// registrationInputError describes why the registration form was
+// rejected, the message is shown to the user
+type registrationInputError string
+
+func (r registrationInputError) Error() string { return string(r) }
+
+// registrationConfig enables the sign-up of new users. Registrations
+// need a confirmed mail address and the approval of an admin, approved
+// users are provisioned into the SCIM store and log in through the
+// simple provider.
+type registrationConfig struct {
+	Store     string        `yaml:"store"`
+	URL       string        `yaml:"url"`
+	Secret    string        `yaml:"secret"`
+	Lifetime  time.Duration `yaml:"lifetime"`
+	From      string        `yaml:"from"`
+	Subject   string        `yaml:"subject"`
+	Body      string        `yaml:"body"`
+	SMTP      smtpConfig    `yaml:"smtp"`
+	RateLimit *tokenBucket  `yaml:"rate_limit"`
+
+	from *mail.Address
+	body *pongo2.Template
+}
+
+// Enabled returns whether a store for the registrations is configured
+func (c registrationConfig) Enabled() bool { return c.Store != "" }
+
+// Load checks the configuration and compiles the mail template
+func (c *registrationConfig) Load(scim scimConfig) error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if scim.Store == "" {
+		return errors.New("Approved users are kept in the SCIM store which needs to be configured")
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("URL of the login needs to be an absolute http or https URL")
+	}
+
+	if len(c.Secret) < passwordResetMinSecretLength {
+		return errors.Errorf("Secret needs to be at least %d characters long", passwordResetMinSecretLength)
+	}
+
+	if c.Lifetime < 0 {
+		return errors.New("Lifetime must not be negative")
+	}
+
+	if c.from, err = mail.ParseAddress(c.From); err != nil {
+		return errors.Wrap(err, "Invalid sender address")
+	}
+
+	if err := c.SMTP.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid SMTP config")
+	}
+
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return errors.Wrap(err, "Invalid rate limit")
+		}
+	}
+
+	body := c.Body
+	if body == "" {
+		body = defaultRegistrationBody
+	}
+	c.body, err = pongo2.FromString("{% autoescape off %}" + body + "{% endautoescape %}")
+	return errors.Wrap(err, "Invalid body template")
+}
+
+func (c registrationConfig) lifetime() time.Duration {
+	if c.Lifetime == 0 {
+		return defaultRegistrationLifetime
+	}
+	return c.Lifetime
+}
+
+func (c registrationConfig) rateLimit() tokenBucket {
+	if c.RateLimit == nil {
+		return defaultRegistrationRateLimit
+	}
+	return *c.RateLimit
+}
+
+func (c registrationConfig) subject() string {
+	if c.Subject == "" {
+		return defaultRegistrationSubject
+	}
+	return c.Subject
+}
+
+// registrationClaims are signed into the confirmation link. The link is
+// single-use as the confirmation moves the registration out of the
+// unverified state.
+type registrationClaims struct {
+	ID      string `json:"i"`
+	Expires int64  `json:"e"`
+}
+
+func (c registrationConfig) issueToken(id string, now time.Time) (string, error) {
+	return signMailToken(c.Secret, "registration", registrationClaims{ID: id, Expires: now.Add(c.lifetime()).Unix()})
+}
+
+func (c registrationConfig) parseToken(token string, now time.Time) (registrationClaims, error) {
+	var claims registrationClaims
+	if !verifyMailToken(c.Secret, "registration", token, &claims) || claims.ID == "" || now.Unix() > claims.Expires {
+		return claims, errRegistrationInvalid
+	}
+	return claims, nil
+}
+
+// checkRateLimit takes a token from the bucket of the client IP and
+// returns the time to wait if it is empty
+func (c registrationConfig) checkRateLimit(r *http.Request) time.Duration {
+	store, err := getRateLimitStore(getMainConfig().Cluster.storeFor(""))
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to access registration rate limit store")
+		return 0
+	}
+
+	wait, err := store.Take(registrationKeyPrefix+"ip:"+getMainConfig().trustedClientIP(r), c.rateLimit(), time.Now())
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to check registration rate limit")
+		return 0
+	}
+	return wait
+}
+
+// registration is a sign-up of a user waiting for the confirmation of
+// the mail address or the decision of an admin
+type registration struct {
+	ID           string     `json:"id"`
+	UserName     string     `json:"user_name"`
+	Email        string     `json:"email"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	State        string     `json:"state"`
+	Created      time.Time  `json:"created"`
+	Verified     *time.Time `json:"verified,omitempty"`
+	Decided      *time.Time `json:"decided,omitempty"`
+	DecidedBy    string     `json:"decided_by,omitempty"`
+}
+
+// registrationStore keeps the registrations in a JSON file
+type registrationStore struct {
+	path string
+	data struct {
+		Registrations []registration `json:"registrations"`
+	}
+
+	lock sync.Mutex
+}
+
+// getRegistrationStore returns the store for the file, it is read once
+// and kept across configuration reloads
+func getRegistrationStore(path string) (*registrationStore, error) {
+	registrationStoresLock.Lock()
+	defer registrationStoresLock.Unlock()
+
+	if s, ok := registrationStores[path]; ok {
+		return s, nil
+	}
+
+	s := &registrationStore{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		// Nobody signed up yet
+	case err != nil:
+		return nil, errors.Wrap(err, "Unable to read registration store")
+	default:
+		if err := json.Unmarshal(data, &s.data); err != nil {
+			return nil, errors.Wrap(err, "Unable to parse registration store")
+		}
+	}
+
+	registrationStores[path] = s
+	return s, nil
+}
+
+// save persists the store. Must be called with the lock held.
+func (s *registrationStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal registration store")
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+// prune removes registrations whose mail address was not confirmed
+// within the lifetime of the link. Must be called with the lock held.
+func (s *registrationStore) prune(now time.Time, lifetime time.Duration) {
+	kept := s.data.Registrations[:0]
+	for _, reg := range s.data.Registrations {
+		if reg.State == registrationStateUnverified && now.Sub(reg.Created) > lifetime {
+			continue
+		}
+		kept = append(kept, reg)
+	}
+	s.data.Registrations = kept
+}
+
+// Create adds the registration unless the username is claimed by
+// another open registration. If the mail address is already used by an
+// open registration nothing is stored and false is returned.
+func (s *registrationStore) Create(reg registration, lifetime time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.prune(reg.Created, lifetime)
+
+	for _, other := range s.data.Registrations {
+		if other.State == registrationStateRejected {
+			continue
+		}
+		if strings.EqualFold(other.UserName, reg.UserName) {
+			return false, errRegistrationUsernameTaken
+		}
+		if strings.EqualFold(other.Email, reg.Email) {
+			return false, nil
+		}
+	}
+
+	s.data.Registrations = append(s.data.Registrations, reg)
+	return true, s.save()
+}
+
+// Verify marks the mail address of the registration as confirmed and
+// returns whether the state of the registration changed
+func (s *registrationStore) Verify(id string, now time.Time) (registration, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.data.Registrations {
+		reg := &s.data.Registrations[i]
+		if reg.ID != id {
+			continue
+		}
+
+		switch reg.State {
+		case registrationStateUnverified:
+			reg.State = registrationStatePending
+			reg.Verified = &now
+			return *reg, true, s.save()
+
+		case registrationStatePending:
+			// The link was opened twice
+			return *reg, false, nil
+		}
+		break
+	}
+
+	return registration{}, false, errRegistrationInvalid
+}
+
+// List returns the registrations in the given state (or all if the
+// state is empty) without their password hashes
+func (s *registrationStore) List(state string) []registration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	out := []registration{}
+	for _, reg := range s.data.Registrations {
+		if state != "" && reg.State != state {
+			continue
+		}
+		reg.PasswordHash = ""
+		out = append(out, reg)
+	}
+	return out
+}
+
+// Decide approves or rejects the pending registration. Approved users
+// are provisioned before the decision is stored.
+func (s *registrationStore) Decide(id, state, admin string, now time.Time) (registration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.data.Registrations {
+		reg := &s.data.Registrations[i]
+		if reg.ID != id {
+			continue
+		}
+
+		if reg.State != registrationStatePending {
+			return *reg, errRegistrationDecided
+		}
+
+		if state == registrationStateApproved {
+			if err := provisionRegistration(*reg, now); err != nil {
+				return *reg, err
+			}
+		}
+
+		reg.State = state
+		reg.Decided = &now
+		reg.DecidedBy = admin
+		reg.PasswordHash = ""
+		return *reg, s.save()
+	}
+
+	return registration{}, errRegistrationNotFound
+}
+
+// provisionRegistration creates the active user for the approved
+// registration in the SCIM store
+func provisionRegistration(reg registration, now time.Time) error {
+	store := getSCIMStore()
+	if store == nil {
+		return errors.New("SCIM store is not configured")
+	}
+
+	return store.addUser(scimUser{
+		ID:           reg.ID,
+		UserName:     reg.UserName,
+		Emails:       []scimEmail{{Value: reg.Email, Primary: true}},
+		Active:       true,
+		PasswordHash: reg.PasswordHash,
+		Created:      now,
+		LastModified: now,
+	})
+}
+
+// registrationNameTaken checks the users configured in the simple
+// provider and the provisioned users for the username
+func registrationNameTaken(r *http.Request, username string) bool {
+	if store := getSCIMStore(); store != nil {
+		if _, ok := store.userByName(username); ok {
+			return true
+		}
+	}
+
+	for _, a := range requestAuthenticators(r) {
+		if s, ok := a.(*authSimple); ok {
+			for user := range s.Users {
+				if strings.EqualFold(user, username) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// handleRegistrationRequest shows the sign-up form, stores the
+// registration on POST and confirms the mail address when the link
+// from the mail is opened
+func handleRegistrationRequest(res http.ResponseWriter, r *http.Request) {
+	cfg := getMainConfig().Registration
+	if !cfg.Enabled() {
+		http.NotFound(res, r)
+		return
+	}
+
+	var (
+		status = http.StatusOK
+		step   = "register"
+		token  = r.FormValue("token")
+		errMsg string
+	)
+
+	switch {
+	case token != "":
+		step = "confirm"
+
+		claims, err := cfg.parseToken(token, time.Now())
+		if err != nil {
+			status, step, errMsg = http.StatusBadRequest, "register", err.Error()
+			break
+		}
+
+		// Opening the link only shows a button to keep mail scanners
+		// following links from confirming the address
+		if r.Method != http.MethodPost {
+			break
+		}
+
+		if err := verifyRegistration(r, cfg, claims); err != nil {
+			status, step, errMsg = http.StatusBadRequest, "register", err.Error()
+			if err != errRegistrationInvalid {
+				requestLog(r).WithError(err).Error("Unable to confirm registration")
+				status, errMsg = http.StatusInternalServerError, "Something went wrong, please try again"
+			}
+			break
+		}
+		step = "verified"
+
+	case r.Method == http.MethodPost:
+		if wait := cfg.checkRateLimit(r); wait > 0 {
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			status, errMsg = http.StatusTooManyRequests, "Too many registrations, please try again later"
+			break
+		}
+
+		if r.PostFormValue("password") != r.PostFormValue("password_confirm") {
+			status, errMsg = http.StatusBadRequest, "The passwords do not match"
+			break
+		}
+
+		err := register(r, cfg, strings.TrimSpace(r.PostFormValue("username")), strings.TrimSpace(r.PostFormValue("email")), r.PostFormValue("password"))
+		switch err.(type) {
+		case nil:
+			step = "sent"
+		case passwordPolicyViolation, registrationInputError:
+			status, errMsg = http.StatusBadRequest, err.Error()
+		default:
+			requestLog(r).WithError(err).Error("Unable to store registration")
+			status, errMsg = http.StatusInternalServerError, "Something went wrong, please try again"
+		}
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("register.html"))
+	body, err := tpl.ExecuteBytes(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"email":      r.PostFormValue("email"),
+		"error":      errMsg,
+		"login":      getMainConfig().Login,
+		"policy":     getMainConfig().PasswordPolicy.view(),
+		"step":       step,
+		"token":      token,
+		"username":   r.PostFormValue("username"),
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+// register validates the form and stores the registration. The mail
+// with the confirmation link is sent in the background.
+func register(r *http.Request, cfg registrationConfig, username, email, password string) error {
+	if !registrationUsernameRegex.MatchString(username) {
+		return registrationInputError("Username must consist of 2 to 64 letters, digits, dots, dashes or underscores")
+	}
+
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return registrationInputError("Please enter a valid mail address")
+	}
+
+	if len(password) > bcryptMaxPasswordLength {
+		return errPasswordTooLongForBcrypt
+	}
+	if err := getMainConfig().PasswordPolicy.Check(username, "", password); err != nil {
+		return err
+	}
+
+	if registrationNameTaken(r, username) {
+		return errRegistrationUsernameTaken
+	}
+
+	store, err := getRegistrationStore(cfg.Store)
+	if err != nil {
+		return err
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+
+	hash, err := scimHashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	created, err := store.Create(registration{
+		ID:           id,
+		UserName:     username,
+		Email:        email,
+		PasswordHash: hash,
+		State:        registrationStateUnverified,
+		Created:      now.UTC(),
+	}, cfg.lifetime())
+	if err != nil {
+		return err
+	}
+
+	getMainConfig().AuditLog.Log(auditEventRegistrationRequested, r, map[string]string{"username": username})
+	if !created {
+		// The response does not reveal the address to be registered
+		return nil
+	}
+
+	token, err := cfg.issueToken(id, now)
+	if err != nil {
+		return err
+	}
+
+	body, err := cfg.body.Execute(pongo2.Context{
+		"expires": now.Add(cfg.lifetime()).Format("2006-01-02 15:04 MST"),
+		"url":     strings.TrimRight(cfg.URL, "/") + registrationPath + "?token=" + url.QueryEscape(token),
+		"user":    username,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to render registration mail")
+	}
+
+	logger := requestLog(r).WithField("username", username)
+	go func() {
+		if err := sendRegistrationMail(cfg, email, body); err != nil {
+			logger.WithError(err).Error("Unable to send registration mail")
+			return
+		}
+		logger.Info("Sent registration mail")
+	}()
+
+	return nil
+}
+
+// verifyRegistration confirms the mail address of the registration in
+// the token, afterwards it waits for the approval of an admin
+func verifyRegistration(r *http.Request, cfg registrationConfig, claims registrationClaims) error {
+	store, err := getRegistrationStore(cfg.Store)
+	if err != nil {
+		return err
+	}
+
+	reg, changed, err := store.Verify(claims.ID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		getMainConfig().AuditLog.Log(auditEventRegistrationVerified, r, map[string]string{"username": reg.UserName})
+	}
+	return nil
+}
+
+func handleAdminRegistrationsRequest(res http.ResponseWriter, r *http.Request) {
+	admin, ok := detectAdmin(res, r)
+	if !ok {
+		return
+	}
+
+	if !getMainConfig().Registration.Enabled() {
+		http.Error(res, "Registration is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	store, err := getRegistrationStore(getMainConfig().Registration.Store)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to open registration store")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		res.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(res).Encode(store.List(r.URL.Query().Get("state"))); err != nil {
+			requestLog(r).WithError(err).Error("Unable to encode registrations")
+		}
+
+	case http.MethodPost:
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(res, "Parameter id is required", http.StatusBadRequest)
+			return
+		}
+
+		var (
+			state string
+			event auditEvent
+		)
+		switch r.FormValue("action") {
+		case "approve":
+			state, event = registrationStateApproved, auditEventRegistrationApproved
+		case "reject":
+			state, event = registrationStateRejected, auditEventRegistrationRejected
+		default:
+			http.Error(res, "Parameter action needs to be approve or reject", http.StatusBadRequest)
+			return
+		}
+
+		reg, err := store.Decide(id, state, admin, time.Now().UTC())
+		switch err {
+		case nil:
+			// Decision stored
+
+		case errRegistrationNotFound:
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+
+		case errRegistrationDecided, errSCIMUniqueness:
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+
+		default:
+			requestLog(r).WithError(err).Error("Unable to decide registration")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(event, r, map[string]string{
+			"admin":    admin,
+			"username": reg.UserName,
+		})
+		res.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
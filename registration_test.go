@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistrationFlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-registration")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := initializeSCIM(scimConfig{Store: filepath.Join(dir, "scim.json"), Tokens: []string{"token"}}); err != nil {
+		t.Fatalf("Unable to initialize SCIM store: %s", err)
+	}
+	defer initializeSCIM(scimConfig{})
+
+	mails := make(chan [2]string, 1)
+	prevSend, prevAuthenticators, prevFrontend, prevRegistration := sendRegistrationMail, getAuthenticatorSnapshot(), getMainConfig().Frontend, getMainConfig().Registration
+	defer func() {
+		sendRegistrationMail, getMainConfig().Frontend, getMainConfig().Registration = prevSend, prevFrontend, prevRegistration
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	sendRegistrationMail = func(c registrationConfig, to, body string) error {
+		mails <- [2]string{to, body}
+		return nil
+	}
+	setAuthenticators([]authenticator{&authSimple{Users: map[string]string{"alice": "$2a$10$"}}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().Registration = registrationConfig{
+		Store:  filepath.Join(dir, "registrations.json"),
+		URL:    "https://login.example.com",
+		Secret: strings.Repeat("s", 32),
+		From:   "SSO <sso@example.com>",
+		SMTP:   smtpConfig{Server: "mail.example.com:587"},
+		// The tests sign up more often than the default limit allows
+		RateLimit: &tokenBucket{Rate: 100, Interval: time.Minute},
+	}
+	if err := getMainConfig().Registration.Load(scimConfig{Store: "scim.json"}); err != nil {
+		t.Fatalf("Unable to load registration: %s", err)
+	}
+
+	csrf := strings.Repeat("c", 43)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		form.Set(csrfFieldName, csrf)
+		r := httptest.NewRequest(http.MethodPost, registrationPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: getMainConfig().GetCookieName(r, csrfCookieSuffix), Value: csrf})
+
+		res := httptest.NewRecorder()
+		withCSRFProtection(handleRegistrationRequest)(res, r)
+		return res
+	}
+	signUp := func(user, email string) *httptest.ResponseRecorder {
+		return post(url.Values{"username": {user}, "email": {email}, "password": {"sign-up-secret"}, "password_confirm": {"sign-up-secret"}})
+	}
+
+	for user, email := range map[string]string{
+		"Alice":   "alice@example.com",
+		"b":       "bob@example.com",
+		"bob":     "Bob <bob@example.com>",
+		"bob bob": "bob@example.com",
+	} {
+		if res := signUp(user, email); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected registration of %q <%s> to be rejected, got %d", user, email, res.Code)
+		}
+	}
+
+	if res := signUp("bob", "bob@example.com"); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "A link to confirm your mail address") {
+		t.Fatalf("Expected registration to be stored, got %d", res.Code)
+	}
+
+	var mail [2]string
+	select {
+	case mail = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected confirmation mail to be sent")
+	}
+	if mail[0] != "bob@example.com" {
+		t.Errorf("Expected mail to bob@example.com, got %s", mail[0])
+	}
+	link := regexp.MustCompile(`https://login\.example\.com/register\?token=(\S+)`).FindStringSubmatch(mail[1])
+	if link == nil {
+		t.Fatalf("Expected link in mail: %s", mail[1])
+	}
+	token, _ := url.QueryUnescape(link[1])
+
+	if res := signUp("BOB", "other@example.com"); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected username of open registration to be taken, got %d", res.Code)
+	}
+	if res := signUp("robert", "bob@example.com"); res.Code != http.StatusOK {
+		t.Errorf("Expected same response for registered mail address, got %d", res.Code)
+	}
+	select {
+	case mail = <-mails:
+		t.Errorf("Expected no mail for registered address, got one to %s", mail[0])
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	store, err := getRegistrationStore(getMainConfig().Registration.Store)
+	if err != nil {
+		t.Fatalf("Unable to open registration store: %s", err)
+	}
+	regs := store.List(registrationStateUnverified)
+	if len(regs) != 1 || regs[0].PasswordHash != "" {
+		t.Fatalf("Expected one unverified registration without hash, got %#v", regs)
+	}
+	id := regs[0].ID
+
+	if _, err := store.Decide(id, registrationStateApproved, "admin", time.Now()); err != errRegistrationDecided {
+		t.Errorf("Expected unverified registration not to be approvable, got %v", err)
+	}
+
+	// Opening the link only shows the confirmation button
+	res := httptest.NewRecorder()
+	handleRegistrationRequest(res, httptest.NewRequest(http.MethodGet, registrationPath+"?token="+link[1], nil))
+	if !strings.Contains(res.Body.String(), "Confirm mail address") || len(store.List(registrationStatePending)) != 0 {
+		t.Errorf("Expected confirmation form, got %d", res.Code)
+	}
+
+	if res := post(url.Values{"token": {token}}); !strings.Contains(res.Body.String(), "needs to approve your account") {
+		t.Fatalf("Expected mail address to be confirmed, got %d", res.Code)
+	}
+	if len(store.List(registrationStatePending)) != 1 {
+		t.Error("Expected registration to be pending")
+	}
+
+	scim := getSCIMStore()
+	if _, ok := scim.Authenticate("bob", "sign-up-secret"); ok {
+		t.Error("Expected pending user not to be able to log in")
+	}
+
+	if _, err := store.Decide(id, registrationStateApproved, "admin", time.Now()); err != nil {
+		t.Fatalf("Expected registration to be approved, got %v", err)
+	}
+	if user, ok := scim.Authenticate("bob", "sign-up-secret"); !ok || user != "bob" {
+		t.Error("Expected approved user to be able to log in")
+	}
+	if _, err := store.Decide(id, registrationStateRejected, "admin", time.Now()); err != errRegistrationDecided {
+		t.Errorf("Expected decision to be final, got %v", err)
+	}
+
+	// The store is persisted without the hash of approved users
+	data, _ := ioutil.ReadFile(getMainConfig().Registration.Store)
+	if !strings.Contains(string(data), `"state": "approved"`) || strings.Contains(string(data), "password_hash") {
+		t.Errorf("Unexpected registration store: %s", data)
+	}
+}
@@ -1,156 +1,456 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/Luzifer/nginx-sso/plugins"
 	log "github.com/sirupsen/logrus"
 )
 
-type authenticator interface {
-	// AuthenticatorID needs to return an unique string to identify
-	// this special authenticator
-	AuthenticatorID() (id string)
-
-	// Configure loads the configuration for the Authenticator from the
-	// global config.yaml file which is passed as a byte-slice.
-	// If no configuration for the Authenticator is supplied the function
-	// needs to return the errProviderUnconfigured
-	Configure(yamlSource []byte) (err error)
-
-	// DetectUser is used to detect a user without a login form from
-	// a cookie, header or other methods
-	// If no user was detected the errNoValidUserFound needs to be
-	// returned
-	DetectUser(res http.ResponseWriter, r *http.Request) (user string, groups []string, err error)
-
-	// Login is called when the user submits the login form and needs
-	// to authenticate the user or throw an error. If the user has
-	// successfully logged in the persistent cookie should be written
-	// in order to use DetectUser for the next login.
-	// With the login result an array of mfaConfig must be returned. In
-	// case there is no MFA config or the provider does not support MFA
-	// return nil.
-	// If the user did not login correctly the errNoValidUserFound
-	// needs to be returned
-	Login(res http.ResponseWriter, r *http.Request) (user string, mfaConfigs []mfaConfig, err error)
-
-	// LoginFields needs to return the fields required for this login
-	// method. If no login using this method is possible the function
-	// needs to return nil.
-	LoginFields() (fields []loginField)
-
-	// Logout is called when the user visits the logout endpoint and
-	// needs to destroy any persistent stored cookies
-	Logout(res http.ResponseWriter, r *http.Request) (err error)
-
-	// SupportsMFA returns the MFA detection capabilities of the login
-	// provider. If the provider can provide mfaConfig objects from its
-	// configuration return true. If this is true the login interface
-	// will display an additional field for this provider for the user
-	// to fill in their MFA token.
-	SupportsMFA() bool
-}
-
-type loginField struct {
-	Label       string
-	Name        string
-	Placeholder string
-	Type        string
-}
+// The authenticator interface and registry live in pkg/auth to be
+// embeddable into other services
+type (
+	authenticator = auth.Authenticator
+	loginField    = auth.LoginField
+)
+
+const defaultProviderTimeout = 10 * time.Second
 
 var (
-	errProviderUnconfigured = errors.New("No valid configuration found for this provider")
-	errNoValidUserFound     = errors.New("No valid users found")
+	errProviderUnconfigured = auth.ErrProviderUnconfigured
+	errNoUser               = auth.ErrNoUser
+	errWrongCredentials     = auth.ErrWrongCredentials
+	errMFARequired          = auth.ErrMFARequired
+	errBackendUnavailable   = auth.ErrBackendUnavailable
+
+	errAuthenticatorNotConfigured = errors.New("Authenticator is not configured")
+	errLastAuthenticator          = errors.New("The last enabled authenticator can't be disabled")
+
+	authenticatorRegistry = auth.NewRegistry()
+
+	// authenticatorState holds the *authenticatorSnapshot used by the
+	// requests. It is replaced as a whole so requests read it without
+	// locking, authenticatorStateLock serializes the replacements.
+	authenticatorState     atomic.Value
+	authenticatorStateLock sync.Mutex
+	// disabledAuthenticators is kept outside of the config to survive
+	// reloads like the maintenance mode, it is guarded by the
+	// authenticatorStateLock
+	disabledAuthenticators = map[string]bool{}
+)
 
-	authenticatorRegistry      = []authenticator{}
-	authenticatorRegistryMutex sync.RWMutex
+// authenticatorSnapshot is the immutable set of authenticators in use:
+// configured contains the authenticators of the configuration including
+// the ones disabled through the admin API, active the enabled ones
+type authenticatorSnapshot struct {
+	active     []authenticator
+	configured []authenticator
+}
 
-	activeAuthenticators = []authenticator{}
-)
+func getAuthenticatorSnapshot() *authenticatorSnapshot {
+	if s, ok := authenticatorState.Load().(*authenticatorSnapshot); ok {
+		return s
+	}
+	return &authenticatorSnapshot{}
+}
 
 func registerAuthenticator(a authenticator) {
-	authenticatorRegistryMutex.Lock()
-	defer authenticatorRegistryMutex.Unlock()
+	authenticatorRegistry.Register(a)
+}
 
-	authenticatorRegistry = append(authenticatorRegistry, a)
+// configureAuthenticators configures new instances of all registered
+// authenticators, they need to be activated using setAuthenticators
+func configureAuthenticators(yamlSource []byte) ([]authenticator, error) {
+	return authenticatorRegistry.Configure(yamlSource)
 }
 
-func initializeAuthenticators(yamlSource []byte) error {
-	authenticatorRegistryMutex.Lock()
-	defer authenticatorRegistryMutex.Unlock()
+func setAuthenticators(a []authenticator) {
+	authenticatorStateLock.Lock()
+	defer authenticatorStateLock.Unlock()
 
-	tmp := []authenticator{}
-	for _, a := range authenticatorRegistry {
-		err := a.Configure(yamlSource)
+	authenticatorState.Store(&authenticatorSnapshot{active: enabledAuthenticators(a), configured: a})
+}
 
-		switch err {
-		case nil:
-			tmp = append(tmp, a)
-			log.WithFields(log.Fields{"authenticator": a.AuthenticatorID()}).Debug("Activated authenticator")
-		case errProviderUnconfigured:
-			log.WithFields(log.Fields{"authenticator": a.AuthenticatorID()}).Debug("Authenticator unconfigured")
-			// This is okay.
-		default:
-			return fmt.Errorf("Authenticator configuration caused an error: %s", err)
+// enabledAuthenticators filters the disabled authenticators. If all of
+// them are disabled (for example the others were removed by a reload)
+// the disabled ones are ignored as no login would be possible. The
+// caller needs to hold the authenticatorStateLock.
+func enabledAuthenticators(a []authenticator) []authenticator {
+	out := []authenticator{}
+	for _, auth := range a {
+		if !disabledAuthenticators[auth.AuthenticatorID()] {
+			out = append(out, auth)
 		}
 	}
 
-	if len(tmp) == 0 {
-		return fmt.Errorf("No authenticator configurations supplied")
+	if len(out) == 0 && len(a) > 0 {
+		log.Warn("All authenticators are disabled, ignoring the disabled state")
+		return a
 	}
+	return out
+}
 
-	activeAuthenticators = tmp
+// setAuthenticatorEnabled enables or disables a configured authenticator
+// at runtime by swapping the active authenticators. Requests being
+// processed keep using the previous authenticators.
+func setAuthenticatorEnabled(id string, enabled bool) error {
+	authenticatorStateLock.Lock()
+	defer authenticatorStateLock.Unlock()
+
+	configured := getAuthenticatorSnapshot().configured
+
+	var (
+		found     bool
+		remaining int
+	)
+	for _, a := range configured {
+		switch {
+		case a.AuthenticatorID() == id:
+			found = true
+		case !disabledAuthenticators[a.AuthenticatorID()]:
+			remaining++
+		}
+	}
+
+	if !found {
+		return errAuthenticatorNotConfigured
+	}
+	if !enabled && remaining == 0 {
+		return errLastAuthenticator
+	}
+
+	if enabled {
+		delete(disabledAuthenticators, id)
+	} else {
+		disabledAuthenticators[id] = true
+	}
 
+	authenticatorState.Store(&authenticatorSnapshot{active: enabledAuthenticators(configured), configured: configured})
 	return nil
 }
 
+// providerContext derives the context passed to the providers from the
+// request: It is canceled when the client goes away or the provider
+// does not respond within the provider_timeout. The session meta and
+// other request state is kept in the request so it can't be replaced
+// by a request with the derived context.
+func providerContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := getMainConfig().ProviderTimeout
+	if timeout <= 0 {
+		timeout = defaultProviderTimeout
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// callWithContext is used for backend clients without support for a
+// context: It returns the error of the context as soon as it ends while
+// fn is left to finish in the background, bounded only by the timeouts
+// of the client itself.
+func callWithContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return backendUnavailable(ctx.Err())
+	}
+}
+
+// backendUnavailable marks the error of a backend call as an outage
+func backendUnavailable(err error) error {
+	if err == nil || errors.Is(err, errBackendUnavailable) {
+		return err
+	}
+	return &plugins.AuthError{Kind: errBackendUnavailable, Err: err}
+}
+
+// providerError classifies the error returned by a provider: Errors
+// returned after the context of the call ended are caused by the
+// provider taking too long or the client going away.
+func providerError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, errNoUser) {
+		return backendUnavailable(err)
+	}
+	return err
+}
+
 func detectUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
-	authenticatorRegistryMutex.RLock()
-	defer authenticatorRegistryMutex.RUnlock()
-
-	for _, a := range activeAuthenticators {
-		user, groups, err := a.DetectUser(res, r)
-		switch err {
-		case nil:
-			return user, groups, err
-		case errNoValidUserFound:
-			// This is okay.
-		default:
-			return "", nil, err
+	if e, ok := getMainConfig().DetectCache.Get(r); ok {
+		setSessionMeta(r, e.Meta)
+		return e.User, getMainConfig().Roles.Apply(e.Groups), nil
+	}
+
+	if getMainConfig().DetectCache.IsNegative(r) {
+		return "", nil, errNoUser
+	}
+
+	return detectUserCoalesced(res, r)
+}
+
+// resolveUser asks the authenticators and group providers for the user
+// of the request and caches the result in the detect cache
+func resolveUser(res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	a, user, groups, err := detectAuthenticator(res, r, requestAuthenticators(r))
+	if err != nil {
+		if errors.Is(err, errNoUser) {
+			getMainConfig().DetectCache.SetNegative(r)
 		}
+		return "", nil, err
+	}
+
+	setSessionProvider(r, a.AuthenticatorID())
+	if groups, err = resolveGroups(r, user, a.AuthenticatorID(), groups); err != nil {
+		return "", nil, err
 	}
+	meta, _ := getSessionMeta(r)
+	getMainConfig().DetectCache.Set(res, r, detectCacheEntry{User: user, Groups: groups, Meta: meta})
+	return user, getMainConfig().Roles.Apply(groups), nil
+}
+
+// detectResult is the outcome of one authenticator detecting the user
+// of a request handled concurrently with the other authenticators
+type detectResult struct {
+	index   int
+	user    string
+	groups  []string
+	err     error
+	meta    sessionMeta
+	hasMeta bool
+	header  http.Header
+}
 
-	return "", nil, errNoValidUserFound
+// detectRecorder collects the headers written by an authenticator
+// detecting the user concurrently with the other authenticators
+type detectRecorder struct {
+	header http.Header
+}
+
+func (d *detectRecorder) Header() http.Header         { return d.header }
+func (d *detectRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (d *detectRecorder) WriteHeader(status int)      {}
+
+// detectAuthenticator asks the authenticators for the user of the
+// request. Multiple authenticators are asked concurrently and the first
+// one detecting the user wins, authenticators finishing at the same
+// time are decided by their order. An error of an authenticator is
+// only returned if no other one detected the user.
+func detectAuthenticator(res http.ResponseWriter, r *http.Request, authenticators []authenticator) (authenticator, string, []string, error) {
+	switch len(authenticators) {
+	case 0:
+		return nil, "", nil, errNoUser
+
+	case 1:
+		a := authenticators[0]
+		user, groups, err := callDetectUser(a, res, r)
+		if err != nil {
+			clearSessionMeta(r)
+			return nil, "", nil, err
+		}
+		return a, user, groups, nil
+	}
+
+	// The copies of the request share the parsed form, plugins parsing
+	// it concurrently would race for the body
+	r.ParseForm()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	results := make(chan detectResult, len(authenticators))
+	for i, a := range authenticators {
+		go func(i int, a authenticator) {
+			fr := r.WithContext(ctx)
+			copyRequestValues(r, fr)
+			clearSessionMeta(fr)
+
+			rec := &detectRecorder{header: http.Header{}}
+			result := detectResult{index: i, header: rec.header}
+			result.user, result.groups, result.err = callDetectUser(a, rec, fr)
+			result.meta, result.hasMeta = getSessionMeta(fr)
+
+			clearRequestValues(fr)
+			results <- result
+		}(i, a)
+	}
+
+	var (
+		done   = make([]*detectResult, len(authenticators))
+		winner *detectResult
+	)
+	for n := 0; n < len(authenticators) && winner == nil; n++ {
+		result := <-results
+		done[result.index] = &result
+		if result.err != nil {
+			continue
+		}
+
+		// Collect the results already available to decide between
+		// authenticators finishing at the same time by their order
+		for collecting := true; collecting; {
+			select {
+			case other := <-results:
+				done[other.index] = &other
+				n++
+			default:
+				collecting = false
+			}
+		}
+
+		for _, d := range done {
+			if d != nil && d.err == nil {
+				winner = d
+				break
+			}
+		}
+	}
+
+	if winner != nil {
+		// The authenticators still running are canceled and their
+		// responses are discarded
+		copyHeader(res, winner.header)
+		if winner.hasMeta {
+			setSessionMeta(r, winner.meta)
+		} else {
+			clearSessionMeta(r)
+		}
+		return authenticators[winner.index], winner.user, winner.groups, nil
+	}
+
+	clearSessionMeta(r)
+	var err error = errNoUser
+	for _, d := range done {
+		// All authenticators finished, their responses are kept as they
+		// would have been when asking them one after another (for
+		// example removing invalid cookies)
+		copyHeader(res, d.header)
+		if err == errNoUser && !errors.Is(d.err, errNoUser) {
+			err = d.err
+		}
+	}
+	return nil, "", nil, err
+}
+
+// callDetectUser asks the authenticator for the user of the request
+// bound to the provider timeout
+func callDetectUser(a authenticator, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	s := startSpan(r, "detect_user "+a.AuthenticatorID())
+	ctx, cancel := providerContext(r)
+	defer cancel()
+
+	release, err := acquireProvider(ctx, a.AuthenticatorID())
+	if err != nil {
+		s.endAuthentication(a.AuthenticatorID(), err)
+		return "", nil, err
+	}
+
+	user, groups, err := a.DetectUser(ctx, res, r)
+	release()
+	err = providerError(ctx, err)
+	s.endAuthentication(a.AuthenticatorID(), err)
+
+	return user, groups, err
+}
+
+func copyHeader(res http.ResponseWriter, header http.Header) {
+	for k, values := range header {
+		for _, v := range values {
+			res.Header().Add(k, v)
+		}
+	}
 }
 
 func loginUser(res http.ResponseWriter, r *http.Request) (string, []mfaConfig, error) {
-	authenticatorRegistryMutex.RLock()
-	defer authenticatorRegistryMutex.RUnlock()
+	loginErr := errNoUser
+
+	for _, a := range requestAuthenticators(r) {
+		s := startSpan(r, "login "+a.AuthenticatorID())
+		ctx, cancel := providerContext(r)
+		release, err := acquireProvider(ctx, a.AuthenticatorID())
+		var (
+			user    string
+			mfaCfgs []mfaConfig
+		)
+		if err == nil {
+			user, mfaCfgs, err = a.Login(ctx, res, r)
+			release()
+			err = providerError(ctx, err)
+		}
+		cancel()
+		s.endAuthentication(a.AuthenticatorID(), err)
 
-	for _, a := range activeAuthenticators {
-		user, mfaCfgs, err := a.Login(res, r)
-		switch err {
-		case nil:
+		switch {
+		case err == nil:
+			setSessionProvider(r, a.AuthenticatorID())
 			return user, mfaCfgs, nil
-		case errNoValidUserFound:
-			// This is okay.
+		case errors.Is(err, errNoUser):
+			// This is okay, keep the first error in case it tells more
+			// about the failure (wrong password, message for the user)
+			// and no other authenticator accepts the login
+			if loginErr == errNoUser {
+				loginErr = err
+			}
 		default:
 			return "", nil, err
 		}
 	}
 
-	return "", nil, errNoValidUserFound
+	return "", nil, loginErr
+}
+
+// upstreamLogouter is implemented by authenticators relying on a session
+// at an upstream identity provider which can be terminated on logout.
+// If the provider requires the user to visit its logout endpoint the
+// URL to redirect to is returned, the provider needs to send the user
+// to returnTo afterwards.
+type upstreamLogouter interface {
+	UpstreamLogout(res http.ResponseWriter, r *http.Request, returnTo string) (redirect string, err error)
+}
+
+// externalLoginProvider is implemented by authenticators sending the
+// user to an external identity provider (OAuth, OIDC, SAML) instead of
+// showing login fields. They are shown as buttons on the login page and
+// need to send the user to returnTo after the login.
+type externalLoginProvider interface {
+	ExternalLoginURL(res http.ResponseWriter, r *http.Request, returnTo string) (redirect string, err error)
+}
+
+// passwordChanger is implemented by authenticators owning the
+// credentials of their users. ChangePassword needs to verify the old
+// password and return errPasswordMismatch if it does not match or a
+// passwordPolicyViolation if the backend rejects the new password.
+type passwordChanger interface {
+	CanChangePassword(r *http.Request, user string) bool
+	ChangePassword(r *http.Request, user, oldPassword, newPassword string) error
+}
+
+// passwordResetter is implemented by authenticators able to set the
+// password of their users without knowing the current one.
+// PasswordResetAccount looks up the user by the entered username and
+// returns the account passed to ResetPassword and the mail address to
+// send the link to. Unknown users and users without mail address need
+// to return errNoUser.
+type passwordResetter interface {
+	PasswordResetAccount(username string) (account, email string, err error)
+	ResetPassword(account, newPassword string) error
 }
 
 func logoutUser(res http.ResponseWriter, r *http.Request) error {
-	authenticatorRegistryMutex.RLock()
-	defer authenticatorRegistryMutex.RUnlock()
+	getMainConfig().DetectCache.Invalidate(r)
 
-	for _, a := range activeAuthenticators {
-		if err := a.Logout(res, r); err != nil {
+	for _, a := range requestAuthenticators(r) {
+		ctx, cancel := providerContext(r)
+		err := providerError(ctx, a.Logout(ctx, res, r))
+		cancel()
+		if err != nil {
 			return err
 		}
 	}
@@ -158,21 +458,46 @@ func logoutUser(res http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func getFrontendAuthenticators() map[string][]loginField {
-	authenticatorRegistryMutex.RLock()
-	defer authenticatorRegistryMutex.RUnlock()
-
+func getFrontendAuthenticators(r *http.Request) map[string][]loginField {
 	output := map[string][]loginField{}
-	for _, a := range activeAuthenticators {
+	for _, a := range requestAuthenticators(r) {
 		if len(a.LoginFields()) == 0 {
 			continue
 		}
 		output[a.AuthenticatorID()] = a.LoginFields()
 
-		if a.SupportsMFA() && !mainCfg.Login.HideMFAField {
+		if a.SupportsMFA() && !getMainConfig().Login.HideMFAField {
 			output[a.AuthenticatorID()] = append(output[a.AuthenticatorID()], mfaLoginField)
 		}
 	}
 
 	return output
 }
+
+// selectLoginMethod returns the login method shown when the login page
+// is opened: The method requested through the method parameter (set by
+// the tabs and kept after a failed login to not depend on JavaScript for
+// switching), the configured default method or the first active one.
+func selectLoginMethod(r *http.Request, methods map[string][]loginField) string {
+	candidates := []string{r.URL.Query().Get("method"), getMainConfig().Login.DefaultMethod}
+	if rl := getRealm(r); rl != nil && rl.Login.DefaultMethod != "" {
+		candidates[1] = rl.Login.DefaultMethod
+	}
+
+	for _, method := range candidates {
+		if _, ok := methods[method]; ok {
+			return method
+		}
+	}
+
+	names := make([]string, 0, len(methods))
+	for method := range methods {
+		names = append(names, method)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+	"github.com/Luzifer/nginx-sso/plugins"
+	"github.com/pkg/errors"
+)
+
+func TestProviderTimeout(t *testing.T) {
+	// Accepts connections but never answers the manager bind
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	prevAuthenticators, prevTimeout := getAuthenticatorSnapshot(), getMainConfig().ProviderTimeout
+	defer func() {
+		getMainConfig().ProviderTimeout = prevTimeout
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authLDAP{Server: "ldap://" + ln.Addr().String(), EnableBasicAuth: true}})
+	getMainConfig().ProviderTimeout = 100 * time.Millisecond
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.SetBasicAuth("alice", "secret")
+
+	start := time.Now()
+	if _, _, err := detectUser(httptest.NewRecorder(), r); !errors.Is(err, errBackendUnavailable) {
+		t.Errorf("Expected unresponsive backend to be reported as unavailable, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Expected detection to be aborted after the provider_timeout, took %s", d)
+	}
+
+	if err := callWithContext(r.Context(), func() error { return errNoUser }); err != errNoUser {
+		t.Errorf("Expected error of the call to be returned, got %v", err)
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	for _, err := range []error{errWrongCredentials, errMFARequired, errors.Wrap(errWrongCredentials, "Login failed")} {
+		if !errors.Is(err, errNoUser) {
+			t.Errorf("Expected %v to match errNoUser", err)
+		}
+	}
+	if errors.Is(backendUnavailable(io.EOF), errNoUser) || !errors.Is(backendUnavailable(io.EOF), io.EOF) {
+		t.Error("Expected outage to keep the cause and not to match errNoUser")
+	}
+
+	err := errors.Wrap(&plugins.AuthError{Kind: errWrongCredentials, Message: "error_account_disabled"}, "Login failed")
+	if !errors.Is(err, errWrongCredentials) || errors.Is(err, errBackendUnavailable) || plugins.ErrorMessage(err) != "error_account_disabled" {
+		t.Errorf("Expected kind and message to be found in %v", err)
+	}
+
+	// Untranslated messages fall back to the message of the status
+	if key := errorMessage(httptest.NewRequest(http.MethodPost, "/login", nil), err); key != "" {
+		t.Errorf("Expected untranslated message to be ignored, got %q", key)
+	}
+	if key := (loginOutcome{Status: loginStatusUnavailable}).ErrorKey(); key != "error_unavailable" {
+		t.Errorf("Expected message of the status, got %q", key)
+	}
+	if key := (loginOutcome{Status: loginStatusInvalidCredentials, Message: "error_account_disabled"}).ErrorKey(); key != "error_account_disabled" {
+		t.Errorf("Expected message of the provider, got %q", key)
+	}
+}
+
+type testDetectAuthenticator struct {
+	authToken
+
+	id     string
+	detect func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error)
+}
+
+func (t *testDetectAuthenticator) AuthenticatorID() string { return t.id }
+
+func (t *testDetectAuthenticator) DetectUser(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+	return t.detect(ctx, res, r)
+}
+
+func TestParallelDetectUser(t *testing.T) {
+	prevAuthenticators := getAuthenticatorSnapshot()
+	defer authenticatorState.Store(prevAuthenticators)
+
+	canceled := make(chan struct{})
+	slow := &testDetectAuthenticator{id: "slow", detect: func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+		res.Header().Set("X-Slow", "1")
+		<-ctx.Done()
+		close(canceled)
+		return "", nil, ctx.Err()
+	}}
+	fast := &testDetectAuthenticator{id: "fast", detect: func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+		res.Header().Set("X-Fast", "1")
+		setSessionClaims(r, map[string]string{"source": "fast"})
+		return "alice", []string{"staff"}, nil
+	}}
+	broken := &testDetectAuthenticator{id: "broken", detect: func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+		return "", nil, backendUnavailable(io.EOF)
+	}}
+	none := &testDetectAuthenticator{id: "none", detect: func(ctx context.Context, res http.ResponseWriter, r *http.Request) (string, []string, error) {
+		res.Header().Add("Set-Cookie", "none=; Max-Age=0")
+		return "", nil, errNoUser
+	}}
+
+	// A slow authenticator does not delay the one detecting the user
+	setAuthenticators([]authenticator{slow, fast})
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	res := httptest.NewRecorder()
+	start := time.Now()
+	user, groups, err := detectUser(res, r)
+	if err != nil || user != "alice" || len(groups) != 1 {
+		t.Fatalf("Expected alice to be detected, got %q %v: %v", user, groups, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected detection not to wait for the slow authenticator, took %s", d)
+	}
+	if res.Header().Get("X-Fast") != "1" || res.Header().Get("X-Slow") != "" {
+		t.Errorf("Expected only the headers of the detecting authenticator, got %v", res.Header())
+	}
+	if meta, _ := getSessionMeta(r); meta.Provider != "fast" || meta.Claims["source"] != "fast" {
+		t.Errorf("Expected session metadata of the detecting authenticator, got %+v", meta)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected the slow authenticator to be canceled")
+	}
+
+	// Errors are only returned if no authenticator detected the user
+	setAuthenticators([]authenticator{broken, fast})
+	if user, _, err := detectUser(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/auth", nil)); err != nil || user != "alice" {
+		t.Errorf("Expected user to be detected despite the failing authenticator, got %q: %v", user, err)
+	}
+
+	setAuthenticators([]authenticator{none, broken})
+	res = httptest.NewRecorder()
+	if _, _, err := detectUser(res, httptest.NewRequest(http.MethodGet, "/auth", nil)); !errors.Is(err, errBackendUnavailable) {
+		t.Errorf("Expected error of the failing authenticator, got %v", err)
+	}
+	if res.Header().Get("Set-Cookie") == "" {
+		t.Error("Expected headers of the authenticators not detecting a user to be kept")
+	}
+}
+
+// testWrappedUnconfiguredAuthenticator reports its missing
+// configuration wrapped into another error
+type testWrappedUnconfiguredAuthenticator struct{ authSimple }
+
+func (t *testWrappedUnconfiguredAuthenticator) AuthenticatorID() string { return "wrapped" }
+
+func (t *testWrappedUnconfiguredAuthenticator) Configure(yamlSource []byte) error {
+	return errors.Wrap(errProviderUnconfigured, "No wrapped section found")
+}
+
+func TestConfigureAuthenticatorsWrappedUnconfigured(t *testing.T) {
+	prev := authenticatorRegistry
+	authenticatorRegistry = auth.NewRegistry(&testWrappedUnconfiguredAuthenticator{}, &authSimple{})
+	defer func() { authenticatorRegistry = prev }()
+
+	authenticators, err := configureAuthenticators([]byte("providers:\n  simple:\n    users:\n      alice: \"$2a$10$...\"\n"))
+	if err != nil {
+		t.Fatalf("Expected wrapped unconfigured error to be skipped, got %s", err)
+	}
+	if len(authenticators) != 1 || authenticators[0].AuthenticatorID() != "simple" {
+		t.Errorf("Expected only the simple authenticator, got %v", authenticators)
+	}
+}
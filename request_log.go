@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+
+	requestIDHeader = "X-Request-ID"
+)
+
+// requestIDFormat restricts propagated request IDs to prevent injecting
+// arbitrary content into logs and response headers
+var requestIDFormat = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func configureLogFormat(format string) error {
+	switch format {
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	case logFormatText, "":
+		log.SetFormatter(&log.TextFormatter{})
+	default:
+		return errors.Errorf("Log format %q is invalid, use %q or %q", format, logFormatText, logFormatJSON)
+	}
+
+	return nil
+}
+
+// withRequestID assigns a correlation ID to the request and returns it
+// in the X-Request-ID response header
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		res.Header().Set(requestIDHeader, assignRequestID(r))
+		next.ServeHTTP(res, r)
+	})
+}
+
+// assignRequestID attaches the X-Request-ID passed by the proxy to the
+// request or generates a new one if none or an invalid one was passed
+func assignRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDFormat.MatchString(id) {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
+
+	context.Set(r, requestIDContextKey, id)
+	return id
+}
+
+func getRequestID(r *http.Request) string {
+	id, _ := context.Get(r, requestIDContextKey).(string)
+	return id
+}
+
+// requestLog returns a logger for entries produced while handling the
+// request carrying its correlation ID and the trace ID if the request
+// is traced
+func requestLog(r *http.Request) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if id := getRequestID(r); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+	if id := getTraceID(r); id != "" {
+		entry = entry.WithField("trace_id", id)
+	}
+	return entry
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/context"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var logged interface{}
+	handler := withRequestID(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		logged = requestLog(r).Data["request_id"]
+	}))
+
+	for _, tc := range []struct {
+		header    string
+		propagate bool
+	}{
+		{"7f3c2a9e5b1d4c8f", true},
+		{"", false},
+		{"evil\nvalue", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		if tc.header != "" {
+			r.Header.Set(requestIDHeader, tc.header)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, r)
+		context.Clear(r)
+
+		id := res.Header().Get(requestIDHeader)
+		if tc.propagate != (id == tc.header) || !requestIDFormat.MatchString(id) {
+			t.Errorf("Unexpected request ID %q for header %q", id, tc.header)
+		}
+		if logged != id {
+			t.Errorf("Expected log entries to carry request ID %q, got %v", id, logged)
+		}
+	}
+
+	if err := configureLogFormat("xml"); err == nil {
+		t.Error("Expected invalid log format to be rejected")
+	}
+}
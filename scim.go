@@ -0,0 +1,541 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	scimPathPrefix = "/scim/v2/"
+
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaPatchOp      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimSchemaSPConfig     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+)
+
+var (
+	errSCIMNotFound   = errors.New("Resource not found")
+	errSCIMUniqueness = errors.New("Resource with this name already exists")
+
+	scimFilterRegex      = regexp.MustCompile(`^(\w+)\s+eq\s+"([^"]*)"$`)
+	scimEmailPathRegex   = regexp.MustCompile(`^emails\[type eq "(\w+)"\]\.value$`)
+	scimMemberPathRegex  = regexp.MustCompile(`^members\[value eq "([^"]+)"\]$`)
+	scimDefaultListCount = 100
+)
+
+// scimConfig enables the SCIM 2.0 provisioning endpoint. Provisioned
+// users can log in through the simple provider.
+type scimConfig struct {
+	Store  string   `yaml:"store"`
+	Tokens []string `yaml:"tokens"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimUser struct {
+	ID           string      `json:"id"`
+	ExternalID   string      `json:"external_id,omitempty"`
+	UserName     string      `json:"user_name"`
+	DisplayName  string      `json:"display_name,omitempty"`
+	GivenName    string      `json:"given_name,omitempty"`
+	FamilyName   string      `json:"family_name,omitempty"`
+	Emails       []scimEmail `json:"emails,omitempty"`
+	Active       bool        `json:"active"`
+	PasswordHash string      `json:"password_hash,omitempty"`
+	Created      time.Time   `json:"created"`
+	LastModified time.Time   `json:"last_modified"`
+}
+
+// primaryEmail returns the primary address or the first one if none
+// is marked as primary
+func (u scimUser) primaryEmail() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+type scimGroup struct {
+	ID           string    `json:"id"`
+	ExternalID   string    `json:"external_id,omitempty"`
+	DisplayName  string    `json:"display_name"`
+	Members      []string  `json:"members"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type scimStore struct {
+	config scimConfig
+	data   struct {
+		Users  []scimUser  `json:"users"`
+		Groups []scimGroup `json:"groups"`
+	}
+
+	lock sync.RWMutex
+}
+
+var (
+	activeSCIMStore      *scimStore
+	activeSCIMStoreMutex sync.RWMutex
+)
+
+// initializeSCIM loads the provisioned users and groups. Without
+// configured store the SCIM endpoint is disabled.
+func initializeSCIM(c scimConfig) error {
+	activate, err := prepareSCIM(c)
+	if err != nil {
+		return err
+	}
+	activate()
+	return nil
+}
+
+// prepareSCIM reads the store without replacing the active one, the
+// returned function activates it
+func prepareSCIM(c scimConfig) (func(), error) {
+	var s *scimStore
+	if c.Store != "" {
+		if len(c.Tokens) == 0 {
+			return nil, fmt.Errorf("At least one token is required to protect the SCIM endpoint")
+		}
+
+		s = &scimStore{config: c}
+
+		data, err := ioutil.ReadFile(c.Store)
+		switch {
+		case os.IsNotExist(err):
+			// Nothing provisioned yet
+		case err != nil:
+			return nil, errors.Wrap(err, "Unable to read SCIM store")
+		default:
+			if err := json.Unmarshal(data, &s.data); err != nil {
+				return nil, errors.Wrap(err, "Unable to parse SCIM store")
+			}
+		}
+	}
+
+	return func() {
+		activeSCIMStoreMutex.Lock()
+		defer activeSCIMStoreMutex.Unlock()
+
+		activeSCIMStore = s
+	}, nil
+}
+
+func getSCIMStore() *scimStore {
+	activeSCIMStoreMutex.RLock()
+	defer activeSCIMStoreMutex.RUnlock()
+
+	return activeSCIMStore
+}
+
+// save persists the store. Must be called with the lock held.
+func (s *scimStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal SCIM store")
+	}
+
+	return writeFileAtomic(s.config.Store, data)
+}
+
+// userByName returns the provisioned user with the given name
+func (s *scimStore) userByName(name string) (scimUser, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, u := range s.data.Users {
+		if strings.EqualFold(u.UserName, name) {
+			return u, true
+		}
+	}
+	return scimUser{}, false
+}
+
+// Authenticate checks the password of an active provisioned user and
+// returns the user name as provisioned
+func (s *scimStore) Authenticate(name, password string) (string, bool) {
+	u, ok := s.userByName(name)
+	if !ok || !u.Active || u.PasswordHash == "" {
+		return "", false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return "", false
+	}
+
+	return u.UserName, true
+}
+
+// hasPassword returns whether the user is active and has a password to
+// log in with
+func (s *scimStore) hasPassword(name string) bool {
+	u, ok := s.userByName(name)
+	return ok && u.Active && u.PasswordHash != ""
+}
+
+// ChangePassword verifies the old password of the provisioned user and
+// replaces it
+func (s *scimStore) ChangePassword(name, oldPassword, newPassword string) error {
+	return s.setPassword(name, newPassword, func(u scimUser) error {
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(oldPassword)) != nil {
+			return errPasswordMismatch
+		}
+		return nil
+	})
+}
+
+// ResetPassword replaces the password of the provisioned user without
+// verifying the old one
+func (s *scimStore) ResetPassword(name, newPassword string) error {
+	return s.setPassword(name, newPassword, func(scimUser) error { return nil })
+}
+
+// setPassword replaces the password of an active user with password
+// after the verify function accepted the user
+func (s *scimStore) setPassword(name, newPassword string, verify func(scimUser) error) error {
+	if len(newPassword) > bcryptMaxPasswordLength {
+		return errPasswordTooLongForBcrypt
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.data.Users {
+		u := &s.data.Users[i]
+		if !strings.EqualFold(u.UserName, name) {
+			continue
+		}
+
+		if !u.Active || u.PasswordHash == "" {
+			return errPasswordChangeUnsupported
+		}
+		if err := verify(*u); err != nil {
+			return err
+		}
+
+		hash, err := scimHashPassword(newPassword)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+		u.LastModified = time.Now()
+
+		return s.save()
+	}
+
+	return errPasswordChangeUnsupported
+}
+
+// passwordResetAccount returns the name and primary mail address of an
+// active user with password
+func (s *scimStore) passwordResetAccount(name string) (string, string, bool) {
+	u, ok := s.userByName(name)
+	if !ok || !u.Active || u.PasswordHash == "" || u.primaryEmail() == "" {
+		return "", "", false
+	}
+	return u.UserName, u.primaryEmail(), true
+}
+
+// addUser provisions the user created outside of the SCIM endpoint, for
+// example by an approved registration
+func (s *scimStore) addUser(u scimUser) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.checkUserName(u.UserName, u.ID); err != nil {
+		return err
+	}
+
+	s.data.Users = append(s.data.Users, u)
+	if err := s.save(); err != nil {
+		s.data.Users = s.data.Users[:len(s.data.Users)-1]
+		return err
+	}
+	return nil
+}
+
+// Active returns whether the user is provisioned and not deactivated
+func (s *scimStore) Active(name string) bool {
+	u, ok := s.userByName(name)
+	return ok && u.Active
+}
+
+// GroupsOf returns the names of the provisioned groups the user is a
+// member of
+func (s *scimStore) GroupsOf(name string) []string {
+	u, ok := s.userByName(name)
+	if !ok {
+		return nil
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var groups []string
+	for _, g := range s.data.Groups {
+		for _, m := range g.Members {
+			if m == u.ID {
+				groups = append(groups, g.DisplayName)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// Claims returns the identity claims of the provisioned user
+func (s *scimStore) Claims(name string) map[string]string {
+	u, ok := s.userByName(name)
+	if !ok {
+		return nil
+	}
+
+	claims := map[string]string{}
+	for k, v := range map[string]string{
+		"email":       u.primaryEmail(),
+		"family_name": u.FamilyName,
+		"given_name":  u.GivenName,
+		"name":        u.DisplayName,
+	} {
+		if v != "" {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func (s *scimStore) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return false
+	}
+
+	for _, t := range s.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// scimError writes an error response in the format of RFC 7644
+func scimError(res http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimRespond(res, status, body)
+}
+
+func scimRespond(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/scim+json")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(body); err != nil {
+		log.WithError(err).Error("Unable to encode SCIM response")
+	}
+}
+
+func scimLocation(r *http.Request, resourceType, id string) string {
+	return requestScheme(r) + "://" + r.Host + scimPathPrefix + resourceType + "/" + id
+}
+
+func handleSCIMRequest(res http.ResponseWriter, r *http.Request) {
+	store := getSCIMStore()
+	if store == nil {
+		http.NotFound(res, r)
+		return
+	}
+
+	if !store.authorized(r) {
+		publishEvent(authEvent{Type: auditEventAccessDenied, Request: r, Fields: map[string]string{"reason": "invalid SCIM token"}})
+		scimError(res, http.StatusUnauthorized, "", "Invalid bearer token")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, scimPathPrefix), "/", 2)
+	var id string
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	switch parts[0] {
+	case "ServiceProviderConfig":
+		store.handleServiceProviderConfig(res, r)
+	case "ResourceTypes":
+		store.handleResourceTypes(res, r)
+	case "Users":
+		store.handleUsers(res, r, id)
+	case "Groups":
+		store.handleGroups(res, r, id)
+	default:
+		scimError(res, http.StatusNotFound, "", "Unknown resource type")
+	}
+}
+
+func (s *scimStore) handleServiceProviderConfig(res http.ResponseWriter, r *http.Request) {
+	scimRespond(res, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSchemaSPConfig},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimDefaultListCount},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "Token configured in the scim section of the configuration",
+		}},
+	})
+}
+
+func (s *scimStore) handleResourceTypes(res http.ResponseWriter, r *http.Request) {
+	resources := []map[string]string{
+		{"id": "User", "name": "User", "endpoint": "/Users", "schema": scimSchemaUser},
+		{"id": "Group", "name": "Group", "endpoint": "/Groups", "schema": scimSchemaGroup},
+	}
+
+	list := []interface{}{}
+	for _, rt := range resources {
+		list = append(list, map[string]interface{}{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       rt["id"],
+			"name":     rt["name"],
+			"endpoint": rt["endpoint"],
+			"schema":   rt["schema"],
+		})
+	}
+
+	scimListResponse(res, r, list)
+}
+
+// scimListResponse paginates the resources using the startIndex and
+// count parameters of the request
+func scimListResponse(res http.ResponseWriter, r *http.Request, resources []interface{}) {
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 || count > scimDefaultListCount {
+		count = scimDefaultListCount
+	}
+
+	total := len(resources)
+	page := []interface{}{}
+	if startIndex <= total {
+		end := startIndex - 1 + count
+		if end > total {
+			end = total
+		}
+		page = resources[startIndex-1 : end]
+	}
+
+	scimRespond(res, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimSchemaListResponse},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+// parseSCIMFilter supports the `attribute eq "value"` filters used by
+// identity providers to look up existing resources
+func parseSCIMFilter(filter string, attributes ...string) (string, string, error) {
+	if filter == "" {
+		return "", "", nil
+	}
+
+	m := scimFilterRegex.FindStringSubmatch(strings.TrimSpace(filter))
+	if m == nil {
+		return "", "", fmt.Errorf("Only filters in the form 'attribute eq \"value\"' are supported")
+	}
+
+	for _, a := range attributes {
+		if strings.EqualFold(a, m[1]) {
+			return a, m[2], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("Filtering on attribute %q is not supported", m[1])
+}
+
+func decodeSCIMBody(res http.ResponseWriter, r *http.Request, target interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		scimError(res, http.StatusBadRequest, "invalidSyntax", "Unable to parse request body")
+		return false
+	}
+	return true
+}
+
+// scimPatchRequest is the body of a PATCH request as defined in
+// RFC 7644 section 3.5.2
+type scimPatchRequest struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimBool parses boolean values which are sent as strings by some
+// identity providers
+func scimBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, fmt.Errorf("Value is no boolean")
+	}
+	return strconv.ParseBool(s)
+}
+
+// revokeSessions signs out deprovisioned users on all devices if
+// sessions are tracked and removes the users cached for their sessions
+func revokeSessions(user string) {
+	getMainConfig().DetectCache.InvalidateUser(user)
+
+	store := getSessionStore()
+	if store == nil {
+		return
+	}
+
+	if _, err := store.DeleteByUser(user); err != nil {
+		log.WithError(err).WithField("user", user).Error("Unable to revoke sessions of deprovisioned user")
+	}
+}
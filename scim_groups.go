@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scimGroupResource is the representation of a group in the SCIM API
+type scimGroupResource struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	DisplayName string          `json:"displayName"`
+	Members     []scimMemberRef `json:"members"`
+	Meta        *scimMeta       `json:"meta,omitempty"`
+}
+
+// groupResource converts the group into its API representation. Must
+// be called with the lock held.
+func (s *scimStore) groupResource(r *http.Request, g scimGroup) scimGroupResource {
+	res := scimGroupResource{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          g.ID,
+		ExternalID:  g.ExternalID,
+		DisplayName: g.DisplayName,
+		Members:     []scimMemberRef{},
+		Meta: &scimMeta{
+			ResourceType: "Group",
+			Created:      g.Created,
+			LastModified: g.LastModified,
+			Location:     scimLocation(r, "Groups", g.ID),
+		},
+	}
+
+	for _, m := range g.Members {
+		if i := s.userIndex(m); i >= 0 {
+			res.Members = append(res.Members, scimMemberRef{Value: m, Display: s.data.Users[i].UserName, Ref: scimLocation(r, "Users", m)})
+		}
+	}
+
+	return res
+}
+
+// groupIndex returns the position of the group with the given ID or
+// -1. Must be called with the lock held.
+func (s *scimStore) groupIndex(id string) int {
+	for i, g := range s.data.Groups {
+		if g.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkGroup ensures the group has an unique name and only contains
+// known users. Must be called with the lock held.
+func (s *scimStore) checkGroup(g scimGroup) error {
+	if g.DisplayName == "" {
+		return fmt.Errorf("Attribute displayName is required")
+	}
+
+	for _, o := range s.data.Groups {
+		if o.ID != g.ID && strings.EqualFold(o.DisplayName, g.DisplayName) {
+			return errSCIMUniqueness
+		}
+	}
+
+	for _, m := range g.Members {
+		if s.userIndex(m) < 0 {
+			return fmt.Errorf("Member %q is no known user", m)
+		}
+	}
+
+	return nil
+}
+
+func memberIDs(refs []scimMemberRef) []string {
+	ids := []string{}
+	for _, m := range refs {
+		ids = addString(ids, m.Value)
+	}
+	return ids
+}
+
+// addString appends the value to the list if it is not yet contained
+func addString(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// applyGroupPatch applies one operation of a PATCH request to the group
+func applyGroupPatch(g *scimGroup, op, path string, value json.RawMessage) error {
+	op = strings.ToLower(op)
+	lowerPath := strings.ToLower(path)
+
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("Unsupported operation %q", op)
+	}
+
+	if m := scimMemberPathRegex.FindStringSubmatch(path); m != nil && op == "remove" {
+		g.Members = removeString(g.Members, m[1])
+		return nil
+	}
+
+	switch lowerPath {
+	case "":
+		if op == "remove" {
+			return fmt.Errorf("Path is required for remove operations")
+		}
+
+		attrs := map[string]json.RawMessage{}
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return fmt.Errorf("Value needs to be an object if no path is given")
+		}
+		for k, v := range attrs {
+			if strings.ToLower(k) == "id" {
+				continue
+			}
+			if err := applyGroupPatch(g, op, k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "displayname":
+		if op == "remove" {
+			return fmt.Errorf("Attribute displayName is required")
+		}
+		if err := json.Unmarshal(value, &g.DisplayName); err != nil {
+			return fmt.Errorf("Invalid value for attribute %q", path)
+		}
+
+	case "externalid":
+		if op == "remove" {
+			g.ExternalID = ""
+			return nil
+		}
+		if err := json.Unmarshal(value, &g.ExternalID); err != nil {
+			return fmt.Errorf("Invalid value for attribute %q", path)
+		}
+
+	case "members":
+		var refs []scimMemberRef
+		if len(value) > 0 {
+			if err := json.Unmarshal(value, &refs); err != nil {
+				return fmt.Errorf("Invalid value for attribute %q", path)
+			}
+		}
+
+		switch {
+		case op == "replace":
+			g.Members = memberIDs(refs)
+		case op == "add":
+			for _, m := range refs {
+				g.Members = addString(g.Members, m.Value)
+			}
+		case len(refs) == 0:
+			// Remove without value clears the members
+			g.Members = []string{}
+		default:
+			for _, m := range refs {
+				g.Members = removeString(g.Members, m.Value)
+			}
+		}
+
+	default:
+		log.WithField("path", path).Debug("Ignoring unsupported SCIM group attribute")
+	}
+
+	return nil
+}
+
+func (s *scimStore) handleGroups(res http.ResponseWriter, r *http.Request, id string) {
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		s.listGroups(res, r)
+	case r.Method == http.MethodGet:
+		s.getGroup(res, r, id)
+	case r.Method == http.MethodPost && id == "":
+		s.createGroup(res, r)
+	case r.Method == http.MethodPut && id != "":
+		var in scimGroupResource
+		if !decodeSCIMBody(res, r, &in) {
+			return
+		}
+		s.modifyGroup(res, r, id, func(g *scimGroup) error {
+			g.ExternalID, g.DisplayName, g.Members = in.ExternalID, in.DisplayName, memberIDs(in.Members)
+			return nil
+		})
+	case r.Method == http.MethodPatch && id != "":
+		var patch scimPatchRequest
+		if !decodeSCIMBody(res, r, &patch) {
+			return
+		}
+		s.modifyGroup(res, r, id, func(g *scimGroup) error {
+			for _, op := range patch.Operations {
+				if err := applyGroupPatch(g, op.Op, op.Path, op.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case r.Method == http.MethodDelete && id != "":
+		s.deleteGroup(res, r, id)
+	default:
+		scimError(res, http.StatusMethodNotAllowed, "", "Method not allowed")
+	}
+}
+
+func (s *scimStore) listGroups(res http.ResponseWriter, r *http.Request) {
+	attr, value, err := parseSCIMFilter(r.URL.Query().Get("filter"), "displayName", "externalId", "id")
+	if err != nil {
+		scimError(res, http.StatusBadRequest, "invalidFilter", err.Error())
+		return
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := []interface{}{}
+	for _, g := range s.data.Groups {
+		switch attr {
+		case "displayName":
+			if !strings.EqualFold(g.DisplayName, value) {
+				continue
+			}
+		case "externalId":
+			if g.ExternalID != value {
+				continue
+			}
+		case "id":
+			if g.ID != value {
+				continue
+			}
+		}
+		list = append(list, s.groupResource(r, g))
+	}
+
+	scimListResponse(res, r, list)
+}
+
+func (s *scimStore) getGroup(res http.ResponseWriter, r *http.Request, id string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	i := s.groupIndex(id)
+	if i < 0 {
+		scimError(res, http.StatusNotFound, "", errSCIMNotFound.Error())
+		return
+	}
+
+	scimRespond(res, http.StatusOK, s.groupResource(r, s.data.Groups[i]))
+}
+
+func (s *scimStore) createGroup(res http.ResponseWriter, r *http.Request) {
+	var in scimGroupResource
+	if !decodeSCIMBody(res, r, &in) {
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to generate SCIM group ID")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	now := time.Now().UTC()
+	g := scimGroup{
+		ID:           id,
+		ExternalID:   in.ExternalID,
+		DisplayName:  in.DisplayName,
+		Members:      memberIDs(in.Members),
+		Created:      now,
+		LastModified: now,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.writeValidationError(res, s.checkGroup(g)) {
+		return
+	}
+
+	s.data.Groups = append(s.data.Groups, g)
+	if err := s.save(); err != nil {
+		s.data.Groups = s.data.Groups[:len(s.data.Groups)-1]
+		requestLog(r).WithError(err).Error("Unable to save SCIM store")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	res.Header().Set("Location", scimLocation(r, "Groups", g.ID))
+	scimRespond(res, http.StatusCreated, s.groupResource(r, g))
+}
+
+// modifyGroup applies the modification to the group and saves the
+// store
+func (s *scimStore) modifyGroup(res http.ResponseWriter, r *http.Request, id string, modify func(*scimGroup) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := s.groupIndex(id)
+	if i < 0 {
+		scimError(res, http.StatusNotFound, "", errSCIMNotFound.Error())
+		return
+	}
+
+	prev := s.data.Groups[i]
+	g := prev
+	g.Members = append([]string{}, prev.Members...)
+
+	if err := modify(&g); err != nil {
+		scimError(res, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if !s.writeValidationError(res, s.checkGroup(g)) {
+		return
+	}
+
+	g.LastModified = time.Now().UTC()
+	s.data.Groups[i] = g
+	if err := s.save(); err != nil {
+		s.data.Groups[i] = prev
+		requestLog(r).WithError(err).Error("Unable to save SCIM store")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	scimRespond(res, http.StatusOK, s.groupResource(r, g))
+}
+
+func (s *scimStore) deleteGroup(res http.ResponseWriter, r *http.Request, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := s.groupIndex(id)
+	if i < 0 {
+		scimError(res, http.StatusNotFound, "", errSCIMNotFound.Error())
+		return
+	}
+
+	prev := append([]scimGroup(nil), s.data.Groups...)
+	s.data.Groups = append(s.data.Groups[:i], s.data.Groups[i+1:]...)
+
+	if err := s.save(); err != nil {
+		s.data.Groups = prev
+		requestLog(r).WithError(err).Error("Unable to save SCIM store")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
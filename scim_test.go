@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testSCIMRequest(t *testing.T, method, path, body string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer scimtoken")
+	w := httptest.NewRecorder()
+
+	handleSCIMRequest(w, r)
+
+	result := map[string]interface{}{}
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s %s: Unable to parse response %q: %s", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code, result
+}
+
+func TestSCIMProvisioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-scim")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := scimConfig{Store: filepath.Join(dir, "scim.json"), Tokens: []string{"scimtoken"}}
+	if err := initializeSCIM(cfg); err != nil {
+		t.Fatalf("Unable to initialize SCIM: %s", err)
+	}
+	defer initializeSCIM(scimConfig{})
+
+	r := httptest.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+	w := httptest.NewRecorder()
+	handleSCIMRequest(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected request without token to be rejected, got %d", w.Code)
+	}
+
+	code, user := testSCIMRequest(t, http.MethodPost, "/scim/v2/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "jane@example.com",
+		"name": {"givenName": "Jane", "familyName": "Doe"},
+		"emails": [{"value": "jane@example.com", "primary": true}],
+		"password": "secret",
+		"active": true
+	}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected user to be created, got %d: %v", code, user)
+	}
+	userID := user["id"].(string)
+	if _, ok := user["password"]; ok {
+		t.Error("Expected password not to be returned")
+	}
+
+	if code, _ := testSCIMRequest(t, http.MethodPost, "/scim/v2/Users", `{"userName": "JANE@example.com"}`); code != http.StatusConflict {
+		t.Errorf("Expected duplicate user to be rejected with conflict, got %d", code)
+	}
+
+	code, list := testSCIMRequest(t, http.MethodGet, "/scim/v2/Users?filter="+`userName%20eq%20%22jane%40example.com%22`, "")
+	if code != http.StatusOK || list["totalResults"].(float64) != 1 {
+		t.Errorf("Expected user to be found by filter, got %d: %v", code, list)
+	}
+
+	code, group := testSCIMRequest(t, http.MethodPost, "/scim/v2/Groups", `{"displayName": "engineering"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected group to be created, got %d: %v", code, group)
+	}
+	groupID := group["id"].(string)
+
+	if code, resp := testSCIMRequest(t, http.MethodPatch, "/scim/v2/Groups/"+groupID, `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "`+userID+`"}]}
+	]}`); code != http.StatusOK {
+		t.Fatalf("Expected member to be added, got %d: %v", code, resp)
+	}
+
+	store := getSCIMStore()
+	if u, ok := store.Authenticate("jane@example.com", "secret"); !ok || u != "jane@example.com" {
+		t.Errorf("Expected provisioned user to be able to log in, got %q / %v", u, ok)
+	}
+	if g := store.GroupsOf("jane@example.com"); len(g) != 1 || g[0] != "engineering" {
+		t.Errorf("Expected user to be member of engineering, got %v", g)
+	}
+	if c := store.Claims("jane@example.com"); c["email"] != "jane@example.com" || c["given_name"] != "Jane" {
+		t.Errorf("Unexpected claims: %v", c)
+	}
+
+	// Entra ID sends booleans as strings and capitalized operations
+	if code, resp := testSCIMRequest(t, http.MethodPatch, "/scim/v2/Users/"+userID, `{"Operations": [
+		{"op": "Replace", "path": "active", "value": "False"}
+	]}`); code != http.StatusOK || resp["active"] != false {
+		t.Fatalf("Expected user to be deactivated, got %d: %v", code, resp)
+	}
+	if store.Active("jane@example.com") {
+		t.Error("Expected deactivated user not to be active")
+	}
+	if _, ok := store.Authenticate("jane@example.com", "secret"); ok {
+		t.Error("Expected deactivated user not to be able to log in")
+	}
+
+	// Okta sends the attributes without path
+	if code, resp := testSCIMRequest(t, http.MethodPatch, "/scim/v2/Users/"+userID, `{"Operations": [
+		{"op": "replace", "value": {"active": true}}
+	]}`); code != http.StatusOK || resp["active"] != true {
+		t.Fatalf("Expected user to be reactivated, got %d: %v", code, resp)
+	}
+
+	// Provisioned data must survive a restart
+	if err := initializeSCIM(cfg); err != nil {
+		t.Fatalf("Unable to reload SCIM store: %s", err)
+	}
+	store = getSCIMStore()
+	if !store.Active("jane@example.com") {
+		t.Fatal("Expected user to be loaded from the store")
+	}
+
+	if code, _ := testSCIMRequest(t, http.MethodDelete, "/scim/v2/Users/"+userID, ""); code != http.StatusNoContent {
+		t.Fatalf("Expected user to be deleted, got %d", code)
+	}
+	if store.Active("jane@example.com") {
+		t.Error("Expected deleted user not to be active")
+	}
+
+	_, group = testSCIMRequest(t, http.MethodGet, "/scim/v2/Groups/"+groupID, "")
+	if members := group["members"].([]interface{}); len(members) != 0 {
+		t.Errorf("Expected deleted user to be removed from group, got %v", members)
+	}
+}
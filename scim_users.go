@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type scimName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimMemberRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// scimUserResource is the representation of an user in the SCIM API
+type scimUserResource struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Name        *scimName       `json:"name,omitempty"`
+	Emails      []scimEmail     `json:"emails,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Password    string          `json:"password,omitempty"`
+	Groups      []scimMemberRef `json:"groups,omitempty"`
+	Meta        *scimMeta       `json:"meta,omitempty"`
+}
+
+// userResource converts the user into its API representation. The
+// password is never returned. Must be called with the lock held.
+func (s *scimStore) userResource(r *http.Request, u scimUser) scimUserResource {
+	active := u.Active
+	res := scimUserResource{
+		Schemas:     []string{scimSchemaUser},
+		ID:          u.ID,
+		ExternalID:  u.ExternalID,
+		UserName:    u.UserName,
+		DisplayName: u.DisplayName,
+		Emails:      u.Emails,
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      u.Created,
+			LastModified: u.LastModified,
+			Location:     scimLocation(r, "Users", u.ID),
+		},
+	}
+
+	if u.GivenName != "" || u.FamilyName != "" {
+		res.Name = &scimName{GivenName: u.GivenName, FamilyName: u.FamilyName}
+	}
+
+	for _, g := range s.data.Groups {
+		for _, m := range g.Members {
+			if m == u.ID {
+				res.Groups = append(res.Groups, scimMemberRef{Value: g.ID, Display: g.DisplayName, Ref: scimLocation(r, "Groups", g.ID)})
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+// userIndex returns the position of the user with the given ID or -1.
+// Must be called with the lock held.
+func (s *scimStore) userIndex(id string) int {
+	for i, u := range s.data.Users {
+		if u.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkUserName ensures no other user has the given name. Must be
+// called with the lock held.
+func (s *scimStore) checkUserName(name, id string) error {
+	if name == "" {
+		return fmt.Errorf("Attribute userName is required")
+	}
+
+	for _, u := range s.data.Users {
+		if u.ID != id && strings.EqualFold(u.UserName, name) {
+			return errSCIMUniqueness
+		}
+	}
+	return nil
+}
+
+func scimHashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), errors.Wrap(err, "Unable to hash password")
+}
+
+// applyUserResource replaces the attributes of the user with the ones
+// of the resource. The password is kept if none is given.
+func applyUserResource(u *scimUser, in scimUserResource) error {
+	u.ExternalID = in.ExternalID
+	u.UserName = in.UserName
+	u.DisplayName = in.DisplayName
+	u.Emails = in.Emails
+	u.GivenName, u.FamilyName = "", ""
+	if in.Name != nil {
+		u.GivenName, u.FamilyName = in.Name.GivenName, in.Name.FamilyName
+	}
+
+	u.Active = in.Active == nil || *in.Active
+
+	if in.Password != "" {
+		hash, err := scimHashPassword(in.Password)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+	}
+
+	return nil
+}
+
+// applyUserPatch applies one operation of a PATCH request to the user
+func applyUserPatch(u *scimUser, op, path string, value json.RawMessage) error {
+	switch strings.ToLower(op) {
+	case "add", "replace":
+		if path != "" {
+			return applyUserAttribute(u, path, value)
+		}
+
+		attrs := map[string]json.RawMessage{}
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return fmt.Errorf("Value needs to be an object if no path is given")
+		}
+		for k, v := range attrs {
+			if err := applyUserAttribute(u, k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "remove":
+		switch strings.ToLower(path) {
+		case "displayname":
+			u.DisplayName = ""
+		case "emails":
+			u.Emails = nil
+		case "externalid":
+			u.ExternalID = ""
+		case "name":
+			u.GivenName, u.FamilyName = "", ""
+		case "name.familyname":
+			u.FamilyName = ""
+		case "name.givenname":
+			u.GivenName = ""
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("Unsupported operation %q", op)
+	}
+}
+
+// applyUserAttribute sets a single attribute of the user. Attributes
+// not stored by nginx-sso are ignored.
+func applyUserAttribute(u *scimUser, path string, value json.RawMessage) error {
+	var (
+		err error
+		str string
+	)
+
+	switch strings.ToLower(path) {
+	case "active":
+		u.Active, err = scimBool(value)
+
+	case "displayname":
+		err = json.Unmarshal(value, &u.DisplayName)
+
+	case "emails":
+		err = json.Unmarshal(value, &u.Emails)
+
+	case "externalid":
+		err = json.Unmarshal(value, &u.ExternalID)
+
+	case "name":
+		var n scimName
+		if err = json.Unmarshal(value, &n); err == nil {
+			u.GivenName, u.FamilyName = n.GivenName, n.FamilyName
+		}
+
+	case "name.familyname":
+		err = json.Unmarshal(value, &u.FamilyName)
+
+	case "name.givenname":
+		err = json.Unmarshal(value, &u.GivenName)
+
+	case "password":
+		if err = json.Unmarshal(value, &str); err == nil {
+			u.PasswordHash, err = scimHashPassword(str)
+		}
+
+	case "username":
+		err = json.Unmarshal(value, &u.UserName)
+
+	default:
+		m := scimEmailPathRegex.FindStringSubmatch(path)
+		if m == nil {
+			log.WithField("path", path).Debug("Ignoring unsupported SCIM user attribute")
+			return nil
+		}
+
+		if err = json.Unmarshal(value, &str); err != nil {
+			break
+		}
+		for i := range u.Emails {
+			if strings.EqualFold(u.Emails[i].Type, m[1]) {
+				u.Emails[i].Value = str
+				return nil
+			}
+		}
+		u.Emails = append(u.Emails, scimEmail{Value: str, Type: m[1], Primary: len(u.Emails) == 0})
+	}
+
+	if err != nil {
+		return fmt.Errorf("Invalid value for attribute %q", path)
+	}
+	return nil
+}
+
+func (s *scimStore) handleUsers(res http.ResponseWriter, r *http.Request, id string) {
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		s.listUsers(res, r)
+	case r.Method == http.MethodGet:
+		s.getUser(res, r, id)
+	case r.Method == http.MethodPost && id == "":
+		s.createUser(res, r)
+	case r.Method == http.MethodPut && id != "":
+		var in scimUserResource
+		if !decodeSCIMBody(res, r, &in) {
+			return
+		}
+		s.modifyUser(res, r, id, func(u *scimUser) error { return applyUserResource(u, in) })
+	case r.Method == http.MethodPatch && id != "":
+		var patch scimPatchRequest
+		if !decodeSCIMBody(res, r, &patch) {
+			return
+		}
+		s.modifyUser(res, r, id, func(u *scimUser) error {
+			for _, op := range patch.Operations {
+				if err := applyUserPatch(u, op.Op, op.Path, op.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case r.Method == http.MethodDelete && id != "":
+		s.deleteUser(res, r, id)
+	default:
+		scimError(res, http.StatusMethodNotAllowed, "", "Method not allowed")
+	}
+}
+
+func (s *scimStore) listUsers(res http.ResponseWriter, r *http.Request) {
+	attr, value, err := parseSCIMFilter(r.URL.Query().Get("filter"), "userName", "externalId", "id")
+	if err != nil {
+		scimError(res, http.StatusBadRequest, "invalidFilter", err.Error())
+		return
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := []interface{}{}
+	for _, u := range s.data.Users {
+		switch attr {
+		case "userName":
+			if !strings.EqualFold(u.UserName, value) {
+				continue
+			}
+		case "externalId":
+			if u.ExternalID != value {
+				continue
+			}
+		case "id":
+			if u.ID != value {
+				continue
+			}
+		}
+		list = append(list, s.userResource(r, u))
+	}
+
+	scimListResponse(res, r, list)
+}
+
+func (s *scimStore) getUser(res http.ResponseWriter, r *http.Request, id string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	i := s.userIndex(id)
+	if i < 0 {
+		scimError(res, http.StatusNotFound, "", errSCIMNotFound.Error())
+		return
+	}
+
+	scimRespond(res, http.StatusOK, s.userResource(r, s.data.Users[i]))
+}
+
+func (s *scimStore) createUser(res http.ResponseWriter, r *http.Request) {
+	var in scimUserResource
+	if !decodeSCIMBody(res, r, &in) {
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to generate SCIM user ID")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	now := time.Now().UTC()
+	u := scimUser{ID: id, Created: now, LastModified: now}
+	if err := applyUserResource(&u, in); err != nil {
+		scimError(res, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.writeValidationError(res, s.checkUserName(u.UserName, u.ID)) {
+		return
+	}
+
+	s.data.Users = append(s.data.Users, u)
+	if err := s.save(); err != nil {
+		s.data.Users = s.data.Users[:len(s.data.Users)-1]
+		requestLog(r).WithError(err).Error("Unable to save SCIM store")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	requestLog(r).WithField("user", u.UserName).Info("User provisioned through SCIM")
+
+	res.Header().Set("Location", scimLocation(r, "Users", u.ID))
+	scimRespond(res, http.StatusCreated, s.userResource(r, u))
+}
+
+// modifyUser applies the modification to the user and saves the store.
+// Deactivated users are signed out on all devices.
+func (s *scimStore) modifyUser(res http.ResponseWriter, r *http.Request, id string, modify func(*scimUser) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := s.userIndex(id)
+	if i < 0 {
+		scimError(res, http.StatusNotFound, "", errSCIMNotFound.Error())
+		return
+	}
+
+	prev := s.data.Users[i]
+	u := prev
+	u.Emails = append([]scimEmail(nil), prev.Emails...)
+
+	if err := modify(&u); err != nil {
+		scimError(res, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+
+	if !s.writeValidationError(res, s.checkUserName(u.UserName, u.ID)) {
+		return
+	}
+
+	u.LastModified = time.Now().UTC()
+	s.data.Users[i] = u
+	if err := s.save(); err != nil {
+		s.data.Users[i] = prev
+		requestLog(r).WithError(err).Error("Unable to save SCIM store")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	if prev.Active && !u.Active {
+		requestLog(r).WithField("user", u.UserName).Info("User deactivated through SCIM")
+		revokeSessions(u.UserName)
+	}
+	if !strings.EqualFold(prev.UserName, u.UserName) {
+		// Sessions are bound to the name of the user
+		revokeSessions(prev.UserName)
+	}
+
+	scimRespond(res, http.StatusOK, s.userResource(r, u))
+}
+
+func (s *scimStore) deleteUser(res http.ResponseWriter, r *http.Request, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i := s.userIndex(id)
+	if i < 0 {
+		scimError(res, http.StatusNotFound, "", errSCIMNotFound.Error())
+		return
+	}
+
+	var (
+		u          = s.data.Users[i]
+		prevUsers  = append([]scimUser(nil), s.data.Users...)
+		prevGroups = append([]scimGroup(nil), s.data.Groups...)
+	)
+
+	s.data.Users = append(s.data.Users[:i], s.data.Users[i+1:]...)
+	for gi := range s.data.Groups {
+		s.data.Groups[gi].Members = removeString(s.data.Groups[gi].Members, u.ID)
+	}
+
+	if err := s.save(); err != nil {
+		s.data.Users, s.data.Groups = prevUsers, prevGroups
+		requestLog(r).WithError(err).Error("Unable to save SCIM store")
+		scimError(res, http.StatusInternalServerError, "", "Something went wrong")
+		return
+	}
+
+	requestLog(r).WithField("user", u.UserName).Info("User deprovisioned through SCIM")
+	revokeSessions(u.UserName)
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// writeValidationError writes the error response for a failed validation and
+// returns whether the request can proceed
+func (s *scimStore) writeValidationError(res http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case errSCIMUniqueness:
+		scimError(res, http.StatusConflict, "uniqueness", err.Error())
+	default:
+		scimError(res, http.StatusBadRequest, "invalidValue", err.Error())
+	}
+	return false
+}
+
+// removeString returns a copy of the list without the value
+func removeString(list []string, value string) []string {
+	result := []string{}
+	for _, v := range list {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
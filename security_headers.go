@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/pkg/errors"
+)
+
+const (
+	cspNoncePlaceholder = "{nonce}"
+
+	// hstsPreloadMinAge is the minimum max-age accepted for the HSTS
+	// preload list
+	hstsPreloadMinAge = 365 * 24 * time.Hour
+)
+
+var (
+	defaultFrameAncestors = []string{"'none'"}
+	defaultReferrerPolicy = "same-origin"
+
+	// frontendAssetSources serves the assets referenced by the embedded
+	// templates
+	frontendAssetSources = []string{"https://cdnjs.cloudflare.com"}
+)
+
+// securityHeadersConfig controls the headers protecting the pages of
+// the login UI in the browser
+type securityHeadersConfig struct {
+	ContentSecurityPolicy string   `yaml:"content_security_policy"`
+	FrameAncestors        []string `yaml:"frame_ancestors"`
+	HSTS                  struct {
+		MaxAge            time.Duration `yaml:"max_age"`
+		IncludeSubdomains bool          `yaml:"include_subdomains"`
+		Preload           bool          `yaml:"preload"`
+	} `yaml:"hsts"`
+	ReferrerPolicy string            `yaml:"referrer_policy"`
+	Headers        map[string]string `yaml:"headers"`
+}
+
+func (s securityHeadersConfig) Validate() error {
+	if strings.ContainsAny(s.ContentSecurityPolicy, "\r\n") {
+		return errors.New("Content security policy must not contain line breaks")
+	}
+
+	for _, source := range s.FrameAncestors {
+		if source == "" || strings.ContainsAny(source, " ;,\r\n") {
+			return errors.Errorf("Frame ancestor %q is invalid", source)
+		}
+	}
+
+	if s.HSTS.MaxAge < 0 {
+		return errors.New("HSTS max age must not be negative")
+	}
+	if s.HSTS.Preload && (s.HSTS.MaxAge < hstsPreloadMinAge || !s.HSTS.IncludeSubdomains) {
+		return errors.New("HSTS preload requires a max age of at least one year and include_subdomains")
+	}
+
+	for name, value := range s.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+			return errors.Errorf("Header %q is invalid", name)
+		}
+	}
+
+	return nil
+}
+
+func (s securityHeadersConfig) frameAncestors() []string {
+	if len(s.FrameAncestors) == 0 {
+		return defaultFrameAncestors
+	}
+	return s.FrameAncestors
+}
+
+// contentSecurityPolicy returns the configured policy or the default
+// allowing the assets of the embedded templates, the logo and icons of
+// the frontend and the widget of the CAPTCHA provider
+func (s securityHeadersConfig) contentSecurityPolicy(nonce string) string {
+	frameAncestors := "frame-ancestors " + strings.Join(s.frameAncestors(), " ")
+
+	if s.ContentSecurityPolicy != "" {
+		policy := strings.Replace(s.ContentSecurityPolicy, cspNoncePlaceholder, nonce, -1)
+		if !strings.Contains(policy, "frame-ancestors") {
+			policy = strings.TrimRight(strings.TrimSpace(policy), ";") + "; " + frameAncestors
+		}
+		return policy
+	}
+
+	var (
+		assets   = strings.Join(frontendAssetSources, " ")
+		scripts  = []string{"'self'", assets, "'nonce-" + nonce + "'"}
+		connect  = []string{"'self'"}
+		frameSrc = []string{"'none'"}
+	)
+	if getMainConfig().Captcha.Provider != "" {
+		captcha := getMainConfig().Captcha.provider().CSPSources
+		scripts = append(scripts, captcha...)
+		connect = append(connect, captcha...)
+		frameSrc = captcha
+	}
+
+	return strings.Join([]string{
+		"default-src 'none'",
+		"script-src " + strings.Join(scripts, " "),
+		"style-src " + strings.Join(scripts, " "),
+		"font-src " + assets,
+		"img-src 'self' https: data:",
+		"connect-src " + strings.Join(connect, " "),
+		"frame-src " + strings.Join(frameSrc, " "),
+		"base-uri 'none'",
+		frameAncestors,
+	}, "; ")
+}
+
+// setHeaders adds the security headers to the response and returns the
+// nonce of the content security policy
+func (s securityHeadersConfig) setHeaders(res http.ResponseWriter, r *http.Request) string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := base64.StdEncoding.EncodeToString(buf)
+
+	res.Header().Set("Content-Security-Policy", s.contentSecurityPolicy(nonce))
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+
+	switch strings.Join(s.frameAncestors(), " ") {
+	case "'none'":
+		res.Header().Set("X-Frame-Options", "DENY")
+	case "'self'":
+		res.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}
+
+	if policy := s.ReferrerPolicy; policy != "" {
+		res.Header().Set("Referrer-Policy", policy)
+	} else {
+		res.Header().Set("Referrer-Policy", defaultReferrerPolicy)
+	}
+
+	if s.HSTS.MaxAge > 0 && requestScheme(r) == "https" {
+		hsts := "max-age=" + strconv.Itoa(int(s.HSTS.MaxAge/time.Second))
+		if s.HSTS.IncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if s.HSTS.Preload {
+			hsts += "; preload"
+		}
+		res.Header().Set("Strict-Transport-Security", hsts)
+	}
+
+	for name, value := range s.Headers {
+		res.Header().Set(name, value)
+	}
+
+	return nonce
+}
+
+// cspNonce returns the nonce of the content security policy sent with
+// the response to allow the inline scripts and styles of the templates
+func cspNonce(r *http.Request) string {
+	nonce, _ := context.Get(r, cspNonceContextKey).(string)
+	return nonce
+}
+
+// withSecurityHeaders adds the security headers to the pages of the
+// login UI including the error pages rendered by the handler
+func withSecurityHeaders(h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		context.Set(r, cspNonceContextKey, getMainConfig().SecurityHeaders.setHeaders(res, r))
+		h(res, r)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	prevHeaders, prevCaptcha, prevFrontend, prevAuthenticators := getMainConfig().SecurityHeaders, getMainConfig().Captcha, getMainConfig().Frontend, getAuthenticatorSnapshot()
+	defer func() {
+		getMainConfig().SecurityHeaders, getMainConfig().Captcha, getMainConfig().Frontend = prevHeaders, prevCaptcha, prevFrontend
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+
+	render := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/login", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+
+		res := httptest.NewRecorder()
+		withSecurityHeaders(handleLoginRequest)(res, r)
+		return res
+	}
+
+	getMainConfig().SecurityHeaders = securityHeadersConfig{}
+	res := render()
+	csp := res.Header().Get("Content-Security-Policy")
+	for _, expect := range []string{"default-src 'none'", "script-src 'self' https://cdnjs.cloudflare.com 'nonce-", "frame-src 'none'", "frame-ancestors 'none'"} {
+		if !strings.Contains(csp, expect) {
+			t.Errorf("Expected %q in default policy %q", expect, csp)
+		}
+	}
+	nonce := strings.SplitN(strings.SplitN(csp, "'nonce-", 2)[1], "'", 2)[0]
+	if !strings.Contains(res.Body.String(), `<script nonce="`+nonce+`">`) || !strings.Contains(res.Body.String(), `<style nonce="`+nonce+`">`) {
+		t.Error("Expected nonce of the policy in the inline script and style")
+	}
+	for header, expect := range map[string]string{
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"Referrer-Policy":           "same-origin",
+		"Strict-Transport-Security": "",
+	} {
+		if v := res.Header().Get(header); v != expect {
+			t.Errorf("Expected %s to be %q, got %q", header, expect, v)
+		}
+	}
+
+	getMainConfig().Captcha = captchaConfig{Provider: "turnstile"}
+	if csp := render().Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-src https://challenges.cloudflare.com") {
+		t.Errorf("Expected CAPTCHA widget to be allowed, got %q", csp)
+	}
+
+	getMainConfig().SecurityHeaders = securityHeadersConfig{
+		ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-{nonce}';",
+		FrameAncestors:        []string{"'self'"},
+		Headers:               map[string]string{"Permissions-Policy": "camera=()"},
+	}
+	getMainConfig().SecurityHeaders.HSTS.MaxAge = hstsPreloadMinAge
+	getMainConfig().SecurityHeaders.HSTS.IncludeSubdomains = true
+	getMainConfig().SecurityHeaders.HSTS.Preload = true
+	if err := getMainConfig().SecurityHeaders.Validate(); err != nil {
+		t.Fatalf("Unable to validate security headers: %s", err)
+	}
+
+	res = render()
+	if csp := res.Header().Get("Content-Security-Policy"); strings.Contains(csp, "{nonce}") || !strings.HasSuffix(csp, "; frame-ancestors 'self'") {
+		t.Errorf("Unexpected custom policy %q", csp)
+	}
+	for header, expect := range map[string]string{
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains; preload",
+		"Permissions-Policy":        "camera=()",
+	} {
+		if v := res.Header().Get(header); v != expect {
+			t.Errorf("Expected %s to be %q, got %q", header, expect, v)
+		}
+	}
+
+	for name, s := range map[string]securityHeadersConfig{
+		"header injection": {Headers: map[string]string{"X-Test": "a\r\nSet-Cookie: b"}},
+		"policy injection": {ContentSecurityPolicy: "default-src 'self'\r\nX-Test: a"},
+		"frame ancestors":  {FrameAncestors: []string{"'self'; script-src *"}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+
+	s := securityHeadersConfig{}
+	s.HSTS.MaxAge = 24 * time.Hour
+	s.HSTS.Preload = true
+	if err := s.Validate(); err == nil {
+		t.Error("Expected preload with short max age to be rejected")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	loginFieldRememberMe = "remember-me"
+	sessionIDLength      = 16
+)
+
+func newSessionID() (string, error) {
+	buf := make([]byte, sessionIDLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "Unable to read random bytes")
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// getAuthSession reads the session cookie of the given authenticator.
+// If session binding is enabled the cookie must be presented by the
+// client it was issued to and if session tracking is enabled the
+// session must still be known to the session store. If there is no
+// valid session errNoUser is returned.
+func getAuthSession(r *http.Request, authenticatorID string) (*sessions.Session, error) {
+	sess, err := cookieStore.Get(r, getMainConfig().GetCookieName(r, authenticatorID))
+	if err != nil || sess.IsNew {
+		return nil, errNoUser
+	}
+
+	if getMainConfig().SessionBinding.Enabled() && !requestACL(r).SkipsSessionBinding(aclFieldSet(r)) {
+		if fp, _ := sess.Values["bind"].(string); fp != getMainConfig().SessionBinding.Fingerprint(r) {
+			requestLog(r).WithFields(log.Fields{
+				"provider":    authenticatorID,
+				"remote_addr": getMainConfig().AuditLog.findIP(r),
+				"user":        sess.Values["user"],
+			}).Warn("Session cookie was presented by another client")
+			return nil, errNoUser
+		}
+	}
+
+	store := getSessionStore()
+	if store == nil {
+		setSessionMeta(r, sessionMetaFromValues(authenticatorID, sess.Values))
+		return sess, nil
+	}
+
+	sid, ok := sess.Values["sid"].(string)
+	if !ok {
+		// Session was created before tracking was enabled
+		return nil, errNoUser
+	}
+
+	info, err := store.Get(sid)
+	switch err {
+	case nil:
+		// Session is still active
+	case errSessionNotFound:
+		return nil, errNoUser
+	default:
+		return nil, errors.Wrap(err, "Unable to fetch session from store")
+	}
+
+	if info.Provider != authenticatorID {
+		return nil, errNoUser
+	}
+
+	setSessionMeta(r, sessionMetaFromValues(authenticatorID, sess.Values))
+	return sess, nil
+}
+
+// newAuthSession returns an empty session for the given authenticator
+// to be filled after a successful login
+func newAuthSession(r *http.Request, authenticatorID string) (*sessions.Session, error) {
+	sess, _ := cookieStore.Get(r, getMainConfig().GetCookieName(r, authenticatorID))
+	sess.Values = map[interface{}]interface{}{
+		"created":  time.Now().Unix(),
+		"ip":       getMainConfig().AuditLog.findIP(r),
+		"remember": rememberLogin(r),
+	}
+
+	if getMainConfig().SessionBinding.Enabled() {
+		sess.Values["bind"] = getMainConfig().SessionBinding.Fingerprint(r)
+	}
+
+	if getSessionStore() != nil {
+		sid, err := newSessionID()
+		if err != nil {
+			return nil, err
+		}
+		sess.Values["sid"] = sid
+	}
+
+	return sess, nil
+}
+
+// rememberLogin checks whether the user requested a persistent cookie
+// using the toggle in the login form
+func rememberLogin(r *http.Request) bool {
+	if getMainConfig().Login.HideRememberMe {
+		return getMainConfig().Login.RememberMeDefault
+	}
+
+	return r.FormValue(loginFieldRememberMe) == "true"
+}
+
+// saveAuthSession writes the session cookie of the given authenticator
+// and updates the session store if session tracking is enabled
+func saveAuthSession(res http.ResponseWriter, r *http.Request, sess *sessions.Session, authenticatorID, user string) error {
+	sess.Options = getMainConfig().GetSessionOpts(r, authenticatorID)
+	ttl := time.Duration(sess.Options.MaxAge) * time.Second
+
+	if remember, ok := sess.Values["remember"].(bool); ok && !remember {
+		// Browser-session cookie, removed when the browser is closed
+		sess.Options.MaxAge = 0
+	}
+
+	if store := getSessionStore(); store != nil {
+		sid, _ := sess.Values["sid"].(string)
+		created, _ := sess.Values["created"].(int64)
+
+		if err := store.Save(sessionInfo{
+			ID:         sid,
+			User:       user,
+			Provider:   authenticatorID,
+			Created:    time.Unix(created, 0),
+			LastSeen:   time.Now(),
+			RemoteAddr: getMainConfig().AuditLog.findIP(r),
+			UserAgent:  r.UserAgent(),
+		}, ttl); err != nil {
+			return errors.Wrap(err, "Unable to store session")
+		}
+	}
+
+	if err := sess.Save(r, res); err != nil {
+		return err
+	}
+
+	if sess.IsNew {
+		remember, _ := sess.Values["remember"].(bool)
+		publishEvent(authEvent{Type: auditEventSessionCreated, Request: r, User: user, Provider: authenticatorID, Fields: map[string]string{
+			"provider": authenticatorID,
+			"remember": strconv.FormatBool(remember),
+		}})
+	}
+	return nil
+}
+
+// currentSessionID returns the tracked session ID stored in the cookie
+// of the given authenticator or an empty string if there is none
+func currentSessionID(r *http.Request, authenticatorID string) string {
+	sess, err := cookieStore.Get(r, getMainConfig().GetCookieName(r, authenticatorID))
+	if err != nil || sess.IsNew {
+		return ""
+	}
+
+	sid, _ := sess.Values["sid"].(string)
+	return sid
+}
+
+// deleteAuthSession removes the session cookie of the given
+// authenticator and removes it from the session store
+func deleteAuthSession(res http.ResponseWriter, r *http.Request, authenticatorID string) error {
+	sess, _ := cookieStore.Get(r, getMainConfig().GetCookieName(r, authenticatorID))
+
+	if store := getSessionStore(); store != nil {
+		if sid, ok := sess.Values["sid"].(string); ok {
+			if err := store.Delete(sid); err != nil {
+				requestLog(r).WithError(err).Error("Unable to remove session from store")
+			}
+		}
+	}
+
+	sess.Options = getMainConfig().GetSessionOpts(r, authenticatorID)
+	sess.Options.MaxAge = -1 // Instant delete
+	return sess.Save(r, res)
+}
+
+// revokeUserSessions removes all sessions of the user from the session
+// store which invalidates their cookies on all devices. The users cached
+// for those cookies are removed too.
+func revokeUserSessions(user string) (int, error) {
+	store := getSessionStore()
+	if store == nil {
+		return 0, errSessionTrackingDisabled
+	}
+
+	n, err := store.DeleteByUser(user)
+	getMainConfig().DetectCache.InvalidateUser(user)
+	return n, err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	sessionBindIP        = "ip"
+	sessionBindNetwork   = "network"
+	sessionBindUserAgent = "user_agent"
+)
+
+type sessionBindingConfig struct {
+	BindTo     []string `yaml:"bind_to"`
+	IPv4Prefix int      `yaml:"ipv4_prefix"`
+	IPv6Prefix int      `yaml:"ipv6_prefix"`
+}
+
+func (s sessionBindingConfig) Validate() error {
+	for _, b := range s.BindTo {
+		switch b {
+		case sessionBindIP, sessionBindNetwork, sessionBindUserAgent:
+		default:
+			return fmt.Errorf("Unsupported session binding %q", b)
+		}
+	}
+
+	if s.IPv4Prefix < 0 || s.IPv4Prefix > 32 {
+		return fmt.Errorf("IPv4 prefix %d is invalid", s.IPv4Prefix)
+	}
+
+	if s.IPv6Prefix < 0 || s.IPv6Prefix > 128 {
+		return fmt.Errorf("IPv6 prefix %d is invalid", s.IPv6Prefix)
+	}
+
+	return nil
+}
+
+// Enabled returns whether sessions should be bound to the client
+func (s sessionBindingConfig) Enabled() bool { return len(s.BindTo) > 0 }
+
+// Fingerprint calculates a hash of the client properties the session
+// is bound to. The hash is stored in the cookie instead of the plain
+// values as JWT cookies are not encrypted.
+func (s sessionBindingConfig) Fingerprint(r *http.Request) string {
+	parts := []string{}
+
+	for _, b := range s.BindTo {
+		switch b {
+		case sessionBindIP:
+			parts = append(parts, s.clientNetwork(r, 32, 128))
+		case sessionBindNetwork:
+			parts = append(parts, s.clientNetwork(r, s.IPv4Prefix, s.IPv6Prefix))
+		case sessionBindUserAgent:
+			parts = append(parts, r.UserAgent())
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s sessionBindingConfig) clientNetwork(r *http.Request, v4Prefix, v6Prefix int) string {
+	addr := getMainConfig().trustedClientIP(r)
+
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		// Unable to parse, compare the raw value
+		return addr
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(v4Prefix, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(v6Prefix, 128)).String()
+}
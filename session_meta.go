@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+type contextKey int
+
+const (
+	sessionMetaContextKey contextKey = iota
+	adminUserContextKey
+	requestIDContextKey
+	traceSpanContextKey
+	csrfTokenContextKey
+	cspNonceContextKey
+	aclFieldsContextKey
+)
+
+// sessionMeta contains information about the session the user was
+// detected from. It is attached to the request by detectUser.
+type sessionMeta struct {
+	Provider  string
+	LoginTime time.Time
+	MFA       bool
+	ClientIP  string
+	Claims    map[string]string
+}
+
+func sessionMetaFromValues(authenticatorID string, values map[interface{}]interface{}) sessionMeta {
+	m := sessionMeta{Provider: authenticatorID}
+
+	if created, ok := values["created"].(int64); ok {
+		m.LoginTime = time.Unix(created, 0)
+	}
+	m.MFA, _ = values["mfa"].(bool)
+	m.ClientIP, _ = values["ip"].(string)
+
+	if raw, ok := values["claims"].(string); ok {
+		// Invalid claims are ignored, the cookie is signed so this
+		// should not happen
+		json.Unmarshal([]byte(raw), &m.Claims)
+	}
+
+	return m
+}
+
+// encodeSessionClaims serializes the claims to be stored in the session
+// cookie. A string is used as gob and JSON cookies do not share a
+// common representation for maps.
+func encodeSessionClaims(claims map[string]string) string {
+	raw, _ := json.Marshal(claims)
+	return string(raw)
+}
+
+// Fields returns the session metadata as fields to be used in ACL rules
+func (s sessionMeta) Fields() map[string]string {
+	fields := map[string]string{}
+	s.addFields(fields)
+	return fields
+}
+
+// addFields adds the session metadata to the fields of a request
+func (s sessionMeta) addFields(fields map[string]string) {
+	fields["session.provider"] = s.Provider
+	fields["session.mfa"] = strconv.FormatBool(s.MFA)
+	fields["session.client_ip"] = s.ClientIP
+
+	if !s.LoginTime.IsZero() {
+		fields["session.login_time"] = strconv.FormatInt(s.LoginTime.Unix(), 10)
+	}
+
+	for k, v := range s.Claims {
+		fields["claim."+strings.ToLower(k)] = v
+	}
+}
+
+// SetHeaders adds the session metadata as response headers to be
+// passed to the upstream application
+func (s sessionMeta) SetHeaders(res http.ResponseWriter) {
+	res.Header().Set("X-Auth-Provider", s.Provider)
+	res.Header().Set("X-Auth-MFA", strconv.FormatBool(s.MFA))
+
+	if !s.LoginTime.IsZero() {
+		res.Header().Set("X-Auth-Login-Time", s.LoginTime.UTC().Format(time.RFC3339))
+	}
+}
+
+func setSessionMeta(r *http.Request, m sessionMeta) {
+	context.Set(r, sessionMetaContextKey, m)
+}
+
+func getSessionMeta(r *http.Request) (sessionMeta, bool) {
+	m, ok := context.Get(r, sessionMetaContextKey).(sessionMeta)
+	return m, ok
+}
+
+func clearSessionMeta(r *http.Request) {
+	context.Delete(r, sessionMetaContextKey)
+}
+
+// setACLRequestFields attaches the fields of the request built by
+// handleAuthRequest so the checks during the detection of the user
+// do not need to build them again
+func setACLRequestFields(r *http.Request, fields map[string]string) {
+	context.Set(r, aclFieldsContextKey, fields)
+}
+
+// aclFieldSet returns the fields of the request including the session
+// metadata, reusing the fields attached by handleAuthRequest
+func aclFieldSet(r *http.Request) map[string]string {
+	if fields, ok := context.Get(r, aclFieldsContextKey).(map[string]string); ok {
+		return withSessionMetaFields(r, fields)
+	}
+	return buildACLFieldSet(r)
+}
+
+// copyRequestValues attaches the values of the request (like the session
+// metadata, the request ID and the current span) to a copy of it which
+// is handled concurrently, the copy starts with its own set of values.
+// They need to be removed using clearRequestValues when the copy is not
+// used anymore.
+func copyRequestValues(from, to *http.Request) {
+	for k, v := range context.GetAll(from) {
+		context.Set(to, k, v)
+	}
+}
+
+func clearRequestValues(r *http.Request) {
+	context.Clear(r)
+}
+
+// setSessionClaims adds identity claims provided by the authenticator
+// to the session metadata
+func setSessionClaims(r *http.Request, claims map[string]string) {
+	if len(claims) == 0 {
+		return
+	}
+
+	m, _ := getSessionMeta(r)
+	if m.Claims == nil {
+		m.Claims = map[string]string{}
+	}
+
+	for k, v := range claims {
+		m.Claims[k] = v
+	}
+
+	setSessionMeta(r, m)
+}
+
+// setSessionProvider ensures the metadata contain the provider which
+// detected the user, also for providers not using session cookies
+func setSessionProvider(r *http.Request, authenticatorID string) {
+	m, _ := getSessionMeta(r)
+
+	m.Provider = authenticatorID
+	if m.ClientIP == "" {
+		m.ClientIP = getMainConfig().AuditLog.findIP(r)
+	}
+
+	setSessionMeta(r, m)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const sessionStoreCleanupInterval = time.Minute
+
+var (
+	errSessionNotFound         = errors.New("Session not found")
+	errSessionTrackingDisabled = errors.New("Session tracking is not enabled")
+)
+
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Provider   string    `json:"provider"`
+	Created    time.Time `json:"created"`
+	LastSeen   time.Time `json:"last_seen"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+type sessionStore interface {
+	// Save stores or updates the session and resets its lifetime
+	Save(s sessionInfo, ttl time.Duration) error
+
+	// Get retrieves a session by its ID. If the session does not exist
+	// or is expired the errSessionNotFound needs to be returned
+	Get(id string) (sessionInfo, error)
+
+	// Delete removes a single session
+	Delete(id string) error
+
+	// ListByUser returns all active sessions of the given user
+	ListByUser(user string) ([]sessionInfo, error)
+
+	// DeleteByUser removes all sessions of the given user and returns
+	// the number of removed sessions
+	DeleteByUser(user string) (int, error)
+}
+
+type sessionStoreConfig struct {
+	Type string `yaml:"type"`
+	URI  string `yaml:"uri"`
+}
+
+// sessionStoreConfig returns the configuration of the session store
+// using the store of the cluster if the redis store has no URI set
+func (m *mainConfig) sessionStoreConfig() sessionStoreConfig {
+	c := m.SessionStore
+	if c.Type == "redis" {
+		c.URI = m.Cluster.storeFor(c.URI)
+	}
+	return c
+}
+
+var (
+	activeSessionStore       sessionStore
+	activeSessionStoreConfig sessionStoreConfig
+	sessionStoreMutex        sync.RWMutex
+)
+
+func initializeSessionStore(c sessionStoreConfig) error {
+	activate, err := prepareSessionStore(c)
+	if err != nil {
+		return err
+	}
+	activate()
+	return nil
+}
+
+// prepareSessionStore connects the store without replacing the active
+// one, the returned function activates it
+func prepareSessionStore(c sessionStoreConfig) (func(), error) {
+	sessionStoreMutex.RLock()
+	unchanged := activeSessionStore != nil && c == activeSessionStoreConfig
+	sessionStoreMutex.RUnlock()
+
+	if unchanged {
+		// Keep the existing store (and its sessions) on config reloads
+		return func() {}, nil
+	}
+
+	var store sessionStore
+	switch c.Type {
+	case "":
+		// Sessions are not tracked
+	case "memory":
+		store = instrumentedSessionStore{newMemorySessionStore()}
+	case "redis":
+		if c.URI == "" {
+			return nil, errors.New("The redis session store needs an URI")
+		}
+		s, err := newRedisSessionStore(c.URI)
+		if err != nil {
+			return nil, err
+		}
+		store = instrumentedSessionStore{s}
+	default:
+		return nil, fmt.Errorf("Unsupported session store type %q", c.Type)
+	}
+
+	return func() {
+		sessionStoreMutex.Lock()
+		defer sessionStoreMutex.Unlock()
+
+		activeSessionStore = store
+		activeSessionStoreConfig = c
+	}, nil
+}
+
+// getSessionStore returns the configured session store or nil if
+// sessions are not tracked
+func getSessionStore() sessionStore {
+	sessionStoreMutex.RLock()
+	defer sessionStoreMutex.RUnlock()
+
+	return activeSessionStore
+}
+
+// instrumentedSessionStore records the duration and result of all
+// operations of the wrapped store in the metrics
+type instrumentedSessionStore struct {
+	sessionStore
+}
+
+func (i instrumentedSessionStore) observe(operation string, start time.Time, err error) {
+	result := "success"
+	switch err {
+	case nil:
+	case errSessionNotFound:
+		result = "not_found"
+	default:
+		result = "error"
+	}
+
+	metricSessionStoreOperations.ObserveSince(start, operation, result)
+}
+
+func (i instrumentedSessionStore) Save(s sessionInfo, ttl time.Duration) error {
+	start := time.Now()
+	err := i.sessionStore.Save(s, ttl)
+	i.observe("save", start, err)
+	return err
+}
+
+func (i instrumentedSessionStore) Get(id string) (sessionInfo, error) {
+	start := time.Now()
+	s, err := i.sessionStore.Get(id)
+	i.observe("get", start, err)
+	return s, err
+}
+
+func (i instrumentedSessionStore) Delete(id string) error {
+	start := time.Now()
+	err := i.sessionStore.Delete(id)
+	i.observe("delete", start, err)
+	return err
+}
+
+func (i instrumentedSessionStore) ListByUser(user string) ([]sessionInfo, error) {
+	start := time.Now()
+	s, err := i.sessionStore.ListByUser(user)
+	i.observe("list_by_user", start, err)
+	return s, err
+}
+
+func (i instrumentedSessionStore) DeleteByUser(user string) (int, error) {
+	start := time.Now()
+	n, err := i.sessionStore.DeleteByUser(user)
+	i.observe("delete_by_user", start, err)
+	return n, err
+}
+
+type memorySessionStoreEntry struct {
+	expires time.Time
+	session sessionInfo
+}
+
+type memorySessionStore struct {
+	*memoryRequestCounter
+
+	sessions map[string]memorySessionStoreEntry
+	lock     sync.RWMutex
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	m := &memorySessionStore{
+		memoryRequestCounter: newMemoryRequestCounter(),
+		sessions:             map[string]memorySessionStoreEntry{},
+	}
+	go m.cleanup()
+	return m
+}
+
+func (m *memorySessionStore) cleanup() {
+	for range time.Tick(sessionStoreCleanupInterval) {
+		m.lock.Lock()
+		for id, e := range m.sessions {
+			if e.expires.Before(time.Now()) {
+				delete(m.sessions, id)
+			}
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *memorySessionStore) Save(s sessionInfo, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sessions[s.ID] = memorySessionStoreEntry{expires: time.Now().Add(ttl), session: s}
+	return nil
+}
+
+func (m *memorySessionStore) Get(id string) (sessionInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	e, ok := m.sessions[id]
+	if !ok || e.expires.Before(time.Now()) {
+		return sessionInfo{}, errSessionNotFound
+	}
+
+	return e.session, nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessionStore) ListByUser(user string) ([]sessionInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	result := []sessionInfo{}
+	for _, e := range m.sessions {
+		if e.session.User == user && e.expires.After(time.Now()) {
+			result = append(result, e.session)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+
+	return result, nil
+}
+
+func (m *memorySessionStore) DeleteByUser(user string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var n int
+	for id, e := range m.sessions {
+		if e.session.User == user {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
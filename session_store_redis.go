@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	redisSessionKeyPrefix     = "nginx-sso:session:"
+	redisUserSessionKeyPrefix = "nginx-sso:user-sessions:"
+	redisRequestCountPrefix   = "nginx-sso:request-count:"
+)
+
+// redisSessionSaveScript stores the session and adds it to the index of
+// the sessions of the user. The index lives as long as the longest
+// living session of the user.
+const redisSessionSaveScript = `
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+redis.call("SADD", KEYS[2], ARGV[2])
+if redis.call("PTTL", KEYS[2]) < tonumber(ARGV[3]) then
+  redis.call("PEXPIRE", KEYS[2], ARGV[3])
+end
+return 1
+`
+
+// redisSessionIndexScript adds the session to the index of the sessions
+// of the user. In a Redis Cluster the session and the index live in
+// different slots and are not stored by the same script.
+const redisSessionIndexScript = `
+redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[2]) then
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`
+
+// redisRequestCountScript counts the request and starts the window
+// with the first request
+const redisRequestCountScript = `
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`
+
+// redisSessionStore keeps the sessions in Redis to share them (and the
+// request quotas) between all instances using the same Redis. Listing
+// and deleting the sessions of a user is pipelined, lookups are sent to
+// replicas when the URI enables read_from_replica.
+type redisSessionStore struct {
+	client *redisClient
+}
+
+func newRedisSessionStore(uri string) (*redisSessionStore, error) {
+	c, err := getRedisClient(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSessionStore{client: c}, nil
+}
+
+func (r *redisSessionStore) Save(s sessionInfo, ttl time.Duration) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "Unable to encode session")
+	}
+
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	if !r.client.Cluster() {
+		_, err = r.client.Do("EVAL", redisSessionSaveScript, "2",
+			redisSessionKeyPrefix+s.ID, redisUserSessionKeyPrefix+s.User,
+			string(data), s.ID, ms,
+		)
+		return err
+	}
+
+	replies, err := r.client.Pipeline(
+		[]string{"SET", redisSessionKeyPrefix + s.ID, string(data), "PX", ms},
+		[]string{"EVAL", redisSessionIndexScript, "1", redisUserSessionKeyPrefix + s.User, s.ID, ms},
+	)
+	if err != nil {
+		return err
+	}
+	return redisPipelineError(replies)
+}
+
+func (r *redisSessionStore) Get(id string) (sessionInfo, error) {
+	reply, err := r.client.Read("GET", redisSessionKeyPrefix+id)
+	if err != nil {
+		return sessionInfo{}, err
+	}
+	return decodeRedisSession(reply)
+}
+
+func decodeRedisSession(reply interface{}) (sessionInfo, error) {
+	data, ok := reply.(string)
+	if !ok {
+		return sessionInfo{}, errSessionNotFound
+	}
+
+	var s sessionInfo
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return sessionInfo{}, errors.Wrap(err, "Unable to decode session")
+	}
+
+	return s, nil
+}
+
+func (r *redisSessionStore) Delete(id string) error {
+	// Read from the primary, a replica might not know the session yet
+	reply, err := r.client.Do("GET", redisSessionKeyPrefix+id)
+	if err != nil {
+		return err
+	}
+
+	s, err := decodeRedisSession(reply)
+	switch err {
+	case nil:
+	case errSessionNotFound:
+		return nil
+	default:
+		return err
+	}
+
+	replies, err := r.client.Pipeline(
+		[]string{"SREM", redisUserSessionKeyPrefix + s.User, id},
+		[]string{"DEL", redisSessionKeyPrefix + id},
+	)
+	if err != nil {
+		return err
+	}
+	return redisPipelineError(replies)
+}
+
+func (r *redisSessionStore) userSessionIDs(user string) ([]string, error) {
+	reply, err := r.client.Read("SMEMBERS", redisUserSessionKeyPrefix+user)
+	if err != nil {
+		return nil, err
+	}
+
+	members, _ := reply.([]interface{})
+	ids := []string{}
+	for _, m := range members {
+		if id, ok := m.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (r *redisSessionStore) ListByUser(user string) ([]sessionInfo, error) {
+	ids, err := r.userSessionIDs(user)
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([][]string, len(ids))
+	for i, id := range ids {
+		cmds[i] = []string{"GET", redisSessionKeyPrefix + id}
+	}
+	replies, err := r.client.ReadPipeline(cmds...)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisPipelineError(replies); err != nil {
+		return nil, err
+	}
+
+	var (
+		result  = []sessionInfo{}
+		expired = []string{"SREM", redisUserSessionKeyPrefix + user}
+	)
+	for i, reply := range replies {
+		s, err := decodeRedisSession(reply)
+		switch err {
+		case nil:
+			result = append(result, s)
+		case errSessionNotFound:
+			expired = append(expired, ids[i])
+		default:
+			return nil, err
+		}
+	}
+
+	// Clean up the index from the expired sessions
+	if len(expired) > 2 {
+		if _, err := r.client.Do(expired...); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+
+	return result, nil
+}
+
+func (r *redisSessionStore) DeleteByUser(user string) (int, error) {
+	ids, err := r.userSessionIDs(user)
+	if err != nil {
+		return 0, err
+	}
+
+	// Sessions are deleted one by one as their keys are distributed over
+	// the slots of a Cluster
+	cmds := make([][]string, 0, len(ids)+1)
+	for _, id := range ids {
+		cmds = append(cmds, []string{"DEL", redisSessionKeyPrefix + id})
+	}
+	cmds = append(cmds, []string{"DEL", redisUserSessionKeyPrefix + user})
+
+	replies, err := r.client.Pipeline(cmds...)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, reply := range replies[:len(ids)] {
+		if deleted, _ := reply.(int64); deleted > 0 {
+			n++
+		}
+	}
+	return n, redisPipelineError(replies)
+}
+
+// Increment implements the acl.Counter to share the request quotas
+// between the instances
+func (r *redisSessionStore) Increment(key string, window time.Duration) (int, error) {
+	reply, err := r.client.Do("EVAL", redisRequestCountScript, "1",
+		redisRequestCountPrefix+key, strconv.FormatInt(int64(window/time.Millisecond), 10))
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errors.Errorf("Unexpected reply %v", reply)
+	}
+
+	return int(n), nil
+}
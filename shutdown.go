@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var (
+	httpServers     []*http.Server
+	httpServersLock sync.Mutex
+
+	shuttingDown int32
+)
+
+// trackServer registers the server to be drained on shutdown
+func trackServer(srv *http.Server) *http.Server {
+	httpServersLock.Lock()
+	defer httpServersLock.Unlock()
+
+	httpServers = append(httpServers, srv)
+	return srv
+}
+
+func isShuttingDown() bool { return atomic.LoadInt32(&shuttingDown) == 1 }
+
+// shutdownChecker fails the readiness check while the server is
+// draining to get it removed from load balancers
+type shutdownChecker struct{}
+
+func (shutdownChecker) CheckReadiness() error {
+	return fmt.Errorf("Server is shutting down")
+}
+
+// shutdownServers stops accepting new connections on all listeners and
+// waits for active requests to finish until the timeout is reached
+func shutdownServers(timeout time.Duration) {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	httpServersLock.Lock()
+	servers := httpServers
+	httpServersLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.WithError(err).Warn("Listener did not drain in time, closing remaining connections")
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsActiveRequests(t *testing.T) {
+	defer func() {
+		atomic.StoreInt32(&shuttingDown, 0)
+		httpServers = nil
+	}()
+
+	started := make(chan struct{})
+	srv := trackServer(&http.Server{Handler: http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		res.WriteHeader(http.StatusOK)
+	})})
+
+	l, err := listenConfig{Addr: "127.0.0.1", ReusePort: true}.Listen()
+	if err != nil {
+		t.Fatalf("Unable to open listener: %s", err)
+	}
+	go srv.Serve(l)
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("Unexpected status %s", resp.Status)
+			}
+		}
+		result <- err
+	}()
+
+	<-started
+	shutdownServers(time.Second)
+
+	if err := <-result; err != nil {
+		t.Errorf("Expected active request to finish, got %s", err)
+	}
+
+	if !isShuttingDown() {
+		t.Error("Expected server to report shutdown")
+	}
+
+	if _, ok := collectReadinessCheckers()["shutdown"]; !ok {
+		t.Error("Expected readiness check to fail during shutdown")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// File descriptors passed by systemd start after stdin, stdout and stderr
+const systemdListenFDsStart = 3
+
+var (
+	systemdListeners     map[string]net.Listener
+	systemdListenersErr  error
+	systemdListenersOnce sync.Once
+)
+
+// loadSystemdListeners converts the sockets passed by systemd socket
+// activation into listeners keyed by their FileDescriptorName
+func loadSystemdListeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		// Sockets were not passed to this process
+		return listeners, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to parse LISTEN_FDS")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to use socket %q passed by systemd", name)
+		}
+		// The listener holds its own copy of the descriptor
+		f.Close()
+
+		listeners[name] = l
+	}
+
+	// Prevent child processes to pick up the sockets
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return listeners, nil
+}
+
+// systemdListener returns the socket with the given name passed by
+// systemd socket activation. Every socket can only be used once.
+func systemdListener(name string) (net.Listener, error) {
+	systemdListenersOnce.Do(func() {
+		systemdListeners, systemdListenersErr = loadSystemdListeners()
+	})
+	if systemdListenersErr != nil {
+		return nil, systemdListenersErr
+	}
+
+	l, ok := systemdListeners[name]
+	if !ok {
+		return nil, fmt.Errorf("No socket named %q was passed by systemd", name)
+	}
+	delete(systemdListeners, name)
+
+	return l, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+type subcommand struct {
+	// Description is shown in the usage of the subcommand
+	Description string
+
+	// Flags registers the flags specific to the subcommand
+	Flags func(fs *pflag.FlagSet)
+
+	// Run executes the subcommand after the configuration was loaded
+	Run func() error
+
+	// SkipConfig runs the subcommand without loading the configuration
+	// before, for subcommands dealing with the configuration themselves
+	SkipConfig bool
+}
+
+var (
+	subcommands = map[string]subcommand{
+		"acl-test":       aclTestSubcommand,
+		"bench":          benchSubcommand,
+		"caddy-config":   caddyConfigSubcommand,
+		"check-config":   checkConfigSubcommand,
+		"gen-keys":       genKeysSubcommand,
+		"hash-password":  hashPasswordSubcommand,
+		"migrate-config": migrateConfigSubcommand,
+		"whoami":         whoamiSubcommand,
+	}
+
+	activeSubcommand *subcommand
+)
+
+// parseSubcommand checks whether the first argument is a subcommand
+// and parses its flags. Subcommands share the global flags needed to
+// load the configuration.
+func parseSubcommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	sc, ok := subcommands[args[0]]
+	if !ok {
+		return false, nil
+	}
+
+	fs := pflag.NewFlagSet(args[0], pflag.ExitOnError)
+	fs.StringVarP(&cfg.ConfigFile, "config", "c", envDefault("CONFIG", "config.yaml"), "Location of the configuration file or directory")
+	fs.StringVar(&cfg.LogFormat, "log-format", envDefault("LOG_FORMAT", "text"), "Format of the logs (text, json)")
+	fs.StringVar(&cfg.LogOutput, "log-output", envDefault("LOG_OUTPUT", defaultLogOutput), "Comma separated targets to write the logs to (fd://, file://, syslog://)")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "Level of logs to display (debug, info, warn, error)")
+	if sc.Flags != nil {
+		sc.Flags(fs)
+	}
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s %s: %s\n", os.Args[0], args[0], sc.Description)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return true, err
+	}
+
+	activeSubcommand = &sc
+	return true, nil
+}
+
+func envDefault(env, def string) string {
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return def
+}
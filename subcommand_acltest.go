@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	aclTestCfg = struct {
+		User    string
+		Groups  []string
+		Host    string
+		Path    string
+		Method  string
+		IP      string
+		Headers []string
+	}{}
+
+	aclTestSubcommand = subcommand{
+		Description: "Evaluate the ACL for a simulated request and print the decision",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&aclTestCfg.User, "user", "", "User to evaluate the ACL for")
+			fs.StringSliceVar(&aclTestCfg.Groups, "groups", nil, "Groups of the user (comma separated)")
+			fs.StringVar(&aclTestCfg.Host, "host", "", "Host of the simulated request")
+			fs.StringVar(&aclTestCfg.Path, "path", "/", "Path of the simulated request (sent as X-Origin-URI)")
+			fs.StringVar(&aclTestCfg.Method, "method", "GET", "Method of the simulated request")
+			fs.StringVar(&aclTestCfg.IP, "ip", "127.0.0.1", "Client IP of the simulated request")
+			fs.StringArrayVar(&aclTestCfg.Headers, "header", nil, "Additional header in format 'Name: value' (can be repeated)")
+		},
+		Run: runACLTest,
+	}
+)
+
+func runACLTest() error {
+	req, err := http.NewRequest(aclTestCfg.Method, "http://localhost/auth", nil)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+
+	req.RemoteAddr = aclTestCfg.IP + ":0"
+	req.Header.Set("X-Origin-URI", aclTestCfg.Path)
+	if aclTestCfg.Host != "" {
+		req.Header.Set("X-Host", aclTestCfg.Host)
+	}
+	for _, h := range aclTestCfg.Headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Header %q is not in format 'Name: value'", h)
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	a := getACL()
+	groups := getMainConfig().Roles.Apply(aclTestCfg.Groups)
+	aclReq := newACLRequest(aclTestCfg.User, groups, req, buildACLFieldSet(req))
+
+	// Rule sets judge the composite groups expanded by the ACL
+	expanded := aclReq
+	expanded.Groups = a.Groups.Expand(groups)
+
+	for i, rs := range a.RuleSets {
+		name := fmt.Sprintf("Rule set %d", i+1)
+		if rs.Shadow {
+			name += " (shadow)"
+		}
+
+		if !rs.AppliesToFields(aclReq.Fields) {
+			fmt.Printf("%s: rules do not apply\n", name)
+			continue
+		}
+		fmt.Printf("%s: rules apply, result: %s\n", name, rs.HasAccess(expanded))
+	}
+
+	result, decidedBy := a.Evaluate(aclReq)
+	if decidedBy < 0 {
+		fmt.Printf("Decision: %s (default policy, no rule set judged the request)\n", result)
+		return nil
+	}
+
+	fmt.Printf("Decision: %s (rule set %s)\n", result, a.RuleSetID(decidedBy))
+	return nil
+}
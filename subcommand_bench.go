@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const (
+	benchEndpointAuth  = "/auth"
+	benchEndpointLogin = "/login"
+)
+
+// benchConfig describes the requests sent by the bench subcommand
+type benchConfig struct {
+	URL            string
+	Concurrency    int
+	Duration       time.Duration
+	Requests       int
+	Cookies        []string
+	AnonymousRatio float64
+	LoginRatio     float64
+	LoginForm      string
+	Host           string
+	URI            string
+}
+
+var (
+	benchCfg = benchConfig{}
+
+	benchSubcommand = subcommand{
+		Description: "Send requests to the /auth and /login endpoints of a running instance and report their latencies",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&benchCfg.URL, "url", "http://127.0.0.1:8082", "Base URL of the instance to send the requests to")
+			fs.IntVar(&benchCfg.Concurrency, "concurrency", 10, "Number of requests sent in parallel")
+			fs.DurationVar(&benchCfg.Duration, "duration", 10*time.Second, "Time to send requests for")
+			fs.IntVar(&benchCfg.Requests, "requests", 0, "Number of requests to send, stops before the duration passed (0 = no limit)")
+			fs.StringArrayVar(&benchCfg.Cookies, "cookie", nil, "Cookie header to send with /auth requests, repeat to rotate through multiple sessions")
+			fs.Float64Var(&benchCfg.AnonymousRatio, "anonymous-ratio", 0, "Share of /auth requests sent without cookie (0-1)")
+			fs.Float64Var(&benchCfg.LoginRatio, "login-ratio", 0, "Share of requests sent to /login (0-1)")
+			fs.StringVar(&benchCfg.LoginForm, "login-form", "", "URL encoded form posted to /login (simple-username=alice&simple-password=secret)")
+			fs.StringVar(&benchCfg.Host, "host", "", "Host passed in the X-Host header")
+			fs.StringVar(&benchCfg.URI, "uri", "/", "URI passed in the X-Origin-URI header")
+		},
+		Run:        runBench,
+		SkipConfig: true,
+	}
+)
+
+func runBench() error {
+	if err := benchCfg.Validate(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sending requests to %s with concurrency %d for %s\n", benchCfg.URL, benchCfg.Concurrency, benchCfg.Duration)
+
+	start := time.Now()
+	results := runBenchmark(benchCfg)
+	printBenchReport(os.Stdout, results, time.Since(start))
+
+	for _, res := range results {
+		if res.errors < len(res.latencies) {
+			return nil
+		}
+	}
+	return errors.New("All requests failed")
+}
+
+func (b benchConfig) Validate() error {
+	switch {
+	case b.Concurrency < 1:
+		return errors.New("Concurrency must be at least 1")
+	case b.Duration <= 0 && b.Requests <= 0:
+		return errors.New("Duration or number of requests is required")
+	case b.AnonymousRatio < 0 || b.AnonymousRatio > 1, b.LoginRatio < 0 || b.LoginRatio > 1:
+		return errors.New("Ratios need to be between 0 and 1")
+	case b.LoginRatio > 0 && b.LoginForm == "":
+		return errors.New("Login requests need a login form, use --login-form")
+	}
+	return nil
+}
+
+// benchResult collects the outcome of the requests to one endpoint
+type benchResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+func (b *benchResult) add(latency time.Duration, status int, err error) {
+	b.latencies = append(b.latencies, latency)
+	if err != nil {
+		b.errors++
+		return
+	}
+	b.statuses[status]++
+}
+
+func (b *benchResult) merge(o *benchResult) {
+	b.latencies = append(b.latencies, o.latencies...)
+	b.errors += o.errors
+	for status, n := range o.statuses {
+		b.statuses[status] += n
+	}
+}
+
+// percentile returns the latency below which the given share of the
+// requests finished, the latencies need to be sorted
+func (b *benchResult) percentile(p float64) time.Duration {
+	if len(b.latencies) == 0 {
+		return 0
+	}
+
+	idx := int(float64(len(b.latencies))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(b.latencies) {
+		idx = len(b.latencies) - 1
+	}
+	return b.latencies[idx]
+}
+
+func newBenchResults() map[string]*benchResult {
+	return map[string]*benchResult{
+		benchEndpointAuth:  {statuses: map[int]int{}},
+		benchEndpointLogin: {statuses: map[int]int{}},
+	}
+}
+
+// runBenchmark sends the requests from all workers until the duration
+// passed or the number of requests was sent
+func runBenchmark(b benchConfig) map[string]*benchResult {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: b.Concurrency,
+		},
+		// Logins redirect to the target, only the login is measured
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		Timeout:       30 * time.Second,
+	}
+
+	var (
+		deadline = time.Now().Add(b.Duration)
+		sent     int64
+		results  = newBenchResults()
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	for w := 0; w < b.Concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			local := newBenchResults()
+			rnd := rand.New(rand.NewSource(int64(w)))
+
+			for {
+				n := atomic.AddInt64(&sent, 1)
+				if (b.Requests > 0 && n > int64(b.Requests)) || (b.Duration > 0 && time.Now().After(deadline)) {
+					break
+				}
+
+				endpoint, req, err := b.request(rnd, int(n))
+				if err != nil {
+					local[endpoint].add(0, 0, err)
+					continue
+				}
+
+				start := time.Now()
+				resp, err := client.Do(req)
+				if err == nil {
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					local[endpoint].add(time.Since(start), resp.StatusCode, nil)
+					continue
+				}
+				local[endpoint].add(time.Since(start), 0, err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for endpoint, res := range local {
+				results[endpoint].merge(res)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, res := range results {
+		sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	}
+	return results
+}
+
+// request builds the n-th request: The login ratio selects the
+// endpoint, /auth requests rotate through the cookies unless they are
+// sent anonymously
+func (b benchConfig) request(rnd *rand.Rand, n int) (string, *http.Request, error) {
+	base := strings.TrimRight(b.URL, "/")
+
+	var (
+		endpoint = benchEndpointAuth
+		req      *http.Request
+		err      error
+	)
+	if rnd.Float64() < b.LoginRatio {
+		endpoint = benchEndpointLogin
+		if req, err = http.NewRequest(http.MethodPost, base+endpoint, strings.NewReader(b.LoginForm)); err != nil {
+			return endpoint, nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		if req, err = http.NewRequest(http.MethodGet, base+endpoint, nil); err != nil {
+			return endpoint, nil, err
+		}
+		if len(b.Cookies) > 0 && rnd.Float64() >= b.AnonymousRatio {
+			req.Header.Set("Cookie", b.Cookies[n%len(b.Cookies)])
+		}
+	}
+
+	req.Header.Set("User-Agent", "nginx-sso-bench/"+version)
+	req.Header.Set("X-Origin-URI", b.URI)
+	if b.Host != "" {
+		req.Header.Set("X-Host", b.Host)
+	}
+
+	return endpoint, req, nil
+}
+
+func printBenchReport(w io.Writer, results map[string]*benchResult, elapsed time.Duration) {
+	for _, endpoint := range []string{benchEndpointAuth, benchEndpointLogin} {
+		res := results[endpoint]
+		if len(res.latencies) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s: %d requests (%.1f/s), %d errors\n", endpoint, len(res.latencies), float64(len(res.latencies))/elapsed.Seconds(), res.errors)
+
+		statuses := []int{}
+		for status := range res.statuses {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		parts := []string{}
+		for _, status := range statuses {
+			parts = append(parts, fmt.Sprintf("%d=%d", status, res.statuses[status]))
+		}
+		if len(parts) > 0 {
+			fmt.Fprintf(w, "  status:  %s\n", strings.Join(parts, " "))
+		}
+
+		fmt.Fprintf(w, "  latency: p50=%s p90=%s p99=%s max=%s\n",
+			res.percentile(0.5).Round(time.Microsecond),
+			res.percentile(0.9).Round(time.Microsecond),
+			res.percentile(0.99).Round(time.Microsecond),
+			res.latencies[len(res.latencies)-1].Round(time.Microsecond),
+		)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchSubcommand(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login" && r.FormValue("simple-username") == "alice":
+			http.Redirect(res, r, "/", http.StatusFound)
+		case r.URL.Path == "/auth" && r.Header.Get("Cookie") != "" && r.Header.Get("X-Host") == "app.example.com":
+			res.WriteHeader(http.StatusOK)
+		default:
+			res.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := benchConfig{
+		URL:            srv.URL,
+		Concurrency:    4,
+		Requests:       200,
+		Cookies:        []string{"nginx-sso-simple=a", "nginx-sso-simple=b"},
+		AnonymousRatio: 0.5,
+		LoginRatio:     0.25,
+		LoginForm:      "simple-username=alice&simple-password=secret",
+		Host:           "app.example.com",
+		URI:            "/",
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected valid configuration, got %s", err)
+	}
+
+	results := runBenchmark(cfg)
+	auth, login := results[benchEndpointAuth], results[benchEndpointLogin]
+	if n := len(auth.latencies) + len(login.latencies); n != 200 || auth.errors+login.errors != 0 {
+		t.Fatalf("Expected 200 successful requests, got %d with %d errors", n, auth.errors+login.errors)
+	}
+	if login.statuses[http.StatusFound] != len(login.latencies) || auth.statuses[http.StatusOK] == 0 || auth.statuses[http.StatusUnauthorized] == 0 {
+		t.Errorf("Unexpected status mix: auth %v, login %v", auth.statuses, login.statuses)
+	}
+
+	buf := new(bytes.Buffer)
+	printBenchReport(buf, results, time.Second)
+	if !strings.Contains(buf.String(), "/login: ") || !strings.Contains(buf.String(), "p99=") {
+		t.Errorf("Unexpected report %q", buf.String())
+	}
+
+	r := &benchResult{latencies: []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	if p50, p99 := r.percentile(0.5), r.percentile(0.99); p50 != 5 || p99 != 10 {
+		t.Errorf("Expected p50 5 and p99 10, got %d and %d", p50, p99)
+	}
+
+	if err := (benchConfig{Concurrency: 1, Duration: time.Second, LoginRatio: 0.5}).Validate(); err == nil {
+		t.Error("Expected logins without form to be rejected")
+	}
+}
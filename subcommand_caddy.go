@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	caddyConfigCfg = struct {
+		LoginURL string
+		Upstream string
+	}{}
+
+	caddyConfigSubcommand = subcommand{
+		Description: "Print a Caddyfile forward_auth snippet matching the identity header configuration",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&caddyConfigCfg.LoginURL, "login-url", "", "Public URL of the nginx-sso login page to redirect unauthenticated users to")
+			fs.StringVar(&caddyConfigCfg.Upstream, "upstream", "", "Address Caddy uses to reach nginx-sso (default: listen address)")
+		},
+		Run: runCaddyConfig,
+	}
+)
+
+// identityHeaderNames returns all header names the /auth endpoint might
+// return for a successful request
+func (m *mainConfig) identityHeaderNames() []string {
+	names := map[string]bool{}
+	for name := range m.IdentityHeaders.compiled {
+		names[name] = true
+	}
+	for _, h := range m.IdentityHeaders.Hosts {
+		for name := range h.compiled {
+			names[name] = true
+		}
+	}
+
+	if m.SessionHeaders {
+		for _, name := range []string{"X-Auth-Provider", "X-Auth-MFA", "X-Auth-Login-Time"} {
+			names[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+
+	result := []string{}
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+func runCaddyConfig() error {
+	upstream := caddyConfigCfg.Upstream
+	if upstream == "" {
+		upstream = fmt.Sprintf("%s:%d", getMainConfig().Listen.Addr, getMainConfig().Listen.Port)
+		if getMainConfig().Listen.Socket != "" {
+			upstream = "unix/" + getMainConfig().Listen.Socket
+		}
+	}
+
+	lines := []string{
+		"# Generated by nginx-sso caddy-config",
+		fmt.Sprintf("forward_auth %s {", upstream),
+		"\turi /auth",
+		"\tcopy_headers " + strings.Join(getMainConfig().identityHeaderNames(), " "),
+	}
+
+	if caddyConfigCfg.LoginURL != "" {
+		lines = append(lines,
+			"",
+			"\t@unauthenticated status 401",
+			"\thandle_response @unauthenticated {",
+			fmt.Sprintf("\t\tredir %s?go={scheme}://{host}{uri}", caddyConfigCfg.LoginURL),
+			"\t}",
+		)
+	}
+
+	lines = append(lines, "}")
+	fmt.Println(strings.Join(lines, "\n"))
+
+	return nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/Luzifer/nginx-sso/pkg/acl"
+	"github.com/Luzifer/nginx-sso/pkg/auth"
+)
+
+var (
+	checkConfigSubcommand = subcommand{
+		Description: "Validate the configuration and report all errors with their line",
+		SkipConfig:  true,
+		Run:         runCheckConfig,
+	}
+
+	// yamlErrorLine matches the lines reported in errors of the yaml parser
+	yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+	// aclErrorPosition matches the positions reported in ACL errors
+	aclErrorPosition = regexp.MustCompile(`(RuleSet|Rule|Host default) on position (\d+)`)
+)
+
+// configProblem is an error in a configuration file. Line is 0 if the
+// line could not be determined.
+type configProblem struct {
+	File string
+	Line int
+	Path string
+	Err  string
+
+	path []interface{}
+}
+
+func (c configProblem) String() string {
+	loc := c.File
+	if c.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", c.File, c.Line)
+	}
+
+	if c.Path == "" {
+		return fmt.Sprintf("%s: %s", loc, c.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", loc, c.Path, c.Err)
+}
+
+func runCheckConfig() error {
+	problems, err := checkConfiguration(cfg.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Configuration contains %d error(s)", len(problems))
+	}
+
+	fmt.Printf("%s: Configuration is valid\n", cfg.ConfigFile)
+	return nil
+}
+
+// checkConfiguration runs the checks done on load of the configuration
+// and reports all problems found instead of stopping at the first one
+func checkConfiguration(file string) ([]configProblem, error) {
+	var dirSources map[string][]byte
+	if stat, err := os.Stat(file); err == nil && stat.IsDir() {
+		var problems []configProblem
+		if dirSources, problems = checkConfigDirFiles(file); len(problems) > 0 {
+			// The files can't be merged
+			return problems, nil
+		}
+	}
+
+	config, err := readConfiguration(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read configuration file: %s", err)
+	}
+	source := config.Source
+
+	m := &mainConfig{}
+	setMainConfigDefaults(m)
+	if err := yaml.Unmarshal(source, m); err != nil {
+		// The other checks are meaningless without parsed configuration
+		return yamlProblems(file, err), nil
+	}
+
+	problems := []configProblem{}
+
+	validations := append(m.validations(),
+		configValidation{"geoip", "GeoIP", func() error { return initializeGeoIP(m.GeoIP) }},
+		configValidation{"oidc_provider", "OIDC provider", func() error { return initializeOIDCProvider(m.OIDCProvider) }},
+		configValidation{"scim", "SCIM", func() error { return initializeSCIM(m.SCIM) }},
+		configValidation{"session_store", "session store", func() error { return initializeSessionStore(m.sessionStoreConfig()) }},
+	)
+	for _, v := range validations {
+		if err := v.Validate(); err != nil {
+			problems = append(problems, newConfigProblem(file, source, []interface{}{v.Key}, err))
+		}
+	}
+
+	problems = append(problems, checkACLConfiguration(file, config.Dir, source)...)
+	problems = append(problems, checkProviderConfiguration(file, source)...)
+
+	if dirSources != nil {
+		locateConfigProblems(file, dirSources, problems)
+	} else if string(config.Original) != string(source) {
+		// The configuration was migrated from an older version
+		locateConfigProblems(file, map[string][]byte{file: config.Original}, problems)
+	}
+
+	return problems, nil
+}
+
+// checkConfigDirFiles reads the files of a configuration directory and
+// reports their syntax errors
+func checkConfigDirFiles(dir string) (map[string][]byte, []configProblem) {
+	files, err := configDirFiles(dir)
+	if err != nil {
+		return nil, []configProblem{{File: dir, Err: err.Error()}}
+	}
+
+	var (
+		problems = []configProblem{}
+		sources  = map[string][]byte{}
+	)
+	for _, f := range files {
+		source, err := readConfigFile(f)
+		if err != nil {
+			problems = append(problems, configProblem{File: f, Err: err.Error()})
+			continue
+		}
+
+		if err := yaml.Unmarshal(source, &map[interface{}]interface{}{}); err != nil {
+			problems = append(problems, yamlProblems(f, err)...)
+			continue
+		}
+
+		sources[f] = source
+	}
+
+	return sources, problems
+}
+
+// locateConfigProblems moves the problems found in the merged (or
+// migrated) configuration to the file defining the setting. If multiple
+// files define it the last one is used as its value wins.
+func locateConfigProblems(dir string, sources map[string][]byte, problems []configProblem) {
+	files := []string{}
+	for f := range sources {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	for i, p := range problems {
+		if p.File != dir {
+			continue
+		}
+
+		// Lines of the merged document are meaningless to the user
+		problems[i].Line = 0
+
+		depth := 1
+		for _, f := range files {
+			for l := len(p.path); l >= depth; l-- {
+				if line := yamlPathLine(sources[f], p.path[:l]); line > 0 {
+					problems[i].File, problems[i].Line = f, line
+					depth = l
+					break
+				}
+			}
+		}
+	}
+}
+
+// checkACLConfiguration validates the rule sets of the configuration
+// and of the included files separately to report the line of the
+// broken rules
+func checkACLConfiguration(file, dir string, source []byte) []configProblem {
+	envelope := struct {
+		ACL acl.ACL `yaml:"acl"`
+	}{}
+	if err := yaml.Unmarshal(source, &envelope); err != nil {
+		return yamlProblems(file, err)
+	}
+
+	problems := checkACLRuleSets(file, source, []interface{}{"acl"}, envelope.ACL.RuleSets)
+
+	for _, pattern := range envelope.ACL.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			problems = append(problems, newConfigProblem(file, source, []interface{}{"acl", "include"}, err))
+			continue
+		}
+		sort.Strings(files)
+
+		for _, inc := range files {
+			incSource, err := readConfigFile(inc)
+			if err != nil {
+				problems = append(problems, configProblem{File: inc, Err: err.Error()})
+				continue
+			}
+
+			ruleSets, err := acl.LoadInclude(inc, readConfigFile)
+			if err != nil {
+				problems = append(problems, yamlProblems(inc, err)...)
+				continue
+			}
+
+			problems = append(problems, checkACLRuleSets(inc, incSource, nil, ruleSets)...)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	// Rule sets are valid on their own, check the ACL as a whole (default
+	// policies and IDs unique across all files)
+	if _, err := loadACL(source, dir); err != nil {
+		return []configProblem{newConfigProblem(file, source, aclErrorPath([]interface{}{"acl"}, err), err)}
+	}
+
+	return nil
+}
+
+func checkACLRuleSets(file string, source []byte, prefix []interface{}, ruleSets []acl.RuleSet) []configProblem {
+	problems := []configProblem{}
+
+	for i, rs := range ruleSets {
+		path := append(append([]interface{}{}, prefix...), "rule_sets", i)
+
+		err := rs.Validate()
+		if err == nil {
+			err = rs.Compile()
+		}
+		if err != nil {
+			problems = append(problems, newConfigProblem(file, source, aclErrorPath(path, err), err))
+		}
+	}
+
+	return problems
+}
+
+// aclErrorPath extends the path by the positions of the rule sets,
+// rules and host defaults mentioned in the error
+func aclErrorPath(path []interface{}, err error) []interface{} {
+	for _, m := range aclErrorPosition.FindAllStringSubmatch(err.Error(), -1) {
+		pos, _ := strconv.Atoi(m[2])
+		switch m[1] {
+		case "RuleSet":
+			path = append(path, "rule_sets", pos-1)
+		case "Rule":
+			path = append(path, "rules", pos-1)
+		case "Host default":
+			path = append(path, "host_defaults", pos-1)
+		}
+	}
+
+	return path
+}
+
+// checkProviderConfiguration configures new instances of all registered
+// providers to report configuration errors of all of them
+func checkProviderConfiguration(file string, source []byte) []configProblem {
+	type providerCheck struct {
+		Section   string
+		ID        string
+		Configure func([]byte) error
+	}
+
+	checks := []providerCheck{}
+
+	for _, proto := range authenticatorRegistry.Authenticators() {
+		a := auth.NewInstance(proto).(authenticator)
+		checks = append(checks, providerCheck{"providers", a.AuthenticatorID(), a.Configure})
+	}
+
+	authenticators := len(checks)
+
+	groupProviderRegistryMutex.RLock()
+	for _, proto := range groupProviderRegistry {
+		g := auth.NewInstance(proto).(groupProvider)
+		checks = append(checks, providerCheck{"group_providers", g.GroupProviderID(), g.Configure})
+	}
+	groupProviderRegistryMutex.RUnlock()
+
+	mfaRegistryMutex.RLock()
+	for _, proto := range mfaRegistry {
+		m := auth.NewInstance(proto).(mfaProvider)
+		checks = append(checks, providerCheck{"mfa", m.ProviderID(), m.Configure})
+	}
+	mfaRegistryMutex.RUnlock()
+
+	var (
+		problems   = []configProblem{}
+		configured = 0
+	)
+	for i, c := range checks {
+		switch err := c.Configure(source); {
+		case err == nil:
+			if i < authenticators {
+				configured++
+			}
+		case errors.Is(err, errProviderUnconfigured):
+			// This is okay.
+		default:
+			problems = append(problems, newConfigProblem(file, source, []interface{}{c.Section, c.ID}, err))
+		}
+	}
+
+	if configured == 0 && len(problems) == 0 {
+		problems = append(problems, newConfigProblem(file, source, []interface{}{"providers"}, fmt.Errorf("No authenticator configurations supplied")))
+	}
+
+	return problems
+}
+
+// newConfigProblem creates a problem at the line of the given path in
+// the source. If the path can't be found (for example in flow style
+// YAML) its closest parent found is used.
+func newConfigProblem(file string, source []byte, path []interface{}, err error) configProblem {
+	p := configProblem{File: file, Path: formatYAMLPath(path), Err: err.Error(), path: path}
+
+	for l := len(path); l > 0 && p.Line == 0; l-- {
+		p.Line = yamlPathLine(source, path[:l])
+	}
+
+	return p
+}
+
+// yamlProblems splits the errors of the yaml parser into one problem
+// per reported line
+func yamlProblems(file string, err error) []configProblem {
+	problems := []configProblem{}
+	for _, m := range yamlErrorLine.FindAllStringSubmatch(err.Error(), -1) {
+		line, _ := strconv.Atoi(m[1])
+		problems = append(problems, configProblem{File: file, Line: line, Err: m[2]})
+	}
+
+	if len(problems) == 0 {
+		problems = append(problems, configProblem{File: file, Err: err.Error()})
+	}
+
+	return problems
+}
+
+func formatYAMLPath(path []interface{}) string {
+	out := ""
+	for _, elem := range path {
+		switch e := elem.(type) {
+		case int:
+			out += fmt.Sprintf("[%d]", e)
+		default:
+			if out != "" {
+				out += "."
+			}
+			out += fmt.Sprint(e)
+		}
+	}
+	return out
+}
+
+// yamlPathLine returns the (1-based) line of the element at the path
+// in block style YAML. Path elements are keys of mappings (string) or
+// positions in sequences (int, 0-based). 0 is returned if the element
+// is not found.
+func yamlPathLine(source []byte, path []interface{}) int {
+	var (
+		lines      = strings.Split(string(source), "\n")
+		start, end = 0, len(lines)
+		line       = -1
+	)
+
+	for _, elem := range path {
+		line = -1
+		indent, pos := -1, 0
+
+		for i := start; i < end && line < 0; i++ {
+			content := strings.TrimLeft(lines[i], " ")
+			if content == "" || content[0] == '#' {
+				continue
+			}
+
+			// The first line of the block defines the indentation of
+			// its elements
+			lineIndent := len(lines[i]) - len(content)
+			if indent < 0 {
+				indent = lineIndent
+			}
+			if lineIndent != indent {
+				continue
+			}
+
+			switch e := elem.(type) {
+			case string:
+				if strings.HasPrefix(content, e+":") || strings.HasPrefix(content, strconv.Quote(e)+":") {
+					line = i
+				}
+			case int:
+				if content == "-" || strings.HasPrefix(content, "- ") {
+					if pos == e {
+						line = i
+					}
+					pos++
+				}
+			}
+		}
+
+		if line < 0 {
+			return 0
+		}
+
+		_, isItem := elem.(int)
+		if isItem {
+			// The first key of the item is on the line of the dash
+			lines[line] = strings.Replace(lines[line], "-", " ", 1)
+			start = line
+		} else {
+			start = line + 1
+		}
+
+		// The block ends at the first line indented less than its
+		// elements. Sequences below keys may use the indentation of the
+		// key.
+		end = len(lines)
+		for i := line + 1; i < len(lines); i++ {
+			content := strings.TrimLeft(lines[i], " ")
+			if content == "" || content[0] == '#' {
+				continue
+			}
+
+			lineIndent := len(lines[i]) - len(content)
+			if lineIndent < indent || (lineIndent == indent && (isItem || !strings.HasPrefix(content, "-"))) {
+				end = i
+				break
+			}
+		}
+	}
+
+	return line + 1
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestYAMLPathLine(t *testing.T) {
+	source := []byte(`# Comment
+cookie:
+  domain: ".example.com"
+
+acl:
+  rule_sets:
+  - rules:
+    - field: "host"
+      equals: "a.example.com"
+  - allow: ["@admins"]
+    rules:
+      - field: "host"
+        equals: "b.example.com"
+      - field: "x-origin-uri"
+providers:
+  "simple":
+    users: {}
+`)
+
+	for _, tc := range []struct {
+		path []interface{}
+		line int
+	}{
+		{[]interface{}{"cookie"}, 2},
+		{[]interface{}{"cookie", "domain"}, 3},
+		{[]interface{}{"acl", "rule_sets", 0}, 7},
+		{[]interface{}{"acl", "rule_sets", 0, "rules", 0, "equals"}, 9},
+		{[]interface{}{"acl", "rule_sets", 1, "rules", 1}, 14},
+		{[]interface{}{"acl", "rule_sets", 2}, 0},
+		{[]interface{}{"providers", "simple"}, 16},
+		{[]interface{}{"domain"}, 0},
+	} {
+		if line := yamlPathLine(source, tc.path); line != tc.line {
+			t.Errorf("Expected %s to be found on line %d, got %d", formatYAMLPath(tc.path), tc.line, line)
+		}
+	}
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-check-config")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer initializePATStore(patConfig{})
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(`cookie:
+  authentication_key: "Ff1uWJcLouKu9kwxgbnKcU3ps47gps72sxEz79TGHFCpJNCPtiZAFDisM4MWbstH"
+cors:
+  allowed_origins: ["*"]
+  allow_credentials: true
+acl:
+  rule_sets:
+  - rules:
+    - field: "x-origin-uri"
+      regexp: "^/api("
+    allow: ["@admins"]
+providers:
+  simple:
+    users: {}
+`), 0600); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+
+	problems, err := checkConfiguration(file)
+	if err != nil {
+		t.Fatalf("Unable to check configuration: %s", err)
+	}
+
+	if len(problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", problems)
+	}
+	if problems[0].Line != 3 || problems[0].Path != "cors" {
+		t.Errorf("Unexpected CORS problem %s", problems[0])
+	}
+	if problems[1].Line != 9 || problems[1].Path != "acl.rule_sets[0].rules[0]" {
+		t.Errorf("Unexpected ACL problem %s", problems[1])
+	}
+
+	if err := ioutil.WriteFile(file, []byte("acl:\n  default: [\n"), 0600); err != nil {
+		t.Fatalf("Unable to write config: %s", err)
+	}
+	if problems, _ := checkConfiguration(file); len(problems) != 1 || problems[0].Line == 0 {
+		t.Errorf("Expected syntax error with line, got %v", problems)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const (
+	genKeysTypeCookie      = "cookie"
+	genKeysTypeEd25519     = "ed25519"
+	genKeysTypePASETOLocal = "paseto-local"
+	genKeysTypeRSA         = "rsa"
+
+	genKeysCookieAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	genKeysCfg = struct {
+		Type    string
+		RSABits int
+		Output  string
+	}{}
+
+	genKeysSubcommand = subcommand{
+		Description: "Generate keys in the format expected by the configuration",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&genKeysCfg.Type, "type", genKeysTypeCookie, "Type of the key (cookie, ed25519, rsa, paseto-local)")
+			fs.IntVar(&genKeysCfg.RSABits, "rsa-bits", 2048, "Size of RSA keys")
+			fs.StringVarP(&genKeysCfg.Output, "output", "o", "", "File to write the key to (default: stdout)")
+		},
+		Run:        runGenKeys,
+		SkipConfig: true,
+	}
+)
+
+func runGenKeys() error {
+	key, err := generateKey(genKeysCfg.Type, genKeysCfg.RSABits)
+	if err != nil {
+		return err
+	}
+
+	if genKeysCfg.Output == "" {
+		_, err = os.Stdout.Write(key)
+		return err
+	}
+
+	return errors.Wrap(ioutil.WriteFile(genKeysCfg.Output, key, 0600), "Unable to write key")
+}
+
+// generateKey creates a key of the given type: cookie keys as entry of
+// the keys in the cookie section, ed25519 and rsa keys as PEM encoded private
+// keys usable as signing_keys and paseto-local keys as hex encoded key
+// file for the paseto.v4.local format
+func generateKey(keyType string, rsaBits int) ([]byte, error) {
+	switch keyType {
+	case genKeysTypeCookie:
+		authKey, err := randomAlphanumeric(cookieRotatedAuthKeyLength)
+		if err != nil {
+			return nil, err
+		}
+		encryptionKey, err := randomAlphanumeric(cookieRotatedEncryptionKeyLength)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("cookie:\n  keys:\n    - authentication_key: %q\n      encryption_key: %q\n", authKey, encryptionKey)), nil
+
+	case genKeysTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to generate key")
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to encode key")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+
+	case genKeysTypeRSA:
+		if rsaBits < 2048 {
+			return nil, errors.New("RSA keys need at least 2048 bits")
+		}
+		key, err := rsa.GenerateKey(rand.Reader, rsaBits)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to generate key")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+
+	case genKeysTypePASETOLocal:
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrap(err, "Unable to generate key")
+		}
+		return []byte(hex.EncodeToString(key) + "\n"), nil
+
+	default:
+		return nil, errors.Errorf("Unsupported key type %q", keyType)
+	}
+}
+
+func randomAlphanumeric(length int) (string, error) {
+	max := big.NewInt(int64(len(genKeysCookieAlphabet)))
+
+	out := make([]byte, length)
+	for i := range out {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "Unable to generate key")
+		}
+		out[i] = genKeysCookieAlphabet[n.Int64()]
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+var (
+	hashPasswordCfg = struct {
+		Algorithm string
+		Cost      int
+	}{}
+
+	hashPasswordSubcommand = subcommand{
+		Description: "Read a password from stdin and print its hash for the simple provider",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&hashPasswordCfg.Algorithm, "algorithm", passwordHashBcrypt, "Hash algorithm to use (bcrypt, argon2id)")
+			fs.IntVar(&hashPasswordCfg.Cost, "cost", bcrypt.DefaultCost, "Cost of bcrypt hashes")
+		},
+		Run:        runHashPassword,
+		SkipConfig: true,
+	}
+)
+
+func runHashPassword() error {
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		return errors.New("Password must not be empty")
+	}
+
+	hash, err := hashPassword(hashPasswordCfg.Algorithm, password, hashPasswordCfg.Cost)
+	if err != nil {
+		return errors.Wrap(err, "Unable to hash password")
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+// readPassword prompts for the password twice on a terminal and reads
+// the first line of stdin otherwise
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.Wrap(err, "Unable to read password")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to read password")
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to read password")
+	}
+
+	if string(password) != string(repeated) {
+		return "", errors.New("Passwords do not match")
+	}
+
+	return string(password), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+var (
+	migrateConfigCfg = struct {
+		Write bool
+	}{}
+
+	migrateConfigSubcommand = subcommand{
+		Description: "Upgrade the configuration file to the current schema version",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.BoolVarP(&migrateConfigCfg.Write, "write", "w", false, "Replace the file instead of printing the migrated configuration (the previous file is kept as .bak)")
+		},
+		Run:        runMigrateConfig,
+		SkipConfig: true,
+	}
+)
+
+// runMigrateConfig migrates the file as it is: References to environment
+// variables and secrets are not expanded to keep them out of the result
+func runMigrateConfig() error {
+	if stat, err := os.Stat(cfg.ConfigFile); err == nil && stat.IsDir() {
+		return errors.New("Configuration directories need to be migrated file by file, pass the files using --config")
+	}
+
+	source, err := ioutil.ReadFile(cfg.ConfigFile)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read configuration file")
+	}
+
+	if isSOPSDocument(source) {
+		return errors.New("Files encrypted by sops can't be migrated, decrypt the file before")
+	}
+
+	out, version, applied, err := migrateConfig(source)
+	if err != nil {
+		return err
+	}
+
+	if version == currentConfigVersion {
+		fmt.Fprintf(os.Stderr, "%s: Configuration already uses version %d\n", cfg.ConfigFile, currentConfigVersion)
+		if !migrateConfigCfg.Write {
+			_, err = os.Stdout.Write(out)
+		}
+		return err
+	}
+
+	for _, m := range applied {
+		fmt.Fprintf(os.Stderr, "%s: Applied migration to version %s\n", cfg.ConfigFile, m)
+	}
+
+	if !migrateConfigCfg.Write {
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	stat, err := os.Stat(cfg.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(cfg.ConfigFile+".bak", source, stat.Mode()); err != nil {
+		return errors.Wrap(err, "Unable to write backup")
+	}
+	return errors.Wrap(ioutil.WriteFile(cfg.ConfigFile, out, stat.Mode()), "Unable to write configuration file")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+var (
+	whoamiCfg = struct {
+		Cookie string
+		Host   string
+	}{}
+
+	whoamiSubcommand = subcommand{
+		Description: "Decode the session cookies of a Cookie header and print their content",
+		Flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&whoamiCfg.Cookie, "cookie", "", "Content of the Cookie header (name=value; name2=value2)")
+			fs.StringVar(&whoamiCfg.Host, "host", "", "Host the cookies were sent to (selects cookie overrides and realms)")
+		},
+		Run: runWhoami,
+	}
+)
+
+func runWhoami() error {
+	if whoamiCfg.Cookie == "" {
+		return errors.New("No cookie given, use --cookie")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/auth", nil)
+	if err != nil {
+		return fmt.Errorf("Unable to create request: %s", err)
+	}
+	req.Header.Set("Cookie", whoamiCfg.Cookie)
+	if whoamiCfg.Host != "" {
+		req.Header.Set("X-Host", whoamiCfg.Host)
+	}
+
+	found := false
+	for _, s := range inspectSessionCookies(req) {
+		found = true
+		fmt.Printf("Provider %s (cookie %s):\n", s.Provider, s.Cookie)
+		if s.Err != nil {
+			fmt.Printf("  Unable to decode: %s\n", s.Err)
+			continue
+		}
+		for _, l := range s.Values {
+			fmt.Printf("  %s\n", l)
+		}
+	}
+
+	if !found {
+		return errors.New("No session cookie of the configured providers found")
+	}
+	return nil
+}
+
+type inspectedSessionCookie struct {
+	Provider string
+	Cookie   string
+	Values   []string
+	Err      error
+}
+
+// inspectSessionCookies decodes the session cookies of all providers
+// present in the request
+func inspectSessionCookies(r *http.Request) []inspectedSessionCookie {
+	out := []inspectedSessionCookie{}
+	for _, a := range requestAuthenticators(r) {
+		name := getMainConfig().GetCookieName(r, a.AuthenticatorID())
+		if _, err := r.Cookie(name); err != nil {
+			continue
+		}
+
+		s := inspectedSessionCookie{Provider: a.AuthenticatorID(), Cookie: name}
+
+		sess, err := cookieStore.New(r, name)
+		if err != nil {
+			s.Err = err
+			out = append(out, s)
+			continue
+		}
+
+		for k, v := range sess.Values {
+			if created, ok := v.(int64); ok && k == "created" {
+				v = fmt.Sprintf("%d (%s)", created, time.Unix(created, 0).UTC().Format(time.RFC3339))
+			}
+			s.Values = append(s.Values, fmt.Sprintf("%v: %v", k, v))
+		}
+
+		sort.Strings(s.Values)
+
+		if sid, ok := sess.Values["sid"].(string); ok {
+			s.Values = append(s.Values, "tracked session: "+inspectTrackedSession(sid))
+		}
+		out = append(out, s)
+	}
+
+	return out
+}
+
+func inspectTrackedSession(sid string) string {
+	store := getSessionStore()
+	if store == nil {
+		return "session tracking is disabled"
+	}
+
+	info, err := store.Get(sid)
+	switch err {
+	case nil:
+		return fmt.Sprintf("active, last seen %s", info.LastSeen.UTC().Format(time.RFC3339))
+	case errSessionNotFound:
+		return "revoked or expired"
+	default:
+		return fmt.Sprintf("unable to fetch: %s", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	systemdSelfCheckTimeout = 5 * time.Second
+	systemdReadyRetry       = time.Second
+)
+
+// systemdNotify sends the state to the service manager. Without the
+// NOTIFY_SOCKET (not started by systemd using Type=notify) nothing is
+// sent.
+func systemdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(socket, "@") {
+		// Abstract socket namespace
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "Unable to connect to notify socket")
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return errors.Wrap(err, "Unable to send notification")
+}
+
+// systemdWatchdogInterval returns the interval to ping the watchdog in
+// (half of WatchdogSec= as recommended by systemd) or zero if the
+// watchdog is not enabled for this process
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchSystemd reports the service to be ready once the self-check
+// passed for the first time and afterwards pings the watchdog as long
+// as the self-check passes. If the listener wedges the pings stop and
+// systemd restarts the service after WatchdogSec=.
+func watchSystemd(check func() error) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	for {
+		err := check()
+		if err == nil {
+			break
+		}
+		log.WithError(err).Debug("Self-check failed, delaying readiness notification")
+		time.Sleep(systemdReadyRetry)
+	}
+
+	if err := systemdNotify("READY=1"); err != nil {
+		log.WithError(err).Error("Unable to notify systemd about readiness")
+	}
+
+	interval := systemdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		if isShuttingDown() {
+			// Shutdown is bound by the stop timeout of systemd
+			return
+		}
+
+		if err := check(); err != nil {
+			log.WithError(err).Error("Self-check failed, skipping watchdog ping")
+			continue
+		}
+
+		if err := systemdNotify("WATCHDOG=1"); err != nil {
+			log.WithError(err).Error("Unable to ping systemd watchdog")
+		}
+	}
+}
+
+// listenerSelfCheck requests the health check through the listener to
+// ensure connections are still accepted and handled
+func listenerSelfCheck(addr net.Addr, useTLS, proxyProtocol bool) func() error {
+	client := &http.Client{
+		Timeout: systemdSelfCheckTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, addr.Network(), addr.String())
+				if err != nil || !proxyProtocol {
+					return conn, err
+				}
+
+				// The connection is not proxied, the listener uses its own address
+				if _, err := conn.Write([]byte("PROXY UNKNOWN\r\n")); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return conn, nil
+			},
+			DisableKeepAlives: true,
+			// Only the own listener is contacted
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+
+	return func() error {
+		resp, err := client.Get(scheme + "://nginx-sso/healthz")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("Health check responded with status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsso-notify")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := systemdNotify("READY=1"); err != nil {
+		t.Fatalf("Unable to notify: %s", err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected READY=1, got %q (%v)", buf[:n], err)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if i := systemdWatchdogInterval(); i != 15*time.Second {
+		t.Errorf("Expected watchdog interval of 15s, got %s", i)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if i := systemdWatchdogInterval(); i != 0 {
+		t.Errorf("Expected watchdog of other process to be ignored, got %s", i)
+	}
+}
+
+func TestListenerSelfCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+
+	go http.Serve(proxyProtocolListener{l}, http.HandlerFunc(handleHealthzRequest))
+
+	if err := listenerSelfCheck(l.Addr(), false, true)(); err != nil {
+		t.Errorf("Expected self-check to pass: %s", err)
+	}
+
+	l.Close()
+	if err := listenerSelfCheck(l.Addr(), false, true)(); err == nil {
+		t.Error("Expected self-check of closed listener to fail")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/pkg/errors"
+)
+
+const (
+	termsPath      = "/terms"
+	termsKeyPrefix = "nginx-sso:terms:"
+)
+
+var (
+	termsStores     = map[string]termsStore{}
+	termsStoresLock sync.Mutex
+)
+
+// termsConfig requires the users to accept a versioned terms document
+// after their login. Changing the version asks all users again.
+type termsConfig struct {
+	Version string `yaml:"version"`
+	Title   string `yaml:"title"`
+	File    string `yaml:"file"`
+	URL     string `yaml:"url"`
+	Store   string `yaml:"store"`
+
+	content string
+}
+
+// termsAcceptance is recorded when a user accepts the terms
+type termsAcceptance struct {
+	Version  string    `json:"version"`
+	Accepted time.Time `json:"accepted"`
+}
+
+// Enabled returns whether a version of the terms is configured
+func (t termsConfig) Enabled() bool { return t.Version != "" }
+
+// Load checks the configuration and reads the document
+func (t *termsConfig) Load() error {
+	if !t.Enabled() {
+		return nil
+	}
+
+	if t.File == "" && t.URL == "" {
+		return errors.New("Either file or url of the document needs to be set")
+	}
+
+	if t.URL != "" {
+		if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("URL of the document needs to be an absolute http or https URL")
+		}
+	}
+
+	if t.File != "" {
+		content, err := ioutil.ReadFile(t.File)
+		if err != nil {
+			return errors.Wrap(err, "Unable to read document")
+		}
+		t.content = string(content)
+	}
+
+	if t.Store == "" {
+		return errors.New("Store to record the acceptances in is required")
+	}
+	if isRedisURI(t.Store) {
+		if _, err := parseRedisURI(t.Store); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t termsConfig) title() string {
+	if t.Title == "" {
+		return "Terms of service"
+	}
+	return t.Title
+}
+
+// accepted looks up whether the user accepted the current version. If
+// the store is not available the terms are treated as accepted to not
+// lock out all users.
+func (t termsConfig) accepted(r *http.Request, user string) bool {
+	store, err := getTermsStore(t.Store)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to access terms store")
+		return true
+	}
+
+	a, err := store.Get(normalizeLockoutUser(user))
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to read terms acceptance")
+		return true
+	}
+
+	return a.Version == t.Version
+}
+
+// Accepted returns whether the user detected from the request accepted
+// the terms. Only users logged in through a session are asked to accept
+// them, requests using tokens or basic auth are not blocked.
+func (t termsConfig) Accepted(r *http.Request, user string) bool {
+	if !t.Enabled() {
+		return true
+	}
+
+	if m, ok := getSessionMeta(r); !ok || m.Provider == "" {
+		return true
+	}
+
+	return t.accepted(r, user)
+}
+
+// Redirect returns the terms page if the user who just logged in needs
+// to accept the terms before being sent to the target
+func (t termsConfig) Redirect(r *http.Request, user, target string) string {
+	if !t.Enabled() || t.accepted(r, user) {
+		return target
+	}
+	return termsPath + "?go=" + url.QueryEscape(target)
+}
+
+// handleTermsRequest shows the terms to the logged in user and records
+// the acceptance on POST before sending the user on to the go target
+func handleTermsRequest(res http.ResponseWriter, r *http.Request) {
+	cfg := getMainConfig().Terms
+	if !cfg.Enabled() {
+		http.NotFound(res, r)
+		return
+	}
+
+	if !validateRedirect(res, r) {
+		return
+	}
+	target := r.FormValue("go")
+
+	user, _, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// Show the terms below
+
+	case errors.Is(err, errNoUser):
+		http.Redirect(res, r, "/login?go="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		store, err := getTermsStore(cfg.Store)
+		if err == nil {
+			err = store.Set(normalizeLockoutUser(user), termsAcceptance{Version: cfg.Version, Accepted: time.Now().UTC()})
+		}
+		if err != nil {
+			requestLog(r).WithError(err).Error("Unable to record terms acceptance")
+			http.Error(res, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		getMainConfig().AuditLog.Log(auditEventTermsAccepted, r, map[string]string{
+			"username": user,
+			"version":  cfg.Version,
+		})
+		http.Redirect(res, r, target, http.StatusFound)
+		return
+	}
+
+	tpl := pongo2.Must(getMainConfig().Frontend.Template("terms.html"))
+	body, err := tpl.ExecuteBytes(pongo2.Context{
+		"branding":   getMainConfig().Frontend.Branding(),
+		"content":    cfg.content,
+		"csp_nonce":  cspNonce(r),
+		"csrf_token": getMainConfig().CSRF.Token(res, r),
+		"go":         target,
+		"login":      getMainConfig().Login,
+		"title":      cfg.title(),
+		"url":        cfg.URL,
+		"user":       user,
+		"version":    cfg.Version,
+	})
+	if err != nil {
+		requestLog(r).WithError(err).Error("Unable to render template")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.Write(body)
+}
+
+type termsStore interface {
+	// Get returns the acceptance of the user or an empty acceptance if
+	// the user never accepted the terms
+	Get(user string) (termsAcceptance, error)
+
+	// Set records the acceptance of the user
+	Set(user string, a termsAcceptance) error
+}
+
+func getTermsStore(store string) (termsStore, error) {
+	termsStoresLock.Lock()
+	defer termsStoresLock.Unlock()
+
+	if s, ok := termsStores[store]; ok {
+		return s, nil
+	}
+
+	var s termsStore
+	if isRedisURI(store) {
+		c, err := getRedisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		s = redisTermsStore{c}
+	} else {
+		f, err := loadFileTermsStore(store)
+		if err != nil {
+			return nil, err
+		}
+		s = f
+	}
+
+	termsStores[store] = s
+	return s, nil
+}
+
+// fileTermsStore keeps the acceptances in a JSON file which is read once
+type fileTermsStore struct {
+	path        string
+	acceptances map[string]termsAcceptance
+
+	lock sync.RWMutex
+}
+
+func loadFileTermsStore(path string) (*fileTermsStore, error) {
+	f := &fileTermsStore{path: path, acceptances: map[string]termsAcceptance{}}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		// Nobody accepted the terms yet
+	case err != nil:
+		return nil, errors.Wrap(err, "Unable to read terms store")
+	default:
+		if err := json.Unmarshal(data, &f.acceptances); err != nil {
+			return nil, errors.Wrap(err, "Unable to parse terms store")
+		}
+	}
+
+	return f, nil
+}
+
+func (f *fileTermsStore) Get(user string) (termsAcceptance, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.acceptances[user], nil
+}
+
+func (f *fileTermsStore) Set(user string, a termsAcceptance) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	prev, existed := f.acceptances[user]
+	f.acceptances[user] = a
+
+	data, err := json.MarshalIndent(f.acceptances, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(f.path, data)
+	}
+	if err != nil {
+		if existed {
+			f.acceptances[user] = prev
+		} else {
+			delete(f.acceptances, user)
+		}
+		return errors.Wrap(err, "Unable to save terms store")
+	}
+
+	return nil
+}
+
+// redisTermsStore shares the acceptances between all instances using
+// the same Redis, the keys do not expire
+type redisTermsStore struct {
+	client *redisClient
+}
+
+func (r redisTermsStore) Get(user string) (termsAcceptance, error) {
+	a := termsAcceptance{}
+
+	reply, err := r.client.Do("GET", termsKeyPrefix+user)
+	if err != nil || reply == nil {
+		return a, err
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return a, errors.Errorf("Unexpected reply %v", reply)
+	}
+
+	return a, errors.Wrap(json.Unmarshal([]byte(data), &a), "Unable to decode acceptance")
+}
+
+func (r redisTermsStore) Set(user string, a termsAcceptance) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Do("SET", termsKeyPrefix+user, string(data))
+	return err
+}
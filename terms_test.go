@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTermsAcceptance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx-sso-terms")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	document := filepath.Join(dir, "terms.html")
+	ioutil.WriteFile(document, []byte("<p>Be nice.</p>"), 0644)
+
+	for name, cfg := range map[string]termsConfig{
+		"no document":  {Version: "1", Store: filepath.Join(dir, "terms.json")},
+		"no store":     {Version: "1", File: document},
+		"missing file": {Version: "1", File: filepath.Join(dir, "missing.html"), Store: filepath.Join(dir, "terms.json")},
+		"relative url": {Version: "1", URL: "/terms.html", Store: filepath.Join(dir, "terms.json")},
+	} {
+		if err := cfg.Load(); err == nil {
+			t.Errorf("Expected config with %s to be rejected", name)
+		}
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	prevAuthenticators, prevFrontend, prevTerms := getAuthenticatorSnapshot(), getMainConfig().Frontend, getMainConfig().Terms
+	defer func() {
+		getMainConfig().Frontend, getMainConfig().Terms = prevFrontend, prevTerms
+		authenticatorState.Store(prevAuthenticators)
+	}()
+	setAuthenticators([]authenticator{&authSimple{EnableBasicAuth: true, Users: map[string]string{"alice": string(hash)}}})
+
+	getMainConfig().Frontend = frontendConfig{}
+	if err := getMainConfig().Frontend.Load(); err != nil {
+		t.Fatalf("Unable to load frontend: %s", err)
+	}
+	getMainConfig().Terms = termsConfig{Version: "2026-01", File: document, Store: filepath.Join(dir, "terms.json")}
+	if err := getMainConfig().Terms.Load(); err != nil {
+		t.Fatalf("Unable to load terms: %s", err)
+	}
+
+	// Only users logged in through a session are asked
+	session := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	setSessionMeta(session, sessionMeta{Provider: "simple"})
+	if getMainConfig().Terms.Accepted(session, "alice") {
+		t.Error("Expected terms not to be accepted yet")
+	}
+	if !getMainConfig().Terms.Accepted(httptest.NewRequest(http.MethodGet, "/auth", nil), "alice") {
+		t.Error("Expected requests without session not to be blocked")
+	}
+	if target := getMainConfig().Terms.Redirect(session, "alice", "https://app.example.com/"); target != "/terms?go=https%3A%2F%2Fapp.example.com%2F" {
+		t.Errorf("Expected redirect to the terms, got %s", target)
+	}
+
+	res := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, termsPath, nil)
+	r.SetBasicAuth("alice", "secret")
+	handleTermsRequest(res, r)
+	if !strings.Contains(res.Body.String(), "<p>Be nice.</p>") {
+		t.Errorf("Expected document to be shown, got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, termsPath, strings.NewReader(url.Values{"go": {"/sessions"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("alice", "secret")
+	handleTermsRequest(res, r)
+	if res.Code != http.StatusFound || res.Header().Get("Location") != "/sessions" {
+		t.Fatalf("Expected redirect to the target after accepting, got %d %s", res.Code, res.Header().Get("Location"))
+	}
+
+	if !getMainConfig().Terms.Accepted(session, "Alice") {
+		t.Error("Expected terms to be accepted")
+	}
+
+	// A new version needs to be accepted again
+	getMainConfig().Terms.Version = "2026-02"
+	if getMainConfig().Terms.Accepted(session, "alice") {
+		t.Error("Expected new version not to be accepted")
+	}
+
+	stored, err := loadFileTermsStore(getMainConfig().Terms.Store)
+	if err != nil {
+		t.Fatalf("Unable to load terms store: %s", err)
+	}
+	if a, _ := stored.Get("alice"); a.Version != "2026-01" || a.Accepted.IsZero() {
+		t.Errorf("Expected acceptance to be persisted, got %#v", a)
+	}
+}
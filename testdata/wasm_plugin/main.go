@@ -0,0 +1,164 @@
+// Command wasm_plugin is an authenticator compiled to WebAssembly used
+// by TestWASMPlugin. Build it using:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o plugin.wasm
+package main
+
+import (
+	"strings"
+	"unsafe"
+)
+
+const (
+	statusOK = iota
+	statusNoUser
+	statusWrongCredentials
+	statusMFARequired
+	statusUnavailable
+	statusUnconfigured
+	statusError
+)
+
+const info = `{"id": "wasm", "login_fields": [
+	{"label": "Username", "name": "username", "type": "text"},
+	{"label": "Password", "name": "password", "type": "password"}
+]}`
+
+var (
+	password string
+	// buffers keeps the memory passed to the host from being collected
+	buffers = map[unsafe.Pointer][]byte{}
+)
+
+//go:wasmimport nginx_sso request_header
+func requestHeader(name unsafe.Pointer, nameLen uint32, buf unsafe.Pointer, capacity uint32) int32
+
+//go:wasmimport nginx_sso request_cookie
+func requestCookie(name unsafe.Pointer, nameLen uint32, buf unsafe.Pointer, capacity uint32) int32
+
+//go:wasmimport nginx_sso request_form_value
+func requestFormValue(name unsafe.Pointer, nameLen uint32, buf unsafe.Pointer, capacity uint32) int32
+
+//go:wasmimport nginx_sso add_response_header
+func addResponseHeader(name unsafe.Pointer, nameLen uint32, value unsafe.Pointer, valueLen uint32)
+
+//go:wasmimport nginx_sso set_info
+func setInfo(ptr unsafe.Pointer, size uint32)
+
+//go:wasmimport nginx_sso set_user
+func setUser(ptr unsafe.Pointer, size uint32)
+
+//go:wasmimport nginx_sso add_group
+func addGroup(ptr unsafe.Pointer, size uint32)
+
+//go:wasmimport nginx_sso set_message
+func setMessage(ptr unsafe.Pointer, size uint32)
+
+func ptr(s string) (unsafe.Pointer, uint32) {
+	if s == "" {
+		return nil, 0
+	}
+	b := []byte(s)
+	return unsafe.Pointer(&b[0]), uint32(len(b))
+}
+
+func lookup(fn func(unsafe.Pointer, uint32, unsafe.Pointer, uint32) int32, name string) (string, bool) {
+	buf := make([]byte, 64)
+	np, nl := ptr(name)
+	for {
+		n := fn(np, nl, unsafe.Pointer(&buf[0]), uint32(len(buf)))
+		if n < 0 {
+			return "", false
+		}
+		if int(n) <= len(buf) {
+			return string(buf[:n]), true
+		}
+		buf = make([]byte, n)
+	}
+}
+
+func call(fn func(unsafe.Pointer, uint32), s string) { fn(ptr(s)) }
+
+//go:wasmexport nginx_sso_abi_version
+func abiVersion() uint32 { return 1 }
+
+//go:wasmexport nginx_sso_malloc
+func malloc(size uint32) unsafe.Pointer {
+	buf := make([]byte, size+1)
+	p := unsafe.Pointer(&buf[0])
+	buffers[p] = buf
+	return p
+}
+
+//go:wasmexport nginx_sso_info
+func getInfo() uint32 {
+	call(setInfo, info)
+	return statusOK
+}
+
+//go:wasmexport nginx_sso_configure
+func configure(p unsafe.Pointer, size uint32) uint32 {
+	config := string(buffers[p][:size])
+	delete(buffers, p)
+
+	idx := strings.Index(config, "wasm:")
+	if idx < 0 {
+		return statusUnconfigured
+	}
+	rest := config[idx:]
+	if i := strings.Index(rest, "password: "); i >= 0 {
+		password = strings.TrimSpace(strings.SplitN(rest[i+len("password: "):], "\n", 2)[0])
+	}
+	if password == "" {
+		call(setMessage, "password is required")
+		return statusError
+	}
+	return statusOK
+}
+
+//go:wasmexport nginx_sso_detect_user
+func detectUser() uint32 {
+	if _, ok := lookup(requestHeader, "X-Hang"); ok {
+		for {
+		}
+	}
+
+	user, ok := lookup(requestCookie, "wasm-user")
+	if !ok || user == "" {
+		return statusNoUser
+	}
+	call(setUser, user)
+	call(addGroup, "wasm-users")
+	return statusOK
+}
+
+//go:wasmexport nginx_sso_login
+func login() uint32 {
+	user, _ := lookup(requestFormValue, "wasm-username")
+	pass, _ := lookup(requestFormValue, "wasm-password")
+	switch {
+	case user == "":
+		return statusNoUser
+	case pass == "unavailable":
+		return statusUnavailable
+	case pass != password:
+		call(setMessage, "error_invalid_credentials")
+		return statusWrongCredentials
+	}
+
+	np, nl := ptr("Set-Cookie")
+	vp, vl := ptr("wasm-user=" + user + "; Path=/")
+	addResponseHeader(np, nl, vp, vl)
+	call(setUser, user)
+	return statusOK
+}
+
+//go:wasmexport nginx_sso_logout
+func logout() uint32 {
+	np, nl := ptr("Set-Cookie")
+	vp, vl := ptr("wasm-user=; Path=/; Max-Age=0")
+	addResponseHeader(np, nl, vp, vl)
+	return statusOK
+}
+
+func main() {}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const tlsCertificateCheckInterval = 10 * time.Second
+
+// tlsCertificateReloader serves the certificate from the given files and
+// reloads it when the files are changed (for example by an ACME client
+// renewing the certificate)
+type tlsCertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+func newTLSCertificateReloader(certFile, keyFile string) (*tlsCertificateReloader, error) {
+	t := &tlsCertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tlsCertificateReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{t.certFile, t.keyFile} {
+		stat, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate if the files were modified since the
+// last load. Must be called with the lock held or before the reloader
+// is used.
+func (t *tlsCertificateReloader) reload() error {
+	t.lastCheck = time.Now()
+
+	modTime, err := t.filesModTime()
+	if err != nil {
+		return errors.Wrap(err, "Unable to access TLS certificate")
+	}
+
+	if t.cert != nil && !modTime.After(t.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "Unable to load TLS certificate")
+	}
+
+	t.cert = &cert
+	t.modTime = modTime
+	log.WithField("cert_file", t.certFile).Debug("Loaded TLS certificate")
+
+	return nil
+}
+
+func (t *tlsCertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if time.Since(t.lastCheck) > tlsCertificateCheckInterval {
+		if err := t.reload(); err != nil {
+			log.WithError(err).Error("Unable to reload TLS certificate, keeping previous version")
+		}
+	}
+
+	return t.cert, nil
+}
+
+// mainListenConfig adds the HTTP redirect to the main listener
+type mainListenConfig struct {
+	listenConfig       `yaml:",inline"`
+	httpRedirectConfig `yaml:",inline"`
+}
+
+func (m mainListenConfig) Validate() error {
+	if err := m.listenConfig.Validate(); err != nil {
+		return err
+	}
+	return m.httpRedirectConfig.Validate(m.listenConfig)
+}
+
+// httpRedirectConfig configures the plain HTTP listener redirecting to
+// the TLS listener and serving ACME HTTP-01 challenges
+type httpRedirectConfig struct {
+	HTTPRedirectPort int    `yaml:"http_redirect_port"`
+	ACMEWebroot      string `yaml:"acme_webroot"`
+}
+
+func (h httpRedirectConfig) Validate(l listenConfig) error {
+	if h.HTTPRedirectPort == 0 {
+		if h.ACMEWebroot != "" {
+			return fmt.Errorf("ACME webroot requires the HTTP redirect listener")
+		}
+		return nil
+	}
+
+	if l.TLSCertFile == "" {
+		return fmt.Errorf("HTTP redirect requires TLS to be configured")
+	}
+
+	if l.Socket != "" {
+		return fmt.Errorf("HTTP redirect is not supported on unix sockets")
+	}
+
+	return nil
+}
+
+// Handler redirects all requests to the TLS listener except requests
+// for ACME challenges which are served from the webroot
+func (h httpRedirectConfig) Handler(tlsPort int) http.Handler {
+	var challenges http.Handler
+	if h.ACMEWebroot != "" {
+		challenges = http.FileServer(http.Dir(h.ACMEWebroot))
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if challenges != nil && strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			challenges.ServeHTTP(res, r)
+			return
+		}
+
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+
+		http.Redirect(res, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
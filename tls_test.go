@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHTTPRedirectHandler(t *testing.T) {
+	webroot, err := ioutil.TempDir("", "nginx-sso-acme")
+	if err != nil {
+		t.Fatalf("Unable to create webroot: %s", err)
+	}
+	defer os.RemoveAll(webroot)
+
+	challengeDir := path.Join(webroot, ".well-known", "acme-challenge")
+	if err := os.MkdirAll(challengeDir, 0755); err != nil {
+		t.Fatalf("Unable to create challenge dir: %s", err)
+	}
+	if err := ioutil.WriteFile(path.Join(challengeDir, "token"), []byte("token.thumbprint"), 0644); err != nil {
+		t.Fatalf("Unable to write challenge: %s", err)
+	}
+
+	for _, tc := range []struct {
+		tlsPort int
+		url     string
+		expCode int
+		expLoc  string
+		expBody string
+	}{
+		{443, "http://login.example.com/login?go=x", http.StatusMovedPermanently, "https://login.example.com/login?go=x", ""},
+		{8443, "http://login.example.com:8080/", http.StatusMovedPermanently, "https://login.example.com:8443/", ""},
+		{443, "http://login.example.com/.well-known/acme-challenge/token", http.StatusOK, "", "token.thumbprint"},
+	} {
+		h := httpRedirectConfig{HTTPRedirectPort: 80, ACMEWebroot: webroot}.Handler(tc.tlsPort)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+		if rec.Code != tc.expCode {
+			t.Errorf("%s: Expected status %d, got %d", tc.url, tc.expCode, rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != tc.expLoc {
+			t.Errorf("%s: Expected location %q, got %q", tc.url, tc.expLoc, loc)
+		}
+		if tc.expBody != "" && rec.Body.String() != tc.expBody {
+			t.Errorf("%s: Expected body %q, got %q", tc.url, tc.expBody, rec.Body.String())
+		}
+	}
+}
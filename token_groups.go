@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+const (
+	tokenGroupSourceClaim         = "claim"
+	tokenGroupSourceGroupProvider = "group_provider"
+	tokenGroupSourceGroups        = "groups"
+	tokenGroupSourceStatic        = "static"
+)
+
+// tokenGroupsConfig builds the groups embedded into the issued tokens
+// (identity assertion, OIDC and upstream tokens) from multiple sources
+// to give the applications a consistent group namespace
+type tokenGroupsConfig struct {
+	Sources         []tokenGroupSource `yaml:"sources"`
+	IncludePrefixes []string           `yaml:"include_prefixes"`
+	StripPrefix     bool               `yaml:"strip_prefix"`
+}
+
+type tokenGroupSource struct {
+	Type string `yaml:"type"`
+	// Prefix is prepended to all groups of the source
+	Prefix string `yaml:"prefix"`
+
+	// Claim and Separator configure the claim source
+	Claim     string `yaml:"claim"`
+	Separator string `yaml:"separator"`
+
+	// Provider is the ID of the group provider to query
+	Provider string `yaml:"provider"`
+
+	// Mapping assigns groups to users and groups prefixed with an @
+	Mapping map[string][]string `yaml:"mapping"`
+}
+
+func (t tokenGroupsConfig) Validate() error {
+	for n, s := range t.Sources {
+		switch s.Type {
+		case tokenGroupSourceGroups:
+		case tokenGroupSourceClaim:
+			if s.Claim == "" {
+				return fmt.Errorf("Group source on position %d needs a claim", n+1)
+			}
+		case tokenGroupSourceGroupProvider:
+			if s.Provider == "" {
+				return fmt.Errorf("Group source on position %d needs a provider", n+1)
+			}
+		case tokenGroupSourceStatic:
+			if len(s.Mapping) == 0 {
+				return fmt.Errorf("Group source on position %d needs a mapping", n+1)
+			}
+		default:
+			return fmt.Errorf("Group source on position %d has unknown type %q", n+1, s.Type)
+		}
+	}
+
+	return nil
+}
+
+// Resolve collects the groups of all sources, deduplicates them and
+// applies the prefix filter. The user is the user detected by the
+// provider, groups are the groups as forwarded to the applications.
+// Without sources the groups are used unchanged.
+func (t tokenGroupsConfig) Resolve(r *http.Request, user string, groups []string) ([]string, error) {
+	sources := t.Sources
+	if len(sources) == 0 {
+		sources = []tokenGroupSource{{Type: tokenGroupSourceGroups}}
+	}
+
+	m, _ := getSessionMeta(r)
+
+	result := []string{}
+	add := func(prefix string, list []string) {
+		for _, g := range list {
+			g = strings.TrimSpace(g)
+			if g == "" {
+				continue
+			}
+			g = prefix + g
+
+			if len(t.IncludePrefixes) > 0 {
+				p, ok := matchingPrefix(g, t.IncludePrefixes)
+				if !ok {
+					continue
+				}
+				if t.StripPrefix {
+					g = strings.TrimPrefix(g, p)
+				}
+			}
+
+			if g != "" && !str.StringInSlice(g, result) {
+				result = append(result, g)
+			}
+		}
+	}
+
+	for _, s := range sources {
+		switch s.Type {
+		case tokenGroupSourceGroups:
+			add(s.Prefix, groups)
+
+		case tokenGroupSourceClaim:
+			sep := s.Separator
+			if sep == "" {
+				sep = ","
+			}
+			if v := m.Claims[s.Claim]; v != "" {
+				add(s.Prefix, strings.Split(v, sep))
+			}
+
+		case tokenGroupSourceGroupProvider:
+			extra, err := getUserGroupsFromProvider(s.Provider, user, m.Provider)
+			if err != nil {
+				return nil, err
+			}
+			add(s.Prefix, extra)
+
+		case tokenGroupSourceStatic:
+			// Sorted to keep the order of the groups stable
+			static := []string{}
+			for group, members := range s.Mapping {
+				if staticGroupMatches(members, user, groups) {
+					static = append(static, group)
+				}
+			}
+			sort.Strings(static)
+			add(s.Prefix, static)
+		}
+	}
+
+	return result, nil
+}
+
+func matchingPrefix(group string, prefixes []string) (string, bool) {
+	for _, p := range prefixes {
+		if strings.HasPrefix(group, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// staticGroupMatches checks the members list containing users and
+// groups prefixed with an @ like the ACL
+func staticGroupMatches(members []string, user string, groups []string) bool {
+	if str.StringInSlice(user, members) {
+		return true
+	}
+
+	for _, g := range groups {
+		if str.StringInSlice("@"+g, members) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getUserGroupsFromProvider queries a single active group provider
+func getUserGroupsFromProvider(id, user, authenticatorID string) ([]string, error) {
+	groupProviderRegistryMutex.RLock()
+	defer groupProviderRegistryMutex.RUnlock()
+
+	for _, g := range activeGroupProviders {
+		if g.GroupProviderID() != id {
+			continue
+		}
+
+		groups, err := g.GetUserGroups(user, authenticatorID)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve groups using %q: %s", id, err)
+		}
+		return groups, nil
+	}
+
+	return nil, fmt.Errorf("Group provider %q is not configured", id)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testGroupProvider map[string][]string
+
+func (t testGroupProvider) GroupProviderID() string           { return "test" }
+func (t testGroupProvider) Configure(yamlSource []byte) error { return nil }
+func (t testGroupProvider) GetUserGroups(user, authenticatorID string) ([]string, error) {
+	return t[user], nil
+}
+
+func TestTokenGroups(t *testing.T) {
+	groupProviderRegistryMutex.Lock()
+	prev := activeGroupProviders
+	activeGroupProviders = []groupProvider{testGroupProvider{"alice": {"devs", "ops"}}}
+	groupProviderRegistryMutex.Unlock()
+	defer func() {
+		groupProviderRegistryMutex.Lock()
+		activeGroupProviders = prev
+		groupProviderRegistryMutex.Unlock()
+	}()
+
+	c := tokenGroupsConfig{
+		Sources: []tokenGroupSource{
+			{Type: tokenGroupSourceGroups, Prefix: "sso:"},
+			{Type: tokenGroupSourceClaim, Claim: "roles", Prefix: "sso:"},
+			{Type: tokenGroupSourceGroupProvider, Provider: "test", Prefix: "ldap:"},
+			{Type: tokenGroupSourceStatic, Prefix: "sso:", Mapping: map[string][]string{
+				"deployers": {"@admins"},
+				"auditors":  {"bob"},
+			}},
+		},
+		IncludePrefixes: []string{"sso:"},
+		StripPrefix:     true,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Unable to validate config: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	setSessionClaims(r, map[string]string{"roles": "admins, editors"})
+	defer clearSessionMeta(r)
+
+	groups, err := c.Resolve(r, "alice", []string{"admins"})
+	if err != nil {
+		t.Fatalf("Unable to resolve groups: %s", err)
+	}
+
+	expect := []string{"admins", "editors", "deployers"}
+	if len(groups) != len(expect) {
+		t.Fatalf("Expected groups %v, got %v", expect, groups)
+	}
+	for i := range expect {
+		if groups[i] != expect[i] {
+			t.Errorf("Expected groups %v, got %v", expect, groups)
+			break
+		}
+	}
+
+	c.IncludePrefixes, c.StripPrefix = nil, false
+	if groups, _ = c.Resolve(r, "alice", []string{"admins"}); len(groups) != 5 || groups[2] != "ldap:devs" {
+		t.Errorf("Expected unfiltered groups with prefixes, got %v", groups)
+	}
+}
+
+func TestTokenGroupsDefaults(t *testing.T) {
+	groups, err := tokenGroupsConfig{}.Resolve(httptest.NewRequest(http.MethodGet, "/auth", nil), "alice", []string{"admins", "admins"})
+	if err != nil || len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("Expected deduplicated groups, got %v (%v)", groups, err)
+	}
+
+	if err := (tokenGroupsConfig{Sources: []tokenGroupSource{{Type: "unknown"}}}).Validate(); err == nil {
+		t.Error("Expected unknown source type to be rejected")
+	}
+}
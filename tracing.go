@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathRand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/pkg/errors"
+)
+
+// Minimal OpenTelemetry tracing: Spans are created for the /auth and
+// /login requests and the work done by the authenticators and exported
+// in batches using OTLP/HTTP with JSON encoding. The trace context is
+// taken from the W3C traceparent header passed by the proxy.
+
+const (
+	traceparentHeader     = "traceparent"
+	tracingBatchSize      = 100
+	tracingExportTimeout  = 10 * time.Second
+	tracingOTLPTracesPath = "/v1/traces"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+var (
+	// traceExporters keeps the export queues by their endpoint to keep
+	// buffered spans on reloads
+	traceExporters     = map[string]*deliveryQueue{}
+	traceExportersLock sync.Mutex
+
+	traceExportClient = &http.Client{Timeout: tracingExportTimeout}
+)
+
+type tracingConfig struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	SampleRate  float64           `yaml:"sample_rate"`
+	ServiceName string            `yaml:"service_name"`
+}
+
+// Validate checks the endpoint and the sample rate, tracing is disabled
+// without endpoint
+func (t tracingConfig) Validate() error {
+	if t.Endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(t.Endpoint)
+	if err != nil {
+		return errors.Wrap(err, "Unable to parse endpoint")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Endpoint needs to be a http(s) URL")
+	}
+
+	if t.SampleRate < 0 || t.SampleRate > 1 {
+		return errors.New("Sample rate needs to be between 0 and 1")
+	}
+
+	return nil
+}
+
+// span is a single timed operation of a trace. All methods are safe to
+// call on nil spans which are returned if tracing is disabled or the
+// trace is not sampled.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]interface{}
+	err        error
+
+	parent *span
+	r      *http.Request
+}
+
+// withTracing creates the server span for the request, continuing the
+// trace passed in the traceparent header
+func withTracing(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, r *http.Request) {
+		s := startServerSpan(r, name)
+		if s == nil {
+			h(res, r)
+			return
+		}
+
+		rec := &metricsStatusRecorder{ResponseWriter: res}
+		h(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			s.SetError(errors.Errorf("Request failed with status %d", rec.status))
+		}
+		s.End()
+	}
+}
+
+func startServerSpan(r *http.Request, name string) *span {
+	if getMainConfig().Tracing.Endpoint == "" {
+		return nil
+	}
+
+	s := &span{name: name, kind: spanKindServer, start: time.Now(), r: r}
+
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		if getMainConfig().Tracing.SampleRate < 1 && mathRand.Float64() >= getMainConfig().Tracing.SampleRate {
+			return nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	s.SetAttribute("http.request.method", r.Method)
+	s.SetAttribute("url.path", r.URL.Path)
+	if id := getRequestID(r); id != "" {
+		s.SetAttribute("request_id", id)
+	}
+
+	context.Set(r, traceSpanContextKey, s)
+	return s
+}
+
+// startSpan creates a child of the current span of the request which
+// becomes the current span until it is ended
+func startSpan(r *http.Request, name string) *span {
+	parent := currentSpan(r)
+	if parent == nil {
+		return nil
+	}
+
+	s := &span{
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    time.Now(),
+		parent:   parent,
+		r:        r,
+	}
+	rand.Read(s.spanID[:])
+
+	context.Set(r, traceSpanContextKey, s)
+	return s
+}
+
+// startClientSpan creates a child span for a call to the given upstream
+// server
+func startClientSpan(r *http.Request, name, server string) *span {
+	s := startSpan(r, name)
+	if s != nil {
+		s.kind = spanKindClient
+		s.SetAttribute("server.address", server)
+	}
+	return s
+}
+
+func currentSpan(r *http.Request) *span {
+	s, _ := context.Get(r, traceSpanContextKey).(*span)
+	return s
+}
+
+// getTraceID returns the ID of the trace the request is part of or an
+// empty string if it is not traced
+func getTraceID(r *http.Request) string {
+	if s := currentSpan(r); s != nil {
+		return hex.EncodeToString(s.traceID[:])
+	}
+	return ""
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = map[string]interface{}{}
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed, nil errors are ignored
+func (s *span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err
+}
+
+// endAuthentication ends the span of an authenticator call
+func (s *span) endAuthentication(authenticatorID string, err error) {
+	s.SetAttribute("authenticator", authenticatorID)
+	s.SetAttribute("user.found", err == nil)
+	s.Finish(err)
+}
+
+// Finish records the error and ends the span. errNoUser is not
+// treated as failure as it is the expected result for requests without
+// (valid) credentials.
+func (s *span) Finish(err error) {
+	if !errors.Is(err, errNoUser) {
+		s.SetError(err)
+	}
+	s.End()
+}
+
+// End finishes the span, restores its parent as current span and
+// queues it for export
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+
+	end := time.Now()
+	context.Set(s.r, traceSpanContextKey, s.parent)
+
+	data, err := json.Marshal(s.otlp(end))
+	if err == nil {
+		err = getTraceExporter(getMainConfig().Tracing.Endpoint).Write(data)
+	}
+	if err != nil {
+		requestLog(s.r).WithError(err).Debug("Unable to export span")
+	}
+}
+
+func (s *span) otlp(end time.Time) otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.attributes),
+		Status:            otlpStatus{Code: spanStatusOK},
+	}
+
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+	}
+
+	return o
+}
+
+// parseTraceparent reads a W3C traceparent header in the format
+// 00-<trace-id>-<parent-id>-<flags>
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return traceID, parentID, false, false
+	}
+
+	if len(parts[1]) != 2*len(traceID) || len(parts[2]) != 2*len(parentID) {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+func getTraceExporter(endpoint string) *deliveryQueue {
+	traceExportersLock.Lock()
+	defer traceExportersLock.Unlock()
+
+	if q, ok := traceExporters[endpoint]; ok {
+		return q
+	}
+
+	q := newDeliveryQueue("tracing", tracingBatchSize, otlpExporter{
+		url: strings.TrimRight(endpoint, "/") + tracingOTLPTracesPath,
+	}.Deliver)
+	traceExporters[endpoint] = q
+	return q
+}
+
+// otlpExporter posts batches of spans to an OTLP/HTTP collector
+type otlpExporter struct {
+	url string
+}
+
+func (o otlpExporter) Deliver(spans [][]byte) error {
+	serviceName := getMainConfig().Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "nginx-sso"
+	}
+
+	raw := make([]json.RawMessage, len(spans))
+	for i := range spans {
+		raw[i] = spans[i]
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "nginx-sso", "version": version},
+				"spans": raw,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nginx-sso/"+version)
+	for k, v := range getMainConfig().Tracing.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := traceExportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("Collector responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// otlpAttributes encodes the attributes, integers are passed as strings
+// as required by the JSON mapping of OTLP
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	keys := []string{}
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := []otlpAttribute{}
+	for _, k := range keys {
+		var value map[string]interface{}
+		switch v := attrs[k].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttribute{Key: k, Value: value})
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+func TestTracingExport(t *testing.T) {
+	received := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Tenant") != "sso" {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					received <- s
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	getMainConfig().Tracing = tracingConfig{
+		Endpoint:   srv.URL,
+		Headers:    map[string]string{"X-Tenant": "sso"},
+		SampleRate: 1,
+	}
+	defer func() { getMainConfig().Tracing = tracingConfig{} }()
+
+	if err := getMainConfig().Tracing.Validate(); err != nil {
+		t.Fatalf("Unable to validate tracing config: %s", err)
+	}
+
+	h := withTracing("auth", func(res http.ResponseWriter, r *http.Request) {
+		s := startClientSpan(r, "ldap check_login", "ldap://ldap.example.com")
+		s.Finish(errNoUser)
+		res.WriteHeader(http.StatusUnauthorized)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	defer context.Clear(r)
+	h(httptest.NewRecorder(), r)
+
+	spans := map[string]map[string]interface{}{}
+	for len(spans) < 2 {
+		select {
+		case s := <-received:
+			spans[s["name"].(string)] = s
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Spans were not exported, got %v", spans)
+		}
+	}
+
+	server, client := spans["auth"], spans["ldap check_login"]
+	if server["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || server["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("Server span does not continue the trace: %v", server)
+	}
+	if client["traceId"] != server["traceId"] || client["parentSpanId"] != server["spanId"] {
+		t.Errorf("Client span is not a child of the server span: %v", client)
+	}
+	if status := client["status"].(map[string]interface{}); status["code"].(float64) != spanStatusOK {
+		t.Errorf("Expected missing user not to be an error, got status %v", status)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for header, valid := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-ext": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ext": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e47360-00f067aa0ba902b7-01":    false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01":     false,
+		"": false,
+	} {
+		if _, _, _, ok := parseTraceparent(header); ok != valid {
+			t.Errorf("Expected validity of %q to be %v", header, valid)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type userInfo struct {
+	User      string            `json:"user"`
+	Groups    []string          `json:"groups"`
+	Provider  string            `json:"provider"`
+	MFA       bool              `json:"mfa"`
+	LoginTime *time.Time        `json:"login_time"`
+	Expires   *time.Time        `json:"expires"`
+	Claims    map[string]string `json:"claims"`
+}
+
+func handleUserInfoRequest(res http.ResponseWriter, r *http.Request) {
+	user, groups, err := detectUser(res, r)
+	switch {
+	case err == nil:
+		// User detected, continue below
+
+	case errors.Is(err, errNoUser):
+		http.Error(res, "No valid user found", http.StatusUnauthorized)
+		return
+
+	default:
+		requestLog(r).WithError(err).Error("Error while detecting user")
+		http.Error(res, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	m, _ := getSessionMeta(r)
+
+	info := userInfo{
+		User:     user,
+		Groups:   groups,
+		Provider: m.Provider,
+		MFA:      m.MFA,
+		Claims:   m.Claims,
+	}
+
+	if info.Groups == nil {
+		info.Groups = []string{}
+	}
+	if info.Claims == nil {
+		info.Claims = map[string]string{}
+	}
+
+	if !m.LoginTime.IsZero() {
+		// Cookie based session: The cookie is renewed on every request
+		// so it expires after its lifetime from now on
+		loginTime := m.LoginTime.UTC()
+		info.LoginTime = &loginTime
+
+		if maxAge := getMainConfig().GetSessionOpts(r, m.Provider).MaxAge; maxAge > 0 {
+			expires := time.Now().UTC().Add(time.Duration(maxAge) * time.Second).Truncate(time.Second)
+			info.Expires = &expires
+		}
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(res).Encode(info); err != nil {
+		requestLog(r).WithError(err).Error("Unable to encode user info")
+	}
+}
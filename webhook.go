@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Luzifer/go_helpers/str"
+)
+
+const (
+	defaultWebhookMaxAttempts  = 5
+	defaultWebhookRetryBackoff = time.Second
+	webhookMaxRetryBackoff     = time.Minute
+
+	webhookSignatureHeader = "X-Nginx-SSO-Signature"
+	webhookTimestampHeader = "X-Nginx-SSO-Timestamp"
+)
+
+var (
+	// webhookQueues keeps the queues by the configuration of the webhook
+	// to not lose pending deliveries on reloads not changing it
+	webhookQueues     = map[string]*deliveryQueue{}
+	webhookQueuesLock sync.Mutex
+)
+
+// webhookConfig sends the audit events listed in events to the URL as
+// soon as they happen, independent of the audit log configuration
+type webhookConfig struct {
+	URL          string            `yaml:"url"`
+	Events       []string          `yaml:"events"`
+	Secret       string            `yaml:"secret"`
+	Headers      map[string]string `yaml:"headers"`
+	MaxAttempts  int               `yaml:"max_attempts"`
+	RetryBackoff time.Duration     `yaml:"retry_backoff"`
+	// HTTPTransport names the transport used to deliver the events
+	HTTPTransport string `yaml:"http_transport"`
+}
+
+type webhooksConfig []webhookConfig
+
+func (w webhooksConfig) Validate() error {
+	for i, hook := range w {
+		if err := hook.Validate(); err != nil {
+			return errors.Wrapf(err, "Webhook #%d is invalid", i+1)
+		}
+	}
+	return nil
+}
+
+// Subscribed returns the webhooks to send the event to
+func (w webhooksConfig) Subscribed(event auditEvent) webhooksConfig {
+	var out webhooksConfig
+	for _, hook := range w {
+		if str.StringInSlice(string(event), hook.Events) {
+			out = append(out, hook)
+		}
+	}
+	return out
+}
+
+// Fire queues the event for delivery to all webhooks, a full queue
+// must not prevent the event from reaching the others
+func (w webhooksConfig) Fire(line []byte) error {
+	var errs []string
+	for _, hook := range w {
+		if err := hook.queue().Write(line); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (w webhookConfig) Validate() error {
+	u, err := url.Parse(w.URL)
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "Unable to parse URL")
+	case u.Scheme != "http" && u.Scheme != "https":
+		return errors.New("URL needs to use http or https")
+	case u.Host == "":
+		return errors.New("URL needs a host")
+	case len(w.Events) == 0:
+		return errors.New("No events configured")
+	case w.MaxAttempts < 0:
+		return errors.New("Max attempts must not be negative")
+	case w.RetryBackoff < 0:
+		return errors.New("Retry backoff must not be negative")
+	}
+
+	for _, event := range w.Events {
+		if _, ok := auditEventCategories[auditEvent(event)]; !ok {
+			return errors.Errorf("Event %q is unknown", event)
+		}
+	}
+
+	return nil
+}
+
+func (w webhookConfig) queue() *deliveryQueue {
+	key := fmt.Sprintf("%#v", w)
+
+	webhookQueuesLock.Lock()
+	defer webhookQueuesLock.Unlock()
+
+	if q, ok := webhookQueues[key]; ok {
+		return q
+	}
+
+	attempts := w.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultWebhookMaxAttempts
+	}
+
+	u, _ := url.Parse(w.URL) // Validated on load
+	q := newRetryingDeliveryQueue("webhook "+u.Redacted(), 1, attempts, w.backoff, w.Deliver)
+	webhookQueues[key] = q
+	return q
+}
+
+// backoff doubles the wait time after every failed attempt
+func (w webhookConfig) backoff(attempt int) time.Duration {
+	wait := w.RetryBackoff
+	if wait == 0 {
+		wait = defaultWebhookRetryBackoff
+	}
+
+	for i := 1; i < attempt && wait < webhookMaxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > webhookMaxRetryBackoff {
+		wait = webhookMaxRetryBackoff
+	}
+
+	return wait
+}
+
+// Deliver posts the events to the URL. If a secret is configured the
+// request is signed using a HMAC-SHA256 of the timestamp and the body.
+func (w webhookConfig) Deliver(events [][]byte) error {
+	for _, event := range events {
+		req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(event))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "nginx-sso/"+version)
+		for k, v := range w.Headers {
+			req.Header.Set(k, v)
+		}
+
+		if w.Secret != "" {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(webhookTimestampHeader, ts)
+			req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(w.Secret, ts, event))
+		}
+
+		client := &http.Client{Timeout: auditWebhookTimeout, Transport: namedHTTPTransport(w.HTTPTransport)}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return errors.Errorf("Webhook responded with status %d", resp.StatusCode)
+		}
+	}
+
+	return nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	var (
+		attempts = 0
+		received = make(chan *http.Request, 1)
+		body     []byte
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			// Fail the first attempt to trigger a retry
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ = ioutil.ReadAll(r.Body)
+		received <- r
+	}))
+	defer srv.Close()
+
+	prev := getMainConfig().Webhooks
+	defer func() { getMainConfig().Webhooks = prev }()
+
+	getMainConfig().Webhooks = webhooksConfig{{
+		URL:          srv.URL,
+		Events:       []string{string(auditEventLoginFailure)},
+		Secret:       "secret",
+		Headers:      map[string]string{"X-Source": "test"},
+		RetryBackoff: time.Millisecond,
+	}}
+	if err := getMainConfig().Webhooks.Validate(); err != nil {
+		t.Fatalf("Unable to validate webhooks: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	getMainConfig().AuditLog.Log(auditEventLogout, r, nil)
+	getMainConfig().AuditLog.Log(auditEventLoginFailure, r, map[string]string{"username": "eve"})
+
+	select {
+	case req := <-received:
+		ts := req.Header.Get(webhookTimestampHeader)
+		if sig := req.Header.Get(webhookSignatureHeader); sig != "sha256="+signWebhook("secret", ts, body) {
+			t.Errorf("Unexpected signature %q", sig)
+		}
+		if req.Header.Get("X-Source") != "test" {
+			t.Error("Expected configured header to be sent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not delivered")
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected delivery on second attempt, got %d attempts", attempts)
+	}
+
+	if w := (webhookConfig{RetryBackoff: 20 * time.Second}); w.backoff(1) != 20*time.Second || w.backoff(2) != 40*time.Second || w.backoff(5) != webhookMaxRetryBackoff {
+		t.Error("Expected backoff to double up to the maximum")
+	}
+
+	if err := (webhooksConfig{{URL: srv.URL, Events: []string{"login"}}}).Validate(); err == nil {
+		t.Error("Expected unknown event to be rejected")
+	}
+}